@@ -0,0 +1,35 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+type idempotencyTokenKey struct{}
+
+// NewIdempotencyToken returns a random token which identifies a single remote execution.
+func NewIdempotencyToken() string {
+	var b [16]byte
+	// Reading from crypto/rand does not fail on supported platforms.
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// WithIdempotencyToken returns a context which carries the idempotency token of a remote execution.
+// The context is passed to the Exec method of queries created by remote engines, and the token stays
+// the same when the execution is retried, so that leaf engines and caching proxies can deduplicate
+// retried requests instead of evaluating and accounting for them more than once.
+func WithIdempotencyToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, idempotencyTokenKey{}, token)
+}
+
+// IdempotencyTokenFromContext returns the idempotency token of the remote execution
+// which the context belongs to, if there is one.
+func IdempotencyTokenFromContext(ctx context.Context) (string, bool) {
+	token, ok := ctx.Value(idempotencyTokenKey{}).(string)
+	return token, ok
+}
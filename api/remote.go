@@ -18,9 +18,60 @@ type RemoteEngine interface {
 	MaxT() int64
 	MinT() int64
 	LabelSets() []labels.Labels
+	Capabilities() Capabilities
 	NewRangeQuery(opts *promql.QueryOpts, qs string, start, end time.Time, interval time.Duration) (promql.Query, error)
 }
 
+// DataRangeReporter is implemented by remote queries which report the time range of the data
+// held by the remote engine when the query was executed. It is used for detecting engines
+// which advertised a stale time range when the query was planned.
+type DataRangeReporter interface {
+	// DataRange returns the min and max time of the data the query was executed against.
+	DataRange() (mint, maxt int64)
+}
+
+// TimeoutProvider is implemented by remote engines which have a timeout of their own, which
+// overrides the remote engine timeout of the distributed engine. Queries of the engine which
+// do not complete within the timeout are abandoned, and the distributed query proceeds
+// without the results of the engine.
+type TimeoutProvider interface {
+	// Timeout returns the timeout of queries of the engine. Zero means that the engine has no timeout of its own.
+	Timeout() time.Duration
+}
+
+// Capabilities describe which PromQL constructs a remote engine is able to evaluate.
+// Expressions which a remote engine cannot evaluate are not pushed down to it.
+type Capabilities struct {
+	// Functions are the names of functions supported by the engine.
+	// A nil set means that all functions are supported.
+	Functions map[string]struct{}
+	// XFunctions is true when the engine supports the xrate, xincrease, xdelta and xsmoothincrease functions.
+	XFunctions bool
+	// ExperimentalFunctions is true when the engine supports experimental functions such as mad_over_time.
+	ExperimentalFunctions bool
+	// NativeHistograms is true when the engine supports functions over native histograms.
+	NativeHistograms bool
+	// PlanProtocolVersion is the version of the query plan protocol supported by the engine.
+	// Version 0 means that the engine only accepts queries as PromQL strings.
+	PlanProtocolVersion int
+	// ExternalLabels is true when the engine attaches its external labels to all series it returns.
+	// Results of such engines are not deduplicated if their external label sets are disjoint.
+	ExternalLabels bool
+}
+
+// PlanProtocolPartialAggregates is the plan protocol version from which engines can return
+// partial aggregates that are combined into exact avg, stddev and stdvar aggregations.
+const PlanProtocolPartialAggregates = 1
+
+// SupportsFunction returns true if the function with the given name is in the supported set.
+func (c Capabilities) SupportsFunction(name string) bool {
+	if c.Functions == nil {
+		return true
+	}
+	_, ok := c.Functions[name]
+	return ok
+}
+
 type staticEndpoints struct {
 	engines []RemoteEngine
 }
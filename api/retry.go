@@ -0,0 +1,51 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package api
+
+import (
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// TransientError is implemented by errors of remote queries which can succeed when the query is
+// executed again, for example because a connection was lost or a replica was briefly unavailable.
+type TransientError interface {
+	Transient() bool
+}
+
+type transientError struct {
+	error
+}
+
+func (e transientError) Transient() bool { return true }
+
+func (e transientError) Unwrap() error { return e.error }
+
+// NewTransientError marks the error of a remote query as transient, so that the query is retried.
+func NewTransientError(err error) error {
+	return transientError{error: err}
+}
+
+// IsTransient returns true if a remote query which failed with the error can succeed when it is retried.
+// Errors are transient if they implement TransientError, or if they are network or storage errors.
+// Other errors, such as errors evaluating the query, fail again when the query is retried.
+func IsTransient(err error) bool {
+	var transient TransientError
+	if errors.As(err, &transient) {
+		return transient.Transient()
+	}
+	var (
+		netErr     net.Error
+		storageErr promql.ErrStorage
+	)
+	return errors.As(err, &netErr) ||
+		errors.As(err, &storageErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED)
+}
@@ -0,0 +1,51 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package api
+
+import (
+	"context"
+
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// StreamingQuery is implemented by remote queries which can return their result incrementally.
+// The results of such queries are consumed in batches of steps instead of being buffered in full
+// before they are deduplicated and merged with the results of other engines.
+type StreamingQuery interface {
+	promql.Query
+
+	// Stream executes the query and returns a stream over its result.
+	// The series of the result have to be known when the stream is returned.
+	Stream(ctx context.Context) (ResultStream, error)
+}
+
+// ResultStream iterates over the result of a streaming query in batches of consecutive steps.
+type ResultStream interface {
+	// Series returns the series of the result. Samples refer to series by their index.
+	Series() []labels.Labels
+
+	// Next returns the next batch of steps in increasing order of time, or nil once all steps were returned.
+	// Steps without samples can be omitted. The returned steps are not used after the following call to Next.
+	Next(ctx context.Context) ([]StepSamples, error)
+
+	// Warnings returns the warnings of the query. It is called once all steps were returned.
+	Warnings() storage.Warnings
+
+	// Close releases the resources of the stream.
+	Close()
+}
+
+// StepSamples are the samples of a streamed result at a single step.
+type StepSamples struct {
+	T int64
+
+	SampleIDs []uint64
+	Samples   []float64
+
+	HistogramIDs []uint64
+	Histograms   []*histogram.FloatHistogram
+}
@@ -0,0 +1,32 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine
+
+import (
+	"context"
+	"time"
+)
+
+// CheckpointSink receives checkpoints from range queries. A checkpoint is the timestamp
+// of the last step which was fully evaluated by the query. Long-running evaluations, such
+// as backfills, can persist checkpoints and resume an interrupted query by issuing a new
+// range query which starts one step after the last checkpoint. Results of steps are only
+// checkpointed once they are part of the result of the query: a query which fails after
+// a checkpoint returns the results of all steps up to the last checkpoint with its error.
+type CheckpointSink interface {
+	Checkpoint(ts time.Time)
+}
+
+type checkpointSinkKey struct{}
+
+// WithCheckpointSink returns a context which makes range queries executed with it
+// emit a checkpoint to the sink after each evaluated batch of steps.
+func WithCheckpointSink(ctx context.Context, sink CheckpointSink) context.Context {
+	return context.WithValue(ctx, checkpointSinkKey{}, sink)
+}
+
+func checkpointSinkFromContext(ctx context.Context) CheckpointSink {
+	sink, _ := ctx.Value(checkpointSinkKey{}).(CheckpointSink)
+	return sink
+}
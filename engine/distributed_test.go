@@ -7,16 +7,22 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/efficientgo/core/errors"
 	"github.com/efficientgo/core/testutil"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
 
 	"github.com/thanos-community/promql-engine/api"
 	"github.com/thanos-community/promql-engine/engine"
 	"github.com/thanos-community/promql-engine/logicalplan"
+	"github.com/thanos-community/promql-engine/query"
 )
 
 type partition struct {
@@ -75,6 +81,10 @@ func TestDistributedAggregations(t *testing.T) {
 		return []string{labels.MetricName, name, "zone", zone, "pod", pod}
 	}
 
+	makeBucket := func(zone, pod, le string) []string {
+		return []string{labels.MetricName, "bar_bucket", "zone", zone, "pod", pod, "le", le}
+	}
+
 	tests := []struct {
 		name        string
 		seriesSets  []partition
@@ -87,7 +97,7 @@ func TestDistributedAggregations(t *testing.T) {
 				{
 					extLset: []labels.Labels{labels.FromStrings("zone", "east-1")},
 					series: []*mockSeries{
-						newMockSeries(makeSeries("east-1", "nginx-1"), []int64{30, 60, 90, 120}, []float64{2, 3, 4, 5}),
+						newMockSeries([]string{labels.MetricName, "bar", "zone", "east-1", "pod", "nginx-1"}, []int64{30, 60, 90, 120}, []float64{2, 3, 4, 5}),
 						newMockSeries(makeSeries("east-1", "nginx-2"), []int64{30, 60, 90, 120}, []float64{3, 4, 5, 6}),
 					},
 				},
@@ -97,7 +107,7 @@ func TestDistributedAggregations(t *testing.T) {
 						labels.FromStrings("zone", "west-2"),
 					},
 					series: []*mockSeries{
-						newMockSeries(makeSeries("west-1", "nginx-1"), []int64{30, 60, 90, 120}, []float64{4, 5, 6, 7}),
+						newMockSeries([]string{labels.MetricName, "bar", "zone", "west-1", "pod", "nginx-1"}, []int64{30, 60, 90, 120}, []float64{4, 5, 6, 7}),
 						newMockSeries(makeSeries("west-1", "nginx-2"), []int64{30, 60, 90, 120}, []float64{5, 6, 7, 8}),
 						newMockSeries(makeSeries("west-2", "nginx-1"), []int64{30, 60, 90, 120}, []float64{6, 7, 8, 9}),
 					},
@@ -110,7 +120,7 @@ func TestDistributedAggregations(t *testing.T) {
 					labels.FromStrings("zone", "west-2"),
 				},
 				series: []*mockSeries{
-					newMockSeries(makeSeries("east-1", "nginx-1"), []int64{30, 60}, []float64{2, 3}),
+					newMockSeries([]string{labels.MetricName, "bar", "zone", "east-1", "pod", "nginx-1"}, []int64{30, 60}, []float64{2, 3}),
 					newMockSeries(makeSeries("west-1", "nginx-2"), []int64{30, 60}, []float64{5, 6}),
 					newMockSeries(makeSeries("west-2", "nginx-1"), []int64{30, 60}, []float64{6, 7}),
 				},
@@ -123,7 +133,7 @@ func TestDistributedAggregations(t *testing.T) {
 				{
 					extLset: []labels.Labels{labels.FromStrings("zone", "east-1")},
 					series: []*mockSeries{
-						newMockSeries(makeSeries("east-1", "nginx-1"), []int64{60, 90, 120}, []float64{3, 4, 5}),
+						newMockSeries([]string{labels.MetricName, "bar", "zone", "east-1", "pod", "nginx-1"}, []int64{60, 90, 120}, []float64{3, 4, 5}),
 						newMockSeries(makeSeries("east-2", "nginx-1"), []int64{30, 60, 90, 120}, []float64{3, 4, 5, 6}),
 					},
 				},
@@ -131,7 +141,7 @@ func TestDistributedAggregations(t *testing.T) {
 			timeOverlap: partition{
 				extLset: []labels.Labels{labels.FromStrings("zone", "east-1"), labels.FromStrings("zone", "west-1")},
 				series: []*mockSeries{
-					newMockSeries(makeSeries("east-1", "nginx-1"), []int64{30, 60}, []float64{2, 3}),
+					newMockSeries([]string{labels.MetricName, "bar", "zone", "east-1", "pod", "nginx-1"}, []int64{30, 60}, []float64{2, 3}),
 					newMockSeries(makeSeries("east-2", "nginx-1"), []int64{30, 60}, []float64{3, 4}),
 				},
 			},
@@ -148,6 +158,27 @@ func TestDistributedAggregations(t *testing.T) {
 			},
 			rangeEnd: time.Unix(15000, 0),
 		},
+		{
+			name: "histogram buckets",
+			seriesSets: []partition{
+				{
+					extLset: []labels.Labels{labels.FromStrings("zone", "east-1")},
+					series: []*mockSeries{
+						newMockSeries(makeBucket("east-1", "nginx-1", "0.1"), []int64{30, 60, 90, 120}, []float64{1, 2, 3, 4}),
+						newMockSeries(makeBucket("east-1", "nginx-1", "1"), []int64{30, 60, 90, 120}, []float64{2, 4, 6, 8}),
+						newMockSeries(makeBucket("east-1", "nginx-1", "+Inf"), []int64{30, 60, 90, 120}, []float64{3, 6, 9, 12}),
+					},
+				},
+				{
+					extLset: []labels.Labels{labels.FromStrings("zone", "west-1")},
+					series: []*mockSeries{
+						newMockSeries(makeBucket("west-1", "nginx-1", "0.1"), []int64{30, 60, 90, 120}, []float64{0, 1, 1, 2}),
+						newMockSeries(makeBucket("west-1", "nginx-1", "1"), []int64{30, 60, 90, 120}, []float64{4, 5, 8, 9}),
+						newMockSeries(makeBucket("west-1", "nginx-1", "+Inf"), []int64{30, 60, 90, 120}, []float64{5, 7, 10, 12}),
+					},
+				},
+			},
+		},
 		{
 			name: "count by __name__ label",
 			seriesSets: []partition{
@@ -173,6 +204,11 @@ func TestDistributedAggregations(t *testing.T) {
 	}{
 		{name: "sum", query: `sum by (pod) (bar)`},
 		{name: "avg", query: `avg by (pod) (bar)`},
+		{name: "avg without", query: `avg without (pod) (bar)`},
+		{name: "avg of binary expression with constant operand", query: `avg by (region) (bar * 60)`},
+		{name: "stddev", query: `stddev by (pod) (bar)`},
+		{name: "stdvar", query: `stdvar by (region) (bar)`},
+		{name: "stddev without", query: `stddev without (pod) (bar)`},
 		{name: "count", query: `count by (pod) (bar)`},
 		{name: "count by __name__", query: `count by (__name__) ({__name__=~".+"})`},
 		{name: "group", query: `group by (pod) (bar)`},
@@ -188,11 +224,22 @@ func TestDistributedAggregations(t *testing.T) {
 		{name: "binary expression with constant operand", query: `sum by (region) (bar * 60)`},
 		{name: "binary aggregation", query: `sum by (region) (bar) / sum by (pod) (bar)`},
 		{name: "filtered selector interaction", query: `sum by (region) (bar{region="east"}) / sum by (region) (bar)`},
-		{name: "unsupported aggregation", query: `count_values("pod", bar)`, expectFallback: true},
+		{name: "count_values", query: `count_values("pod", bar)`},
+		{name: "count_values by", query: `count_values by (region) ("value", bar)`},
+		{name: "histogram_quantile", query: `histogram_quantile(0.9, sum by (le) (bar_bucket))`},
+		{name: "histogram_quantile with grouping", query: `histogram_quantile(0.5, sum by (pod, le) (bar_bucket))`},
+		{name: "histogram_quantile without", query: `histogram_quantile(0.5, sum without (zone) (bar_bucket))`},
 		{name: "absent_over_time for non-existing metric", query: `absent_over_time(foo[2m])`},
 		{name: "absent_over_time for existing metric", query: `absent_over_time(bar{pod="nginx-1"}[2m])`},
 		{name: "absent for non-existing metric", query: `absent(foo)`},
 		{name: "absent for existing metric", query: `absent(bar{pod="nginx-1"})`},
+		{name: "subquery", query: `max_over_time(rate(bar[1m])[2m:30s])`},
+		// Aggregations are only engine-local for engines with external labels, so subqueries
+		// over partitions without external labels fall back to central evaluation.
+		{name: "subquery with engine-local aggregation", query: `max_over_time(sum by (pod, zone) (bar)[2m:30s])`, expectFallback: true},
+		{name: "aggregation of subquery", query: `max by (pod) (min_over_time(sum by (pod, zone) (bar * 2)[1m:15s] offset 30s))`, expectFallback: true},
+		{name: "nested subqueries", query: `max_over_time(max_over_time(bar[1m:30s])[2m:1m])`},
+		{name: "subquery with aggregation across engines", query: `max_over_time(sum by (pod) (bar)[2m:30s])`, expectFallback: true},
 	}
 
 	optimizersOpts := map[string][]logicalplan.Optimizer{
@@ -300,3 +347,1091 @@ func TestDistributedAggregations(t *testing.T) {
 		}
 	}
 }
+
+func TestDistributedDedupPolicies(t *testing.T) {
+	series := []string{labels.MetricName, "bar", "zone", "east-1", "pod", "nginx-1"}
+	extLset := []labels.Labels{labels.FromStrings("zone", "east-1")}
+	older := partition{
+		extLset: extLset,
+		series: []*mockSeries{
+			newMockSeries(series, []int64{30, 60, 90, 120}, []float64{2, 7, 4, 5}),
+		},
+	}
+	newer := partition{
+		extLset: extLset,
+		series: []*mockSeries{
+			newMockSeries(series, []int64{60, 90, 120, 150, 180}, []float64{5, 4, 9, 10, 11}),
+		},
+	}
+
+	cases := []struct {
+		name      string
+		policy    query.DedupPolicy
+		tolerance float64
+		expected  []promql.FPoint
+		warnings  int
+	}{
+		{
+			name:     "prefer newest",
+			policy:   query.DedupPreferNewest,
+			expected: []promql.FPoint{{T: 60000, F: 5}, {T: 90000, F: 4}, {T: 120000, F: 9}},
+		},
+		{
+			name:     "prefer largest",
+			policy:   query.DedupPreferLargest,
+			expected: []promql.FPoint{{T: 60000, F: 7}, {T: 90000, F: 4}, {T: 120000, F: 9}},
+		},
+		{
+			name:     "average",
+			policy:   query.DedupAverage,
+			expected: []promql.FPoint{{T: 60000, F: 6}, {T: 90000, F: 4}, {T: 120000, F: 7}},
+		},
+		{
+			name:      "conflicts within tolerance",
+			policy:    query.DedupPreferNewest,
+			tolerance: 5,
+			expected:  []promql.FPoint{{T: 60000, F: 5}, {T: 90000, F: 4}, {T: 120000, F: 9}},
+		},
+		{
+			name:      "conflicts above tolerance",
+			policy:    query.DedupPreferNewest,
+			tolerance: 1,
+			expected:  []promql.FPoint{{T: 60000, F: 5}, {T: 90000, F: 4}, {T: 120000, F: 9}},
+			warnings:  1,
+		},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			opts := engine.Opts{
+				EngineOpts: promql.EngineOpts{
+					Timeout:    1 * time.Hour,
+					MaxSamples: 1e10,
+				},
+				DisableFallback:        true,
+				DedupPolicy:            tcase.policy,
+				DedupConflictTolerance: tcase.tolerance,
+			}
+			remoteEngines := []api.RemoteEngine{
+				engine.NewRemoteEngine(opts, storageWithMockSeries(older.series...), older.mint(), older.maxt(), older.extLset),
+				engine.NewRemoteEngine(opts, storageWithMockSeries(newer.series...), newer.mint(), newer.maxt(), newer.extLset),
+			}
+			distEngine := engine.NewDistributedEngine(opts, api.NewStaticEndpoints(remoteEngines))
+
+			qry, err := distEngine.NewRangeQuery(storageWithMockSeries(), nil, "bar", time.Unix(60, 0), time.Unix(120, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			result := qry.Exec(context.Background())
+			testutil.Ok(t, result.Err)
+
+			matrix, err := result.Matrix()
+			testutil.Ok(t, err)
+			testutil.Equals(t, 1, len(matrix))
+			testutil.Equals(t, tcase.expected, matrix[0].Floats)
+			testutil.Equals(t, tcase.warnings, len(result.Warnings))
+		})
+	}
+}
+
+func TestDistributedPenaltyDedup(t *testing.T) {
+	// newReplica creates a partition of an HA pair with a sample of the given value
+	// every 30s between from and to, except for the timestamps in gap.
+	newReplica := func(replica string, from, to int64, gap []int64, value float64) partition {
+		var (
+			timestamps []int64
+			values     []float64
+		)
+	samples:
+		for ts := from; ts <= to; ts += 30 {
+			for _, g := range gap {
+				if ts == g {
+					continue samples
+				}
+			}
+			timestamps = append(timestamps, ts)
+			values = append(values, value)
+		}
+		return partition{
+			extLset: []labels.Labels{labels.FromStrings("zone", "east-1")},
+			series: []*mockSeries{
+				newMockSeries([]string{labels.MetricName, "bar", "zone", "east-1", "pod", "nginx-1", "replica", replica}, timestamps, values),
+			},
+		}
+	}
+
+	cases := []struct {
+		name     string
+		policy   query.DedupPolicy
+		expected []float64
+	}{
+		{
+			name:     "prefer newest switches back after a gap",
+			policy:   query.DedupPreferNewest,
+			expected: []float64{1, 1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+		},
+		{
+			name:     "penalty keeps the replica selected after a gap",
+			policy:   query.DedupPenalty,
+			expected: []float64{1, 1, 1, 1, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1},
+		},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			// The newer replica has the highest MaxT, so it is preferred until it has a gap.
+			newer := newReplica("a", 30, 600, []int64{240, 270, 300}, 1)
+			older := newReplica("b", 0, 570, nil, 2)
+
+			opts := engine.Opts{
+				EngineOpts: promql.EngineOpts{
+					Timeout:       1 * time.Hour,
+					MaxSamples:    1e10,
+					LookbackDelta: 20 * time.Second,
+				},
+				DisableFallback:    true,
+				DedupPolicy:        tcase.policy,
+				DedupReplicaLabels: []string{"replica"},
+			}
+			remoteEngines := []api.RemoteEngine{
+				engine.NewRemoteEngine(opts, storageWithMockSeries(older.series...), older.mint(), older.maxt(), older.extLset),
+				engine.NewRemoteEngine(opts, storageWithMockSeries(newer.series...), newer.mint(), newer.maxt(), newer.extLset),
+			}
+			distEngine := engine.NewDistributedEngine(opts, api.NewStaticEndpoints(remoteEngines))
+
+			qry, err := distEngine.NewRangeQuery(storageWithMockSeries(), nil, "bar", time.Unix(30, 0), time.Unix(600, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer qry.Close()
+			result := qry.Exec(context.Background())
+			testutil.Ok(t, result.Err)
+
+			matrix, err := result.Matrix()
+			testutil.Ok(t, err)
+			testutil.Equals(t, 1, len(matrix))
+			testutil.Equals(t, labels.FromStrings(labels.MetricName, "bar", "zone", "east-1", "pod", "nginx-1"), matrix[0].Metric)
+
+			values := make([]float64, 0, len(matrix[0].Floats))
+			for _, p := range matrix[0].Floats {
+				values = append(values, p.F)
+			}
+			testutil.Equals(t, tcase.expected, values)
+		})
+	}
+}
+
+// externalLabelsEngine is a remote engine which attaches its external labels to its series.
+type externalLabelsEngine struct {
+	api.RemoteEngine
+}
+
+func (e externalLabelsEngine) Capabilities() api.Capabilities {
+	capabilities := e.RemoteEngine.Capabilities()
+	capabilities.ExternalLabels = true
+	return capabilities
+}
+
+func TestDistributedDisjointEngines(t *testing.T) {
+	east := partition{
+		extLset: []labels.Labels{labels.FromStrings("zone", "east-1")},
+		series: []*mockSeries{
+			newMockSeries([]string{labels.MetricName, "bar", "zone", "east-1", "pod", "nginx-1"}, []int64{30, 60, 90, 120}, []float64{1, 2, 3, 4}),
+			newMockSeries([]string{labels.MetricName, "bar", "zone", "east-1", "pod", "nginx-2"}, []int64{30, 60, 90, 120}, []float64{2, 4, 6, 8}),
+		},
+	}
+	west := partition{
+		extLset: []labels.Labels{labels.FromStrings("zone", "west-1")},
+		series: []*mockSeries{
+			newMockSeries([]string{labels.MetricName, "bar", "zone", "west-1", "pod", "nginx-1"}, []int64{60, 90, 120, 150}, []float64{5, 6, 7, 8}),
+		},
+	}
+	partitions := []partition{east, west}
+
+	opts := engine.Opts{
+		EngineOpts: promql.EngineOpts{
+			Timeout:    1 * time.Hour,
+			MaxSamples: 1e10,
+		},
+		DisableFallback: true,
+	}
+	queries := []string{
+		"bar",
+		"rate(bar[1m])",
+		"sum by (pod) (bar)",
+		"max(bar) - 1",
+	}
+	for _, qs := range queries {
+		t.Run(qs, func(t *testing.T) {
+			var (
+				engines         []api.RemoteEngine
+				disjointEngines []api.RemoteEngine
+			)
+			for _, p := range partitions {
+				engines = append(engines, engine.NewRemoteEngine(opts, storageWithMockSeries(p.series...), p.mint(), p.maxt(), p.extLset))
+				disjointEngines = append(disjointEngines, externalLabelsEngine{
+					RemoteEngine: engine.NewRemoteEngine(opts, storageWithMockSeries(p.series...), p.mint(), p.maxt(), p.extLset),
+				})
+			}
+
+			exec := func(engines []api.RemoteEngine) promql.Matrix {
+				distEngine := engine.NewDistributedEngine(opts, api.NewStaticEndpoints(engines))
+				qry, err := distEngine.NewRangeQuery(storageWithMockSeries(), nil, qs, time.Unix(0, 0), time.Unix(180, 0), 30*time.Second)
+				testutil.Ok(t, err)
+				defer qry.Close()
+
+				result := qry.Exec(context.Background())
+				testutil.Ok(t, result.Err)
+				matrix, err := result.Matrix()
+				testutil.Ok(t, err)
+				return matrix
+			}
+			expected := exec(engines)
+			testutil.Assert(t, len(expected) > 0, "expected non-empty result")
+			testutil.Equals(t, expected, exec(disjointEngines))
+		})
+	}
+}
+
+// staleRangeEngine is a remote engine which advertises a stale min time
+// and reports the actual min time of its data from executed queries.
+type staleRangeEngine struct {
+	api.RemoteEngine
+	advertisedMinT int64
+	dataMinT       int64
+
+	mu          sync.Mutex
+	queryStarts []time.Time
+}
+
+func (e *staleRangeEngine) MinT() int64 { return e.advertisedMinT }
+
+func (e *staleRangeEngine) NewRangeQuery(opts *promql.QueryOpts, qs string, start, end time.Time, interval time.Duration) (promql.Query, error) {
+	e.mu.Lock()
+	e.queryStarts = append(e.queryStarts, start)
+	e.mu.Unlock()
+
+	qry, err := e.RemoteEngine.NewRangeQuery(opts, qs, start, end, interval)
+	if err != nil {
+		return nil, err
+	}
+	return dataRangeQuery{Query: qry, mint: e.dataMinT, maxt: e.MaxT()}, nil
+}
+
+type dataRangeQuery struct {
+	promql.Query
+	mint, maxt int64
+}
+
+func (q dataRangeQuery) DataRange() (int64, int64) { return q.mint, q.maxt }
+
+func TestDistributedReplanStaleEngine(t *testing.T) {
+	series := []string{labels.MetricName, "bar", "zone", "east-1", "pod", "nginx-1"}
+	extLset := []labels.Labels{labels.FromStrings("zone", "east-1")}
+	store := partition{
+		extLset: extLset,
+		series: []*mockSeries{
+			newMockSeries(series, []int64{30, 60, 90, 120, 150}, []float64{1, 2, 3, 4, 5}),
+		},
+	}
+	// The samples before 120s are no longer part of the leaf data range,
+	// and results for them should be taken from the store.
+	leaf := partition{
+		extLset: extLset,
+		series: []*mockSeries{
+			newMockSeries(series, []int64{30, 60, 90, 120, 150, 180}, []float64{0, 0, 0, 4, 5, 6}),
+		},
+	}
+
+	opts := engine.Opts{
+		EngineOpts: promql.EngineOpts{
+			Timeout:    1 * time.Hour,
+			MaxSamples: 1e10,
+		},
+		DisableFallback: true,
+	}
+	leafEngine := &staleRangeEngine{
+		RemoteEngine:   engine.NewRemoteEngine(opts, storageWithMockSeries(leaf.series...), leaf.mint(), leaf.maxt(), leaf.extLset),
+		advertisedMinT: leaf.mint(),
+		dataMinT:       120 * 1000,
+	}
+	remoteEngines := []api.RemoteEngine{
+		engine.NewRemoteEngine(opts, storageWithMockSeries(store.series...), store.mint(), store.maxt(), store.extLset),
+		leafEngine,
+	}
+	distEngine := engine.NewDistributedEngine(opts, api.NewStaticEndpoints(remoteEngines))
+
+	qry, err := distEngine.NewRangeQuery(storageWithMockSeries(), nil, "bar", time.Unix(30, 0), time.Unix(180, 0), 30*time.Second)
+	testutil.Ok(t, err)
+	result := qry.Exec(context.Background())
+	testutil.Ok(t, result.Err)
+
+	matrix, err := result.Matrix()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(matrix))
+	expected := []promql.FPoint{{T: 30000, F: 1}, {T: 60000, F: 2}, {T: 90000, F: 3}, {T: 120000, F: 4}, {T: 150000, F: 5}, {T: 180000, F: 6}}
+	testutil.Equals(t, expected, matrix[0].Floats)
+	testutil.Equals(t, []time.Time{time.Unix(30, 0), time.Unix(120, 0)}, leafEngine.queryStarts)
+}
+
+// tokenRecordingEngine is a remote engine which records the idempotency
+// tokens with which its queries are executed.
+type tokenRecordingEngine struct {
+	api.RemoteEngine
+
+	mu     sync.Mutex
+	tokens []string
+}
+
+func (e *tokenRecordingEngine) NewRangeQuery(opts *promql.QueryOpts, qs string, start, end time.Time, interval time.Duration) (promql.Query, error) {
+	qry, err := e.RemoteEngine.NewRangeQuery(opts, qs, start, end, interval)
+	if err != nil {
+		return nil, err
+	}
+	return tokenRecordingQuery{Query: qry, engine: e}, nil
+}
+
+type tokenRecordingQuery struct {
+	promql.Query
+	engine *tokenRecordingEngine
+}
+
+func (q tokenRecordingQuery) Exec(ctx context.Context) *promql.Result {
+	token, _ := api.IdempotencyTokenFromContext(ctx)
+	q.engine.mu.Lock()
+	q.engine.tokens = append(q.engine.tokens, token)
+	q.engine.mu.Unlock()
+	return q.Query.Exec(ctx)
+}
+
+func TestDistributedIdempotencyTokens(t *testing.T) {
+	east := partition{
+		extLset: []labels.Labels{labels.FromStrings("zone", "east-1")},
+		series: []*mockSeries{
+			newMockSeries([]string{labels.MetricName, "bar", "zone", "east-1", "pod", "nginx-1"}, []int64{30, 60, 90, 120}, []float64{1, 2, 3, 4}),
+		},
+	}
+	west := partition{
+		extLset: []labels.Labels{labels.FromStrings("zone", "west-1")},
+		series: []*mockSeries{
+			newMockSeries([]string{labels.MetricName, "bar", "zone", "west-1", "pod", "nginx-1"}, []int64{30, 60, 90, 120}, []float64{1, 2, 3, 4}),
+		},
+	}
+
+	opts := engine.Opts{
+		EngineOpts: promql.EngineOpts{
+			Timeout:    1 * time.Hour,
+			MaxSamples: 1e10,
+		},
+		DisableFallback: true,
+	}
+	eastEngine := &tokenRecordingEngine{
+		RemoteEngine: engine.NewRemoteEngine(opts, storageWithMockSeries(east.series...), east.mint(), east.maxt(), east.extLset),
+	}
+	westEngine := &tokenRecordingEngine{
+		RemoteEngine: engine.NewRemoteEngine(opts, storageWithMockSeries(west.series...), west.mint(), west.maxt(), west.extLset),
+	}
+	distEngine := engine.NewDistributedEngine(opts, api.NewStaticEndpoints([]api.RemoteEngine{eastEngine, westEngine}))
+
+	for i := 0; i < 2; i++ {
+		qry, err := distEngine.NewRangeQuery(storageWithMockSeries(), nil, "sum by (zone) (bar)", time.Unix(30, 0), time.Unix(120, 0), 30*time.Second)
+		testutil.Ok(t, err)
+		result := qry.Exec(context.Background())
+		testutil.Ok(t, result.Err)
+		qry.Close()
+	}
+
+	// Every remote execution has its own token.
+	seen := make(map[string]struct{})
+	for _, tokens := range [][]string{eastEngine.tokens, westEngine.tokens} {
+		testutil.Equals(t, 2, len(tokens))
+		for _, token := range tokens {
+			testutil.Assert(t, token != "", "expected remote query to be executed with an idempotency token")
+			seen[token] = struct{}{}
+		}
+	}
+	testutil.Equals(t, 4, len(seen))
+}
+
+// unreliableEngine is a remote engine whose queries fail a number of times before they
+// succeed. If it is slow, its first query blocks until it is canceled.
+type unreliableEngine struct {
+	api.RemoteEngine
+
+	mu       sync.Mutex
+	failures int
+	// permanent makes the failures permanent errors, which are not retried.
+	permanent bool
+	slow      bool
+	tokens    []string
+	// canceled is closed once the slow query is canceled.
+	canceled chan struct{}
+	timeout  time.Duration
+}
+
+func (e *unreliableEngine) Timeout() time.Duration { return e.timeout }
+
+func (e *unreliableEngine) NewRangeQuery(opts *promql.QueryOpts, qs string, start, end time.Time, interval time.Duration) (promql.Query, error) {
+	qry, err := e.RemoteEngine.NewRangeQuery(opts, qs, start, end, interval)
+	if err != nil {
+		return nil, err
+	}
+	return unreliableQuery{Query: qry, engine: e}, nil
+}
+
+type unreliableQuery struct {
+	promql.Query
+	engine *unreliableEngine
+}
+
+func (q unreliableQuery) Exec(ctx context.Context) *promql.Result {
+	token, _ := api.IdempotencyTokenFromContext(ctx)
+	q.engine.mu.Lock()
+	q.engine.tokens = append(q.engine.tokens, token)
+	slow := q.engine.slow
+	q.engine.slow = false
+	fail := q.engine.failures > 0
+	if fail {
+		q.engine.failures--
+	}
+	q.engine.mu.Unlock()
+
+	if slow {
+		<-ctx.Done()
+		if q.engine.canceled != nil {
+			close(q.engine.canceled)
+		}
+		return &promql.Result{Err: ctx.Err()}
+	}
+	if fail && q.engine.permanent {
+		return &promql.Result{Err: errors.New("invalid query")}
+	}
+	if fail {
+		return &promql.Result{Err: api.NewTransientError(errors.New("connection reset"))}
+	}
+	return q.Query.Exec(ctx)
+}
+
+func TestDistributedRetries(t *testing.T) {
+	east := partition{
+		extLset: []labels.Labels{labels.FromStrings("zone", "east-1")},
+		series: []*mockSeries{
+			newMockSeries([]string{labels.MetricName, "bar", "zone", "east-1", "pod", "nginx-1"}, []int64{30, 60, 90, 120}, []float64{1, 2, 3, 4}),
+		},
+	}
+	opts := engine.Opts{
+		EngineOpts: promql.EngineOpts{
+			Timeout:    1 * time.Hour,
+			MaxSamples: 1e10,
+		},
+		DisableFallback:   true,
+		RemoteRetryPolicy: query.RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond},
+	}
+	newEngine := func(failures int) *unreliableEngine {
+		return &unreliableEngine{
+			RemoteEngine: engine.NewRemoteEngine(opts, storageWithMockSeries(east.series...), east.mint(), east.maxt(), east.extLset),
+			failures:     failures,
+		}
+	}
+
+	t.Run("query succeeds after retries", func(t *testing.T) {
+		remoteEngine := newEngine(2)
+		distEngine := engine.NewDistributedEngine(opts, api.NewStaticEndpoints([]api.RemoteEngine{remoteEngine}))
+		qry, err := distEngine.NewRangeQuery(storageWithMockSeries(), nil, "sum by (zone) (bar)", time.Unix(30, 0), time.Unix(120, 0), 30*time.Second)
+		testutil.Ok(t, err)
+		defer qry.Close()
+
+		result := qry.Exec(context.Background())
+		testutil.Ok(t, result.Err)
+		matrix, err := result.Matrix()
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(matrix))
+		testutil.Equals(t, []promql.FPoint{{T: 30000, F: 1}, {T: 60000, F: 2}, {T: 90000, F: 3}, {T: 120000, F: 4}}, matrix[0].Floats)
+
+		// Retries are executed with the token of the first attempt.
+		testutil.Equals(t, 3, len(remoteEngine.tokens))
+		testutil.Equals(t, remoteEngine.tokens[0], remoteEngine.tokens[1])
+		testutil.Equals(t, remoteEngine.tokens[0], remoteEngine.tokens[2])
+	})
+	t.Run("query fails after max attempts", func(t *testing.T) {
+		remoteEngine := newEngine(3)
+		distEngine := engine.NewDistributedEngine(opts, api.NewStaticEndpoints([]api.RemoteEngine{remoteEngine}))
+		qry, err := distEngine.NewRangeQuery(storageWithMockSeries(), nil, "sum by (zone) (bar)", time.Unix(30, 0), time.Unix(120, 0), 30*time.Second)
+		testutil.Ok(t, err)
+		defer qry.Close()
+
+		result := qry.Exec(context.Background())
+		testutil.NotOk(t, result.Err)
+		testutil.Equals(t, 3, len(remoteEngine.tokens))
+	})
+	t.Run("permanent errors are not retried", func(t *testing.T) {
+		remoteEngine := newEngine(1)
+		remoteEngine.permanent = true
+		distEngine := engine.NewDistributedEngine(opts, api.NewStaticEndpoints([]api.RemoteEngine{remoteEngine}))
+		qry, err := distEngine.NewRangeQuery(storageWithMockSeries(), nil, "sum by (zone) (bar)", time.Unix(30, 0), time.Unix(120, 0), 30*time.Second)
+		testutil.Ok(t, err)
+		defer qry.Close()
+
+		result := qry.Exec(context.Background())
+		testutil.NotOk(t, result.Err)
+		testutil.Equals(t, 1, len(remoteEngine.tokens))
+	})
+	t.Run("slow query is hedged", func(t *testing.T) {
+		hedgedOpts := opts
+		hedgedOpts.RemoteRetryPolicy = query.RetryPolicy{HedgeDelay: 10 * time.Millisecond}
+		remoteEngine := newEngine(0)
+		remoteEngine.slow = true
+		remoteEngine.canceled = make(chan struct{})
+		distEngine := engine.NewDistributedEngine(hedgedOpts, api.NewStaticEndpoints([]api.RemoteEngine{remoteEngine}))
+		qry, err := distEngine.NewRangeQuery(storageWithMockSeries(), nil, "sum by (zone) (bar)", time.Unix(30, 0), time.Unix(120, 0), 30*time.Second)
+		testutil.Ok(t, err)
+
+		result := qry.Exec(context.Background())
+		testutil.Ok(t, result.Err)
+		matrix, err := result.Matrix()
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(matrix))
+		testutil.Equals(t, []promql.FPoint{{T: 30000, F: 1}, {T: 60000, F: 2}, {T: 90000, F: 3}, {T: 120000, F: 4}}, matrix[0].Floats)
+		qry.Close()
+
+		// The slow attempt is canceled once the hedged attempt completes. Both attempts run at the same
+		// time, so the hedged attempt is a separate request with a token of its own.
+		<-remoteEngine.canceled
+		testutil.Equals(t, 2, len(remoteEngine.tokens))
+		testutil.Assert(t, remoteEngine.tokens[0] != remoteEngine.tokens[1], "expected different tokens for hedged attempts")
+	})
+}
+
+func TestDistributedRemoteEngineTimeout(t *testing.T) {
+	east := partition{
+		extLset: []labels.Labels{labels.FromStrings("zone", "east-1")},
+		series: []*mockSeries{
+			newMockSeries([]string{labels.MetricName, "bar", "zone", "east-1", "pod", "nginx-1"}, []int64{30, 60, 90, 120}, []float64{1, 2, 3, 4}),
+		},
+	}
+	west := partition{
+		extLset: []labels.Labels{labels.FromStrings("zone", "west-1")},
+		series: []*mockSeries{
+			newMockSeries([]string{labels.MetricName, "bar", "zone", "west-1", "pod", "nginx-1"}, []int64{30, 60, 90, 120}, []float64{5, 6, 7, 8}),
+		},
+	}
+	opts := engine.Opts{
+		EngineOpts: promql.EngineOpts{
+			Timeout:    1 * time.Hour,
+			MaxSamples: 1e10,
+		},
+		DisableFallback: true,
+	}
+
+	cases := []struct {
+		name          string
+		engineTimeout time.Duration
+		timeout       time.Duration
+	}{
+		{name: "timeout of distributed engine", timeout: 20 * time.Millisecond},
+		{name: "timeout of remote engine", engineTimeout: 20 * time.Millisecond},
+		{name: "timeout of remote engine overrides timeout of distributed engine", engineTimeout: 20 * time.Millisecond, timeout: time.Hour},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			stuckEngine := &unreliableEngine{
+				RemoteEngine: engine.NewRemoteEngine(opts, storageWithMockSeries(east.series...), east.mint(), east.maxt(), east.extLset),
+				slow:         true,
+				timeout:      tcase.engineTimeout,
+			}
+			westEngine := engine.NewRemoteEngine(opts, storageWithMockSeries(west.series...), west.mint(), west.maxt(), west.extLset)
+
+			distOpts := opts
+			distOpts.RemoteEngineTimeout = tcase.timeout
+			distEngine := engine.NewDistributedEngine(distOpts, api.NewStaticEndpoints([]api.RemoteEngine{stuckEngine, westEngine}))
+			qry, err := distEngine.NewRangeQuery(storageWithMockSeries(), nil, "sum by (zone) (bar)", time.Unix(30, 0), time.Unix(120, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer qry.Close()
+
+			result := qry.Exec(context.Background())
+			testutil.Ok(t, result.Err)
+			matrix, err := result.Matrix()
+			testutil.Ok(t, err)
+			testutil.Equals(t, 1, len(matrix))
+			testutil.Equals(t, labels.FromStrings("zone", "west-1"), matrix[0].Metric)
+			testutil.Equals(t, 1, len(result.Warnings))
+			testutil.Assert(t, strings.Contains(result.Warnings[0].Error(), "abandoned"), "expected warning about abandoned remote query, got %v", result.Warnings[0])
+		})
+	}
+}
+
+// streamingEngine is a remote engine whose queries stream their results in batches of batchSize steps.
+// Batches are produced lazily with the context the stream was opened with, like from a connection.
+// Streams stall after stallAfter batches if it is set, and the first failures attempts to open
+// a stream fail with a transient error, or with a permanent one if permanent is set.
+type streamingEngine struct {
+	api.RemoteEngine
+	batchSize  int
+	stallAfter int
+	failures   int
+	permanent  bool
+
+	mu sync.Mutex
+	// attempts is the number of attempts to open a stream.
+	attempts int
+	// streams is the number of opened streams, batches the number of batches read from them,
+	// and open the number of streams which are not closed.
+	streams int
+	batches int
+	open    int
+}
+
+func (e *streamingEngine) NewRangeQuery(opts *promql.QueryOpts, qs string, start, end time.Time, interval time.Duration) (promql.Query, error) {
+	qry, err := e.RemoteEngine.NewRangeQuery(opts, qs, start, end, interval)
+	if err != nil {
+		return nil, err
+	}
+	return streamingQuery{Query: qry, engine: e}, nil
+}
+
+type streamingQuery struct {
+	promql.Query
+	engine *streamingEngine
+}
+
+func (q streamingQuery) Exec(context.Context) *promql.Result {
+	return &promql.Result{Err: errors.New("streaming queries must not be executed")}
+}
+
+func (q streamingQuery) Stream(ctx context.Context) (api.ResultStream, error) {
+	q.engine.mu.Lock()
+	q.engine.attempts++
+	fail := q.engine.failures > 0
+	if fail {
+		q.engine.failures--
+	}
+	q.engine.mu.Unlock()
+	if fail && q.engine.permanent {
+		return nil, errors.New("invalid query")
+	}
+	if fail {
+		return nil, api.NewTransientError(errors.New("connection reset"))
+	}
+
+	result := q.Query.Exec(ctx)
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	matrix, err := result.Matrix()
+	if err != nil {
+		return nil, err
+	}
+
+	series := make([]labels.Labels, len(matrix))
+	stepsByTime := make(map[int64]*api.StepSamples)
+	stepAt := func(t int64) *api.StepSamples {
+		if _, ok := stepsByTime[t]; !ok {
+			stepsByTime[t] = &api.StepSamples{T: t}
+		}
+		return stepsByTime[t]
+	}
+	for i, s := range matrix {
+		series[i] = s.Metric
+		for _, p := range s.Floats {
+			step := stepAt(p.T)
+			step.SampleIDs = append(step.SampleIDs, uint64(i))
+			step.Samples = append(step.Samples, p.F)
+		}
+		for _, p := range s.Histograms {
+			step := stepAt(p.T)
+			step.HistogramIDs = append(step.HistogramIDs, uint64(i))
+			step.Histograms = append(step.Histograms, p.H)
+		}
+	}
+	steps := make([]api.StepSamples, 0, len(stepsByTime))
+	for _, step := range stepsByTime {
+		steps = append(steps, *step)
+	}
+	sort.Slice(steps, func(i, j int) bool { return steps[i].T < steps[j].T })
+
+	q.engine.mu.Lock()
+	q.engine.streams++
+	q.engine.open++
+	q.engine.mu.Unlock()
+	return &lazyStream{ctx: ctx, engine: q.engine, series: series, steps: steps, warnings: result.Warnings}, nil
+}
+
+type lazyStream struct {
+	// ctx is the context the stream was opened with.
+	ctx      context.Context
+	engine   *streamingEngine
+	series   []labels.Labels
+	steps    []api.StepSamples
+	warnings storage.Warnings
+	batches  int
+}
+
+func (s *lazyStream) Series() []labels.Labels { return s.series }
+
+func (s *lazyStream) Next(ctx context.Context) ([]api.StepSamples, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "stream context is done")
+	}
+	if s.engine.stallAfter > 0 && s.batches >= s.engine.stallAfter {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-s.ctx.Done():
+			return nil, s.ctx.Err()
+		}
+	}
+	if len(s.steps) == 0 {
+		return nil, nil
+	}
+	n := s.engine.batchSize
+	if n > len(s.steps) {
+		n = len(s.steps)
+	}
+	batch := s.steps[:n]
+	s.steps = s.steps[n:]
+	s.batches++
+
+	s.engine.mu.Lock()
+	s.engine.batches++
+	s.engine.mu.Unlock()
+	return batch, nil
+}
+
+func (s *lazyStream) Warnings() storage.Warnings { return s.warnings }
+
+func (s *lazyStream) Close() {
+	s.engine.mu.Lock()
+	s.engine.open--
+	s.engine.mu.Unlock()
+}
+
+func TestDistributedStreamingResults(t *testing.T) {
+	// newSeries creates a series with a sample every 30s between from and to.
+	newSeries := func(from, to int64, lbls ...string) *mockSeries {
+		var (
+			timestamps []int64
+			values     []float64
+		)
+		for ts := from; ts <= to; ts += 30 {
+			timestamps = append(timestamps, ts)
+			values = append(values, float64(ts/30))
+		}
+		return newMockSeries(lbls, timestamps, values)
+	}
+	olderEast := partition{
+		extLset: []labels.Labels{labels.FromStrings("zone", "east-1")},
+		series:  []*mockSeries{newSeries(0, 420, labels.MetricName, "bar", "zone", "east-1", "pod", "nginx-1")},
+	}
+	newerEast := partition{
+		extLset: []labels.Labels{labels.FromStrings("zone", "east-1")},
+		series:  []*mockSeries{newSeries(240, 600, labels.MetricName, "bar", "zone", "east-1", "pod", "nginx-1")},
+	}
+	west := partition{
+		extLset: []labels.Labels{labels.FromStrings("zone", "west-1")},
+		series: []*mockSeries{
+			newSeries(0, 600, labels.MetricName, "bar", "zone", "west-1", "pod", "nginx-1"),
+			newSeries(0, 600, labels.MetricName, "bar", "zone", "west-1", "pod", "nginx-2"),
+		},
+	}
+	partitions := []partition{olderEast, newerEast, west}
+
+	opts := engine.Opts{
+		EngineOpts: promql.EngineOpts{
+			Timeout:    1 * time.Hour,
+			MaxSamples: 1e10,
+		},
+		DisableFallback: true,
+	}
+	queries := []string{
+		"bar",
+		"sum by (zone) (bar)",
+		"max_over_time(bar[2m])",
+	}
+	for _, qs := range queries {
+		t.Run(qs, func(t *testing.T) {
+			var (
+				bufferedEngines  []api.RemoteEngine
+				streamingEngines []api.RemoteEngine
+			)
+			for _, p := range partitions {
+				bufferedEngines = append(bufferedEngines, engine.NewRemoteEngine(opts, storageWithMockSeries(p.series...), p.mint(), p.maxt(), p.extLset))
+				streamingEngines = append(streamingEngines, &streamingEngine{
+					RemoteEngine: engine.NewRemoteEngine(opts, storageWithMockSeries(p.series...), p.mint(), p.maxt(), p.extLset),
+					batchSize:    3,
+				})
+			}
+
+			exec := func(engines []api.RemoteEngine) promql.Matrix {
+				distEngine := engine.NewDistributedEngine(opts, api.NewStaticEndpoints(engines))
+				qry, err := distEngine.NewRangeQuery(storageWithMockSeries(), nil, qs, time.Unix(0, 0), time.Unix(600, 0), 15*time.Second)
+				testutil.Ok(t, err)
+				defer qry.Close()
+
+				result := qry.Exec(context.Background())
+				testutil.Ok(t, result.Err)
+				matrix, err := result.Matrix()
+				testutil.Ok(t, err)
+				return matrix
+			}
+			expected := exec(bufferedEngines)
+			testutil.Assert(t, len(expected) > 0, "expected non-empty result")
+			testutil.Equals(t, expected, exec(streamingEngines))
+
+			var streams int
+			for _, e := range streamingEngines {
+				e := e.(*streamingEngine)
+				streams += e.streams
+				testutil.Assert(t, e.streams == 0 || e.batches > e.streams, "expected results to be streamed in multiple batches, got %d batches from %d streams", e.batches, e.streams)
+				testutil.Equals(t, 0, e.open)
+			}
+			testutil.Assert(t, streams > 0, "expected results to be streamed")
+		})
+	}
+}
+
+func TestDistributedStreamingRemoteTimeout(t *testing.T) {
+	east := partition{
+		extLset: []labels.Labels{labels.FromStrings("zone", "east-1")},
+		series: []*mockSeries{
+			newMockSeries([]string{labels.MetricName, "bar", "zone", "east-1", "pod", "nginx-1"}, []int64{30, 60, 90, 120, 150, 180}, []float64{1, 2, 3, 4, 5, 6}),
+		},
+	}
+	opts := engine.Opts{
+		EngineOpts: promql.EngineOpts{
+			Timeout:    1 * time.Hour,
+			MaxSamples: 1e10,
+		},
+		DisableFallback: true,
+	}
+
+	exec := func(remoteEngine api.RemoteEngine, remoteTimeout time.Duration) *promql.Result {
+		distOpts := opts
+		distOpts.RemoteEngineTimeout = remoteTimeout
+		distEngine := engine.NewDistributedEngine(distOpts, api.NewStaticEndpoints([]api.RemoteEngine{remoteEngine}))
+		qry, err := distEngine.NewRangeQuery(storageWithMockSeries(), nil, "bar", time.Unix(30, 0), time.Unix(180, 0), 30*time.Second)
+		testutil.Ok(t, err)
+		defer qry.Close()
+
+		return qry.Exec(context.Background())
+	}
+
+	t.Run("stream is read after it was opened", func(t *testing.T) {
+		streaming := &streamingEngine{
+			RemoteEngine: engine.NewRemoteEngine(opts, storageWithMockSeries(east.series...), east.mint(), east.maxt(), east.extLset),
+			batchSize:    2,
+		}
+		result := exec(streaming, time.Hour)
+		testutil.Ok(t, result.Err)
+		testutil.Equals(t, 0, len(result.Warnings))
+		matrix, err := result.Matrix()
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(matrix))
+		testutil.Equals(t, 6, len(matrix[0].Floats))
+		testutil.Assert(t, streaming.batches > 1, "expected results to be streamed in multiple batches, got %d", streaming.batches)
+		testutil.Equals(t, 0, streaming.open)
+	})
+
+	t.Run("timeout applies to reading the stream", func(t *testing.T) {
+		streaming := &streamingEngine{
+			RemoteEngine: engine.NewRemoteEngine(opts, storageWithMockSeries(east.series...), east.mint(), east.maxt(), east.extLset),
+			batchSize:    2,
+			stallAfter:   1,
+		}
+		result := exec(streaming, 50*time.Millisecond)
+		testutil.NotOk(t, result.Err)
+		testutil.Assert(t, strings.Contains(result.Err.Error(), "exceeded the timeout"), "expected timeout error, got %v", result.Err)
+	})
+}
+
+func TestDistributedStreamingRetries(t *testing.T) {
+	east := partition{
+		extLset: []labels.Labels{labels.FromStrings("zone", "east-1")},
+		series: []*mockSeries{
+			newMockSeries([]string{labels.MetricName, "bar", "zone", "east-1", "pod", "nginx-1"}, []int64{30, 60, 90, 120}, []float64{1, 2, 3, 4}),
+		},
+	}
+	opts := engine.Opts{
+		EngineOpts: promql.EngineOpts{
+			Timeout:    1 * time.Hour,
+			MaxSamples: 1e10,
+		},
+		DisableFallback:   true,
+		RemoteRetryPolicy: query.RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond},
+	}
+	exec := func(remoteEngine api.RemoteEngine) *promql.Result {
+		distEngine := engine.NewDistributedEngine(opts, api.NewStaticEndpoints([]api.RemoteEngine{remoteEngine}))
+		qry, err := distEngine.NewRangeQuery(storageWithMockSeries(), nil, "bar", time.Unix(30, 0), time.Unix(120, 0), 30*time.Second)
+		testutil.Ok(t, err)
+		defer qry.Close()
+
+		return qry.Exec(context.Background())
+	}
+
+	t.Run("transient errors are retried", func(t *testing.T) {
+		streaming := &streamingEngine{
+			RemoteEngine: engine.NewRemoteEngine(opts, storageWithMockSeries(east.series...), east.mint(), east.maxt(), east.extLset),
+			batchSize:    2,
+			failures:     2,
+		}
+		result := exec(streaming)
+		testutil.Ok(t, result.Err)
+		matrix, err := result.Matrix()
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(matrix))
+		testutil.Equals(t, 3, streaming.attempts)
+	})
+	t.Run("permanent errors are not retried", func(t *testing.T) {
+		streaming := &streamingEngine{
+			RemoteEngine: engine.NewRemoteEngine(opts, storageWithMockSeries(east.series...), east.mint(), east.maxt(), east.extLset),
+			batchSize:    2,
+			failures:     1,
+			permanent:    true,
+		}
+		result := exec(streaming)
+		testutil.NotOk(t, result.Err)
+		testutil.Equals(t, 1, streaming.attempts)
+	})
+}
+
+func TestDistributedQueryReceipts(t *testing.T) {
+	east := partition{
+		extLset: []labels.Labels{labels.FromStrings("zone", "east-1")},
+		series: []*mockSeries{
+			newMockSeries([]string{labels.MetricName, "bar", "zone", "east-1", "pod", "nginx-1"}, []int64{30, 60, 90, 120}, []float64{1, 2, 3, 4}),
+		},
+	}
+	west := partition{
+		extLset: []labels.Labels{labels.FromStrings("zone", "west-1")},
+		series: []*mockSeries{
+			newMockSeries([]string{labels.MetricName, "bar", "zone", "west-1", "pod", "nginx-1"}, []int64{30, 60, 90, 120}, []float64{1, 2, 3, 4}),
+		},
+	}
+
+	opts := engine.Opts{
+		EngineOpts: promql.EngineOpts{
+			Timeout:    1 * time.Hour,
+			MaxSamples: 1e10,
+		},
+		DisableFallback: true,
+	}
+	remoteEngines := []api.RemoteEngine{
+		engine.NewRemoteEngine(opts, storageWithMockSeries(east.series...), east.mint(), east.maxt(), east.extLset),
+		engine.NewRemoteEngine(opts, storageWithMockSeries(west.series...), west.mint(), west.maxt(), west.extLset),
+	}
+	opts.EnableQueryReceipts = true
+	distEngine := engine.NewDistributedEngine(opts, api.NewStaticEndpoints(remoteEngines))
+
+	qry, err := distEngine.NewRangeQuery(storageWithMockSeries(), nil, "sum by (pod) (bar)", time.Unix(30, 0), time.Unix(120, 0), 30*time.Second)
+	testutil.Ok(t, err)
+	result := qry.Exec(context.Background())
+	testutil.Ok(t, result.Err)
+
+	expected := "PromQL info: query touched 0 selectors in 0 shards, 0 series, 0 samples and 2 remote engine queries"
+	testutil.Equals(t, 1, len(result.Warnings))
+	testutil.Equals(t, expected, result.Warnings[0].Error())
+}
+
+func TestDistributedLocalExecution(t *testing.T) {
+	east := partition{
+		extLset: []labels.Labels{labels.FromStrings("zone", "east-1")},
+		series: []*mockSeries{
+			newMockSeries([]string{labels.MetricName, "bar", "zone", "east-1", "pod", "nginx-1"}, []int64{30, 60, 90, 120}, []float64{1, 2, 3, 4}),
+		},
+	}
+	west := partition{
+		extLset: []labels.Labels{labels.FromStrings("zone", "west-1")},
+		series: []*mockSeries{
+			newMockSeries([]string{labels.MetricName, "bar", "zone", "west-1", "pod", "nginx-1"}, []int64{30, 60, 90, 120}, []float64{1, 2, 3, 4}),
+		},
+	}
+
+	cases := []struct {
+		name          string
+		estimate      int64
+		local         bool
+		withEstimates bool
+	}{
+		{name: "estimated below threshold", estimate: 2, withEstimates: true, local: true},
+		{name: "estimated above threshold", estimate: 20, withEstimates: true},
+		{name: "without estimates"},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			opts := engine.Opts{
+				EngineOpts: promql.EngineOpts{
+					Timeout:    1 * time.Hour,
+					MaxSamples: 1e10,
+				},
+				DisableFallback: true,
+			}
+			eastEngine := &tokenRecordingEngine{
+				RemoteEngine: engine.NewRemoteEngine(opts, storageWithMockSeries(east.series...), east.mint(), east.maxt(), east.extLset),
+			}
+			westEngine := &tokenRecordingEngine{
+				RemoteEngine: engine.NewRemoteEngine(opts, storageWithMockSeries(west.series...), west.mint(), west.maxt(), west.extLset),
+			}
+			opts.MinDistributedSeries = 10
+			distEngine := engine.NewDistributedEngine(opts, api.NewStaticEndpoints([]api.RemoteEngine{eastEngine, westEngine}))
+
+			var queryable storage.Queryable = storageWithMockSeries(append(east.series, west.series...)...)
+			if tcase.withEstimates {
+				queryable = &estimatingQueryable{Queryable: queryable, series: tcase.estimate}
+			}
+			qry, err := distEngine.NewRangeQuery(queryable, nil, "sum by (zone) (bar)", time.Unix(30, 0), time.Unix(120, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer qry.Close()
+
+			result := qry.Exec(context.Background())
+			testutil.Ok(t, result.Err)
+			matrix, err := result.Matrix()
+			testutil.Ok(t, err)
+			testutil.Equals(t, 2, len(matrix))
+
+			remoteQueries := len(eastEngine.tokens) + len(westEngine.tokens)
+			if tcase.local {
+				testutil.Equals(t, 0, remoteQueries)
+			} else {
+				testutil.Equals(t, 2, remoteQueries)
+			}
+		})
+	}
+}
+
+func TestFederation(t *testing.T) {
+	opts := engine.Opts{
+		EngineOpts: promql.EngineOpts{
+			Timeout:    1 * time.Hour,
+			MaxSamples: 1e10,
+		},
+		DisableFallback: true,
+	}
+	east := []*mockSeries{
+		newMockSeries([]string{labels.MetricName, "bar", "zone", "east-1", "pod", "nginx-1"}, []int64{30, 60, 90, 120}, []float64{2, 3, 4, 5}),
+		newMockSeries([]string{labels.MetricName, "bar", "zone", "east-1", "pod", "nginx-2"}, []int64{30, 60, 90, 120}, []float64{3, 4, 5, 6}),
+	}
+	west := []*mockSeries{
+		newMockSeries([]string{labels.MetricName, "bar", "zone", "west-1", "pod", "nginx-1"}, []int64{30, 60, 90, 120}, []float64{4, 5, 6, 7}),
+	}
+	completeSeriesSet := storageWithMockSeries(append(append([]*mockSeries{}, east...), west...)...)
+
+	federation := engine.NewFederation(opts, engine.NewRemoteEngine(
+		opts,
+		storageWithMockSeries(east...),
+		math.MinInt64,
+		math.MaxInt64,
+		[]labels.Labels{labels.FromStrings("zone", "east-1")},
+	))
+	federation.AddQueryable(storageWithMockSeries(west...), math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("zone", "west-1")})
+	testutil.Equals(t, 2, len(federation.Engines()))
+
+	for _, query := range []string{`bar`, `sum by (zone) (bar)`, `max(rate(bar[1m]))`, `bar{zone="west-1"}`} {
+		t.Run(query, func(t *testing.T) {
+			fedQry, err := federation.NewRangeQuery(storageWithMockSeries(), nil, query, time.Unix(0, 0), time.Unix(120, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			fedResult := fedQry.Exec(context.Background())
+			testutil.Ok(t, fedResult.Err)
+
+			promQry, err := promql.NewEngine(opts.EngineOpts).NewRangeQuery(completeSeriesSet, nil, query, time.Unix(0, 0), time.Unix(120, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			promResult := promQry.Exec(context.Background())
+
+			roundValues(promResult)
+			roundValues(fedResult)
+			testutil.Equals(t, promResult, fedResult)
+		})
+	}
+}
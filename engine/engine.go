@@ -12,14 +12,16 @@ import (
 
 	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
 
-	"github.com/cespare/xxhash/v2"
 	"github.com/prometheus/prometheus/model/labels"
 	v1 "github.com/prometheus/prometheus/web/api/v1"
 
+	"fmt"
 	"io"
 	"math"
 	"runtime"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/thanos-community/promql-engine/api"
@@ -30,18 +32,28 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/prometheus/promql"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/thanos-community/promql-engine/execution"
+	"github.com/thanos-community/promql-engine/execution/audit"
 	"github.com/thanos-community/promql-engine/execution/model"
 	"github.com/thanos-community/promql-engine/execution/parse"
+	"github.com/thanos-community/promql-engine/execution/receipt"
+	engstore "github.com/thanos-community/promql-engine/execution/storage"
+	"github.com/thanos-community/promql-engine/execution/warnings"
 	"github.com/thanos-community/promql-engine/logicalplan"
+	"github.com/thanos-community/promql-engine/query"
 )
 
 type QueryType int
 
+const tracerName = "github.com/thanos-community/promql-engine"
+
 type engineMetrics struct {
 	currentQueries prometheus.Gauge
 	queries        *prometheus.CounterVec
+	batchDurations *prometheus.HistogramVec
 }
 
 const (
@@ -70,10 +82,186 @@ type Opts struct {
 	// Defaults to 1 hour if not specified.
 	ExtLookbackDelta time.Duration
 
-	// EnableXFunctions enables custom xRate, xIncrease and xDelta functions.
+	// EnableXFunctions enables custom xRate, xIncrease, xDelta and xSmoothIncrease functions.
 	// This will default to false.
 	EnableXFunctions bool
 
+	// EnableExtendedRangeFunctions evaluates rate, increase and delta with the semantics of
+	// xrate, xincrease and xdelta, for users who migrate from engines which use them by default.
+	EnableExtendedRangeFunctions bool
+
+	// EnableExperimentalFunctions enables functions which are not part of PromQL yet,
+	// such as mad_over_time. This will default to false.
+	EnableExperimentalFunctions bool
+
+	// EnableChunkQuerying selects series as chunks when the queryable passed to a query
+	// also implements storage.ChunkQueryable. Chunks are then only decoded once
+	// samples from their time range are needed by the query.
+	EnableChunkQuerying bool
+
+	// MaxRegexComplexity limits the complexity of regex matchers, measured as the number of
+	// instructions in the compiled regex program. Queries with more complex matchers are
+	// rejected before any data is selected. Zero disables the limit.
+	MaxRegexComplexity int
+
+	// WarnOnRegexComplexity logs a warning instead of rejecting queries with regex matchers
+	// which exceed MaxRegexComplexity.
+	WarnOnRegexComplexity bool
+
+	// RegexResolutionLimit enables resolving regex matchers into lists of matching label values
+	// before series are selected, which helps stores that can only index equality matchers.
+	// Regex matchers are only resolved when they match at most this many values. Zero disables resolution.
+	RegexResolutionLimit int
+
+	// RejectUnboundedSelectors rejects queries with selectors which can select every series in storage,
+	// such as {__name__=~".+"}, before any data is selected. Selectors need an equality matcher on the
+	// metric name, a positive matcher on another label which does not match the empty string
+	// nor any non-empty value, such as {job=~".+"}, or one of the SelectiveMatchers.
+	RejectUnboundedSelectors bool
+
+	// SelectiveMatchers are matchers which make selectors sufficiently selective when
+	// RejectUnboundedSelectors is enabled, for example {__name__=~"job:.+"} for recording rules.
+	SelectiveMatchers []*labels.Matcher
+
+	// EnableInfoAnnotations enables informational annotations which are returned as
+	// warnings with query results, such as hints about range selectors which are
+	// too short for the scrape interval of the selected series.
+	EnableInfoAnnotations bool
+
+	// EnableStreamingSeries reads the series of selectors from storage in batches, and opens the
+	// iterator of each series when it is first scanned instead of when the series is selected.
+	// Iterators are released as soon as their series have no samples left in the query range,
+	// which lowers memory usage for high cardinality selects with short-lived series.
+	EnableStreamingSeries bool
+
+	// EnableStreamingAggregation computes sum, min, max, count and group over vector selectors from partial
+	// aggregates of each shard of the selected series, which are folded as batches of samples arrive. Only the
+	// partial aggregates are merged between shards, which bounds memory usage for aggregations over many series.
+	EnableStreamingAggregation bool
+
+	// EnableParallelAggregation computes sum, min, max, count and group over vector selectors and over functions of
+	// matrix selectors, such as sum(rate(http_requests_total[5m])), from partial aggregates which are computed
+	// concurrently for each shard of the selected series. It implies EnableStreamingAggregation.
+	EnableParallelAggregation bool
+
+	// EnableDelayedNameRemoval removes the metric name from the output of functions once the query
+	// is evaluated, instead of when the functions are evaluated. This allows later operations to match,
+	// group and relabel series by their metric name, for example in sum by (__name__) (rate(...)).
+	EnableDelayedNameRemoval bool
+
+	// EnableLabelAudit counts the labels.Labels copies and sorts performed while executing
+	// each query. The counts of each operator are included in the analysis returned by the
+	// Analyze method of queries, and the total counts are written to the DebugWriter and
+	// logged at debug level.
+	EnableLabelAudit bool
+
+	// EnableQueryReceipts adds an informational annotation to every result which summarizes
+	// what the query touched: the number of selectors, shards, series, samples and remote engine queries.
+	EnableQueryReceipts bool
+
+	// MaxPointsPerWindow limits the number of points a range selector can select for a single
+	// series at a single step, which protects against queries whose cost grows quadratically
+	// with the range, such as high resolution ranges over long periods. Queries which exceed
+	// the limit fail, unless TruncateWindows is set. Zero disables the limit.
+	MaxPointsPerWindow int
+
+	// TruncateWindows makes ranges which exceed MaxPointsPerWindow keep only their most
+	// recent points, and adds a warning annotation to the result instead of failing the query.
+	TruncateWindows bool
+
+	// JoinMemoryLimit is the number of bytes which the index of a binary operation between two
+	// vectors can use. Binary operations between high cardinality vectors whose index exceeds the
+	// limit keep it in a temporary file in SpillDirectory instead, which trades memory for disk reads
+	// at every step. Zero keeps all indexes in memory.
+	JoinMemoryLimit int64
+
+	// SpillDirectory is the directory in which operators exceeding their memory limit create
+	// temporary files. Defaults to the default directory for temporary files.
+	SpillDirectory string
+
+	// EnableQuerySnapshots makes operators track their progress, so that the state of the
+	// operator trees of queries which are being executed can be retrieved with Snapshot.
+	EnableQuerySnapshots bool
+
+	// SeriesRefCache caches label computations on series from storages which expose stable
+	// series references, so that repeated queries over the same series skip them. The cache
+	// needs to be reset by the caller whenever series references can be reused for different
+	// series, such as after head truncation. Entries are scoped to the queryable passed to the query.
+	SeriesRefCache *engstore.SeriesRefCache
+
+	// PlanCacheSize is the number of optimized plans which are cached across queries, so that repeated queries,
+	// such as the ones of dashboards, are only parsed and optimized once. Plans are keyed by the query string,
+	// whether the query is a range query and the lookback delta. Queries with @ modifiers are not cached.
+	// Zero disables the cache.
+	PlanCacheSize int
+
+	// TimeSplitRange splits range queries which are longer than this range into consecutive slices of at
+	// most this range. Slices are evaluated concurrently and their results are concatenated, which bounds
+	// the memory used by operators for long range queries. Zero disables splitting.
+	TimeSplitRange time.Duration
+
+	// VerticalShards splits aggregations over a single selector, such as sum by (l) (rate(m[5m])), into
+	// partial aggregations over this many disjoint shards of the selected series, which are evaluated
+	// concurrently and merged by a final aggregation. Values below 2 disable sharding.
+	VerticalShards int
+
+	// DedupPolicy determines how values for the same series and step are resolved when they differ
+	// between remote engines with overlapping time ranges. Defaults to preferring the engine with the highest MaxT.
+	DedupPolicy query.DedupPolicy
+
+	// DedupConflictTolerance is the largest absolute difference between values from remote engines
+	// which is tolerated during deduplication. Larger differences are returned as warnings.
+	// Zero disables conflict warnings.
+	DedupConflictTolerance float64
+
+	// DedupReplicaLabels are labels which identify replicas of a series, such as the replica labels of
+	// HA Prometheus pairs. Series from remote engines which only differ in these labels are deduplicated
+	// as replicas of the same series, and the labels are removed from the results.
+	DedupReplicaLabels []string
+
+	// RemoteRetryPolicy determines how failed queries of remote engines are retried with backoff, and
+	// whether queries which are slower than a delay are hedged with a second request to the remote engine.
+	RemoteRetryPolicy query.RetryPolicy
+
+	// RemoteEngineTimeout is the time after which the queries of a remote engine are abandoned, so that a
+	// single stuck engine does not fail the distributed query. The query proceeds without the results of the
+	// engine and returns a warning instead. Engines implementing api.TimeoutProvider override the timeout.
+	// Zero disables the timeout, leaving remote queries bounded only by the timeout of the query.
+	RemoteEngineTimeout time.Duration
+
+	// FutureTimestamps determines how evaluation timestamps after the current time are handled.
+	// Defaults to evaluating queries at future timestamps as requested.
+	FutureTimestamps FutureTimestamps
+
+	// MaxFutureSkew is the duration by which evaluation timestamps can be after the current time
+	// before they are clamped, which tolerates clock skew between the engine and its callers.
+	MaxFutureSkew time.Duration
+
+	// Now returns the current time which future evaluation timestamps are compared to.
+	// Defaults to time.Now.
+	Now func() time.Time
+
+	// EnableOperatorTracing records spans for the operators of queries whose estimated cost is at least
+	// OperatorTracingCostThreshold. Spans are added to the trace of the context which queries are executed
+	// with, so that cheap queries do not pay for tracing while the expensive ones are always captured.
+	EnableOperatorTracing bool
+
+	// OperatorTracingCostThreshold is the lowest cost, as estimated by logicalplan.EstimateCost,
+	// of queries whose operators are traced. Zero traces all queries.
+	OperatorTracingCostThreshold float64
+
+	// MinDistributedSeries is the smallest number of series, as estimated from the queryable passed to queries of a
+	// distributed engine, for which queries are distributed to remote engines. Queries which are estimated to select
+	// fewer series are executed against the queryable instead. Estimates are taken from queriers which implement
+	// storage.CardinalityEstimator, and queries are always distributed when they cannot be estimated. Zero distributes all queries.
+	MinDistributedSeries int64
+
+	// SeriesCache caches the series selected by queries, so that repeated selections with the same
+	// matchers and time range over the same queryable are served from memory. Entries expire after the
+	// TTL of the cache, until then samples appended to the storage are not visible to cached selections.
+	// With EnableChunkQuerying, selections which are not served from the cache are read as chunks.
+	SeriesCache *engstore.SeriesCache
+
 	// FallbackEngine
 	Engine v1.QueryEngine
 }
@@ -85,7 +273,15 @@ func (o Opts) getLogicalOptimizers() []logicalplan.Optimizer {
 	} else {
 		optimizers = o.LogicalOptimizers
 	}
-	return append(optimizers, logicalplan.TrimSortFunctions{})
+	if o.EnableExtendedRangeFunctions {
+		optimizers = append([]logicalplan.Optimizer{logicalplan.ExtendedRangeFunctions{}}, optimizers...)
+	}
+	optimizers = append(optimizers, logicalplan.TrimSortFunctions{})
+	if o.VerticalShards > 1 {
+		// Shards share their expressions, so they are created after all other optimizers ran.
+		optimizers = append(optimizers, logicalplan.VerticalShardingOptimizer{Shards: o.VerticalShards})
+	}
+	return optimizers
 }
 
 type remoteEngine struct {
@@ -94,6 +290,9 @@ type remoteEngine struct {
 	labelSets []labels.Labels
 	maxt      int64
 	mint      int64
+
+	enableXFunctions            bool
+	enableExperimentalFunctions bool
 }
 
 func NewRemoteEngine(opts Opts, q storage.Queryable, mint, maxt int64, labelSets []labels.Labels) *remoteEngine {
@@ -103,6 +302,9 @@ func NewRemoteEngine(opts Opts, q storage.Queryable, mint, maxt int64, labelSets
 		maxt:      maxt,
 		mint:      mint,
 		engine:    New(opts),
+
+		enableXFunctions:            opts.EnableXFunctions,
+		enableExperimentalFunctions: opts.EnableExperimentalFunctions,
 	}
 }
 
@@ -118,6 +320,16 @@ func (l remoteEngine) LabelSets() []labels.Labels {
 	return l.labelSets
 }
 
+func (l remoteEngine) Capabilities() api.Capabilities {
+	// All other functions are either supported natively or by the fallback engine.
+	return api.Capabilities{
+		XFunctions:            l.enableXFunctions,
+		ExperimentalFunctions: l.enableExperimentalFunctions,
+		NativeHistograms:      true,
+		PlanProtocolVersion:   api.PlanProtocolPartialAggregates,
+	}
+}
+
 func (l remoteEngine) NewRangeQuery(opts *promql.QueryOpts, qs string, start, end time.Time, interval time.Duration) (promql.Query, error) {
 	return l.engine.NewRangeQuery(l.q, opts, qs, start, end, interval)
 }
@@ -125,17 +337,75 @@ func (l remoteEngine) NewRangeQuery(opts *promql.QueryOpts, qs string, start, en
 type distributedEngine struct {
 	endpoints    api.RemoteEndpoints
 	remoteEngine *compatibilityEngine
+
+	// localEngine executes queries which are estimated to select fewer than minDistributedSeries series.
+	localEngine          *compatibilityEngine
+	minDistributedSeries int64
 }
 
 func NewDistributedEngine(opts Opts, endpoints api.RemoteEndpoints) v1.QueryEngine {
+	var localEngine *compatibilityEngine
+	if opts.MinDistributedSeries > 0 {
+		localEngine = New(opts)
+	}
 	opts.LogicalOptimizers = []logicalplan.Optimizer{
-		logicalplan.DistributedExecutionOptimizer{Endpoints: endpoints},
+		logicalplan.DistributedExecutionOptimizer{Endpoints: endpoints, ReplicaLabels: opts.DedupReplicaLabels},
 	}
+	// Distributed plans depend on the time range of queries, so they cannot be cached.
+	opts.PlanCacheSize = 0
 
 	return &distributedEngine{
-		endpoints:    endpoints,
-		remoteEngine: New(opts),
+		endpoints:            endpoints,
+		remoteEngine:         New(opts),
+		localEngine:          localEngine,
+		minDistributedSeries: opts.MinDistributedSeries,
+	}
+}
+
+// selectorRanges returns the ranges of the selectors of a query, which are estimated
+// to decide whether the query is executed locally. The returned bool is false when
+// the query is always distributed.
+func (l distributedEngine) selectorRanges(q storage.Queryable, opts *promql.QueryOpts, qs string, start, end time.Time, step time.Duration) ([]logicalplan.SelectorRange, bool) {
+	if l.localEngine == nil || q == nil {
+		return nil, false
+	}
+	expr, err := parser.ParseExpr(qs)
+	if err != nil {
+		return nil, false
 	}
+	lookbackDelta := l.remoteEngine.lookbackDelta
+	if opts != nil && opts.LookbackDelta > 0 {
+		lookbackDelta = opts.LookbackDelta
+	}
+	plan := logicalplan.New(expr, &logicalplan.Opts{
+		Start:            start,
+		End:              end,
+		Step:             step,
+		LookbackDelta:    lookbackDelta,
+		ExtLookbackDelta: l.remoteEngine.extLookbackDelta,
+	})
+	return plan.SelectorRanges(), true
+}
+
+// executeLocally returns true if the selectors are estimated to select fewer than minDistributedSeries
+// series from the queryable, in which case executing the query locally is cheaper than distributing it.
+func (l distributedEngine) executeLocally(ctx context.Context, q storage.Queryable, ranges []logicalplan.SelectorRange) bool {
+	var (
+		series    int64
+		estimator = engstore.NewEstimator()
+	)
+	for _, r := range ranges {
+		hints := &storage.SelectHints{Start: r.MinT, End: r.MaxT, Range: r.Range.Milliseconds()}
+		estimate, ok, err := estimator.EstimateSeries(ctx, q, hints, r.Selector.LabelMatchers...)
+		if err != nil || !ok {
+			return false
+		}
+		series += estimate.Series
+		if series >= l.minDistributedSeries {
+			return false
+		}
+	}
+	return true
 }
 
 func (l distributedEngine) SetQueryLogger(log promql.QueryLogger) {}
@@ -145,7 +415,19 @@ func (l distributedEngine) NewInstantQuery(q storage.Queryable, opts *promql.Que
 	// Some clients might only support second precision when executing queries.
 	ts = ts.Truncate(time.Second)
 
-	return l.remoteEngine.NewInstantQuery(q, opts, qs, ts)
+	remote, err := l.remoteEngine.NewInstantQuery(q, opts, qs, ts)
+	if err != nil {
+		return nil, err
+	}
+	ranges, ok := l.selectorRanges(q, opts, qs, ts, ts, 0)
+	if !ok {
+		return remote, nil
+	}
+	return &localOrRemoteQuery{
+		Query:          remote,
+		newLocal:       func() (promql.Query, error) { return l.localEngine.NewInstantQuery(q, opts, qs, ts) },
+		executeLocally: func(ctx context.Context) bool { return l.executeLocally(ctx, q, ranges) },
+	}, nil
 }
 
 func (l distributedEngine) NewRangeQuery(q storage.Queryable, opts *promql.QueryOpts, qs string, start, end time.Time, interval time.Duration) (promql.Query, error) {
@@ -155,7 +437,87 @@ func (l distributedEngine) NewRangeQuery(q storage.Queryable, opts *promql.Query
 	end = end.Truncate(time.Second)
 	interval = interval.Truncate(time.Second)
 
-	return l.remoteEngine.NewRangeQuery(q, opts, qs, start, end, interval)
+	remote, err := l.remoteEngine.NewRangeQuery(q, opts, qs, start, end, interval)
+	if err != nil {
+		return nil, err
+	}
+	ranges, ok := l.selectorRanges(q, opts, qs, start, end, interval)
+	if !ok {
+		return remote, nil
+	}
+	return &localOrRemoteQuery{
+		Query:          remote,
+		newLocal:       func() (promql.Query, error) { return l.localEngine.NewRangeQuery(q, opts, qs, start, end, interval) },
+		executeLocally: func(ctx context.Context) bool { return l.executeLocally(ctx, q, ranges) },
+	}, nil
+}
+
+// localOrRemoteQuery is a distributed query which is executed locally instead when its selectors are
+// estimated to select few series. Series are estimated once the query is executed, so that storage is
+// accessed with the context of the query.
+type localOrRemoteQuery struct {
+	promql.Query
+	newLocal       func() (promql.Query, error)
+	executeLocally func(ctx context.Context) bool
+
+	mu        sync.Mutex
+	local     promql.Query
+	cancelled bool
+}
+
+func (q *localOrRemoteQuery) Exec(ctx context.Context) *promql.Result {
+	if !q.executeLocally(ctx) {
+		return q.Query.Exec(ctx)
+	}
+	local, err := q.newLocal()
+	if err != nil {
+		return q.Query.Exec(ctx)
+	}
+	q.mu.Lock()
+	q.local = local
+	if q.cancelled {
+		local.Cancel()
+	}
+	q.mu.Unlock()
+	return local.Exec(ctx)
+}
+
+func (q *localOrRemoteQuery) Stats() *stats.Statistics {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.local != nil {
+		return q.local.Stats()
+	}
+	return q.Query.Stats()
+}
+
+func (q *localOrRemoteQuery) Cancel() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.cancelled = true
+	if q.local != nil {
+		q.local.Cancel()
+	}
+	q.Query.Cancel()
+}
+
+func (q *localOrRemoteQuery) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.local != nil {
+		q.local.Close()
+	}
+	q.Query.Close()
+}
+
+// NewFromPromQLOpts creates an engine from the options used for constructing a Prometheus engine.
+// It allows projects to switch between the two engines with minimal code changes. Options which
+// this engine does not implement, such as MaxSamples, are still applied by the fallback engine.
+func NewFromPromQLOpts(opts promql.EngineOpts) v1.QueryEngine {
+	return New(Opts{EngineOpts: opts})
 }
 
 func New(opts Opts) *compatibilityEngine {
@@ -171,10 +533,20 @@ func New(opts Opts) *compatibilityEngine {
 		level.Debug(opts.Logger).Log("msg", "externallookback delta is zero, setting to default value", "value", 1*24*time.Hour)
 	}
 
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+
 	if opts.EnableXFunctions {
 		parser.Functions["xdelta"] = parse.Functions["xdelta"]
 		parser.Functions["xincrease"] = parse.Functions["xincrease"]
 		parser.Functions["xrate"] = parse.Functions["xrate"]
+		parser.Functions["xsmoothincrease"] = parse.Functions["xsmoothincrease"]
+	}
+	if opts.EnableExperimentalFunctions {
+		for name, f := range parse.ExperimentalFunctions {
+			parser.Functions[name] = f
+		}
 	}
 
 	metrics := &engineMetrics{
@@ -194,6 +566,25 @@ func New(opts Opts) *compatibilityEngine {
 				Help:      "Number of PromQL queries.",
 			}, []string{"fallback"},
 		),
+		batchDurations: promauto.With(opts.Reg).NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "operator_batch_duration_seconds",
+				Help:      "Wall time spent by operators on producing a batch of steps, including time spent waiting for child operators.",
+				Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+			}, []string{"operator"},
+		),
+	}
+
+	var inflight *inflightQueries
+	if opts.EnableQuerySnapshots {
+		inflight = newInflightQueries()
+	}
+
+	var planCache *logicalplan.PlanCache
+	if opts.PlanCacheSize > 0 {
+		planCache = logicalplan.NewPlanCache(opts.PlanCacheSize)
 	}
 
 	var engine v1.QueryEngine
@@ -214,6 +605,43 @@ func New(opts Opts) *compatibilityEngine {
 		timeout:           opts.Timeout,
 		metrics:           metrics,
 		extLookbackDelta:  opts.ExtLookbackDelta,
+		seriesRefCache:    opts.SeriesRefCache,
+		seriesCache:       opts.SeriesCache,
+		planCache:         planCache,
+		timeSplitRange:    opts.TimeSplitRange,
+		queryTracker:      opts.ActiveQueryTracker,
+		inflight:          inflight,
+
+		enableChunkQuerying:   opts.EnableChunkQuerying,
+		maxRegexComplexity:    opts.MaxRegexComplexity,
+		rejectUnbounded:       opts.RejectUnboundedSelectors,
+		selectiveMatchers:     opts.SelectiveMatchers,
+		warnOnRegexComplexity: opts.WarnOnRegexComplexity,
+		regexResolutionLimit:  opts.RegexResolutionLimit,
+		enableInfoAnnotations: opts.EnableInfoAnnotations,
+		enableLabelAudit:      opts.EnableLabelAudit,
+		enableQueryReceipts:   opts.EnableQueryReceipts,
+		enableStreamingSeries: opts.EnableStreamingSeries,
+		delayNameRemoval:      opts.EnableDelayedNameRemoval,
+		streamingAggregation:  opts.EnableStreamingAggregation,
+		parallelAggregation:   opts.EnableParallelAggregation,
+		maxPointsPerWindow:    opts.MaxPointsPerWindow,
+		truncateWindows:       opts.TruncateWindows,
+		joinMemoryLimit:       opts.JoinMemoryLimit,
+		spillDirectory:        opts.SpillDirectory,
+
+		dedupPolicy:            opts.DedupPolicy,
+		dedupConflictTolerance: opts.DedupConflictTolerance,
+		dedupReplicaLabels:     opts.DedupReplicaLabels,
+		remoteRetryPolicy:      opts.RemoteRetryPolicy,
+		remoteEngineTimeout:    opts.RemoteEngineTimeout,
+
+		futureTimestamps: opts.FutureTimestamps,
+		maxFutureSkew:    opts.MaxFutureSkew,
+		now:              opts.Now,
+
+		enableOperatorTracing:        opts.EnableOperatorTracing,
+		operatorTracingCostThreshold: opts.OperatorTracingCostThreshold,
 	}
 }
 
@@ -230,18 +658,149 @@ type compatibilityEngine struct {
 	metrics           *engineMetrics
 
 	extLookbackDelta time.Duration
+	queryTracker     promql.QueryTracker
+	// inflight tracks executing queries for snapshots. It is nil when snapshots are disabled.
+	inflight *inflightQueries
+	// seriesRefCache is nil when series computations are not cached across queries.
+	seriesRefCache *engstore.SeriesRefCache
+	// seriesCache is nil when selected series are not cached across queries.
+	seriesCache *engstore.SeriesCache
+	// planCache is nil when plans are not cached across queries.
+	planCache *logicalplan.PlanCache
+	// timeSplitRange is the longest range of the slices of range queries. Queries are not split when it is zero.
+	timeSplitRange time.Duration
+
+	enableChunkQuerying   bool
+	maxRegexComplexity    int
+	rejectUnbounded       bool
+	selectiveMatchers     []*labels.Matcher
+	warnOnRegexComplexity bool
+	regexResolutionLimit  int
+	enableInfoAnnotations bool
+	enableLabelAudit      bool
+	enableQueryReceipts   bool
+	enableStreamingSeries bool
+	delayNameRemoval      bool
+	streamingAggregation  bool
+	parallelAggregation   bool
+	maxPointsPerWindow    int
+	truncateWindows       bool
+	joinMemoryLimit       int64
+	spillDirectory        string
+
+	dedupPolicy            query.DedupPolicy
+	dedupConflictTolerance float64
+	dedupReplicaLabels     []string
+	remoteRetryPolicy      query.RetryPolicy
+	remoteEngineTimeout    time.Duration
+
+	futureTimestamps FutureTimestamps
+	maxFutureSkew    time.Duration
+	now              func() time.Time
+
+	enableOperatorTracing        bool
+	operatorTracingCostThreshold float64
 }
 
 func (e *compatibilityEngine) SetQueryLogger(l promql.QueryLogger) {
 	e.prom.SetQueryLogger(l)
 }
 
-func (e *compatibilityEngine) NewInstantQuery(q storage.Queryable, opts *promql.QueryOpts, qs string, ts time.Time) (promql.Query, error) {
+func (e *compatibilityEngine) queryOptions(start, end time.Time, step, lookbackDelta time.Duration) *query.Options {
+	return &query.Options{
+		Start:                      start,
+		End:                        end,
+		Step:                       step,
+		LookbackDelta:              lookbackDelta,
+		ExtLookbackDelta:           e.extLookbackDelta,
+		RegexResolutionLimit:       e.regexResolutionLimit,
+		EnableInfoAnnotations:      e.enableInfoAnnotations,
+		EnableStreamingSeries:      e.enableStreamingSeries,
+		EnableDelayedNameRemoval:   e.delayNameRemoval,
+		EnableStreamingAggregation: e.streamingAggregation,
+		EnableParallelAggregation:  e.parallelAggregation,
+		MaxPointsPerWindow:         e.maxPointsPerWindow,
+		TruncateWindows:            e.truncateWindows,
+		JoinMemoryLimit:            e.joinMemoryLimit,
+		SpillDirectory:             e.spillDirectory,
+		TrackOperatorState:         e.inflight != nil,
+		AuditLabels:                e.enableLabelAudit,
+		BatchDurations:             e.metrics.batchDurations,
+
+		DedupPolicy:            e.dedupPolicy,
+		DedupConflictTolerance: e.dedupConflictTolerance,
+		DedupReplicaLabels:     e.dedupReplicaLabels,
+		RetryPolicy:            e.remoteRetryPolicy,
+		RemoteTimeout:          e.remoteEngineTimeout,
+	}
+}
+
+// traceOperators returns true if the operators of a query with the given estimated cost are traced.
+func (e *compatibilityEngine) traceOperators(cost float64) bool {
+	return e.enableOperatorTracing && cost >= e.operatorTracingCostThreshold
+}
+
+func (e *compatibilityEngine) checkRegexComplexity(expr parser.Expr) error {
+	if e.maxRegexComplexity <= 0 {
+		return nil
+	}
+	err := logicalplan.CheckRegexComplexity(expr, e.maxRegexComplexity)
+	if err != nil && e.warnOnRegexComplexity {
+		level.Warn(e.logger).Log("msg", "query contains a complex regex matcher", "expr", expr.String(), "err", err)
+		return nil
+	}
+	return err
+}
+
+func (e *compatibilityEngine) queryable(q storage.Queryable) storage.Queryable {
+	if cq, ok := q.(storage.ChunkQueryable); ok && e.enableChunkQuerying {
+		if e.seriesCache != nil {
+			return engstore.NewCachedChunkQueryable(cq, e.seriesCache)
+		}
+		return engstore.NewChunkQueryable(cq)
+	}
+	if e.seriesCache != nil {
+		return engstore.NewCachedQueryable(q, e.seriesCache)
+	}
+	return q
+}
+
+// plan parses and optimizes the plan of a query, or returns it from the plan cache
+// if it was already planned by a previous query.
+func (e *compatibilityEngine) plan(qs string, rangeQuery bool, planOpts *logicalplan.Opts) (parser.Expr, logicalplan.Plan, error) {
+	key := logicalplan.PlanCacheKey{Query: qs, Range: rangeQuery, LookbackDelta: planOpts.LookbackDelta}
+	if e.planCache != nil {
+		if cached, ok := e.planCache.Get(key); ok {
+			return cached.Expr, cached.Plan(planOpts), nil
+		}
+	}
+
 	expr, err := parser.ParseExpr(qs)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if err := e.checkRegexComplexity(expr); err != nil {
+		return nil, nil, err
 	}
+	if e.rejectUnbounded {
+		if err := logicalplan.CheckUnboundedSelectors(expr, e.selectiveMatchers); err != nil {
+			return nil, nil, err
+		}
+	}
+	// Use same check as Prometheus for range queries.
+	if rangeQuery && expr.Type() != parser.ValueTypeVector && expr.Type() != parser.ValueTypeScalar {
+		return nil, nil, errors.Newf("invalid expression type %q for range query, must be Scalar or instant Vector", parser.DocumentedType(expr.Type()))
+	}
+
+	lplan := logicalplan.New(expr, planOpts)
+	lplan = lplan.Optimize(e.logicalOptimizers)
+	if e.planCache != nil {
+		e.planCache.Add(key, expr, lplan)
+	}
+	return expr, lplan, nil
+}
 
+func (e *compatibilityEngine) NewInstantQuery(q storage.Queryable, opts *promql.QueryOpts, qs string, ts time.Time) (promql.Query, error) {
 	if opts == nil {
 		opts = &promql.QueryOpts{}
 	}
@@ -250,20 +809,29 @@ func (e *compatibilityEngine) NewInstantQuery(q storage.Queryable, opts *promql.
 		opts.LookbackDelta = e.lookbackDelta
 	}
 
-	// determine sorting order before optimizers run, we do this by looking for "sort"
-	// and "sort_desc" and optimize them away afterwards since they are only needed at
-	// the presentation layer and not when computing the results.
-	resultSort := newResultSort(expr)
+	ts, clampWarning := e.clampInstantTimestamp(ts)
 
-	lplan := logicalplan.New(expr, &logicalplan.Opts{
-		Start:         ts,
-		End:           ts,
-		Step:          1,
-		LookbackDelta: opts.LookbackDelta,
-	})
-	lplan = lplan.Optimize(e.logicalOptimizers)
+	planOpts := &logicalplan.Opts{
+		Start:            ts,
+		End:              ts,
+		Step:             1,
+		LookbackDelta:    opts.LookbackDelta,
+		ExtLookbackDelta: e.extLookbackDelta,
+	}
+	expr, lplan, err := e.plan(qs, false, planOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	// determine sorting order from the syntax tree, we do this by looking for "sort"
+	// and "sort_desc" which the optimizers remove from the plan since they are only
+	// needed at the presentation layer and not when computing the results.
+	resultSort := newResultSort(expr)
 
-	exec, err := execution.New(lplan.Expr(), q, ts, ts, 0, opts.LookbackDelta, e.extLookbackDelta)
+	cost := logicalplan.EstimateCost(lplan.Root(), planOpts)
+	queryOpts := e.queryOptions(ts, ts, 0, opts.LookbackDelta)
+	queryOpts.TraceOperators = e.traceOperators(cost)
+	exec, err := execution.New(lplan.Root(), e.queryable(q), queryOpts)
 	if e.triggerFallback(err) {
 		e.metrics.queries.WithLabelValues("true").Inc()
 		return e.prom.NewInstantQuery(q, opts, qs, ts)
@@ -278,26 +846,62 @@ func (e *compatibilityEngine) NewInstantQuery(q storage.Queryable, opts *promql.
 	}
 
 	return &compatibilityQuery{
-		Query:      &Query{exec: exec, opts: opts},
-		engine:     e,
-		expr:       expr,
-		ts:         ts,
-		t:          InstantQuery,
-		resultSort: resultSort,
+		Query:        &Query{exec: exec, opts: opts, plan: lplan, cost: cost, traced: queryOpts.TraceOperators},
+		engine:       e,
+		queryable:    q,
+		expr:         expr,
+		ts:           ts,
+		t:            InstantQuery,
+		resultSort:   resultSort,
+		clampWarning: clampWarning,
 	}, nil
 }
 
 func (e *compatibilityEngine) NewRangeQuery(q storage.Queryable, opts *promql.QueryOpts, qs string, start, end time.Time, step time.Duration) (promql.Query, error) {
-	expr, err := parser.ParseExpr(qs)
+	return e.newRangeQuery(q, opts, qs, start, end, step, nil)
+}
+
+// NewRangeQueryAtTimestamps creates a range query which is evaluated at the given timestamps
+// instead of at a fixed step, for example at calendar month boundaries. Timestamps have to be
+// sorted in ascending order. Such queries are not supported by the fallback engine.
+func (e *compatibilityEngine) NewRangeQueryAtTimestamps(q storage.Queryable, opts *promql.QueryOpts, qs string, timestamps []time.Time) (promql.Query, error) {
+	if len(timestamps) == 0 {
+		return nil, errors.New("at least one evaluation timestamp is required")
+	}
+
+	ts := make([]int64, len(timestamps))
+	step := time.Duration(0)
+	for i := range timestamps {
+		ts[i] = timestamps[i].UnixMilli()
+		if i == 0 {
+			continue
+		}
+		if ts[i] <= ts[i-1] {
+			return nil, errors.Newf("evaluation timestamps must be sorted in ascending order, got %s after %s", timestamps[i], timestamps[i-1])
+		}
+		// The smallest interval between timestamps is used as the step for selecting series.
+		if interval := timestamps[i].Sub(timestamps[i-1]); step == 0 || interval < step {
+			step = interval
+		}
+	}
+	return e.newRangeQuery(q, opts, qs, timestamps[0], timestamps[len(timestamps)-1], step, ts)
+}
+
+// NewCalendarRangeQuery creates a range query which is evaluated at calendar boundaries of the given
+// location between start and end, such as at every midnight for a "1d" step or at the first day of
+// every month for a "1M" step.
+func (e *compatibilityEngine) NewCalendarRangeQuery(q storage.Queryable, opts *promql.QueryOpts, qs string, start, end time.Time, step query.CalendarStep, loc *time.Location) (promql.Query, error) {
+	timestamps, err := query.CalendarTimestamps(start, end, step, loc)
 	if err != nil {
 		return nil, err
 	}
-
-	// Use same check as Prometheus for range queries.
-	if expr.Type() != parser.ValueTypeVector && expr.Type() != parser.ValueTypeScalar {
-		return nil, errors.Newf("invalid expression type %q for range query, must be Scalar or instant Vector", parser.DocumentedType(expr.Type()))
+	if len(timestamps) == 0 {
+		return nil, errors.Newf("no %s calendar boundary between %s and %s", step, start, end)
 	}
+	return e.NewRangeQueryAtTimestamps(q, opts, qs, timestamps)
+}
 
+func (e *compatibilityEngine) newRangeQuery(q storage.Queryable, opts *promql.QueryOpts, qs string, start, end time.Time, step time.Duration, timestamps []int64) (promql.Query, error) {
 	if opts == nil {
 		opts = &promql.QueryOpts{}
 	}
@@ -306,16 +910,30 @@ func (e *compatibilityEngine) NewRangeQuery(q storage.Queryable, opts *promql.Qu
 		opts.LookbackDelta = e.lookbackDelta
 	}
 
-	lplan := logicalplan.New(expr, &logicalplan.Opts{
-		Start:         start,
-		End:           end,
-		Step:          step,
-		LookbackDelta: opts.LookbackDelta,
-	})
-	lplan = lplan.Optimize(e.logicalOptimizers)
+	start, end, timestamps, clampWarning := e.clampRangeTimestamps(start, end, step, timestamps)
 
-	exec, err := execution.New(lplan.Expr(), q, start, end, step, opts.LookbackDelta, e.extLookbackDelta)
-	if e.triggerFallback(err) {
+	planOpts := &logicalplan.Opts{
+		Start:            start,
+		End:              end,
+		Step:             step,
+		LookbackDelta:    opts.LookbackDelta,
+		ExtLookbackDelta: e.extLookbackDelta,
+	}
+	expr, lplan, err := e.plan(qs, true, planOpts)
+	if err != nil {
+		return nil, err
+	}
+	// Slices depend on the time range of the query, so queries are split after the plan is retrieved from the cache.
+	if e.timeSplitRange > 0 {
+		lplan = lplan.Optimize([]logicalplan.Optimizer{logicalplan.TimeSplitOptimizer{SliceRange: e.timeSplitRange}})
+	}
+
+	cost := logicalplan.EstimateCost(lplan.Root(), planOpts)
+	queryOpts := e.queryOptions(start, end, step, opts.LookbackDelta)
+	queryOpts.Timestamps = timestamps
+	queryOpts.TraceOperators = e.traceOperators(cost)
+	exec, err := execution.New(lplan.Root(), e.queryable(q), queryOpts)
+	if e.triggerFallback(err) && timestamps == nil {
 		e.metrics.queries.WithLabelValues("true").Inc()
 		return e.prom.NewRangeQuery(q, opts, qs, start, end, step)
 	}
@@ -329,16 +947,33 @@ func (e *compatibilityEngine) NewRangeQuery(q storage.Queryable, opts *promql.Qu
 	}
 
 	return &compatibilityQuery{
-		Query:  &Query{exec: exec, opts: opts},
-		engine: e,
-		expr:   expr,
-		t:      RangeQuery,
+		Query:        &Query{exec: exec, opts: opts, plan: lplan, cost: cost, traced: queryOpts.TraceOperators},
+		engine:       e,
+		queryable:    q,
+		expr:         expr,
+		t:            RangeQuery,
+		clampWarning: clampWarning,
 	}, nil
 }
 
 type Query struct {
-	exec model.VectorOperator
-	opts *promql.QueryOpts
+	exec   model.VectorOperator
+	opts   *promql.QueryOpts
+	plan   logicalplan.Plan
+	cost   float64
+	traced bool
+}
+
+// EstimatedCost returns the cost of the query as estimated from its plan by logicalplan.EstimateCost.
+func (q *Query) EstimatedCost() float64 {
+	return q.cost
+}
+
+// SelectorRanges returns the time range of samples which each selector of the
+// optimized plan reads from storage, including lookback, offsets and @ modifiers.
+// It can be used to compute cache keys or to check whether the data is retained.
+func (q *Query) SelectorRanges() []logicalplan.SelectorRange {
+	return q.plan.SelectorRanges()
 }
 
 // Explain returns human-readable explanation of the created executor.
@@ -347,6 +982,13 @@ func (q *Query) Explain() string {
 	return "not implemented"
 }
 
+// Analyze returns the analysis of the operators of the query. The label copies and sorts
+// of operators are only counted when the engine is created with EnableLabelAudit, and
+// are complete once the query was executed.
+func (q *Query) Analyze() execution.OperatorAnalysis {
+	return execution.Analyze(q.exec)
+}
+
 func (q *Query) Profile() {
 	// TODO(bwplotka): Return profile.
 }
@@ -366,6 +1008,11 @@ type sortFuncResultSort struct {
 	sortOrder sortOrder
 }
 
+type labelResultSort struct {
+	sortingLabels []string
+	sortOrder     sortOrder
+}
+
 type aggregateResultSort struct {
 	sortingLabels []string
 	groupBy       bool
@@ -378,12 +1025,21 @@ type noSortResultSort struct {
 
 func newResultSort(expr parser.Expr) resultSorter {
 	switch texpr := expr.(type) {
+	case *parser.ParenExpr:
+		// Parentheses do not change the order of the result of the inner expression.
+		return newResultSort(texpr.Expr)
+	case *parser.StepInvariantExpr:
+		return newResultSort(texpr.Expr)
 	case *parser.Call:
 		switch texpr.Func.Name {
 		case "sort":
 			return sortFuncResultSort{sortOrder: sortOrderAsc}
 		case "sort_desc":
 			return sortFuncResultSort{sortOrder: sortOrderDesc}
+		case "sort_by_label":
+			return labelResultSort{sortingLabels: stringArgs(texpr.Args[1:]), sortOrder: sortOrderAsc}
+		case "sort_by_label_desc":
+			return labelResultSort{sortingLabels: stringArgs(texpr.Args[1:]), sortOrder: sortOrderDesc}
 		}
 	case *parser.AggregateExpr:
 		switch texpr.Op {
@@ -423,6 +1079,44 @@ func (s sortFuncResultSort) comparer(samples *promql.Vector) func(i, j int) bool
 	}
 }
 
+// comparer orders samples by the values of the sorting labels in turn,
+// and by their full label sets when all sorting labels are equal.
+func (s labelResultSort) comparer(samples *promql.Vector) func(i, j int) bool {
+	return func(i, j int) bool {
+		iMetric, jMetric := (*samples)[i].Metric, (*samples)[j].Metric
+		cmp := 0
+		for _, l := range s.sortingLabels {
+			if cmp = strings.Compare(iMetric.Get(l), jMetric.Get(l)); cmp != 0 {
+				break
+			}
+		}
+		if cmp == 0 {
+			cmp = labels.Compare(iMetric, jMetric)
+		}
+		if s.sortOrder == sortOrderDesc {
+			return cmp > 0
+		}
+		return cmp < 0
+	}
+}
+
+func stringArgs(args parser.Expressions) []string {
+	result := make([]string, 0, len(args))
+	for _, arg := range args {
+		for {
+			paren, ok := arg.(*parser.ParenExpr)
+			if !ok {
+				break
+			}
+			arg = paren.Expr
+		}
+		if s, ok := arg.(*parser.StringLiteral); ok {
+			result = append(result, s.Val)
+		}
+	}
+	return result
+}
+
 func (s aggregateResultSort) comparer(samples *promql.Vector) func(i, j int) bool {
 	return func(i int, j int) bool {
 		var iLbls labels.Labels
@@ -447,11 +1141,15 @@ func (s aggregateResultSort) comparer(samples *promql.Vector) func(i, j int) boo
 
 type compatibilityQuery struct {
 	*Query
-	engine     *compatibilityEngine
+	engine *compatibilityEngine
+	// queryable is the queryable passed by the caller, which scopes cached series references.
+	queryable  storage.Queryable
 	expr       parser.Expr
 	ts         time.Time // Empty for range queries.
 	t          QueryType
 	resultSort resultSorter
+	// clampWarning is reported with the result when the evaluation time was clamped.
+	clampWarning error
 
 	cancel context.CancelFunc
 }
@@ -474,27 +1172,88 @@ func (q *compatibilityQuery) Exec(ctx context.Context) (ret *promql.Result) {
 	defer cancel()
 	q.cancel = cancel
 
+	if q.engine.queryTracker != nil {
+		queryIndex, err := q.engine.queryTracker.Insert(ctx, q.expr.String())
+		if err != nil {
+			return newErrResult(ret, err)
+		}
+		defer q.engine.queryTracker.Delete(queryIndex)
+	}
+	if q.engine.inflight != nil {
+		q.engine.inflight.add(q)
+		defer q.engine.inflight.remove(q)
+	}
+
+	if q.traced {
+		var span trace.Span
+		ctx, span = trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).Start(ctx, "query.exec", trace.WithAttributes(
+			attribute.String("query", q.expr.String()),
+			attribute.Float64("estimated_cost", q.cost),
+		))
+		defer span.End()
+	}
+
+	ctx = warnings.NewContext(ctx)
+	defer func() {
+		ret.Warnings = warnings.FromContext(ctx)
+	}()
+	if q.clampWarning != nil {
+		warnings.AddToContext(q.clampWarning, ctx)
+	}
+
+	if q.engine.enableLabelAudit {
+		ctx = audit.NewContext(ctx)
+		defer q.reportLabelStats(ctx)
+	}
+	if q.engine.enableQueryReceipts {
+		ctx = receipt.NewContext(ctx)
+		defer q.reportReceipt(ctx)
+	}
+	if q.engine.seriesRefCache != nil {
+		ctx = engstore.WithSeriesRefCache(ctx, q.engine.seriesRefCache, q.queryable)
+	}
+
 	resultSeries, err := q.Query.exec.Series(ctx)
 	if err != nil {
 		return newErrResult(ret, err)
 	}
-	if containsDuplicateLabelSet(resultSeries) {
-		return newErrResult(ret, errors.New("vector cannot contain metrics with the same labelset"))
+	if q.engine.delayNameRemoval {
+		resultSeries = model.RemoveMarkedNames(resultSeries)
 	}
+	// Series with the same labels are merged into one result series, and only samples
+	// from such series in the same step are rejected, as in the Prometheus engine.
+	resultSeries, seriesIndex := mergeDuplicateLabelSets(resultSeries)
 
 	series := make([]promql.Series, len(resultSeries))
 	for i := 0; i < len(resultSeries); i++ {
 		series[i].Metric = resultSeries[i]
 	}
+
+	var (
+		checkpoints CheckpointSink
+		// checkpointed is the last step for which a checkpoint was emitted.
+		checkpointed int64 = math.MinInt64
+	)
+	if q.t == RangeQuery {
+		checkpoints = checkpointSinkFromContext(ctx)
+	}
+	// fail returns the error of the query. Queries with checkpoints also return the results of all steps
+	// up to the last checkpoint, since resumed queries start after it.
+	fail := func(err error) *promql.Result {
+		if checkpoints != nil {
+			ret.Value = rangeMatrix(series, checkpointed)
+		}
+		return newErrResult(ret, err)
+	}
 loop:
 	for {
 		select {
 		case <-ctx.Done():
-			return newErrResult(ret, ctx.Err())
+			return fail(ctx.Err())
 		default:
 			r, err := q.Query.exec.Next(ctx)
 			if err != nil {
-				return newErrResult(ret, err)
+				return fail(err)
 			}
 			if r == nil {
 				break loop
@@ -507,7 +1266,14 @@ loop:
 			}
 
 			for _, vector := range r {
-				for i, s := range vector.SampleIDs {
+				for i, sampleID := range vector.SampleIDs {
+					s := sampleID
+					if seriesIndex != nil {
+						s = seriesIndex[sampleID]
+						if hasSampleAt(series[s], vector.T) {
+							return fail(errDuplicateLabelSet)
+						}
+					}
 					if len(series[s].Floats) == 0 {
 						series[s].Floats = make([]promql.FPoint, 0, 121) // Typically 1h of data.
 					}
@@ -516,7 +1282,14 @@ loop:
 						F: vector.Samples[i],
 					})
 				}
-				for i, s := range vector.HistogramIDs {
+				for i, sampleID := range vector.HistogramIDs {
+					s := sampleID
+					if seriesIndex != nil {
+						s = seriesIndex[sampleID]
+						if hasSampleAt(series[s], vector.T) {
+							return fail(errDuplicateLabelSet)
+						}
+					}
 					if len(series[s].Histograms) == 0 {
 						series[s].Histograms = make([]promql.HPoint, 0, 121) // Typically 1h of data.
 					}
@@ -527,21 +1300,17 @@ loop:
 				}
 				q.Query.exec.GetPool().PutStepVector(vector)
 			}
+			if checkpoints != nil && len(r) > 0 {
+				checkpointed = r[len(r)-1].T
+				checkpoints.Checkpoint(time.UnixMilli(checkpointed))
+			}
 			q.Query.exec.GetPool().PutVectors(r)
 		}
 	}
 
 	// For range Query we expect always a Matrix value type.
 	if q.t == RangeQuery {
-		resultMatrix := make(promql.Matrix, 0, len(series))
-		for _, s := range series {
-			if len(s.Floats)+len(s.Histograms) == 0 {
-				continue
-			}
-			resultMatrix = append(resultMatrix, s)
-		}
-		sort.Sort(resultMatrix)
-		ret.Value = resultMatrix
+		ret.Value = rangeMatrix(series, math.MaxInt64)
 		return ret
 	}
 
@@ -588,6 +1357,25 @@ loop:
 	return ret
 }
 
+func (q *compatibilityQuery) reportLabelStats(ctx context.Context) {
+	stats, ok := audit.FromContext(ctx)
+	if !ok {
+		return
+	}
+	level.Debug(q.engine.logger).Log("msg", "label allocation audit", "expr", q.expr.String(), "copies", stats.Copies, "sorts", stats.Sorts)
+	if q.engine.debugWriter != nil {
+		_, _ = fmt.Fprintln(q.engine.debugWriter, stats.String())
+	}
+}
+
+func (q *compatibilityQuery) reportReceipt(ctx context.Context) {
+	r, ok := receipt.FromContext(ctx)
+	if !ok {
+		return
+	}
+	warnings.AddToContext(errors.Newf("PromQL info: %s", r), ctx)
+}
+
 func newErrResult(r *promql.Result, err error) *promql.Result {
 	if r == nil {
 		r = &promql.Result{}
@@ -598,20 +1386,76 @@ func newErrResult(r *promql.Result, err error) *promql.Result {
 	return r
 }
 
-func containsDuplicateLabelSet(series []labels.Labels) bool {
+// rangeMatrix returns the sorted non-empty series of a range query with their samples up to until.
+func rangeMatrix(series []promql.Series, until int64) promql.Matrix {
+	matrix := make(promql.Matrix, 0, len(series))
+	for _, s := range series {
+		for len(s.Floats) > 0 && s.Floats[len(s.Floats)-1].T > until {
+			s.Floats = s.Floats[:len(s.Floats)-1]
+		}
+		for len(s.Histograms) > 0 && s.Histograms[len(s.Histograms)-1].T > until {
+			s.Histograms = s.Histograms[:len(s.Histograms)-1]
+		}
+		if len(s.Floats)+len(s.Histograms) == 0 {
+			continue
+		}
+		matrix = append(matrix, s)
+	}
+	sort.Sort(matrix)
+	return matrix
+}
+
+var errDuplicateLabelSet = errors.New("vector cannot contain metrics with the same labelset")
+
+// mergeDuplicateLabelSets returns the distinct label sets of series. If series contains
+// duplicate label sets, it also returns a mapping from the position of each series
+// to the position of its label set in the result.
+func mergeDuplicateLabelSets(series []labels.Labels) ([]labels.Labels, []uint64) {
 	if len(series) <= 1 {
-		return false
+		return series, nil
 	}
-	var h uint64
-	buf := make([]byte, 0)
-	seen := make(map[uint64]struct{}, len(series))
+	var (
+		buf     = make([]byte, 0)
+		seen    = make(map[string]uint64, len(series))
+		index   []uint64
+		deduped []labels.Labels
+	)
 	for i := range series {
-		buf = buf[:0]
-		h = xxhash.Sum64(series[i].Bytes(buf))
-		if _, ok := seen[h]; ok {
-			return true
+		buf = series[i].Bytes(buf)
+		id, ok := seen[string(buf)]
+		if !ok {
+			id = uint64(len(seen))
+			seen[string(buf)] = id
+		}
+		if ok && index == nil {
+			// Lazily build the index on the first duplicate.
+			index = make([]uint64, len(series))
+			deduped = make([]labels.Labels, 0, len(series))
+			for j := 0; j < i; j++ {
+				index[j] = uint64(j)
+				deduped = append(deduped, series[j])
+			}
 		}
-		seen[h] = struct{}{}
+		if index != nil {
+			index[i] = id
+			if !ok {
+				deduped = append(deduped, series[i])
+			}
+		}
+	}
+	if index == nil {
+		return series, nil
+	}
+	return deduped, index
+}
+
+// hasSampleAt returns true if the last sample of s is at timestamp t.
+func hasSampleAt(s promql.Series, t int64) bool {
+	if n := len(s.Floats); n > 0 && s.Floats[n-1].T == t {
+		return true
+	}
+	if n := len(s.Histograms); n > 0 && s.Histograms[n-1].T == t {
+		return true
 	}
 	return false
 }
@@ -4,15 +4,19 @@
 package engine_test
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"math"
 	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -21,19 +25,28 @@ import (
 	"github.com/google/go-cmp/cmp/cmpopts"
 
 	"github.com/thanos-community/promql-engine/engine"
+	"github.com/thanos-community/promql-engine/execution"
+	engstore "github.com/thanos-community/promql-engine/execution/storage"
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
 	"github.com/thanos-community/promql-engine/logicalplan"
+	"github.com/thanos-community/promql-engine/query"
 
+	"github.com/efficientgo/core/errors"
 	"github.com/efficientgo/core/testutil"
 	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/model/timestamp"
+	"github.com/prometheus/prometheus/model/value"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
 	"github.com/prometheus/prometheus/tsdb/tsdbutil"
 	"github.com/prometheus/prometheus/util/stats"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/goleak"
+	"golang.org/x/exp/slices"
 )
 
 func TestMain(m *testing.M) {
@@ -118,6 +131,26 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
 				       http_requests_total{pod="nginx-2", route="/"} 1`,
 			query: "stddev by (pod) (http_requests_total)",
 		},
+		{
+			name: "stddev and stdvar without grouping labels",
+			load: `load 30s
+				       http_requests_total{pod="nginx-1", route="/"} 1+1x15
+				       http_requests_total{pod="nginx-2", route="/"} 2+3x15
+				       http_requests_total{pod="nginx-3", route="/"} NaN`,
+			query: `stddev(http_requests_total) + stdvar(http_requests_total{pod!="nginx-3"})`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(300, 0),
+		},
+		{
+			name: "quantile without grouping labels",
+			load: `load 30s
+				       http_requests_total{pod="nginx-1", route="/"} 1+1x15
+				       http_requests_total{pod="nginx-2", route="/"} 2+3x15
+				       http_requests_total{pod="nginx-3", route="/"} 5+2x15`,
+			query: "quantile(0.9, http_requests_total)",
+			start: time.Unix(0, 0),
+			end:   time.Unix(300, 0),
+		},
 		{
 			name: "aggregate without",
 			load: `load 30s
@@ -175,6 +208,54 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
 					http_requests_total{pod="nginx-2"} 1+2x18`,
 			query: "deriv(http_requests_total[30s])",
 		},
+		{
+			name: "deriv over a long range",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15 0+3x20
+					http_requests_total{pod="nginx-2"} 1+2.5x18 _x3 4 7 1 2`,
+			query: "deriv(http_requests_total[3m])",
+		},
+		{
+			name: "predict_linear",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15 0+3x20
+					http_requests_total{pod="nginx-2"} 1+2.5x18 _x3 4 7 1 2`,
+			query: "predict_linear(http_requests_total[2m], 300)",
+		},
+		{
+			name: "predict_linear with offset and negative duration",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15 0+3x20
+					http_requests_total{pod="nginx-2"} 1+2.5x18 _x3 4 7 1 2`,
+			query: "predict_linear(http_requests_total[1m] offset 1m, -60)",
+		},
+		{
+			name: "predict_linear with step dependent duration",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15 0+3x20
+					http_requests_total{pod="nginx-2"} 1+2.5x18 _x3 4 7 1 2`,
+			query: "predict_linear(http_requests_total[2m], time() / 10)",
+		},
+		{
+			name: "holt_winters",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15 0+3x20
+					http_requests_total{pod="nginx-2"} 1+2.5x18 _x3 4 7 1 2`,
+			query: "holt_winters(http_requests_total[3m], 0.3, 0.6)",
+		},
+		{
+			name: "holt_winters with step dependent factors",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15 0+3x20
+					http_requests_total{pod="nginx-2"} 1+2.5x18 _x3 4 7 1 2`,
+			query: "holt_winters(http_requests_total[3m], 0.5, time() / 1000)",
+		},
+		{
+			name: "holt_winters with invalid smoothing factor",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15`,
+			query: "holt_winters(http_requests_total[3m], 1, 0.5)",
+		},
 		{
 			name: "abs",
 			load: `load 30s
@@ -559,6 +640,16 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
 			end:   time.Unix(3000, 0),
 			step:  2 * time.Second,
 		},
+		{
+			name: "irate and idelta with many points per range",
+			load: `load 10s
+				http_requests_total{pod="nginx-1"} 1+1.1x100 0+3x50
+				http_requests_total{pod="nginx-2"} 2+2.3x40 _x20 stale 5+1x60`,
+			query: "irate(http_requests_total[5m]) - idelta(http_requests_total[3m])",
+			start: time.Unix(0, 0),
+			end:   time.Unix(2000, 0),
+			step:  25 * time.Second,
+		},
 		{
 			name:  "number literal",
 			load:  "",
@@ -569,6 +660,54 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
 			load:  "",
 			query: "vector(24)",
 		},
+		{
+			name: "timestamp",
+			load: `load 7s
+				foo{method="get"} 1+1x20
+				foo{method="put"} 1+2x20`,
+			query: "timestamp(foo)",
+		},
+		{
+			name: "timestamp with offset",
+			load: `load 7s
+				foo{method="get"} 1+1x20
+				foo{method="put"} 1+2x20`,
+			query: "timestamp(foo offset 1m)",
+		},
+		{
+			name: "timestamp with parentheses",
+			load: `load 7s
+				foo{method="get"} 1+1x20
+				foo{method="put"} 1+2x20`,
+			query: "timestamp(((foo)))",
+		},
+		{
+			name: "timestamp with @ modifier",
+			load: `load 7s
+				foo{method="get"} 1+1x20
+				foo{method="put"} 1+2x20`,
+			query: "timestamp(foo @ 50)",
+		},
+		{
+			name: "timestamp of a sparse series",
+			load: `load 7s
+				foo{method="get"} 1 _ _ 4 _ _ _ 8 _ _ _ _ 13`,
+			query: "timestamp(foo)",
+		},
+		{
+			name: "timestamp of a function",
+			load: `load 7s
+				foo{method="get"} 1+1x20
+				foo{method="put"} 1+2x20`,
+			query: "timestamp(abs(foo))",
+		},
+		{
+			name: "timestamp in a binary expression",
+			load: `load 7s
+				foo{method="get"} 1+1x20
+				foo{method="put"} 1+2x20`,
+			query: "time() - timestamp(foo)",
+		},
 		{
 			name: "binary operation atan2",
 			load: `load 30s
@@ -583,6 +722,39 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
          bar{} NaN`,
 			query: "foo atan2 bar",
 		},
+		{
+			name: "binary operation atan2 with scalar",
+			load: `load 30s
+				foo{method="get"} 1+1x10
+				foo{method="put"} -1-2x10`,
+			query: "foo atan2 2",
+		},
+		{
+			name: "binary operation atan2 with scalar on the left hand side",
+			load: `load 30s
+				foo{method="get"} 1+1x10
+				foo{method="put"} -1-2x10`,
+			query: "-2 atan2 foo",
+		},
+		{
+			name: "binary operation atan2 with vector matching",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1x10
+				foo{method="get", code="404"} -2-1x10
+				foo{method="put", code="501"} 3+1x10
+				bar{method="get"} -1+2x10
+				bar{method="put"} 2-1x10`,
+			query: "foo atan2 on (method) group_left bar",
+		},
+		{
+			name: "binary operation atan2 with ignoring",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1x10
+				foo{method="put", code="501"} 3+1x10
+				bar{method="get", code="500", pod="nginx-1"} -1+2x10
+				bar{method="put", code="501", pod="nginx-1"} 2-1x10`,
+			query: "foo atan2 ignoring (pod) bar",
+		},
 		{
 			name: "binary operation with one-to-one matching",
 			load: `load 30s
@@ -662,6 +834,63 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
 			start: time.Unix(0, 0),
 			end:   time.Unix(600, 0),
 		},
+		{
+			name: "binary operation with group_left and labels included from an info metric",
+			load: `load 30s
+				http_requests_total{instance="a", path="/"} 1+1x40
+				http_requests_total{instance="a", path="/api"} 2+3x40
+				http_requests_total{instance="b", path="/"} 1+2x40
+				build_info{instance="a", version="1.0"} 1x10
+				build_info{instance="a", version="1.1"} _x24 1x15
+				build_info{instance="b"} 1x40`,
+			query: `http_requests_total * on(instance) group_left(version) build_info`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(1200, 0),
+		},
+		{
+			name: "binary operation with group_right overriding labels from the one side",
+			load: `load 30s
+				http_requests_total{instance="a", version="0.9", path="/"} 1+1x40
+				http_requests_total{instance="a", version="0.9", path="/api"} 2+3x40
+				build_info{instance="a", version="1.0"} 1x40`,
+			query: `build_info * on(instance) group_right(version) http_requests_total`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(1200, 0),
+		},
+		{
+			name: "binary operation with group_left and multiple matches on the many side",
+			load: `load 30s
+				foo{instance="a", version="0.9"} 1+1x40
+				foo{instance="a", version="1.0"} 2+3x40
+				bar{instance="a", version="1.1"} 1x40`,
+			query: `foo * on(instance) group_left(version) bar`,
+		},
+		{
+			name: "binary operation with group_left and multiple matches on the many side in different steps",
+			load: `load 30s
+				foo{instance="a", version="0.9"} 1+1x10
+				foo{instance="a", version="1.0"} _x20 2+3x20
+				bar{instance="a", version="1.1"} 1x40`,
+			query: `foo * on(instance) group_left(version) bar`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(1200, 0),
+		},
+		{
+			name: "binary operation with one-to-one matching and multiple matches on the left side",
+			load: `load 30s
+				foo{instance="a", path="/"} 1+1x40
+				foo{instance="a", path="/api"} 2+3x40
+				bar{instance="a"} 1x40`,
+			query: `foo * on(instance) bar`,
+		},
+		{
+			name: "binary operation with one-to-one matching and unmatched duplicates on the right side",
+			load: `load 30s
+				foo{instance="a"} 1+1x40
+				bar{instance="b", path="/"} 1x40
+				bar{instance="b", path="/api"} 1x40`,
+			query: `foo * on(instance) bar`,
+		},
 		{
 			name: "binary operation with vector and scalar on the right",
 			load: `load 30s
@@ -710,6 +939,157 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
 				bar{code="200", method="post"} 1+1x20`,
 			query: `foo + on(code) group_right bar`,
 		},
+		{
+			name: "binary operation with and",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1x40
+				foo{method="get", code="404"} 1+2x40
+				foo{method="post", code="500"} 1+3x40
+				bar{method="get", code="500"} 1+1.1x20
+				bar{method="post", code="404"} 1+2.1x40`,
+			query: `foo and bar`,
+		},
+		{
+			name: "binary operation with and on",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1x40
+				foo{method="get", code="404"} 1+2x40
+				foo{method="post", code="500"} 1+3x40
+				bar{method="get", code="200"} 1+1.1x20
+				bar{method="put", code="404"} 1+2.1x40`,
+			query: `foo and on(method) bar`,
+		},
+		{
+			name: "binary operation with and ignoring",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1x40
+				foo{method="get", code="404"} 1+2x40
+				foo{method="post", code="500"} 1+3x40
+				bar{method="get", code="200"} 1+1.1x20
+				bar{method="put", code="404"} 1+2.1x40`,
+			query: `foo and ignoring(code) bar`,
+		},
+		{
+			name: "binary operation with unless",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1x40
+				foo{method="get", code="404"} 1+2x40
+				foo{method="post", code="500"} 1+3x40
+				bar{method="get", code="500"} 1+1.1x20
+				bar{method="post", code="404"} 1+2.1x40`,
+			query: `foo unless bar`,
+		},
+		{
+			name: "binary operation with unless on",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1x40
+				foo{method="get", code="404"} 1+2x40
+				foo{method="post", code="500"} 1+3x40
+				bar{method="get", code="200"} 1+1.1x20
+				bar{method="put", code="404"} 1+2.1x40`,
+			query: `foo unless on(method) bar`,
+		},
+		{
+			name: "binary operation with or",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1x20
+				foo{method="post", code="500"} 1+3x40
+				bar{method="get", code="500"} 1+1.1x40
+				bar{method="post", code="404"} 1+2.1x40`,
+			query: `foo or bar`,
+		},
+		{
+			name: "binary operation with or ignoring",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1x20
+				foo{method="post", code="500"} 1+3x40
+				bar{method="get", code="404"} 1+1.1x40
+				bar{method="put", code="404"} 1+2.1x40`,
+			query: `foo or ignoring(code) bar`,
+		},
+		{
+			name: "binary operation with or and series with the same labels",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1x10
+				foo{method="post", code="500"} 1+3x40
+				bar{method="get", code="500"} 1+1.1x40`,
+			query: `rate(foo[1m]) or rate(bar[1m])`,
+		},
+		{
+			name: "binary operation with nested set operators",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1x20
+				foo{method="post", code="500"} 1+3x40
+				bar{method="get", code="500"} 1+1.1x40
+				baz{method="post", code="404"} 1+2.1x40`,
+			query: `(foo unless on(method) baz) or (bar and ignoring(code) foo)`,
+		},
+		{
+			name: "binary operation with or and a function dropping metric names",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x21`,
+			query: `atan(http_requests_total or delta({pod="nginx-2"}[3m]))`,
+		},
+		{
+			name: "aggregation and join over binary operations",
+			load: `load 30s
+				http_requests_total{pod="nginx-1", zone="a"} 1+1x15
+				http_requests_total{pod="nginx-2", zone="a"} 1+2x21
+				http_requests_total{pod="nginx-3", zone="b"} 1+3x21
+				http_responses_total{pod="nginx-1", zone="a"} 2+1x15
+				http_responses_total{pod="nginx-2", zone="a"} 2+2x21
+				zone_info{zone="a", region="eu"} 1x40
+				zone_info{zone="b", region="us"} 1x40`,
+			query: `sum by (zone) (http_requests_total * 2) + on(zone) group_left(region) (zone_info * 1)`,
+		},
+		{
+			name: "aggregation by metric name over a comparison",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_responses_total{pod="nginx-1"} 1+2x21
+				http_responses_total{pod="nginx-2"} 1+3x21`,
+			query: `count by (__name__) ({__name__=~"http_.+"} > 5)`,
+		},
+		{
+			name: "aggregations over comparisons with constants",
+			load: `load 30s
+				http_requests_total{pod="nginx-1", zone="a"} 1+1x15
+				http_requests_total{pod="nginx-2", zone="a"} 1+2x21
+				http_requests_total{pod="nginx-3", zone="b"} NaN 1+3x20`,
+			query: `sum by (zone) (http_requests_total > 5) + on(zone) count by (zone) (10 >= http_requests_total)`,
+		},
+		{
+			name: "aggregation over chained comparisons with constants",
+			load: `load 30s
+				http_requests_total{pod="nginx-1", zone="a"} 1+1x15
+				http_requests_total{pod="nginx-2", zone="a"} 1+2x21
+				http_requests_total{pod="nginx-3", zone="b"} 1+3x20`,
+			query: `topk by (zone) (1, (http_requests_total offset 1m) > 5 < 20)`,
+		},
+		{
+			name: "aggregation over set operations",
+			load: `load 30s
+				http_requests_total{pod="nginx-1", zone="a"} 1+1x15
+				http_requests_total{pod="nginx-2", zone="b"} 1+2x21
+				http_responses_total{pod="nginx-1", zone="a"} 2+1x15
+				http_responses_total{pod="nginx-3", zone="b"} 2+2x21`,
+			query: `sum by (zone) (http_requests_total and on(pod) http_responses_total) + on(zone) count by (zone) (http_requests_total or http_responses_total)`,
+		},
+		{
+			name: "function dropping metric names of series in different steps",
+			load: `load 30s
+				foo{pod="nginx-1"} 1+1x10
+				bar{pod="nginx-1"} _x20 1+2x10`,
+			query: `abs({__name__=~"foo|bar"})`,
+		},
+		{
+			name: "function dropping metric names of series in the same step",
+			load: `load 30s
+				foo{pod="nginx-1"} 1+1x10
+				bar{pod="nginx-1"} _x5 1+2x10`,
+			query: `abs({__name__=~"foo|bar"})`,
+		},
 		{
 			name: "vector binary op ==",
 			load: `load 30s
@@ -873,6 +1253,50 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
 			load:  ``,
 			query: `1 <= bool 2`,
 		},
+		{
+			name: "vector binary op with bool modifier and ignoring",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1x40
+				foo{method="post", code="500"} 1+2x40
+				bar{method="get", code="404"} 1+1.1x30
+				bar{method="post", code="404"} 1+1.5x30`,
+			query: `foo > bool ignoring(code) bar`,
+		},
+		{
+			name: "vector binary op with bool modifier and group_left",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1x40
+				foo{method="get", code="404"} 1+2x40
+				bar{method="get", path="/a"} 1+1.1x30`,
+			query: `foo <= bool on(method) group_left(path) bar`,
+		},
+		{
+			name: "vector binary op with bool modifier and NaN values",
+			load: `load 30s
+				foo{method="get", code="500"} NaN 1 NaN 2 3 NaN
+				bar{method="get", code="500"} 1 NaN NaN 2 1 1`,
+			query: `foo == bool bar`,
+		},
+		{
+			name: "vector binary op with bool modifier and scalar function",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1x40`,
+			query: `foo >= bool time() / 30`,
+		},
+		{
+			name: "scalar binary op with bool modifier and scalar functions",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1x40
+				bar{method="get", code="500"} 5x40`,
+			query: `scalar(foo) > bool scalar(bar)`,
+		},
+		{
+			name: "nested binary ops with bool modifier",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1x40
+				bar{method="get", code="500"} 5x40`,
+			query: `(foo > bool bar) + (bar < bool 10) * 2`,
+		},
 		{
 			name:  "scalar binary op % 0",
 			load:  ``,
@@ -888,6 +1312,35 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
 			load:  ``,
 			query: `2 ^ 2`,
 		},
+		{
+			name:  "nested scalar binary ops",
+			load:  ``,
+			query: `(2 * 3 - 1) / 4 ^ 2 % 3`,
+		},
+		{
+			name:  "scalar binary op with NaN and Inf",
+			load:  ``,
+			query: `(NaN + 1) * -Inf`,
+		},
+		{
+			name: "scalar binary ops with scalar functions",
+			load: `load 30s
+				foo{method="get"} 1+1x40
+				bar{method="get"} 5+0.5x20`,
+			query: `2 * 3 + scalar(foo) - scalar(bar) / time()`,
+		},
+		{
+			name: "scalar binary ops with scalar function of missing series",
+			load: `load 30s
+				foo{method="get"} 1+1x40`,
+			query: `2 * scalar(bar) + scalar(foo)`,
+		},
+		{
+			name: "scalar binary ops with negated scalar function",
+			load: `load 30s
+				foo{method="get"} 1+1x40`,
+			query: `-(2 * scalar(foo)) + 1`,
+		},
 		{
 			name:  "empty series",
 			load:  "",
@@ -943,6 +1396,14 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
 					http_requests_total{pod="nginx-2"} 1+2x18`,
 			query: `present_over_time(http_requests_total[30s])`,
 		},
+		{
+			name: "present_over_time with gaps and stale markers",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1 _x8 2 stale _x10 3 4 stale
+					http_requests_total{pod="nginx-2"} _x5 1+2x3 _x20 5 stale 6`,
+			query: `present_over_time(http_requests_total[2m])`,
+			step:  10 * time.Second,
+		},
 		{
 			name: "complex binary with aggregation",
 			load: `load 30s
@@ -1102,6 +1563,20 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
 			query: "max(http_requests_total @ end()) / max(http_responses_total)",
 			end:   time.Unix(600, 0),
 		},
+		{
+			name: "set operation with empty @ modifier operand",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "nonexistent @ 100 or http_requests_total unless http_requests_total @ 10000",
+		},
+		{
+			name: "aggregation with @ modifier and constant",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "sum(http_requests_total @ 100) * (2 + 3) or vector(2)",
+		},
 		{
 			name: "binop with @ end() modifier outside of query range",
 			load: `load 30s
@@ -1143,14 +1618,14 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
 			load: `load 30s
 					http_requests_total{pod="nginx-1"} 1+1x15
 					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "days_in_month(http_requests_total)",
+			query: "day_of_week(http_requests_total)",
 		},
 		{
 			name: "day_of_week without input",
 			load: `load 30s
 					http_requests_total{pod="nginx-1"} 1+1x15
 					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "days_in_month()",
+			query: "day_of_week()",
 		},
 		{
 			name: "day_of_year with input",
@@ -1222,6 +1697,28 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
 					http_requests_total{pod="nginx-2"} 1+2x18`,
 			query: "year()",
 		},
+		{
+			name: "date functions with timestamps as input",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1706740200+3600x48
+					http_requests_total{pod="nginx-2"} 1709245800+86400x2`,
+			query: `day_of_month(http_requests_total) + 100 * month(http_requests_total) + 10000 * day_of_week(http_requests_total) + 100000 * days_in_month(http_requests_total)`,
+		},
+		{
+			name: "date functions with expression as input",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `hour(http_requests_total * 3600 + 1706740200) * 60 + minute(vector(time() + 1706740200))`,
+		},
+		{
+			name: "date functions without input across days",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15`,
+			query: `hour() * 60 + minute() + 10000 * day_of_year() + 1000000 * year()`,
+			start: time.Unix(1704065400, 0),
+			end:   time.Unix(1704069000, 0),
+		},
 		{
 			name: "selector merge",
 			load: `load 30s
@@ -1297,6 +1794,82 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
 			http_requests_total{pod="nginx-2"} 1+2x18`,
 			query: `10 + scalar(max(http_requests_total))`,
 		},
+		{
+			name: "scalar func with series appearing and disappearing",
+			load: `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} _x5 1+2x5`,
+			query: `scalar(http_requests_total)`,
+		},
+		{
+			name: "scalar func with count",
+			load: `load 30s
+			up{job="api", instance="a"} 1x20
+			up{job="api", instance="b"} _x5 1x10
+			http_requests_total{job="api", instance="a"} 1+1x20
+			http_requests_total{job="api", instance="b"} 1+3x20`,
+			query: `http_requests_total > scalar(count(up{job="api"})) * 5`,
+		},
+		{
+			name: "scalar func with count of missing series",
+			load: `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x15`,
+			query: `scalar((count(up)))`,
+		},
+		{
+			name: "scalar func with missing series",
+			load: `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x15`,
+			query: `scalar(max(up))`,
+		},
+		{
+			name: "scalar func with grouped count",
+			load: `load 30s
+			up{job="api", instance="a"} 1x20
+			up{job="db", instance="b"} _x5 1x10`,
+			query: `scalar(count by (job) (up))`,
+		},
+		{
+			name: "round with to-nearest argument",
+			load: `load 30s
+			http_requests_total{pod="nginx-1"} 1+1.13x40
+			http_requests_total{pod="nginx-2"} -3.27-0.71x40`,
+			query: `round(http_requests_total, 0.1)`,
+		},
+		{
+			name: "round with to-nearest expression",
+			load: `load 30s
+			http_requests_total{pod="nginx-1"} 1+1.13x40
+			http_requests_total{pod="nginx-2"} -3.27-0.71x40
+			threshold{pod="nginx-1"} _x10 3+1x30`,
+			query: `round(http_requests_total, scalar(threshold) / 7)`,
+		},
+		{
+			name: "round with time based to-nearest argument",
+			load: `load 30s
+			http_requests_total{pod="nginx-1"} 1+13.7x40`,
+			query: `round(http_requests_total, time() / 300 + 1)`,
+		},
+		{
+			name: "vector func",
+			load: `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x15`,
+			query: `vector(1)`,
+		},
+		{
+			name: "vector func with scalar func",
+			load: `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `vector(scalar(max(http_requests_total))) * 2`,
+		},
+		{
+			name: "time func minus aggregation",
+			load: `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `time() - max(http_requests_total)`,
+		},
 		{
 			name: "quantile",
 			load: `load 30s
@@ -1315,42 +1888,72 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
 			query: `clamp(http_requests_total, 5, 10)`,
 		},
 		{
-			name: "clamp_min",
+			name: "clamp with scalar expression bounds",
 			load: `load 30s
 			http_requests_total{pod="nginx-1"} 1+1x15
-			http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `clamp_min(http_requests_total, 10)`,
+			http_requests_total{pod="nginx-2"} 1+2x18
+			bounds{type="min"} 1+1x30
+			bounds{type="max"} 20-1x30`,
+			query: `clamp(http_requests_total, scalar(bounds{type="min"}), scalar(bounds{type="max"}))`,
 		},
 		{
-			name: "complex func query",
+			name: "clamp with time based bounds",
 			load: `load 30s
 			http_requests_total{pod="nginx-1"} 1+1x15
 			http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `clamp(1 - http_requests_total, 10 - 5, 10)`,
+			query: `clamp(http_requests_total, time() / 100, 30 - time() / 60)`,
 		},
 		{
-			name: "func within func query",
+			name: "clamp_max with scalar expression bound",
 			load: `load 30s
 			http_requests_total{pod="nginx-1"} 1+1x15
 			http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `clamp(irate(http_requests_total[30s]), 10 - 5, 10)`,
+			query: `clamp_max(http_requests_total, scalar(min(http_requests_total)) + 2)`,
 		},
 		{
-			name: "aggr within func query",
+			name: "clamp with missing scalar bound",
 			load: `load 30s
 			http_requests_total{pod="nginx-1"} 1+1x15
 			http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `clamp(rate(http_requests_total[30s]), 10 - 5, 10)`,
+			query: `clamp(http_requests_total, scalar(nonexistent), 10)`,
 		},
 		{
-			name: "func with scalar arg that selects storage",
+			name: "clamp_min",
 			load: `load 30s
 			http_requests_total{pod="nginx-1"} 1+1x15
 			http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `clamp_min(http_requests_total, scalar(max(http_requests_total)))`,
+			query: `clamp_min(http_requests_total, 10)`,
 		},
 		{
-			name: "func with scalar arg that selects storage + number",
+			name: "complex func query",
+			load: `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `clamp(1 - http_requests_total, 10 - 5, 10)`,
+		},
+		{
+			name: "func within func query",
+			load: `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `clamp(irate(http_requests_total[30s]), 10 - 5, 10)`,
+		},
+		{
+			name: "aggr within func query",
+			load: `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `clamp(rate(http_requests_total[30s]), 10 - 5, 10)`,
+		},
+		{
+			name: "func with scalar arg that selects storage",
+			load: `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `clamp_min(http_requests_total, scalar(max(http_requests_total)))`,
+		},
+		{
+			name: "func with scalar arg that selects storage + number",
 			load: `load 30s
 			http_requests_total{pod="nginx-1"} 1+1x15
 			http_requests_total{pod="nginx-2"} 1+2x18`,
@@ -1435,6 +2038,119 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
 			http_requests_total{pod="nginx-2", le="+Inf"} 4+1x10`,
 			query: `histogram_quantile(0.9, sum by (pod, le) (rate(http_requests_total[2m])))`,
 		},
+		{
+			name: "repeated aggregation",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `sum by (pod) (rate(http_requests_total[1m])) / on (pod) sum by (pod) (rate(http_requests_total[1m]))`,
+		},
+		{
+			name: "repeated function call",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `sum(rate(http_requests_total[1m])) / count(rate(http_requests_total[1m])) + rate(http_requests_total[1m]) * 2`,
+		},
+		{
+			name: "repeated function call with scalar parent",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `rate(http_requests_total[1m]) - rate(http_requests_total[1m]) * scalar(sum(rate(http_requests_total[1m])))`,
+		},
+		{
+			name: "constant operand",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `rate(http_requests_total[1m]) * (60 * 60) - -(2 ^ 3) + 1 / 0`,
+		},
+		{
+			name: "constant function argument",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", le="1"} 1+3x10
+					http_requests_total{pod="nginx-1", le="2"} 1+4x10
+					http_requests_total{pod="nginx-1", le="+Inf"} 1+5x10`,
+			query: `histogram_quantile(0.5 + 0.4, rate(http_requests_total[1m])) > bool (1 < bool 2)`,
+		},
+		{
+			name:  "constant expression",
+			load:  `load 30s`,
+			query: `4 + 0.5 * 2 % 3`,
+		},
+		{
+			name: "literal regex matchers",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", series="1"} 1+1x15
+					http_requests_total{pod="nginx-2", series="2"} 1+2x18
+					http_requests_total{pod="nginx.3", series="3"} 1+3x18`,
+			query: `http_requests_total{pod=~"nginx-1"} or http_requests_total{pod!~"^nginx-1$", series=~"(2)"}`,
+		},
+		{
+			name: "alternation regex matchers",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", series="1"} 1+1x15
+					http_requests_total{pod="nginx-2", series="2"} 1+2x18
+					http_requests_total{pod="nginx.3", series="3"} 1+3x18`,
+			query: `sum by (pod) (rate(http_requests_total{pod=~"^nginx(-|_)[12]$|nginx.3"}[1m]))`,
+		},
+		{
+			name: "anchored regex matchers",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", series="1"} 1+1x15
+					http_requests_total{pod="nginx-2", series="2"} 1+2x18
+					http_requests_total{pod="nginx.3", series="3"} 1+3x18`,
+			query: `http_requests_total{pod=~"^(nginx-.*)$"} + on (series) http_requests_total{pod!~"^nginx\\..+$"}`,
+		},
+		{
+			name: "implied matchers",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `rate(http_requests_total{pod="nginx-1", pod=~"nginx-.*"}[1m]) + http_requests_total{pod=~"nginx-1|nginx-2", pod="nginx-2"}`,
+		},
+		{
+			name: "contradicting matchers",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `rate(http_requests_total{pod="nginx-1", pod!~"nginx-.*"}[1m]) or http_requests_total{pod="nginx-1", pod="nginx-2"} or vector(1)`,
+		},
+		{
+			name: "contradicting matchers in aggregation",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `count(http_requests_total{pod="", pod!=""}) or vector(scalar(sum(http_requests_total{pod="nginx-1", pod="nginx-2"})))`,
+		},
+		{
+			name: "matchers propagated to selector of another metric",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", job="api"} 1+1x15
+					http_requests_total{pod="nginx-2", job="web"} 1+2x18
+					http_responses_total{pod="nginx-1", job="api"} 2+1x15
+					http_responses_total{pod="nginx-2", job="web"} 3+2x18`,
+			query: `http_requests_total{job="api"} - http_responses_total`,
+		},
+		{
+			name: "matchers propagated through on",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", job="api"} 1+1x15
+					http_requests_total{pod="nginx-2", job="web"} 1+2x18
+					http_responses_total{pod="nginx-1", job="api", instance="a"} 2+1x15
+					http_responses_total{pod="nginx-2", job="web", instance="b"} 3+2x18`,
+			query: `http_requests_total{job="api"} / on (job) http_responses_total + on (job, pod) group_left http_requests_total{pod=~"nginx-.*"}`,
+		},
+		{
+			name: "matchers propagated through ignoring",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", job="api"} 1+1x15
+					http_requests_total{pod="nginx-2", job="web"} 1+2x18
+					http_responses_total{pod="nginx-1", job="api", instance="a"} 2+1x15
+					http_responses_total{pod="nginx-1", job="web", instance="b"} 3+2x18`,
+			query: `http_responses_total{job="web"} - ignoring (instance) group_left http_requests_total{pod="nginx-1"}`,
+		},
 		{
 			name: "histogram quantile with scalar operator",
 			load: `load 30s
@@ -1448,6 +2164,73 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
 			http_requests_total{pod="nginx-2", le="+Inf"} 4+1x10`,
 			query: `histogram_quantile(scalar(max(quantile)), http_requests_total)`,
 		},
+		{
+			name: "count_values",
+			load: `load 30s
+				http_requests_total{pod="nginx-1", series="1"} 1+1x40
+				http_requests_total{pod="nginx-2", series="1"} 2+1x50
+				http_requests_total{pod="nginx-4", series="2"} 1+2x50
+				http_requests_total{pod="nginx-5", series="2"} 0.5+0.5x50`,
+			query: `count_values("value", http_requests_total)`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(1600, 0),
+			step:  20 * time.Second,
+		},
+		{
+			name: "count_values by",
+			load: `load 30s
+				http_requests_total{pod="nginx-1", series="1"} 1+1x40
+				http_requests_total{pod="nginx-2", series="1"} 2+1x50
+				http_requests_total{pod="nginx-4", series="2"} 1+2x50
+				http_requests_total{pod="nginx-5", series="2"} 0.5+0.5x50`,
+			query: `count_values by (series) ("value", http_requests_total)`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(1600, 0),
+			step:  20 * time.Second,
+		},
+		{
+			name: "count_values without",
+			load: `load 30s
+				http_requests_total{pod="nginx-1", series="1"} 1+1x40
+				http_requests_total{pod="nginx-2", series="1"} 2+1x50
+				http_requests_total{pod="nginx-4", series="2"} 1+2x50`,
+			query: `count_values without (pod) ("series", http_requests_total)`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(1600, 0),
+			step:  20 * time.Second,
+		},
+		{
+			name: "count_values of negative zero sums",
+			load: `load 30s
+				http_requests_total{pod="nginx-1", series="1"} -0 0 -0 1
+				http_requests_total{pod="nginx-2", series="1"} -0 -0 0 1
+				http_requests_total{pod="nginx-3", series="2"} -0 -0 -0 1`,
+			query: `count_values("value", sum by (series) (http_requests_total))`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(120, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name: "count_values of negative zero averages",
+			load: `load 30s
+				http_requests_total{pod="nginx-1", series="1"} -0 0 -0 1
+				http_requests_total{pod="nginx-2", series="1"} -0 -0 0 1
+				http_requests_total{pod="nginx-3", series="2"} -0 -0 -0 1`,
+			query: `count_values("avg", avg by (pod) (http_requests_total))`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(120, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name: "count_values with function",
+			load: `load 30s
+				http_requests_total{pod="nginx-1", series="1"} 1+1x40
+				http_requests_total{pod="nginx-2", series="1"} 2+1x50`,
+			query: `sum by (value) (count_values("value", round(rate(http_requests_total[1m]) * 60)))`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(1600, 0),
+			step:  20 * time.Second,
+		},
 		{
 			name: "topk",
 			load: `load 30s
@@ -1585,6 +2368,34 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
 			end:   time.Unix(500, 0),
 			step:  2 * time.Second,
 		},
+		{
+			name: "topk with parameter changing between steps",
+			load: `load 30s
+				k 0 1 2 3 1 0 2 5 3 1 100
+				http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
+				http_requests_total{pod="nginx-2", series="1"} 2+2.3x50
+				http_requests_total{pod="nginx-4", series="2"} 5+2.4x50
+				http_requests_total{pod="nginx-5", series="2"} 8.4+2.3x50
+				http_requests_total{pod="nginx-6", series="2"} 2.3+2.3x50`,
+			query: "topk(scalar(k), http_requests_total) by (series)",
+			start: time.Unix(0, 0),
+			end:   time.Unix(500, 0),
+			step:  10 * time.Second,
+		},
+		{
+			name: "bottomk with parameter larger than groups",
+			load: `load 30s
+				k 0 1 2 3 1 0 2 5 3 1 100
+				http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
+				http_requests_total{pod="nginx-2", series="1"} 2+2.3x50
+				http_requests_total{pod="nginx-4", series="2"} 5+2.4x50
+				http_requests_total{pod="nginx-5", series="2"} 8.4+2.3x50
+				http_requests_total{pod="nginx-6", series="2"} 2.3+2.3x50`,
+			query: "bottomk(scalar(k) * 1000, http_requests_total) by (series)",
+			start: time.Unix(0, 0),
+			end:   time.Unix(500, 0),
+			step:  10 * time.Second,
+		},
 		{
 			name: "topk with expression as argument not returning any value",
 			load: `load 30s
@@ -1968,6 +2779,25 @@ func TestXFunctions(t *testing.T) {
 				createSample(17000, 20, labels.FromStrings("path", "/bar")),
 			},
 		},
+		// Tests for xSmoothIncrease
+		{
+			name:  "eval instant at 50s xsmoothincrease, with 12s lookback",
+			load:  defaultLoad,
+			query: "xsmoothincrease(http_requests[12s])",
+			expected: []promql.Sample{
+				createSample(defaultQueryTime.UnixMilli(), 24, labels.FromStrings("path", "/foo")),
+				createSample(defaultQueryTime.UnixMilli(), 24, labels.FromStrings("path", "/bar")),
+			},
+		},
+		{
+			name:  "eval instant at 50s xsmoothincrease, with 30s lookback and counter reset",
+			load:  defaultLoad,
+			query: "xsmoothincrease(http_requests[30s])",
+			expected: []promql.Sample{
+				createSample(defaultQueryTime.UnixMilli(), 60, labels.FromStrings("path", "/foo")),
+				createSample(defaultQueryTime.UnixMilli(), 50, labels.FromStrings("path", "/bar")),
+			},
+		},
 		{
 			name:  "eval instant at 50s xrate, with 50s lookback",
 			load:  defaultLoad,
@@ -2496,6 +3326,22 @@ func TestInstantQuery(t *testing.T) {
 			queryTime: time.Unix(160, 0),
 			query:     "increase(http_requests_total[1m] offset 1m)",
 		},
+		{
+			name: "timestamp",
+			load: `load 7s
+				http_requests_total{pod="nginx-1"} 1+1x40
+				http_requests_total{pod="nginx-2"} 1 _ _ 4`,
+			queryTime: time.Unix(160, 0),
+			query:     "timestamp(http_requests_total)",
+		},
+		{
+			name: "timestamp with @ modifier",
+			load: `load 7s
+				http_requests_total{pod="nginx-1"} 1+1x40
+				http_requests_total{pod="nginx-2"} 1 _ _ 4`,
+			queryTime: time.Unix(160, 0),
+			query:     "timestamp(http_requests_total @ 100)",
+		},
 		{
 			name: "round",
 			load: `load 1s
@@ -2540,6 +3386,47 @@ func TestInstantQuery(t *testing.T) {
 			queryTime: time.Unix(0, 0),
 			query:     "sort_desc(http_requests_total)",
 		},
+		{
+			name: "sort with NaN",
+			load: `load 1s
+				       http_requests_total{pod="nginx-1", series="1"} 1
+				       http_requests_total{pod="nginx-2", series="2"} NaN
+				       http_requests_total{pod="nginx-4", series="3"} 5
+				       http_requests_total{pod="nginx-5", series="1"} NaN
+				       http_requests_total{pod="nginx-6", series="2"} -2`,
+			queryTime: time.Unix(0, 0),
+			query:     "sort(http_requests_total)",
+		},
+		{
+			name: "sort_desc with NaN",
+			load: `load 1s
+				       http_requests_total{pod="nginx-1", series="1"} 1
+				       http_requests_total{pod="nginx-2", series="2"} NaN
+				       http_requests_total{pod="nginx-4", series="3"} 5
+				       http_requests_total{pod="nginx-6", series="2"} -2`,
+			queryTime: time.Unix(0, 0),
+			query:     "sort_desc(http_requests_total)",
+		},
+		{
+			name: "sort in parentheses",
+			load: `load 1s
+				       http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
+				       http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
+				       http_requests_total{pod="nginx-4", series="3"} 5+2.4x50
+				       http_requests_total{pod="nginx-6", series="2"} 2.3+2.3x50`,
+			queryTime: time.Unix(0, 0),
+			query:     "(sort_desc(http_requests_total))",
+		},
+		{
+			name: "sort with at modifier",
+			load: `load 1s
+				       http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
+				       http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
+				       http_requests_total{pod="nginx-4", series="3"} 5+2.4x50
+				       http_requests_total{pod="nginx-6", series="2"} 2.3+2.3x50`,
+			queryTime: time.Unix(10, 0),
+			query:     "sort_desc(http_requests_total @ 5)",
+		},
 		{
 			name: "quantile by pod",
 			load: `load 30s
@@ -2967,6 +3854,35 @@ func TestInstantQuery(t *testing.T) {
 			load:  ``,
 			query: `2 ^ 2`,
 		},
+		{
+			name:  "nested scalar binary ops",
+			load:  ``,
+			query: `(2 * 3 - 1) / 4 ^ 2 % 3`,
+		},
+		{
+			name:  "scalar binary op with NaN and Inf",
+			load:  ``,
+			query: `(NaN + 1) * -Inf`,
+		},
+		{
+			name: "scalar binary ops with scalar functions",
+			load: `load 30s
+				foo{method="get"} 1+1x40
+				bar{method="get"} 5+0.5x20`,
+			query: `2 * 3 + scalar(foo) - scalar(bar) / time()`,
+		},
+		{
+			name: "scalar binary ops with scalar function of missing series",
+			load: `load 30s
+				foo{method="get"} 1+1x40`,
+			query: `2 * scalar(bar) + scalar(foo)`,
+		},
+		{
+			name: "scalar binary ops with negated scalar function",
+			load: `load 30s
+				foo{method="get"} 1+1x40`,
+			query: `-(2 * scalar(foo)) + 1`,
+		},
 		{
 			name:  "empty series",
 			load:  "",
@@ -3221,6 +4137,74 @@ func TestInstantQuery(t *testing.T) {
 				http_requests_total{pod="nginx-3", series="1"} NaN`,
 			query: "sgn(http_requests_total)",
 		},
+		{
+			name: "duplicate series on the right side of one-to-one matching",
+			load: `load 30s
+				foo{job="api", instance="a"} 1+1x10
+				bar{job="api", instance="b"} 1+2x10
+				bar{job="api", instance="c"} 1+3x10`,
+			query: "foo + on(job) bar",
+		},
+		{
+			name: "duplicate series on the right side of group_left",
+			load: `load 30s
+				foo{job="api", instance="a"} 1+1x10
+				foo{job="api", instance="b"} 1+1x10
+				bar{job="api", version="1"} 1+2x10
+				bar{job="api", version="2"} 1+3x10`,
+			query: "foo * on(job) group_left(version) bar",
+		},
+		{
+			name: "duplicate series on the left side of group_right",
+			load: `load 30s
+				foo{job="api", version="1"} 1+2x10
+				foo{job="api", version="2"} 1+3x10
+				bar{job="api", instance="a"} 1+1x10
+				bar{job="api", instance="b"} 1+1x10`,
+			query: "foo * on(job) group_right(version) bar",
+		},
+		{
+			name: "duplicate series on the right side without samples on the left side",
+			load: `load 30s
+				foo{job="api", instance="a"} 1+1x10
+				bar{job="api", instance="b"} 1+2x10
+				bar{job="api", instance="c"} 1+3x10`,
+			query: `foo{instance="b"} + on(job) bar`,
+		},
+		{
+			name: "duplicate series on the left side of one-to-one matching filtered by a comparison",
+			load: `load 30s
+				foo{a="1", b="x"} 1+1x10
+				foo{a="1", b="y"} 2+1x10
+				bar{a="1"} 100`,
+			query: "foo > on(a) bar",
+		},
+		{
+			name: "duplicate series on the left side of one-to-one matching with a single kept sample",
+			load: `load 30s
+				foo{a="1", b="x"} 1+1x10
+				foo{a="1", b="y"} 200+1x10
+				bar{a="1"} 100`,
+			query: "foo > on(a) bar",
+		},
+		{
+			name: "duplicate series on both sides of one-to-one matching",
+			load: `load 30s
+				foo{a="1", b="x"} 1+1x10
+				foo{a="1", b="y"} 2+1x10
+				qux{a="1", b="p"} 3+1x10
+				qux{a="1", b="q"} 4+1x10`,
+			query: "foo * ignoring(b) qux",
+		},
+		{
+			name: "duplicate series on both sides of group_left",
+			load: `load 30s
+				foo{a="1", b="x"} 1+1x10
+				foo{a="1", b="y"} 2+1x10
+				qux{a="1", b="p"} 3+1x10
+				qux{a="1", b="q"} 4+1x10`,
+			query: "foo * on(a) group_left(b) qux",
+		},
 	}
 
 	disableOptimizerOpts := []bool{true, false}
@@ -3700,8 +4684,8 @@ func TestFallback(t *testing.T) {
 	end := time.Unix(120, 0)
 	step := time.Second * 30
 
-	// TODO(fpetkovski): Update this expression once we add support for predict_linear.
-	query := `predict_linear(http_requests_total{pod="nginx-1"}[5m], 10)`
+	// TODO(fpetkovski): Update this expression once we add support for quantile_over_time.
+	query := `quantile_over_time(0.9, http_requests_total{pod="nginx-1"}[5m])`
 	load := `load 30s
 				http_requests_total{pod="nginx-1"} 1+1x1
 				http_requests_total{pod="nginx-2"} 1+2x40`
@@ -3731,622 +4715,3854 @@ func TestFallback(t *testing.T) {
 	}
 }
 
-func TestQueryStats(t *testing.T) {
+func TestChunkQuerying(t *testing.T) {
+	start := time.Unix(6000, 0)
+	end := time.Unix(9000, 0)
+	step := time.Minute
+
+	load := `load 10s
+				http_requests_total{pod="nginx-1"} 1+1x1000
+				http_requests_total{pod="nginx-2"} 1+2x500 1+3x500
+				http_requests_total{pod="nginx-3"} 1+1x200 _x300 1+5x500`
+	queries := []string{
+		`http_requests_total`,
+		`rate(http_requests_total[5m])`,
+		`sum by (pod) (increase(http_requests_total[10m]))`,
+		`max_over_time(http_requests_total[1h])`,
+		`http_requests_total offset 2h`,
+	}
+	opts := promql.EngineOpts{
+		Timeout:    1 * time.Hour,
+		MaxSamples: math.MaxInt64,
+	}
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	for _, query := range queries {
+		t.Run(query, func(t *testing.T) {
+			oldEngine := promql.NewEngine(opts)
+			q1, err := oldEngine.NewRangeQuery(test.Storage(), nil, query, start, end, step)
+			testutil.Ok(t, err)
+			defer q1.Close()
+			oldResult := q1.Exec(context.Background())
+			testutil.Ok(t, oldResult.Err)
+
+			newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true, EnableChunkQuerying: true})
+			q2, err := newEngine.NewRangeQuery(test.Storage(), nil, query, start, end, step)
+			testutil.Ok(t, err)
+			defer q2.Close()
+			newResult := q2.Exec(context.Background())
+			testutil.Ok(t, newResult.Err)
+
+			testutil.Equals(t, oldResult, newResult)
+		})
+	}
+}
+
+type checkpointRecorder struct {
+	checkpoints  []time.Time
+	onCheckpoint func()
+}
+
+func (c *checkpointRecorder) Checkpoint(ts time.Time) {
+	c.checkpoints = append(c.checkpoints, ts)
+	if c.onCheckpoint != nil {
+		c.onCheckpoint()
+	}
+}
+
+func TestQueryCheckpoints(t *testing.T) {
 	start := time.Unix(0, 0)
-	end := time.Unix(120, 0)
-	step := time.Second * 30
+	end := time.Unix(1800, 0)
+	step := time.Minute
 
-	query := `http_requests_total{pod="nginx-1"}`
 	load := `load 30s
-				http_requests_total{pod="nginx-1"} 1+1x1
-				http_requests_total{pod="nginx-2"} 1+2x1`
+				http_requests_total{pod="nginx-1"} 1+1x60
+				http_requests_total{pod="nginx-2"} 1+2x60`
 	opts := promql.EngineOpts{
-		Timeout:    2 * time.Second,
+		Timeout:    1 * time.Hour,
 		MaxSamples: math.MaxInt64,
 	}
 
 	test, err := promql.NewTest(t, load)
 	testutil.Ok(t, err)
 	defer test.Close()
+	testutil.Ok(t, test.Run())
 
-	newEngine := engine.New(engine.Opts{DisableFallback: true, EngineOpts: opts})
-	q, err := newEngine.NewRangeQuery(test.Storage(), nil, query, start, end, step)
+	newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true})
+	q, err := newEngine.NewRangeQuery(test.Storage(), nil, `sum(rate(http_requests_total[2m]))`, start, end, step)
 	testutil.Ok(t, err)
-	stats.NewQueryStats(q.Stats())
+	defer q.Close()
+
+	recorder := &checkpointRecorder{}
+	result := q.Exec(engine.WithCheckpointSink(context.Background(), recorder))
+	testutil.Ok(t, result.Err)
+	testutil.Equals(t, []time.Time{
+		time.Unix(540, 0),
+		time.Unix(1140, 0),
+		time.Unix(1740, 0),
+		time.Unix(1800, 0),
+	}, recorder.checkpoints)
+
+	// Resuming from the first checkpoint yields the remaining steps.
+	q, err = newEngine.NewRangeQuery(test.Storage(), nil, `sum(rate(http_requests_total[2m]))`, recorder.checkpoints[0].Add(step), end, step)
+	testutil.Ok(t, err)
+	defer q.Close()
+	resumed := q.Exec(context.Background())
+	testutil.Ok(t, resumed.Err)
 
-	q, err = newEngine.NewInstantQuery(test.Storage(), nil, query, end)
+	matrix, err := result.Matrix()
 	testutil.Ok(t, err)
-	stats.NewQueryStats(q.Stats())
-}
+	resumedMatrix, err := resumed.Matrix()
+	testutil.Ok(t, err)
+	var remaining []promql.FPoint
+	for _, p := range matrix[0].Floats {
+		if p.T > recorder.checkpoints[0].UnixMilli() {
+			remaining = append(remaining, p)
+		}
+	}
+	testutil.Equals(t, remaining, resumedMatrix[0].Floats)
 
-func storageWithMockSeries(mockSeries ...*mockSeries) *storage.MockQueryable {
-	series := make([]storage.Series, 0, len(mockSeries))
-	for _, mock := range mockSeries {
-		series = append(series, storage.Series(mock))
-	}
-	return storageWithSeries(series...)
-}
-
-func storageWithSeries(series ...storage.Series) *storage.MockQueryable {
-	return &storage.MockQueryable{
-		MockQuerier: &storage.MockQuerier{
-			SelectMockFunction: func(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
-				result := make([]storage.Series, 0)
-			loopSeries:
-				for _, s := range series {
-					for _, m := range matchers {
-						lbl := s.Labels().Get(m.Name)
-						if lbl != "" && !m.Matches(lbl) {
-							continue loopSeries
-						}
-					}
-					result = append(result, s)
-				}
-				return newTestSeriesSet(result...)
-			},
-		},
+	// An interrupted query returns the results of all checkpointed steps.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupting := &checkpointRecorder{onCheckpoint: cancel}
+	q, err = newEngine.NewRangeQuery(test.Storage(), nil, `sum(rate(http_requests_total[2m]))`, start, end, step)
+	testutil.Ok(t, err)
+	defer q.Close()
+	interrupted := q.Exec(engine.WithCheckpointSink(ctx, interrupting))
+	testutil.NotOk(t, interrupted.Err)
+	testutil.Equals(t, 1, len(interrupting.checkpoints))
+
+	interruptedMatrix, ok := interrupted.Value.(promql.Matrix)
+	testutil.Assert(t, ok, "expected partial matrix result, got %T", interrupted.Value)
+	var delivered []promql.FPoint
+	for _, p := range matrix[0].Floats {
+		if p.T <= interrupting.checkpoints[0].UnixMilli() {
+			delivered = append(delivered, p)
+		}
 	}
+	testutil.Equals(t, delivered, interruptedMatrix[0].Floats)
 }
 
-type byTimestamps mockSeries
+func TestRegexComplexityLimit(t *testing.T) {
+	query := `http_requests_total{pod=~"(nginx-[0-9]{1,30}){1,30}"}`
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x10`
 
-func (b byTimestamps) Len() int {
-	return len(b.timestamps)
-}
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
 
-func (b byTimestamps) Less(i, j int) bool {
-	return b.timestamps[i] < b.timestamps[j]
-}
+	for _, warn := range []bool{true, false} {
+		t.Run(fmt.Sprintf("warn=%t", warn), func(t *testing.T) {
+			newEngine := engine.New(engine.Opts{
+				EngineOpts:            promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64},
+				MaxRegexComplexity:    1000,
+				WarnOnRegexComplexity: warn,
+			})
+			q, err := newEngine.NewInstantQuery(test.Storage(), nil, query, time.Unix(300, 0))
+			if !warn {
+				testutil.NotOk(t, err)
+				testutil.Assert(t, errors.Is(err, logicalplan.ErrRegexTooComplex))
+				return
+			}
+			testutil.Ok(t, err)
+			defer q.Close()
 
-func (b byTimestamps) Swap(i, j int) {
-	b.timestamps[i], b.timestamps[j] = b.timestamps[j], b.timestamps[i]
-	b.values[i], b.values[j] = b.values[j], b.values[i]
+			result := q.Exec(context.Background())
+			testutil.Ok(t, result.Err)
+			vector, err := result.Vector()
+			testutil.Ok(t, err)
+			testutil.Equals(t, 1, len(vector))
+		})
+	}
 }
 
-type mockSeries struct {
-	labels     []string
-	timestamps []int64
-	values     []float64
-}
+func TestRangeTooSmallAnnotation(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x40
+				http_requests_total{pod="nginx-2"} 1+2x40`
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
 
-func newMockSeries(labels []string, timestamps []int64, values []float64) *mockSeries {
-	for i := range timestamps {
-		timestamps[i] = timestamps[i] * 1000
+	cases := []struct {
+		query             string
+		enableAnnotations bool
+		expected          int
+	}{
+		{query: `rate(http_requests_total[20s])`, enableAnnotations: true, expected: 1},
+		{query: `sum(increase(http_requests_total[25s]))`, enableAnnotations: true, expected: 1},
+		{query: `rate(http_requests_total[20s])`, enableAnnotations: false, expected: 0},
+		{query: `rate(http_requests_total[2m])`, enableAnnotations: true, expected: 0},
+		{query: `max_over_time(http_requests_total[20s])`, enableAnnotations: true, expected: 0},
 	}
-	return &mockSeries{labels: labels, timestamps: timestamps, values: values}
-}
-
-func (m mockSeries) Labels() labels.Labels {
-	return labels.FromStrings(m.labels...)
-}
+	for _, tcase := range cases {
+		t.Run(fmt.Sprintf("%s/enableAnnotations=%t", tcase.query, tcase.enableAnnotations), func(t *testing.T) {
+			newEngine := engine.New(engine.Opts{
+				EngineOpts:            promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64},
+				DisableFallback:       true,
+				EnableInfoAnnotations: tcase.enableAnnotations,
+			})
+			q, err := newEngine.NewRangeQuery(test.Storage(), nil, tcase.query, time.Unix(0, 0), time.Unix(600, 0), time.Minute)
+			testutil.Ok(t, err)
+			defer q.Close()
 
-func (m mockSeries) Iterator(chunkenc.Iterator) chunkenc.Iterator {
-	return &mockIterator{
-		i:          -1,
-		timestamps: m.timestamps,
-		values:     m.values,
+			result := q.Exec(context.Background())
+			testutil.Ok(t, result.Err)
+			testutil.Equals(t, tcase.expected, len(result.Warnings))
+		})
 	}
 }
 
-type mockIterator struct {
-	i          int
-	timestamps []int64
-	values     []float64
+type queryTracker struct {
+	mu      sync.Mutex
+	active  map[int]string
+	queries []string
 }
 
-func (m *mockIterator) Next() chunkenc.ValueType {
-	m.i++
-	if m.i >= len(m.values) {
-		return chunkenc.ValNone
-	}
-
-	return chunkenc.ValFloat
-}
+func (q *queryTracker) GetMaxConcurrent() int { return 1 }
 
-func (m *mockIterator) Seek(t int64) chunkenc.ValueType {
-	if m.i > -1 && m.i < len(m.timestamps) {
-		currentTS := m.timestamps[m.i]
-		if currentTS > t {
-			return chunkenc.ValFloat
-		}
-	}
-	for {
-		next := m.Next()
-		if next == chunkenc.ValNone {
-			return chunkenc.ValNone
-		}
+func (q *queryTracker) Insert(_ context.Context, query string) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
 
-		if m.AtT() >= t {
-			return next
-		}
-	}
+	q.queries = append(q.queries, query)
+	q.active[len(q.queries)] = query
+	return len(q.queries), nil
 }
 
-func (m *mockIterator) At() (int64, float64) {
-	return m.timestamps[m.i], m.values[m.i]
-}
+func (q *queryTracker) Delete(insertIndex int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
 
-func (m *mockIterator) AtHistogram() (int64, *histogram.Histogram) { return 0, nil }
+	delete(q.active, insertIndex)
+}
 
-func (m *mockIterator) AtFloatHistogram() (int64, *histogram.FloatHistogram) { return 0, nil }
+func TestNewFromPromQLOpts(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x10
+				http_requests_total{pod="nginx-2"} 1+2x10`
 
-func (m *mockIterator) AtT() int64 { return m.timestamps[m.i] }
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
 
-func (m *mockIterator) Err() error { return nil }
+	tracker := &queryTracker{active: make(map[int]string)}
+	newEngine := engine.NewFromPromQLOpts(promql.EngineOpts{
+		Timeout:            1 * time.Hour,
+		MaxSamples:         math.MaxInt64,
+		ActiveQueryTracker: tracker,
+	})
+	q, err := newEngine.NewInstantQuery(test.Storage(), nil, `sum(http_requests_total)`, time.Unix(60, 0))
+	testutil.Ok(t, err)
+	defer q.Close()
 
-type testSeriesSet struct {
-	i      int
-	series []storage.Series
-}
+	result := q.Exec(context.Background())
+	testutil.Ok(t, result.Err)
+	vector, err := result.Vector()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(vector))
+	testutil.Equals(t, float64(8), vector[0].F)
 
-func newTestSeriesSet(series ...storage.Series) storage.SeriesSet {
-	return &testSeriesSet{
-		i:      -1,
-		series: series,
-	}
+	testutil.Equals(t, []string{`sum(http_requests_total)`}, tracker.queries)
+	testutil.Equals(t, 0, len(tracker.active))
 }
 
-func (s *testSeriesSet) Next() bool                 { s.i++; return s.i < len(s.series) }
-func (s *testSeriesSet) At() storage.Series         { return s.series[s.i] }
-func (s *testSeriesSet) Err() error                 { return nil }
-func (s *testSeriesSet) Warnings() storage.Warnings { return nil }
-
-type slowSeries struct{}
+func TestLabelAudit(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x10
+				http_requests_total{pod="nginx-2"} 1+2x10`
 
-func (d slowSeries) Labels() labels.Labels                        { return labels.FromStrings("foo", "bar") }
-func (d slowSeries) Iterator(chunkenc.Iterator) chunkenc.Iterator { return &slowIterator{} }
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
 
-type slowIterator struct {
-	ts int64
+	cases := []struct {
+		query string
+		// expected are the label stats of the audited operators which copied or sorted labels.
+		expected []string
+	}{
+		{query: `http_requests_total`},
+		{
+			query:    `rate(http_requests_total[1m])`,
+			expected: []string{"[*rebalance] label copies: 2, label sorts: 2"},
+		},
+		{
+			query: `sum(rate(http_requests_total[1m])) + abs(http_requests_total * 2)`,
+			expected: []string{
+				"[*rebalance] label copies: 2, label sorts: 2",
+				"[*functionOperator] label copies: 2, label sorts: 0",
+				"[*scalarOperator] label copies: 2, label sorts: 0",
+			},
+		},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.query, func(t *testing.T) {
+			newEngine := engine.New(engine.Opts{
+				EngineOpts:       promql.EngineOpts{Timeout: 1 * time.Hour},
+				DisableFallback:  true,
+				EnableLabelAudit: true,
+			})
+			q, err := newEngine.NewInstantQuery(test.Storage(), nil, tcase.query, time.Unix(60, 0))
+			testutil.Ok(t, err)
+			defer q.Close()
+			testutil.Ok(t, q.Exec(context.Background()).Err)
+
+			var audited []string
+			var collect func(execution.OperatorAnalysis)
+			collect = func(a execution.OperatorAnalysis) {
+				if a.Audited && (a.LabelStats.Copies > 0 || a.LabelStats.Sorts > 0) {
+					operator, _, _ := strings.Cut(a.Operator, " ")
+					audited = append(audited, fmt.Sprintf("%s %s", operator, a.LabelStats))
+				}
+				for _, child := range a.Children {
+					collect(child)
+				}
+			}
+			collect(q.(interface {
+				Analyze() execution.OperatorAnalysis
+			}).Analyze())
+			testutil.Equals(t, tcase.expected, audited)
+		})
+	}
 }
 
-func (d *slowIterator) AtHistogram() (int64, *histogram.Histogram) {
-	panic("not implemented")
-}
+func TestDoubleExponentialSmoothing(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x15 0+3x20
+				http_requests_total{pod="nginx-2"} 1+2.5x18 _x3 4 7 1 2`
 
-func (d *slowIterator) AtFloatHistogram() (int64, *histogram.FloatHistogram) {
-	panic("not implemented")
-}
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
 
-func (d *slowIterator) AtT() int64 {
-	return d.ts
-}
+	var (
+		start = time.Unix(0, 0)
+		end   = time.Unix(1200, 0)
+		step  = 30 * time.Second
+		opts  = promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64}
+	)
+	// Prometheus only supports the function under its previous name.
+	newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true})
+	q1, err := newEngine.NewRangeQuery(test.Storage(), nil, "double_exponential_smoothing(http_requests_total[3m], 0.3, 0.6)", start, end, step)
+	testutil.Ok(t, err)
+	defer q1.Close()
+	newResult := q1.Exec(context.Background())
+	testutil.Ok(t, newResult.Err)
 
-func (d *slowIterator) At() (int64, float64) {
-	return d.ts, 1
-}
+	q2, err := promql.NewEngine(opts).NewRangeQuery(test.Storage(), nil, "holt_winters(http_requests_total[3m], 0.3, 0.6)", start, end, step)
+	testutil.Ok(t, err)
+	defer q2.Close()
+	oldResult := q2.Exec(context.Background())
+	testutil.Ok(t, oldResult.Err)
 
-func (d *slowIterator) Next() chunkenc.ValueType {
-	<-time.After(10 * time.Millisecond)
-	d.ts += 30 * 1000
-	return chunkenc.ValFloat
+	testutil.Equals(t, oldResult.Value, newResult.Value)
 }
 
-func (d *slowIterator) Seek(t int64) chunkenc.ValueType {
-	<-time.After(10 * time.Millisecond)
-	d.ts = t
-	return chunkenc.ValFloat
-}
-func (d *slowIterator) Err() error { return nil }
+func TestMadOverTime(t *testing.T) {
+	load := `load 10s
+				http_requests_total{pod="nginx-1"} 1 2 3 4 100
+				http_requests_total{pod="nginx-2"} 2 4 6 8 10 30`
 
-type mockRuntimeErr struct{}
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
 
-func (m *mockRuntimeErr) Error() string {
-	return "panic!"
-}
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64}
+	newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true, EnableExperimentalFunctions: true})
+	q, err := newEngine.NewInstantQuery(test.Storage(), nil, "mad_over_time(http_requests_total[1m])", time.Unix(50, 0))
+	testutil.Ok(t, err)
+	defer q.Close()
+	result := q.Exec(context.Background())
+	testutil.Ok(t, result.Err)
 
-func (m *mockRuntimeErr) RuntimeError() {
+	expected := promql.Vector{
+		{Metric: labels.FromStrings("pod", "nginx-1"), T: 50000, F: 1},
+		{Metric: labels.FromStrings("pod", "nginx-2"), T: 50000, F: 3},
+	}
+	sortByLabels(result)
+	testutil.Equals(t, expected, result.Value)
 }
 
-func TestEngineRecoversFromPanic(t *testing.T) {
-	t.Parallel()
+func TestTimestampOfOverTime(t *testing.T) {
+	load := `load 10s
+				http_requests_total{pod="nginx-1"} 1 5 3 5 2
+				http_requests_total{pod="nginx-2"} NaN 4 1 1`
 
-	querier := &storage.MockQueryable{
-		MockQuerier: &storage.MockQuerier{
-			SelectMockFunction: func(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
-				panic(runtime.Error(&mockRuntimeErr{}))
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	cases := []struct {
+		query    string
+		expected promql.Vector
+	}{
+		{
+			query: "ts_of_max_over_time(http_requests_total[1m])",
+			expected: promql.Vector{
+				{Metric: labels.FromStrings("pod", "nginx-1"), T: 50000, F: 30},
+				{Metric: labels.FromStrings("pod", "nginx-2"), T: 50000, F: 10},
+			},
+		},
+		{
+			query: "ts_of_min_over_time(http_requests_total[1m])",
+			expected: promql.Vector{
+				{Metric: labels.FromStrings("pod", "nginx-1"), T: 50000, F: 0},
+				{Metric: labels.FromStrings("pod", "nginx-2"), T: 50000, F: 30},
+			},
+		},
+		{
+			query: "ts_of_last_over_time(http_requests_total[1m])",
+			expected: promql.Vector{
+				{Metric: labels.FromStrings("pod", "nginx-1"), T: 50000, F: 40},
+				{Metric: labels.FromStrings("pod", "nginx-2"), T: 50000, F: 30},
+			},
+		},
+		{
+			query: "ts_of_max_over_time(http_requests_total[15s])",
+			expected: promql.Vector{
+				{Metric: labels.FromStrings("pod", "nginx-1"), T: 50000, F: 40},
 			},
 		},
 	}
-	t.Run("instant", func(t *testing.T) {
-		newEngine := engine.New(engine.Opts{
-			DisableFallback: true,
-		})
-		q, err := newEngine.NewInstantQuery(querier, nil, "somequery", time.Time{})
-		testutil.Ok(t, err)
 
-		r := q.Exec(context.Background())
-		testutil.Assert(t, r.Err.Error() == "unexpected error: panic!")
-	})
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64}
+	newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true, EnableExperimentalFunctions: true})
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			q, err := newEngine.NewInstantQuery(test.Storage(), nil, tc.query, time.Unix(50, 0))
+			testutil.Ok(t, err)
+			defer q.Close()
 
-	t.Run("range", func(t *testing.T) {
-		newEngine := engine.New(engine.Opts{
-			DisableFallback: true,
+			result := q.Exec(context.Background())
+			testutil.Ok(t, result.Err)
+			sortByLabels(result)
+			testutil.Equals(t, tc.expected, result.Value)
 		})
-		q, err := newEngine.NewRangeQuery(querier, nil, "somequery", time.Time{}, time.Time{}, 42)
-		testutil.Ok(t, err)
+	}
+}
 
-		r := q.Exec(context.Background())
-		testutil.Assert(t, r.Err.Error() == "unexpected error: panic!")
-	})
-
-}
-
-type histogramTestCase struct {
-	name                   string
-	query                  string
-	wantEmptyForMixedTypes bool
-}
+func TestFirstOverTime(t *testing.T) {
+	load := `load 10s
+				http_requests_total{pod="nginx-1"} 1 2 3 4 5
+				http_requests_total{pod="nginx-2"} _ _ 7 8`
 
-type histogramGeneratorFunc func(app storage.Appender, numSeries int, withMixedTypes bool) error
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
 
-func TestNativeHistograms(t *testing.T) {
-	opts := promql.EngineOpts{
-		Timeout:              1 * time.Hour,
-		MaxSamples:           1e10,
-		EnableNegativeOffset: true,
-		EnableAtModifier:     true,
-	}
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64}
+	newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true, EnableExperimentalFunctions: true})
+	q, err := newEngine.NewRangeQuery(test.Storage(), nil, "first_over_time(http_requests_total[25s])", time.Unix(20, 0), time.Unix(40, 0), 20*time.Second)
+	testutil.Ok(t, err)
+	defer q.Close()
+	result := q.Exec(context.Background())
+	testutil.Ok(t, result.Err)
 
-	cases := []histogramTestCase{
-		{
-			name:  "plain selector",
-			query: "native_histogram_series",
-		},
-		{
-			name:  "irate()",
-			query: "irate(native_histogram_series[1m])",
-		},
+	expected := promql.Matrix{
 		{
-			name:  "rate()",
-			query: "rate(native_histogram_series[1m])",
+			Metric: labels.FromStrings("__name__", "http_requests_total", "pod", "nginx-1"),
+			Floats: []promql.FPoint{{T: 20000, F: 1}, {T: 40000, F: 3}},
 		},
 		{
-			name:  "increase()",
-			query: "increase(native_histogram_series[1m])",
+			Metric: labels.FromStrings("__name__", "http_requests_total", "pod", "nginx-2"),
+			Floats: []promql.FPoint{{T: 20000, F: 7}, {T: 40000, F: 7}},
 		},
+	}
+	testutil.Equals(t, expected, result.Value)
+}
+
+func TestExtendedRangeFunctions(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x40
+				http_requests_total{pod="nginx-2"} 1+2x20 _x5 3+3x10`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64}
+	start, end, step := time.Unix(0, 0), time.Unix(1200, 0), 30*time.Second
+	cases := []struct {
+		query    string
+		expected string
+	}{
+		{query: "rate(http_requests_total[1m])", expected: "xrate(http_requests_total[1m])"},
+		{query: "sum(increase(http_requests_total[2m]))", expected: "sum(xincrease(http_requests_total[2m]))"},
+		{query: "delta(http_requests_total[1m] offset 1m)", expected: "xdelta(http_requests_total[1m] offset 1m)"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true, EnableExtendedRangeFunctions: true})
+			q, err := newEngine.NewRangeQuery(test.Storage(), nil, tc.query, start, end, step)
+			testutil.Ok(t, err)
+			defer q.Close()
+			result := q.Exec(context.Background())
+			testutil.Ok(t, result.Err)
+
+			xEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true, EnableXFunctions: true})
+			q, err = xEngine.NewRangeQuery(test.Storage(), nil, tc.expected, start, end, step)
+			testutil.Ok(t, err)
+			defer q.Close()
+			expected := q.Exec(context.Background())
+			testutil.Ok(t, expected.Err)
+
+			sortByLabels(result)
+			sortByLabels(expected)
+			testutil.WithGoCmp(cmpopts.EquateNaNs()).Equals(t, expected.Value, result.Value)
+		})
+	}
+}
+
+func TestSortByLabel(t *testing.T) {
+	load := `load 10s
+				http_requests_total{pod="nginx-1", route="/"} 1
+				http_requests_total{pod="nginx-2", route="/"} 2
+				http_requests_total{pod="nginx-1", route="/api"} 3
+				http_requests_total{pod="nginx-3"} 4`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	cases := []struct {
+		query    string
+		expected promql.Vector
+	}{
 		{
-			name:  "delta()",
-			query: "delta(native_histogram_series[1m])",
+			query: `sort_by_label(http_requests_total, "route", "pod")`,
+			expected: promql.Vector{
+				{Metric: labels.FromStrings("__name__", "http_requests_total", "pod", "nginx-3"), T: 0, F: 4},
+				{Metric: labels.FromStrings("__name__", "http_requests_total", "pod", "nginx-1", "route", "/"), T: 0, F: 1},
+				{Metric: labels.FromStrings("__name__", "http_requests_total", "pod", "nginx-2", "route", "/"), T: 0, F: 2},
+				{Metric: labels.FromStrings("__name__", "http_requests_total", "pod", "nginx-1", "route", "/api"), T: 0, F: 3},
+			},
 		},
 		{
-			name:                   "sum()",
-			query:                  "sum(native_histogram_series)",
-			wantEmptyForMixedTypes: true,
+			query: `sort_by_label_desc(http_requests_total, "pod")`,
+			expected: promql.Vector{
+				{Metric: labels.FromStrings("__name__", "http_requests_total", "pod", "nginx-3"), T: 0, F: 4},
+				{Metric: labels.FromStrings("__name__", "http_requests_total", "pod", "nginx-2", "route", "/"), T: 0, F: 2},
+				{Metric: labels.FromStrings("__name__", "http_requests_total", "pod", "nginx-1", "route", "/api"), T: 0, F: 3},
+				{Metric: labels.FromStrings("__name__", "http_requests_total", "pod", "nginx-1", "route", "/"), T: 0, F: 1},
+			},
 		},
 		{
-			name:                   "sum by (foo)",
-			query:                  "sum by (foo) (native_histogram_series)",
-			wantEmptyForMixedTypes: true,
+			query: `(sort_by_label(sum by (pod) (http_requests_total), "pod"))`,
+			expected: promql.Vector{
+				{Metric: labels.FromStrings("pod", "nginx-1"), T: 0, F: 4},
+				{Metric: labels.FromStrings("pod", "nginx-2"), T: 0, F: 2},
+				{Metric: labels.FromStrings("pod", "nginx-3"), T: 0, F: 4},
+			},
 		},
+	}
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64}
+	newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true, EnableExperimentalFunctions: true})
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			q, err := newEngine.NewInstantQuery(test.Storage(), nil, tc.query, time.Unix(0, 0))
+			testutil.Ok(t, err)
+			defer q.Close()
+
+			result := q.Exec(context.Background())
+			testutil.Ok(t, result.Err)
+			testutil.Equals(t, tc.expected, result.Value)
+		})
+	}
+}
+
+func TestRangeQueryAtTimestamps(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x40
+				http_requests_total{pod="nginx-2"} 1+2x20 _x5 3+3x10`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	timestamps := []time.Time{
+		time.Unix(0, 0),
+		time.Unix(45, 0),
+		time.Unix(60, 0),
+		time.Unix(400, 0),
+		time.Unix(401, 0),
+		time.Unix(900, 0),
+		time.Unix(1500, 0),
+	}
+	queries := []string{
+		`http_requests_total`,
+		`rate(http_requests_total[1m])`,
+		`sum(rate(http_requests_total[2m])) * 2 + time()`,
+		`timestamp(http_requests_total)`,
+		`http_requests_total @ 400`,
+		`predict_linear(http_requests_total[5m], 60)`,
+		`vector(1)`,
+	}
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64, EnableAtModifier: true}
+	for _, query := range queries {
+		t.Run(query, func(t *testing.T) {
+			// The expected result is assembled from instant queries at each timestamp.
+			series := make(map[string]*promql.Series)
+			for _, ts := range timestamps {
+				q, err := promql.NewEngine(opts).NewInstantQuery(test.Storage(), nil, query, ts)
+				testutil.Ok(t, err)
+				result := q.Exec(context.Background())
+				testutil.Ok(t, result.Err)
+				vector, err := result.Vector()
+				testutil.Ok(t, err)
+				for _, sample := range vector {
+					key := sample.Metric.String()
+					if _, ok := series[key]; !ok {
+						series[key] = &promql.Series{Metric: sample.Metric}
+					}
+					series[key].Floats = append(series[key].Floats, promql.FPoint{T: sample.T, F: sample.F})
+				}
+				q.Close()
+			}
+			expected := make(promql.Matrix, 0, len(series))
+			for _, s := range series {
+				expected = append(expected, *s)
+			}
+			sort.Sort(expected)
+
+			newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true})
+			q, err := newEngine.NewRangeQueryAtTimestamps(test.Storage(), nil, query, timestamps)
+			testutil.Ok(t, err)
+			defer q.Close()
+			result := q.Exec(context.Background())
+			testutil.Ok(t, result.Err)
+			matrix, err := result.Matrix()
+			testutil.Ok(t, err)
+
+			emptyLabelsToNil(&promql.Result{Value: expected})
+			emptyLabelsToNil(result)
+			testutil.Equals(t, expected, matrix)
+		})
+	}
+
+	newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true})
+	_, err = newEngine.NewRangeQueryAtTimestamps(test.Storage(), nil, "http_requests_total", []time.Time{time.Unix(60, 0), time.Unix(30, 0)})
+	testutil.NotOk(t, err)
+}
+
+func TestCalendarRangeQuery(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	testutil.Ok(t, err)
+
+	cases := []struct {
+		name     string
+		start    time.Time
+		end      time.Time
+		step     string
+		loc      *time.Location
+		expected []time.Time
+	}{
 		{
-			name:  "count",
-			query: "count (native_histogram_series)",
+			name:  "days across daylight saving time change",
+			start: time.Date(2023, 3, 24, 12, 0, 0, 0, berlin),
+			end:   time.Date(2023, 3, 28, 0, 0, 0, 0, berlin),
+			step:  "1d",
+			loc:   berlin,
+			expected: []time.Time{
+				time.Date(2023, 3, 25, 0, 0, 0, 0, berlin),
+				time.Date(2023, 3, 26, 0, 0, 0, 0, berlin),
+				time.Date(2023, 3, 27, 0, 0, 0, 0, berlin),
+				time.Date(2023, 3, 28, 0, 0, 0, 0, berlin),
+			},
 		},
 		{
-			name:  "count by (foo)",
-			query: "count by (foo) (native_histogram_series)",
+			name:  "weeks aligned to mondays",
+			start: time.Date(2023, 5, 3, 0, 0, 0, 0, time.UTC),
+			end:   time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC),
+			step:  "2w",
+			expected: []time.Time{
+				time.Date(2023, 5, 8, 0, 0, 0, 0, time.UTC),
+				time.Date(2023, 5, 22, 0, 0, 0, 0, time.UTC),
+			},
 		},
-		// TODO(fpetkovski): The Prometheus engine returns an incorrect result for this case.
-		// Uncomment once it gets fixed: https://github.com/prometheus/prometheus/issues/11973.
-		// {
-		//	name:  "max",
-		//	query: "max (native_histogram_series)",
-		// },
 		{
-			name:  "max by (foo)",
-			query: "max by (foo) (native_histogram_series)",
+			name:  "months in time zone",
+			start: time.Date(2023, 1, 1, 0, 0, 0, 0, berlin),
+			end:   time.Date(2023, 4, 1, 0, 0, 0, 0, berlin),
+			step:  "1M",
+			loc:   berlin,
+			expected: []time.Time{
+				time.Date(2023, 1, 1, 0, 0, 0, 0, berlin),
+				time.Date(2023, 2, 1, 0, 0, 0, 0, berlin),
+				time.Date(2023, 3, 1, 0, 0, 0, 0, berlin),
+				time.Date(2023, 4, 1, 0, 0, 0, 0, berlin),
+			},
 		},
-		// TODO(fpetkovski): The Prometheus engine returns an incorrect result for this case.
-		// Uncomment once it gets fixed: https://github.com/prometheus/prometheus/issues/11973.
-		// {
-		//	name:  "min",
-		//	query: "min (native_histogram_series)",
-		// },
-		{
-			name:  "min by (foo)",
-			query: "min by (foo) (native_histogram_series)",
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			step, err := query.ParseCalendarStep(tc.step)
+			testutil.Ok(t, err)
+			timestamps, err := query.CalendarTimestamps(tc.start, tc.end, step, tc.loc)
+			testutil.Ok(t, err)
+			testutil.Equals(t, len(tc.expected), len(timestamps))
+			for i := range tc.expected {
+				testutil.Assert(t, tc.expected[i].Equal(timestamps[i]), "expected %s, got %s", tc.expected[i], timestamps[i])
+			}
+		})
+	}
+
+	for _, invalid := range []string{"", "d", "0d", "-1w", "1h", "1.5M"} {
+		_, err := query.ParseCalendarStep(invalid)
+		testutil.NotOk(t, err, "expected error for step %q", invalid)
+	}
+
+	load := `load 1h
+		http_requests_total{pod="nginx-1"} 0+1x2200`
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	step, err := query.ParseCalendarStep("1M")
+	testutil.Ok(t, err)
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64}
+	newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true})
+	q, err := newEngine.NewCalendarRangeQuery(test.Storage(), nil, "http_requests_total", time.Unix(0, 0), time.Unix(0, 0).Add(2200*time.Hour), step, loc)
+	testutil.Ok(t, err)
+	defer q.Close()
+	result := q.Exec(context.Background())
+	testutil.Ok(t, result.Err)
+	matrix, err := result.Matrix()
+	testutil.Ok(t, err)
+
+	expected := promql.Matrix{{
+		Metric: labels.FromStrings("__name__", "http_requests_total", "pod", "nginx-1"),
+		Floats: []promql.FPoint{
+			{T: time.Date(1970, 2, 1, 0, 0, 0, 0, loc).UnixMilli(), F: 31*24 - 2},
+			{T: time.Date(1970, 3, 1, 0, 0, 0, 0, loc).UnixMilli(), F: 59*24 - 2},
+			{T: time.Date(1970, 4, 1, 0, 0, 0, 0, loc).UnixMilli(), F: 90*24 - 2},
 		},
-		{
-			name:  "histogram_sum",
-			query: "histogram_sum(native_histogram_series)",
+	}}
+	testutil.Equals(t, expected, matrix)
+
+	_, err = newEngine.NewCalendarRangeQuery(test.Storage(), nil, "http_requests_total", time.Unix(0, 0).Add(time.Hour), time.Unix(0, 0).Add(2*time.Hour), step, loc)
+	testutil.NotOk(t, err)
+}
+
+func TestMaxPointsPerWindow(t *testing.T) {
+	load := `load 10s
+				http_requests_total{pod="nginx-1"} 1+1x100
+				http_requests_total{pod="nginx-2"} 1+2x100`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	var (
+		start = time.Unix(0, 0)
+		end   = time.Unix(600, 0)
+		step  = 30 * time.Second
+		opts  = promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64}
+	)
+
+	t.Run("fail", func(t *testing.T) {
+		newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true, MaxPointsPerWindow: 3})
+		q, err := newEngine.NewRangeQuery(test.Storage(), nil, "sum_over_time(http_requests_total[1m])", start, end, step)
+		testutil.Ok(t, err)
+		defer q.Close()
+		result := q.Exec(context.Background())
+		testutil.NotOk(t, result.Err)
+		testutil.Assert(t, strings.Contains(result.Err.Error(), "contains more than 3 points"), result.Err.Error())
+	})
+
+	t.Run("truncate functions which need fewer points", func(t *testing.T) {
+		newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true, MaxPointsPerWindow: 3, TruncateWindows: true})
+		q, err := newEngine.NewRangeQuery(test.Storage(), nil, "irate(http_requests_total[1m])", start, end, step)
+		testutil.Ok(t, err)
+		defer q.Close()
+		newResult := q.Exec(context.Background())
+		testutil.Ok(t, newResult.Err)
+		testutil.Equals(t, 0, len(newResult.Warnings))
+
+		q2, err := promql.NewEngine(opts).NewRangeQuery(test.Storage(), nil, "irate(http_requests_total[1m])", start, end, step)
+		testutil.Ok(t, err)
+		defer q2.Close()
+		oldResult := q2.Exec(context.Background())
+		testutil.Ok(t, oldResult.Err)
+
+		emptyLabelsToNil(oldResult)
+		emptyLabelsToNil(newResult)
+		testutil.Equals(t, oldResult.Value, newResult.Value)
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true, MaxPointsPerWindow: 3, TruncateWindows: true})
+		q, err := newEngine.NewRangeQuery(test.Storage(), nil, "sum_over_time(http_requests_total[1m])", start, end, step)
+		testutil.Ok(t, err)
+		defer q.Close()
+		newResult := q.Exec(context.Background())
+		testutil.Ok(t, newResult.Err)
+		testutil.Equals(t, 1, len(newResult.Warnings))
+
+		// The three most recent points of each range are the points of a 20s range.
+		q2, err := promql.NewEngine(opts).NewRangeQuery(test.Storage(), nil, "sum_over_time(http_requests_total[20s])", start, end, step)
+		testutil.Ok(t, err)
+		defer q2.Close()
+		oldResult := q2.Exec(context.Background())
+		testutil.Ok(t, oldResult.Err)
+
+		emptyLabelsToNil(oldResult)
+		emptyLabelsToNil(newResult)
+		testutil.Equals(t, oldResult.Value, newResult.Value)
+	})
+}
+
+func TestQuerySnapshots(t *testing.T) {
+	selecting := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	querier := &storage.MockQueryable{
+		MockQuerier: &storage.MockQuerier{
+			SelectMockFunction: func(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+				once.Do(func() { close(selecting) })
+				<-release
+				return newTestSeriesSet(newMockSeries([]string{labels.MetricName, "http_requests_total", "pod", "nginx-1"}, []int64{0, 30000, 60000}, []float64{1, 2, 3}))
+			},
 		},
+	}
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64}
+	newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true, EnableQuerySnapshots: true})
+	q, err := newEngine.NewRangeQuery(querier, nil, "sum(rate(http_requests_total[1m]))", time.Unix(0, 0), time.Unix(60, 0), 30*time.Second)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	done := make(chan *promql.Result)
+	go func() { done <- q.Exec(context.Background()) }()
+	<-selecting
+
+	snapshots := newEngine.Snapshot()
+	testutil.Equals(t, 1, len(snapshots))
+	testutil.Equals(t, "sum(rate(http_requests_total[1m]))", snapshots[0].Query)
+	testutil.Assert(t, snapshots[0].Operators.Tracked, "expected root operator to be tracked")
+	testutil.Assert(t, snapshots[0].Operators.InNext, "expected root operator to be producing a batch")
+	waitingOn := snapshots[0].WaitingOn()
+	testutil.Assert(t, len(waitingOn) > 0, "expected query to wait on an operator")
+	for _, operator := range waitingOn {
+		testutil.Assert(t, strings.Contains(operator, "matrixSelector"), "expected query to wait on matrix selector, got %s", operator)
+	}
+
+	close(release)
+	result := <-done
+	testutil.Ok(t, result.Err)
+	testutil.Equals(t, 0, len(newEngine.Snapshot()))
+}
+
+func TestQueryReceipts(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x10
+				http_requests_total{pod="nginx-2"} 1+2x10`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	numShards := runtime.GOMAXPROCS(0) / 2
+	if numShards < 1 {
+		numShards = 1
+	}
+	cases := []struct {
+		query    string
+		expected string
+	}{
 		{
-			name:  "histogram_count",
-			query: "histogram_count(native_histogram_series)",
+			query:    `http_requests_total`,
+			expected: "PromQL info: query touched 1 selectors in 1 shards, 2 series, 2 samples and 0 remote engine queries",
 		},
 		{
-			name:  "histogram_quantile",
-			query: "histogram_quantile(0.7, native_histogram_series)",
+			query:    `rate(http_requests_total[1m])`,
+			expected: fmt.Sprintf("PromQL info: query touched 1 selectors in %d shards, 2 series, 6 samples and 0 remote engine queries", numShards),
 		},
 		{
-			name:  "histogram_fraction",
-			query: "histogram_fraction(0, 0.2, native_histogram_series)",
+			query:    `sum(rate(http_requests_total[1m])) + abs(http_requests_total{pod="nginx-1"} * 2)`,
+			expected: fmt.Sprintf("PromQL info: query touched 2 selectors in %d shards, 3 series, 7 samples and 0 remote engine queries", numShards+1),
 		},
 	}
+	for _, tcase := range cases {
+		t.Run(tcase.query, func(t *testing.T) {
+			newEngine := engine.New(engine.Opts{
+				EngineOpts:          promql.EngineOpts{Timeout: 1 * time.Hour},
+				DisableFallback:     true,
+				EnableQueryReceipts: true,
+			})
+			q, err := newEngine.NewInstantQuery(test.Storage(), nil, tcase.query, time.Unix(60, 0))
+			testutil.Ok(t, err)
+			defer q.Close()
 
-	t.Run("integer_histograms", func(t *testing.T) {
-		testNativeHistograms(t, cases, opts, generateNativeHistogramSeries)
-	})
-	t.Run("float_histograms", func(t *testing.T) {
-		testNativeHistograms(t, cases, opts, generateFloatHistogramSeries)
-	})
+			result := q.Exec(context.Background())
+			testutil.Ok(t, result.Err)
+			testutil.Equals(t, 1, len(result.Warnings))
+			testutil.Equals(t, tcase.expected, result.Warnings[0].Error())
+		})
+	}
 }
 
-func testNativeHistograms(t *testing.T, cases []histogramTestCase, opts promql.EngineOpts, generateHistograms histogramGeneratorFunc) {
-	numHistograms := 100
-	mixedTypesOpts := []bool{false, true}
-	for _, tc := range cases {
-		t.Run(tc.name, func(t *testing.T) {
-			for _, withMixedTypes := range mixedTypesOpts {
-				t.Run(fmt.Sprintf("mixedTypes=%t", withMixedTypes), func(t *testing.T) {
-					test, err := promql.NewTest(t, "")
-					testutil.Ok(t, err)
-					defer test.Close()
-
-					app := test.Storage().Appender(context.TODO())
-					err = generateHistograms(app, numHistograms, withMixedTypes)
-					testutil.Ok(t, err)
-					testutil.Ok(t, app.Commit())
-					testutil.Ok(t, test.Run())
+type warningsQueryable struct {
+	storage.Queryable
+	warnings storage.Warnings
+}
 
-					// New Engine
-					engine := engine.New(engine.Opts{
-						EngineOpts:        opts,
-						DisableFallback:   true,
-						LogicalOptimizers: logicalplan.AllOptimizers,
-					})
+func (q *warningsQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	querier, err := q.Queryable.Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	return &warningsQuerier{Querier: querier, warnings: q.warnings}, nil
+}
 
-					t.Run("instant", func(t *testing.T) {
-						qry, err := engine.NewInstantQuery(test.Queryable(), nil, tc.query, time.Unix(50, 0))
-						testutil.Ok(t, err)
-						newResult := qry.Exec(test.Context())
-						testutil.Ok(t, newResult.Err)
-						newVector, err := newResult.Vector()
-						testutil.Ok(t, err)
+type warningsQuerier struct {
+	storage.Querier
+	warnings storage.Warnings
+}
 
-						promEngine := test.QueryEngine()
-						qry, err = promEngine.NewInstantQuery(test.Queryable(), nil, tc.query, time.Unix(50, 0))
-						testutil.Ok(t, err)
-						promResult := qry.Exec(test.Context())
-						testutil.Ok(t, promResult.Err)
-						promVector, err := promResult.Vector()
-						testutil.Ok(t, err)
+func (q *warningsQuerier) Select(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	return &warningsSeriesSet{SeriesSet: q.Querier.Select(sortSeries, hints, matchers...), warnings: q.warnings}
+}
 
-						// Make sure we're not getting back empty results.
-						if withMixedTypes && tc.wantEmptyForMixedTypes {
-							testutil.Assert(t, len(promVector) == 0)
-						}
+type warningsSeriesSet struct {
+	storage.SeriesSet
+	warnings storage.Warnings
+}
 
-						sortByLabels(promResult)
-						sortByLabels(newResult)
-						if hasNaNs(promResult) {
-							t.Log("Applying comparison with NaN equality.")
-							testutil.WithGoCmp(cmpopts.EquateNaNs()).Equals(t, promVector, newVector)
-						} else {
-							testutil.Equals(t, promVector, newVector)
-						}
-					})
+func (s *warningsSeriesSet) Warnings() storage.Warnings { return s.warnings }
 
-					t.Run("range", func(t *testing.T) {
-						qry, err := engine.NewRangeQuery(test.Queryable(), nil, tc.query, time.Unix(50, 0), time.Unix(600, 0), 30*time.Second)
-						testutil.Ok(t, err)
-						res := qry.Exec(test.Context())
-						testutil.Ok(t, res.Err)
-						actual, err := res.Matrix()
-						testutil.Ok(t, err)
+type refQueryable struct {
+	storage.Queryable
+}
 
-						promEngine := test.QueryEngine()
-						qry, err = promEngine.NewRangeQuery(test.Queryable(), nil, tc.query, time.Unix(50, 0), time.Unix(600, 0), 30*time.Second)
-						testutil.Ok(t, err)
-						res = qry.Exec(test.Context())
-						testutil.Ok(t, res.Err)
-						expected, err := res.Matrix()
-						testutil.Ok(t, err)
+func (q *refQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	querier, err := q.Queryable.Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	return &refQuerier{Querier: querier}, nil
+}
 
-						// Make sure we're not getting back empty results.
-						if withMixedTypes && tc.wantEmptyForMixedTypes {
-							testutil.Assert(t, len(expected) == 0)
-						}
-						testutil.Equals(t, len(expected), len(actual))
-						if hasNaNs(res) {
-							t.Log("Applying comparison with NaN equality.")
-							testutil.WithGoCmp(cmpopts.EquateNaNs()).Equals(t, expected, actual)
-						} else {
-							testutil.Equals(t, expected, actual)
-						}
-					})
-				})
+type refQuerier struct {
+	storage.Querier
+}
+
+func (q *refQuerier) Select(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	return &refSeriesSet{SeriesSet: q.Querier.Select(sortSeries, hints, matchers...)}
+}
+
+type refSeriesSet struct {
+	storage.SeriesSet
+}
+
+func (s *refSeriesSet) At() storage.Series { return &refSeries{Series: s.SeriesSet.At()} }
+
+// refSeries uses the hash of its labels as a stable series reference.
+type refSeries struct {
+	storage.Series
+}
+
+func (s *refSeries) SeriesRef() storage.SeriesRef { return storage.SeriesRef(s.Labels().Hash()) }
+
+func TestSeriesRefCache(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1", route="/"} 1+1x40
+				http_requests_total{pod="nginx-2", route="/"} 1+2x40
+				http_requests_total{pod="nginx-1", route="/api"} 1+3x40
+				http_responses_total{pod="nginx-1", route="/"} 1+1x40`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	queries := []string{
+		`sum by (pod) (rate(http_requests_total[1m]))`,
+		`sum by (__name__) (rate(http_requests_total[1m]))`,
+		`sum by (__name__) ({__name__=~"http_.*"})`,
+		`rate(http_requests_total[1m]) / on (pod, route) rate(http_responses_total[1m])`,
+		`http_requests_total / ignoring (route) group_left sum without (route) (http_requests_total)`,
+		`topk by (route) (1, http_requests_total)`,
+	}
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64}
+	queryable := &refQueryable{Queryable: test.Storage()}
+	newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true, SeriesRefCache: engstore.NewSeriesRefCache(10000)})
+	for _, query := range queries {
+		t.Run(query, func(t *testing.T) {
+			q, err := promql.NewEngine(opts).NewRangeQuery(test.Storage(), nil, query, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer q.Close()
+			expected := q.Exec(context.Background())
+			testutil.Ok(t, expected.Err)
+
+			// Later executions reuse computations cached by the first one.
+			for i := 0; i < 2; i++ {
+				q, err := newEngine.NewRangeQuery(queryable, nil, query, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+				testutil.Ok(t, err)
+				defer q.Close()
+
+				result := q.Exec(context.Background())
+				testutil.Ok(t, result.Err)
+				testutil.Equals(t, expected, result)
 			}
 		})
 	}
 }
 
-func generateNativeHistogramSeries(app storage.Appender, numSeries int, withMixedTypes bool) error {
-	commonLabels := []string{labels.MetricName, "native_histogram_series", "foo", "bar"}
-	series := make([][]*histogram.Histogram, numSeries)
-	for i := range series {
-		series[i] = tsdbutil.GenerateTestHistograms(2000)
+func TestPlanCache(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1", route="/"} 1+1x40
+				http_requests_total{pod="nginx-2", route="/"} 1+2x40
+				http_requests_total{pod="nginx-1", route="/api"} 1+3x40`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	queries := []string{
+		`sum by (pod) (rate(http_requests_total[1m]))`,
+		`sort_desc(http_requests_total)`,
+		`http_requests_total @ end() + http_requests_total`,
+		`sum(http_requests_total @ start()) by (pod)`,
+		`time() - http_requests_total`,
 	}
-	higherSchemaHist := &histogram.Histogram{
-		Schema: 3,
-		PositiveSpans: []histogram.Span{
-			{Offset: -5, Length: 2}, // -5 -4
-			{Offset: 2, Length: 3},  // -1 0 1
-			{Offset: 2, Length: 2},  // 4 5
-		},
-		PositiveBuckets: []int64{1, 2, -2, 1, -1, 0, 3},
-		Count:           13,
+	ranges := []struct{ start, end time.Time }{
+		{start: time.Unix(0, 0), end: time.Unix(300, 0)},
+		{start: time.Unix(300, 0), end: time.Unix(900, 0)},
 	}
-	for sid, histograms := range series {
-		lbls := append(commonLabels, "h", strconv.Itoa(sid))
-		for i := range histograms {
-			ts := time.Unix(int64(i*15), 0).UnixMilli()
-			if i == 0 {
-				// Inject a histogram with a higher schema.
-				// Regression test for:
-				// * https://github.com/thanos-community/promql-engine/pull/182
-				// * https://github.com/thanos-community/promql-engine/pull/183.
-				if _, err := app.AppendHistogram(0, labels.FromStrings(lbls...), ts, higherSchemaHist, nil); err != nil {
-					return err
-				}
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64, EnableAtModifier: true}
+	newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true, PlanCacheSize: 10})
+	for _, query := range queries {
+		t.Run(query, func(t *testing.T) {
+			// Later queries reuse the plans cached by the first one with a different time range.
+			for _, r := range ranges {
+				q, err := promql.NewEngine(opts).NewRangeQuery(test.Storage(), nil, query, r.start, r.end, 30*time.Second)
+				testutil.Ok(t, err)
+				defer q.Close()
+				expected := q.Exec(context.Background())
+				testutil.Ok(t, expected.Err)
+
+				q, err = newEngine.NewRangeQuery(test.Storage(), nil, query, r.start, r.end, 30*time.Second)
+				testutil.Ok(t, err)
+				defer q.Close()
+				result := q.Exec(context.Background())
+				testutil.Ok(t, result.Err)
+				testutil.Equals(t, expected, result)
+
+				q, err = promql.NewEngine(opts).NewInstantQuery(test.Storage(), nil, query, r.end)
+				testutil.Ok(t, err)
+				defer q.Close()
+				expected = q.Exec(context.Background())
+				testutil.Ok(t, expected.Err)
+
+				q, err = newEngine.NewInstantQuery(test.Storage(), nil, query, r.end)
+				testutil.Ok(t, err)
+				defer q.Close()
+				result = q.Exec(context.Background())
+				testutil.Ok(t, result.Err)
+				// Instant queries have no guarantees on result ordering.
+				testutil.WithGoCmp(comparer).Equals(t, expected, result)
 			}
-			if _, err := app.AppendHistogram(0, labels.FromStrings(lbls...), ts, histograms[i], nil); err != nil {
-				return err
+		})
+	}
+}
+
+func TestPlanCacheConcurrentQueries(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1", route="/"} 1+1x40
+				http_requests_total{pod="nginx-2", route="/"} 1+2x40
+				http_requests_total{pod="nginx-1", route="/api"} 1+3x40`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	// Grouping labels are not sorted, so that operators which sort them in place would modify the plans.
+	exprs := []string{
+		`sum by (route, pod) (rate(http_requests_total[1m]))`,
+		`topk by (route, pod) (1, http_requests_total)`,
+		`count_values by (route, pod) ("value", http_requests_total)`,
+		`http_requests_total / on (route, pod) group_left http_requests_total`,
+		`http_requests_total and on (route, pod) http_requests_total`,
+	}
+	start, end, step := time.Unix(0, 0), time.Unix(600, 0), 30*time.Second
+	planOpts := &logicalplan.Opts{Start: start, End: end, Step: step, LookbackDelta: 5 * time.Minute}
+
+	const concurrency = 8
+	for _, qs := range exprs {
+		t.Run(qs, func(t *testing.T) {
+			expr, err := parser.ParseExpr(qs)
+			testutil.Ok(t, err)
+			// Plans served from the plan cache are shared by the operators of concurrent queries.
+			plan := logicalplan.New(expr, planOpts).Optimize(logicalplan.DefaultOptimizers)
+			planString := plan.Root().String()
+
+			var (
+				wg   sync.WaitGroup
+				errs = make([]error, concurrency)
+			)
+			for i := 0; i < concurrency; i++ {
+				i := i
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, errs[i] = execution.New(plan.Root(), test.Storage(), &query.Options{
+						Start:         start,
+						End:           end,
+						Step:          step,
+						LookbackDelta: planOpts.LookbackDelta,
+					})
+				}()
 			}
-			if withMixedTypes {
-				if _, err := app.Append(0, labels.FromStrings(append(lbls, "le", "1")...), ts, float64(i)); err != nil {
-					return err
-				}
-				if _, err := app.Append(0, labels.FromStrings(append(lbls, "le", "+Inf")...), ts, float64(i*2)); err != nil {
-					return err
-				}
+			wg.Wait()
+			for _, err := range errs {
+				testutil.Ok(t, err)
 			}
+			testutil.Equals(t, planString, plan.Root().String())
+		})
+	}
+}
+
+func TestTimeSplit(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1", route="/"} 1+1x40
+				http_requests_total{pod="nginx-2", route="/"} 1+2x20
+				http_requests_total{pod="nginx-1", route="/api"} _x20 1+3x20
+				http_responses_total{pod="nginx-1", route="/"} 1+1x40`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	queries := []string{
+		`http_requests_total`,
+		`sum by (pod) (rate(http_requests_total[1m]))`,
+		`topk(1, http_requests_total)`,
+		`rate(http_requests_total[1m]) / on (pod, route) rate(http_responses_total[1m])`,
+		`sum(rate(http_requests_total[1m])) / count(rate(http_requests_total[1m]))`,
+		`timestamp(http_requests_total)`,
+		`http_requests_total @ 300`,
+		`time()`,
+	}
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64, EnableAtModifier: true}
+	for _, sliceRange := range []time.Duration{time.Minute, 3 * time.Minute} {
+		newEngine := engine.New(engine.Opts{
+			EngineOpts:        opts,
+			DisableFallback:   true,
+			LogicalOptimizers: logicalplan.AllOptimizers,
+			TimeSplitRange:    sliceRange,
+		})
+		for _, query := range queries {
+			t.Run(fmt.Sprintf("%s/slice=%s", query, sliceRange), func(t *testing.T) {
+				q, err := promql.NewEngine(opts).NewRangeQuery(test.Storage(), nil, query, time.Unix(0, 0), time.Unix(1200, 0), 30*time.Second)
+				testutil.Ok(t, err)
+				defer q.Close()
+				expected := q.Exec(context.Background())
+				testutil.Ok(t, expected.Err)
+
+				q, err = newEngine.NewRangeQuery(test.Storage(), nil, query, time.Unix(0, 0), time.Unix(1200, 0), 30*time.Second)
+				testutil.Ok(t, err)
+				defer q.Close()
+				result := q.Exec(context.Background())
+				testutil.Ok(t, result.Err)
+				testutil.WithGoCmp(comparer).Equals(t, expected, result)
+			})
+		}
+	}
+}
+
+func TestVerticalSharding(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1", route="/"} 1+1x40
+				http_requests_total{pod="nginx-2", route="/"} 1+2x20
+				http_requests_total{pod="nginx-3", route="/"} 1+4x40
+				http_requests_total{pod="nginx-1", route="/api"} _x20 1+3x20
+				http_requests_total{pod="nginx-2", route="/api"} 5+1x40
+				http_responses_total{pod="nginx-1", route="/"} 1+1x40`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	queries := []string{
+		`sum by (pod) (rate(http_requests_total[1m]))`,
+		`sum without (pod) (rate(http_requests_total[1m]) * 2)`,
+		`count by (route) (http_requests_total)`,
+		`max(http_requests_total) - min(http_requests_total)`,
+		`group by (route) (http_requests_total > 10)`,
+		`sum(rate(http_requests_total[1m])) / sum(rate(http_responses_total[1m]))`,
+		`avg(http_requests_total)`,
+		`sum(rate(http_requests_total[1m]) / on (pod, route) rate(http_responses_total[1m]))`,
+	}
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64}
+	for _, shards := range []int{2, 3, 8} {
+		newEngine := engine.New(engine.Opts{
+			EngineOpts:      opts,
+			DisableFallback: true,
+			VerticalShards:  shards,
+		})
+		for _, query := range queries {
+			t.Run(fmt.Sprintf("%s/shards=%d", query, shards), func(t *testing.T) {
+				q, err := promql.NewEngine(opts).NewRangeQuery(test.Storage(), nil, query, time.Unix(0, 0), time.Unix(1200, 0), 30*time.Second)
+				testutil.Ok(t, err)
+				defer q.Close()
+				expected := q.Exec(context.Background())
+				testutil.Ok(t, expected.Err)
+
+				q, err = newEngine.NewRangeQuery(test.Storage(), nil, query, time.Unix(0, 0), time.Unix(1200, 0), 30*time.Second)
+				testutil.Ok(t, err)
+				defer q.Close()
+				result := q.Exec(context.Background())
+				testutil.Ok(t, result.Err)
+				testutil.WithGoCmp(comparer).Equals(t, expected, result)
+			})
 		}
 	}
+}
+
+func TestStorageWarnings(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x10
+				http_requests_total{pod="nginx-2"} 1+2x10`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	partialData := errors.New("partial data")
+	queryable := &warningsQueryable{Queryable: test.Storage(), warnings: storage.Warnings{partialData}}
+	newEngine := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: 1 * time.Hour}, DisableFallback: true})
+
+	t.Run("instant", func(t *testing.T) {
+		q, err := newEngine.NewInstantQuery(queryable, nil, `sum(rate(http_requests_total[1m])) + sum(http_requests_total)`, time.Unix(60, 0))
+		testutil.Ok(t, err)
+		defer q.Close()
+
+		res := q.Exec(context.Background())
+		testutil.Ok(t, res.Err)
+		testutil.Equals(t, storage.Warnings{partialData}, res.Warnings)
+	})
+	t.Run("range", func(t *testing.T) {
+		q, err := newEngine.NewRangeQuery(queryable, nil, `http_requests_total`, time.Unix(0, 0), time.Unix(300, 0), 30*time.Second)
+		testutil.Ok(t, err)
+		defer q.Close()
+
+		res := q.Exec(context.Background())
+		testutil.Ok(t, res.Err)
+		testutil.Equals(t, storage.Warnings{partialData}, res.Warnings)
+	})
+}
+
+func TestStreamingSeries(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x40
+				http_requests_total{pod="nginx-2"} 1+2x20 _x10 stale 1+3x10
+				http_requests_total{pod="nginx-3"} 1+3x10 _x20 1+1x10
+				http_requests_total{pod="nginx-4"} 1+1x5`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64, EnableAtModifier: true}
+	queries := []string{
+		`http_requests_total`,
+		`http_requests_total offset 2m`,
+		`rate(http_requests_total[2m])`,
+		`sum_over_time(http_requests_total[5m] offset 1m)`,
+		`sum by (pod) (increase(http_requests_total[1m]))`,
+	}
+	for _, query := range queries {
+		t.Run(query, func(t *testing.T) {
+			promEngine := promql.NewEngine(opts)
+			q, err := promEngine.NewRangeQuery(test.Storage(), nil, query, time.Unix(0, 0), time.Unix(1200, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer q.Close()
+			expected := q.Exec(context.Background())
+			testutil.Ok(t, expected.Err)
+
+			queryable := &iteratorCountingQueryable{Queryable: test.Storage()}
+			newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true, EnableStreamingSeries: true})
+			q, err = newEngine.NewRangeQuery(queryable, nil, query, time.Unix(0, 0), time.Unix(1200, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer q.Close()
+			actual := q.Exec(context.Background())
+			testutil.Ok(t, actual.Err)
+
+			testutil.Equals(t, expected, actual)
+			// Iterators are kept across batches of steps, so each series is only opened once.
+			testutil.Equals(t, int64(4), queryable.iterators.Load())
+		})
+	}
+}
+
+type iteratorCountingQueryable struct {
+	storage.Queryable
+	iterators atomic.Int64
+}
+
+func (q *iteratorCountingQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	querier, err := q.Queryable.Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	return &iteratorCountingQuerier{Querier: querier, iterators: &q.iterators}, nil
+}
+
+type iteratorCountingQuerier struct {
+	storage.Querier
+	iterators *atomic.Int64
+}
+
+func (q *iteratorCountingQuerier) Select(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	return &iteratorCountingSeriesSet{SeriesSet: q.Querier.Select(sortSeries, hints, matchers...), iterators: q.iterators}
+}
+
+type iteratorCountingSeriesSet struct {
+	storage.SeriesSet
+	iterators *atomic.Int64
+}
+
+func (s *iteratorCountingSeriesSet) At() storage.Series {
+	return &iteratorCountingSeries{Series: s.SeriesSet.At(), iterators: s.iterators}
+}
+
+type iteratorCountingSeries struct {
+	storage.Series
+	iterators *atomic.Int64
+}
+
+func (s *iteratorCountingSeries) Iterator(it chunkenc.Iterator) chunkenc.Iterator {
+	s.iterators.Add(1)
+	return s.Series.Iterator(it)
+}
+
+func TestOperatorBatchDurations(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x10
+				http_requests_total{pod="nginx-2"} 1+2x10`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	reg := prometheus.NewRegistry()
+	newEngine := engine.New(engine.Opts{
+		EngineOpts:      promql.EngineOpts{Timeout: 1 * time.Hour, Reg: reg},
+		DisableFallback: true,
+	})
+	q, err := newEngine.NewRangeQuery(test.Storage(), nil, `sum(rate(http_requests_total[1m])) / sum(http_requests_total)`, time.Unix(0, 0), time.Unix(300, 0), 30*time.Second)
+	testutil.Ok(t, err)
+	defer q.Close()
+	testutil.Ok(t, q.Exec(context.Background()).Err)
+
+	metrics, err := reg.Gather()
+	testutil.Ok(t, err)
+	batches := make(map[string]uint64)
+	for _, m := range metrics {
+		if m.GetName() != "thanos_engine_operator_batch_duration_seconds" {
+			continue
+		}
+		for _, metric := range m.GetMetric() {
+			batches[metric.GetLabel()[0].GetValue()] = metric.GetHistogram().GetSampleCount()
+		}
+	}
+	for _, operator := range []string{"vector_selector", "matrix_selector", "aggregate", "binary"} {
+		testutil.Assert(t, batches[operator] > 0, "expected batches to be recorded for %s", operator)
+	}
+}
+
+func TestQueryStats(t *testing.T) {
+	start := time.Unix(0, 0)
+	end := time.Unix(120, 0)
+	step := time.Second * 30
+
+	query := `http_requests_total{pod="nginx-1"}`
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x1
+				http_requests_total{pod="nginx-2"} 1+2x1`
+	opts := promql.EngineOpts{
+		Timeout:    2 * time.Second,
+		MaxSamples: math.MaxInt64,
+	}
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+
+	newEngine := engine.New(engine.Opts{DisableFallback: true, EngineOpts: opts})
+	q, err := newEngine.NewRangeQuery(test.Storage(), nil, query, start, end, step)
+	testutil.Ok(t, err)
+	stats.NewQueryStats(q.Stats())
+
+	q, err = newEngine.NewInstantQuery(test.Storage(), nil, query, end)
+	testutil.Ok(t, err)
+	stats.NewQueryStats(q.Stats())
+}
+
+func storageWithMockSeries(mockSeries ...*mockSeries) *storage.MockQueryable {
+	series := make([]storage.Series, 0, len(mockSeries))
+	for _, mock := range mockSeries {
+		series = append(series, storage.Series(mock))
+	}
+	return storageWithSeries(series...)
+}
+
+func storageWithSeries(series ...storage.Series) *storage.MockQueryable {
+	return &storage.MockQueryable{
+		MockQuerier: &storage.MockQuerier{
+			SelectMockFunction: func(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+				result := make([]storage.Series, 0)
+			loopSeries:
+				for _, s := range series {
+					for _, m := range matchers {
+						lbl := s.Labels().Get(m.Name)
+						if lbl != "" && !m.Matches(lbl) {
+							continue loopSeries
+						}
+					}
+					result = append(result, s)
+				}
+				return newTestSeriesSet(result...)
+			},
+		},
+	}
+}
+
+type byTimestamps mockSeries
+
+func (b byTimestamps) Len() int {
+	return len(b.timestamps)
+}
+
+func (b byTimestamps) Less(i, j int) bool {
+	return b.timestamps[i] < b.timestamps[j]
+}
+
+func (b byTimestamps) Swap(i, j int) {
+	b.timestamps[i], b.timestamps[j] = b.timestamps[j], b.timestamps[i]
+	b.values[i], b.values[j] = b.values[j], b.values[i]
+}
+
+type mockSeries struct {
+	labels     []string
+	timestamps []int64
+	values     []float64
+}
+
+func newMockSeries(labels []string, timestamps []int64, values []float64) *mockSeries {
+	for i := range timestamps {
+		timestamps[i] = timestamps[i] * 1000
+	}
+	return &mockSeries{labels: labels, timestamps: timestamps, values: values}
+}
+
+func (m mockSeries) Labels() labels.Labels {
+	return labels.FromStrings(m.labels...)
+}
+
+func (m mockSeries) Iterator(chunkenc.Iterator) chunkenc.Iterator {
+	return &mockIterator{
+		i:          -1,
+		timestamps: m.timestamps,
+		values:     m.values,
+	}
+}
+
+type mockIterator struct {
+	i          int
+	timestamps []int64
+	values     []float64
+}
+
+func (m *mockIterator) Next() chunkenc.ValueType {
+	m.i++
+	if m.i >= len(m.values) {
+		return chunkenc.ValNone
+	}
+
+	return chunkenc.ValFloat
+}
+
+func (m *mockIterator) Seek(t int64) chunkenc.ValueType {
+	if m.i > -1 && m.i < len(m.timestamps) {
+		currentTS := m.timestamps[m.i]
+		if currentTS > t {
+			return chunkenc.ValFloat
+		}
+	}
+	for {
+		next := m.Next()
+		if next == chunkenc.ValNone {
+			return chunkenc.ValNone
+		}
+
+		if m.AtT() >= t {
+			return next
+		}
+	}
+}
+
+func (m *mockIterator) At() (int64, float64) {
+	return m.timestamps[m.i], m.values[m.i]
+}
+
+func (m *mockIterator) AtHistogram() (int64, *histogram.Histogram) { return 0, nil }
+
+func (m *mockIterator) AtFloatHistogram() (int64, *histogram.FloatHistogram) { return 0, nil }
+
+func (m *mockIterator) AtT() int64 { return m.timestamps[m.i] }
+
+func (m *mockIterator) Err() error { return nil }
+
+type testSeriesSet struct {
+	i      int
+	series []storage.Series
+}
+
+func newTestSeriesSet(series ...storage.Series) storage.SeriesSet {
+	return &testSeriesSet{
+		i:      -1,
+		series: series,
+	}
+}
+
+func (s *testSeriesSet) Next() bool                 { s.i++; return s.i < len(s.series) }
+func (s *testSeriesSet) At() storage.Series         { return s.series[s.i] }
+func (s *testSeriesSet) Err() error                 { return nil }
+func (s *testSeriesSet) Warnings() storage.Warnings { return nil }
+
+type slowSeries struct{}
+
+func (d slowSeries) Labels() labels.Labels                        { return labels.FromStrings("foo", "bar") }
+func (d slowSeries) Iterator(chunkenc.Iterator) chunkenc.Iterator { return &slowIterator{} }
+
+type slowIterator struct {
+	ts int64
+}
+
+func (d *slowIterator) AtHistogram() (int64, *histogram.Histogram) {
+	panic("not implemented")
+}
+
+func (d *slowIterator) AtFloatHistogram() (int64, *histogram.FloatHistogram) {
+	panic("not implemented")
+}
+
+func (d *slowIterator) AtT() int64 {
+	return d.ts
+}
+
+func (d *slowIterator) At() (int64, float64) {
+	return d.ts, 1
+}
+
+func (d *slowIterator) Next() chunkenc.ValueType {
+	<-time.After(10 * time.Millisecond)
+	d.ts += 30 * 1000
+	return chunkenc.ValFloat
+}
+
+func (d *slowIterator) Seek(t int64) chunkenc.ValueType {
+	<-time.After(10 * time.Millisecond)
+	d.ts = t
+	return chunkenc.ValFloat
+}
+func (d *slowIterator) Err() error { return nil }
+
+type mockRuntimeErr struct{}
+
+func (m *mockRuntimeErr) Error() string {
+	return "panic!"
+}
+
+func (m *mockRuntimeErr) RuntimeError() {
+}
+
+func TestEngineRecoversFromPanic(t *testing.T) {
+	t.Parallel()
+
+	querier := &storage.MockQueryable{
+		MockQuerier: &storage.MockQuerier{
+			SelectMockFunction: func(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+				panic(runtime.Error(&mockRuntimeErr{}))
+			},
+		},
+	}
+	t.Run("instant", func(t *testing.T) {
+		newEngine := engine.New(engine.Opts{
+			DisableFallback: true,
+		})
+		q, err := newEngine.NewInstantQuery(querier, nil, "somequery", time.Time{})
+		testutil.Ok(t, err)
+
+		r := q.Exec(context.Background())
+		testutil.Assert(t, r.Err.Error() == "unexpected error: panic!")
+	})
+
+	t.Run("range", func(t *testing.T) {
+		newEngine := engine.New(engine.Opts{
+			DisableFallback: true,
+		})
+		q, err := newEngine.NewRangeQuery(querier, nil, "somequery", time.Time{}, time.Time{}, 42)
+		testutil.Ok(t, err)
+
+		r := q.Exec(context.Background())
+		testutil.Assert(t, r.Err.Error() == "unexpected error: panic!")
+	})
+
+}
+
+type histogramTestCase struct {
+	name                   string
+	query                  string
+	wantEmptyForMixedTypes bool
+}
+
+type histogramGeneratorFunc func(app storage.Appender, numSeries int, withMixedTypes bool) error
+
+func TestNativeHistograms(t *testing.T) {
+	opts := promql.EngineOpts{
+		Timeout:              1 * time.Hour,
+		MaxSamples:           1e10,
+		EnableNegativeOffset: true,
+		EnableAtModifier:     true,
+	}
+
+	cases := []histogramTestCase{
+		{
+			name:  "plain selector",
+			query: "native_histogram_series",
+		},
+		{
+			name:  "irate()",
+			query: "irate(native_histogram_series[1m])",
+		},
+		{
+			name:  "rate()",
+			query: "rate(native_histogram_series[1m])",
+		},
+		{
+			name:  "increase()",
+			query: "increase(native_histogram_series[1m])",
+		},
+		{
+			name:  "delta()",
+			query: "delta(native_histogram_series[1m])",
+		},
+		{
+			name:                   "sum()",
+			query:                  "sum(native_histogram_series)",
+			wantEmptyForMixedTypes: true,
+		},
+		{
+			name:                   "sum by (foo)",
+			query:                  "sum by (foo) (native_histogram_series)",
+			wantEmptyForMixedTypes: true,
+		},
+		{
+			name:  "count",
+			query: "count (native_histogram_series)",
+		},
+		{
+			name:  "count by (foo)",
+			query: "count by (foo) (native_histogram_series)",
+		},
+		// TODO(fpetkovski): The Prometheus engine returns an incorrect result for this case.
+		// Uncomment once it gets fixed: https://github.com/prometheus/prometheus/issues/11973.
+		// {
+		//	name:  "max",
+		//	query: "max (native_histogram_series)",
+		// },
+		{
+			name:  "max by (foo)",
+			query: "max by (foo) (native_histogram_series)",
+		},
+		// TODO(fpetkovski): The Prometheus engine returns an incorrect result for this case.
+		// Uncomment once it gets fixed: https://github.com/prometheus/prometheus/issues/11973.
+		// {
+		//	name:  "min",
+		//	query: "min (native_histogram_series)",
+		// },
+		{
+			name:  "min by (foo)",
+			query: "min by (foo) (native_histogram_series)",
+		},
+		{
+			name:  "histogram_sum",
+			query: "histogram_sum(native_histogram_series)",
+		},
+		{
+			name:  "histogram_count",
+			query: "histogram_count(native_histogram_series)",
+		},
+		{
+			name:  "histogram_count of rate",
+			query: "histogram_count(rate(native_histogram_series[1m]))",
+		},
+		{
+			name:  "histogram_sum of increase",
+			query: "histogram_sum(increase(native_histogram_series[1m]))",
+		},
+		{
+			name:                   "histogram_sum of sum of rate",
+			query:                  "histogram_sum(sum by (foo) (rate(native_histogram_series[1m])))",
+			wantEmptyForMixedTypes: true,
+		},
+		{
+			name:  "histogram_count and histogram_quantile of the same series",
+			query: "histogram_count(rate(native_histogram_series[1m])) * histogram_quantile(0.7, rate(native_histogram_series[1m]))",
+		},
+		{
+			name:  "histogram_quantile",
+			query: "histogram_quantile(0.7, native_histogram_series)",
+		},
+		{
+			name:  "histogram_fraction",
+			query: "histogram_fraction(0, 0.2, native_histogram_series)",
+		},
+		{
+			name:  "and",
+			query: `native_histogram_series and native_histogram_series{h=~"1.*"}`,
+		},
+		{
+			name:  "unless ignoring",
+			query: `native_histogram_series{h=~"1.*"} unless ignoring(le) native_histogram_series{h="1", le=""}`,
+		},
+		{
+			name:  "or",
+			query: `native_histogram_series{h=~"1.*"} or native_histogram_series{h=~".*1"}`,
+		},
+	}
+
+	t.Run("integer_histograms", func(t *testing.T) {
+		testNativeHistograms(t, cases, opts, generateNativeHistogramSeries)
+	})
+	t.Run("float_histograms", func(t *testing.T) {
+		testNativeHistograms(t, cases, opts, generateFloatHistogramSeries)
+	})
+}
+
+func testNativeHistograms(t *testing.T, cases []histogramTestCase, opts promql.EngineOpts, generateHistograms histogramGeneratorFunc) {
+	numHistograms := 100
+	mixedTypesOpts := []bool{false, true}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, withMixedTypes := range mixedTypesOpts {
+				t.Run(fmt.Sprintf("mixedTypes=%t", withMixedTypes), func(t *testing.T) {
+					test, err := promql.NewTest(t, "")
+					testutil.Ok(t, err)
+					defer test.Close()
+
+					app := test.Storage().Appender(context.TODO())
+					err = generateHistograms(app, numHistograms, withMixedTypes)
+					testutil.Ok(t, err)
+					testutil.Ok(t, app.Commit())
+					testutil.Ok(t, test.Run())
+
+					// New Engine
+					engine := engine.New(engine.Opts{
+						EngineOpts:        opts,
+						DisableFallback:   true,
+						LogicalOptimizers: logicalplan.AllOptimizers,
+					})
+
+					t.Run("instant", func(t *testing.T) {
+						qry, err := engine.NewInstantQuery(test.Queryable(), nil, tc.query, time.Unix(50, 0))
+						testutil.Ok(t, err)
+						newResult := qry.Exec(test.Context())
+						testutil.Ok(t, newResult.Err)
+						newVector, err := newResult.Vector()
+						testutil.Ok(t, err)
+
+						promEngine := test.QueryEngine()
+						qry, err = promEngine.NewInstantQuery(test.Queryable(), nil, tc.query, time.Unix(50, 0))
+						testutil.Ok(t, err)
+						promResult := qry.Exec(test.Context())
+						testutil.Ok(t, promResult.Err)
+						promVector, err := promResult.Vector()
+						testutil.Ok(t, err)
+
+						// Make sure we're not getting back empty results.
+						if withMixedTypes && tc.wantEmptyForMixedTypes {
+							testutil.Assert(t, len(promVector) == 0)
+						}
+
+						sortByLabels(promResult)
+						sortByLabels(newResult)
+						if hasNaNs(promResult) {
+							t.Log("Applying comparison with NaN equality.")
+							testutil.WithGoCmp(cmpopts.EquateNaNs()).Equals(t, promVector, newVector)
+						} else {
+							testutil.Equals(t, promVector, newVector)
+						}
+					})
+
+					t.Run("range", func(t *testing.T) {
+						qry, err := engine.NewRangeQuery(test.Queryable(), nil, tc.query, time.Unix(50, 0), time.Unix(600, 0), 30*time.Second)
+						testutil.Ok(t, err)
+						res := qry.Exec(test.Context())
+						testutil.Ok(t, res.Err)
+						actual, err := res.Matrix()
+						testutil.Ok(t, err)
+
+						promEngine := test.QueryEngine()
+						qry, err = promEngine.NewRangeQuery(test.Queryable(), nil, tc.query, time.Unix(50, 0), time.Unix(600, 0), 30*time.Second)
+						testutil.Ok(t, err)
+						res = qry.Exec(test.Context())
+						testutil.Ok(t, res.Err)
+						expected, err := res.Matrix()
+						testutil.Ok(t, err)
+
+						// Make sure we're not getting back empty results.
+						if withMixedTypes && tc.wantEmptyForMixedTypes {
+							testutil.Assert(t, len(expected) == 0)
+						}
+						testutil.Equals(t, len(expected), len(actual))
+						if hasNaNs(res) {
+							t.Log("Applying comparison with NaN equality.")
+							testutil.WithGoCmp(cmpopts.EquateNaNs()).Equals(t, expected, actual)
+						} else {
+							testutil.Equals(t, expected, actual)
+						}
+					})
+				})
+			}
+		})
+	}
+}
+
+func TestNativeHistogramQuantileMixedTypes(t *testing.T) {
+	for _, withMixedTypes := range []bool{false, true} {
+		t.Run(fmt.Sprintf("mixedTypes=%t", withMixedTypes), func(t *testing.T) {
+			test, err := promql.NewTest(t, "")
+			testutil.Ok(t, err)
+			defer test.Close()
+
+			app := test.Storage().Appender(context.TODO())
+			testutil.Ok(t, generateNativeHistogramSeries(app, 2, withMixedTypes))
+			testutil.Ok(t, app.Commit())
+			testutil.Ok(t, test.Run())
+
+			ng := engine.New(engine.Opts{
+				EngineOpts:      promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10},
+				DisableFallback: true,
+			})
+			qry, err := ng.NewInstantQuery(test.Queryable(), nil, "histogram_quantile(0.7, native_histogram_series)", time.Unix(50, 0))
+			testutil.Ok(t, err)
+			result := qry.Exec(test.Context())
+			testutil.Ok(t, result.Err)
+			vector, err := result.Vector()
+			testutil.Ok(t, err)
+
+			if !withMixedTypes {
+				testutil.Equals(t, 2, len(vector))
+				testutil.Equals(t, 0, len(result.Warnings))
+				return
+			}
+			testutil.Equals(t, 0, len(vector))
+			testutil.Equals(t, 1, len(result.Warnings))
+			testutil.Equals(t, `PromQL warning: vector contains a mix of classic and native histograms for metric name "native_histogram_series"`, result.Warnings[0].Error())
+		})
+	}
+}
+
+func TestNativeHistogramAverage(t *testing.T) {
+	h1 := &histogram.FloatHistogram{
+		Schema:          0,
+		Count:           4,
+		Sum:             4,
+		PositiveSpans:   []histogram.Span{{Offset: 0, Length: 2}},
+		PositiveBuckets: []float64{2, 2},
+	}
+	// The second histogram has a higher schema, so it is reduced to the schema of the first one.
+	h2 := &histogram.FloatHistogram{
+		Schema:          1,
+		Count:           6,
+		Sum:             10,
+		PositiveSpans:   []histogram.Span{{Offset: 0, Length: 4}},
+		PositiveBuckets: []float64{1, 2, 1, 2},
+	}
+
+	for _, withMixedTypes := range []bool{false, true} {
+		t.Run(fmt.Sprintf("mixedTypes=%t", withMixedTypes), func(t *testing.T) {
+			test, err := promql.NewTest(t, "")
+			testutil.Ok(t, err)
+			defer test.Close()
+
+			app := test.Storage().Appender(context.TODO())
+			_, err = app.AppendHistogram(0, labels.FromStrings(labels.MetricName, "native_histogram_series", "foo", "bar", "h", "1"), 0, nil, h1)
+			testutil.Ok(t, err)
+			_, err = app.AppendHistogram(0, labels.FromStrings(labels.MetricName, "native_histogram_series", "foo", "bar", "h", "2"), 0, nil, h2)
+			testutil.Ok(t, err)
+			if withMixedTypes {
+				_, err = app.Append(0, labels.FromStrings(labels.MetricName, "native_histogram_series", "foo", "bar", "h", "3"), 0, 1)
+				testutil.Ok(t, err)
+			}
+			testutil.Ok(t, app.Commit())
+			testutil.Ok(t, test.Run())
+
+			ng := engine.New(engine.Opts{
+				EngineOpts:      promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10},
+				DisableFallback: true,
+			})
+			cases := []struct {
+				query    string
+				op       string
+				expected *histogram.FloatHistogram
+			}{
+				{query: "avg(native_histogram_series)", op: "avg", expected: h1.Copy().Add(h2).Scale(0.5)},
+				{query: "avg by (foo) (native_histogram_series)", op: "avg", expected: h1.Copy().Add(h2).Scale(0.5)},
+				{query: "sum by (foo) (native_histogram_series)", op: "sum", expected: h1.Copy().Add(h2)},
+			}
+			for _, tcase := range cases {
+				t.Run(tcase.query, func(t *testing.T) {
+					qry, err := ng.NewInstantQuery(test.Queryable(), nil, tcase.query, time.Unix(0, 0))
+					testutil.Ok(t, err)
+					result := qry.Exec(test.Context())
+					testutil.Ok(t, result.Err)
+					vector, err := result.Vector()
+					testutil.Ok(t, err)
+
+					if withMixedTypes {
+						testutil.Equals(t, 0, len(vector))
+						testutil.Equals(t, 1, len(result.Warnings))
+						expectedWarning := fmt.Sprintf("PromQL warning: encountered a mix of histograms and floats for %s aggregation", tcase.op)
+						testutil.Equals(t, expectedWarning, result.Warnings[0].Error())
+						return
+					}
+					testutil.Equals(t, 1, len(vector))
+					testutil.Equals(t, 0, len(result.Warnings))
+					testutil.Equals(t, tcase.expected, vector[0].H)
+				})
+			}
+		})
+	}
+}
+
+func TestNativeHistogramScalarArithmetic(t *testing.T) {
+	test, err := promql.NewTest(t, "")
+	testutil.Ok(t, err)
+	defer test.Close()
+
+	h := &histogram.FloatHistogram{
+		Schema:          0,
+		Count:           4,
+		Sum:             6,
+		PositiveSpans:   []histogram.Span{{Offset: 0, Length: 2}},
+		PositiveBuckets: []float64{1, 3},
+	}
+	app := test.Storage().Appender(context.TODO())
+	_, err = app.AppendHistogram(0, labels.FromStrings(labels.MetricName, "native_histogram_series", "foo", "bar"), 0, nil, h)
+	testutil.Ok(t, err)
+	_, err = app.Append(0, labels.FromStrings(labels.MetricName, "float_series"), 0, 4)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, test.Run())
+
+	ng := engine.New(engine.Opts{
+		EngineOpts:      promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10},
+		DisableFallback: true,
+	})
+	cases := []struct {
+		query           string
+		expected        *histogram.FloatHistogram
+		expectedWarning string
+	}{
+		{query: "native_histogram_series * 3", expected: h.Copy().Scale(3)},
+		{query: "3 * native_histogram_series", expected: h.Copy().Scale(3)},
+		{query: "native_histogram_series / 2", expected: h.Copy().Scale(0.5)},
+		{query: "native_histogram_series * scalar(float_series)", expected: h.Copy().Scale(4)},
+		{
+			query:           "native_histogram_series + 1",
+			expectedWarning: `PromQL info: incompatible sample types encountered for binary operator "+": histogram + float`,
+		},
+		{
+			query:           "2 / native_histogram_series",
+			expectedWarning: `PromQL info: incompatible sample types encountered for binary operator "/": float / histogram`,
+		},
+		{
+			query:           "native_histogram_series > 1",
+			expectedWarning: `PromQL info: incompatible sample types encountered for binary operator ">": histogram > float`,
+		},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.query, func(t *testing.T) {
+			qry, err := ng.NewInstantQuery(test.Queryable(), nil, tcase.query, time.Unix(0, 0))
+			testutil.Ok(t, err)
+			result := qry.Exec(test.Context())
+			testutil.Ok(t, result.Err)
+			vector, err := result.Vector()
+			testutil.Ok(t, err)
+
+			if tcase.expectedWarning != "" {
+				testutil.Equals(t, 0, len(vector))
+				testutil.Equals(t, 1, len(result.Warnings))
+				testutil.Equals(t, tcase.expectedWarning, result.Warnings[0].Error())
+				return
+			}
+			testutil.Equals(t, 1, len(vector))
+			testutil.Equals(t, 0, len(result.Warnings))
+			testutil.Equals(t, labels.FromStrings("foo", "bar"), vector[0].Metric)
+			testutil.Equals(t, tcase.expected, vector[0].H)
+		})
+	}
+}
+
+func TestStepInvariantNativeHistograms(t *testing.T) {
+	test, err := promql.NewTest(t, "")
+	testutil.Ok(t, err)
+	defer test.Close()
+
+	app := test.Storage().Appender(context.TODO())
+	for ts := int64(0); ts <= 120_000; ts += 30_000 {
+		h := &histogram.FloatHistogram{
+			Count:           float64(ts / 1000),
+			Sum:             float64(ts / 1000),
+			PositiveSpans:   []histogram.Span{{Offset: 0, Length: 1}},
+			PositiveBuckets: []float64{float64(ts / 1000)},
+		}
+		_, err = app.AppendHistogram(0, labels.FromStrings(labels.MetricName, "native_histogram", "pod", "nginx-1"), ts, nil, h)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, test.Run())
+
+	ng := engine.New(engine.Opts{
+		EngineOpts:      promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64},
+		DisableFallback: true,
+	})
+	for _, query := range []string{`native_histogram @ 60`, `sum(native_histogram @ 60)`} {
+		t.Run(query, func(t *testing.T) {
+			qry, err := ng.NewRangeQuery(test.Queryable(), nil, query, time.Unix(0, 0), time.Unix(120, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer qry.Close()
+
+			result := qry.Exec(test.Context())
+			testutil.Ok(t, result.Err)
+			matrix, err := result.Matrix()
+			testutil.Ok(t, err)
+			testutil.Equals(t, 1, len(matrix))
+			testutil.Equals(t, 5, len(matrix[0].Histograms))
+			for _, p := range matrix[0].Histograms {
+				testutil.Equals(t, 60.0, p.H.Sum)
+			}
+		})
+	}
+}
+
+func TestHistogramStatsCounterResets(t *testing.T) {
+	test, err := promql.NewTest(t, "")
+	testutil.Ok(t, err)
+	defer test.Close()
+
+	// The count increases between the last two histograms, but the
+	// first bucket decreases, which indicates a counter reset.
+	buckets := [][]float64{{1, 1}, {5, 5}, {1, 12}}
+	app := test.Storage().Appender(context.TODO())
+	for i, b := range buckets {
+		h := &histogram.FloatHistogram{
+			Count:           b[0] + b[1],
+			Sum:             b[0] + b[1],
+			PositiveSpans:   []histogram.Span{{Offset: 0, Length: 2}},
+			PositiveBuckets: b,
+		}
+		_, err = app.AppendHistogram(0, labels.FromStrings(labels.MetricName, "native_histogram", "pod", "nginx-1"), int64(i)*30_000, nil, h)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, test.Run())
+
+	ng := engine.New(engine.Opts{
+		EngineOpts:        promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64},
+		DisableFallback:   true,
+		LogicalOptimizers: logicalplan.AllOptimizers,
+	})
+	for _, query := range []string{
+		`histogram_count(increase(native_histogram[2m]))`,
+		`histogram_sum(rate(native_histogram[1m]))`,
+	} {
+		t.Run(query, func(t *testing.T) {
+			qry, err := ng.NewInstantQuery(test.Queryable(), nil, query, time.Unix(60, 0))
+			testutil.Ok(t, err)
+			defer qry.Close()
+			result := qry.Exec(test.Context())
+			testutil.Ok(t, result.Err)
+
+			promQry, err := test.QueryEngine().NewInstantQuery(test.Queryable(), nil, query, time.Unix(60, 0))
+			testutil.Ok(t, err)
+			defer promQry.Close()
+			promResult := promQry.Exec(test.Context())
+			testutil.Ok(t, promResult.Err)
+
+			testutil.Equals(t, promResult.Value, result.Value)
+		})
+	}
+}
+
+func TestNativeHistogramBinaryArithmetic(t *testing.T) {
+	test, err := promql.NewTest(t, "")
+	testutil.Ok(t, err)
+	defer test.Close()
+
+	// Buckets (0.707, 1] and (1, 1.414].
+	highRes := &histogram.FloatHistogram{
+		Schema:          1,
+		Count:           3,
+		Sum:             3,
+		PositiveSpans:   []histogram.Span{{Offset: 0, Length: 2}},
+		PositiveBuckets: []float64{1, 2},
+	}
+	// Buckets (0.5, 1] and (1, 2].
+	lowRes := &histogram.FloatHistogram{
+		Schema:          0,
+		Count:           7,
+		Sum:             10,
+		PositiveSpans:   []histogram.Span{{Offset: 0, Length: 2}},
+		PositiveBuckets: []float64{3, 4},
+	}
+	unknownSchema := highRes.Copy()
+	unknownSchema.Schema = 9
+
+	app := test.Storage().Appender(context.TODO())
+	for _, s := range []struct {
+		name string
+		h    *histogram.FloatHistogram
+	}{
+		{name: "high_res_histogram", h: highRes},
+		{name: "low_res_histogram", h: lowRes},
+		{name: "unknown_schema_histogram", h: unknownSchema},
+	} {
+		_, err = app.AppendHistogram(0, labels.FromStrings(labels.MetricName, s.name, "foo", "bar"), 0, nil, s.h)
+		testutil.Ok(t, err)
+	}
+	_, err = app.Append(0, labels.FromStrings(labels.MetricName, "float_series", "foo", "bar"), 0, 2)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, test.Run())
+
+	ng := engine.New(engine.Opts{
+		EngineOpts:      promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10},
+		DisableFallback: true,
+	})
+	cases := []struct {
+		query           string
+		expected        *histogram.FloatHistogram
+		expectedWarning string
+	}{
+		{
+			query: "high_res_histogram + low_res_histogram",
+			expected: &histogram.FloatHistogram{
+				Schema:          0,
+				Count:           10,
+				Sum:             13,
+				PositiveSpans:   []histogram.Span{{Offset: 0, Length: 2}},
+				PositiveBuckets: []float64{4, 6},
+			},
+		},
+		{
+			query: "low_res_histogram + high_res_histogram",
+			expected: &histogram.FloatHistogram{
+				Schema:          0,
+				Count:           10,
+				Sum:             13,
+				PositiveSpans:   []histogram.Span{{Offset: 0, Length: 2}},
+				PositiveBuckets: []float64{4, 6},
+			},
+		},
+		{
+			query: "low_res_histogram - high_res_histogram",
+			expected: &histogram.FloatHistogram{
+				Schema:          0,
+				Count:           4,
+				Sum:             7,
+				PositiveSpans:   []histogram.Span{{Offset: 0, Length: 2}},
+				PositiveBuckets: []float64{2, 2},
+			},
+		},
+		{
+			query: "high_res_histogram - low_res_histogram",
+			expected: &histogram.FloatHistogram{
+				Schema:          0,
+				Count:           -4,
+				Sum:             -7,
+				PositiveSpans:   []histogram.Span{{Offset: 0, Length: 2}},
+				PositiveBuckets: []float64{-2, -2},
+			},
+		},
+		{query: "high_res_histogram * on(foo) float_series", expected: highRes.Copy().Scale(2)},
+		{query: "float_series * on(foo) high_res_histogram", expected: highRes.Copy().Scale(2)},
+		{
+			query:           "high_res_histogram + on(foo) float_series",
+			expectedWarning: `PromQL info: incompatible sample types encountered for binary operator "+": histogram + float`,
+		},
+		{
+			query:           "high_res_histogram * low_res_histogram",
+			expectedWarning: `PromQL info: incompatible sample types encountered for binary operator "*": histogram * histogram`,
+		},
+		{
+			query:           "high_res_histogram + unknown_schema_histogram",
+			expectedWarning: `PromQL warning: incompatible bucket layout encountered for binary operator "+"`,
+		},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.query, func(t *testing.T) {
+			qry, err := ng.NewInstantQuery(test.Queryable(), nil, tcase.query, time.Unix(0, 0))
+			testutil.Ok(t, err)
+			result := qry.Exec(test.Context())
+			testutil.Ok(t, result.Err)
+			vector, err := result.Vector()
+			testutil.Ok(t, err)
+
+			if tcase.expectedWarning != "" {
+				testutil.Equals(t, 0, len(vector))
+				testutil.Equals(t, 1, len(result.Warnings))
+				testutil.Equals(t, tcase.expectedWarning, result.Warnings[0].Error())
+				return
+			}
+			testutil.Equals(t, 1, len(vector))
+			testutil.Equals(t, 0, len(result.Warnings))
+			testutil.Equals(t, labels.FromStrings("foo", "bar"), vector[0].Metric)
+			testutil.Equals(t, tcase.expected, vector[0].H)
+		})
+	}
+}
+
+func TestNativeHistogramStdDev(t *testing.T) {
+	test, err := promql.NewTest(t, "")
+	testutil.Ok(t, err)
+	defer test.Close()
+
+	// Buckets (0.5, 1] and (1, 2] with two observations each.
+	h := &histogram.FloatHistogram{
+		Schema:          0,
+		Count:           4,
+		Sum:             4,
+		PositiveSpans:   []histogram.Span{{Offset: 0, Length: 2}},
+		PositiveBuckets: []float64{2, 2},
+	}
+	app := test.Storage().Appender(context.TODO())
+	_, err = app.AppendHistogram(0, labels.FromStrings(labels.MetricName, "native_histogram_series", "foo", "bar"), 0, nil, h)
+	testutil.Ok(t, err)
+	_, err = app.Append(0, labels.FromStrings(labels.MetricName, "float_series", "foo", "baz"), 0, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, test.Run())
+
+	variance := (2*math.Pow(math.Sqrt(0.5)-1, 2) + 2*math.Pow(math.Sqrt(2)-1, 2)) / 4
+	cases := []struct {
+		query    string
+		expected float64
+	}{
+		{query: "histogram_stdvar(native_histogram_series)", expected: variance},
+		{query: "histogram_stddev(native_histogram_series)", expected: math.Sqrt(variance)},
+		{query: `histogram_stddev({foo=~"ba.*"})`, expected: math.Sqrt(variance)},
+	}
+	ng := engine.New(engine.Opts{
+		EngineOpts:      promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10},
+		DisableFallback: true,
+	})
+	for _, tcase := range cases {
+		t.Run(tcase.query, func(t *testing.T) {
+			qry, err := ng.NewInstantQuery(test.Queryable(), nil, tcase.query, time.Unix(0, 0))
+			testutil.Ok(t, err)
+			result := qry.Exec(test.Context())
+			testutil.Ok(t, result.Err)
+			vector, err := result.Vector()
+			testutil.Ok(t, err)
+
+			testutil.Equals(t, 1, len(vector))
+			testutil.Equals(t, labels.FromStrings("foo", "bar"), vector[0].Metric)
+			testutil.Assert(t, math.Abs(tcase.expected-vector[0].F) < 1e-12, "expected %v, got %v", tcase.expected, vector[0].F)
+		})
+	}
+}
+
+func TestNativeHistogramRateWithResetsAndMixedTypes(t *testing.T) {
+	test, err := promql.NewTest(t, "")
+	testutil.Ok(t, err)
+	defer test.Close()
+
+	app := test.Storage().Appender(context.TODO())
+	histograms := tsdbutil.GenerateTestFloatHistograms(20)
+	lowerSchema := histograms[0].CopyToSchema(histograms[0].Schema - 1)
+	for i := 0; i < 40; i++ {
+		ts := time.Unix(int64(i*15), 0).UnixMilli()
+
+		// The counter resets after 20 samples and one sample has a lower schema.
+		h := histograms[i%20]
+		if i == 25 {
+			h = histograms[i%20].CopyToSchema(lowerSchema.Schema)
+		}
+		_, err := app.AppendHistogram(0, labels.FromStrings(labels.MetricName, "native_histogram_series", "series", "resets"), ts, nil, h)
+		testutil.Ok(t, err)
+
+		// The series changes from floats to histograms half way through.
+		lbls := labels.FromStrings(labels.MetricName, "native_histogram_series", "series", "mixed")
+		if i < 20 {
+			_, err = app.Append(0, lbls, ts, float64(i))
+		} else {
+			_, err = app.AppendHistogram(0, lbls, ts, nil, histograms[i%20])
+		}
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, test.Run())
+
+	ng := engine.New(engine.Opts{
+		EngineOpts:      promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10},
+		DisableFallback: true,
+	})
+	for _, query := range []string{
+		"rate(native_histogram_series[1m])",
+		"increase(native_histogram_series[2m])",
+		"delta(native_histogram_series[1m])",
+	} {
+		t.Run(query, func(t *testing.T) {
+			qry, err := ng.NewRangeQuery(test.Queryable(), nil, query, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			newResult := qry.Exec(test.Context())
+			testutil.Ok(t, newResult.Err)
+
+			qry, err = test.QueryEngine().NewRangeQuery(test.Queryable(), nil, query, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			promResult := qry.Exec(test.Context())
+			testutil.Ok(t, promResult.Err)
+
+			testutil.Equals(t, promResult, newResult)
+		})
+	}
+}
+
+func generateNativeHistogramSeries(app storage.Appender, numSeries int, withMixedTypes bool) error {
+	commonLabels := []string{labels.MetricName, "native_histogram_series", "foo", "bar"}
+	series := make([][]*histogram.Histogram, numSeries)
+	for i := range series {
+		series[i] = tsdbutil.GenerateTestHistograms(2000)
+	}
+	higherSchemaHist := &histogram.Histogram{
+		Schema: 3,
+		PositiveSpans: []histogram.Span{
+			{Offset: -5, Length: 2}, // -5 -4
+			{Offset: 2, Length: 3},  // -1 0 1
+			{Offset: 2, Length: 2},  // 4 5
+		},
+		PositiveBuckets: []int64{1, 2, -2, 1, -1, 0, 3},
+		Count:           13,
+	}
+	for sid, histograms := range series {
+		lbls := append(commonLabels, "h", strconv.Itoa(sid))
+		for i := range histograms {
+			ts := time.Unix(int64(i*15), 0).UnixMilli()
+			if i == 0 {
+				// Inject a histogram with a higher schema.
+				// Regression test for:
+				// * https://github.com/thanos-community/promql-engine/pull/182
+				// * https://github.com/thanos-community/promql-engine/pull/183.
+				if _, err := app.AppendHistogram(0, labels.FromStrings(lbls...), ts, higherSchemaHist, nil); err != nil {
+					return err
+				}
+			}
+			if _, err := app.AppendHistogram(0, labels.FromStrings(lbls...), ts, histograms[i], nil); err != nil {
+				return err
+			}
+			if withMixedTypes {
+				if _, err := app.Append(0, labels.FromStrings(append(lbls, "le", "1")...), ts, float64(i)); err != nil {
+					return err
+				}
+				if _, err := app.Append(0, labels.FromStrings(append(lbls, "le", "+Inf")...), ts, float64(i*2)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func generateFloatHistogramSeries(app storage.Appender, numSeries int, withMixedTypes bool) error {
+	lbls := []string{labels.MetricName, "native_histogram_series", "foo", "bar"}
+	h1 := tsdbutil.GenerateTestFloatHistograms(numSeries)
+	h2 := tsdbutil.GenerateTestFloatHistograms(numSeries)
+	for i := range h1 {
+		ts := time.Unix(int64(i*15), 0).UnixMilli()
+		if withMixedTypes {
+			if _, err := app.Append(0, labels.FromStrings(append(lbls, "le", "1")...), ts, float64(i)); err != nil {
+				return err
+			}
+			if _, err := app.Append(0, labels.FromStrings(append(lbls, "le", "+Inf")...), ts, float64(i*2)); err != nil {
+				return err
+			}
+		}
+		if _, err := app.AppendHistogram(0, labels.FromStrings(append(lbls, "h", "1")...), ts, nil, h1[i]); err != nil {
+			return err
+		}
+		if _, err := app.AppendHistogram(0, labels.FromStrings(append(lbls, "h", "2")...), ts, nil, h2[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestMixedNativeHistogramTypes(t *testing.T) {
+	histograms := tsdbutil.GenerateTestHistograms(2)
+
+	test, err := promql.NewTest(t, "")
+	testutil.Ok(t, err)
+	defer test.Close()
+
+	lbls := []string{labels.MetricName, "native_histogram_series"}
+
+	app := test.Storage().Appender(context.TODO())
+	_, err = app.AppendHistogram(0, labels.FromStrings(lbls...), 0, nil, histograms[0].ToFloat())
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	app = test.Storage().Appender(context.TODO())
+	_, err = app.AppendHistogram(0, labels.FromStrings(lbls...), 30_000, histograms[1], nil)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	testutil.Ok(t, test.Run())
+
+	opts := promql.EngineOpts{
+		Timeout:              1 * time.Hour,
+		MaxSamples:           1e10,
+		EnableNegativeOffset: true,
+		EnableAtModifier:     true,
+	}
+
+	engine := engine.New(engine.Opts{
+		EngineOpts:        opts,
+		DisableFallback:   true,
+		LogicalOptimizers: logicalplan.AllOptimizers,
+	})
+
+	t.Run("vector_select", func(t *testing.T) {
+		qry, err := engine.NewInstantQuery(test.Queryable(), nil, "sum(native_histogram_series)", time.Unix(30, 0))
+		testutil.Ok(t, err)
+		res := qry.Exec(context.Background())
+		testutil.Ok(t, res.Err)
+		actual, err := res.Vector()
+		testutil.Ok(t, err)
+
+		testutil.Equals(t, 1, len(actual), "expected vector with 1 element")
+		expected := histograms[1].ToFloat()
+		expected.CounterResetHint = histogram.UnknownCounterReset
+		testutil.Equals(t, expected, actual[0].H)
+	})
+
+	t.Run("matrix_select", func(t *testing.T) {
+		qry, err := engine.NewRangeQuery(test.Queryable(), nil, "rate(native_histogram_series[1m])", time.Unix(0, 0), time.Unix(60, 0), 60*time.Second)
+		testutil.Ok(t, err)
+		res := qry.Exec(context.Background())
+		testutil.Ok(t, res.Err)
+		actual, err := res.Matrix()
+		testutil.Ok(t, err)
+
+		testutil.Equals(t, 1, len(actual), "expected 1 series")
+		testutil.Equals(t, 1, len(actual[0].Histograms), "expected 1 point")
+		expected := histograms[1].ToFloat().Sub(histograms[0].ToFloat()).Scale(1 / float64(30))
+		expected.CounterResetHint = histogram.GaugeType
+		testutil.Equals(t, expected, actual[0].Histograms[0].H)
+	})
+}
+
+func TestNativeHistogramStaleMarkers(t *testing.T) {
+	histograms := tsdbutil.GenerateTestHistograms(3)
+	staleHistogram := &histogram.Histogram{Sum: math.Float64frombits(value.StaleNaN)}
+
+	test, err := promql.NewTest(t, "")
+	testutil.Ok(t, err)
+	defer test.Close()
+
+	app := test.Storage().Appender(context.TODO())
+	for i, h := range histograms {
+		ts := time.Unix(int64(i*15), 0).UnixMilli()
+		_, err = app.AppendHistogram(0, labels.FromStrings(labels.MetricName, "native_histogram_series", "h", "1"), ts, h, nil)
+		testutil.Ok(t, err)
+		_, err = app.AppendHistogram(0, labels.FromStrings(labels.MetricName, "native_histogram_series", "h", "2"), ts, nil, h.ToFloat())
+		testutil.Ok(t, err)
+		// The same samples without a stale marker.
+		_, err = app.AppendHistogram(0, labels.FromStrings(labels.MetricName, "native_histogram_without_stale", "h", "1"), ts, h, nil)
+		testutil.Ok(t, err)
+		_, err = app.AppendHistogram(0, labels.FromStrings(labels.MetricName, "native_histogram_without_stale", "h", "2"), ts, nil, h.ToFloat())
+		testutil.Ok(t, err)
+	}
+	_, err = app.AppendHistogram(0, labels.FromStrings(labels.MetricName, "native_histogram_series", "h", "1"), 45_000, staleHistogram, nil)
+	testutil.Ok(t, err)
+	_, err = app.AppendHistogram(0, labels.FromStrings(labels.MetricName, "native_histogram_series", "h", "2"), 45_000, nil, staleHistogram.ToFloat())
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, test.Run())
+
+	opts := promql.EngineOpts{
+		Timeout:    1 * time.Hour,
+		MaxSamples: 1e10,
+	}
+	newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true})
+
+	for _, query := range []string{
+		"native_histogram_series",
+		"rate(native_histogram_series[1m])",
+	} {
+		t.Run(query, func(t *testing.T) {
+			qry, err := newEngine.NewRangeQuery(test.Queryable(), nil, query, time.Unix(0, 0), time.Unix(120, 0), 15*time.Second)
+			testutil.Ok(t, err)
+			res := qry.Exec(test.Context())
+			testutil.Ok(t, res.Err)
+			actual, err := res.Matrix()
+			testutil.Ok(t, err)
+
+			qry, err = test.QueryEngine().NewRangeQuery(test.Queryable(), nil, query, time.Unix(0, 0), time.Unix(120, 0), 15*time.Second)
+			testutil.Ok(t, err)
+			res = qry.Exec(test.Context())
+			testutil.Ok(t, res.Err)
+			expected, err := res.Matrix()
+			testutil.Ok(t, err)
+
+			testutil.Equals(t, 2, len(expected))
+			testutil.Equals(t, expected, actual)
+		})
+	}
+
+	// Extended range functions are not supported by Prometheus. Stale markers are skipped by
+	// their selectors, so they return the same result as for the series without the marker.
+	xEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true, EnableXFunctions: true})
+	for _, function := range []string{"xrate", "xincrease", "xdelta"} {
+		t.Run(function, func(t *testing.T) {
+			execute := func(query string) promql.Matrix {
+				qry, err := xEngine.NewRangeQuery(test.Queryable(), nil, query, time.Unix(0, 0), time.Unix(120, 0), 15*time.Second)
+				testutil.Ok(t, err)
+				res := qry.Exec(test.Context())
+				testutil.Ok(t, res.Err)
+				m, err := res.Matrix()
+				testutil.Ok(t, err)
+				return m
+			}
+
+			expected := execute(function + "(native_histogram_without_stale[1m])")
+			actual := execute(function + "(native_histogram_series[1m])")
+			testutil.Equals(t, 2, len(expected))
+			testutil.Equals(t, expected, actual)
+		})
+	}
+}
+
+func sortByLabels(r *promql.Result) {
+	switch r.Value.Type() {
+	case promparser.ValueTypeVector:
+		m, _ := r.Vector()
+		sort.Sort(samplesByLabels(m))
+		r.Value = m
+	case promparser.ValueTypeMatrix:
+		m, _ := r.Matrix()
+		sort.Sort(seriesByLabels(m))
+		r.Value = m
+	}
+}
+
+type seriesByLabels []promql.Series
+
+func (b seriesByLabels) Len() int           { return len(b) }
+func (b seriesByLabels) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b seriesByLabels) Less(i, j int) bool { return labels.Compare(b[i].Metric, b[j].Metric) < 0 }
+
+type samplesByLabels []promql.Sample
+
+func (b samplesByLabels) Len() int           { return len(b) }
+func (b samplesByLabels) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b samplesByLabels) Less(i, j int) bool { return labels.Compare(b[i].Metric, b[j].Metric) < 0 }
+
+// roundValues rounds all values to 10 decimal points and
+// can be used to eliminate floating point division errors
+// when comparing two promql results.
+func roundValues(r *promql.Result) {
+	switch result := r.Value.(type) {
+	case promql.Matrix:
+		for i := range result {
+			for j := range result[i].Floats {
+				result[i].Floats[j].F = math.Floor(result[i].Floats[j].F*1e10) / 1e10
+			}
+		}
+	case promql.Vector:
+		for i := range result {
+			result[i].F = math.Floor(result[i].F*10e10) / 10e10
+		}
+	}
+}
+
+// emptyLabelsToNil sets empty labelsets to nil to work around inconsistent
+// results from the old engine depending on the literal type (e.g. number vs. compare).
+func emptyLabelsToNil(result *promql.Result) {
+	if value, ok := result.Value.(promql.Matrix); ok {
+		for i, s := range value {
+			if len(s.Metric) == 0 {
+				result.Value.(promql.Matrix)[i].Metric = nil
+			}
+		}
+	}
+}
+
+type countingQueryable struct {
+	storage.Queryable
+	// sharded makes queriers support sharded selects.
+	sharded bool
+
+	mu      sync.Mutex
+	selects int
+}
+
+func (q *countingQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	querier, err := q.Queryable.Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	if q.sharded {
+		return &countingShardedQuerier{countingQuerier{Querier: querier, queryable: q}}, nil
+	}
+	return &countingQuerier{Querier: querier, queryable: q}, nil
+}
+
+type countingQuerier struct {
+	storage.Querier
+	queryable *countingQueryable
+}
+
+func (q *countingQuerier) Select(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	q.queryable.mu.Lock()
+	q.queryable.selects++
+	q.queryable.mu.Unlock()
+	return q.Querier.Select(sortSeries, hints, matchers...)
+}
+
+type countingShardedQuerier struct {
+	countingQuerier
+}
+
+func (q *countingShardedQuerier) SelectShard(sortSeries bool, hints *engstore.ShardedSelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	var series []storage.Series
+	seriesSet := q.Select(sortSeries, &hints.SelectHints, matchers...)
+	for i := uint64(0); seriesSet.Next(); i++ {
+		if i%hints.ShardCount == hints.ShardIndex {
+			series = append(series, seriesSet.At())
+		}
+	}
+	if seriesSet.Err() != nil {
+		return storage.ErrSeriesSet(seriesSet.Err())
+	}
+	return newTestSeriesSet(series...)
+}
+
+func TestSeriesCache(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1", route="/"} 1+1x40
+				http_requests_total{pod="nginx-2", route="/"} 1+2x40
+				http_requests_total{pod="nginx-1", route="/api"} 1+3x40`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	queries := []string{
+		`sum by (pod) (rate(http_requests_total[1m]))`,
+		`http_requests_total`,
+		`sum(http_requests_total)`,
+	}
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64}
+	for _, query := range queries {
+		t.Run(query, func(t *testing.T) {
+			q, err := promql.NewEngine(opts).NewRangeQuery(test.Storage(), nil, query, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer q.Close()
+			expected := q.Exec(context.Background())
+			testutil.Ok(t, expected.Err)
+
+			queryable := &countingQueryable{Queryable: test.Storage()}
+			newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true, SeriesCache: engstore.NewSeriesCache(10000, time.Hour)})
+			// Later executions are served from the series selected by the first one.
+			for i := 0; i < 3; i++ {
+				q, err := newEngine.NewRangeQuery(queryable, nil, query, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+				testutil.Ok(t, err)
+				defer q.Close()
+
+				result := q.Exec(context.Background())
+				testutil.Ok(t, result.Err)
+				testutil.WithGoCmp(comparer).Equals(t, expected, result)
+			}
+			testutil.Equals(t, 1, queryable.selects)
+
+			// Selections which are not served from the cache are read as chunks with chunk querying.
+			chunkQueryable := &countingChunkQueryable{countingQueryable: &countingQueryable{Queryable: test.Storage()}, chunkQueryable: test.Storage()}
+			newEngine = engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true, EnableChunkQuerying: true, SeriesCache: engstore.NewSeriesCache(10000, time.Hour)})
+			for i := 0; i < 3; i++ {
+				q, err := newEngine.NewRangeQuery(chunkQueryable, nil, query, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+				testutil.Ok(t, err)
+				defer q.Close()
+
+				result := q.Exec(context.Background())
+				testutil.Ok(t, result.Err)
+				testutil.WithGoCmp(comparer).Equals(t, expected, result)
+			}
+			testutil.Equals(t, 0, chunkQueryable.selects)
+			testutil.Equals(t, 1, chunkQueryable.chunkSelects)
+		})
+	}
+}
+
+// countingChunkQueryable counts the selects of its queriers and of its chunk queriers.
+type countingChunkQueryable struct {
+	*countingQueryable
+	chunkQueryable storage.ChunkQueryable
+
+	chunkSelects int
+}
+
+func (q *countingChunkQueryable) ChunkQuerier(ctx context.Context, mint, maxt int64) (storage.ChunkQuerier, error) {
+	querier, err := q.chunkQueryable.ChunkQuerier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	return &countingChunkQuerier{ChunkQuerier: querier, queryable: q}, nil
+}
+
+type countingChunkQuerier struct {
+	storage.ChunkQuerier
+	queryable *countingChunkQueryable
+}
+
+func (q *countingChunkQuerier) Select(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.ChunkSeriesSet {
+	q.queryable.mu.Lock()
+	q.queryable.chunkSelects++
+	q.queryable.mu.Unlock()
+	return q.ChunkQuerier.Select(sortSeries, hints, matchers...)
+}
+
+func TestSelectorRanges(t *testing.T) {
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64, LookbackDelta: 5 * time.Minute}
+	ng := engine.New(engine.Opts{EngineOpts: opts, EnableXFunctions: true, ExtLookbackDelta: time.Minute})
+
+	q, err := ng.NewRangeQuery(storageWithSeries(), nil, `xrate(http_requests_total[1m] offset 1m) / http_responses_total`, time.Unix(600, 0), time.Unix(1200, 0), 30*time.Second)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	ranges := q.(interface {
+		SelectorRanges() []logicalplan.SelectorRange
+	}).SelectorRanges()
+	testutil.Equals(t, 2, len(ranges))
+	testutil.Equals(t, "http_requests_total", ranges[0].Selector.Name)
+	testutil.Equals(t, int64(420_000), ranges[0].MinT)
+	testutil.Equals(t, int64(1_140_000), ranges[0].MaxT)
+	testutil.Equals(t, "http_responses_total", ranges[1].Selector.Name)
+	testutil.Equals(t, int64(300_000), ranges[1].MinT)
+	testutil.Equals(t, int64(1_200_000), ranges[1].MaxT)
+}
+
+func TestScalarCountExplain(t *testing.T) {
+	var buf bytes.Buffer
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64}
+	ng := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true, DebugWriter: &buf})
+
+	q, err := ng.NewRangeQuery(storageWithSeries(), nil, `http_requests_total > scalar(count(up{job="api"}))`, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	explanation := buf.String()
+	testutil.Assert(t, strings.Contains(explanation, `[*countScalarOperator] scalar(count(up{job="api"}))`), "expected dedicated operator, got %s", explanation)
+	testutil.Assert(t, !strings.Contains(explanation, "[*aggregate]"), "expected no aggregation, got %s", explanation)
+	testutil.Assert(t, !strings.Contains(explanation, "scalarFunctionOperator"), "expected no scalar function, got %s", explanation)
+}
+
+func TestComparisonPushdown(t *testing.T) {
+	test, err := promql.NewTest(t, "")
+	testutil.Ok(t, err)
+	defer test.Close()
+
+	h := &histogram.FloatHistogram{
+		Schema:          0,
+		Count:           4,
+		Sum:             6,
+		PositiveSpans:   []histogram.Span{{Offset: 0, Length: 2}},
+		PositiveBuckets: []float64{1, 3},
+	}
+	app := test.Storage().Appender(context.TODO())
+	_, err = app.AppendHistogram(0, labels.FromStrings(labels.MetricName, "http_requests_total", "pod", "nginx-1"), 0, nil, h)
+	testutil.Ok(t, err)
+	_, err = app.Append(0, labels.FromStrings(labels.MetricName, "http_requests_total", "pod", "nginx-2"), 0, 4)
+	testutil.Ok(t, err)
+	_, err = app.Append(0, labels.FromStrings(labels.MetricName, "http_requests_total", "pod", "nginx-3"), 0, 8)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, test.Run())
+
+	var buf bytes.Buffer
+	ng := engine.New(engine.Opts{
+		EngineOpts:        promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64},
+		DisableFallback:   true,
+		LogicalOptimizers: logicalplan.AllOptimizers,
+		DebugWriter:       &buf,
+	})
+	qry, err := ng.NewInstantQuery(test.Queryable(), nil, `sum(http_requests_total > 5)`, time.Unix(0, 0))
+	testutil.Ok(t, err)
+	defer qry.Close()
+
+	// The comparison is evaluated by the selector, whose shards are only created once the query is executed.
+	explanation := buf.String()
+	testutil.Assert(t, !strings.Contains(explanation, "[*scalarOperator]"), "expected no binary operator, got %s", explanation)
+
+	result := qry.Exec(test.Context())
+	testutil.Ok(t, result.Err)
+	vector, err := result.Vector()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(vector))
+	testutil.Equals(t, 8.0, vector[0].F)
+	testutil.Equals(t, 1, len(result.Warnings))
+	testutil.Equals(t, `PromQL info: incompatible sample types encountered for binary operator ">": histogram > float`, result.Warnings[0].Error())
+}
+
+func TestCommonSubexpressionElimination(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x100
+				http_requests_total{pod="nginx-2"} 1+2x100`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	var buf bytes.Buffer
+	ng := engine.New(engine.Opts{
+		EngineOpts:        promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64},
+		DisableFallback:   true,
+		LogicalOptimizers: logicalplan.AllOptimizers,
+		DebugWriter:       &buf,
+	})
+	qry, err := ng.NewRangeQuery(test.Queryable(), nil, `sum(rate(http_requests_total[1m])) / count(rate(http_requests_total[1m]))`, time.Unix(120, 0), time.Unix(600, 0), 30*time.Second)
+	testutil.Ok(t, err)
+	defer qry.Close()
+
+	explanation := buf.String()
+	testutil.Assert(t, strings.Contains(explanation, "[*fanOut] consumer 1 of 2"), "expected a fan-out operator, got %s", explanation)
+	testutil.Assert(t, strings.Contains(explanation, "[*fanOut] consumer 2 of 2"), "expected a fan-out operator, got %s", explanation)
+
+	result := qry.Exec(test.Context())
+	testutil.Ok(t, result.Err)
+	matrix, err := result.Matrix()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(matrix))
+	for _, p := range matrix[0].Floats {
+		// The average of the rates of both series.
+		testutil.Assert(t, math.Abs(p.F-0.05) < 1e-9, "unexpected value %v at %d", p.F, p.T)
+	}
+
+	// count_values reads all of its input before returning the first batch, so the other consumer
+	// of the shared expression falls behind the buffer of the fan-out and evaluates the expression again.
+	buf.Reset()
+	query := `count(count_values("value", sum(rate(http_requests_total[1m])))) + sum(rate(http_requests_total[1m]))`
+	start, end, step := time.Unix(0, 0), time.Unix(3000, 0), 10*time.Second
+	qry, err = ng.NewRangeQuery(test.Queryable(), nil, query, start, end, step)
+	testutil.Ok(t, err)
+	defer qry.Close()
+	testutil.Assert(t, strings.Contains(buf.String(), "[*fanOut] consumer 2 of 2"), "expected a fan-out operator, got %s", buf.String())
+	result = qry.Exec(test.Context())
+	testutil.Ok(t, result.Err)
+
+	promQry, err := promql.NewEngine(promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64}).NewRangeQuery(test.Queryable(), nil, query, start, end, step)
+	testutil.Ok(t, err)
+	defer promQry.Close()
+	expected := promQry.Exec(test.Context())
+	testutil.Ok(t, expected.Err)
+	testutil.WithGoCmp(comparer).Equals(t, expected, result)
+
+	// Sort functions are trimmed when their argument is shared.
+	query = `sort(sum by (pod) (http_requests_total)) + sum by (pod) (http_requests_total)`
+	qry, err = ng.NewInstantQuery(test.Queryable(), nil, query, time.Unix(600, 0))
+	testutil.Ok(t, err)
+	defer qry.Close()
+	result = qry.Exec(test.Context())
+	testutil.Ok(t, result.Err)
+
+	promQry, err = promql.NewEngine(promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64}).NewInstantQuery(test.Queryable(), nil, query, time.Unix(600, 0))
+	testutil.Ok(t, err)
+	defer promQry.Close()
+	expected = promQry.Exec(test.Context())
+	testutil.Ok(t, expected.Err)
+	testutil.WithGoCmp(comparer).Equals(t, expected, result)
+}
+
+func TestFutureTimestamps(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x100
+				http_requests_total{pod="nginx-2"} 1+2x100`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64}
+	now := func() time.Time { return time.Unix(600, 0) }
+	promEngine := promql.NewEngine(opts)
+	query := `rate(http_requests_total[1m])`
+
+	t.Run("instant query", func(t *testing.T) {
+		cases := []struct {
+			name     string
+			mode     engine.FutureTimestamps
+			skew     time.Duration
+			ts       time.Time
+			expected time.Time
+			clamped  bool
+		}{
+			{name: "allowed", mode: engine.AllowFutureTimestamps, ts: time.Unix(900, 0), expected: time.Unix(900, 0)},
+			{name: "clamped", mode: engine.ClampFutureTimestamps, ts: time.Unix(900, 0), expected: time.Unix(600, 0), clamped: true},
+			{name: "clamped with skew", mode: engine.ClampFutureTimestamps, skew: time.Minute, ts: time.Unix(900, 0), expected: time.Unix(660, 0), clamped: true},
+			{name: "within skew", mode: engine.ClampFutureTimestamps, skew: 5 * time.Minute, ts: time.Unix(900, 0), expected: time.Unix(900, 0)},
+			{name: "in the past", mode: engine.ClampFutureTimestamps, ts: time.Unix(300, 0), expected: time.Unix(300, 0)},
+		}
+		for _, tc := range cases {
+			t.Run(tc.name, func(t *testing.T) {
+				q, err := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true, FutureTimestamps: tc.mode, MaxFutureSkew: tc.skew, Now: now}).NewInstantQuery(test.Storage(), nil, query, tc.ts)
+				testutil.Ok(t, err)
+				defer q.Close()
+				result := q.Exec(context.Background())
+				testutil.Ok(t, result.Err)
+				testutil.Equals(t, tc.clamped, len(result.Warnings) > 0)
+
+				q, err = promEngine.NewInstantQuery(test.Storage(), nil, query, tc.expected)
+				testutil.Ok(t, err)
+				defer q.Close()
+				expected := q.Exec(context.Background())
+				testutil.Ok(t, expected.Err)
+				testutil.WithGoCmp(cmpopts.EquateNaNs()).Equals(t, expected.Value, result.Value)
+			})
+		}
+	})
+
+	t.Run("range query", func(t *testing.T) {
+		cases := []struct {
+			name          string
+			start, end    time.Time
+			expectedStart time.Time
+			expectedEnd   time.Time
+		}{
+			{
+				name:          "ending in the future",
+				start:         time.Unix(0, 0),
+				end:           time.Unix(1200, 0),
+				expectedStart: time.Unix(0, 0),
+				expectedEnd:   time.Unix(600, 0),
+			},
+			{
+				name:          "unaligned to the current time",
+				start:         time.Unix(10, 0),
+				end:           time.Unix(1200, 0),
+				expectedStart: time.Unix(10, 0),
+				expectedEnd:   time.Unix(580, 0),
+			},
+			{
+				name:          "starting in the future",
+				start:         time.Unix(900, 0),
+				end:           time.Unix(1200, 0),
+				expectedStart: time.Unix(600, 0),
+				expectedEnd:   time.Unix(600, 0),
+			},
+		}
+		for _, tc := range cases {
+			t.Run(tc.name, func(t *testing.T) {
+				q, err := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true, FutureTimestamps: engine.ClampFutureTimestamps, Now: now}).NewRangeQuery(test.Storage(), nil, query, tc.start, tc.end, 30*time.Second)
+				testutil.Ok(t, err)
+				defer q.Close()
+				result := q.Exec(context.Background())
+				testutil.Ok(t, result.Err)
+				testutil.Equals(t, 1, len(result.Warnings))
+
+				q, err = promEngine.NewRangeQuery(test.Storage(), nil, query, tc.expectedStart, tc.expectedEnd, 30*time.Second)
+				testutil.Ok(t, err)
+				defer q.Close()
+				expected := q.Exec(context.Background())
+				testutil.Ok(t, expected.Err)
+				testutil.WithGoCmp(cmpopts.EquateNaNs()).Equals(t, expected.Value, result.Value)
+			})
+		}
+	})
+}
+
+func TestKahanSummation(t *testing.T) {
+	load := `load 30s
+				metric 1 1e100 1 -1e100
+				series{id="1"} 1
+				series{id="2"} 1e100
+				series{id="3"} 1
+				series{id="4"} -1e100`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	cases := []struct {
+		query    string
+		expected float64
+	}{
+		{query: `sum_over_time(metric[2m])`, expected: 2},
+		{query: `avg_over_time(metric[2m])`, expected: 0.5},
+		{query: `avg(series)`, expected: 0.5},
+		{query: `avg by (__name__) (series)`, expected: 0.5},
+	}
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64}
+	for _, disableOptimizers := range []bool{false, true} {
+		var optimizers []logicalplan.Optimizer
+		if disableOptimizers {
+			optimizers = logicalplan.NoOptimizers
+		}
+		newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true, LogicalOptimizers: optimizers})
+		for _, tc := range cases {
+			t.Run(fmt.Sprintf("%s/disableOptimizers=%v", tc.query, disableOptimizers), func(t *testing.T) {
+				q, err := newEngine.NewInstantQuery(test.Storage(), nil, tc.query, time.Unix(90, 0))
+				testutil.Ok(t, err)
+				defer q.Close()
+
+				result := q.Exec(context.Background())
+				testutil.Ok(t, result.Err)
+				vector, err := result.Vector()
+				testutil.Ok(t, err)
+				testutil.Equals(t, 1, len(vector))
+				testutil.Equals(t, tc.expected, vector[0].F)
+			})
+		}
+	}
+}
+
+func TestAverageOverflow(t *testing.T) {
+	load := `load 30s
+				metric 1.5e308 1.5e308 -1e308
+				series{id="1"} 1.5e308
+				series{id="2"} 1.5e308
+				series{id="3"} -1e308`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	// The sum of the values overflows, so the mean is computed incrementally.
+	expected := 2e308 / 3
+	newEngine := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: 1 * time.Hour}, DisableFallback: true})
+	for _, query := range []string{
+		`avg_over_time(metric[2m])`,
+		`avg(series)`,
+		`avg by (__name__) (series)`,
+	} {
+		t.Run(query, func(t *testing.T) {
+			q, err := newEngine.NewInstantQuery(test.Storage(), nil, query, time.Unix(60, 0))
+			testutil.Ok(t, err)
+			defer q.Close()
+
+			result := q.Exec(context.Background())
+			testutil.Ok(t, result.Err)
+			vector, err := result.Vector()
+			testutil.Ok(t, err)
+			testutil.Equals(t, 1, len(vector))
+			testutil.WithGoCmp(cmpopts.EquateApprox(1e-12, 0)).Equals(t, expected, vector[0].F)
+		})
+	}
+}
+
+func TestVarianceAggregations(t *testing.T) {
+	load := `load 30s
+				series{id="1"} 1000000004
+				series{id="2"} 1000000007
+				series{id="3"} 1000000013
+				series{id="4"} 1000000016
+				textbook{id="1"} 2
+				textbook{id="2"} 4
+				textbook{id="3"} 4
+				textbook{id="4"} 4
+				textbook{id="5"} 5
+				textbook{id="6"} 5
+				textbook{id="7"} 7
+				textbook{id="8"} 9`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	cases := []struct {
+		query    string
+		expected float64
+	}{
+		{query: `stdvar(series)`, expected: 22.5},
+		{query: `stddev(series)`, expected: math.Sqrt(22.5)},
+		{query: `stdvar by (__name__) (series)`, expected: 22.5},
+		{query: `stdvar(textbook)`, expected: 4},
+		{query: `stddev(textbook)`, expected: 2},
+	}
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64}
+	newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true})
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			q, err := newEngine.NewInstantQuery(test.Storage(), nil, tc.query, time.Unix(0, 0))
+			testutil.Ok(t, err)
+			defer q.Close()
+
+			result := q.Exec(context.Background())
+			testutil.Ok(t, result.Err)
+			vector, err := result.Vector()
+			testutil.Ok(t, err)
+			testutil.Equals(t, 1, len(vector))
+			// The result depends on the order in which series are accumulated, so it is only compared within a tolerance.
+			testutil.Assert(t, math.Abs(tc.expected-vector[0].F) < 1e-9, "expected %v, got %v", tc.expected, vector[0].F)
+		})
+	}
+}
+
+func TestOperatorTracing(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x100
+				http_requests_total{pod="nginx-2"} 1+2x100`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64}
+	ng := engine.New(engine.Opts{
+		EngineOpts:                   opts,
+		DisableFallback:              true,
+		EnableOperatorTracing:        true,
+		OperatorTracingCostThreshold: 10000,
+	})
+
+	cases := []struct {
+		name   string
+		query  string
+		start  time.Time
+		traced bool
+	}{
+		{name: "cheap query", query: `http_requests_total`, start: time.Unix(3000, 0)},
+		{name: "expensive query", query: `sum(rate(http_requests_total[5m]))`, start: time.Unix(0, 0), traced: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			q, err := ng.NewRangeQuery(test.Storage(), nil, tc.query, tc.start, time.Unix(3000, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer q.Close()
+			cost := q.(interface{ EstimatedCost() float64 }).EstimatedCost()
+			testutil.Equals(t, tc.traced, cost >= 10000)
+
+			provider := &recordingTracerProvider{}
+			ctx := trace.ContextWithSpan(context.Background(), &recordingSpan{Span: trace.SpanFromContext(context.Background()), provider: provider})
+			result := q.Exec(ctx)
+			testutil.Ok(t, result.Err)
+
+			if !tc.traced {
+				testutil.Equals(t, 0, len(provider.spans))
+				return
+			}
+			testutil.Equals(t, "query.exec", provider.spans[0])
+			for _, span := range []string{"aggregate.series", "aggregate.next", "matrix_selector.next"} {
+				testutil.Assert(t, slices.Contains(provider.spans, span), "expected span %s, got %v", span, provider.spans)
+			}
+		})
+	}
+}
+
+type recordingTracerProvider struct {
+	mu    sync.Mutex
+	spans []string
+}
+
+func (p *recordingTracerProvider) Tracer(string, ...trace.TracerOption) trace.Tracer {
+	return &recordingTracer{provider: p}
+}
+
+type recordingTracer struct {
+	provider *recordingTracerProvider
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, _ ...trace.SpanStartOption) (context.Context, trace.Span) {
+	t.provider.mu.Lock()
+	t.provider.spans = append(t.provider.spans, name)
+	t.provider.mu.Unlock()
+
+	span := &recordingSpan{Span: trace.SpanFromContext(context.Background()), provider: t.provider}
+	return trace.ContextWithSpan(ctx, span), span
+}
+
+type recordingSpan struct {
+	trace.Span
+	provider *recordingTracerProvider
+}
+
+func (s *recordingSpan) TracerProvider() trace.TracerProvider {
+	return s.provider
+}
+
+func TestVectorSelectorShards(t *testing.T) {
+	var load strings.Builder
+	load.WriteString("load 30s\n")
+	for i := 0; i < 2500; i++ {
+		fmt.Fprintf(&load, "http_requests_total{pod=\"nginx-%d\"} 1+1x10\n", i)
+	}
+	test, err := promql.NewTest(t, load.String())
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	// Selectors create one shard for every 1000 series, and at most one shard per CPU.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	maxShards := runtime.GOMAXPROCS(0)
+	cases := []struct {
+		query     string
+		numSeries int
+		numShards int
+	}{
+		{query: `http_requests_total{pod="nginx-1"}`, numSeries: 1, numShards: 1},
+		{query: `http_requests_total{pod=~"nginx-1.*"}`, numSeries: 1111, numShards: 2},
+		{query: `http_requests_total`, numSeries: 2500, numShards: 3},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.query, func(t *testing.T) {
+			newEngine := engine.New(engine.Opts{
+				EngineOpts:          promql.EngineOpts{Timeout: 1 * time.Hour},
+				DisableFallback:     true,
+				EnableQueryReceipts: true,
+			})
+			// Series are selected once, even by storage which supports sharded selects.
+			queryable := &countingQueryable{Queryable: test.Storage(), sharded: true}
+			q, err := newEngine.NewInstantQuery(queryable, nil, tcase.query, time.Unix(60, 0))
+			testutil.Ok(t, err)
+			defer q.Close()
+
+			result := q.Exec(context.Background())
+			testutil.Ok(t, result.Err)
+			vector, err := result.Vector()
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.numSeries, len(vector))
+			testutil.Equals(t, 1, queryable.selects)
+
+			numShards := tcase.numShards
+			if numShards > maxShards {
+				numShards = maxShards
+			}
+			expected := fmt.Sprintf("PromQL info: query touched 1 selectors in %d shards, %d series, %d samples and 0 remote engine queries", numShards, tcase.numSeries, tcase.numSeries)
+			testutil.Equals(t, 1, len(result.Warnings))
+			testutil.Equals(t, expected, result.Warnings[0].Error())
+		})
+	}
+}
+
+func TestEstimatedSelectorShards(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x10
+				http_requests_total{pod="nginx-2"} 1+2x10`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	// Matrix selectors create one shard for every 1000 estimated series, and at most one shard per CPU.
+	// Vector selectors are rebalanced once their series are selected.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	cases := []struct {
+		name      string
+		query     string
+		estimate  int64
+		numShards int
+	}{
+		{name: "vector selector with few series", query: `http_requests_total`, estimate: 10, numShards: 1},
+		{name: "matrix selector with few series", query: `rate(http_requests_total[1m])`, estimate: 10, numShards: 1},
+		{name: "matrix selector with many series", query: `rate(http_requests_total[1m])`, estimate: 2500, numShards: 3},
+		{name: "matrix selector with too many series", query: `rate(http_requests_total[1m])`, estimate: 10000, numShards: 4},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			newEngine := engine.New(engine.Opts{
+				EngineOpts:          promql.EngineOpts{Timeout: 1 * time.Hour},
+				DisableFallback:     true,
+				EnableQueryReceipts: true,
+			})
+			queryable := &estimatingQueryable{Queryable: test.Storage(), series: tcase.estimate}
+			q, err := newEngine.NewInstantQuery(queryable, nil, tcase.query, time.Unix(60, 0))
+			testutil.Ok(t, err)
+			defer q.Close()
+
+			result := q.Exec(context.Background())
+			testutil.Ok(t, result.Err)
+			vector, err := result.Vector()
+			testutil.Ok(t, err)
+			testutil.Equals(t, 2, len(vector))
+
+			expected := fmt.Sprintf("1 selectors in %d shards", tcase.numShards)
+			testutil.Equals(t, 1, len(result.Warnings))
+			testutil.Assert(t, strings.Contains(result.Warnings[0].Error(), expected), "expected %q, got %q", expected, result.Warnings[0].Error())
+		})
+	}
+}
+
+// estimatingQueryable returns queriers which estimate that every selector returns the given number of series.
+type estimatingQueryable struct {
+	storage.Queryable
+	series int64
+}
+
+func (q *estimatingQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	querier, err := q.Queryable.Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	return &estimatingQuerier{Querier: querier, series: q.series}, nil
+}
+
+type estimatingQuerier struct {
+	storage.Querier
+	series int64
+}
+
+func (q *estimatingQuerier) EstimateSeries(*storage.SelectHints, ...*labels.Matcher) (engstore.SeriesEstimate, error) {
+	return engstore.SeriesEstimate{Series: q.series}, nil
+}
+
+func TestJoinBuildSide(t *testing.T) {
+	load := `load 30s
+				foo{pod="nginx-1"} 1+1x10
+				foo{pod="nginx-2"} 1+2x10
+				bar{pod="nginx-1"} 1+1x10`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	// The side of a join which is estimated to select fewer series is selected first.
+	// When it has no series, the other side is not selected.
+	cases := []struct {
+		name      string
+		query     string
+		estimates map[string]int64
+		selected  []string
+	}{
+		{name: "empty build side", query: `foo * on(pod) baz`, estimates: map[string]int64{"foo": 1000, "baz": 0}, selected: []string{"baz"}},
+		{name: "empty build side on the left", query: `baz * on(pod) foo`, estimates: map[string]int64{"foo": 1000, "baz": 0}, selected: []string{"baz"}},
+		{name: "build side with series", query: `foo * on(pod) bar`, estimates: map[string]int64{"foo": 1000, "bar": 1}, selected: []string{"bar", "foo"}},
+		{name: "wrong estimate", query: `foo * on(pod) baz`, estimates: map[string]int64{"foo": 0, "baz": 1000}, selected: []string{"baz", "foo"}},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			queryable := &metricEstimatingQueryable{Queryable: test.Storage(), estimates: tcase.estimates}
+			ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: 1 * time.Hour}, DisableFallback: true})
+			q, err := ng.NewInstantQuery(queryable, nil, tcase.query, time.Unix(60, 0))
+			testutil.Ok(t, err)
+			defer q.Close()
+			result := q.Exec(context.Background())
+			testutil.Ok(t, result.Err)
 
-	return nil
+			promQuery, err := promql.NewEngine(promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64}).NewInstantQuery(test.Storage(), nil, tcase.query, time.Unix(60, 0))
+			testutil.Ok(t, err)
+			defer promQuery.Close()
+			expected := promQuery.Exec(context.Background())
+			testutil.Ok(t, expected.Err)
+			testutil.WithGoCmp(comparer).Equals(t, expected, result)
+
+			sort.Strings(queryable.selected)
+			testutil.Equals(t, tcase.selected, queryable.selected)
+		})
+	}
 }
 
-func generateFloatHistogramSeries(app storage.Appender, numSeries int, withMixedTypes bool) error {
-	lbls := []string{labels.MetricName, "native_histogram_series", "foo", "bar"}
-	h1 := tsdbutil.GenerateTestFloatHistograms(numSeries)
-	h2 := tsdbutil.GenerateTestFloatHistograms(numSeries)
-	for i := range h1 {
-		ts := time.Unix(int64(i*15), 0).UnixMilli()
-		if withMixedTypes {
-			if _, err := app.Append(0, labels.FromStrings(append(lbls, "le", "1")...), ts, float64(i)); err != nil {
-				return err
-			}
-			if _, err := app.Append(0, labels.FromStrings(append(lbls, "le", "+Inf")...), ts, float64(i*2)); err != nil {
-				return err
-			}
-		}
-		if _, err := app.AppendHistogram(0, labels.FromStrings(append(lbls, "h", "1")...), ts, nil, h1[i]); err != nil {
-			return err
-		}
-		if _, err := app.AppendHistogram(0, labels.FromStrings(append(lbls, "h", "2")...), ts, nil, h2[i]); err != nil {
-			return err
-		}
+// metricEstimatingQueryable returns queriers which estimate the series of selectors by their metric name,
+// and records the metric names of selections.
+type metricEstimatingQueryable struct {
+	storage.Queryable
+	estimates map[string]int64
+
+	mu       sync.Mutex
+	selected []string
+}
+
+func (q *metricEstimatingQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	querier, err := q.Queryable.Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return &metricEstimatingQuerier{Querier: querier, queryable: q}, nil
 }
 
-func TestMixedNativeHistogramTypes(t *testing.T) {
-	histograms := tsdbutil.GenerateTestHistograms(2)
+type metricEstimatingQuerier struct {
+	storage.Querier
+	queryable *metricEstimatingQueryable
+}
 
-	test, err := promql.NewTest(t, "")
+func (q *metricEstimatingQuerier) Select(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	q.queryable.mu.Lock()
+	q.queryable.selected = append(q.queryable.selected, metricName(matchers))
+	q.queryable.mu.Unlock()
+	return q.Querier.Select(sortSeries, hints, matchers...)
+}
+
+func (q *metricEstimatingQuerier) EstimateSeries(_ *storage.SelectHints, matchers ...*labels.Matcher) (engstore.SeriesEstimate, error) {
+	return engstore.SeriesEstimate{Series: q.queryable.estimates[metricName(matchers)]}, nil
+}
+
+func metricName(matchers []*labels.Matcher) string {
+	for _, m := range matchers {
+		if m.Name == labels.MetricName {
+			return m.Value
+		}
+	}
+	return ""
+}
+
+func TestStreamingAggregation(t *testing.T) {
+	var load strings.Builder
+	load.WriteString("load 30s\n")
+	for i := 0; i < 2500; i++ {
+		fmt.Fprintf(&load, "http_requests_total{pod=\"nginx-%d\", zone=\"zone-%d\"} %d+%dx20\n", i, i%3, i%7, i%5)
+	}
+	test, err := promql.NewTest(t, load.String())
 	testutil.Ok(t, err)
 	defer test.Close()
+	testutil.Ok(t, test.Run())
 
-	lbls := []string{labels.MetricName, "native_histogram_series"}
+	// Use enough CPUs to split the selected series into several shards.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	queries := []struct {
+		query string
+		// combined is set for aggregations whose partial aggregates are combined with a different aggregation,
+		// which shows in the explanation of the query when it is streamed.
+		combined string
+	}{
+		{query: `sum(http_requests_total)`},
+		{query: `sum by (zone) (http_requests_total)`},
+		{query: `sum without (pod) (http_requests_total)`},
+		{query: `count by (zone) (http_requests_total)`, combined: `[*aggregate] sum by ([zone])`},
+		{query: `min by (zone) (http_requests_total)`},
+		{query: `max without (pod, zone) (http_requests_total)`},
+		{query: `group by (zone) (http_requests_total)`},
+		{query: `sum by (zone) (http_requests_total{pod=~"nginx-1.*"})`},
+		{query: `count(http_requests_total{zone="zone-1"} > 5)`},
+	}
+	var (
+		start = time.Unix(0, 0)
+		end   = time.Unix(600, 0)
+		step  = 30 * time.Second
+	)
+	for _, tc := range queries {
+		query := tc.query
+		t.Run(query, func(t *testing.T) {
+			var explanation bytes.Buffer
+			newEngine := engine.New(engine.Opts{
+				EngineOpts:                 promql.EngineOpts{Timeout: 1 * time.Hour},
+				DisableFallback:            true,
+				EnableStreamingAggregation: true,
+				DebugWriter:                &explanation,
+			})
+			q1, err := newEngine.NewRangeQuery(test.Storage(), nil, query, start, end, step)
+			testutil.Ok(t, err)
+			defer q1.Close()
+			if tc.combined != "" {
+				testutil.Assert(t, strings.Contains(explanation.String(), tc.combined), "expected streamed aggregation, got %s", explanation.String())
+				testutil.Assert(t, !strings.Contains(explanation.String(), "count"), "expected streamed aggregation, got %s", explanation.String())
+			}
+			newResult := q1.Exec(context.Background())
+			testutil.Ok(t, newResult.Err)
 
-	app := test.Storage().Appender(context.TODO())
-	_, err = app.AppendHistogram(0, labels.FromStrings(lbls...), 0, nil, histograms[0].ToFloat())
-	testutil.Ok(t, err)
-	testutil.Ok(t, app.Commit())
+			oldEngine := promql.NewEngine(promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64})
+			q2, err := oldEngine.NewRangeQuery(test.Storage(), nil, query, start, end, step)
+			testutil.Ok(t, err)
+			defer q2.Close()
+			oldResult := q2.Exec(context.Background())
+			testutil.Ok(t, oldResult.Err)
 
-	app = test.Storage().Appender(context.TODO())
-	_, err = app.AppendHistogram(0, labels.FromStrings(lbls...), 30_000, histograms[1], nil)
+			sortByLabels(newResult)
+			sortByLabels(oldResult)
+			testutil.Equals(t, oldResult, newResult)
+		})
+	}
+}
+
+func TestParallelAggregation(t *testing.T) {
+	var load strings.Builder
+	load.WriteString("load 30s\n")
+	for i := 0; i < 2500; i++ {
+		fmt.Fprintf(&load, "http_requests_total{pod=\"nginx-%d\", zone=\"zone-%d\"} %d+%dx40\n", i, i%3, i%7, i%5)
+	}
+	test, err := promql.NewTest(t, load.String())
 	testutil.Ok(t, err)
-	testutil.Ok(t, app.Commit())
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	// Use enough CPUs to split the selected series into several shards.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	queries := []string{
+		`sum(rate(http_requests_total[2m]))`,
+		`sum by (zone) (rate(http_requests_total[2m]))`,
+		`count without (pod) (increase(http_requests_total[2m]))`,
+		`max by (zone) (last_over_time(http_requests_total[1m]))`,
+		`min(avg_over_time(http_requests_total[2m]))`,
+		`group by (zone) (rate(http_requests_total{pod=~"nginx-1.*"}[2m]))`,
+		`sum by (zone) (http_requests_total)`,
+	}
+	var (
+		start = time.Unix(0, 0)
+		end   = time.Unix(1200, 0)
+		step  = 30 * time.Second
+	)
+	for _, query := range queries {
+		t.Run(query, func(t *testing.T) {
+			newEngine := engine.New(engine.Opts{
+				EngineOpts:                promql.EngineOpts{Timeout: 1 * time.Hour},
+				DisableFallback:           true,
+				EnableParallelAggregation: true,
+			})
+			q1, err := newEngine.NewRangeQuery(test.Storage(), nil, query, start, end, step)
+			testutil.Ok(t, err)
+			defer q1.Close()
+			newResult := q1.Exec(context.Background())
+			testutil.Ok(t, newResult.Err)
+
+			oldEngine := promql.NewEngine(promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64})
+			q2, err := oldEngine.NewRangeQuery(test.Storage(), nil, query, start, end, step)
+			testutil.Ok(t, err)
+			defer q2.Close()
+			oldResult := q2.Exec(context.Background())
+			testutil.Ok(t, oldResult.Err)
+
+			sortByLabels(newResult)
+			sortByLabels(oldResult)
+			// Partial sums of shards are added in a different order than in Prometheus.
+			testutil.WithGoCmp(cmpopts.EquateApprox(0, 1e-9)).Equals(t, oldResult, newResult)
+		})
+	}
+}
 
+func TestJoinMemoryLimit(t *testing.T) {
+	var load strings.Builder
+	load.WriteString("load 30s\n")
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&load, "http_requests_total{pod=\"nginx-%d\", zone=\"zone-%d\"} %d+%dx20\n", i, i%3, i%7, i%5)
+		fmt.Fprintf(&load, "http_responses_total{pod=\"nginx-%d\", zone=\"zone-%d\"} %d+%dx20\n", i, i%3, i%5, i%7)
+	}
+	load.WriteString("zone_info{zone=\"zone-0\", region=\"eu\"} 1x20\n")
+	load.WriteString("zone_info{zone=\"zone-1\", region=\"us\"} 1x20\n")
+	// zone_dup has two series in the same match group from the sixth step on.
+	load.WriteString("zone_dup{zone=\"zone-0\", region=\"eu\"} 1x20\n")
+	load.WriteString("zone_dup{zone=\"zone-0\", region=\"us\"} _ _ _ _ _ 1x15\n")
+	test, err := promql.NewTest(t, load.String())
+	testutil.Ok(t, err)
+	defer test.Close()
 	testutil.Ok(t, test.Run())
 
-	opts := promql.EngineOpts{
-		Timeout:              1 * time.Hour,
-		MaxSamples:           1e10,
-		EnableNegativeOffset: true,
-		EnableAtModifier:     true,
+	queries := []string{
+		`http_requests_total + http_responses_total`,
+		`http_requests_total > bool on(pod) http_responses_total`,
+		`http_requests_total * on(zone) group_left(region) zone_info`,
+		`zone_info * on(zone) group_right http_requests_total`,
 	}
+	var (
+		start = time.Unix(0, 0)
+		end   = time.Unix(600, 0)
+		step  = 30 * time.Second
+	)
+	for _, query := range queries {
+		// A limit of one byte spills indexes before any output series is added, while the larger
+		// limit is exceeded while the indexes are built.
+		for _, memoryLimit := range []int64{1, 12000} {
+			t.Run(fmt.Sprintf("%s/limit=%d", query, memoryLimit), func(t *testing.T) {
+				spillDir := t.TempDir()
+				newEngine := engine.New(engine.Opts{
+					EngineOpts:      promql.EngineOpts{Timeout: 1 * time.Hour},
+					DisableFallback: true,
+					JoinMemoryLimit: memoryLimit,
+					SpillDirectory:  spillDir,
+				})
+				q1, err := newEngine.NewRangeQuery(test.Storage(), nil, query, start, end, step)
+				testutil.Ok(t, err)
+				defer q1.Close()
+				newResult := q1.Exec(context.Background())
+				testutil.Ok(t, newResult.Err)
 
-	engine := engine.New(engine.Opts{
-		EngineOpts:        opts,
-		DisableFallback:   true,
-		LogicalOptimizers: logicalplan.AllOptimizers,
-	})
+				oldEngine := promql.NewEngine(promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64})
+				q2, err := oldEngine.NewRangeQuery(test.Storage(), nil, query, start, end, step)
+				testutil.Ok(t, err)
+				defer q2.Close()
+				oldResult := q2.Exec(context.Background())
+				testutil.Ok(t, oldResult.Err)
 
-	t.Run("vector_select", func(t *testing.T) {
-		qry, err := engine.NewInstantQuery(test.Queryable(), nil, "sum(native_histogram_series)", time.Unix(30, 0))
-		testutil.Ok(t, err)
-		res := qry.Exec(context.Background())
-		testutil.Ok(t, res.Err)
-		actual, err := res.Vector()
+				sortByLabels(newResult)
+				sortByLabels(oldResult)
+				testutil.Equals(t, oldResult, newResult)
+
+				// Spill files are removed as soon as they are created, and closed once the operator is exhausted.
+				entries, err := os.ReadDir(spillDir)
+				testutil.Ok(t, err)
+				testutil.Equals(t, 0, len(entries))
+				testutil.Equals(t, 0, openFilesIn(t, spillDir))
+			})
+		}
+	}
+
+	t.Run("failed query", func(t *testing.T) {
+		spillDir := t.TempDir()
+		newEngine := engine.New(engine.Opts{
+			EngineOpts:      promql.EngineOpts{Timeout: 1 * time.Hour},
+			DisableFallback: true,
+			JoinMemoryLimit: 1,
+			SpillDirectory:  spillDir,
+		})
+		q, err := newEngine.NewRangeQuery(test.Storage(), nil, `http_requests_total * on(zone) group_left(region) zone_dup`, start, end, step)
 		testutil.Ok(t, err)
+		defer q.Close()
+		testutil.NotOk(t, q.Exec(context.Background()).Err)
 
-		testutil.Equals(t, 1, len(actual), "expected vector with 1 element")
-		expected := histograms[1].ToFloat()
-		expected.CounterResetHint = histogram.UnknownCounterReset
-		testutil.Equals(t, expected, actual[0].H)
+		// Spill files are closed when the operator fails before it is exhausted.
+		testutil.Equals(t, 0, openFilesIn(t, spillDir))
 	})
 
-	t.Run("matrix_select", func(t *testing.T) {
-		qry, err := engine.NewRangeQuery(test.Queryable(), nil, "rate(native_histogram_series[1m])", time.Unix(0, 0), time.Unix(60, 0), 60*time.Second)
-		testutil.Ok(t, err)
-		res := qry.Exec(context.Background())
-		testutil.Ok(t, res.Err)
-		actual, err := res.Matrix()
+	t.Run("missing spill directory", func(t *testing.T) {
+		newEngine := engine.New(engine.Opts{
+			EngineOpts:      promql.EngineOpts{Timeout: 1 * time.Hour},
+			DisableFallback: true,
+			JoinMemoryLimit: 1,
+			SpillDirectory:  filepath.Join(t.TempDir(), "missing"),
+		})
+		q, err := newEngine.NewRangeQuery(test.Storage(), nil, queries[0], start, end, step)
 		testutil.Ok(t, err)
-
-		testutil.Equals(t, 1, len(actual), "expected 1 series")
-		testutil.Equals(t, 1, len(actual[0].Histograms), "expected 1 point")
-		expected := histograms[1].ToFloat().Sub(histograms[0].ToFloat()).Scale(1 / float64(30))
-		expected.CounterResetHint = histogram.GaugeType
-		testutil.Equals(t, expected, actual[0].Histograms[0].H)
+		defer q.Close()
+		testutil.NotOk(t, q.Exec(context.Background()).Err)
 	})
 }
 
-func sortByLabels(r *promql.Result) {
-	switch r.Value.Type() {
-	case promparser.ValueTypeVector:
-		m, _ := r.Vector()
-		sort.Sort(samplesByLabels(m))
-		r.Value = m
-	case promparser.ValueTypeMatrix:
-		m, _ := r.Matrix()
-		sort.Sort(seriesByLabels(m))
-		r.Value = m
+// openFilesIn returns the number of files in dir which are open by the current process.
+func openFilesIn(t *testing.T, dir string) int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("open files cannot be listed:", err)
+	}
+	var open int
+	for _, fd := range fds {
+		path, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name()))
+		if err == nil && strings.HasPrefix(path, dir) {
+			open++
+		}
 	}
+	return open
 }
 
-type seriesByLabels []promql.Series
+func TestDelayedNameRemoval(t *testing.T) {
+	load := `load 30s
+				foo{pod="nginx-1"} 1+1x10
+				bar{pod="nginx-1"} 1+2x10
+				bar{pod="nginx-2"} 1+3x10`
 
-func (b seriesByLabels) Len() int           { return len(b) }
-func (b seriesByLabels) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
-func (b seriesByLabels) Less(i, j int) bool { return labels.Compare(b[i].Metric, b[j].Metric) < 0 }
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
 
-type samplesByLabels []promql.Sample
+	cases := []struct {
+		name     string
+		query    string
+		expected []labels.Labels
+	}{
+		{
+			name:  "aggregation by metric name",
+			query: `sum by (__name__) (rate({__name__=~"foo|bar"}[1m]))`,
+			expected: []labels.Labels{
+				labels.FromStrings("__name__", "bar"),
+				labels.FromStrings("__name__", "foo"),
+			},
+		},
+		{
+			name:     "aggregation without labels",
+			query:    `sum without (pod) (rate({__name__=~"foo|bar"}[1m]))`,
+			expected: []labels.Labels{labels.EmptyLabels()},
+		},
+		{
+			name:  "function output",
+			query: `abs(rate(bar[1m]))`,
+			expected: []labels.Labels{
+				labels.FromStrings("pod", "nginx-1"),
+				labels.FromStrings("pod", "nginx-2"),
+			},
+		},
+		{
+			name:  "function keeping the metric name",
+			query: `last_over_time(bar[1m])`,
+			expected: []labels.Labels{
+				labels.FromStrings("__name__", "bar", "pod", "nginx-1"),
+				labels.FromStrings("__name__", "bar", "pod", "nginx-2"),
+			},
+		},
+		{
+			name:  "function over function keeping the metric name",
+			query: `clamp_min(last_over_time(bar[1m]), 0)`,
+			expected: []labels.Labels{
+				labels.FromStrings("pod", "nginx-1"),
+				labels.FromStrings("pod", "nginx-2"),
+			},
+		},
+		{
+			name:     "label_join of the metric name",
+			query:    `label_join(rate(foo[1m]), "metric", "", "__name__")`,
+			expected: []labels.Labels{labels.FromStrings("metric", "foo", "pod", "nginx-1")},
+		},
+		{
+			name:  "comparison",
+			query: `rate(bar[1m]) > 0`,
+			expected: []labels.Labels{
+				labels.FromStrings("pod", "nginx-1"),
+				labels.FromStrings("pod", "nginx-2"),
+			},
+		},
+		{
+			name:     "binary operation",
+			query:    `rate(foo[1m]) / rate(bar[1m])`,
+			expected: []labels.Labels{labels.FromStrings("pod", "nginx-1")},
+		},
+	}
 
-func (b samplesByLabels) Len() int           { return len(b) }
-func (b samplesByLabels) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
-func (b samplesByLabels) Less(i, j int) bool { return labels.Compare(b[i].Metric, b[j].Metric) < 0 }
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true, EnableDelayedNameRemoval: true})
+			q, err := ng.NewInstantQuery(test.Storage(), nil, tc.query, time.Unix(120, 0))
+			testutil.Ok(t, err)
+			defer q.Close()
 
-// roundValues rounds all values to 10 decimal points and
-// can be used to eliminate floating point division errors
-// when comparing two promql results.
-func roundValues(r *promql.Result) {
-	switch result := r.Value.(type) {
-	case promql.Matrix:
-		for i := range result {
-			for j := range result[i].Floats {
-				result[i].Floats[j].F = math.Floor(result[i].Floats[j].F*1e10) / 1e10
+			result := q.Exec(context.Background())
+			testutil.Ok(t, result.Err)
+			vector, err := result.Vector()
+			testutil.Ok(t, err)
+
+			actual := make([]labels.Labels, 0, len(vector))
+			for _, s := range vector {
+				actual = append(actual, s.Metric)
 			}
-		}
-	case promql.Vector:
-		for i := range result {
-			result[i].F = math.Floor(result[i].F*10e10) / 10e10
-		}
+			sort.Slice(actual, func(i, j int) bool { return labels.Compare(actual[i], actual[j]) < 0 })
+			testutil.Equals(t, tc.expected, actual)
+		})
 	}
 }
 
-// emptyLabelsToNil sets empty labelsets to nil to work around inconsistent
-// results from the old engine depending on the literal type (e.g. number vs. compare).
-func emptyLabelsToNil(result *promql.Result) {
-	if value, ok := result.Value.(promql.Matrix); ok {
-		for i, s := range value {
-			if len(s.Metric) == 0 {
-				result.Value.(promql.Matrix)[i].Metric = nil
-			}
-		}
+func TestReplay(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x100
+				http_requests_total{pod="nginx-2"} 1+2x100`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	log := `{"params":{"end":"1970-01-01T00:10:00.000Z","query":"sum(rate(http_requests_total[1m]))","start":"1970-01-01T00:10:00.000Z","step":0},"ts":"2023-04-14T05:35:01.000Z"}
+
+{"params":{"end":"1970-01-01T00:30:00.000Z","query":"rate(http_requests_total[1m])","start":"1970-01-01T00:00:00.000Z","step":30},"ts":"2023-04-14T05:35:02.000Z"}
+{"params":{"end":"1970-01-01T00:10:00.000Z","query":"sum(rate(","start":"1970-01-01T00:10:00.000Z","step":0},"ts":"2023-04-14T05:35:03.000Z"}`
+	queries, err := engine.ParseQueryLog(strings.NewReader(log))
+	testutil.Ok(t, err)
+	testutil.Equals(t, []engine.LoggedQuery{
+		{Query: "sum(rate(http_requests_total[1m]))", Start: time.Unix(600, 0).UTC(), End: time.Unix(600, 0).UTC()},
+		{Query: "rate(http_requests_total[1m])", Start: time.Unix(0, 0).UTC(), End: time.Unix(1800, 0).UTC(), Step: 30 * time.Second},
+		{Query: "sum(rate(", Start: time.Unix(600, 0).UTC(), End: time.Unix(600, 0).UTC()},
+	}, queries)
+
+	_, err = engine.ParseQueryLog(strings.NewReader(`{"params":{}}`))
+	testutil.NotOk(t, err)
+
+	ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64}, DisableFallback: true})
+	report := engine.Replay(context.Background(), ng, test.Storage(), queries, engine.ReplayOpts{Concurrency: 2})
+	testutil.Equals(t, len(queries), len(report.Results))
+	testutil.Equals(t, 1, report.Errors())
+	testutil.NotOk(t, report.Results[2].Err)
+	for i, res := range report.Results[:2] {
+		testutil.Ok(t, res.Err)
+		testutil.Equals(t, queries[i], res.Query)
+		testutil.Assert(t, res.Latency > 0)
+	}
+	testutil.Assert(t, report.LatencyPercentile(0.5) <= report.LatencyPercentile(0.99))
+	testutil.Assert(t, report.AllocatedBytesPercentile(0.5) <= report.AllocatedBytesPercentile(0.99))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report = engine.Replay(ctx, ng, test.Storage(), queries, engine.ReplayOpts{})
+	for _, res := range report.Results {
+		testutil.NotOk(t, res.Err)
+	}
+}
+
+func TestRejectUnboundedSelectors(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x10
+				job:http_requests:rate1m{pod="nginx-1"} 1+1x10`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	newEngine := engine.New(engine.Opts{
+		EngineOpts:               promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: math.MaxInt64},
+		RejectUnboundedSelectors: true,
+		SelectiveMatchers:        []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, "job:.+")},
+	})
+
+	query := `count({__name__=~".+"})`
+	_, err = newEngine.NewInstantQuery(test.Storage(), nil, query, time.Unix(60, 0))
+	testutil.Assert(t, errors.Is(err, logicalplan.ErrUnboundedSelector), "expected unbounded selector error, got %v", err)
+	_, err = newEngine.NewRangeQuery(test.Storage(), nil, query, time.Unix(0, 0), time.Unix(60, 0), 30*time.Second)
+	testutil.Assert(t, errors.Is(err, logicalplan.ErrUnboundedSelector), "expected unbounded selector error, got %v", err)
+
+	for _, query := range []string{`count(http_requests_total)`, `count({__name__=~"job:.+"})`} {
+		q, err := newEngine.NewInstantQuery(test.Storage(), nil, query, time.Unix(60, 0))
+		testutil.Ok(t, err)
+		result := q.Exec(context.Background())
+		testutil.Ok(t, result.Err)
+		vector, err := result.Vector()
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(vector))
+		testutil.Equals(t, 1.0, vector[0].F)
+		q.Close()
 	}
 }
@@ -0,0 +1,89 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+	v1 "github.com/prometheus/prometheus/web/api/v1"
+
+	"github.com/thanos-community/promql-engine/api"
+)
+
+// Federation combines multiple engines into a single query engine with a global view
+// of their data. Queries are split by the distributed execution optimizer so that each
+// member engine evaluates the parts of a query for its own time range and external labels,
+// and partial results are merged in process.
+//
+// Members can be remote engines or local queryables added with AddQueryable. The queryable
+// passed to NewInstantQuery and NewRangeQuery is only used for evaluating queries which
+// are not supported by the engine and fall back to the Prometheus engine.
+type Federation struct {
+	opts Opts
+
+	mu      sync.RWMutex
+	engines []api.RemoteEngine
+
+	engine v1.QueryEngine
+}
+
+// NewFederation creates a Federation from the given member engines.
+func NewFederation(opts Opts, engines ...api.RemoteEngine) *Federation {
+	f := &Federation{
+		opts:    opts,
+		engines: engines,
+	}
+	f.engine = NewDistributedEngine(opts, f)
+	return f
+}
+
+// Engines returns the current members of the federation.
+func (f *Federation) Engines() []api.RemoteEngine {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	engines := make([]api.RemoteEngine, len(f.engines))
+	copy(engines, f.engines)
+	return engines
+}
+
+// AddEngine adds an engine to the federation. Only queries created after
+// the engine is added will be evaluated against it.
+func (f *Federation) AddEngine(engine api.RemoteEngine) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.engines = append(f.engines, engine)
+}
+
+// AddQueryable adds a local queryable to the federation. The queryable is evaluated with
+// an engine which uses the options of the federation. The mint and maxt define the time
+// range of the data in the queryable, and labelSets are its external labels.
+func (f *Federation) AddQueryable(q storage.Queryable, mint, maxt int64, labelSets []labels.Labels) {
+	f.AddEngine(NewRemoteEngine(f.opts, q, mint, maxt, labelSets))
+}
+
+// SetEngines replaces all members of the federation.
+func (f *Federation) SetEngines(engines ...api.RemoteEngine) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.engines = engines
+}
+
+func (f *Federation) SetQueryLogger(log promql.QueryLogger) {
+	f.engine.SetQueryLogger(log)
+}
+
+func (f *Federation) NewInstantQuery(q storage.Queryable, opts *promql.QueryOpts, qs string, ts time.Time) (promql.Query, error) {
+	return f.engine.NewInstantQuery(q, opts, qs, ts)
+}
+
+func (f *Federation) NewRangeQuery(q storage.Queryable, opts *promql.QueryOpts, qs string, start, end time.Time, interval time.Duration) (promql.Query, error) {
+	return f.engine.NewRangeQuery(q, opts, qs, start, end, interval)
+}
@@ -0,0 +1,77 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine
+
+import (
+	"sort"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+)
+
+// FutureTimestamps determines how the engine handles evaluation timestamps
+// which are after the current time.
+type FutureTimestamps int
+
+const (
+	// AllowFutureTimestamps evaluates queries at the requested timestamps, even when they are in the future.
+	AllowFutureTimestamps FutureTimestamps = iota
+	// ClampFutureTimestamps moves evaluation timestamps which are in the future back to the current time,
+	// and annotates the result of the query with a warning.
+	ClampFutureTimestamps
+)
+
+// futureTimestampLimit returns the latest timestamp at which queries are evaluated.
+func (e *compatibilityEngine) futureTimestampLimit() time.Time {
+	return e.now().Add(e.maxFutureSkew)
+}
+
+// clampInstantTimestamp clamps the evaluation timestamp of an instant query. The returned
+// warning is nil if the timestamp does not need to be clamped.
+func (e *compatibilityEngine) clampInstantTimestamp(ts time.Time) (time.Time, error) {
+	if e.futureTimestamps != ClampFutureTimestamps {
+		return ts, nil
+	}
+	limit := e.futureTimestampLimit()
+	if !ts.After(limit) {
+		return ts, nil
+	}
+	return limit, clampedWarning(ts, limit)
+}
+
+// clampRangeTimestamps clamps the evaluation timestamps of a range query. Steps after the limit
+// are dropped, so that the remaining steps keep their alignment. If the query starts after the
+// limit, it is evaluated at the limit only. The returned warning is nil if no step was dropped.
+func (e *compatibilityEngine) clampRangeTimestamps(start, end time.Time, step time.Duration, timestamps []int64) (time.Time, time.Time, []int64, error) {
+	if e.futureTimestamps != ClampFutureTimestamps {
+		return start, end, timestamps, nil
+	}
+	limit := e.futureTimestampLimit()
+	if !end.After(limit) {
+		return start, end, timestamps, nil
+	}
+
+	warn := clampedWarning(end, limit)
+	if start.After(limit) {
+		if timestamps != nil {
+			timestamps = []int64{limit.UnixMilli()}
+		}
+		return limit, limit, timestamps, warn
+	}
+
+	if timestamps != nil {
+		n := sort.Search(len(timestamps), func(i int) bool { return timestamps[i] > limit.UnixMilli() })
+		timestamps = timestamps[:n]
+		return start, time.UnixMilli(timestamps[n-1]), timestamps, warn
+	}
+	if step == 0 {
+		return start, start, timestamps, warn
+	}
+	end = start.Add(limit.Sub(start) / step * step)
+	return start, end, timestamps, warn
+}
+
+func clampedWarning(ts, limit time.Time) error {
+	return errors.Newf("PromQL warning: evaluation time %s is in the future, evaluated until %s", ts.UTC().Format(time.RFC3339Nano), limit.UTC().Format(time.RFC3339Nano))
+}
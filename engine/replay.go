@@ -0,0 +1,230 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"runtime/metrics"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+	v1 "github.com/prometheus/prometheus/web/api/v1"
+)
+
+// LoggedQuery is a query recorded in a query log.
+type LoggedQuery struct {
+	Query string
+	Start time.Time
+	End   time.Time
+	// Step is zero for instant queries, which are evaluated at Start.
+	Step time.Duration
+}
+
+// queryLogEntry is an entry written by the Prometheus query logger.
+type queryLogEntry struct {
+	Params struct {
+		Query string    `json:"query"`
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+		// Step is the step of range queries in seconds.
+		Step int64 `json:"step"`
+	} `json:"params"`
+}
+
+// ParseQueryLog reads a query log in the format written by the Prometheus query logger,
+// which contains one JSON object per line. Empty lines are skipped.
+func ParseQueryLog(r io.Reader) ([]LoggedQuery, error) {
+	var queries []LoggedQuery
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry queryLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, errors.Wrapf(err, "parsing query log line %d", line)
+		}
+		if entry.Params.Query == "" {
+			return nil, errors.Newf("query log line %d has no query", line)
+		}
+		queries = append(queries, LoggedQuery{
+			Query: entry.Params.Query,
+			Start: entry.Params.Start,
+			End:   entry.Params.End,
+			Step:  time.Duration(entry.Params.Step) * time.Second,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading query log")
+	}
+	return queries, nil
+}
+
+// ReplayOpts configures how a query log is replayed.
+type ReplayOpts struct {
+	// Concurrency is the number of queries which are executed at the same time.
+	// Defaults to 1.
+	Concurrency int
+}
+
+// ReplayResult is the outcome of executing a single logged query.
+type ReplayResult struct {
+	Query   LoggedQuery
+	Latency time.Duration
+	// AllocatedBytes is the number of heap bytes allocated while the query was executed.
+	// When queries are replayed concurrently, it includes allocations of other queries
+	// which were executed at the same time.
+	AllocatedBytes uint64
+	Err            error
+}
+
+// ReplayReport summarizes the replay of a query log.
+type ReplayReport struct {
+	// Results are in the order of the replayed queries.
+	Results []ReplayResult
+	// Duration is the wall time spent on replaying all queries.
+	Duration time.Duration
+}
+
+// Errors returns the number of queries which failed.
+func (r ReplayReport) Errors() int {
+	var n int
+	for _, res := range r.Results {
+		if res.Err != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// LatencyPercentile returns the latency below which the fraction p of queries completed.
+func (r ReplayReport) LatencyPercentile(p float64) time.Duration {
+	latencies := make([]time.Duration, len(r.Results))
+	for i, res := range r.Results {
+		latencies[i] = res.Latency
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return percentile(latencies, p)
+}
+
+// AllocatedBytesPercentile returns the number of allocated bytes below which the fraction p of queries completed.
+func (r ReplayReport) AllocatedBytesPercentile(p float64) uint64 {
+	allocs := make([]uint64, len(r.Results))
+	for i, res := range r.Results {
+		allocs[i] = res.AllocatedBytes
+	}
+	sort.Slice(allocs, func(i, j int) bool { return allocs[i] < allocs[j] })
+	return percentile(allocs, p)
+}
+
+func (r ReplayReport) String() string {
+	return fmt.Sprintf(
+		"replayed %d queries in %s with %d errors, latency p50 %s p90 %s p99 %s, allocated bytes p50 %d p90 %d p99 %d",
+		len(r.Results), r.Duration, r.Errors(),
+		r.LatencyPercentile(0.5), r.LatencyPercentile(0.9), r.LatencyPercentile(0.99),
+		r.AllocatedBytesPercentile(0.5), r.AllocatedBytesPercentile(0.9), r.AllocatedBytesPercentile(0.99),
+	)
+}
+
+// percentile returns the nearest-rank percentile p of sorted values.
+func percentile[T any](sorted []T, p float64) T {
+	var zero T
+	if len(sorted) == 0 {
+		return zero
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// Replay executes the given queries against the engine and reports the latency and allocations
+// of each of them. Queries which are not started when ctx is canceled fail with the error of ctx.
+func Replay(ctx context.Context, ng v1.QueryEngine, q storage.Queryable, queries []LoggedQuery, opts ReplayOpts) ReplayReport {
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	report := ReplayReport{Results: make([]ReplayResult, len(queries))}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				report.Results[i] = replayQuery(ctx, ng, q, queries[i])
+			}
+		}()
+	}
+
+	start := time.Now()
+dispatch:
+	for i := range queries {
+		select {
+		case <-ctx.Done():
+			for j := i; j < len(queries); j++ {
+				report.Results[j] = ReplayResult{Query: queries[j], Err: ctx.Err()}
+			}
+			break dispatch
+		case indexes <- i:
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	report.Duration = time.Since(start)
+
+	return report
+}
+
+func replayQuery(ctx context.Context, ng v1.QueryEngine, q storage.Queryable, lq LoggedQuery) ReplayResult {
+	result := ReplayResult{Query: lq}
+
+	allocsBefore := heapAllocatedBytes()
+	start := time.Now()
+	var (
+		qry promql.Query
+		err error
+	)
+	if lq.Step == 0 {
+		qry, err = ng.NewInstantQuery(q, nil, lq.Query, lq.Start)
+	} else {
+		qry, err = ng.NewRangeQuery(q, nil, lq.Query, lq.Start, lq.End, lq.Step)
+	}
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer qry.Close()
+
+	result.Err = qry.Exec(ctx).Err
+	result.Latency = time.Since(start)
+	result.AllocatedBytes = heapAllocatedBytes() - allocsBefore
+	return result
+}
+
+// heapAllocatedBytes returns the cumulative number of bytes allocated on the heap by the process.
+func heapAllocatedBytes() uint64 {
+	sample := []metrics.Sample{{Name: "/gc/heap/allocs:bytes"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
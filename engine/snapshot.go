@@ -0,0 +1,85 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/thanos-community/promql-engine/execution"
+)
+
+// QuerySnapshot is a snapshot of a query which is being executed by the engine.
+type QuerySnapshot struct {
+	// Query is the expression of the query.
+	Query string
+	// Started is the time at which the query started executing.
+	Started time.Time
+	// Operators is the state of the operator tree of the query.
+	Operators execution.OperatorState
+}
+
+// WaitingOn returns the operators which the query is waiting on.
+func (s QuerySnapshot) WaitingOn() []string {
+	return s.Operators.WaitingOn()
+}
+
+type inflightQuery struct {
+	query   *compatibilityQuery
+	started time.Time
+}
+
+// inflightQueries keeps track of queries which are being executed.
+type inflightQueries struct {
+	mu      sync.Mutex
+	queries map[*compatibilityQuery]time.Time
+}
+
+func newInflightQueries() *inflightQueries {
+	return &inflightQueries{queries: make(map[*compatibilityQuery]time.Time)}
+}
+
+func (q *inflightQueries) add(query *compatibilityQuery) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.queries[query] = time.Now()
+}
+
+func (q *inflightQueries) remove(query *compatibilityQuery) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.queries, query)
+}
+
+func (q *inflightQueries) list() []inflightQuery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	queries := make([]inflightQuery, 0, len(q.queries))
+	for query, started := range q.queries {
+		queries = append(queries, inflightQuery{query: query, started: started})
+	}
+	return queries
+}
+
+// Snapshot returns the state of the operators of all queries which are being executed, ordered by
+// the time at which they started. It can be used for diagnosing queries which are stuck without
+// taking a goroutine dump. Snapshots are only taken when the engine is created with EnableQuerySnapshots.
+func (e *compatibilityEngine) Snapshot() []QuerySnapshot {
+	if e.inflight == nil {
+		return nil
+	}
+
+	queries := e.inflight.list()
+	snapshots := make([]QuerySnapshot, 0, len(queries))
+	for _, q := range queries {
+		snapshots = append(snapshots, QuerySnapshot{
+			Query:     q.query.expr.String(),
+			Started:   q.started,
+			Operators: execution.Snapshot(q.query.Query.exec),
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Started.Before(snapshots[j].Started) })
+	return snapshots
+}
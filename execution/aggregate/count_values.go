@@ -0,0 +1,185 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package aggregate
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/efficientgo/core/errors"
+	prommodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"golang.org/x/exp/slices"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+)
+
+// countValuesOperator is a model.VectorOperator which counts the series with the same value in each group.
+// Its output series are discovered from the values of its input, and Series has to return all of them
+// before the first step is returned, so the input is consumed when the operator is initialized. Input
+// batches are released as soon as they are counted, and only the counts of the output series of each step
+// are buffered in flat slices, which are returned by Next in batches of steps.
+type countValuesOperator struct {
+	pool       *model.VectorPool
+	next       model.VectorOperator
+	param      string
+	by         bool
+	grouping   []string
+	stepsBatch int
+
+	once   sync.Once
+	series []labels.Labels
+
+	// The counts of step i are counts[stepEnds[i-1]:stepEnds[i]], for the output series at the same indexes of outputIDs.
+	stepTimes []int64
+	stepEnds  []int
+	outputIDs []uint64
+	counts    []float64
+	// returned is the number of steps which were returned by Next.
+	returned int
+}
+
+// NewCountValues creates an operator for count_values, which adds a label with the
+// given name and the sample value to each output series.
+func NewCountValues(pool *model.VectorPool, next model.VectorOperator, param string, by bool, grouping []string, stepsBatch int) (model.VectorOperator, error) {
+	if !prommodel.LabelName(param).IsValid() {
+		return nil, errors.Newf("invalid label name %q", param)
+	}
+	// Grouping labels need to be sorted in order for metric hashing to work.
+	// They are sorted in a copy since plans can be shared by concurrent queries.
+	grouping = slices.Clone(grouping)
+	if by {
+		grouping = append(grouping, param)
+	}
+	slices.Sort(grouping)
+	return &countValuesOperator{
+		pool:       pool,
+		next:       next,
+		param:      param,
+		by:         by,
+		grouping:   grouping,
+		stepsBatch: stepsBatch,
+	}, nil
+}
+
+func (c *countValuesOperator) Explain() (me string, next []model.VectorOperator) {
+	if c.by {
+		return fmt.Sprintf("[*countValues] %q by (%v)", c.param, c.grouping), []model.VectorOperator{c.next}
+	}
+	return fmt.Sprintf("[*countValues] %q without (%v)", c.param, c.grouping), []model.VectorOperator{c.next}
+}
+
+func (c *countValuesOperator) GetPool() *model.VectorPool {
+	return c.pool
+}
+
+func (c *countValuesOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	var err error
+	c.once.Do(func() { err = c.init(ctx) })
+	if err != nil {
+		return nil, err
+	}
+	return c.series, nil
+}
+
+func (c *countValuesOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	var err error
+	c.once.Do(func() { err = c.init(ctx) })
+	if err != nil {
+		return nil, err
+	}
+	if c.returned == len(c.stepTimes) {
+		return nil, nil
+	}
+
+	result := c.pool.GetVectorBatch()
+	for ; c.returned < len(c.stepTimes) && len(result) < c.stepsBatch; c.returned++ {
+		start := 0
+		if c.returned > 0 {
+			start = c.stepEnds[c.returned-1]
+		}
+		end := c.stepEnds[c.returned]
+
+		out := c.pool.GetStepVector(c.stepTimes[c.returned])
+		for i := start; i < end; i++ {
+			out.AppendSample(c.pool, c.outputIDs[i], c.counts[i])
+		}
+		result = append(result, out)
+	}
+	if c.returned == len(c.stepTimes) {
+		c.stepTimes, c.stepEnds, c.outputIDs, c.counts = nil, nil, nil, nil
+		c.returned = 0
+	}
+	return result, nil
+}
+
+func (c *countValuesOperator) init(ctx context.Context) error {
+	inputSeries, err := c.next.Series(ctx)
+	if err != nil {
+		return err
+	}
+
+	var (
+		buf      = make([]byte, 1024)
+		lb       = labels.NewBuilder(nil)
+		grouping = model.Grouping{Without: !c.by, Labels: c.grouping}
+		groups   = model.NewGroups(grouping)
+		// stepIndex maps output series to their index in the current step.
+		stepIndex = make(map[uint64]int)
+	)
+	count := func(sampleID uint64, value string) {
+		lb.Reset(inputSeries[sampleID])
+		lb.Set(c.param, value)
+		metric := lb.Labels()
+
+		id, ok := groups.Get(grouping.Hash(metric, buf), metric)
+		if !ok {
+			c.series = append(c.series, outputMetric(metric, !c.by, c.grouping))
+		}
+		outputID := uint64(id)
+		if i, ok := stepIndex[outputID]; ok {
+			c.counts[i]++
+			return
+		}
+		stepIndex[outputID] = len(c.outputIDs)
+		c.outputIDs = append(c.outputIDs, outputID)
+		c.counts = append(c.counts, 1)
+	}
+
+	for {
+		in, err := c.next.Next(ctx)
+		if err != nil {
+			return err
+		}
+		if in == nil {
+			break
+		}
+		for _, vector := range in {
+			for i, sampleID := range vector.SampleIDs {
+				count(sampleID, strconv.FormatFloat(vector.Samples[i], 'f', -1, 64))
+			}
+			for i, sampleID := range vector.HistogramIDs {
+				count(sampleID, vector.Histograms[i].String())
+			}
+			for k := range stepIndex {
+				delete(stepIndex, k)
+			}
+			c.stepTimes = append(c.stepTimes, vector.T)
+			c.stepEnds = append(c.stepEnds, len(c.outputIDs))
+			c.next.GetPool().PutStepVector(vector)
+		}
+		c.next.GetPool().PutVectors(in)
+	}
+
+	c.pool.SetStepSize(len(c.series))
+	return nil
+}
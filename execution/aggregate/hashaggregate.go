@@ -17,6 +17,7 @@ import (
 
 	"github.com/thanos-community/promql-engine/execution/model"
 	"github.com/thanos-community/promql-engine/execution/parse"
+	"github.com/thanos-community/promql-engine/execution/warnings"
 	"github.com/thanos-community/promql-engine/worker"
 )
 
@@ -56,6 +57,8 @@ func NewHashAggregate(
 
 	// Grouping labels need to be sorted in order for metric hashing to work.
 	// https://github.com/prometheus/prometheus/blob/8ed39fdab1ead382a354e45ded999eb3610f8d5f/model/labels/labels.go#L162-L181
+	// They are sorted in a copy since plans can be shared by concurrent queries.
+	labels = slices.Clone(labels)
 	slices.Sort(labels)
 	a := &aggregate{
 		next:           next,
@@ -149,6 +152,9 @@ func (a *aggregate) Next(ctx context.Context) ([]model.StepVector, error) {
 		if err != nil {
 			return nil, err
 		}
+		if a.tables[i].hasMixedTypes() {
+			warnings.AddToContext(errors.Newf("PromQL warning: encountered a mix of histograms and floats for %s aggregation", a.aggregation), ctx)
+		}
 		result = append(result, output)
 		a.next.GetPool().PutStepVector(vector)
 	}
@@ -164,7 +170,7 @@ func (a *aggregate) initializeTables(ctx context.Context) error {
 	)
 
 	if a.by && len(a.labels) == 0 {
-		tables, series, err = a.initializeVectorizedTables(ctx)
+		tables, series, err = a.initializeVectorizedTables()
 	} else {
 		tables, series, err = a.initializeScalarTables(ctx)
 	}
@@ -184,10 +190,13 @@ func (a *aggregate) workerTask(workerID int, arg float64, vector model.StepVecto
 	return table.toVector(a.vectorPool)
 }
 
-func (a *aggregate) initializeVectorizedTables(ctx context.Context) ([]aggregateTable, []labels.Labels, error) {
+func (a *aggregate) initializeVectorizedTables() ([]aggregateTable, []labels.Labels, error) {
 	tables, err := newVectorizedTables(a.stepsBatch, a.aggregation)
 	if errors.Is(err, parse.ErrNotSupportedExpr) {
-		return a.initializeScalarTables(ctx)
+		// All series belong to the same group, so they are folded into a single
+		// accumulator without being hashed.
+		a.vectorPool.SetStepSize(1)
+		return newUngroupedTables(a.stepsBatch, a.newAccumulator), []labels.Labels{{}}, nil
 	}
 
 	if err != nil {
@@ -203,23 +212,25 @@ func (a *aggregate) initializeScalarTables(ctx context.Context) ([]aggregateTabl
 		return nil, nil, err
 	}
 
+	grouping := model.Grouping{Without: !a.by, Labels: a.labels}
+	hashes, err := model.SeriesHashes(ctx, a.next, grouping)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	inputCache := make([]uint64, len(series))
-	outputMap := make(map[uint64]*model.Series)
+	groups := model.NewGroups(grouping)
 	outputCache := make([]*model.Series, 0)
-	buf := make([]byte, 1024)
 	for i := 0; i < len(series); i++ {
-		hash, _, lbls := hashMetric(series[i], !a.by, a.labels, buf)
-		output, ok := outputMap[hash]
+		id, ok := groups.Get(hashes[i], series[i])
 		if !ok {
-			output = &model.Series{
-				Metric: lbls,
-				ID:     uint64(len(outputCache)),
-			}
-			outputMap[hash] = output
-			outputCache = append(outputCache, output)
+			outputCache = append(outputCache, &model.Series{
+				Metric: outputMetric(series[i], !a.by, a.labels),
+				ID:     uint64(id),
+			})
 		}
 
-		inputCache[i] = output.ID
+		inputCache[i] = uint64(id)
 	}
 	a.vectorPool.SetStepSize(len(outputCache))
 	tables := newScalarTables(a.stepsBatch, inputCache, outputCache, a.newAccumulator)
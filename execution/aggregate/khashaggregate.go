@@ -20,6 +20,9 @@ import (
 	"github.com/thanos-community/promql-engine/execution/model"
 )
 
+// kAggregate is a model.VectorOperator for topk and bottomk. Samples of each step are pushed into a
+// heap per group which keeps the k greatest or lowest samples, so the memory used for aggregating a
+// step is proportional to k and the number of groups instead of the number of input series.
 type kAggregate struct {
 	next    model.VectorOperator
 	paramOp model.VectorOperator
@@ -61,6 +64,8 @@ func NewKHashAggregate(
 	}
 	// Grouping labels need to be sorted in order for metric hashing to work.
 	// https://github.com/prometheus/prometheus/blob/8ed39fdab1ead382a354e45ded999eb3610f8d5f/model/labels/labels.go#L162-L181
+	// They are sorted in a copy since plans can be shared by concurrent queries.
+	labels = slices.Clone(labels)
 	slices.Sort(labels)
 
 	a := &kAggregate{
@@ -115,6 +120,7 @@ func (a *kAggregate) Next(ctx context.Context) ([]model.StepVector, error) {
 		// Skip steps where the argument is less than or equal to 0.
 		if int(a.params[i]) <= 0 {
 			result = append(result, a.GetPool().GetStepVector(vector.T))
+			a.next.GetPool().PutStepVector(vector)
 			continue
 		}
 		a.aggregate(vector.T, &result, int(a.params[i]), vector.SampleIDs, vector.Samples)
@@ -151,38 +157,43 @@ func (a *kAggregate) init(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	hapsHash := make(map[uint64]*samplesHeap)
-	buf := make([]byte, 1024)
+	grouping := model.Grouping{Without: !a.by, Labels: a.labels}
+	hashes, err := model.SeriesHashes(ctx, a.next, grouping)
+	if err != nil {
+		return err
+	}
+	groups := model.NewGroups(grouping)
 	for i := 0; i < len(series); i++ {
-		hash, _, _ := hashMetric(series[i], !a.by, a.labels, buf)
-		h, ok := hapsHash[hash]
+		id, ok := groups.Get(hashes[i], series[i])
 		if !ok {
-			h = &samplesHeap{compare: a.compare}
-			hapsHash[hash] = h
-			a.heaps = append(a.heaps, h)
+			a.heaps = append(a.heaps, &samplesHeap{compare: a.compare})
 		}
+		h := a.heaps[id]
+		h.numSeries++
 		a.inputToHeap = append(a.inputToHeap, h)
 	}
-	a.vectorPool.SetStepSize(len(series))
+	// Each group keeps at most k samples in its heap, so output steps are sized
+	// by the number of groups instead of the number of input series.
+	a.vectorPool.SetStepSize(len(a.heaps))
 	a.series = series
 	return nil
 }
 
 func (a *kAggregate) aggregate(t int64, result *[]model.StepVector, k int, SampleIDs []uint64, samples []float64) {
+	for _, h := range a.heaps {
+		h.resize(k)
+	}
 	for i, sId := range SampleIDs {
 		h := a.inputToHeap[sId]
-		if h.Len() < k || h.compare(h.entries[0].total, samples[i]) || math.IsNaN(h.entries[0].total) {
-			if k == 1 && h.Len() == 1 {
-				h.entries[0].sId = sId
-				h.entries[0].total = samples[i]
-				continue
-			}
-
-			if h.Len() == k {
-				heap.Pop(h)
-			}
-
-			heap.Push(h, &entry{sId: sId, total: samples[i]})
+		if h.Len() < h.k {
+			h.entries = append(h.entries, entry{sId: sId, total: samples[i]})
+			heap.Fix(h, h.Len()-1)
+			continue
+		}
+		// Replace the top of a full heap in place, so that pushing samples does not allocate.
+		if h.compare(h.entries[0].total, samples[i]) || math.IsNaN(h.entries[0].total) {
+			h.entries[0] = entry{sId: sId, total: samples[i]}
+			heap.Fix(h, 0)
 		}
 	}
 
@@ -209,6 +220,24 @@ type entry struct {
 type samplesHeap struct {
 	entries []entry
 	compare func(float64, float64) bool
+
+	// k is the number of entries kept for the current step, which is
+	// at most the number of series in the group.
+	k         int
+	numSeries int
+}
+
+// resize sets the number of entries kept by the heap for the current step.
+// The parameter of topk and bottomk can change between steps, so entries
+// are only allocated for as many series as there are in the group.
+func (s *samplesHeap) resize(k int) {
+	if k > s.numSeries {
+		k = s.numSeries
+	}
+	s.k = k
+	if cap(s.entries) < k {
+		s.entries = make([]entry, 0, k)
+	}
 }
 
 func (s samplesHeap) Len() int {
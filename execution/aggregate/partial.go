@@ -0,0 +1,291 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package aggregate
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"golang.org/x/exp/slices"
+
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+
+	"github.com/thanos-community/promql-engine/execution/function"
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/execution/parse"
+)
+
+// partialGroup accumulates partial aggregates for a single output series.
+type partialGroup struct {
+	// t is the step for which the group was last updated.
+	t     int64
+	count float64
+	sum   float64
+	// c is the compensation of the Kahan summation of sum.
+	c    float64
+	mean float64
+	m2   float64
+}
+
+// partialAggregate is a model.VectorOperator which combines partial aggregates
+// into exact avg, stddev and stdvar aggregations. The count operator returns the number
+// of samples in each partial aggregate, and the component operators return either their
+// sum, for avg, or their mean and variance, for stddev and stdvar.
+// Means and variances are combined using the parallel algorithm from Chan et al.
+// https://en.wikipedia.org/wiki/Algorithms_for_calculating_variance#Parallel_algorithm
+type partialAggregate struct {
+	once   sync.Once
+	series []labels.Labels
+
+	pool        *model.VectorPool
+	aggregation parser.ItemType
+	by          bool
+	labels      []string
+
+	count      model.VectorOperator
+	components []model.VectorOperator
+
+	// componentIndex maps series from each component operator to series from the count operator.
+	componentIndex [][]int
+	// outputIndex maps series from the count operator to output series.
+	outputIndex []uint64
+	// values holds the values of each component for the current step, indexed by count series.
+	values [][]float64
+	// valueSteps holds the step at which each value was last set.
+	valueSteps [][]int64
+	groups     []partialGroup
+}
+
+// NewPartialAggregate creates an operator which computes the given aggregation from partial aggregates.
+// For avg, the components are the sums of the partial aggregates, and for stddev and stdvar
+// they are their means followed by their variances.
+func NewPartialAggregate(
+	pool *model.VectorPool,
+	aggregation parser.ItemType,
+	by bool,
+	labels []string,
+	count model.VectorOperator,
+	components ...model.VectorOperator,
+) (model.VectorOperator, error) {
+	switch aggregation {
+	case parser.AVG:
+		if len(components) != 1 {
+			return nil, errors.Newf("partial %s requires 1 component, got %d", aggregation, len(components))
+		}
+	case parser.STDDEV, parser.STDVAR:
+		if len(components) != 2 {
+			return nil, errors.Newf("partial %s requires 2 components, got %d", aggregation, len(components))
+		}
+	default:
+		return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "partial aggregation %s", aggregation)
+	}
+
+	// Grouping labels need to be sorted in order for metric hashing to work.
+	// They are sorted in a copy since plans can be shared by concurrent queries.
+	labels = slices.Clone(labels)
+	slices.Sort(labels)
+	return &partialAggregate{
+		pool:        pool,
+		aggregation: aggregation,
+		by:          by,
+		labels:      labels,
+		count:       count,
+		components:  components,
+	}, nil
+}
+
+func (p *partialAggregate) Explain() (me string, next []model.VectorOperator) {
+	ops := append([]model.VectorOperator{p.count}, p.components...)
+	if p.by {
+		return fmt.Sprintf("[*partialAggregate] %v by (%v)", p.aggregation.String(), p.labels), ops
+	}
+	return fmt.Sprintf("[*partialAggregate] %v without (%v)", p.aggregation.String(), p.labels), ops
+}
+
+func (p *partialAggregate) Series(ctx context.Context) ([]labels.Labels, error) {
+	var err error
+	p.once.Do(func() { err = p.loadSeries(ctx) })
+	if err != nil {
+		return nil, err
+	}
+	return p.series, nil
+}
+
+func (p *partialAggregate) GetPool() *model.VectorPool {
+	return p.pool
+}
+
+func (p *partialAggregate) Next(ctx context.Context) ([]model.StepVector, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	var err error
+	p.once.Do(func() { err = p.loadSeries(ctx) })
+	if err != nil {
+		return nil, err
+	}
+
+	in, err := p.count.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if in == nil {
+		return nil, nil
+	}
+
+	componentVectors := make([][]model.StepVector, len(p.components))
+	for i, c := range p.components {
+		componentVectors[i], err = c.Next(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := p.pool.GetVectorBatch()
+	for i, vector := range in {
+		for c, vectors := range componentVectors {
+			if i >= len(vectors) || vectors[i].T != vector.T {
+				continue
+			}
+			for j, sampleID := range vectors[i].SampleIDs {
+				if countID := p.componentIndex[c][sampleID]; countID >= 0 {
+					p.values[c][countID] = vectors[i].Samples[j]
+					p.valueSteps[c][countID] = vector.T
+				}
+			}
+		}
+
+		for j, sampleID := range vector.SampleIDs {
+			p.addSample(vector.T, int(sampleID), vector.Samples[j])
+		}
+
+		out := p.pool.GetStepVector(vector.T)
+		for outputID, group := range p.groups {
+			if group.t == vector.T {
+				out.AppendSample(p.pool, uint64(outputID), p.value(group))
+			}
+		}
+		result = append(result, out)
+		p.count.GetPool().PutStepVector(vector)
+	}
+	p.count.GetPool().PutVectors(in)
+
+	for c, vectors := range componentVectors {
+		for _, vector := range vectors {
+			p.components[c].GetPool().PutStepVector(vector)
+		}
+		p.components[c].GetPool().PutVectors(vectors)
+	}
+
+	return result, nil
+}
+
+// addSample merges the partial aggregate for the given count series into its output group.
+func (p *partialAggregate) addSample(t int64, countID int, count float64) {
+	for c := range p.components {
+		if p.valueSteps[c][countID] != t {
+			return
+		}
+	}
+	if count <= 0 {
+		return
+	}
+
+	group := &p.groups[p.outputIndex[countID]]
+	if group.t != t {
+		*group = partialGroup{t: t}
+	}
+
+	if p.aggregation == parser.AVG {
+		group.count += count
+		group.sum, group.c = function.KahanSumInc(p.values[0][countID], group.sum, group.c)
+		return
+	}
+
+	mean, variance := p.values[0][countID], p.values[1][countID]
+	total := group.count + count
+	delta := mean - group.mean
+	group.m2 += variance*count + delta*delta*group.count*count/total
+	group.mean += delta * count / total
+	group.count = total
+}
+
+func (p *partialAggregate) value(group partialGroup) float64 {
+	switch p.aggregation {
+	case parser.AVG:
+		if math.IsInf(group.sum, 0) {
+			return group.sum / group.count
+		}
+		return (group.sum + group.c) / group.count
+	case parser.STDDEV:
+		return math.Sqrt(group.m2 / group.count)
+	default:
+		return group.m2 / group.count
+	}
+}
+
+func (p *partialAggregate) loadSeries(ctx context.Context) error {
+	countSeries, err := p.count.Series(ctx)
+	if err != nil {
+		return err
+	}
+
+	grouping := model.Grouping{Without: !p.by, Labels: p.labels}
+	hashes, err := model.SeriesHashes(ctx, p.count, grouping)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1024)
+	countIndex := make(map[uint64]int, len(countSeries))
+	groups := model.NewGroups(grouping)
+	p.outputIndex = make([]uint64, len(countSeries))
+	for i, s := range countSeries {
+		countIndex[xxhash.Sum64(s.Bytes(buf))] = i
+
+		outputID, ok := groups.Get(hashes[i], s)
+		if !ok {
+			p.series = append(p.series, outputMetric(s, !p.by, p.labels))
+		}
+		p.outputIndex[i] = uint64(outputID)
+	}
+
+	p.componentIndex = make([][]int, len(p.components))
+	p.values = make([][]float64, len(p.components))
+	p.valueSteps = make([][]int64, len(p.components))
+	for c, component := range p.components {
+		series, err := component.Series(ctx)
+		if err != nil {
+			return err
+		}
+		p.componentIndex[c] = make([]int, len(series))
+		for i, s := range series {
+			countID, ok := countIndex[xxhash.Sum64(s.Bytes(buf))]
+			if !ok {
+				countID = -1
+			}
+			p.componentIndex[c][i] = countID
+		}
+		p.values[c] = make([]float64, len(countSeries))
+		p.valueSteps[c] = make([]int64, len(countSeries))
+		for i := range p.valueSteps[c] {
+			p.valueSteps[c][i] = math.MinInt64
+		}
+	}
+
+	p.groups = make([]partialGroup, len(p.series))
+	for i := range p.groups {
+		p.groups[i].t = math.MinInt64
+	}
+	p.pool.SetStepSize(len(p.series))
+	return nil
+}
@@ -24,6 +24,9 @@ type aggregateTable interface {
 	aggregate(arg float64, vector model.StepVector)
 	toVector(pool *model.VectorPool) model.StepVector
 	size() int
+	// hasMixedTypes returns true if a group of the last aggregated step had no value
+	// because it contained both floats and histograms.
+	hasMixedTypes() bool
 }
 
 type scalarTable struct {
@@ -31,6 +34,7 @@ type scalarTable struct {
 	inputs       []uint64
 	outputs      []*model.Series
 	accumulators []*accumulator
+	mixedTypes   bool
 }
 
 func newScalarTables(stepsBatch int, inputCache []uint64, outputCache []*model.Series, newAccumulator newAccumulatorFunc) []aggregateTable {
@@ -87,14 +91,17 @@ func (t *scalarTable) reset(arg float64) {
 
 func (t *scalarTable) toVector(pool *model.VectorPool) model.StepVector {
 	result := pool.GetStepVector(t.timestamp)
+	t.mixedTypes = false
 	for i, v := range t.outputs {
-		if t.accumulators[i].HasValue() {
-			f, h := t.accumulators[i].ValueFunc()
-			if h == nil {
-				result.AppendSample(pool, v.ID, f)
-			} else {
-				result.AppendHistogram(pool, v.ID, h)
-			}
+		if !t.accumulators[i].HasValue() {
+			t.mixedTypes = t.mixedTypes || t.accumulators[i].hasMixedTypes()
+			continue
+		}
+		f, h := t.accumulators[i].ValueFunc()
+		if h == nil {
+			result.AppendSample(pool, v.ID, f)
+		} else {
+			result.AppendHistogram(pool, v.ID, h)
 		}
 	}
 	return result
@@ -104,24 +111,75 @@ func (t *scalarTable) size() int {
 	return len(t.outputs)
 }
 
-func hashMetric(metric labels.Labels, without bool, grouping []string, buf []byte) (uint64, string, labels.Labels) {
-	buf = buf[:0]
+func (t *scalarTable) hasMixedTypes() bool {
+	return t.mixedTypes
+}
+
+// ungroupedTable is a table for aggregations without grouping labels, which fold
+// all samples of a step into a single accumulator without looking up their group.
+type ungroupedTable struct {
+	timestamp   int64
+	accumulator *accumulator
+}
+
+func newUngroupedTables(stepsBatch int, newAccumulator newAccumulatorFunc) []aggregateTable {
+	tables := make([]aggregateTable, stepsBatch)
+	for i := 0; i < len(tables); i++ {
+		tables[i] = &ungroupedTable{accumulator: newAccumulator()}
+	}
+	return tables
+}
+
+func (t *ungroupedTable) aggregate(arg float64, vector model.StepVector) {
+	t.accumulator.Reset(arg)
+	t.timestamp = vector.T
+
+	for _, v := range vector.Samples {
+		t.accumulator.AddFunc(v, nil)
+	}
+	for _, h := range vector.Histograms {
+		t.accumulator.AddFunc(0, h)
+	}
+}
+
+func (t *ungroupedTable) toVector(pool *model.VectorPool) model.StepVector {
+	result := pool.GetStepVector(t.timestamp)
+	if !t.accumulator.HasValue() {
+		return result
+	}
+	f, h := t.accumulator.ValueFunc()
+	if h == nil {
+		result.AppendSample(pool, 0, f)
+	} else {
+		result.AppendHistogram(pool, 0, h)
+	}
+	return result
+}
+
+func (t *ungroupedTable) size() int {
+	return 1
+}
+
+func (t *ungroupedTable) hasMixedTypes() bool {
+	return !t.accumulator.HasValue() && t.accumulator.hasMixedTypes()
+}
+
+// outputMetric returns the labels of the group which the metric belongs to.
+func outputMetric(metric labels.Labels, without bool, grouping []string) labels.Labels {
 	if without {
 		lb := labels.NewBuilder(metric)
 		lb.Del(grouping...)
-		lb.Del(labels.MetricName)
-		key, bytes := metric.HashWithoutLabels(buf, grouping...)
-		return key, string(bytes), lb.Labels()
+		lb.Del(labels.MetricName, model.DropNameLabel)
+		return lb.Labels()
 	}
 
 	if len(grouping) == 0 {
-		return 0, "", labels.Labels{}
+		return labels.Labels{}
 	}
 
 	lb := labels.NewBuilder(metric)
 	lb.Keep(grouping...)
-	key, bytes := metric.HashForLabels(buf, grouping...)
-	return key, string(bytes), lb.Labels()
+	return lb.Labels()
 }
 
 type newAccumulatorFunc func() *accumulator
@@ -131,6 +189,13 @@ type accumulator struct {
 	ValueFunc func() (float64, *histogram.FloatHistogram)
 	HasValue  func() bool
 	Reset     func(arg float64)
+	// MixedTypes returns true if both floats and histograms were added, in which case the
+	// aggregation has no value. It is nil for aggregations which are defined for mixed types.
+	MixedTypes func() bool
+}
+
+func (a *accumulator) hasMixedTypes() bool {
+	return a.MixedTypes != nil && a.MixedTypes()
 }
 
 func makeAccumulatorFunc(expr parser.ItemType) (newAccumulatorFunc, error) {
@@ -145,30 +210,23 @@ func makeAccumulatorFunc(expr parser.ItemType) (newAccumulatorFunc, error) {
 			return &accumulator{
 				AddFunc: func(v float64, h *histogram.FloatHistogram) {
 					if h == nil {
+						// The sum starts from the first value so that the sign of zero is kept.
+						if !hasFloatVal {
+							value = v
+						} else {
+							value += v
+						}
 						hasFloatVal = true
-						value += v
 						return
 					}
-					if histSum == nil {
-						histSum = h.Copy()
-						return
-					}
-					// The histogram being added must have an equal or larger schema.
-					// https://github.com/prometheus/prometheus/blob/57bcbf18880f7554ae34c5b341d52fc53f059a97/promql/engine.go#L2448-L2456
-					if h.Schema >= histSum.Schema {
-						histSum = histSum.Add(h)
-					} else {
-						t := h.Copy()
-						t.Add(histSum)
-						histSum = t
-					}
-
+					histSum = addHistogram(histSum, h)
 				},
 				ValueFunc: func() (float64, *histogram.FloatHistogram) {
 					return value, histSum
 				},
 				// Sum returns an empty result when floats are histograms are aggregated.
-				HasValue: func() bool { return hasFloatVal != (histSum != nil) },
+				HasValue:   func() bool { return hasFloatVal != (histSum != nil) },
+				MixedTypes: func() bool { return hasFloatVal && histSum != nil },
 				Reset: func(_ float64) {
 					histSum = nil
 					hasFloatVal = false
@@ -242,22 +300,34 @@ func makeAccumulatorFunc(expr parser.ItemType) (newAccumulatorFunc, error) {
 		}, nil
 	case "avg":
 		return func() *accumulator {
-			var count, sum float64
-			var hasValue bool
+			var count float64
+			var mean function.Mean
+			var histSum *histogram.FloatHistogram
+			var hasFloatVal bool
 
 			return &accumulator{
-				AddFunc: func(v float64, _ *histogram.FloatHistogram) {
-					hasValue = true
+				AddFunc: func(v float64, h *histogram.FloatHistogram) {
 					count += 1
-					sum += v
+					if h == nil {
+						hasFloatVal = true
+						mean.Add(v)
+						return
+					}
+					histSum = addHistogram(histSum, h)
 				},
 				ValueFunc: func() (float64, *histogram.FloatHistogram) {
-					return sum / count, nil
+					if histSum != nil {
+						return 0, histSum.Copy().Scale(1 / count)
+					}
+					return mean.Value(), nil
 				},
-				HasValue: func() bool { return hasValue },
+				// Avg returns an empty result when floats are histograms are aggregated.
+				HasValue:   func() bool { return hasFloatVal != (histSum != nil) },
+				MixedTypes: func() bool { return hasFloatVal && histSum != nil },
 				Reset: func(_ float64) {
-					hasValue = false
-					sum = 0
+					histSum = nil
+					hasFloatVal = false
+					mean = function.Mean{}
 					count = 0
 				},
 			}
@@ -280,64 +350,11 @@ func makeAccumulatorFunc(expr parser.ItemType) (newAccumulatorFunc, error) {
 		}, nil
 	case "stddev":
 		return func() *accumulator {
-			var count float64
-			var mean, cMean float64
-			var aux, cAux float64
-			var hasValue bool
-			return &accumulator{
-				AddFunc: func(v float64, _ *histogram.FloatHistogram) {
-					hasValue = true
-					count++
-					delta := v - (mean + cMean)
-					mean, cMean = function.KahanSumInc(delta/count, mean, cMean)
-					aux, cAux = function.KahanSumInc(delta*(v-(mean+cMean)), aux, cAux)
-				},
-				ValueFunc: func() (float64, *histogram.FloatHistogram) {
-					if count == 1 {
-						return 0, nil
-					}
-					return math.Sqrt((aux + cAux) / count), nil
-				},
-				HasValue: func() bool { return hasValue },
-				Reset: func(_ float64) {
-					hasValue = false
-					count = 0
-					mean = 0
-					cMean = 0
-					aux = 0
-					cAux = 0
-				},
-			}
+			return newVarianceAccumulator(math.Sqrt)
 		}, nil
 	case "stdvar":
 		return func() *accumulator {
-			var count float64
-			var mean, cMean float64
-			var value float64
-			var hasValue bool
-			return &accumulator{
-				AddFunc: func(v float64, _ *histogram.FloatHistogram) {
-					hasValue = true
-					count++
-					delta := v - (mean + cMean)
-					mean += delta / count
-					value = delta * (v - mean)
-				},
-				ValueFunc: func() (float64, *histogram.FloatHistogram) {
-					if count == 1 {
-						return 0, nil
-					}
-					return value / count, nil
-				},
-				HasValue: func() bool { return hasValue },
-				Reset: func(_ float64) {
-					hasValue = false
-					count = 0
-					mean = 0
-					cMean = 0
-					value = 0
-				},
-			}
+			return newVarianceAccumulator(func(v float64) float64 { return v })
 		}, nil
 	case "quantile":
 		return func() *accumulator {
@@ -388,3 +405,35 @@ func quantile(q float64, points []float64) float64 {
 	weight := rank - math.Floor(rank)
 	return points[int(lowerIndex)]*(1-weight) + points[int(upperIndex)]*weight
 }
+
+// newVarianceAccumulator creates an accumulator which computes the population variance of
+// its values in a single pass with Welford's algorithm, and returns it transformed by value.
+// The running mean and sum of squared differences are summed with Kahan summation.
+func newVarianceAccumulator(value func(variance float64) float64) *accumulator {
+	var count float64
+	var mean, cMean float64
+	var m2, cM2 float64
+	var hasValue bool
+	return &accumulator{
+		AddFunc: func(v float64, _ *histogram.FloatHistogram) {
+			hasValue = true
+			count++
+			delta := v - (mean + cMean)
+			mean, cMean = function.KahanSumInc(delta/count, mean, cMean)
+			m2, cM2 = function.KahanSumInc(delta*(v-(mean+cMean)), m2, cM2)
+		},
+		ValueFunc: func() (float64, *histogram.FloatHistogram) {
+			if count == 1 {
+				return 0, nil
+			}
+			return value((m2 + cM2) / count), nil
+		},
+		HasValue: func() bool { return hasValue },
+		Reset: func(_ float64) {
+			hasValue = false
+			count = 0
+			mean, cMean = 0, 0
+			m2, cM2 = 0, 0
+		},
+	}
+}
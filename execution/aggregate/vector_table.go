@@ -14,6 +14,7 @@ import (
 
 	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
 
+	"github.com/thanos-community/promql-engine/execution/function"
 	"github.com/thanos-community/promql-engine/execution/model"
 	"github.com/thanos-community/promql-engine/execution/parse"
 )
@@ -25,6 +26,7 @@ type vectorTable struct {
 	histValue   *histogram.FloatHistogram
 	value       float64
 	hasValue    bool
+	mixedTypes  bool
 	accumulator vectorAccumulator
 }
 
@@ -49,6 +51,7 @@ func newVectorizedTable(a vectorAccumulator) *vectorTable {
 
 func (t *vectorTable) aggregate(_ float64, vector model.StepVector) {
 	t.timestamp = vector.T
+	t.mixedTypes = false
 
 	if len(vector.SampleIDs) == 0 && len(vector.Histograms) == 0 {
 		t.hasValue = false
@@ -61,6 +64,8 @@ func (t *vectorTable) aggregate(_ float64, vector model.StepVector) {
 	if !ok {
 		t.hasValue = false
 	}
+	// Accumulators which are defined for mixed types always have a value when the step has floats.
+	t.mixedTypes = !ok && len(vector.Samples) != 0 && len(vector.Histograms) != 0
 }
 
 func (t *vectorTable) toVector(pool *model.VectorPool) model.StepVector {
@@ -80,6 +85,10 @@ func (t *vectorTable) size() int {
 	return 1
 }
 
+func (t *vectorTable) hasMixedTypes() bool {
+	return t.mixedTypes
+}
+
 func newVectorAccumulator(expr parser.ItemType) (vectorAccumulator, error) {
 	t := parser.ItemTypeStr[expr]
 	switch t {
@@ -90,7 +99,12 @@ func newVectorAccumulator(expr parser.ItemType) (vectorAccumulator, error) {
 				return 0, nil, false
 			}
 			if len(float64s) > 0 {
-				return floats.Sum(float64s), nil, true
+				// The sum starts from the first value so that the sign of zero is kept.
+				sum := float64s[0]
+				for _, v := range float64s[1:] {
+					sum += v
+				}
+				return sum, nil, true
 			}
 			return 0, histogramSum(histograms), true
 		}, nil
@@ -114,8 +128,19 @@ func newVectorAccumulator(expr parser.ItemType) (vectorAccumulator, error) {
 		}, nil
 	case "avg":
 		return func(float64s []float64, histograms []*histogram.FloatHistogram) (float64, *histogram.FloatHistogram, bool) {
+			// Averaging mixed types is not defined.
+			if len(float64s) != 0 && len(histograms) != 0 {
+				return 0, nil, false
+			}
 			if len(float64s) > 0 {
-				return floats.Sum(float64s) / float64(len(float64s)), nil, true
+				var mean function.Mean
+				for _, v := range float64s {
+					mean.Add(v)
+				}
+				return mean.Value(), nil, true
+			}
+			if len(histograms) > 0 {
+				return 0, histogramSum(histograms).Scale(1 / float64(len(histograms))), true
 			}
 			return 0, nil, false
 		}, nil
@@ -129,19 +154,24 @@ func newVectorAccumulator(expr parser.ItemType) (vectorAccumulator, error) {
 }
 
 func histogramSum(histograms []*histogram.FloatHistogram) *histogram.FloatHistogram {
-	if len(histograms) == 1 {
-		return histograms[0].Copy()
+	var histSum *histogram.FloatHistogram
+	for _, h := range histograms {
+		histSum = addHistogram(histSum, h)
 	}
+	return histSum
+}
 
-	histSum := histograms[0].Copy()
-	for i := 1; i < len(histograms); i++ {
-		if histograms[i].Schema >= histSum.Schema {
-			histSum = histSum.Add(histograms[i])
-		} else {
-			t := histograms[i].Copy()
-			t.Add(histSum)
-			histSum = t
-		}
+// addHistogram adds h to sum, reconciling their schemas, and returns the result. The sum is
+// modified in place when it has the smaller schema, and h is never modified.
+func addHistogram(sum, h *histogram.FloatHistogram) *histogram.FloatHistogram {
+	if sum == nil {
+		return h.Copy()
 	}
-	return histSum
+	// The histogram being added must have an equal or larger schema.
+	// https://github.com/prometheus/prometheus/blob/57bcbf18880f7554ae34c5b341d52fc53f059a97/promql/engine.go#L2448-L2456
+	if h.Schema >= sum.Schema {
+		return sum.Add(h)
+	}
+	t := h.Copy()
+	return t.Add(sum)
 }
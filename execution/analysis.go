@@ -0,0 +1,43 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package execution
+
+import (
+	"github.com/thanos-community/promql-engine/execution/audit"
+	"github.com/thanos-community/promql-engine/execution/model"
+)
+
+// OperatorAnalysis is the analysis of an operator in the tree of an executed query.
+type OperatorAnalysis struct {
+	// Operator describes the operator, as returned by its Explain method.
+	Operator string
+	// Audited is true when the operator counts the label copies and sorts it performs. Only operators
+	// created for expressions are audited, and their counts include helper operators such as exchanges.
+	Audited bool
+	// LabelStats are the label copies and sorts performed by the operator, without the ones of its children.
+	LabelStats audit.LabelStats
+	Children   []OperatorAnalysis
+}
+
+// Analyze returns the analysis of the operator tree rooted at the given operator.
+// Operators are only audited when the query is created with AuditLabels.
+func Analyze(operator model.VectorOperator) OperatorAnalysis {
+	me, next := operator.Explain()
+	analysis := OperatorAnalysis{Operator: me}
+	if o, ok := unwrapState(operator).(*auditedOperator); ok {
+		analysis.Audited = true
+		analysis.LabelStats = o.labels.Stats()
+	}
+	for _, child := range next {
+		analysis.Children = append(analysis.Children, Analyze(child))
+	}
+	return analysis
+}
+
+func unwrapState(operator model.VectorOperator) model.VectorOperator {
+	if o, ok := operator.(*stateOperator); ok {
+		return o.VectorOperator
+	}
+	return operator
+}
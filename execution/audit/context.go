@@ -0,0 +1,89 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package audit
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+type auditKey string
+
+const (
+	key         auditKey = "promql-label-audit"
+	operatorKey auditKey = "promql-label-audit-operator"
+)
+
+// LabelStats counts the labels.Labels copies and sorts performed by operators
+// while a query is executed.
+type LabelStats struct {
+	Copies int64
+	Sorts  int64
+}
+
+func (s LabelStats) String() string {
+	return fmt.Sprintf("label copies: %d, label sorts: %d", s.Copies, s.Sorts)
+}
+
+// Counter counts label copies and sorts. It is safe for concurrent use.
+type Counter struct {
+	copies atomic.Int64
+	sorts  atomic.Int64
+}
+
+// Stats returns the label copies and sorts counted so far.
+func (c *Counter) Stats() LabelStats {
+	return LabelStats{Copies: c.copies.Load(), Sorts: c.sorts.Load()}
+}
+
+// NewContext returns a context which counts label copies and sorts
+// reported by operators while a query is executed.
+func NewContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, key, &Counter{})
+}
+
+// WithOperator returns a context in which label copies and sorts are also counted by the counter
+// of an operator, if auditing is enabled. Copies and sorts are only counted by the counter of the
+// innermost operator, so that the counts of operators do not include the counts of their children.
+func WithOperator(ctx context.Context, c *Counter) context.Context {
+	if _, ok := ctx.Value(key).(*Counter); !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, operatorKey, c)
+}
+
+// AddLabelCopies records n label copies in the context, if auditing is enabled.
+func AddLabelCopies(n int, ctx context.Context) {
+	s, ok := ctx.Value(key).(*Counter)
+	if !ok {
+		return
+	}
+	s.copies.Add(int64(n))
+	if o, ok := ctx.Value(operatorKey).(*Counter); ok {
+		o.copies.Add(int64(n))
+	}
+}
+
+// AddLabelSorts records n label sorts in the context, if auditing is enabled.
+func AddLabelSorts(n int, ctx context.Context) {
+	s, ok := ctx.Value(key).(*Counter)
+	if !ok {
+		return
+	}
+	s.sorts.Add(int64(n))
+	if o, ok := ctx.Value(operatorKey).(*Counter); ok {
+		o.sorts.Add(int64(n))
+	}
+}
+
+// FromContext returns the label stats collected in the context.
+// The second return value is false when auditing is not enabled.
+func FromContext(ctx context.Context) (LabelStats, bool) {
+	s, ok := ctx.Value(key).(*Counter)
+	if !ok {
+		return LabelStats{}, false
+	}
+	return s.Stats(), true
+}
@@ -0,0 +1,87 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package binary
+
+import (
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/histogram"
+
+	"github.com/thanos-community/promql-engine/execution/parse"
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+// Exponential bucket schemas can be reconciled with each other by merging buckets
+// of the histogram with the higher resolution.
+const (
+	minExponentialSchema = -4
+	maxExponentialSchema = 8
+)
+
+// newIncompatibleBucketLayoutError returns the annotation for samples which are dropped because
+// the bucket layouts of the histograms cannot be reconciled.
+func newIncompatibleBucketLayoutError(op parser.ItemType) error {
+	return errors.Newf("PromQL warning: incompatible bucket layout encountered for binary operator %q", parser.ItemTypeStr[op])
+}
+
+// histogramOperation evaluates op between two samples out of which at least one is a histogram.
+// The returned error is the annotation for dropping the sample when the operator is not defined
+// between the samples. The input histograms are never modified.
+func histogramOperation(op parser.ItemType, lhsVal, rhsVal float64, lhs, rhs *histogram.FloatHistogram) (*histogram.FloatHistogram, error) {
+	switch {
+	case lhs != nil && rhs == nil:
+		if h, ok := histogramScalarOperation(op, lhs, rhsVal, false); ok {
+			return h, nil
+		}
+		return nil, parse.IncompatibleTypesErr(op, parse.HistogramSampleType, parse.FloatSampleType)
+	case lhs == nil && rhs != nil:
+		if h, ok := histogramScalarOperation(op, rhs, lhsVal, true); ok {
+			return h, nil
+		}
+		return nil, parse.IncompatibleTypesErr(op, parse.FloatSampleType, parse.HistogramSampleType)
+	}
+
+	switch op {
+	case parser.ADD, parser.SUB:
+	default:
+		return nil, parse.IncompatibleTypesErr(op, parse.HistogramSampleType, parse.HistogramSampleType)
+	}
+	if !isExponentialSchema(lhs.Schema) || !isExponentialSchema(rhs.Schema) {
+		return nil, newIncompatibleBucketLayoutError(op)
+	}
+
+	// Add and Sub reduce the resolution of the argument to the schema of the receiver,
+	// so the receiver has to be the histogram with the lower resolution.
+	if op == parser.ADD {
+		if lhs.Schema <= rhs.Schema {
+			return lhs.Copy().Add(rhs), nil
+		}
+		return rhs.Copy().Add(lhs), nil
+	}
+	if lhs.Schema <= rhs.Schema {
+		return lhs.Copy().Sub(rhs), nil
+	}
+	return rhs.Copy().Scale(-1).Add(lhs), nil
+}
+
+func isExponentialSchema(schema int32) bool {
+	return schema >= minExponentialSchema && schema <= maxExponentialSchema
+}
+
+// histogramScalarOperation evaluates op between a histogram and a scalar, where the scalar
+// is on the left side of the operator when scalarLeft is set. Histograms can only be multiplied
+// by a scalar or divided by one, so false is returned for all other operators.
+// The input histogram is never modified.
+func histogramScalarOperation(op parser.ItemType, h *histogram.FloatHistogram, scalar float64, scalarLeft bool) (*histogram.FloatHistogram, bool) {
+	switch op {
+	case parser.MUL:
+		return h.Copy().Scale(scalar), true
+	case parser.DIV:
+		if scalarLeft {
+			return nil, false
+		}
+		return h.Copy().Scale(1 / scalar), true
+	default:
+		return nil, false
+	}
+}
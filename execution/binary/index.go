@@ -3,33 +3,255 @@
 
 package binary
 
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+
+	"github.com/efficientgo/core/errors"
+)
+
 type outputIndex interface {
-	outputSamples(inputSampleID uint64) []uint64
+	outputSamples(inputSampleID uint64) ([]uint64, error)
+}
+
+// seriesIndex maps input series IDs to the IDs of output series they join into.
+type seriesIndex [][]uint64
+
+func (l seriesIndex) outputSamples(inputSampleID uint64) ([]uint64, error) {
+	return l[inputSampleID], nil
+}
+
+// size returns the approximate number of bytes used by the index.
+func (l seriesIndex) size() int64 {
+	// Each entry has a slice header of three words.
+	size := int64(len(l)) * 24
+	for _, outputs := range l {
+		size += int64(cap(outputs)) * 8
+	}
+	return size
+}
+
+// indexBuilder builds the indexes of the high and low cardinality operators of a join, one match group
+// at a time. The size of the indexes is tracked as output series are added, and once it exceeds the memory
+// limit, the entries built so far are moved to temporary files. The entries of every following match group
+// are then written to the files as soon as the match group is complete.
+type indexBuilder struct {
+	memoryLimit int64
+	spillDir    string
+
+	high, low seriesIndex
+	size      int64
+	// pendingHigh and pendingLow are the input series which were added to since the last flush.
+	pendingHigh, pendingLow []uint64
+
+	// highSpilled and lowSpilled are set once the memory limit is exceeded.
+	highSpilled, lowSpilled *spilledIndex
+}
+
+// newIndexBuilder creates a builder for the indexes of a join. A memoryLimit of zero keeps the indexes in memory.
+func newIndexBuilder(numHighCard, numLowCard int, memoryLimit int64, spillDir string) *indexBuilder {
+	b := &indexBuilder{
+		memoryLimit: memoryLimit,
+		spillDir:    spillDir,
+		high:        make(seriesIndex, numHighCard),
+		low:         make(seriesIndex, numLowCard),
+	}
+	b.size = b.high.size() + b.low.size()
+	return b
+}
+
+func (b *indexBuilder) addHighCard(inputSampleID, outputSampleID uint64) {
+	b.high[inputSampleID] = b.add(b.high[inputSampleID], outputSampleID)
+	b.pendingHigh = append(b.pendingHigh, inputSampleID)
+}
+
+func (b *indexBuilder) addLowCard(inputSampleID, outputSampleID uint64) {
+	b.low[inputSampleID] = b.add(b.low[inputSampleID], outputSampleID)
+	b.pendingLow = append(b.pendingLow, inputSampleID)
+}
+
+func (b *indexBuilder) add(outputs []uint64, outputSampleID uint64) []uint64 {
+	prevCap := cap(outputs)
+	outputs = append(outputs, outputSampleID)
+	b.size += int64(cap(outputs)-prevCap) * 8
+	return outputs
+}
+
+// lowCardOutputs returns the output series added for a low cardinality series in the current match group.
+func (b *indexBuilder) lowCardOutputs(inputSampleID uint64) []uint64 {
+	return b.low[inputSampleID]
+}
+
+// endGroup is called once all output series of a match group were added.
+func (b *indexBuilder) endGroup() error {
+	switch {
+	case b.highSpilled != nil:
+		if err := b.flush(b.highSpilled, b.high, b.pendingHigh); err != nil {
+			return err
+		}
+		if err := b.flush(b.lowSpilled, b.low, b.pendingLow); err != nil {
+			return err
+		}
+	case b.memoryLimit > 0 && b.size > b.memoryLimit:
+		if err := b.spill(); err != nil {
+			return err
+		}
+	}
+	b.pendingHigh = b.pendingHigh[:0]
+	b.pendingLow = b.pendingLow[:0]
+	return nil
+}
+
+// spill moves all entries built so far to temporary files.
+func (b *indexBuilder) spill() error {
+	var err error
+	if b.highSpilled, err = newSpilledIndex(b.spillDir, len(b.high)); err != nil {
+		return err
+	}
+	if b.lowSpilled, err = newSpilledIndex(b.spillDir, len(b.low)); err != nil {
+		return err
+	}
+	for _, spill := range []struct {
+		spilled *spilledIndex
+		index   seriesIndex
+	}{{b.highSpilled, b.high}, {b.lowSpilled, b.low}} {
+		for id, outputs := range spill.index {
+			if len(outputs) == 0 {
+				continue
+			}
+			if err := spill.spilled.write(uint64(id), outputs); err != nil {
+				return err
+			}
+			b.size -= int64(cap(outputs)) * 8
+			spill.index[id] = nil
+		}
+	}
+	return nil
 }
 
-type highCardinalityIndex struct {
-	result []uint64
-	index  []*uint64
+func (b *indexBuilder) flush(spilled *spilledIndex, index seriesIndex, pending []uint64) error {
+	for _, id := range pending {
+		outputs := index[id]
+		if outputs == nil {
+			// The series was added to more than once.
+			continue
+		}
+		if err := spilled.write(id, outputs); err != nil {
+			return err
+		}
+		b.size -= int64(cap(outputs)) * 8
+		index[id] = nil
+	}
+	return nil
 }
 
-func newHighCardIndex(index []*uint64) *highCardinalityIndex {
-	return &highCardinalityIndex{
-		result: make([]uint64, 1),
-		index:  index,
+// finish returns the indexes of the high and low cardinality operators, and the spilled indexes
+// which need to be closed once they are no longer used.
+func (b *indexBuilder) finish() (outputIndex, outputIndex, []*spilledIndex, error) {
+	if b.highSpilled == nil {
+		return b.high, b.low, nil, nil
+	}
+	spilled := []*spilledIndex{b.highSpilled, b.lowSpilled}
+	for _, s := range spilled {
+		if err := s.flushWrites(); err != nil {
+			return nil, nil, nil, err
+		}
 	}
+	return b.highSpilled, b.lowSpilled, spilled, nil
 }
 
-func (h *highCardinalityIndex) outputSamples(inputSampleID uint64) []uint64 {
-	outputSampleID := h.index[inputSampleID]
-	if outputSampleID == nil {
-		return nil
+// close closes the files of spilled indexes when the indexes could not be built.
+func (b *indexBuilder) close() {
+	for _, s := range []*spilledIndex{b.highSpilled, b.lowSpilled} {
+		if s != nil {
+			_ = s.close()
+		}
 	}
-	h.result[0] = *outputSampleID
-	return h.result
 }
 
-type lowCardinalityIndex [][]uint64
+// spilledEntry is the location of the output series IDs of an input series in a spill file.
+type spilledEntry struct {
+	offset int64
+	n      uint32
+}
+
+// spilledIndex is a seriesIndex whose output series IDs are kept in a temporary file instead of memory.
+// Only the location of the output series IDs of each input series is kept in memory, so that looking up
+// the output series of an input series takes a single read.
+type spilledIndex struct {
+	f       *os.File
+	w       *bufio.Writer
+	size    int64
+	entries []spilledEntry
+
+	buf     []byte
+	outputs []uint64
+}
+
+// newSpilledIndex creates an empty index for numSeries input series in a temporary file in dir,
+// or the default directory for temporary files when dir is empty.
+func newSpilledIndex(dir string, numSeries int) (*spilledIndex, error) {
+	f, err := os.CreateTemp(dir, "promql-join-index-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create spill file")
+	}
+	// The file is unlinked right away so that it is removed once it is closed,
+	// even when the query is abandoned before the operator is exhausted.
+	if err := os.Remove(f.Name()); err != nil {
+		_ = f.Close()
+		return nil, errors.Wrap(err, "unlink spill file")
+	}
+	return &spilledIndex{f: f, w: bufio.NewWriter(f), entries: make([]spilledEntry, numSeries)}, nil
+}
+
+// write appends the output series IDs of an input series to the file.
+func (s *spilledIndex) write(inputSampleID uint64, outputs []uint64) error {
+	s.entries[inputSampleID] = spilledEntry{offset: s.size, n: uint32(len(outputs))}
+	var id [8]byte
+	for _, output := range outputs {
+		binary.LittleEndian.PutUint64(id[:], output)
+		if _, err := s.w.Write(id[:]); err != nil {
+			return errors.Wrap(err, "write spill file")
+		}
+	}
+	s.size += int64(len(outputs)) * 8
+	return nil
+}
+
+// flushWrites writes buffered output series IDs to the file before the index is read.
+func (s *spilledIndex) flushWrites() error {
+	if err := s.w.Flush(); err != nil {
+		return errors.Wrap(err, "write spill file")
+	}
+	s.w = nil
+	return nil
+}
+
+// outputSamples returns the output series IDs of the input series. The returned slice
+// is only valid until the next call.
+func (s *spilledIndex) outputSamples(inputSampleID uint64) ([]uint64, error) {
+	entry := s.entries[inputSampleID]
+	n := int(entry.n)
+	if n == 0 {
+		return nil, nil
+	}
+
+	if cap(s.buf) < n*8 {
+		s.buf = make([]byte, n*8)
+		s.outputs = make([]uint64, n)
+	}
+	buf := s.buf[:n*8]
+	if _, err := s.f.ReadAt(buf, entry.offset); err != nil {
+		return nil, errors.Wrap(err, "read spill file")
+	}
+	outputs := s.outputs[:n]
+	for i := range outputs {
+		outputs[i] = binary.LittleEndian.Uint64(buf[i*8:])
+	}
+	return outputs, nil
+}
 
-func (l lowCardinalityIndex) outputSamples(inputSampleID uint64) []uint64 {
-	return l[inputSampleID]
+func (s *spilledIndex) close() error {
+	return s.f.Close()
 }
@@ -13,8 +13,11 @@ import (
 
 	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
 
+	"github.com/thanos-community/promql-engine/execution/audit"
 	"github.com/thanos-community/promql-engine/execution/function"
 	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/execution/parse"
+	"github.com/thanos-community/promql-engine/execution/warnings"
 )
 
 type ScalarSide int
@@ -43,6 +46,8 @@ type scalarOperator struct {
 
 	// Keep the result if both sides are scalars.
 	bothScalars bool
+
+	hashes model.HashCache
 }
 
 func NewScalar(
@@ -80,7 +85,7 @@ func NewScalar(
 }
 
 func (o *scalarOperator) Explain() (me string, next []model.VectorOperator) {
-	return fmt.Sprintf("[*scalarOperator] %s", parser.ItemTypeStr[o.opType]), []model.VectorOperator{o.next, o.scalar}
+	return fmt.Sprintf("[*scalarOperator] %s", operatorString(o.opType, o.returnBool)), []model.VectorOperator{o.next, o.scalar}
 }
 
 func (o *scalarOperator) Series(ctx context.Context) ([]labels.Labels, error) {
@@ -92,6 +97,19 @@ func (o *scalarOperator) Series(ctx context.Context) ([]labels.Labels, error) {
 	return o.series, nil
 }
 
+// SeriesHashes returns the hashes of the vector operand for groupings without the metric name,
+// since it is the only label in which the series of the operator can differ from the operand.
+func (o *scalarOperator) SeriesHashes(ctx context.Context, grouping model.Grouping) ([]uint64, error) {
+	if !grouping.HasMetricName() {
+		return model.SeriesHashes(ctx, o.next, grouping)
+	}
+	series, err := o.Series(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return o.hashes.Get(series, grouping), nil
+}
+
 func (o *scalarOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 	select {
 	case <-ctx.Done():
@@ -119,12 +137,11 @@ func (o *scalarOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 	out := o.pool.GetVectorBatch()
 	for v, vector := range in {
 		step := o.pool.GetStepVector(vector.T)
+		scalarVal := math.NaN()
+		if len(scalarIn) > v && len(scalarIn[v].Samples) > 0 {
+			scalarVal = scalarIn[v].Samples[0]
+		}
 		for i := range vector.Samples {
-			scalarVal := math.NaN()
-			if len(scalarIn) > v && len(scalarIn[v].Samples) > 0 {
-				scalarVal = scalarIn[v].Samples[0]
-			}
-
 			operands := o.getOperands(vector, i, scalarVal)
 			val, keep := o.operation(operands, o.operandValIdx)
 			if o.returnBool {
@@ -139,6 +156,14 @@ func (o *scalarOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 			}
 			step.AppendSample(o.pool, vector.SampleIDs[i], val)
 		}
+		for i, h := range vector.Histograms {
+			result, ok := histogramScalarOperation(o.opType, h, scalarVal, o.operandValIdx == 1)
+			if !ok {
+				warnings.AddToContext(o.incompatibleTypesError(), ctx)
+				continue
+			}
+			step.AppendHistogram(o.pool, vector.HistogramIDs[i], result)
+		}
 		out = append(out, step)
 		o.next.GetPool().PutStepVector(vector)
 	}
@@ -153,6 +178,14 @@ func (o *scalarOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 	return out, nil
 }
 
+// incompatibleTypesError returns the annotation for histograms dropped by the operator.
+func (o *scalarOperator) incompatibleTypesError() error {
+	if o.operandValIdx == 1 {
+		return parse.IncompatibleTypesErr(o.opType, parse.FloatSampleType, parse.HistogramSampleType)
+	}
+	return parse.IncompatibleTypesErr(o.opType, parse.HistogramSampleType, parse.FloatSampleType)
+}
+
 func (o *scalarOperator) GetPool() *model.VectorPool {
 	return o.pool
 }
@@ -163,15 +196,18 @@ func (o *scalarOperator) loadSeries(ctx context.Context) error {
 		return err
 	}
 	series := make([]labels.Labels, len(vectorSeries))
+	var numCopies int
 	for i := range vectorSeries {
 		if vectorSeries[i] != nil {
 			lbls := vectorSeries[i]
 			if shouldDropMetricName(o.opType, o.returnBool) {
 				lbls, _ = function.DropMetricName(lbls.Copy())
+				numCopies++
 			}
 			series[i] = lbls
 		}
 	}
+	audit.AddLabelCopies(numCopies, ctx)
 
 	o.series = series
 	return nil
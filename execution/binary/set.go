@@ -0,0 +1,318 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package binary
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"golang.org/x/exp/slices"
+
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/execution/parse"
+)
+
+// setOperator evaluates the set operators and, or and unless between two step vectors.
+// Series from both operands are assigned to match groups by their signature when the operator
+// is initialized. Each step then marks the groups present on one side and probes
+// the marks with samples from the other side, so a step is evaluated in linear time.
+type setOperator struct {
+	pool *model.VectorPool
+	once sync.Once
+
+	lhs      model.VectorOperator
+	rhs      model.VectorOperator
+	matching *parser.VectorMatching
+	opType   parser.ItemType
+
+	// series contains the output series of the operator.
+	series []labels.Labels
+	// lhsGroups and rhsGroups map input series IDs to their match group.
+	lhsGroups []int
+	rhsGroups []int
+	// rhsOutputIDs maps rhs series IDs to output series IDs for the or operator.
+	rhsOutputIDs []uint64
+	// groupT contains the timestamp of the last step in which each match group was marked.
+	groupT []int64
+
+	hashes model.HashCache
+}
+
+func NewSetOperator(
+	pool *model.VectorPool,
+	lhs model.VectorOperator,
+	rhs model.VectorOperator,
+	matching *parser.VectorMatching,
+	operation parser.ItemType,
+) (model.VectorOperator, error) {
+	switch operation {
+	case parser.LAND, parser.LOR, parser.LUNLESS:
+	default:
+		return nil, parse.UnsupportedOperationErr(operation)
+	}
+	if matching == nil {
+		return nil, errors.Newf("set operator %q requires vector matching", parser.ItemTypeStr[operation])
+	}
+
+	return &setOperator{
+		pool:     pool,
+		lhs:      lhs,
+		rhs:      rhs,
+		matching: matching,
+		opType:   operation,
+	}, nil
+}
+
+func (o *setOperator) Explain() (me string, next []model.VectorOperator) {
+	if o.matching.On {
+		return fmt.Sprintf("[*setOperator] %s on %v", parser.ItemTypeStr[o.opType], o.matching.MatchingLabels), []model.VectorOperator{o.lhs, o.rhs}
+	}
+	return fmt.Sprintf("[*setOperator] %s ignoring %v", parser.ItemTypeStr[o.opType], o.matching.MatchingLabels), []model.VectorOperator{o.lhs, o.rhs}
+}
+
+func (o *setOperator) GetPool() *model.VectorPool {
+	return o.pool
+}
+
+func (o *setOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	var err error
+	o.once.Do(func() { err = o.init(ctx) })
+	if err != nil {
+		return nil, err
+	}
+
+	return o.series, nil
+}
+
+// SeriesHashes returns the hashes of the output series. The and and unless operators
+// return the series of the lhs operator, so its hashes are reused.
+func (o *setOperator) SeriesHashes(ctx context.Context, grouping model.Grouping) ([]uint64, error) {
+	if o.opType != parser.LOR {
+		return model.SeriesHashes(ctx, o.lhs, grouping)
+	}
+	series, err := o.Series(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return o.hashes.Get(series, grouping), nil
+}
+
+func (o *setOperator) init(ctx context.Context) error {
+	// Copy matching labels to avoid side-effects from sorting them.
+	groupingLabels := make([]string, len(o.matching.MatchingLabels))
+	copy(groupingLabels, o.matching.MatchingLabels)
+	slices.Sort(groupingLabels)
+	grouping := model.Grouping{Without: !o.matching.On, Labels: groupingLabels}
+
+	var (
+		lhsSeries []labels.Labels
+		lhsHashes []uint64
+	)
+	var errChan = make(chan error, 1)
+	go func() {
+		defer close(errChan)
+		var err error
+		lhsSeries, err = o.lhs.Series(ctx)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		lhsHashes, err = model.SeriesHashes(ctx, o.lhs, grouping)
+		if err != nil {
+			errChan <- err
+		}
+	}()
+
+	rhsSeries, err := o.rhs.Series(ctx)
+	if err != nil {
+		return err
+	}
+	rhsHashes, err := model.SeriesHashes(ctx, o.rhs, grouping)
+	if err != nil {
+		return err
+	}
+	if err := <-errChan; err != nil {
+		return err
+	}
+
+	groups := make(map[uint64]int)
+	assignGroups := func(hashes []uint64) []int {
+		result := make([]int, len(hashes))
+		for i, h := range hashes {
+			g, ok := groups[h]
+			if !ok {
+				g = len(groups)
+				groups[h] = g
+			}
+			result[i] = g
+		}
+		return result
+	}
+	o.lhsGroups = assignGroups(lhsHashes)
+	o.rhsGroups = assignGroups(rhsHashes)
+	o.groupT = make([]int64, len(groups))
+	for i := range o.groupT {
+		o.groupT[i] = math.MinInt64
+	}
+
+	o.series = lhsSeries
+	if o.opType == parser.LOR {
+		o.series, o.rhsOutputIDs = unionSeries(lhsSeries, rhsSeries)
+	}
+	o.pool.SetStepSize(len(o.series))
+
+	return nil
+}
+
+// unionSeries returns the union of lhs and rhs series together with a mapping from rhs
+// series IDs to IDs of the union. Series from rhs which have the same labels as a series from lhs
+// have the same signature, so they are never selected in the same step and can share its ID.
+func unionSeries(lhs, rhs []labels.Labels) ([]labels.Labels, []uint64) {
+	var (
+		buf       = make([]byte, 0, 1024)
+		series    = make([]labels.Labels, 0, len(lhs)+len(rhs))
+		outputIDs = make(map[string]uint64, len(lhs))
+		rhsIDs    = make([]uint64, len(rhs))
+	)
+	for i, s := range lhs {
+		buf = s.Bytes(buf)
+		outputIDs[string(buf)] = uint64(i)
+		series = append(series, s)
+	}
+	for i, s := range rhs {
+		buf = s.Bytes(buf)
+		if id, ok := outputIDs[string(buf)]; ok {
+			rhsIDs[i] = id
+			continue
+		}
+		rhsIDs[i] = uint64(len(series))
+		series = append(series, s)
+	}
+	return series, rhsIDs
+}
+
+func (o *setOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	var lhs []model.StepVector
+	var lerrChan = make(chan error, 1)
+	go func() {
+		var err error
+		lhs, err = o.lhs.Next(ctx)
+		if err != nil {
+			lerrChan <- err
+		}
+		close(lerrChan)
+	}()
+
+	rhs, rerr := o.rhs.Next(ctx)
+	lerr := <-lerrChan
+	if rerr != nil {
+		return nil, rerr
+	}
+	if lerr != nil {
+		return nil, lerr
+	}
+	if len(lhs) == 0 && len(rhs) == 0 {
+		return nil, nil
+	}
+
+	var err error
+	o.once.Do(func() { err = o.init(ctx) })
+	if err != nil {
+		return nil, err
+	}
+
+	numSteps := len(lhs)
+	if len(rhs) > numSteps {
+		numSteps = len(rhs)
+	}
+	batch := o.pool.GetVectorBatch()
+	for i := 0; i < numSteps; i++ {
+		var lhsVector, rhsVector model.StepVector
+		if i < len(lhs) {
+			lhsVector = lhs[i]
+		}
+		if i < len(rhs) {
+			rhsVector = rhs[i]
+		}
+		ts := lhsVector.T
+		if i >= len(lhs) {
+			ts = rhsVector.T
+		}
+
+		step := o.pool.GetStepVector(ts)
+		switch o.opType {
+		case parser.LAND, parser.LUNLESS:
+			o.markGroups(ts, rhsVector, o.rhsGroups)
+			o.filterLHS(&step, ts, lhsVector, o.opType == parser.LAND)
+		case parser.LOR:
+			o.markGroups(ts, lhsVector, o.lhsGroups)
+			step.AppendSamples(o.pool, lhsVector.SampleIDs, lhsVector.Samples)
+			step.AppendHistograms(o.pool, lhsVector.HistogramIDs, lhsVector.Histograms)
+			o.appendUnmarkedRHS(&step, ts, rhsVector)
+		}
+		batch = append(batch, step)
+
+		if i < len(lhs) {
+			o.lhs.GetPool().PutStepVector(lhsVector)
+		}
+		if i < len(rhs) {
+			o.rhs.GetPool().PutStepVector(rhsVector)
+		}
+	}
+	o.lhs.GetPool().PutVectors(lhs)
+	o.rhs.GetPool().PutVectors(rhs)
+
+	return batch, nil
+}
+
+// markGroups marks the match groups of all samples in the vector as present in the step.
+func (o *setOperator) markGroups(ts int64, vector model.StepVector, groups []int) {
+	for _, sampleID := range vector.SampleIDs {
+		o.groupT[groups[sampleID]] = ts
+	}
+	for _, sampleID := range vector.HistogramIDs {
+		o.groupT[groups[sampleID]] = ts
+	}
+}
+
+// filterLHS appends samples from the lhs vector whose match group
+// is marked in the step when keepMarked is true, or unmarked otherwise.
+func (o *setOperator) filterLHS(step *model.StepVector, ts int64, lhs model.StepVector, keepMarked bool) {
+	for i, sampleID := range lhs.SampleIDs {
+		if (o.groupT[o.lhsGroups[sampleID]] == ts) == keepMarked {
+			step.AppendSample(o.pool, sampleID, lhs.Samples[i])
+		}
+	}
+	for i, sampleID := range lhs.HistogramIDs {
+		if (o.groupT[o.lhsGroups[sampleID]] == ts) == keepMarked {
+			step.AppendHistogram(o.pool, sampleID, lhs.Histograms[i])
+		}
+	}
+}
+
+// appendUnmarkedRHS appends samples from the rhs vector whose match group is not marked in the step.
+func (o *setOperator) appendUnmarkedRHS(step *model.StepVector, ts int64, rhs model.StepVector) {
+	for i, sampleID := range rhs.SampleIDs {
+		if o.groupT[o.rhsGroups[sampleID]] != ts {
+			step.AppendSample(o.pool, o.rhsOutputIDs[sampleID], rhs.Samples[i])
+		}
+	}
+	for i, sampleID := range rhs.HistogramIDs {
+		if o.groupT[o.rhsGroups[sampleID]] != ts {
+			step.AppendHistogram(o.pool, o.rhsOutputIDs[sampleID], rhs.Histograms[i])
+		}
+	}
+}
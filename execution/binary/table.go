@@ -4,12 +4,17 @@
 package binary
 
 import (
+	"context"
 	"math"
 
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/histogram"
+
 	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
 
 	"github.com/thanos-community/promql-engine/execution/model"
 	"github.com/thanos-community/promql-engine/execution/parse"
+	"github.com/thanos-community/promql-engine/execution/warnings"
 )
 
 type binOpSide string
@@ -33,96 +38,191 @@ func newManyToManyMatchError(sampleID, duplicateSampleID uint64, side binOpSide)
 	}
 }
 
+func (e *errManyToManyMatch) Error() string {
+	return "many-to-many matching not allowed: matching labels must be unique on one side"
+}
+
+var (
+	errMultipleMatchesOneToOne = errors.New("multiple matches for labels: many-to-one matching must be explicit (group_left/group_right)")
+	errMultipleMatchesGrouping = errors.New("multiple matches for labels: grouping labels must ensure unique matches")
+)
+
 type outputSample struct {
-	lhT        int64
-	rhT        int64
-	lhSampleID uint64
-	rhSampleID uint64
-	v          float64
+	// lowCardT is the timestamp of the last step in which the output sample
+	// had a sample from the low cardinality operator.
+	lowCardT int64
+	lowCardV float64
+	// lowCardH is the histogram of the low cardinality sample, if the sample is a histogram.
+	lowCardH *histogram.FloatHistogram
+	// matchedT is the timestamp of the last step in which a sample was kept
+	// for the output sample, which is used to detect multiple matches.
+	matchedT int64
+}
+
+// groupSample is the last sample seen for a match group of the low cardinality operator.
+type groupSample struct {
+	t        int64
+	sampleID uint64
 }
 
 type table struct {
 	pool *model.VectorPool
 
 	operation operation
+	opType    parser.ItemType
 	card      parser.VectorMatchCardinality
 
 	outputValues []outputSample
 	// highCardOutputIndex is a mapping from series ID of the high cardinality
-	// operator to an output series ID.
+	// operator to output series IDs.
 	// During joins, each high cardinality series that has a matching
-	// low cardinality series will map to exactly one output series.
+	// low cardinality series will map to one output series for each
+	// distinct set of labels included from the low cardinality side.
 	highCardOutputIndex outputIndex
 	// lowCardOutputIndex is a mapping from series ID of the low cardinality
 	// operator to an output series ID.
 	// Each series from the low cardinality operator can join with many
 	// series of the high cardinality operator.
 	lowCardOutputIndex outputIndex
+	// lowCardGroups maps series IDs of the low cardinality operator to their match group.
+	lowCardGroups []uint64
+	// groupSamples holds the last sample seen for each match group
+	// of the low cardinality operator.
+	groupSamples []groupSample
 }
 
 func newTable(
 	pool *model.VectorPool,
 	card parser.VectorMatchCardinality,
 	operation operation,
+	opType parser.ItemType,
 	outputValues []outputSample,
 	highCardOutputCache outputIndex,
 	lowCardOutputCache outputIndex,
+	lowCardGroups []uint64,
 ) *table {
 	for i := range outputValues {
-		outputValues[i].lhT = -1
-		outputValues[i].rhT = -1
+		outputValues[i].lowCardT = -1
+		outputValues[i].matchedT = -1
+	}
+	var numGroups uint64
+	for _, g := range lowCardGroups {
+		if g >= numGroups {
+			numGroups = g + 1
+		}
+	}
+	groupSamples := make([]groupSample, numGroups)
+	for i := range groupSamples {
+		groupSamples[i].t = -1
 	}
 	return &table{
 		pool: pool,
 		card: card,
 
 		operation:           operation,
+		opType:              opType,
 		outputValues:        outputValues,
 		highCardOutputIndex: highCardOutputCache,
 		lowCardOutputIndex:  lowCardOutputCache,
+		lowCardGroups:       lowCardGroups,
+		groupSamples:        groupSamples,
 	}
 }
 
-func (t *table) execBinaryOperation(lhs model.StepVector, rhs model.StepVector, returnBool bool) (model.StepVector, *errManyToManyMatch) {
+// execBinaryOperation evaluates the operation for a single step in the same order as Prometheus.
+// Samples of the low cardinality operator are stored in the output samples they map to first,
+// so that duplicate series in a match group are reported before any match is evaluated. Samples
+// of the high cardinality operator are then joined with them, and multiple matches are reported
+// once more than one sample is kept for the same output sample.
+func (t *table) execBinaryOperation(ctx context.Context, lhs model.StepVector, rhs model.StepVector, returnBool bool) (model.StepVector, error) {
 	ts := lhs.T
 	step := t.pool.GetStepVector(ts)
+	// Nothing can match in the step, so duplicates are not reported either.
+	if len(lhs.SampleIDs)+len(lhs.HistogramIDs) == 0 || len(rhs.SampleIDs)+len(rhs.HistogramIDs) == 0 {
+		return step, nil
+	}
 
-	lhsIndex, rhsIndex := t.highCardOutputIndex, t.lowCardOutputIndex
+	highCard, lowCard := lhs, rhs
+	lowCardSide := rhBinOpSide
 	if t.card == parser.CardOneToMany {
-		lhsIndex, rhsIndex = rhsIndex, lhsIndex
+		highCard, lowCard = rhs, lhs
+		lowCardSide = lhBinOpSide
 	}
 
-	for i, sampleID := range lhs.SampleIDs {
-		lhsVal := lhs.Samples[i]
-		outputSampleIDs := lhsIndex.outputSamples(sampleID)
-		for _, outputSampleID := range outputSampleIDs {
-			if t.card != parser.CardManyToOne && t.outputValues[outputSampleID].lhT == ts {
-				prevSampleID := t.outputValues[outputSampleID].lhSampleID
-				return model.StepVector{}, newManyToManyMatchError(prevSampleID, sampleID, lhBinOpSide)
-			}
+	for i, sampleID := range lowCard.SampleIDs {
+		if err := t.setLowCard(ts, lowCardSide, sampleID, lowCard.Samples[i], nil); err != nil {
+			return model.StepVector{}, err
+		}
+	}
+	for i, sampleID := range lowCard.HistogramIDs {
+		if err := t.setLowCard(ts, lowCardSide, sampleID, 0, lowCard.Histograms[i]); err != nil {
+			return model.StepVector{}, err
+		}
+	}
 
-			t.outputValues[outputSampleID].lhSampleID = sampleID
-			t.outputValues[outputSampleID].lhT = lhs.T
-			t.outputValues[outputSampleID].v = lhsVal
+	for i, sampleID := range highCard.SampleIDs {
+		if err := t.joinHighCard(ctx, &step, sampleID, highCard.Samples[i], nil, returnBool); err != nil {
+			return model.StepVector{}, err
+		}
+	}
+	for i, sampleID := range highCard.HistogramIDs {
+		if err := t.joinHighCard(ctx, &step, sampleID, 0, highCard.Histograms[i], returnBool); err != nil {
+			return model.StepVector{}, err
 		}
 	}
 
-	for i, sampleID := range rhs.SampleIDs {
-		rhVal := rhs.Samples[i]
-		outputSampleIDs := rhsIndex.outputSamples(sampleID)
-		for _, outputSampleID := range outputSampleIDs {
-			outputSample := t.outputValues[outputSampleID]
-			if rhs.T != outputSample.lhT {
+	return step, nil
+}
+
+// setLowCard stores a sample from the low cardinality operator in all output samples it maps to.
+func (t *table) setLowCard(ts int64, side binOpSide, sampleID uint64, v float64, h *histogram.FloatHistogram) error {
+	if err := t.checkLowCardDuplicate(ts, sampleID, side); err != nil {
+		return err
+	}
+	outputSampleIDs, err := t.lowCardOutputIndex.outputSamples(sampleID)
+	if err != nil {
+		return err
+	}
+	for _, outputSampleID := range outputSampleIDs {
+		t.outputValues[outputSampleID].lowCardT = ts
+		t.outputValues[outputSampleID].lowCardV = v
+		t.outputValues[outputSampleID].lowCardH = h
+	}
+	return nil
+}
+
+// joinHighCard evaluates the operation between a sample from the high cardinality operator and the
+// low cardinality samples stored in the output samples it maps to, and appends the results to the step.
+func (t *table) joinHighCard(ctx context.Context, step *model.StepVector, sampleID uint64, v float64, h *histogram.FloatHistogram, returnBool bool) error {
+	outputSampleIDs, err := t.highCardOutputIndex.outputSamples(sampleID)
+	if err != nil {
+		return err
+	}
+	for _, outputSampleID := range outputSampleIDs {
+		outputSample := t.outputValues[outputSampleID]
+		if step.T != outputSample.lowCardT {
+			continue
+		}
+
+		// Account for the low cardinality operator being on the left side.
+		lhV, rhV, lhH, rhH := v, outputSample.lowCardV, h, outputSample.lowCardH
+		if t.card == parser.CardOneToMany {
+			lhV, rhV, lhH, rhH = rhV, lhV, rhH, lhH
+		}
+
+		var (
+			outputVal float64
+			result    *histogram.FloatHistogram
+		)
+		if lhH != nil || rhH != nil {
+			result, err = histogramOperation(t.opType, lhV, rhV, lhH, rhH)
+			if err != nil {
+				warnings.AddToContext(err, ctx)
 				continue
 			}
-			if t.card != parser.CardOneToMany && outputSample.rhT == rhs.T {
-				prevSampleID := t.outputValues[outputSampleID].rhSampleID
-				return model.StepVector{}, newManyToManyMatchError(prevSampleID, sampleID, rhBinOpSide)
-			}
-			t.outputValues[outputSampleID].rhSampleID = sampleID
-			t.outputValues[outputSampleID].rhT = rhs.T
-
-			outputVal, keep := t.operation([2]float64{outputSample.v, rhVal}, 0)
+		} else {
+			var keep bool
+			outputVal, keep = t.operation([2]float64{lhV, rhV}, 0)
 			if returnBool {
 				outputVal = 0
 				if keep {
@@ -131,11 +231,35 @@ func (t *table) execBinaryOperation(lhs model.StepVector, rhs model.StepVector,
 			} else if !keep {
 				continue
 			}
+		}
+
+		// Only kept samples count as matches.
+		if outputSample.matchedT == step.T {
+			if t.card == parser.CardOneToOne {
+				return errMultipleMatchesOneToOne
+			}
+			return errMultipleMatchesGrouping
+		}
+		t.outputValues[outputSampleID].matchedT = step.T
+
+		if result != nil {
+			step.AppendHistogram(t.pool, outputSampleID, result)
+		} else {
 			step.AppendSample(t.pool, outputSampleID, outputVal)
 		}
 	}
+	return nil
+}
 
-	return step, nil
+// checkLowCardDuplicate returns an error if another series from the same match group
+// of the low cardinality operator already has a sample in the current step.
+func (t *table) checkLowCardDuplicate(ts int64, sampleID uint64, side binOpSide) *errManyToManyMatch {
+	group := t.lowCardGroups[sampleID]
+	if prev := t.groupSamples[group]; prev.t == ts {
+		return newManyToManyMatchError(sampleID, prev.sampleID, side)
+	}
+	t.groupSamples[group] = groupSample{t: ts, sampleID: sampleID}
+	return nil
 }
 
 // operands is a length 2 array which contains lhs and rhs.
@@ -210,6 +334,15 @@ func btof(b bool) float64 {
 	return 0
 }
 
+// operatorString returns the string representation of a binary operator
+// together with the bool modifier of comparison operators.
+func operatorString(op parser.ItemType, returnBool bool) string {
+	if returnBool && op.IsComparisonOperator() {
+		return parser.ItemTypeStr[op] + " bool"
+	}
+	return parser.ItemTypeStr[op]
+}
+
 func shouldDropMetricName(op parser.ItemType, returnBool bool) bool {
 	switch op.String() {
 	case "+", "-", "*", "/", "%", "^":
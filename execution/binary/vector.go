@@ -17,6 +17,10 @@ import (
 	"github.com/thanos-community/promql-engine/execution/model"
 )
 
+// SideEstimator returns the estimated number of series of the lhs and rhs operators of a join.
+// The returned bool is false when the series cannot be estimated.
+type SideEstimator func(ctx context.Context) (lhs, rhs int64, ok bool, err error)
+
 // vectorOperator evaluates an expression between two step vectors.
 type vectorOperator struct {
 	pool *model.VectorPool
@@ -43,6 +47,22 @@ type vectorOperator struct {
 
 	// If true then 1/0 needs to be returned instead of the value.
 	returnBool bool
+
+	hashes model.HashCache
+
+	// memoryLimit is the number of bytes the join index can use before it is spilled
+	// to a temporary file in spillDir. Zero keeps the index in memory.
+	memoryLimit int64
+	spillDir    string
+	// spilled contains the indexes which were spilled and need to be closed.
+	spilledMu sync.Mutex
+	spilled   []*spilledIndex
+
+	// estimateSides chooses the build side of the join, whose series are selected first.
+	// When the build side has no series, the other side is not selected at all.
+	estimateSides SideEstimator
+	// empty is true when one side has no series, so that the operator has no output.
+	empty bool
 }
 
 func NewVectorOperator(
@@ -52,6 +72,9 @@ func NewVectorOperator(
 	matching *parser.VectorMatching,
 	operation parser.ItemType,
 	returnBool bool,
+	memoryLimit int64,
+	spillDir string,
+	estimateSides SideEstimator,
 ) (model.VectorOperator, error) {
 	op, err := newOperation(operation, true)
 	if err != nil {
@@ -73,14 +96,18 @@ func NewVectorOperator(
 		operation:      op,
 		opType:         operation,
 		returnBool:     returnBool,
+		memoryLimit:    memoryLimit,
+		spillDir:       spillDir,
+		estimateSides:  estimateSides,
 	}, nil
 }
 
 func (o *vectorOperator) Explain() (me string, next []model.VectorOperator) {
+	op := operatorString(o.opType, o.returnBool)
 	if o.matching.On {
-		return fmt.Sprintf("[*vectorOperator] %s %v on %v group %v", parser.ItemTypeStr[o.opType], o.matching.Card.String(), o.matching.MatchingLabels, o.matching.Include), []model.VectorOperator{o.lhs, o.rhs}
+		return fmt.Sprintf("[*vectorOperator] %s %v on %v group %v", op, o.matching.Card.String(), o.matching.MatchingLabels, o.matching.Include), []model.VectorOperator{o.lhs, o.rhs}
 	}
-	return fmt.Sprintf("[*vectorOperator] %s %v ignoring %v group %v", parser.ItemTypeStr[o.opType], o.matching.Card.String(), o.matching.On, o.matching.Include), []model.VectorOperator{o.lhs, o.rhs}
+	return fmt.Sprintf("[*vectorOperator] %s %v ignoring %v group %v", op, o.matching.Card.String(), o.matching.MatchingLabels, o.matching.Include), []model.VectorOperator{o.lhs, o.rhs}
 }
 
 func (o *vectorOperator) Series(ctx context.Context) ([]labels.Labels, error) {
@@ -93,22 +120,76 @@ func (o *vectorOperator) Series(ctx context.Context) ([]labels.Labels, error) {
 	return o.series, nil
 }
 
+// SeriesHashes returns the hashes of the output series, which are computed once for each grouping.
+func (o *vectorOperator) SeriesHashes(ctx context.Context, grouping model.Grouping) ([]uint64, error) {
+	series, err := o.Series(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return o.hashes.Get(series, grouping), nil
+}
+
+// selectBuildSide selects the series of the side which is estimated to have fewer series,
+// and returns true if it has none. Nothing can match then, so the other side is not selected.
+func (o *vectorOperator) selectBuildSide(ctx context.Context) (bool, error) {
+	if o.estimateSides == nil {
+		return false, nil
+	}
+	lhs, rhs, ok, err := o.estimateSides(ctx)
+	if err != nil || !ok {
+		return false, err
+	}
+	buildSide := o.rhs
+	if lhs < rhs {
+		buildSide = o.lhs
+	}
+	series, err := buildSide.Series(ctx)
+	if err != nil {
+		return false, err
+	}
+	return len(series) == 0, nil
+}
+
 func (o *vectorOperator) initOutputs(ctx context.Context) error {
-	var highCardSide []labels.Labels
+	empty, err := o.selectBuildSide(ctx)
+	if err != nil {
+		return err
+	}
+	if empty {
+		o.empty = true
+		o.series = []labels.Labels{}
+		return nil
+	}
+
+	grouping := model.Grouping{Without: !o.matching.On, Labels: o.groupingLabels}
+
+	var (
+		highCardSide   []labels.Labels
+		highCardHashes []uint64
+	)
 	var errChan = make(chan error, 1)
 	go func() {
+		defer close(errChan)
 		var err error
 		highCardSide, err = o.lhs.Series(ctx)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		highCardHashes, err = model.SeriesHashes(ctx, o.lhs, grouping)
 		if err != nil {
 			errChan <- err
 		}
-		close(errChan)
 	}()
 
 	lowCardSide, err := o.rhs.Series(ctx)
 	if err != nil {
 		return err
 	}
+	lowCardHashes, err := model.SeriesHashes(ctx, o.rhs, grouping)
+	if err != nil {
+		return err
+	}
 	if err := <-errChan; err != nil {
 		return err
 	}
@@ -118,18 +199,38 @@ func (o *vectorOperator) initOutputs(ctx context.Context) error {
 
 	if o.matching.Card == parser.CardOneToMany {
 		highCardSide, lowCardSide = lowCardSide, highCardSide
+		highCardHashes, lowCardHashes = lowCardHashes, highCardHashes
 	}
 
-	buf := make([]byte, 1024)
 	var includeLabels []string
 	if len(o.matching.Include) > 0 {
 		includeLabels = o.matching.Include
 	}
 	keepLabels := o.matching.Card != parser.CardOneToOne
 	keepName := !shouldDropMetricName(o.opType, o.returnBool)
-	highCardHashes, highCardInputMap := o.hashSeries(highCardSide, keepLabels, keepName, buf)
-	lowCardHashes, lowCardInputMap := o.hashSeries(lowCardSide, keepLabels, keepName, buf)
-	output, highCardOutputIndex, lowCardOutputIndex := o.join(highCardHashes, highCardInputMap, lowCardHashes, lowCardInputMap, includeLabels)
+	highCardIndex := o.hashSeries(highCardSide, highCardHashes, keepLabels, keepName)
+	lowCardIndex := o.hashSeries(lowCardSide, lowCardHashes, keepLabels, keepName)
+	indexes := newIndexBuilder(len(highCardSide), len(lowCardSide), o.memoryLimit, o.spillDir)
+	output, lowCardGroups, err := o.join(highCardIndex, lowCardIndex, lowCardSide, includeLabels, indexes)
+	if err != nil {
+		indexes.close()
+		return err
+	}
+	highCardOutputs, lowCardOutputs, spilled, err := indexes.finish()
+	if err != nil {
+		indexes.close()
+		return err
+	}
+	if len(spilled) > 0 {
+		o.spilledMu.Lock()
+		o.spilled = spilled
+		o.spilledMu.Unlock()
+		// The files are closed once the query is done, also when the operator is not exhausted.
+		go func() {
+			<-ctx.Done()
+			_ = o.closeSpilled()
+		}()
+	}
 
 	series := make([]labels.Labels, len(output))
 	for _, s := range output {
@@ -138,30 +239,58 @@ func (o *vectorOperator) initOutputs(ctx context.Context) error {
 	o.series = series
 
 	o.outputCache = make([]outputSample, len(series))
-	for i := range o.outputCache {
-		o.outputCache[i].lhT = -1
-	}
 	o.pool.SetStepSize(len(highCardSide))
 
 	o.table = newTable(
 		o.pool,
 		o.matching.Card,
 		o.operation,
+		o.opType,
 		o.outputCache,
-		newHighCardIndex(highCardOutputIndex),
-		lowCardinalityIndex(lowCardOutputIndex),
+		highCardOutputs,
+		lowCardOutputs,
+		lowCardGroups,
 	)
 
 	return nil
 }
 
-func (o *vectorOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+// closeSpilled closes the files of spilled indexes once the operator is exhausted, fails, or the query is done.
+func (o *vectorOperator) closeSpilled() error {
+	o.spilledMu.Lock()
+	defer o.spilledMu.Unlock()
+
+	var firstErr error
+	for _, s := range o.spilled {
+		if err := s.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	o.spilled = nil
+	return firstErr
+}
+
+func (o *vectorOperator) Next(ctx context.Context) (_ []model.StepVector, err error) {
+	defer func() {
+		if err != nil {
+			_ = o.closeSpilled()
+		}
+	}()
+
 	select {
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	default:
 	}
 
+	o.once.Do(func() { err = o.initOutputs(ctx) })
+	if err != nil {
+		return nil, err
+	}
+	if o.empty {
+		return nil, nil
+	}
+
 	var lhs []model.StepVector
 	var lerrChan = make(chan error, 1)
 	go func() {
@@ -186,38 +315,36 @@ func (o *vectorOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 	// we might want to drain or close the other one.
 	// We don't have a concept of closing an operator yet.
 	if len(lhs) == 0 || len(rhs) == 0 {
-		return nil, nil
-	}
-
-	var err error
-	o.once.Do(func() { err = o.initOutputs(ctx) })
-	if err != nil {
-		return nil, err
+		return nil, o.closeSpilled()
 	}
 
 	batch := o.pool.GetVectorBatch()
 	for i, vector := range lhs {
 		if i < len(rhs) {
-			step, err := o.table.execBinaryOperation(lhs[i], rhs[i], o.returnBool)
+			step, err := o.table.execBinaryOperation(ctx, lhs[i], rhs[i], o.returnBool)
 			if err == nil {
 				batch = append(batch, step)
 				o.rhs.GetPool().PutStepVector(rhs[i])
 				continue
 			}
+			var manyToManyErr *errManyToManyMatch
+			if !errors.As(err, &manyToManyErr) {
+				return nil, err
+			}
 
 			var sampleID, duplicateSampleID labels.Labels
-			switch err.side {
+			switch manyToManyErr.side {
 			case lhBinOpSide:
-				sampleID = o.lhSampleIDs[err.sampleID]
-				duplicateSampleID = o.lhSampleIDs[err.duplicateSampleID]
+				sampleID = o.lhSampleIDs[manyToManyErr.sampleID]
+				duplicateSampleID = o.lhSampleIDs[manyToManyErr.duplicateSampleID]
 			case rhBinOpSide:
-				sampleID = o.rhSampleIDs[err.sampleID]
-				duplicateSampleID = o.rhSampleIDs[err.duplicateSampleID]
+				sampleID = o.rhSampleIDs[manyToManyErr.sampleID]
+				duplicateSampleID = o.rhSampleIDs[manyToManyErr.duplicateSampleID]
 			}
 			group := sampleID.MatchLabels(o.matching.On, o.matching.MatchingLabels...)
 			msg := "found duplicate series for the match group %s on the %s hand-side of the operation: [%s, %s]" +
 				";many-to-many matching not allowed: matching labels must be unique on one side"
-			return nil, errors.Newf(msg, group, err.side, sampleID.String(), duplicateSampleID.String())
+			return nil, errors.Newf(msg, group, manyToManyErr.side, sampleID.String(), duplicateSampleID.String())
 		}
 		o.lhs.GetPool().PutStepVector(vector)
 	}
@@ -231,125 +358,164 @@ func (o *vectorOperator) GetPool() *model.VectorPool {
 	return o.pool
 }
 
-// hashSeries calculates the hash of each series from an input operator.
-// Since series from the high cardinality operator can map to multiple output series,
-// hashSeries returns an index from hash to a slice of resulting series, and
-// a map from input series ID to output series ID.
-// The latter can be used to build an array backed index from input model.Series to output model.Series,
-// avoiding expensive hashmap lookups.
-func (o *vectorOperator) hashSeries(series []labels.Labels, keepLabels, keepName bool, buf []byte) (map[uint64][]model.Series, map[uint64][]uint64) {
+// hashSeries indexes each series from an input operator by its precomputed hash.
+// Since many series can have the same hash, hashSeries returns an index from hash
+// to a slice of series whose IDs point to the position of the series in the input operator.
+func (o *vectorOperator) hashSeries(series []labels.Labels, seriesHashes []uint64, keepLabels, keepName bool) map[uint64][]model.Series {
 	hashes := make(map[uint64][]model.Series)
-	inputIndex := make(map[uint64][]uint64)
 	for i, s := range series {
-		sig, lbls := signature(s, !o.matching.On, o.groupingLabels, keepLabels, keepName, buf)
+		sig := seriesHashes[i]
+		lbls := outputLabels(s, !o.matching.On, o.groupingLabels, keepLabels, keepName)
 		if _, ok := hashes[sig]; !ok {
 			hashes[sig] = make([]model.Series, 0, 1)
-			inputIndex[sig] = make([]uint64, 0, 1)
 		}
 		hashes[sig] = append(hashes[sig], model.Series{
 			ID:     uint64(i),
 			Metric: lbls,
 		})
-		inputIndex[sig] = append(inputIndex[sig], uint64(i))
 	}
 
-	return hashes, inputIndex
+	return hashes
 }
 
 // join performs a join between series from the high cardinality and low cardinality operators.
 // It does that by using hash maps which point from series hash to the output series.
-// It also returns array backed indices for the high cardinality and low cardinality operators,
-// pointing from input model.Series ID to output model.Series ID.
-// The high cardinality operator can fail to join, which is why its index contains nullable values.
+// It also builds indices for the high cardinality and low cardinality operators,
+// pointing from input model.Series ID to output model.Series IDs.
+// The high cardinality operator can fail to join, which is why its index can contain empty values.
 // The low cardinality operator can join to multiple high cardinality series, which is why its index
 // points to an array of output series.
+//
+// Labels included with a group modifier are copied from the low cardinality series, so a high
+// cardinality series produces one output series for each distinct set of included label values
+// in its match group. High cardinality series which produce the same labels in the same match
+// group share an output series, which allows detecting multiple matches while evaluating steps.
+// Finally, join returns the match group of each low cardinality series which is used for detecting
+// duplicate series on the low cardinality side.
 func (o *vectorOperator) join(
 	highCardHashes map[uint64][]model.Series,
-	highCardInputIndex map[uint64][]uint64,
 	lowCardHashes map[uint64][]model.Series,
-	lowCardInputIndex map[uint64][]uint64,
+	lowCardSide []labels.Labels,
 	includeLabels []string,
-) ([]model.Series, []*uint64, [][]uint64) {
+	indexes *indexBuilder,
+) ([]model.Series, []uint64, error) {
 	// Output index points from output series ID
 	// to the actual series.
 	outputIndex := make([]model.Series, 0)
+	lowCardGroups := make([]uint64, len(lowCardSide))
 
-	// Prune high cardinality series which do not have a
-	// matching low cardinality series.
-	outputSize := 0
-	for hash, series := range highCardHashes {
-		outputSize += len(series)
-		if _, ok := lowCardHashes[hash]; !ok {
-			delete(highCardHashes, hash)
-			continue
+	var (
+		buf = make([]byte, 0, 1024)
+		// groupOutputs maps the labels of output series in the current match group to their IDs.
+		groupOutputs = make(map[string]uint64)
+		numGroups    uint64
+	)
+	for hash, lowCardSeries := range lowCardHashes {
+		for _, s := range lowCardSeries {
+			lowCardGroups[s.ID] = numGroups
 		}
-	}
-	lowCardOutputSize := 0
-	for _, lowCardOutputs := range lowCardInputIndex {
-		lowCardOutputSize += len(lowCardOutputs)
-	}
+		numGroups++
 
-	highCardOutputIndex := make([]*uint64, outputSize)
-	lowCardOutputIndex := make([][]uint64, lowCardOutputSize)
-	for hash, highCardSeries := range highCardHashes {
-		for _, lowCardSeriesID := range lowCardInputIndex[hash] {
-			// Each low cardinality series can map to multiple output series.
-			lowCardOutputIndex[lowCardSeriesID] = make([]uint64, 0, len(highCardSeries))
+		highCardSeries, ok := highCardHashes[hash]
+		if !ok {
+			continue
+		}
+		for k := range groupOutputs {
+			delete(groupOutputs, k)
+		}
+		variants := includedLabelVariants(lowCardSide, lowCardSeries, includeLabels)
+		for _, highCard := range highCardSeries {
+			for _, variant := range variants {
+				metric := resultMetric(highCard.Metric, variant.labels, includeLabels)
+				buf = metric.Bytes(buf)
+				outputID, ok := groupOutputs[string(buf)]
+				if !ok {
+					outputID = uint64(len(outputIndex))
+					outputIndex = append(outputIndex, model.Series{ID: outputID, Metric: metric})
+					groupOutputs[string(buf)] = outputID
+				}
+				indexes.addHighCard(highCard.ID, outputID)
+				for _, lowCardSeriesID := range variant.seriesIDs {
+					// Output series can be shared between variants, so make sure
+					// each low cardinality series points to them only once.
+					if ok && slices.Contains(indexes.lowCardOutputs(lowCardSeriesID), outputID) {
+						continue
+					}
+					indexes.addLowCard(lowCardSeriesID, outputID)
+				}
+			}
+		}
+		if err := indexes.endGroup(); err != nil {
+			return nil, nil, err
 		}
+	}
 
-		lowCardSeries := lowCardHashes[hash][0]
-		for i, output := range highCardSeries {
-			outputSeries := buildOutputSeries(uint64(len(outputIndex)), output, lowCardSeries, includeLabels)
-			outputIndex = append(outputIndex, outputSeries)
+	return outputIndex, lowCardGroups, nil
+}
 
-			highCardSeriesID := highCardInputIndex[hash][i]
-			highCardOutputIndex[highCardSeriesID] = &outputSeries.ID
+// labelVariant is a set of labels included with a group modifier, together
+// with the low cardinality series which have these labels.
+type labelVariant struct {
+	labels    labels.Labels
+	seriesIDs []uint64
+}
 
-			for _, lowCardSeriesID := range lowCardInputIndex[hash] {
-				lowCardOutputIndex[lowCardSeriesID] = append(lowCardOutputIndex[lowCardSeriesID], outputSeries.ID)
-			}
+// includedLabelVariants groups low cardinality series from the same match group
+// by the values of their included labels.
+func includedLabelVariants(lowCardSide []labels.Labels, series []model.Series, includeLabels []string) []labelVariant {
+	if len(includeLabels) == 0 {
+		ids := make([]uint64, 0, len(series))
+		for _, s := range series {
+			ids = append(ids, s.ID)
 		}
+		return []labelVariant{{seriesIDs: ids}}
 	}
 
-	return outputIndex, highCardOutputIndex, lowCardOutputIndex
+	variants := make([]labelVariant, 0, 1)
+	lb := labels.NewBuilder(nil)
+	for _, s := range series {
+		lb.Reset(lowCardSide[s.ID])
+		lbls := lb.Keep(includeLabels...).Labels()
+		i := slices.IndexFunc(variants, func(v labelVariant) bool { return labels.Equal(v.labels, lbls) })
+		if i < 0 {
+			i = len(variants)
+			variants = append(variants, labelVariant{labels: lbls})
+		}
+		variants[i].seriesIDs = append(variants[i].seriesIDs, s.ID)
+	}
+	return variants
 }
 
-func signature(metric labels.Labels, without bool, grouping []string, keepOriginalLabels, keepName bool, buf []byte) (uint64, labels.Labels) {
-	buf = buf[:0]
+func outputLabels(metric labels.Labels, without bool, grouping []string, keepOriginalLabels, keepName bool) labels.Labels {
 	lb := labels.NewBuilder(metric)
 	if !keepName {
-		lb = lb.Del(labels.MetricName)
+		lb = lb.Del(labels.MetricName, model.DropNameLabel)
 	}
-	if without {
-		dropLabels := grouping
-		if !keepName {
-			dropLabels = append(grouping, labels.MetricName)
-		}
-		key, _ := metric.HashWithoutLabels(buf, dropLabels...)
-		if !keepOriginalLabels {
-			lb.Del(dropLabels...)
-		}
-		return key, lb.Labels()
+	if keepOriginalLabels {
+		return lb.Labels()
 	}
-
-	if !keepOriginalLabels {
+	if without {
+		lb.Del(grouping...)
+	} else {
 		lb.Keep(grouping...)
 	}
-	if len(grouping) == 0 {
-		return 0, lb.Labels()
-	}
-
-	key, _ := metric.HashForLabels(buf, grouping...)
-	return key, lb.Labels()
+	return lb.Labels()
 }
 
-func buildOutputSeries(seriesID uint64, highCardSeries, lowCardSeries model.Series, includeLabels []string) model.Series {
-	metric := highCardSeries.Metric
-	if len(includeLabels) > 0 {
-		lowCardLabels := labels.NewBuilder(lowCardSeries.Metric).
-			Keep(includeLabels...).
-			Labels()
-		metric = append(metric, lowCardLabels...)
+// resultMetric returns the labels of an output series from a high cardinality series and
+// the included labels of a low cardinality series. Included labels which are missing from
+// the low cardinality series are removed from the output.
+func resultMetric(highCardMetric, lowCardLabels labels.Labels, includeLabels []string) labels.Labels {
+	if len(includeLabels) == 0 {
+		return highCardMetric
+	}
+	lb := labels.NewBuilder(highCardMetric)
+	for _, name := range includeLabels {
+		if v := lowCardLabels.Get(name); v != "" {
+			lb.Set(name, v)
+		} else {
+			lb.Del(name)
+		}
 	}
-	return model.Series{ID: seriesID, Metric: metric}
+	return lb.Labels()
 }
@@ -70,6 +70,24 @@ func (c *coalesce) Series(ctx context.Context) ([]labels.Labels, error) {
 	return c.series, nil
 }
 
+func (c *coalesce) SeriesHashes(ctx context.Context, grouping model.Grouping) ([]uint64, error) {
+	series, err := c.Series(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hashes are kept by the coalesced operators, in the same order as their series.
+	hashes := make([]uint64, 0, len(series))
+	for _, o := range c.operators {
+		h, err := model.SeriesHashes(ctx, o, grouping)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, h...)
+	}
+	return hashes, nil
+}
+
 func (c *coalesce) Next(ctx context.Context) ([]model.StepVector, error) {
 	select {
 	case <-ctx.Done():
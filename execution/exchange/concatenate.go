@@ -0,0 +1,182 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package exchange
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+)
+
+// concatenate is a model.VectorOperator which returns the step vectors of its downstream operators
+// one after another, in the order in which the operators are provided in NewConcatenate.
+// Each operator evaluates a consecutive slice of the steps of the query. Operators are pulled
+// concurrently and buffer up to bufferSize batches, so that later slices are evaluated while
+// the earlier ones are consumed. Series with the same labels in different operators are
+// returned as a single series.
+type concatenate struct {
+	once   sync.Once
+	series []labels.Labels
+
+	pool       *model.VectorPool
+	operators  []model.VectorOperator
+	bufferSize int
+
+	// outputIndex maps the input series IDs of each operator to output series IDs.
+	outputIndex [][]uint64
+	buffers     []chan maybeStepVector
+	current     int
+}
+
+func NewConcatenate(pool *model.VectorPool, bufferSize int, operators ...model.VectorOperator) model.VectorOperator {
+	return &concatenate{
+		pool:       pool,
+		operators:  operators,
+		bufferSize: bufferSize,
+	}
+}
+
+func (c *concatenate) Explain() (me string, next []model.VectorOperator) {
+	return fmt.Sprintf("[*concatenate(buff=%v)]", c.bufferSize), c.operators
+}
+
+func (c *concatenate) GetPool() *model.VectorPool {
+	return c.pool
+}
+
+func (c *concatenate) Series(ctx context.Context) ([]labels.Labels, error) {
+	var err error
+	c.once.Do(func() { err = c.loadSeries(ctx) })
+	if err != nil {
+		return nil, err
+	}
+	return c.series, nil
+}
+
+func (c *concatenate) Next(ctx context.Context) ([]model.StepVector, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	var err error
+	c.once.Do(func() { err = c.loadSeries(ctx) })
+	if err != nil {
+		return nil, err
+	}
+	if c.buffers == nil {
+		c.buffers = make([]chan maybeStepVector, len(c.operators))
+		for i, o := range c.operators {
+			c.buffers[i] = make(chan maybeStepVector, c.bufferSize)
+			go c.pull(ctx, o, c.buffers[i])
+		}
+	}
+
+	for c.current < len(c.operators) {
+		r, ok := <-c.buffers[c.current]
+		if !ok {
+			c.current++
+			continue
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		// Map input IDs to output IDs. Scalar operators do not have series,
+		// and their samples are returned with the same IDs.
+		o := c.operators[c.current]
+		outputIndex := c.outputIndex[c.current]
+		out := c.pool.GetVectorBatch()
+		for _, vector := range r.stepVector {
+			if len(outputIndex) > 0 {
+				for i := range vector.SampleIDs {
+					vector.SampleIDs[i] = outputIndex[vector.SampleIDs[i]]
+				}
+				for i := range vector.HistogramIDs {
+					vector.HistogramIDs[i] = outputIndex[vector.HistogramIDs[i]]
+				}
+			}
+			step := c.pool.GetStepVector(vector.T)
+			step.AppendSamples(c.pool, vector.SampleIDs, vector.Samples)
+			step.AppendHistograms(c.pool, vector.HistogramIDs, vector.Histograms)
+			out = append(out, step)
+			o.GetPool().PutStepVector(vector)
+		}
+		o.GetPool().PutVectors(r.stepVector)
+		return out, nil
+	}
+	return nil, nil
+}
+
+func (c *concatenate) pull(ctx context.Context, o model.VectorOperator, buffer chan maybeStepVector) {
+	defer close(buffer)
+
+	for {
+		r, err := o.Next(ctx)
+		if err != nil {
+			select {
+			case buffer <- maybeStepVector{err: err}:
+			case <-ctx.Done():
+			}
+			return
+		}
+		if r == nil {
+			return
+		}
+		select {
+		case buffer <- maybeStepVector{stepVector: r}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *concatenate) loadSeries(ctx context.Context) error {
+	var wg sync.WaitGroup
+	allSeries := make([][]labels.Labels, len(c.operators))
+	errChan := make(errorChan, len(c.operators))
+	for i := range c.operators {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			series, err := c.operators[i].Series(ctx)
+			if err != nil {
+				errChan <- errors.Wrapf(err, "loading series of slice %d", i)
+				return
+			}
+			allSeries[i] = series
+		}(i)
+	}
+	wg.Wait()
+	close(errChan)
+	if err := errChan.getError(); err != nil {
+		return err
+	}
+
+	outputIDs := make(map[uint64]uint64)
+	hashBuf := make([]byte, 0, 128)
+	c.outputIndex = make([][]uint64, len(c.operators))
+	for i, series := range allSeries {
+		c.outputIndex[i] = make([]uint64, len(series))
+		for inputID, s := range series {
+			hash := hashSeries(hashBuf, s)
+			outputID, ok := outputIDs[hash]
+			if !ok {
+				outputID = uint64(len(c.series))
+				outputIDs[hash] = outputID
+				c.series = append(c.series, s)
+			}
+			c.outputIndex[i][inputID] = outputID
+		}
+	}
+
+	c.pool.SetStepSize(len(c.series))
+	return nil
+}
@@ -41,6 +41,10 @@ func (c *concurrencyOperator) Series(ctx context.Context) ([]labels.Labels, erro
 	return c.next.Series(ctx)
 }
 
+func (c *concurrencyOperator) SeriesHashes(ctx context.Context, grouping model.Grouping) ([]uint64, error) {
+	return model.SeriesHashes(ctx, c.next, grouping)
+}
+
 func (c *concurrencyOperator) GetPool() *model.VectorPool {
 	return c.next.GetPool()
 }
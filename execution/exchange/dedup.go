@@ -5,19 +5,41 @@ package exchange
 
 import (
 	"context"
+	"math"
 	"sync"
 
 	"github.com/cespare/xxhash/v2"
+	"github.com/efficientgo/core/errors"
 	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/model/labels"
 
 	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/execution/warnings"
+	"github.com/thanos-community/promql-engine/query"
 )
 
 type dedupSample struct {
 	t int64
 	v float64
 	h *histogram.FloatHistogram
+
+	// last is the last float value seen for the step, used for detecting conflicts.
+	last float64
+	// sum and count are used for averaging float values.
+	sum   float64
+	count int
+
+	// replica is the input series of the sample and rank its priority under the penalty policy.
+	replica uint64
+	rank    int
+}
+
+// replicaState is the replica which the penalty policy selected for an output series.
+type replicaState struct {
+	selected bool
+	replica  uint64
+	// lastT is the timestamp of the last sample of the selected replica.
+	lastT int64
 }
 
 // The dedupCache is an internal cache used to deduplicate samples inside a single step vector.
@@ -25,9 +47,12 @@ type dedupCache []dedupSample
 
 // dedupOperator is a model.VectorOperator that deduplicates samples with
 // same IDs inside a single model.StepVector.
-// Deduplication is done using a last-sample-wins strategy, which means that
+// By default, deduplication is done using a last-sample-wins strategy, which means that
 // if multiple samples with the same ID are present in a StepVector, dedupOperator
-// will keep the last sample in that vector.
+// will keep the last sample in that vector. Float samples can also be resolved
+// by keeping the largest value or by averaging all values. The penalty policy selects
+// samples of one replica of a series across steps, as described by query.DedupPenalty.
+// Series which only differ in replica labels are treated as replicas of the same series.
 type dedupOperator struct {
 	once   sync.Once
 	series []labels.Labels
@@ -37,12 +62,26 @@ type dedupOperator struct {
 	// outputIndex is a slice that is used as an index from input sample ID to output sample ID.
 	outputIndex []uint64
 	dedupCache  dedupCache
+
+	policy        query.DedupPolicy
+	tolerance     float64
+	replicaLabels []string
+	// conflicts marks output series for which a conflict has already been reported.
+	conflicts []bool
+
+	// replicas are the replicas selected for output series by the penalty policy, and
+	// penalizedUntil the time until which input series are penalized after a gap.
+	replicas       []replicaState
+	penalizedUntil []int64
 }
 
-func NewDedupOperator(pool *model.VectorPool, next model.VectorOperator) model.VectorOperator {
+func NewDedupOperator(pool *model.VectorPool, next model.VectorOperator, policy query.DedupPolicy, tolerance float64, replicaLabels []string) model.VectorOperator {
 	return &dedupOperator{
-		next: next,
-		pool: pool,
+		next:          next,
+		pool:          pool,
+		policy:        policy,
+		tolerance:     tolerance,
+		replicaLabels: replicaLabels,
 	}
 }
 
@@ -63,16 +102,20 @@ func (d *dedupOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 
 	result := d.pool.GetVectorBatch()
 	for _, vector := range in {
-		for i, inputSampleID := range vector.SampleIDs {
-			outputSampleID := d.outputIndex[inputSampleID]
-			d.dedupCache[outputSampleID].t = vector.T
-			d.dedupCache[outputSampleID].v = vector.Samples[i]
-		}
-
-		for i, inputSampleID := range vector.HistogramIDs {
-			outputSampleID := d.outputIndex[inputSampleID]
-			d.dedupCache[outputSampleID].t = vector.T
-			d.dedupCache[outputSampleID].h = vector.Histograms[i]
+		if d.policy == query.DedupPenalty {
+			for i, inputSampleID := range vector.SampleIDs {
+				d.addReplicaSample(inputSampleID, vector.T, vector.Samples[i], nil)
+			}
+			for i, inputSampleID := range vector.HistogramIDs {
+				d.addReplicaSample(inputSampleID, vector.T, 0, vector.Histograms[i])
+			}
+		} else {
+			for i, inputSampleID := range vector.SampleIDs {
+				d.addSample(ctx, d.outputIndex[inputSampleID], vector.T, vector.Samples[i])
+			}
+			for i, inputSampleID := range vector.HistogramIDs {
+				d.dedupCache[d.outputIndex[inputSampleID]] = dedupSample{t: vector.T, h: vector.Histograms[i]}
+			}
 		}
 
 		out := d.pool.GetStepVector(vector.T)
@@ -82,6 +125,9 @@ func (d *dedupOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 			// If the timestamp of the sample does not match the input vector timestamp, it means that
 			// the sample was added in a previous iteration and should be skipped.
 			if sample.t == vector.T {
+				if d.policy == query.DedupPenalty {
+					d.selectReplica(uint64(outputSampleID), sample)
+				}
 				if sample.h == nil {
 					out.AppendSample(d.pool, uint64(outputSampleID), sample.v)
 				} else {
@@ -95,6 +141,76 @@ func (d *dedupOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 	return result, nil
 }
 
+// addSample resolves a float sample for the output series with the given sample
+// values already seen in the same step, according to the dedup policy.
+func (d *dedupOperator) addSample(ctx context.Context, outputSampleID uint64, t int64, v float64) {
+	sample := &d.dedupCache[outputSampleID]
+	if sample.t != t || sample.count == 0 {
+		*sample = dedupSample{t: t, v: v, last: v, sum: v, count: 1}
+		return
+	}
+
+	if d.tolerance > 0 && math.Abs(sample.last-v) > d.tolerance {
+		d.reportConflict(ctx, outputSampleID)
+	}
+	sample.last = v
+
+	switch d.policy {
+	case query.DedupPreferLargest:
+		if v > sample.v || math.IsNaN(sample.v) {
+			sample.v = v
+		}
+	case query.DedupAverage:
+		sample.sum += v
+		sample.count++
+		sample.v = sample.sum / float64(sample.count)
+	default:
+		sample.v = v
+	}
+}
+
+// addReplicaSample keeps the sample of the input series if it has a higher priority than the
+// samples of other replicas of the output series in the same step. The selected replica has the
+// highest priority, followed by replicas which are not penalized. Ties are resolved in favor of
+// the later sample, as with the other policies.
+func (d *dedupOperator) addReplicaSample(inputSampleID uint64, t int64, v float64, h *histogram.FloatHistogram) {
+	outputSampleID := d.outputIndex[inputSampleID]
+	var rank int
+	if state := d.replicas[outputSampleID]; state.selected && state.replica == inputSampleID {
+		rank = 2
+	} else if d.penalizedUntil[inputSampleID] < t {
+		rank = 1
+	}
+
+	sample := &d.dedupCache[outputSampleID]
+	if sample.t == t && sample.count > 0 && rank < sample.rank {
+		return
+	}
+	*sample = dedupSample{t: t, v: v, h: h, count: 1, replica: inputSampleID, rank: rank}
+}
+
+// selectReplica records the replica of the sample as the selected replica of the output series.
+// When the previously selected replica has no sample in the step, it is penalized for twice the
+// length of its gap so far.
+func (d *dedupOperator) selectReplica(outputSampleID uint64, sample dedupSample) {
+	state := &d.replicas[outputSampleID]
+	if state.selected && state.replica != sample.replica {
+		d.penalizedUntil[state.replica] = sample.t + 2*(sample.t-state.lastT)
+	}
+	*state = replicaState{selected: true, replica: sample.replica, lastT: sample.t}
+}
+
+func (d *dedupOperator) reportConflict(ctx context.Context, outputSampleID uint64) {
+	if d.conflicts[outputSampleID] {
+		return
+	}
+	d.conflicts[outputSampleID] = true
+	warnings.AddToContext(errors.Newf(
+		"PromQL warning: remote engines returned values which differ by more than %g for series %s",
+		d.tolerance, d.series[outputSampleID],
+	), ctx)
+}
+
 func (d *dedupOperator) Series(ctx context.Context) ([]labels.Labels, error) {
 	var err error
 	d.once.Do(func() { err = d.loadSeries(ctx) })
@@ -121,7 +237,12 @@ func (d *dedupOperator) loadSeries(ctx context.Context) error {
 	outputIndex := make(map[uint64]uint64)
 	inputIndex := make([]uint64, len(series))
 	hashBuf := make([]byte, 0, 128)
+	builder := labels.NewBuilder(labels.EmptyLabels())
 	for inputSeriesID, inputSeries := range series {
+		if len(d.replicaLabels) > 0 {
+			builder.Reset(inputSeries)
+			inputSeries = builder.Del(d.replicaLabels...).Labels()
+		}
 		hash := hashSeries(hashBuf, inputSeries)
 
 		inputIndex[inputSeriesID] = hash
@@ -142,6 +263,14 @@ func (d *dedupOperator) loadSeries(ctx context.Context) error {
 	for i := range d.dedupCache {
 		d.dedupCache[i].t = -1
 	}
+	d.conflicts = make([]bool, len(outputIndex))
+	if d.policy == query.DedupPenalty {
+		d.replicas = make([]replicaState, len(outputIndex))
+		d.penalizedUntil = make([]int64, len(series))
+		for i := range d.penalizedUntil {
+			d.penalizedUntil[i] = math.MinInt64
+		}
+	}
 
 	return nil
 }
@@ -0,0 +1,291 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package exchange
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+)
+
+// FallbackFactory creates an operator which evaluates the expression of a fan-out operator again.
+type FallbackFactory func() (model.VectorOperator, error)
+
+// fanOut evaluates an operator once and feeds its batches to multiple consumers.
+// Batches are buffered until every consumer has read them, so consumers can advance
+// at different speeds. At most maxBuffered batches are buffered: consumers which fall
+// further behind, or which stopped reading, are detached from the fan-out and no longer
+// hold batches. A detached consumer which is read again evaluates the expression itself.
+type fanOut struct {
+	next         model.VectorOperator
+	newFallback  FallbackFactory
+	numConsumers int
+	maxBuffered  int
+
+	mu sync.Mutex
+	// pulled is signaled when a consumer finished pulling a batch from the next operator.
+	pulled  *sync.Cond
+	pulling bool
+	// positions holds the index of the next batch returned by each consumer.
+	positions []int
+	// detached holds the consumers which no longer read buffered batches.
+	detached []bool
+	// offset is the index of the first buffered batch.
+	offset  int
+	batches [][]model.StepVector
+	done    bool
+	err     error
+}
+
+// NewFanOut returns numConsumers operators which all return the series and batches of next.
+// Each consumer returns copies of the step vectors, which it can modify and put back into its own pool.
+// Consumers which fall more than maxBuffered batches behind use an operator created by newFallback instead.
+func NewFanOut(next model.VectorOperator, numConsumers int, stepsBatch int, maxBuffered int, newFallback FallbackFactory) []model.VectorOperator {
+	f := &fanOut{
+		next:         next,
+		newFallback:  newFallback,
+		numConsumers: numConsumers,
+		maxBuffered:  maxBuffered,
+		positions:    make([]int, numConsumers),
+		detached:     make([]bool, numConsumers),
+	}
+	f.pulled = sync.NewCond(&f.mu)
+
+	consumers := make([]model.VectorOperator, numConsumers)
+	for i := range consumers {
+		consumers[i] = &fanOutConsumer{
+			fanOut: f,
+			id:     i,
+			pool:   model.NewVectorPool(stepsBatch),
+		}
+	}
+	return consumers
+}
+
+// read copies the next batch of a consumer into its pool, pulling the batch from the next operator
+// if no consumer did yet. The returned bool is false once the consumer was detached.
+// A nil batch is returned once the next operator is exhausted.
+func (f *fanOut) read(ctx context.Context, c *fanOutConsumer) ([]model.StepVector, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for {
+		if f.detached[c.id] {
+			return nil, false, nil
+		}
+		i := f.positions[c.id]
+		if i < f.offset+len(f.batches) {
+			out := c.copyBatch(f.batches[i-f.offset])
+			f.positions[c.id]++
+			f.release()
+			return out, true, nil
+		}
+		if f.err != nil {
+			return nil, true, f.err
+		}
+		if f.done {
+			return nil, true, nil
+		}
+		if !f.pulling {
+			break
+		}
+		f.pulled.Wait()
+	}
+
+	// Other consumers can read buffered batches while the next batch is pulled.
+	f.pulling = true
+	f.mu.Unlock()
+	vectors, err := f.next.Next(ctx)
+	f.mu.Lock()
+	f.pulling = false
+	f.pulled.Broadcast()
+
+	if err != nil {
+		f.err = err
+		return nil, true, err
+	}
+	if vectors == nil {
+		f.done = true
+		return nil, true, nil
+	}
+	f.batches = append(f.batches, vectors)
+	out := c.copyBatch(vectors)
+	f.positions[c.id]++
+	if len(f.batches) > f.maxBuffered {
+		f.detachSlowest()
+	}
+	f.release()
+	return out, true, nil
+}
+
+// detachSlowest detaches the consumers which did not read the first buffered batch yet.
+func (f *fanOut) detachSlowest() {
+	for id, position := range f.positions {
+		if !f.detached[id] && position == f.offset {
+			f.detached[id] = true
+		}
+	}
+}
+
+// release returns batches which were read by all attached consumers to the pool of the next operator.
+func (f *fanOut) release() {
+	minPosition := f.offset + len(f.batches)
+	for id, position := range f.positions {
+		if !f.detached[id] && position < minPosition {
+			minPosition = position
+		}
+	}
+	for f.offset < minPosition {
+		for _, v := range f.batches[0] {
+			f.next.GetPool().PutStepVector(v)
+		}
+		f.next.GetPool().PutVectors(f.batches[0])
+		f.batches[0] = nil
+		f.batches = f.batches[1:]
+		f.offset++
+	}
+}
+
+type fanOutConsumer struct {
+	fanOut *fanOut
+	id     int
+	pool   *model.VectorPool
+
+	once sync.Once
+
+	// fallback evaluates the expression once the consumer was detached from the fan-out.
+	fallback model.VectorOperator
+	// fallbackIDs maps series IDs of the fallback operator to the series IDs of the fan-out.
+	fallbackIDs []uint64
+}
+
+func (c *fanOutConsumer) Explain() (me string, next []model.VectorOperator) {
+	return fmt.Sprintf("[*fanOut] consumer %d of %d", c.id+1, c.fanOut.numConsumers), []model.VectorOperator{c.fanOut.next}
+}
+
+func (c *fanOutConsumer) Series(ctx context.Context) ([]labels.Labels, error) {
+	series, err := c.fanOut.next.Series(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.once.Do(func() { c.pool.SetStepSize(len(series)) })
+	return series, nil
+}
+
+func (c *fanOutConsumer) SeriesHashes(ctx context.Context, grouping model.Grouping) ([]uint64, error) {
+	return model.SeriesHashes(ctx, c.fanOut.next, grouping)
+}
+
+func (c *fanOutConsumer) GetPool() *model.VectorPool {
+	return c.pool
+}
+
+func (c *fanOutConsumer) Next(ctx context.Context) ([]model.StepVector, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	if _, err := c.Series(ctx); err != nil {
+		return nil, err
+	}
+	if c.fallback == nil {
+		out, attached, err := c.fanOut.read(ctx, c)
+		if attached || err != nil {
+			return out, err
+		}
+		if err := c.initFallback(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	in, err := c.fallback.Next(ctx)
+	if err != nil || in == nil {
+		return nil, err
+	}
+	out := c.pool.GetVectorBatch()
+	for _, v := range in {
+		vector := c.pool.GetStepVector(v.T)
+		for i, sampleID := range v.SampleIDs {
+			vector.AppendSample(c.pool, c.fallbackIDs[sampleID], v.Samples[i])
+		}
+		for i, sampleID := range v.HistogramIDs {
+			vector.AppendHistogram(c.pool, c.fallbackIDs[sampleID], v.Histograms[i])
+		}
+		out = append(out, vector)
+		c.fallback.GetPool().PutStepVector(v)
+	}
+	c.fallback.GetPool().PutVectors(in)
+	return out, nil
+}
+
+// initFallback creates the operator which is used once the consumer was detached, and skips
+// the batches which were already returned from the fan-out. The fallback operator can order
+// its series differently, so its series are mapped to the series of the fan-out by their labels.
+func (c *fanOutConsumer) initFallback(ctx context.Context) error {
+	fallback, err := c.fanOut.newFallback()
+	if err != nil {
+		return err
+	}
+	series, err := c.fanOut.next.Series(ctx)
+	if err != nil {
+		return err
+	}
+	fallbackSeries, err := fallback.Series(ctx)
+	if err != nil {
+		return err
+	}
+
+	var (
+		buf = make([]byte, 0, 1024)
+		ids = make(map[string]uint64, len(series))
+	)
+	for i, s := range series {
+		ids[string(s.Bytes(buf))] = uint64(i)
+	}
+	c.fallbackIDs = make([]uint64, len(fallbackSeries))
+	for i, s := range fallbackSeries {
+		id, ok := ids[string(s.Bytes(buf))]
+		if !ok {
+			return errors.Newf("series %s of the re-evaluated shared expression was not returned by its first evaluation", s.String())
+		}
+		c.fallbackIDs[i] = id
+	}
+
+	c.fanOut.mu.Lock()
+	position := c.fanOut.positions[c.id]
+	c.fanOut.mu.Unlock()
+	for i := 0; i < position; i++ {
+		in, err := fallback.Next(ctx)
+		if err != nil {
+			return err
+		}
+		if in == nil {
+			break
+		}
+		for _, v := range in {
+			fallback.GetPool().PutStepVector(v)
+		}
+		fallback.GetPool().PutVectors(in)
+	}
+	c.fallback = fallback
+	return nil
+}
+
+func (c *fanOutConsumer) copyBatch(in []model.StepVector) []model.StepVector {
+	out := c.pool.GetVectorBatch()
+	for _, v := range in {
+		vector := c.pool.GetStepVector(v.T)
+		vector.AppendSamples(c.pool, v.SampleIDs, v.Samples)
+		vector.AppendHistograms(c.pool, v.HistogramIDs, v.Histograms)
+		out = append(out, vector)
+	}
+	return out
+}
@@ -0,0 +1,130 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package exchange
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+)
+
+// SeriesCounter returns the number of series which are split into shards.
+type SeriesCounter func(ctx context.Context) (int, error)
+
+// ShardFactory creates the operator for a single shard when series are split into numShards shards.
+type ShardFactory func(shard, numShards int) (model.VectorOperator, error)
+
+// rebalance is a model.VectorOperator which decides how many shards to split series into
+// once the number of selected series is known. Small selections are collapsed into a single
+// shard, which avoids the overhead of exchanging batches between shards, while large selections
+// are split into more shards so that samples are processed in parallel.
+type rebalance struct {
+	once sync.Once
+	// err is the error of the initialization, which is returned by every call once it failed.
+	err  error
+	pool *model.VectorPool
+	// mu guards next, which is read by Explain while the operator is being initialized.
+	mu   sync.Mutex
+	next model.VectorOperator
+
+	maxShards      int
+	seriesPerShard int
+	count          SeriesCounter
+	newShard       ShardFactory
+}
+
+// NewRebalance creates an operator which counts series, and then coalesces one shard
+// for every seriesPerShard series, up to maxShards shards.
+func NewRebalance(pool *model.VectorPool, maxShards, seriesPerShard int, count SeriesCounter, newShard ShardFactory) model.VectorOperator {
+	return &rebalance{
+		pool:           pool,
+		maxShards:      maxShards,
+		seriesPerShard: seriesPerShard,
+		count:          count,
+		newShard:       newShard,
+	}
+}
+
+func (r *rebalance) Explain() (me string, next []model.VectorOperator) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Shards are only created once the series are counted.
+	if r.next == nil {
+		return fmt.Sprintf("[*rebalance] max %d shards", r.maxShards), nil
+	}
+	return fmt.Sprintf("[*rebalance] max %d shards", r.maxShards), []model.VectorOperator{r.next}
+}
+
+func (r *rebalance) GetPool() *model.VectorPool {
+	return r.pool
+}
+
+func (r *rebalance) Series(ctx context.Context) ([]labels.Labels, error) {
+	if err := r.init(ctx); err != nil {
+		return nil, err
+	}
+	return r.next.Series(ctx)
+}
+
+func (r *rebalance) SeriesHashes(ctx context.Context, grouping model.Grouping) ([]uint64, error) {
+	if err := r.init(ctx); err != nil {
+		return nil, err
+	}
+	return model.SeriesHashes(ctx, r.next, grouping)
+}
+
+func (r *rebalance) Next(ctx context.Context) ([]model.StepVector, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	if err := r.init(ctx); err != nil {
+		return nil, err
+	}
+	return r.next.Next(ctx)
+}
+
+func (r *rebalance) init(ctx context.Context) error {
+	r.once.Do(func() {
+		numSeries, err := r.count(ctx)
+		if err != nil {
+			r.err = err
+			return
+		}
+
+		numShards := r.numShards(numSeries)
+		operators := make([]model.VectorOperator, 0, numShards)
+		for i := 0; i < numShards; i++ {
+			operator, err := r.newShard(i, numShards)
+			if err != nil {
+				r.err = err
+				return
+			}
+			operators = append(operators, operator)
+		}
+		r.mu.Lock()
+		r.next = NewCoalesce(r.pool, operators...)
+		r.mu.Unlock()
+	})
+	return r.err
+}
+
+// numShards returns the number of shards for the given number of series.
+func (r *rebalance) numShards(numSeries int) int {
+	numShards := (numSeries + r.seriesPerShard - 1) / r.seriesPerShard
+	if numShards < 1 {
+		return 1
+	}
+	if numShards > r.maxShards {
+		return r.maxShards
+	}
+	return numShards
+}
@@ -17,6 +17,7 @@
 package execution
 
 import (
+	"context"
 	"runtime"
 	"sort"
 	"time"
@@ -32,8 +33,7 @@ import (
 
 	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
 
-	"github.com/prometheus/prometheus/model/labels"
-
+	"github.com/thanos-community/promql-engine/api"
 	"github.com/thanos-community/promql-engine/execution/aggregate"
 	"github.com/thanos-community/promql-engine/execution/binary"
 	"github.com/thanos-community/promql-engine/execution/exchange"
@@ -50,51 +50,72 @@ import (
 
 const stepsBatch = 10
 
-// New creates new physical query execution for a given query expression which represents logical plan.
+// maxFanOutBatches is the number of batches a shared expression buffers for its slowest consumer.
+const maxFanOutBatches = 16
+
+// New creates new physical query execution for the root node of a logical plan.
 // TODO(bwplotka): Add definition (could be parameters for each execution operator) we can optimize - it would represent physical plan.
-func New(expr parser.Expr, queryable storage.Queryable, mint, maxt time.Time, step, lookbackDelta, extLookbackDelta time.Duration) (model.VectorOperator, error) {
-	opts := &query.Options{
-		Start:            mint,
-		End:              maxt,
-		Step:             step,
-		LookbackDelta:    lookbackDelta,
-		StepsBatch:       stepsBatch,
-		ExtLookbackDelta: extLookbackDelta,
-	}
-	selectorPool := engstore.NewSelectorPool(queryable)
+func New(expr logicalplan.Node, queryable storage.Queryable, opts *query.Options) (model.VectorOperator, error) {
+	opts.StepsBatch = stepsBatch
+	selectorPool := engstore.NewSelectorPool(queryable, opts)
 	hints := storage.SelectHints{
-		Start: mint.UnixMilli(),
-		End:   maxt.UnixMilli(),
+		Start: opts.Start.UnixMilli(),
+		End:   opts.End.UnixMilli(),
 		// TODO(fpetkovski): Adjust the step for sub-queries once they are supported.
-		Step: step.Milliseconds(),
+		Step: opts.Step.Milliseconds(),
+	}
+	expr, err := newSharedOperators(expr, selectorPool, opts, hints)
+	if err != nil {
+		return nil, err
 	}
 	return newOperator(expr, selectorPool, opts, hints)
 }
 
-func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
+func newOperator(expr logicalplan.Node, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
+	operator, err := newUninstrumentedOperator(expr, storage, opts, hints)
+	if err != nil {
+		return nil, err
+	}
+	return instrumentOperator(operator, expr, opts), nil
+}
+
+func newUninstrumentedOperator(expr logicalplan.Node, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
 	switch e := expr.(type) {
-	case *parser.NumberLiteral:
+	case *logicalplan.NumberLiteral:
 		return scan.NewNumberLiteralSelector(model.NewVectorPool(stepsBatch), opts, e.Val), nil
 
-	case *parser.VectorSelector:
-		start, end := getTimeRangesForVectorSelector(e, opts, 0)
-		hints.Start = start
-		hints.End = end
-		filter := storage.GetSelector(start, end, opts.Step.Milliseconds(), e.LabelMatchers, hints)
-		return newShardedVectorSelector(filter, opts, e.Offset)
+	case *logicalplan.VectorSelector, *logicalplan.FilteredSelector:
+		return newVectorSelector(e, storage, opts, hints, vectorSelectorOpts{})
 
-	case *logicalplan.FilteredSelector:
-		start, end := getTimeRangesForVectorSelector(e.VectorSelector, opts, 0)
-		hints.Start = start
-		hints.End = end
-		selector := storage.GetFilteredSelector(start, end, opts.Step.Milliseconds(), e.LabelMatchers, e.Filters, hints)
-		return newShardedVectorSelector(selector, opts, e.Offset)
-
-	case *parser.Call:
+	case *logicalplan.FunctionCall:
 		hints.Func = e.Func.Name
 		hints.Grouping = nil
 		hints.By = false
 
+		if e.Func.Name == "timestamp" {
+			// Vector selectors need to return the timestamps of the selected samples
+			// instead of step timestamps, so they are evaluated separately.
+			next, ok, err := newTimestampSelector(e.Args[0], storage, opts, hints)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				return function.NewTimestampOperator(e, next, stepsBatch, opts)
+			}
+		}
+
+		if count, ok := ungroupedCount(e); ok {
+			// The count does not need to group series, since scalar() only
+			// depends on the number of samples at each step.
+			hints.Func = count.Op.String()
+			hints.By = true
+			next, err := newOperator(count.Expr, storage, opts, hints)
+			if err != nil {
+				return nil, err
+			}
+			return function.NewCountScalarOperator(e, next, stepsBatch, opts), nil
+		}
+
 		if e.Func.Name == "histogram_quantile" {
 			nextOperators := make([]model.VectorOperator, len(e.Args))
 			for i := range e.Args {
@@ -105,7 +126,7 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 				nextOperators[i] = next
 			}
 
-			return function.NewHistogramOperator(model.NewVectorPool(stepsBatch), e.Args, nextOperators, stepsBatch)
+			return function.NewHistogramOperator(model.NewVectorPool(stepsBatch), e, nextOperators, stepsBatch)
 		}
 
 		// TODO(saswatamcode): Tracked in https://github.com/thanos-community/promql-engine/issues/23
@@ -119,42 +140,11 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 		// before it can be non-nested. https://github.com/thanos-community/promql-engine/issues/39
 		for i := range e.Args {
 			switch t := e.Args[i].(type) {
-			case *parser.MatrixSelector:
+			case *logicalplan.MatrixSelector:
 				if call == nil {
 					return nil, parse.ErrNotImplemented
 				}
-
-				vs, filters, err := unpackVectorSelector(t)
-				if err != nil {
-					return nil, err
-				}
-
-				milliSecondRange := t.Range.Milliseconds()
-				if function.IsExtFunction(hints.Func) {
-					milliSecondRange += opts.ExtLookbackDelta.Milliseconds()
-				}
-
-				start, end := getTimeRangesForVectorSelector(vs, opts, milliSecondRange)
-				hints.Start = start
-				hints.End = end
-				hints.Range = milliSecondRange
-				filter := storage.GetFilteredSelector(start, end, opts.Step.Milliseconds(), vs.LabelMatchers, filters, hints)
-
-				numShards := runtime.GOMAXPROCS(0) / 2
-				if numShards < 1 {
-					numShards = 1
-				}
-
-				operators := make([]model.VectorOperator, 0, numShards)
-				for i := 0; i < numShards; i++ {
-					operator := exchange.NewConcurrent(
-						scan.NewMatrixSelector(model.NewVectorPool(stepsBatch), filter, call, e, opts, t.Range, vs.Offset, i, numShards),
-						2,
-					)
-					operators = append(operators, operator)
-				}
-
-				return exchange.NewCoalesce(model.NewVectorPool(stepsBatch), operators...), nil
+				return newMatrixSelector(e, call, t, storage, opts, hints, nil)
 			}
 		}
 
@@ -162,7 +152,7 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 		nextOperators := make([]model.VectorOperator, 0, len(e.Args))
 		for i := range e.Args {
 			// Strings don't need an operator
-			if e.Args[i].Type() == parser.ValueTypeString {
+			if e.Args[i].ReturnType() == parser.ValueTypeString {
 				continue
 			}
 			next, err := newOperator(e.Args[i], storage, opts, hints)
@@ -174,27 +164,48 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 
 		return function.NewFunctionOperator(e, call, nextOperators, stepsBatch, opts)
 
-	case *parser.AggregateExpr:
+	case *logicalplan.Aggregation:
 		hints.Func = e.Op.String()
 		hints.Grouping = e.Grouping
 		hints.By = !e.Without
 		var paramOp model.VectorOperator
 
-		next, err := newOperator(e.Expr, storage, opts, hints)
-		if err != nil {
-			return nil, err
+		if op, ok, err := newStreamingAggregate(e, storage, opts, hints); ok || err != nil {
+			return op, err
+		}
+
+		var next model.VectorOperator
+		var err error
+		if existenceOnly(e) {
+			next, err = newVectorSelector(e.Expr, storage, opts, hints, vectorSelectorOpts{existenceOnly: true})
+			if err != nil {
+				return nil, err
+			}
+			next = instrumentOperator(next, e.Expr, opts)
+		} else {
+			next, err = newOperator(e.Expr, storage, opts, hints)
+			if err != nil {
+				return nil, err
+			}
 		}
 
-		if e.Param != nil && e.Param.Type() != parser.ValueTypeString {
+		if e.Param != nil && e.Param.ReturnType() != parser.ValueTypeString {
 			paramOp, err = newOperator(e.Param, storage, opts, hints)
 			if err != nil {
 				return nil, err
 			}
 		}
 
-		if e.Op == parser.TOPK || e.Op == parser.BOTTOMK {
+		switch e.Op {
+		case parser.COUNT_VALUES:
+			param, ok := e.Param.(*logicalplan.StringLiteral)
+			if !ok {
+				return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "got %s:", e.String())
+			}
+			next, err = aggregate.NewCountValues(model.NewVectorPool(stepsBatch), next, param.Val, !e.Without, e.Grouping, stepsBatch)
+		case parser.TOPK, parser.BOTTOMK:
 			next, err = aggregate.NewKHashAggregate(model.NewVectorPool(stepsBatch), next, paramOp, e.Op, !e.Without, e.Grouping, stepsBatch)
-		} else {
+		default:
 			next, err = aggregate.NewHashAggregate(model.NewVectorPool(stepsBatch), next, paramOp, e.Op, !e.Without, e.Grouping, stepsBatch)
 		}
 
@@ -204,17 +215,17 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 
 		return exchange.NewConcurrent(next, 2), nil
 
-	case *parser.BinaryExpr:
-		if e.LHS.Type() == parser.ValueTypeScalar || e.RHS.Type() == parser.ValueTypeScalar {
+	case *logicalplan.Binary:
+		if e.LHS.ReturnType() == parser.ValueTypeScalar || e.RHS.ReturnType() == parser.ValueTypeScalar {
 			return newScalarBinaryOperator(e, storage, opts, hints)
 		}
 
 		return newVectorBinaryOperator(e, storage, opts, hints)
 
-	case *parser.ParenExpr:
+	case *logicalplan.Parens:
 		return newOperator(e.Expr, storage, opts, hints)
 
-	case *parser.UnaryExpr:
+	case *logicalplan.Unary:
 		next, err := newOperator(e.Expr, storage, opts, hints)
 		if err != nil {
 			return nil, err
@@ -230,9 +241,9 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 			return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "got: %s", e)
 		}
 
-	case *parser.StepInvariantExpr:
+	case *logicalplan.StepInvariantExpr:
 		switch t := e.Expr.(type) {
-		case *parser.NumberLiteral:
+		case *logicalplan.NumberLiteral:
 			return scan.NewNumberLiteralSelector(model.NewVectorPool(stepsBatch), opts, t.Val), nil
 		}
 		next, err := newOperator(e.Expr, storage, opts.WithEndTime(opts.Start), hints)
@@ -242,7 +253,7 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 		return step_invariant.NewStepInvariantOperator(model.NewVectorPool(stepsBatch), next, e.Expr, opts, stepsBatch)
 
 	case logicalplan.Deduplicate:
-		// The Deduplicate operator will deduplicate samples using a last-sample-wins strategy.
+		// The Deduplicate operator will by default deduplicate samples using a last-sample-wins strategy.
 		// Sorting engines by MaxT ensures that samples produced due to
 		// staleness will be overwritten and corrected by samples coming from
 		// engines with a higher max time.
@@ -259,12 +270,42 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 			operators[i] = operator
 		}
 		coalesce := exchange.NewCoalesce(model.NewVectorPool(stepsBatch), operators...)
-		dedup := exchange.NewDedupOperator(model.NewVectorPool(stepsBatch), coalesce)
+		dedup := exchange.NewDedupOperator(model.NewVectorPool(stepsBatch), coalesce, opts.DedupPolicy, opts.DedupConflictTolerance, opts.DedupReplicaLabels)
 		return exchange.NewConcurrent(dedup, 2), nil
 
+	case *logicalplan.PartialAggregation:
+		count, err := newOperator(e.Count, storage, opts, hints)
+		if err != nil {
+			return nil, err
+		}
+		var components []model.VectorOperator
+		for _, expr := range []logicalplan.Node{e.Sum, e.Mean, e.Variance} {
+			if expr == nil {
+				continue
+			}
+			operator, err := newOperator(expr, storage, opts, hints)
+			if err != nil {
+				return nil, err
+			}
+			components = append(components, operator)
+		}
+		return aggregate.NewPartialAggregate(model.NewVectorPool(stepsBatch), e.Op, !e.Without, e.Grouping, count, components...)
+
 	case logicalplan.RemoteExecution:
-		// Create a new remote query scoped to the calculated start time.
-		qry, err := e.Engine.NewRangeQuery(&promql.QueryOpts{LookbackDelta: opts.LookbackDelta}, e.Query, e.QueryRangeStart, opts.End, opts.Step)
+		if len(opts.Timestamps) > 0 {
+			return nil, errors.Wrap(parse.ErrNotSupportedExpr, "remote execution at explicit evaluation timestamps")
+		}
+		// Create a new remote query scoped to the calculated start time, or to the start
+		// of the slice if the query is split into time slices.
+		start := e.QueryRangeStart
+		if opts.Start.After(start) {
+			start = opts.Start
+		}
+		if start.After(opts.End) {
+			return noop.NewOperator(), nil
+		}
+		newQuery := newRemoteQueryFunc(e, start, opts)
+		qry, err := newQuery()
 		if err != nil {
 			return nil, err
 		}
@@ -274,43 +315,553 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 		// We need to set the lookback for the selector to 0 since the remote query already applies one lookback.
 		selectorOpts := *opts
 		selectorOpts.LookbackDelta = 0
-		remoteExec := remote.NewExecution(qry, model.NewVectorPool(stepsBatch), &selectorOpts)
+		if p, ok := e.Engine.(api.TimeoutProvider); ok && p.Timeout() > 0 {
+			selectorOpts.RemoteTimeout = p.Timeout()
+		}
+		replan := newRemoteReplanFunc(e, start, opts)
+		if streaming, ok := qry.(api.StreamingQuery); ok {
+			// Streamed results are consumed in batches of steps instead of being buffered in full.
+			return exchange.NewConcurrent(remote.NewStreamingExecution(streaming, newQuery, model.NewVectorPool(stepsBatch), &selectorOpts, replan), 2), nil
+		}
+		remoteExec := remote.NewExecution(qry, newQuery, model.NewVectorPool(stepsBatch), &selectorOpts, replan)
 		return exchange.NewConcurrent(remoteExec, 2), nil
+	case *logicalplan.TimeSplit:
+		// Slices are step-aligned with the query, which is not the case for explicit evaluation timestamps.
+		if len(opts.Timestamps) > 0 {
+			return newOperator(e.Expr, storage, opts, hints)
+		}
+		operators := make([]model.VectorOperator, len(e.Slices))
+		for i, slice := range e.Slices {
+			sliceOpts := opts.WithTimeRange(slice.Start, slice.End)
+			sliceHints := hints
+			sliceHints.Start = slice.Start.UnixMilli()
+			sliceHints.End = slice.End.UnixMilli()
+
+			// Each slice selects series for its own time range.
+			sliceStorage := storage.Isolated()
+			expr, err := newSharedOperators(e.Expr, sliceStorage, sliceOpts, sliceHints)
+			if err != nil {
+				return nil, err
+			}
+			operator, err := newOperator(expr, sliceStorage, sliceOpts, sliceHints)
+			if err != nil {
+				return nil, err
+			}
+			operators[i] = operator
+		}
+		return exchange.NewConcatenate(model.NewVectorPool(stepsBatch), 2, operators...), nil
+	case *logicalplan.Shard:
+		// Selections are shared between shards, but each shard creates its own operators.
+		return newOperator(e.Expr, storage.Sharded(e.Index, e.Total), opts, hints)
+	case *logicalplan.Coalesce:
+		operators := make([]model.VectorOperator, len(e.Exprs))
+		for i, expr := range e.Exprs {
+			operator, err := newOperator(expr, storage, opts, hints)
+			if err != nil {
+				return nil, err
+			}
+			operators[i] = operator
+		}
+		return exchange.NewCoalesce(model.NewVectorPool(stepsBatch), operators...), nil
 	case logicalplan.Noop:
 		return noop.NewOperator(), nil
+	case *sharedOperator:
+		return e.operator, nil
 	default:
 		return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "got: %s", e)
 	}
 }
 
-func unpackVectorSelector(t *parser.MatrixSelector) (*parser.VectorSelector, []*labels.Matcher, error) {
+// sharedOperator is an occurrence of a shared expression in the plan, which is replaced with one
+// of the consumers of the fan-out operator for the expression.
+type sharedOperator struct {
+	*logicalplan.SharedExpr
+	operator model.VectorOperator
+}
+
+// newSharedOperators creates a single operator for each shared expression in the plan and
+// replaces the occurrences of the expression with consumers of the operator. The expression
+// is copied along the paths to shared expressions, so the plan itself is not modified.
+// Shared expressions are created with the hints of the query since they have multiple parents.
+func newSharedOperators(expr logicalplan.Node, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (logicalplan.Node, error) {
+	occurrences := make(map[*logicalplan.SharedExpr]int)
+	countSharedExprs(expr, occurrences)
+	if len(occurrences) == 0 {
+		return expr, nil
+	}
+
+	consumers := make(map[*logicalplan.SharedExpr][]model.VectorOperator, len(occurrences))
+	var replace func(logicalplan.Node) (logicalplan.Node, error)
+	replace = func(expr logicalplan.Node) (logicalplan.Node, error) {
+		return mapSharedExprs(expr, func(e *logicalplan.SharedExpr) (logicalplan.Node, error) {
+			if _, ok := consumers[e]; !ok {
+				inner, err := replace(e.Expr)
+				if err != nil {
+					return nil, err
+				}
+				operator, err := newOperator(inner, storage, opts, hints)
+				if err != nil {
+					return nil, err
+				}
+				// Consumers which fall too far behind evaluate the expression again without sharing it.
+				newFallback := func() (model.VectorOperator, error) {
+					return newOperator(unshare(e.Expr), storage, opts, hints)
+				}
+				consumers[e] = exchange.NewFanOut(operator, occurrences[e], stepsBatch, maxFanOutBatches, newFallback)
+			}
+			operator := consumers[e][0]
+			consumers[e] = consumers[e][1:]
+			return &sharedOperator{SharedExpr: e, operator: operator}, nil
+		})
+	}
+	return replace(expr)
+}
+
+// unshare replaces the shared expressions in the plan with the expressions they share.
+func unshare(expr logicalplan.Node) logicalplan.Node {
+	expr, _ = mapSharedExprs(expr, func(e *logicalplan.SharedExpr) (logicalplan.Node, error) {
+		return unshare(e.Expr), nil
+	})
+	return expr
+}
+
+// mapSharedExprs replaces the shared expressions in the plan with the result of fn. The expression
+// is copied along the paths to shared expressions, so the plan itself is not modified.
+func mapSharedExprs(expr logicalplan.Node, fn func(*logicalplan.SharedExpr) (logicalplan.Node, error)) (logicalplan.Node, error) {
+	switch e := expr.(type) {
+	case *logicalplan.SharedExpr:
+		return fn(e)
+	case *logicalplan.Aggregation:
+		c := *e
+		var err error
+		if c.Expr, err = mapSharedExprs(e.Expr, fn); err != nil {
+			return nil, err
+		}
+		if e.Param != nil {
+			if c.Param, err = mapSharedExprs(e.Param, fn); err != nil {
+				return nil, err
+			}
+		}
+		return &c, nil
+	case *logicalplan.FunctionCall:
+		c := *e
+		c.Args = make([]logicalplan.Node, len(e.Args))
+		for i := range e.Args {
+			arg, err := mapSharedExprs(e.Args[i], fn)
+			if err != nil {
+				return nil, err
+			}
+			c.Args[i] = arg
+		}
+		return &c, nil
+	case *logicalplan.Binary:
+		c := *e
+		var err error
+		if c.LHS, err = mapSharedExprs(e.LHS, fn); err != nil {
+			return nil, err
+		}
+		if c.RHS, err = mapSharedExprs(e.RHS, fn); err != nil {
+			return nil, err
+		}
+		return &c, nil
+	case *logicalplan.Parens:
+		inner, err := mapSharedExprs(e.Expr, fn)
+		if err != nil {
+			return nil, err
+		}
+		return &logicalplan.Parens{Expr: inner}, nil
+	case *logicalplan.Unary:
+		inner, err := mapSharedExprs(e.Expr, fn)
+		if err != nil {
+			return nil, err
+		}
+		return &logicalplan.Unary{Op: e.Op, Expr: inner}, nil
+	default:
+		return expr, nil
+	}
+}
+
+// countSharedExprs counts the occurrences of each shared expression. Shared expressions nested
+// in another shared expression are only counted once, since the outer expression is evaluated once.
+func countSharedExprs(expr logicalplan.Node, occurrences map[*logicalplan.SharedExpr]int) {
+	switch e := expr.(type) {
+	case *logicalplan.SharedExpr:
+		occurrences[e]++
+		if occurrences[e] == 1 {
+			countSharedExprs(e.Expr, occurrences)
+		}
+	case *logicalplan.Aggregation:
+		countSharedExprs(e.Expr, occurrences)
+		if e.Param != nil {
+			countSharedExprs(e.Param, occurrences)
+		}
+	case *logicalplan.FunctionCall:
+		for _, arg := range e.Args {
+			countSharedExprs(arg, occurrences)
+		}
+	case *logicalplan.Binary:
+		countSharedExprs(e.LHS, occurrences)
+		countSharedExprs(e.RHS, occurrences)
+	case *logicalplan.Parens:
+		countSharedExprs(e.Expr, occurrences)
+	case *logicalplan.Unary:
+		countSharedExprs(e.Expr, occurrences)
+	}
+}
+
+// newScalarArgOperators creates operators for the scalar arguments of a function call over a range vector.
+func newScalarArgOperators(e *logicalplan.FunctionCall, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) ([]model.VectorOperator, error) {
+	var operators []model.VectorOperator
+	for _, arg := range e.Args {
+		if arg.ReturnType() != parser.ValueTypeScalar {
+			continue
+		}
+		operator, err := newOperator(arg, storage, opts, hints)
+		if err != nil {
+			return nil, err
+		}
+		operators = append(operators, operator)
+	}
+	return operators, nil
+}
+
+// newRemoteQueryFunc returns a function which creates the query of a remote execution starting at start.
+func newRemoteQueryFunc(e logicalplan.RemoteExecution, start time.Time, opts *query.Options) remote.QueryFunc {
+	return func() (promql.Query, error) {
+		return e.Engine.NewRangeQuery(&promql.QueryOpts{LookbackDelta: opts.LookbackDelta}, e.Query, start, opts.End, opts.Step)
+	}
+}
+
+// newRemoteReplanFunc returns a function which re-plans a remote execution when the remote
+// engine reports a min time later than the one it advertised when the query was planned.
+// The re-planned query starts at the first step covered by the data in the remote engine, so that
+// results for earlier steps are taken from other engines instead of from truncated ranges.
+func newRemoteReplanFunc(e logicalplan.RemoteExecution, queryStart time.Time, opts *query.Options) remote.ReplanFunc {
+	return func(executed promql.Query) (remote.QueryFunc, error) {
+		reporter, ok := executed.(api.DataRangeReporter)
+		if !ok {
+			return nil, nil
+		}
+		mint, _ := reporter.DataRange()
+		if mint <= queryStart.UnixMilli() || mint > opts.End.UnixMilli() {
+			return nil, nil
+		}
+
+		start := logicalplan.StepAlignedStart(mint, &logicalplan.Opts{Start: opts.Start, End: opts.End, Step: opts.Step})
+		if !start.After(queryStart) {
+			return nil, nil
+		}
+		return newRemoteQueryFunc(e, start, opts), nil
+	}
+}
+
+// newMatrixSelector creates the operator for a function call whose argument is the matrix selector t.
+// If wrapShard is not nil, it is applied to the operator of each shard of the selector.
+func newMatrixSelector(e *logicalplan.FunctionCall, call function.FunctionCall, t *logicalplan.MatrixSelector, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints, wrapShard func(model.VectorOperator) (model.VectorOperator, error)) (model.VectorOperator, error) {
+	vs, err := unpackVectorSelector(t)
+	if err != nil {
+		return nil, err
+	}
+
+	milliSecondRange := t.Range.Milliseconds()
+	if function.IsExtFunction(hints.Func) {
+		milliSecondRange += opts.ExtLookbackDelta.Milliseconds()
+	}
+
+	start, end := getTimeRangesForVectorSelector(vs.VectorSelector, opts, milliSecondRange)
+	hints.Start = start
+	hints.End = end
+	hints.Range = milliSecondRange
+	hints = projectionHints(hints, vs.Projection)
+	filter := getFilteredSelector(storage, start, end, opts, vs, hints)
+
+	defaultShards := runtime.GOMAXPROCS(0) / 2
+	if defaultShards < 1 {
+		defaultShards = 1
+	}
+	maxShards := runtime.GOMAXPROCS(0)
+
+	// Shards are created once the query is executed, but operators for scalar arguments
+	// select series from the selector pool, which can only be done while the query is planned.
+	// Each shard consumes its own operators for the scalar arguments of the function.
+	scalarArgs := make([][]model.VectorOperator, maxShards)
+	for i := range scalarArgs {
+		scalarArgs[i], err = newScalarArgOperators(e, storage, opts, hints)
+		if err != nil {
+			return nil, err
+		}
+	}
+	countSeries := func(ctx context.Context) (int, error) {
+		return estimateSeries(ctx, filter, defaultShards)
+	}
+	newShard := func(shard, numShards int) (model.VectorOperator, error) {
+		var operator model.VectorOperator = exchange.NewConcurrent(
+			trackState(scan.NewMatrixSelector(model.NewVectorPool(stepsBatch), filter, call, e, scalarArgs[shard], opts, t.Range, vs.Offset, shard, numShards), opts),
+			2,
+		)
+		if wrapShard != nil {
+			return wrapShard(operator)
+		}
+		return operator, nil
+	}
+	return exchange.NewRebalance(model.NewVectorPool(stepsBatch), maxShards, seriesPerShard, countSeries, newShard), nil
+}
+
+// vectorSelectorOpts configures the operator created for a vector selector.
+type vectorSelectorOpts struct {
+	// selectTimestamp makes the selector return the timestamps of samples instead of their values.
+	selectTimestamp bool
+	// existenceOnly hints to storage that only the presence of samples is needed, and not their values.
+	existenceOnly bool
+	// valueFilters are the comparisons which samples have to pass in order to be selected.
+	valueFilters []logicalplan.ValueFilter
+	// wrapShard is applied to the operator of each shard of the selector, if it is set.
+	wrapShard func(model.VectorOperator) (model.VectorOperator, error)
+}
+
+// newVectorSelector creates the operator for a vector selector.
+func newVectorSelector(expr logicalplan.Node, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints, vsOpts vectorSelectorOpts) (model.VectorOperator, error) {
+	var selectorOpts []engstore.SelectorOption
+	if vsOpts.existenceOnly {
+		selectorOpts = append(selectorOpts, engstore.WithExistenceOnly())
+	}
+
+	switch e := expr.(type) {
+	case *logicalplan.VectorSelector:
+		start, end := getTimeRangesForVectorSelector(e, opts, 0)
+		hints.Start = start
+		hints.End = end
+		filter := storage.GetSelector(start, end, opts.Step.Milliseconds(), e.LabelMatchers, hints, selectorOpts...)
+		return newShardedVectorSelector(filter, opts, e.Offset, vsOpts)
+	case *logicalplan.FilteredSelector:
+		start, end := getTimeRangesForVectorSelector(e.VectorSelector, opts, 0)
+		hints.Start = start
+		hints.End = end
+		hints = projectionHints(hints, e.Projection)
+		selector := getFilteredSelector(storage, start, end, opts, e, hints, selectorOpts...)
+		vsOpts.valueFilters = e.ValueFilters
+		return newShardedVectorSelector(selector, opts, e.Offset, vsOpts)
+	default:
+		return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "got: %s", e)
+	}
+}
+
+// newTimestampSelector creates a selector which returns sample timestamps if expr is a
+// vector selector, optionally enclosed in parentheses or a step invariant expression.
+// The returned bool is false when expr is not a vector selector.
+func newTimestampSelector(expr logicalplan.Node, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, bool, error) {
+	switch e := expr.(type) {
+	case *logicalplan.Parens:
+		return newTimestampSelector(e.Expr, storage, opts, hints)
+	case *logicalplan.VectorSelector, *logicalplan.FilteredSelector:
+		next, err := newVectorSelector(e, storage, opts, hints, vectorSelectorOpts{selectTimestamp: true})
+		return next, true, err
+	case *logicalplan.StepInvariantExpr:
+		next, ok, err := newTimestampSelector(e.Expr, storage, opts.WithEndTime(opts.Start), hints)
+		if !ok || err != nil {
+			return nil, ok, err
+		}
+		next, err = step_invariant.NewStepInvariantOperator(model.NewVectorPool(stepsBatch), next, e.Expr, opts, stepsBatch)
+		return next, true, err
+	default:
+		return nil, false, nil
+	}
+}
+
+// unpackVectorSelector returns the selector of a matrix selector as a filtered selector.
+func unpackVectorSelector(t *logicalplan.MatrixSelector) (*logicalplan.FilteredSelector, error) {
 	switch t := t.VectorSelector.(type) {
-	case *parser.VectorSelector:
-		return t, nil, nil
+	case *logicalplan.VectorSelector:
+		return &logicalplan.FilteredSelector{VectorSelector: t}, nil
 	case *logicalplan.FilteredSelector:
-		return t.VectorSelector, t.Filters, nil
+		// Comparisons are only pushed down to vector selectors.
+		if len(t.ValueFilters) > 0 {
+			return nil, parse.ErrNotSupportedExpr
+		}
+		return t, nil
 	default:
-		return nil, nil, parse.ErrNotSupportedExpr
+		return nil, parse.ErrNotSupportedExpr
 	}
 }
 
-func newShardedVectorSelector(selector engstore.SeriesSelector, opts *query.Options, offset time.Duration) (model.VectorOperator, error) {
-	numShards := runtime.GOMAXPROCS(0) / 2
-	if numShards < 1 {
-		numShards = 1
+// getFilteredSelector returns the series selector for a filtered selector. Selectors which
+// cannot select any series do not query storage.
+func getFilteredSelector(storage *engstore.SelectorPool, start, end int64, opts *query.Options, e *logicalplan.FilteredSelector, hints storage.SelectHints, selectorOpts ...engstore.SelectorOption) engstore.SeriesSelector {
+	if e.Empty {
+		return engstore.NewEmptySelector(e.LabelMatchers)
 	}
-	operators := make([]model.VectorOperator, 0, numShards)
-	for i := 0; i < numShards; i++ {
-		operator := exchange.NewConcurrent(
-			scan.NewVectorSelector(
-				model.NewVectorPool(stepsBatch), selector, opts, offset, i, numShards), 2)
-		operators = append(operators, operator)
+	if e.SkipHistogramBuckets {
+		selectorOpts = append(selectorOpts, engstore.WithHistogramStats())
+	}
+	return storage.GetFilteredSelector(start, end, opts.Step.Milliseconds(), e.LabelMatchers, e.Filters, e.Projection, hints, selectorOpts...)
+}
+
+// projectionHints passes the labels retained by a projection to storage as grouping hints.
+func projectionHints(hints storage.SelectHints, projection *logicalplan.Projection) storage.SelectHints {
+	if projection == nil {
+		return hints
+	}
+	hints.Grouping = projection.Labels
+	hints.By = projection.Include
+	return hints
+}
+
+// seriesPerShard is the number of series for which selectors create one shard.
+const seriesPerShard = 1000
+
+// estimateSeries returns the number of series which storage estimates the selector to return, so that
+// one shard is created for every seriesPerShard series. It returns enough series for defaultShards shards
+// when storage cannot estimate the series of the selector.
+func estimateSeries(ctx context.Context, selector engstore.SeriesSelector, defaultShards int) (int, error) {
+	estimate, ok, err := selector.EstimateSeries(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return defaultShards * seriesPerShard, nil
+	}
+	return int(estimate.Series), nil
+}
+
+// newShardedVectorSelector creates a vector selector whose series are split into shards once they
+// are selected, with one shard for every seriesPerShard series and at most one shard per CPU.
+func newShardedVectorSelector(selector engstore.SeriesSelector, opts *query.Options, offset time.Duration, vsOpts vectorSelectorOpts) (model.VectorOperator, error) {
+	// Series are selected once to be counted, and the selected series are split into shards.
+	selector = engstore.NewLoadedSelector(selector)
+	countSeries := func(ctx context.Context) (int, error) {
+		series, err := selector.GetSeries(ctx, 0, 1)
+		if err != nil {
+			return 0, err
+		}
+		return len(series), nil
+	}
+	newShard := func(shard, numShards int) (model.VectorOperator, error) {
+		var op model.VectorOperator = exchange.NewConcurrent(
+			trackState(scan.NewVectorSelector(
+				model.NewVectorPool(stepsBatch), selector, opts, offset, vsOpts.selectTimestamp, vsOpts.valueFilters, shard, numShards), opts), 2)
+		if vsOpts.wrapShard != nil {
+			return vsOpts.wrapShard(op)
+		}
+		return op, nil
+	}
+	return exchange.NewRebalance(model.NewVectorPool(stepsBatch), runtime.GOMAXPROCS(0), seriesPerShard, countSeries, newShard), nil
+}
+
+// streamingAggregations maps aggregations which can be computed from partial aggregates of
+// disjoint sets of series to the aggregation which combines the partial aggregates.
+var streamingAggregations = map[parser.ItemType]parser.ItemType{
+	parser.SUM:   parser.SUM,
+	parser.MIN:   parser.MIN,
+	parser.MAX:   parser.MAX,
+	parser.COUNT: parser.SUM,
+	parser.GROUP: parser.GROUP,
+}
+
+// newStreamingAggregate creates an aggregation over a vector selector, or over a function of a matrix
+// selector, in which each shard of the selector is aggregated concurrently as its batches arrive, so
+// that only partial aggregates of the shards are merged instead of all selected series.
+// It returns false if the aggregation cannot be split into partial aggregates.
+func newStreamingAggregate(e *logicalplan.Aggregation, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, bool, error) {
+	combine, ok := streamingAggregations[e.Op]
+	if !ok || e.Param != nil {
+		return nil, false, nil
+	}
+
+	var newShardedOperator func(wrapShard func(model.VectorOperator) (model.VectorOperator, error)) (model.VectorOperator, error)
+	switch expr := e.Expr.(type) {
+	case *logicalplan.VectorSelector, *logicalplan.FilteredSelector:
+		if !opts.EnableStreamingAggregation && !opts.EnableParallelAggregation {
+			return nil, false, nil
+		}
+		newShardedOperator = func(wrapShard func(model.VectorOperator) (model.VectorOperator, error)) (model.VectorOperator, error) {
+			return newVectorSelector(expr, storage, opts, hints, vectorSelectorOpts{existenceOnly: existenceOnly(e), wrapShard: wrapShard})
+		}
+	case *logicalplan.FunctionCall:
+		if !opts.EnableParallelAggregation {
+			return nil, false, nil
+		}
+		matrix, ok := matrixArg(expr)
+		if !ok {
+			return nil, false, nil
+		}
+		// Unsupported functions are reported when the call is created without partial aggregates.
+		call, err := function.NewFunctionCall(expr.Func)
+		if err != nil || call == nil {
+			return nil, false, nil
+		}
+		hints.Func = expr.Func.Name
+		hints.Grouping = nil
+		hints.By = false
+		newShardedOperator = func(wrapShard func(model.VectorOperator) (model.VectorOperator, error)) (model.VectorOperator, error) {
+			return newMatrixSelector(expr, call, matrix, storage, opts, hints, wrapShard)
+		}
+	default:
+		return nil, false, nil
+	}
+
+	wrapShard := func(shard model.VectorOperator) (model.VectorOperator, error) {
+		return aggregate.NewHashAggregate(model.NewVectorPool(stepsBatch), shard, nil, e.Op, !e.Without, e.Grouping, stepsBatch)
+	}
+	next, err := newShardedOperator(wrapShard)
+	if err != nil {
+		return nil, true, err
+	}
+	// Partial aggregates are labeled with the output labels of their group,
+	// so they are combined with the same grouping.
+	next, err = aggregate.NewHashAggregate(model.NewVectorPool(stepsBatch), next, nil, combine, !e.Without, e.Grouping, stepsBatch)
+	if err != nil {
+		return nil, true, err
+	}
+	return exchange.NewConcurrent(next, 2), true, nil
+}
+
+// existenceOnly returns true if the aggregation only depends on the presence of the samples of its
+// argument, which is a vector selector, and not on their values.
+func existenceOnly(e *logicalplan.Aggregation) bool {
+	if e.Op != parser.COUNT && e.Op != parser.GROUP {
+		return false
+	}
+	switch s := e.Expr.(type) {
+	case *logicalplan.VectorSelector:
+		return true
+	case *logicalplan.FilteredSelector:
+		return len(s.ValueFilters) == 0
+	default:
+		return false
+	}
+}
+
+// matrixArg returns the matrix selector argument of a function call.
+func matrixArg(e *logicalplan.FunctionCall) (*logicalplan.MatrixSelector, bool) {
+	for _, arg := range e.Args {
+		if m, ok := arg.(*logicalplan.MatrixSelector); ok {
+			return m, true
+		}
 	}
+	return nil, false
+}
 
-	return exchange.NewCoalesce(model.NewVectorPool(stepsBatch), operators...), nil
+// ungroupedCount returns the argument of a scalar() call if it is a count aggregation without grouping.
+func ungroupedCount(e *logicalplan.FunctionCall) (*logicalplan.Aggregation, bool) {
+	if e.Func.Name != "scalar" || len(e.Args) != 1 {
+		return nil, false
+	}
+	arg := e.Args[0]
+	for {
+		p, ok := arg.(*logicalplan.Parens)
+		if !ok {
+			break
+		}
+		arg = p.Expr
+	}
+	count, ok := arg.(*logicalplan.Aggregation)
+	if !ok || count.Op != parser.COUNT || count.Without || len(count.Grouping) > 0 {
+		return nil, false
+	}
+	return count, true
 }
 
-func newVectorBinaryOperator(e *parser.BinaryExpr, selectorPool *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
+func newVectorBinaryOperator(e *logicalplan.Binary, selectorPool *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
 	leftOperator, err := newOperator(e.LHS, selectorPool, opts, hints)
 	if err != nil {
 		return nil, err
@@ -319,10 +870,46 @@ func newVectorBinaryOperator(e *parser.BinaryExpr, selectorPool *engstore.Select
 	if err != nil {
 		return nil, err
 	}
-	return binary.NewVectorOperator(model.NewVectorPool(stepsBatch), leftOperator, rightOperator, e.VectorMatching, e.Op, e.ReturnBool)
+	if e.Op.IsSetOperator() {
+		return binary.NewSetOperator(model.NewVectorPool(stepsBatch), leftOperator, rightOperator, e.VectorMatching, e.Op)
+	}
+	estimateSides := func(ctx context.Context) (int64, int64, bool, error) {
+		lhs, ok, err := estimateExprSeries(ctx, e.LHS, selectorPool, opts)
+		if err != nil || !ok {
+			return 0, 0, false, err
+		}
+		rhs, ok, err := estimateExprSeries(ctx, e.RHS, selectorPool, opts)
+		if err != nil || !ok {
+			return 0, 0, false, err
+		}
+		return lhs, rhs, true, nil
+	}
+	return binary.NewVectorOperator(model.NewVectorPool(stepsBatch), leftOperator, rightOperator, e.VectorMatching, e.Op, e.ReturnBool, opts.JoinMemoryLimit, opts.SpillDirectory, estimateSides)
+}
+
+// estimateExprSeries returns the number of series which storage estimates the selectors of the expression
+// to select. The returned bool is false if storage cannot estimate the series of one of the selectors.
+func estimateExprSeries(ctx context.Context, expr logicalplan.Node, selectorPool *engstore.SelectorPool, opts *query.Options) (int64, bool, error) {
+	var series int64
+	ranges := logicalplan.SelectorRanges(expr, &logicalplan.Opts{
+		Start:            opts.Start,
+		End:              opts.End,
+		Step:             opts.Step,
+		LookbackDelta:    opts.LookbackDelta,
+		ExtLookbackDelta: opts.ExtLookbackDelta,
+	})
+	for _, r := range ranges {
+		hints := storage.SelectHints{Start: r.MinT, End: r.MaxT, Range: r.Range.Milliseconds()}
+		estimate, ok, err := selectorPool.EstimateSeries(ctx, hints, r.Selector.LabelMatchers)
+		if err != nil || !ok {
+			return 0, false, err
+		}
+		series += estimate.Series
+	}
+	return series, true, nil
 }
 
-func newScalarBinaryOperator(e *parser.BinaryExpr, selectorPool *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
+func newScalarBinaryOperator(e *logicalplan.Binary, selectorPool *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
 	lhs, err := newOperator(e.LHS, selectorPool, opts, hints)
 	if err != nil {
 		return nil, err
@@ -333,9 +920,9 @@ func newScalarBinaryOperator(e *parser.BinaryExpr, selectorPool *engstore.Select
 	}
 
 	scalarSide := binary.ScalarSideRight
-	if e.LHS.Type() == parser.ValueTypeScalar && e.RHS.Type() == parser.ValueTypeScalar {
+	if e.LHS.ReturnType() == parser.ValueTypeScalar && e.RHS.ReturnType() == parser.ValueTypeScalar {
 		scalarSide = binary.ScalarSideBoth
-	} else if e.LHS.Type() == parser.ValueTypeScalar {
+	} else if e.LHS.ReturnType() == parser.ValueTypeScalar {
 		rhs, lhs = lhs, rhs
 		scalarSide = binary.ScalarSideLeft
 	}
@@ -344,7 +931,7 @@ func newScalarBinaryOperator(e *parser.BinaryExpr, selectorPool *engstore.Select
 }
 
 // Copy from https://github.com/prometheus/prometheus/blob/v2.39.1/promql/engine.go#L791.
-func getTimeRangesForVectorSelector(n *parser.VectorSelector, opts *query.Options, evalRange int64) (int64, int64) {
+func getTimeRangesForVectorSelector(n *logicalplan.VectorSelector, opts *query.Options, evalRange int64) (int64, int64) {
 	start := opts.Start.UnixMilli()
 	end := opts.End.UnixMilli()
 	if n.Timestamp != nil {
@@ -0,0 +1,159 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package function
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/logicalplan"
+	"github.com/thanos-community/promql-engine/query"
+)
+
+// clampOperator implements clamp, clamp_min and clamp_max over whole step vectors.
+// The bounds can be arbitrary scalar expressions, which are evaluated at each step.
+// Steps at which the lower bound is greater than the upper bound have an empty result.
+// Histogram samples are dropped since they cannot be clamped.
+type clampOperator struct {
+	funcExpr *logicalplan.FunctionCall
+	next     model.VectorOperator
+	// minOp and maxOp are nil for clamp_max and clamp_min respectively.
+	minOp model.VectorOperator
+	maxOp model.VectorOperator
+
+	once   sync.Once
+	series []labels.Labels
+
+	// delayNameRemoval marks series for removing the metric name once the query is evaluated.
+	delayNameRemoval bool
+}
+
+func newClampOperator(funcExpr *logicalplan.FunctionCall, nextOps []model.VectorOperator, opts *query.Options) *clampOperator {
+	o := &clampOperator{funcExpr: funcExpr, next: nextOps[0], delayNameRemoval: opts.EnableDelayedNameRemoval}
+	switch funcExpr.Func.Name {
+	case "clamp":
+		o.minOp, o.maxOp = nextOps[1], nextOps[2]
+	case "clamp_min":
+		o.minOp = nextOps[1]
+	case "clamp_max":
+		o.maxOp = nextOps[1]
+	}
+	return o
+}
+
+func (o *clampOperator) Explain() (me string, next []model.VectorOperator) {
+	next = []model.VectorOperator{o.next}
+	if o.minOp != nil {
+		next = append(next, o.minOp)
+	}
+	if o.maxOp != nil {
+		next = append(next, o.maxOp)
+	}
+	return fmt.Sprintf("[*clampOperator] %v", o.funcExpr), next
+}
+
+func (o *clampOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	if err := o.loadSeries(ctx); err != nil {
+		return nil, err
+	}
+	return o.series, nil
+}
+
+func (o *clampOperator) GetPool() *model.VectorPool {
+	return o.next.GetPool()
+}
+
+func (o *clampOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	if err := o.loadSeries(ctx); err != nil {
+		return nil, err
+	}
+
+	vectors, err := o.next.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(vectors) == 0 {
+		return nil, nil
+	}
+
+	mins, err := scalarValues(ctx, o.minOp, len(vectors), math.Inf(-1))
+	if err != nil {
+		return nil, err
+	}
+	maxs, err := scalarValues(ctx, o.maxOp, len(vectors), math.Inf(+1))
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range vectors {
+		vectors[i].HistogramIDs = vectors[i].HistogramIDs[:0]
+		vectors[i].Histograms = vectors[i].Histograms[:0]
+
+		min, max := mins[i], maxs[i]
+		if max < min {
+			vectors[i].SampleIDs = vectors[i].SampleIDs[:0]
+			vectors[i].Samples = vectors[i].Samples[:0]
+			continue
+		}
+		for j, v := range vectors[i].Samples {
+			vectors[i].Samples[j] = math.Max(min, math.Min(max, v))
+		}
+	}
+	return vectors, nil
+}
+
+func (o *clampOperator) loadSeries(ctx context.Context) error {
+	var err error
+	o.once.Do(func() {
+		var series []labels.Labels
+		series, err = o.next.Series(ctx)
+		if err != nil {
+			return
+		}
+		o.series = make([]labels.Labels, len(series))
+		for i, s := range series {
+			o.series[i] = removeMetricName(s, o.delayNameRemoval)
+		}
+	})
+	return err
+}
+
+// scalarValues returns the values of a scalar operator for the next numSteps steps.
+// Steps are set to def when the operator is nil, and to NaN when it has no value.
+func scalarValues(ctx context.Context, op model.VectorOperator, numSteps int, def float64) ([]float64, error) {
+	values := make([]float64, numSteps)
+	if op == nil {
+		for i := range values {
+			values[i] = def
+		}
+		return values, nil
+	}
+
+	vectors, err := op.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range values {
+		values[i] = math.NaN()
+		if i < len(vectors) && len(vectors[i].Samples) > 0 {
+			values[i] = vectors[i].Samples[0]
+		}
+	}
+	for _, v := range vectors {
+		op.GetPool().PutStepVector(v)
+	}
+	op.GetPool().PutVectors(vectors)
+	return values, nil
+}
@@ -6,6 +6,7 @@ package function
 import (
 	"fmt"
 	"math"
+	"sort"
 	"time"
 
 	"github.com/efficientgo/core/errors"
@@ -58,7 +59,8 @@ func filterFloatOnlySamples(samples []promql.Sample) []promql.Sample {
 	return samples
 }
 
-// The engine handles sort and sort_desc when presenting the results. They are not needed here.
+// The engine handles sort, sort_desc, sort_by_label and sort_by_label_desc when presenting the results.
+// They are not needed here.
 var Funcs = map[string]FunctionCall{
 	"abs":   simpleFunc(math.Abs),
 	"ceil":  simpleFunc(math.Ceil),
@@ -179,6 +181,16 @@ var Funcs = map[string]FunctionCall{
 			F:      stdvarOverTime(f.Samples),
 		}
 	},
+	"mad_over_time": func(f FunctionArgs) promql.Sample {
+		if len(f.Samples) == 0 {
+			return InvalidSample
+		}
+		return promql.Sample{
+			Metric: f.Labels,
+			T:      f.StepTime,
+			F:      madOverTime(f.Samples),
+		}
+	},
 	"count_over_time": func(f FunctionArgs) promql.Sample {
 		if len(f.Samples) == 0 {
 			return InvalidSample
@@ -199,6 +211,54 @@ var Funcs = map[string]FunctionCall{
 			F:      f.Samples[len(f.Samples)-1].F,
 		}
 	},
+	"first_over_time": func(f FunctionArgs) promql.Sample {
+		if len(f.Samples) == 0 {
+			return InvalidSample
+		}
+		first := f.Samples[0]
+		if first.H != nil {
+			// Points are buffered between steps, so the histogram is copied.
+			first.H = first.H.Copy()
+		}
+		return promql.Sample{
+			Metric: f.Labels,
+			T:      f.StepTime,
+			F:      first.F,
+			H:      first.H,
+		}
+	},
+	"ts_of_max_over_time": func(f FunctionArgs) promql.Sample {
+		i := compareOverTime(f.Samples, func(cur, max float64) bool { return cur >= max })
+		if i < 0 {
+			return InvalidSample
+		}
+		return promql.Sample{
+			Metric: f.Labels,
+			T:      f.StepTime,
+			F:      float64(f.Samples[i].T) / 1000,
+		}
+	},
+	"ts_of_min_over_time": func(f FunctionArgs) promql.Sample {
+		i := compareOverTime(f.Samples, func(cur, min float64) bool { return cur <= min })
+		if i < 0 {
+			return InvalidSample
+		}
+		return promql.Sample{
+			Metric: f.Labels,
+			T:      f.StepTime,
+			F:      float64(f.Samples[i].T) / 1000,
+		}
+	},
+	"ts_of_last_over_time": func(f FunctionArgs) promql.Sample {
+		if len(f.Samples) == 0 {
+			return InvalidSample
+		}
+		return promql.Sample{
+			Metric: f.Labels,
+			T:      f.StepTime,
+			F:      float64(f.Samples[len(f.Samples)-1].T) / 1000,
+		}
+	},
 	"label_join": func(f FunctionArgs) promql.Sample {
 		// This is specifically handled by functionOperator Series()
 		return promql.Sample{}
@@ -219,6 +279,15 @@ var Funcs = map[string]FunctionCall{
 			F: float64(f.StepTime) / 1000,
 		}
 	},
+	"timestamp": func(f FunctionArgs) promql.Sample {
+		// Samples which are not read directly from a vector selector
+		// are always evaluated at the step timestamp.
+		return promql.Sample{
+			Metric: f.Labels,
+			T:      f.StepTime,
+			F:      float64(f.StepTime) / 1000,
+		}
+	},
 	"changes": func(f FunctionArgs) promql.Sample {
 		if len(f.Samples) == 0 {
 			return InvalidSample
@@ -249,6 +318,18 @@ var Funcs = map[string]FunctionCall{
 			F:      deriv(f.Samples),
 		}
 	},
+	"predict_linear": func(f FunctionArgs) promql.Sample {
+		if len(f.Samples) < 2 || len(f.ScalarPoints) == 0 {
+			return InvalidSample
+		}
+		return promql.Sample{
+			Metric: f.Labels,
+			T:      f.StepTime,
+			F:      predictLinear(f.Samples, f.ScalarPoints[0], f.StepTime),
+		}
+	},
+	"holt_winters":                 holtWintersCall,
+	"double_exponential_smoothing": holtWintersCall,
 	"irate": func(f FunctionArgs) promql.Sample {
 		f.Samples = filterFloatOnlySamples(f.Samples)
 		if len(f.Samples) < 2 {
@@ -290,14 +371,17 @@ var Funcs = map[string]FunctionCall{
 		}
 	},
 	"scalar": func(f FunctionArgs) promql.Sample {
-		// This is handled specially by operator.
+		// This is handled by scalarFunctionOperator.
 		return promql.Sample{}
 	},
 	"rate": func(f FunctionArgs) promql.Sample {
 		if len(f.Samples) < 2 {
 			return InvalidSample
 		}
-		v, h := extrapolatedRate(f.Samples, true, true, f.StepTime, f.SelectRange, f.Offset)
+		v, h, ok := extrapolatedRate(f.Samples, true, true, f.StepTime, f.SelectRange, f.Offset)
+		if !ok {
+			return InvalidSample
+		}
 		return promql.Sample{
 			Metric: f.Labels,
 			T:      f.StepTime,
@@ -309,7 +393,10 @@ var Funcs = map[string]FunctionCall{
 		if len(f.Samples) < 2 {
 			return InvalidSample
 		}
-		v, h := extrapolatedRate(f.Samples, false, false, f.StepTime, f.SelectRange, f.Offset)
+		v, h, ok := extrapolatedRate(f.Samples, false, false, f.StepTime, f.SelectRange, f.Offset)
+		if !ok {
+			return InvalidSample
+		}
 		return promql.Sample{
 			Metric: f.Labels,
 			T:      f.StepTime,
@@ -321,7 +408,10 @@ var Funcs = map[string]FunctionCall{
 		if len(f.Samples) < 2 {
 			return InvalidSample
 		}
-		v, h := extrapolatedRate(f.Samples, true, false, f.StepTime, f.SelectRange, f.Offset)
+		v, h, ok := extrapolatedRate(f.Samples, true, false, f.StepTime, f.SelectRange, f.Offset)
+		if !ok {
+			return InvalidSample
+		}
 		return promql.Sample{
 			Metric: f.Labels,
 			T:      f.StepTime,
@@ -333,7 +423,10 @@ var Funcs = map[string]FunctionCall{
 		if len(f.Samples) == 0 {
 			return InvalidSample
 		}
-		v, h := extendedRate(f.Samples, true, true, f.StepTime, f.SelectRange, f.Offset)
+		v, h, ok := extendedRate(f.Samples, true, true, f.StepTime, f.SelectRange, f.Offset)
+		if !ok {
+			return InvalidSample
+		}
 		return promql.Sample{
 			Metric: f.Labels,
 			T:      f.StepTime,
@@ -345,7 +438,10 @@ var Funcs = map[string]FunctionCall{
 		if len(f.Samples) == 0 {
 			return InvalidSample
 		}
-		v, h := extendedRate(f.Samples, false, false, f.StepTime, f.SelectRange, f.Offset)
+		v, h, ok := extendedRate(f.Samples, false, false, f.StepTime, f.SelectRange, f.Offset)
+		if !ok {
+			return InvalidSample
+		}
 		return promql.Sample{
 			Metric: f.Labels,
 			T:      f.StepTime,
@@ -357,7 +453,10 @@ var Funcs = map[string]FunctionCall{
 		if len(f.Samples) == 0 {
 			return InvalidSample
 		}
-		v, h := extendedRate(f.Samples, true, false, f.StepTime, f.SelectRange, f.Offset)
+		v, h, ok := extendedRate(f.Samples, true, false, f.StepTime, f.SelectRange, f.Offset)
+		if !ok {
+			return InvalidSample
+		}
 		return promql.Sample{
 			Metric: f.Labels,
 			T:      f.StepTime,
@@ -365,81 +464,81 @@ var Funcs = map[string]FunctionCall{
 			H:      h,
 		}
 	},
-	"clamp": func(f FunctionArgs) promql.Sample {
-		if len(f.Samples) == 0 || len(f.ScalarPoints) < 2 {
+	"xsmoothincrease": func(f FunctionArgs) promql.Sample {
+		if len(f.Samples) < 2 {
 			return InvalidSample
 		}
-
-		v := f.Samples[0].F
-		min := f.ScalarPoints[0]
-		max := f.ScalarPoints[1]
-
-		if max < min {
+		v, h, ok := smoothedIncrease(f.Samples, f.SelectRange)
+		if !ok {
 			return InvalidSample
 		}
-
 		return promql.Sample{
 			Metric: f.Labels,
 			T:      f.StepTime,
-			F:      math.Max(min, math.Min(max, v)),
+			F:      v,
+			H:      h,
 		}
 	},
+	"clamp": func(f FunctionArgs) promql.Sample {
+		// This is handled by clampOperator.
+		return promql.Sample{}
+	},
 	"clamp_min": func(f FunctionArgs) promql.Sample {
-		if len(f.Samples) == 0 || len(f.ScalarPoints) == 0 {
+		// This is handled by clampOperator.
+		return promql.Sample{}
+	},
+	"clamp_max": func(f FunctionArgs) promql.Sample {
+		// This is handled by clampOperator.
+		return promql.Sample{}
+	},
+	"histogram_sum": func(f FunctionArgs) promql.Sample {
+		if len(f.Samples) == 0 || f.Samples[0].H == nil {
 			return InvalidSample
 		}
-
-		v := f.Samples[0].F
-		min := f.ScalarPoints[0]
-
 		return promql.Sample{
 			Metric: f.Labels,
 			T:      f.StepTime,
-			F:      math.Max(min, v),
+			F:      f.Samples[0].H.Sum,
 		}
 	},
-	"clamp_max": func(f FunctionArgs) promql.Sample {
-		if len(f.Samples) == 0 || len(f.ScalarPoints) == 0 {
+	"histogram_count": func(f FunctionArgs) promql.Sample {
+		if len(f.Samples) == 0 || f.Samples[0].H == nil {
 			return InvalidSample
 		}
-
-		v := f.Samples[0].F
-		max := f.ScalarPoints[0]
-
 		return promql.Sample{
 			Metric: f.Labels,
 			T:      f.StepTime,
-			F:      math.Min(max, v),
+			F:      f.Samples[0].H.Count,
 		}
 	},
-	"histogram_sum": func(f FunctionArgs) promql.Sample {
+	"histogram_fraction": func(f FunctionArgs) promql.Sample {
 		if len(f.Samples) == 0 || f.Samples[0].H == nil {
 			return InvalidSample
 		}
 		return promql.Sample{
 			Metric: f.Labels,
 			T:      f.StepTime,
-			F:      f.Samples[0].H.Sum,
+			F:      histogramFraction(f.ScalarPoints[0], f.ScalarPoints[1], f.Samples[0].H),
 		}
 	},
-	"histogram_count": func(f FunctionArgs) promql.Sample {
+	"histogram_stddev": func(f FunctionArgs) promql.Sample {
 		if len(f.Samples) == 0 || f.Samples[0].H == nil {
 			return InvalidSample
 		}
 		return promql.Sample{
 			Metric: f.Labels,
 			T:      f.StepTime,
-			F:      f.Samples[0].H.Count,
+			F:      math.Sqrt(histogramVariance(f.Samples[0].H)),
 		}
 	},
-	"histogram_fraction": func(f FunctionArgs) promql.Sample {
+	"histogram_stdvar": func(f FunctionArgs) promql.Sample {
 		if len(f.Samples) == 0 || f.Samples[0].H == nil {
 			return InvalidSample
 		}
 		return promql.Sample{
 			Metric: f.Labels,
 			T:      f.StepTime,
-			F:      histogramFraction(f.ScalarPoints[0], f.ScalarPoints[1], f.Samples[0].H),
+			F:      histogramVariance(f.Samples[0].H),
 		}
 	},
 	"days_in_month": func(f FunctionArgs) promql.Sample {
@@ -501,7 +600,9 @@ func NewFunctionCall(f *parser.Function) (FunctionCall, error) {
 // It calculates the rate (allowing for counter resets if isCounter is true),
 // extrapolates if the first/last sample is close to the boundary, and returns
 // the result as either per-second (if isRate is true) or overall.
-func extrapolatedRate(samples []promql.Sample, isCounter, isRate bool, stepTime int64, selectRange int64, offset int64) (float64, *histogram.FloatHistogram) {
+// The returned bool is false if no result can be calculated because the range
+// contains a mix of floats and histograms, or histograms which are not compatible.
+func extrapolatedRate(samples []promql.Sample, isCounter, isRate bool, stepTime int64, selectRange int64, offset int64) (float64, *histogram.FloatHistogram, bool) {
 	var (
 		rangeStart      = stepTime - (selectRange + offset)
 		rangeEnd        = stepTime - offset
@@ -511,7 +612,16 @@ func extrapolatedRate(samples []promql.Sample, isCounter, isRate bool, stepTime
 
 	if samples[0].H != nil {
 		resultHistogram = histogramRate(samples, isCounter)
+		if resultHistogram == nil {
+			return 0, nil, false
+		}
 	} else {
+		for _, sample := range samples {
+			if sample.H != nil {
+				// Range contains a mix of histograms and floats.
+				return 0, nil, false
+			}
+		}
 		resultValue = samples[len(samples)-1].F - samples[0].F
 		if isCounter {
 			var lastValue float64
@@ -570,17 +680,16 @@ func extrapolatedRate(samples []promql.Sample, isCounter, isRate bool, stepTime
 		resultValue *= factor
 	} else {
 		resultHistogram.Scale(factor)
-
 	}
 
-	return resultValue, resultHistogram
+	return resultValue, resultHistogram, true
 }
 
 // extendedRate is a utility function for xrate/xincrease/xdelta.
 // It calculates the rate (allowing for counter resets if isCounter is true),
 // taking into account the last sample before the range start, and returns
 // the result as either per-second (if isRate is true) or overall.
-func extendedRate(samples []promql.Sample, isCounter, isRate bool, stepTime int64, selectRange int64, offset int64) (float64, *histogram.FloatHistogram) {
+func extendedRate(samples []promql.Sample, isCounter, isRate bool, stepTime int64, selectRange int64, offset int64) (float64, *histogram.FloatHistogram, bool) {
 	var (
 		rangeStart      = stepTime - (selectRange + offset)
 		rangeEnd        = stepTime - offset
@@ -590,8 +699,14 @@ func extendedRate(samples []promql.Sample, isCounter, isRate bool, stepTime int6
 
 	if samples[0].H != nil {
 		// TODO - support extended rate for histograms
+		if len(samples) < 2 {
+			return 0, nil, false
+		}
 		resultHistogram = histogramRate(samples, isCounter)
-		return resultValue, resultHistogram
+		if resultHistogram == nil {
+			return 0, nil, false
+		}
+		return resultValue, resultHistogram, true
 	}
 
 	sameVals := true
@@ -607,7 +722,7 @@ func extendedRate(samples []promql.Sample, isCounter, isRate bool, stepTime int6
 	if isCounter && !isRate && sameVals {
 		// Make sure we are not at the end of the range
 		if stepTime-offset <= until {
-			return samples[0].F, nil
+			return samples[0].F, nil, true
 		}
 	}
 
@@ -620,7 +735,7 @@ func extendedRate(samples []promql.Sample, isCounter, isRate bool, stepTime int6
 		// If the point before the range is too far from rangeStart, drop it.
 		if float64(rangeStart-samples[0].T) > averageDurationBetweenSamples {
 			if len(samples) < 3 {
-				return resultValue, nil
+				return resultValue, nil, true
 			}
 			firstPoint = 1
 			sampledInterval = float64(samples[len(samples)-1].T - samples[1].T)
@@ -660,7 +775,46 @@ func extendedRate(samples []promql.Sample, isCounter, isRate bool, stepTime int6
 		resultValue = resultValue / float64(selectRange/1000)
 	}
 
-	return resultValue, nil
+	return resultValue, nil, true
+}
+
+// smoothedIncrease is a utility function for xsmoothincrease.
+// It calculates the increase of a counter between the last sample at or before the range
+// start and the last sample in the range, and scales it from the interval covered by these
+// samples to the duration of the range. Since windows are aligned to sample timestamps instead
+// of the range boundaries, the result does not jump when scrape jitter moves a sample across
+// a boundary, which smooths out the sawtooth pattern of increase over consecutive steps.
+func smoothedIncrease(samples []promql.Sample, selectRange int64) (float64, *histogram.FloatHistogram, bool) {
+	sampledInterval := float64(samples[len(samples)-1].T - samples[0].T)
+	if sampledInterval <= 0 {
+		return 0, nil, false
+	}
+	factor := float64(selectRange) / sampledInterval
+
+	if samples[0].H != nil {
+		h := histogramRate(samples, true)
+		if h == nil {
+			return 0, nil, false
+		}
+		return 0, h.Scale(factor), true
+	}
+
+	var (
+		counterCorrection float64
+		lastValue         float64
+	)
+	for _, sample := range samples {
+		if sample.H != nil {
+			// The range contains a mix of floats and histograms.
+			return 0, nil, false
+		}
+		if sample.F < lastValue {
+			counterCorrection += lastValue
+		}
+		lastValue = sample.F
+	}
+	increase := samples[len(samples)-1].F - samples[0].F + counterCorrection
+	return increase * factor, nil, true
 }
 
 // histogramRate is a helper function for extrapolatedRate. It requires
@@ -758,38 +912,95 @@ func minOverTime(points []promql.Sample) float64 {
 	return min
 }
 
+// compareOverTime returns the index of the float point which is selected by replace,
+// or -1 if there are no float points. A point replaces the selected point if replace
+// returns true for their values, or if the value of the selected point is NaN.
+func compareOverTime(points []promql.Sample, replace func(cur, selected float64) bool) int {
+	selected := -1
+	for i, p := range points {
+		if p.H != nil {
+			continue
+		}
+		if selected < 0 || math.IsNaN(points[selected].F) || replace(p.F, points[selected].F) {
+			selected = i
+		}
+	}
+	return selected
+}
+
 func countOverTime(points []promql.Sample) float64 {
 	return float64(len(points))
 }
 
 func avgOverTime(points []promql.Sample) float64 {
-	var mean, count, c float64
+	var mean Mean
 	for _, v := range points {
-		count++
-		if math.IsInf(mean, 0) {
-			if math.IsInf(v.F, 0) && (mean > 0) == (v.F > 0) {
-				// The `mean` and `v.F` values are `Inf` of the same sign.  They
-				// can't be subtracted, but the value of `mean` is correct
-				// already.
-				continue
-			}
-			if !math.IsInf(v.F, 0) && !math.IsNaN(v.F) {
-				// At this stage, the mean is an infinite. If the added
-				// value is neither an Inf or a Nan, we can keep that mean
-				// value.
-				// This is required because our calculation below removes
-				// the mean value, which would look like Inf += x - Inf and
-				// end up as a NaN.
-				continue
-			}
+		mean.Add(v.F)
+	}
+	return mean.Value()
+}
+
+// Mean computes the average of float values. Values are summed with Kahan compensation as long
+// as the sum does not overflow, after which the mean is computed incrementally.
+// The zero value is an empty mean.
+type Mean struct {
+	sum, mean, count, c float64
+	incrementalMean     bool
+}
+
+// Add adds a value to the mean.
+func (m *Mean) Add(v float64) {
+	m.count++
+	if m.count == 1 {
+		// The sum starts from the first value so that the sign of zero is kept.
+		m.sum = v
+		return
+	}
+	if !m.incrementalMean {
+		newSum, newC := KahanSumInc(v, m.sum, m.c)
+		// Compute the mean from the sum as long as the sum does not overflow.
+		if m.count == 1 || !math.IsInf(newSum, 0) {
+			m.sum, m.c = newSum, newC
+			return
+		}
+		// Fall back to computing the mean incrementally once it overflows.
+		m.incrementalMean = true
+		m.mean = m.sum / (m.count - 1)
+		m.c /= m.count - 1
+	}
+	if math.IsInf(m.mean, 0) {
+		if math.IsInf(v, 0) && (m.mean > 0) == (v > 0) {
+			// The `mean` and `v` values are `Inf` of the same sign.  They
+			// can't be subtracted, but the value of `mean` is correct
+			// already.
+			return
+		}
+		if !math.IsInf(v, 0) && !math.IsNaN(v) {
+			// At this stage, the mean is an infinite. If the added
+			// value is neither an Inf or a Nan, we can keep that mean
+			// value.
+			// This is required because our calculation below removes
+			// the mean value, which would look like Inf += x - Inf and
+			// end up as a NaN.
+			return
 		}
-		mean, c = KahanSumInc(v.F/count-mean/count, mean, c)
 	}
+	correctedMean := m.mean + m.c
+	m.mean, m.c = KahanSumInc(v/m.count-correctedMean/m.count, m.mean, m.c)
+}
 
-	if math.IsInf(mean, 0) {
-		return mean
+// Value returns the mean of the added values.
+func (m *Mean) Value() float64 {
+	if m.incrementalMean {
+		if math.IsInf(m.mean, 0) {
+			return m.mean
+		}
+		return m.mean + m.c
+	}
+	if math.IsInf(m.sum, 0) || m.c == 0 {
+		return m.sum / m.count
 	}
-	return mean + c
+	return (m.sum + m.c) / m.count
 }
 
 func sumOverTime(points []promql.Sample) float64 {
@@ -829,6 +1040,29 @@ func stdvarOverTime(points []promql.Sample) float64 {
 	return (aux + cAux) / count
 }
 
+// madOverTime returns the median absolute deviation of the points.
+func madOverTime(points []promql.Sample) float64 {
+	values := make([]float64, len(points))
+	for i, p := range points {
+		values[i] = p.F
+	}
+	m := median(values)
+	for i, v := range values {
+		values[i] = math.Abs(v - m)
+	}
+	return median(values)
+}
+
+// median sorts the values in place and returns their median.
+func median(values []float64) float64 {
+	sort.Float64s(values)
+	n := len(values)
+	if n%2 == 1 {
+		return values[n/2]
+	}
+	return (values[n/2-1] + values[n/2]) / 2
+}
+
 func changes(points []promql.Sample) float64 {
 	var count float64
 	prev := points[0].F
@@ -851,6 +1085,50 @@ func deriv(points []promql.Sample) float64 {
 	return slope
 }
 
+func predictLinear(points []promql.Sample, duration float64, stepTime int64) float64 {
+	slope, intercept := linearRegression(points, stepTime)
+	return slope*duration + intercept
+}
+
+func holtWintersCall(f FunctionArgs) promql.Sample {
+	f.Samples = filterFloatOnlySamples(f.Samples)
+	if len(f.Samples) < 2 || len(f.ScalarPoints) < 2 {
+		return InvalidSample
+	}
+	return promql.Sample{
+		Metric: f.Labels,
+		T:      f.StepTime,
+		F:      holtWinters(f.Samples, f.ScalarPoints[0], f.ScalarPoints[1]),
+	}
+}
+
+// holtWinters calculates the smoothed value of the samples using double exponential smoothing
+// with the smoothing factor sf and the trend factor tf. Adapted from Prometheus:
+// https://github.com/prometheus/prometheus/blob/7309ac272195/promql/functions.go#L301-L345
+func holtWinters(points []promql.Sample, sf, tf float64) float64 {
+	var s0, s1, b float64
+	s1 = points[0].F
+	b = points[1].F - points[0].F
+	for i := 1; i < len(points); i++ {
+		x := sf * points[i].F
+		b = holtWintersTrend(i-1, tf, s0, s1, b)
+		y := (1 - sf) * (s1 + b)
+		s0, s1 = s1, x+y
+	}
+	return s1
+}
+
+// holtWintersTrend calculates the trend value at the given index.
+func holtWintersTrend(i int, tf, s0, s1, b float64) float64 {
+	// The trend at the first index is the initial trend.
+	if i == 0 {
+		return b
+	}
+	x := tf * (s1 - s0)
+	y := (1 - tf) * b
+	return x + y
+}
+
 func resets(points []promql.Sample) float64 {
 	count := 0
 	prev := points[0].F
@@ -935,7 +1213,26 @@ func dateWrapper(fa FunctionArgs, f func(time.Time) float64) promql.Sample {
 	}
 }
 
+// ValidateScalarArgs returns an error if the scalar arguments of the
+// function with the given name are not valid for a single step.
+func ValidateScalarArgs(functionName string, args []float64) error {
+	switch functionName {
+	case "holt_winters", "double_exponential_smoothing":
+		if len(args) < 2 {
+			return nil
+		}
+		// Arguments are validated with negated conditions so that NaN values are accepted like in Prometheus.
+		if sf := args[0]; sf <= 0 || sf >= 1 {
+			return errors.Newf("invalid smoothing factor. Expected: 0 < sf < 1, got: %f", sf)
+		}
+		if tf := args[1]; tf <= 0 || tf >= 1 {
+			return errors.Newf("invalid trend factor. Expected: 0 < tf < 1, got: %f", tf)
+		}
+	}
+	return nil
+}
+
 // IsExtFunction is a convenience function to determine whether extended range calculations are required.
 func IsExtFunction(functionName string) bool {
-	return functionName == "xincrease" || functionName == "xrate" || functionName == "xdelta"
+	return functionName == "xincrease" || functionName == "xrate" || functionName == "xdelta" || functionName == "xsmoothincrease"
 }
@@ -11,11 +11,13 @@ import (
 	"sync"
 
 	"github.com/cespare/xxhash/v2"
+	"github.com/efficientgo/core/errors"
 	"github.com/prometheus/prometheus/model/labels"
 
-	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
-
+	"github.com/thanos-community/promql-engine/execution/audit"
 	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/execution/warnings"
+	"github.com/thanos-community/promql-engine/logicalplan"
 )
 
 type histogramSeries struct {
@@ -28,7 +30,7 @@ type histogramSeries struct {
 type histogramOperator struct {
 	pool *model.VectorPool
 
-	funcArgs parser.Expressions
+	funcExpr *logicalplan.FunctionCall
 
 	once     sync.Once
 	series   []labels.Labels
@@ -45,12 +47,16 @@ type histogramOperator struct {
 
 	// seriesBuckets are the buckets for each individual conventional histogram series.
 	seriesBuckets []buckets
+
+	// metricNames are the metric names of input series for each output series,
+	// used for annotating output series which mix classic and native histograms.
+	metricNames []string
 }
 
-func NewHistogramOperator(pool *model.VectorPool, args parser.Expressions, nextOps []model.VectorOperator, stepsBatch int) (model.VectorOperator, error) {
+func NewHistogramOperator(pool *model.VectorPool, funcExpr *logicalplan.FunctionCall, nextOps []model.VectorOperator, stepsBatch int) (model.VectorOperator, error) {
 	return &histogramOperator{
 		pool:         pool,
-		funcArgs:     args,
+		funcExpr:     funcExpr,
 		once:         sync.Once{},
 		scalarOp:     nextOps[0],
 		vectorOp:     nextOps[1],
@@ -60,7 +66,7 @@ func NewHistogramOperator(pool *model.VectorPool, args parser.Expressions, nextO
 
 func (o *histogramOperator) Explain() (me string, next []model.VectorOperator) {
 	next = []model.VectorOperator{o.scalarOp, o.vectorOp}
-	return fmt.Sprintf("[*functionOperator] histogram_quantile(%v)", o.funcArgs), next
+	return fmt.Sprintf("[*functionOperator] %v", o.funcExpr), next
 }
 
 func (o *histogramOperator) Series(ctx context.Context) ([]labels.Labels, error) {
@@ -113,10 +119,10 @@ func (o *histogramOperator) Next(ctx context.Context) ([]model.StepVector, error
 	}
 	o.scalarOp.GetPool().PutVectors(scalars)
 
-	return o.processInputSeries(vectors)
+	return o.processInputSeries(ctx, vectors)
 }
 
-func (o *histogramOperator) processInputSeries(vectors []model.StepVector) ([]model.StepVector, error) {
+func (o *histogramOperator) processInputSeries(ctx context.Context, vectors []model.StepVector) ([]model.StepVector, error) {
 	out := o.pool.GetVectorBatch()
 	for stepIndex, vector := range vectors {
 		o.resetBuckets()
@@ -140,14 +146,21 @@ func (o *histogramOperator) processInputSeries(vectors []model.StepVector) ([]mo
 			outputSeriesID := o.outputIndex[seriesID].outputID
 			// We need to check if there is a conventional histogram mapped to this output series ID.
 			// If that is the case, it means we have mixed data types for a single step and this behavior is undefined.
-			// In that case, we reset the conventional buckets to avoid emitting a sample.
-			// TODO(fpetkovski): Prometheus is looking to solve these conflicts through warnings: https://github.com/prometheus/prometheus/issues/10839.
-			if len(o.seriesBuckets[outputSeriesID]) == 0 {
-				value := histogramQuantile(o.scalarPoints[stepIndex], vector.Histograms[i])
-				step.AppendSample(o.pool, uint64(outputSeriesID), value)
-			} else {
+			// In that case, we reset the conventional buckets to avoid emitting a sample and annotate the result.
+			if len(o.seriesBuckets[outputSeriesID]) != 0 {
 				o.seriesBuckets[outputSeriesID] = o.seriesBuckets[outputSeriesID][:0]
+				warnings.AddToContext(errors.Newf(
+					"PromQL warning: vector contains a mix of classic and native histograms for metric name %q",
+					o.metricNames[outputSeriesID],
+				), ctx)
+				continue
+			}
+			if stepIndex >= len(o.scalarPoints) {
+				step.AppendSample(o.pool, uint64(outputSeriesID), math.NaN())
+				continue
 			}
+			value := histogramQuantile(o.scalarPoints[stepIndex], vector.Histograms[i])
+			step.AppendSample(o.pool, uint64(outputSeriesID), value)
 		}
 
 		for i, stepBuckets := range o.seriesBuckets {
@@ -187,6 +200,7 @@ func (o *histogramOperator) loadSeries(ctx context.Context) error {
 	)
 
 	o.series = make([]labels.Labels, 0)
+	o.metricNames = make([]string, 0)
 	o.outputIndex = make([]*histogramSeries, len(series))
 
 	for i, s := range series {
@@ -196,7 +210,7 @@ func (o *histogramOperator) loadSeries(ctx context.Context) error {
 		if err != nil {
 			hasBucketValue = false
 		}
-		lbls, _ = DropMetricName(lbls)
+		lbls, name := DropMetricName(lbls)
 
 		hasher.Reset()
 		hashBuf = lbls.Bytes(hashBuf)
@@ -208,6 +222,7 @@ func (o *histogramOperator) loadSeries(ctx context.Context) error {
 		seriesID, ok := seriesHashes[seriesHash]
 		if !ok {
 			o.series = append(o.series, lbls)
+			o.metricNames = append(o.metricNames, name.Value)
 			seriesID = len(o.series) - 1
 			seriesHashes[seriesHash] = seriesID
 		}
@@ -218,6 +233,7 @@ func (o *histogramOperator) loadSeries(ctx context.Context) error {
 			hasBucketValue: hasBucketValue,
 		}
 	}
+	audit.AddLabelCopies(len(series), ctx)
 	o.seriesBuckets = make([]buckets, len(o.series))
 	o.pool.SetStepSize(len(o.series))
 	return nil
@@ -17,14 +17,16 @@ import (
 
 	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
 
+	"github.com/thanos-community/promql-engine/execution/audit"
 	"github.com/thanos-community/promql-engine/execution/model"
 	"github.com/thanos-community/promql-engine/execution/parse"
+	"github.com/thanos-community/promql-engine/logicalplan"
 	"github.com/thanos-community/promql-engine/query"
 )
 
 // functionOperator returns []model.StepVector after processing input with desired function.
 type functionOperator struct {
-	funcExpr *parser.Call
+	funcExpr *logicalplan.FunctionCall
 	series   []labels.Labels
 	once     sync.Once
 
@@ -34,15 +36,18 @@ type functionOperator struct {
 	call         FunctionCall
 	scalarPoints [][]float64
 	sampleBuf    []promql.Sample
+
+	// delayNameRemoval marks series for removing the metric name once the query is evaluated.
+	delayNameRemoval bool
 }
 
 type noArgFunctionOperator struct {
 	mint        int64
 	maxt        int64
-	step        int64
+	steps       query.Steps
 	currentStep int64
 	stepsBatch  int
-	funcExpr    *parser.Call
+	funcExpr    *logicalplan.FunctionCall
 	call        FunctionCall
 	vectorPool  *model.VectorPool
 	series      []labels.Labels
@@ -75,26 +80,20 @@ func (o *noArgFunctionOperator) Next(_ context.Context) ([]model.StepVector, err
 		sv.SampleIDs = o.sampleIDs
 
 		ret = append(ret, sv)
-		o.currentStep += o.step
+		o.currentStep = o.steps.Next(o.currentStep)
 	}
 
 	return ret, nil
 }
 
-func NewFunctionOperator(funcExpr *parser.Call, call FunctionCall, nextOps []model.VectorOperator, stepsBatch int, opts *query.Options) (model.VectorOperator, error) {
+func NewFunctionOperator(funcExpr *logicalplan.FunctionCall, call FunctionCall, nextOps []model.VectorOperator, stepsBatch int, opts *query.Options) (model.VectorOperator, error) {
 	// Short-circuit functions that take no args. Their only input is the step's timestamp.
 	if len(nextOps) == 0 {
-		interval := opts.Step.Milliseconds()
-		// We set interval to be at least 1.
-		if interval == 0 {
-			interval = 1
-		}
-
 		op := &noArgFunctionOperator{
 			currentStep: opts.Start.UnixMilli(),
 			mint:        opts.Start.UnixMilli(),
 			maxt:        opts.End.UnixMilli(),
-			step:        interval,
+			steps:       opts.Steps(),
 			stepsBatch:  stepsBatch,
 			funcExpr:    funcExpr,
 			call:        call,
@@ -112,6 +111,16 @@ func NewFunctionOperator(funcExpr *parser.Call, call FunctionCall, nextOps []mod
 
 		return op, nil
 	}
+
+	switch funcExpr.Func.Name {
+	case "scalar":
+		return newScalarFunctionOperator(funcExpr, nextOps[0], stepsBatch, opts), nil
+	case "vector":
+		return &vectorFunctionOperator{next: nextOps[0], funcExpr: funcExpr}, nil
+	case "clamp", "clamp_min", "clamp_max":
+		return newClampOperator(funcExpr, nextOps, opts), nil
+	}
+
 	scalarPoints := make([][]float64, stepsBatch)
 	for i := 0; i < stepsBatch; i++ {
 		scalarPoints[i] = make([]float64, len(nextOps)-1)
@@ -123,10 +132,12 @@ func NewFunctionOperator(funcExpr *parser.Call, call FunctionCall, nextOps []mod
 		vectorIndex:  0,
 		scalarPoints: scalarPoints,
 		sampleBuf:    make([]promql.Sample, 1),
+
+		delayNameRemoval: opts.EnableDelayedNameRemoval,
 	}
 
 	for i := range funcExpr.Args {
-		if funcExpr.Args[i].Type() == parser.ValueTypeVector {
+		if funcExpr.Args[i].ReturnType() == parser.ValueTypeVector {
 			f.vectorIndex = i
 			break
 		}
@@ -134,7 +145,7 @@ func NewFunctionOperator(funcExpr *parser.Call, call FunctionCall, nextOps []mod
 
 	// Check selector type.
 	// TODO(saswatamcode): Add support for matrix.
-	switch funcExpr.Args[f.vectorIndex].Type() {
+	switch funcExpr.Args[f.vectorIndex].ReturnType() {
 	case parser.ValueTypeVector, parser.ValueTypeScalar:
 		return f, nil
 	default:
@@ -142,8 +153,23 @@ func NewFunctionOperator(funcExpr *parser.Call, call FunctionCall, nextOps []mod
 	}
 }
 
+// NewTimestampOperator creates the operator for timestamp() over a vector selector.
+// The selector is expected to return sample timestamps in place of sample values,
+// so they are passed through and only the metric name is dropped from the series.
+func NewTimestampOperator(funcExpr *logicalplan.FunctionCall, next model.VectorOperator, stepsBatch int, opts *query.Options) (model.VectorOperator, error) {
+	return NewFunctionOperator(funcExpr, sampleTimestamp, []model.VectorOperator{next}, stepsBatch, opts)
+}
+
+func sampleTimestamp(f FunctionArgs) promql.Sample {
+	return promql.Sample{
+		Metric: f.Labels,
+		T:      f.StepTime,
+		F:      f.Samples[0].F,
+	}
+}
+
 func (o *functionOperator) Explain() (me string, next []model.VectorOperator) {
-	return fmt.Sprintf("[*functionOperator] %v(%v)", o.funcExpr.Func.Name, o.funcExpr.Args), o.nextOps
+	return fmt.Sprintf("[*functionOperator] %v", o.funcExpr), o.nextOps
 }
 
 func (o *functionOperator) Series(ctx context.Context) ([]labels.Labels, error) {
@@ -207,25 +233,6 @@ func (o *functionOperator) Next(ctx context.Context) ([]model.StepVector, error)
 	}
 
 	for batchIndex, vector := range vectors {
-		// scalar() depends on number of samples per vector and returns NaN if len(samples) != 1.
-		// So need to handle this separately here, instead of going via call which is per point.
-		// TODO(fpetkovski): make this decision once in the constructor and create a new operator.
-		if o.funcExpr.Func.Name == "scalar" {
-			if len(vector.Samples) == 0 {
-				vectors[batchIndex].SampleIDs = []uint64{0}
-				vectors[batchIndex].Samples = []float64{math.NaN()}
-				continue
-			}
-
-			vectors[batchIndex].SampleIDs = vector.SampleIDs[:1]
-			vectors[batchIndex].SampleIDs[0] = 0
-			if len(vector.Samples) > 1 {
-				vectors[batchIndex].Samples = vector.Samples[:1]
-				vectors[batchIndex].Samples[0] = math.NaN()
-			}
-			continue
-		}
-
 		i := 0
 		for i < len(vectors[batchIndex].Samples) {
 			o.sampleBuf[0].H = nil
@@ -244,6 +251,8 @@ func (o *functionOperator) Next(ctx context.Context) ([]model.StepVector, error)
 
 		i = 0
 		for i < len(vectors[batchIndex].Histograms) {
+			// Functions which only handle floats read a zero value for histograms.
+			o.sampleBuf[0].F = 0
 			o.sampleBuf[0].H = vector.Histograms[i]
 			result := o.call(o.newFunctionArgs(vector, batchIndex))
 
@@ -273,16 +282,6 @@ func (o *functionOperator) newFunctionArgs(vector model.StepVector, batchIndex i
 func (o *functionOperator) loadSeries(ctx context.Context) error {
 	var err error
 	o.once.Do(func() {
-		if o.funcExpr.Func.Name == "vector" {
-			o.series = []labels.Labels{labels.New()}
-			return
-		}
-
-		if o.funcExpr.Func.Name == "scalar" {
-			o.series = []labels.Labels{}
-			return
-		}
-
 		series, loadErr := o.nextOps[o.vectorIndex].Series(ctx)
 		if loadErr != nil {
 			err = loadErr
@@ -296,20 +295,20 @@ func (o *functionOperator) loadSeries(ctx context.Context) error {
 		var labelJoinSrcLabels []string
 		if o.funcExpr.Func.Name == "label_join" {
 			l := len(o.funcExpr.Args)
-			labelJoinDst = o.funcExpr.Args[1].(*parser.StringLiteral).Val
+			labelJoinDst = o.funcExpr.Args[1].(*logicalplan.StringLiteral).Val
 			if !prommodel.LabelName(labelJoinDst).IsValid() {
 				err = errors.Newf("invalid destination label name in label_join: %s", labelJoinDst)
 				return
 			}
-			labelJoinSep = o.funcExpr.Args[2].(*parser.StringLiteral).Val
+			labelJoinSep = o.funcExpr.Args[2].(*logicalplan.StringLiteral).Val
 			for j := 3; j < l; j++ {
-				labelJoinSrcLabels = append(labelJoinSrcLabels, o.funcExpr.Args[j].(*parser.StringLiteral).Val)
+				labelJoinSrcLabels = append(labelJoinSrcLabels, o.funcExpr.Args[j].(*logicalplan.StringLiteral).Val)
 			}
 		}
+		var numCopies int
 		for i, s := range series {
 			lbls := s
 			switch o.funcExpr.Func.Name {
-			case "last_over_time":
 			case "label_join":
 				srcVals := make([]string, len(labelJoinSrcLabels))
 
@@ -327,19 +326,46 @@ func (o *functionOperator) loadSeries(ctx context.Context) error {
 
 				lbls = lb.Labels()
 			default:
-				lbls, _ = DropMetricName(s.Copy())
+				if !KeepsMetricName(o.funcExpr.Func.Name) {
+					lbls = removeMetricName(s, o.delayNameRemoval)
+					numCopies++
+				}
 			}
 			o.series[i] = lbls
 		}
+		audit.AddLabelCopies(numCopies, ctx)
 	})
 
 	return err
 }
 
+// DropMetricName removes the metric name from l, together with the mark for removing it lazily.
 func DropMetricName(l labels.Labels) (labels.Labels, labels.Label) {
+	l, _ = dropLabel(l, model.DropNameLabel)
 	return dropLabel(l, labels.MetricName)
 }
 
+// KeepsMetricName returns true if the function with the given name returns
+// series with the metric name of their input.
+func KeepsMetricName(name string) bool {
+	switch name {
+	case "first_over_time", "last_over_time", "label_join", "label_replace":
+		return true
+	default:
+		return false
+	}
+}
+
+// removeMetricName removes the metric name from a copy of l. If delayed is true,
+// the copy is marked for removing the metric name once the query is evaluated instead.
+func removeMetricName(l labels.Labels, delayed bool) labels.Labels {
+	if delayed {
+		return model.MarkDropName(l)
+	}
+	l, _ = DropMetricName(l.Copy())
+	return l
+}
+
 // dropLabel removes the label with name from l and returns the dropped label.
 func dropLabel(l labels.Labels, name string) (labels.Labels, labels.Label) {
 	if len(l) == 0 {
@@ -282,3 +282,38 @@ func histogramFraction(lower, upper float64, h *histogram.FloatHistogram) float6
 
 	return (upperRank - lowerRank) / h.Count
 }
+
+// histogramVariance estimates the variance of observations in a native histogram.
+// Each observation is assumed to be at the geometric mean of its bucket bounds,
+// or at zero for the zero bucket.
+// Based on https://github.com/prometheus/prometheus/blob/v2.49.0/promql/functions.go#L1088.
+func histogramVariance(h *histogram.FloatHistogram) float64 {
+	if h.Count == 0 {
+		return math.NaN()
+	}
+
+	var (
+		mean                = h.Sum / h.Count
+		variance, cVariance float64
+		it                  = h.AllBucketIterator()
+	)
+	for it.Next() {
+		bucket := it.At()
+		if bucket.Count == 0 {
+			continue
+		}
+		var val float64
+		if bucket.Lower <= 0 && 0 <= bucket.Upper {
+			val = 0
+		} else {
+			val = math.Sqrt(bucket.Upper * bucket.Lower)
+			if bucket.Upper < 0 {
+				val = -val
+			}
+		}
+		delta := val - mean
+		variance, cVariance = KahanSumInc(bucket.Count*delta*delta, variance, cVariance)
+	}
+	variance += cVariance
+	return variance / h.Count
+}
@@ -0,0 +1,150 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package function
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/logicalplan"
+	"github.com/thanos-community/promql-engine/query"
+)
+
+// scalarFunctionOperator implements scalar() by converting its input vector to a scalar at each step.
+// Steps at which the vector does not contain exactly one float sample evaluate to NaN.
+type scalarFunctionOperator struct {
+	pool     *model.VectorPool
+	next     model.VectorOperator
+	funcExpr *logicalplan.FunctionCall
+	name     string
+	convert  func(model.StepVector) float64
+
+	currentStep int64
+	maxt        int64
+	steps       query.Steps
+	stepsBatch  int
+}
+
+func newScalarFunctionOperator(funcExpr *logicalplan.FunctionCall, next model.VectorOperator, stepsBatch int, opts *query.Options) *scalarFunctionOperator {
+	pool := model.NewVectorPool(stepsBatch)
+	pool.SetStepSize(1)
+	return &scalarFunctionOperator{
+		pool:        pool,
+		next:        next,
+		funcExpr:    funcExpr,
+		name:        "scalarFunctionOperator",
+		convert:     scalarValue,
+		currentStep: opts.Start.UnixMilli(),
+		maxt:        opts.End.UnixMilli(),
+		steps:       opts.Steps(),
+		stepsBatch:  stepsBatch,
+	}
+}
+
+// NewCountScalarOperator creates an operator for scalar(count(expr)) with next evaluating expr.
+// The count of samples at each step is broadcast as a scalar to upstream operators,
+// which avoids grouping the series of the counted expression.
+func NewCountScalarOperator(funcExpr *logicalplan.FunctionCall, next model.VectorOperator, stepsBatch int, opts *query.Options) model.VectorOperator {
+	o := newScalarFunctionOperator(funcExpr, next, stepsBatch, opts)
+	o.name = "countScalarOperator"
+	o.convert = countValue
+	return o
+}
+
+func scalarValue(vector model.StepVector) float64 {
+	if len(vector.Samples) == 1 && len(vector.Histograms) == 0 {
+		return vector.Samples[0]
+	}
+	return math.NaN()
+}
+
+func countValue(vector model.StepVector) float64 {
+	// Counting an empty vector results in an empty vector, which converts to NaN.
+	if n := len(vector.Samples) + len(vector.Histograms); n > 0 {
+		return float64(n)
+	}
+	return math.NaN()
+}
+
+func (o *scalarFunctionOperator) Explain() (me string, next []model.VectorOperator) {
+	return fmt.Sprintf("[*%s] %v", o.name, o.funcExpr), []model.VectorOperator{o.next}
+}
+
+func (o *scalarFunctionOperator) Series(_ context.Context) ([]labels.Labels, error) {
+	// Scalars do not have series.
+	return []labels.Labels{}, nil
+}
+
+func (o *scalarFunctionOperator) GetPool() *model.VectorPool {
+	return o.pool
+}
+
+func (o *scalarFunctionOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	if o.currentStep > o.maxt {
+		return nil, nil
+	}
+
+	in, err := o.next.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Operators without series might not return any steps, but
+	// scalars have a value at each step of the query.
+	result := o.pool.GetVectorBatch()
+	for i := 0; i < o.stepsBatch && o.currentStep <= o.maxt; i++ {
+		value := math.NaN()
+		if i < len(in) {
+			value = o.convert(in[i])
+		}
+
+		step := o.pool.GetStepVector(o.currentStep)
+		step.AppendSample(o.pool, 0, value)
+		result = append(result, step)
+		o.currentStep = o.steps.Next(o.currentStep)
+	}
+	for _, vector := range in {
+		o.next.GetPool().PutStepVector(vector)
+	}
+	if in != nil {
+		o.next.GetPool().PutVectors(in)
+	}
+
+	return result, nil
+}
+
+// vectorFunctionOperator implements vector() by lifting its scalar input
+// into a vector with a single series without labels.
+type vectorFunctionOperator struct {
+	next     model.VectorOperator
+	funcExpr *logicalplan.FunctionCall
+}
+
+func (o *vectorFunctionOperator) Explain() (me string, next []model.VectorOperator) {
+	return fmt.Sprintf("[*vectorFunctionOperator] %v", o.funcExpr), []model.VectorOperator{o.next}
+}
+
+func (o *vectorFunctionOperator) Series(_ context.Context) ([]labels.Labels, error) {
+	return []labels.Labels{labels.New()}, nil
+}
+
+func (o *vectorFunctionOperator) GetPool() *model.VectorPool {
+	return o.next.GetPool()
+}
+
+func (o *vectorFunctionOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	// Scalar operators always return their value under the sample ID 0,
+	// which is the ID of the only output series.
+	return o.next.Next(ctx)
+}
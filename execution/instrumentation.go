@@ -0,0 +1,221 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package execution
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/thanos-community/promql-engine/execution/audit"
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+	"github.com/thanos-community/promql-engine/logicalplan"
+	"github.com/thanos-community/promql-engine/query"
+)
+
+const tracerName = "github.com/thanos-community/promql-engine"
+
+// batchDurationOperator observes the wall time spent on producing each batch of steps.
+// The time includes waiting for child operators, so the durations of selectors
+// reflect time spent on storage while the durations of other operators also include
+// time spent on computation.
+type batchDurationOperator struct {
+	model.VectorOperator
+	observer prometheus.Observer
+}
+
+func instrumentOperator(operator model.VectorOperator, expr logicalplan.Node, opts *query.Options) model.VectorOperator {
+	name := operatorType(expr)
+	if name == "" {
+		return operator
+	}
+	if opts.BatchDurations != nil {
+		operator = &batchDurationOperator{
+			VectorOperator: operator,
+			observer:       opts.BatchDurations.WithLabelValues(name),
+		}
+	}
+	if opts.TraceOperators {
+		operator = &tracedOperator{VectorOperator: operator, name: name, expr: expr.String()}
+	}
+	if opts.AuditLabels {
+		operator = &auditedOperator{VectorOperator: operator}
+	}
+	return trackState(operator, opts)
+}
+
+// trackState makes the operator track its progress if the query tracks operator state.
+// Selector shards are tracked individually since they are the leaves that queries wait on.
+func trackState(operator model.VectorOperator, opts *query.Options) model.VectorOperator {
+	if !opts.TrackOperatorState {
+		return operator
+	}
+	return &stateOperator{VectorOperator: operator}
+}
+
+func (o *batchDurationOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	start := time.Now()
+	vectors, err := o.VectorOperator.Next(ctx)
+	if vectors != nil || err != nil {
+		o.observer.Observe(time.Since(start).Seconds())
+	}
+	return vectors, err
+}
+
+func (o *batchDurationOperator) SeriesHashes(ctx context.Context, grouping model.Grouping) ([]uint64, error) {
+	return model.SeriesHashes(ctx, o.VectorOperator, grouping)
+}
+
+// tracedOperator records a span for loading the series of an operator and for each batch it produces.
+// Spans are created with the tracer provider of the span in the context of the query, so operators
+// are not traced unless the caller traces the query.
+type tracedOperator struct {
+	model.VectorOperator
+	name string
+	expr string
+}
+
+func (o *tracedOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	ctx, span := o.startSpan(ctx, "series")
+	defer span.End()
+
+	series, err := o.VectorOperator.Series(ctx)
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.SetAttributes(attribute.Int("series", len(series)))
+	return series, err
+}
+
+func (o *tracedOperator) SeriesHashes(ctx context.Context, grouping model.Grouping) ([]uint64, error) {
+	ctx, span := o.startSpan(ctx, "series_hashes")
+	defer span.End()
+	return model.SeriesHashes(ctx, o.VectorOperator, grouping)
+}
+
+func (o *tracedOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	ctx, span := o.startSpan(ctx, "next")
+	defer span.End()
+
+	vectors, err := o.VectorOperator.Next(ctx)
+	if err != nil {
+		span.RecordError(err)
+	}
+	if len(vectors) > 0 {
+		span.SetAttributes(
+			attribute.Int("steps", len(vectors)),
+			attribute.Int64("last_step", vectors[len(vectors)-1].T),
+		)
+	}
+	return vectors, err
+}
+
+func (o *tracedOperator) startSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
+	return tracer.Start(ctx, o.name+"."+method, trace.WithAttributes(attribute.String("expr", o.expr)))
+}
+
+// auditedOperator counts the label copies and sorts performed by an operator and by the
+// helper operators below it, such as exchanges, which are not audited on their own.
+type auditedOperator struct {
+	model.VectorOperator
+	labels audit.Counter
+}
+
+func (o *auditedOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	return o.VectorOperator.Series(audit.WithOperator(ctx, &o.labels))
+}
+
+func (o *auditedOperator) SeriesHashes(ctx context.Context, grouping model.Grouping) ([]uint64, error) {
+	return model.SeriesHashes(audit.WithOperator(ctx, &o.labels), o.VectorOperator, grouping)
+}
+
+func (o *auditedOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	return o.VectorOperator.Next(audit.WithOperator(ctx, &o.labels))
+}
+
+// stateOperator tracks the progress of an operator so that it can be
+// included in snapshots of queries which are being executed.
+type stateOperator struct {
+	model.VectorOperator
+
+	batches  atomic.Int64
+	step     atomic.Int64
+	inSeries atomic.Bool
+	inNext   atomic.Bool
+}
+
+func (o *stateOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	o.inSeries.Store(true)
+	defer o.inSeries.Store(false)
+	return o.VectorOperator.Series(ctx)
+}
+
+func (o *stateOperator) SeriesHashes(ctx context.Context, grouping model.Grouping) ([]uint64, error) {
+	o.inSeries.Store(true)
+	defer o.inSeries.Store(false)
+	return model.SeriesHashes(ctx, o.VectorOperator, grouping)
+}
+
+func (o *stateOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	o.inNext.Store(true)
+	defer o.inNext.Store(false)
+
+	vectors, err := o.VectorOperator.Next(ctx)
+	if len(vectors) > 0 {
+		o.batches.Add(1)
+		o.step.Store(vectors[len(vectors)-1].T)
+	}
+	return vectors, err
+}
+
+func (o *stateOperator) state() OperatorState {
+	return OperatorState{
+		Batches:     o.batches.Load(),
+		CurrentStep: o.step.Load(),
+		InSeries:    o.inSeries.Load(),
+		InNext:      o.inNext.Load(),
+	}
+}
+
+// operatorType returns the type of the operator created for the expression.
+// Expressions which do not create an operator of their own return an empty string.
+func operatorType(expr logicalplan.Node) string {
+	switch e := expr.(type) {
+	case *logicalplan.VectorSelector, *logicalplan.FilteredSelector:
+		return "vector_selector"
+	case *logicalplan.FunctionCall:
+		for _, arg := range e.Args {
+			if _, ok := arg.(*logicalplan.MatrixSelector); ok {
+				return "matrix_selector"
+			}
+		}
+		return "function"
+	case *logicalplan.Aggregation, *logicalplan.PartialAggregation:
+		return "aggregate"
+	case *logicalplan.Binary:
+		return "binary"
+	case *logicalplan.Unary:
+		if e.Op == parser.SUB {
+			return "unary"
+		}
+	case *logicalplan.StepInvariantExpr:
+		return "step_invariant"
+	case logicalplan.Deduplicate:
+		return "dedup"
+	case logicalplan.RemoteExecution:
+		return "remote_execution"
+	case *logicalplan.TimeSplit:
+		return "time_split"
+	case *logicalplan.Coalesce:
+		return "coalesce"
+	}
+	return ""
+}
@@ -0,0 +1,216 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package model
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// Grouping is the subset of labels by which series are matched in binary
+// operations or grouped in aggregations.
+type Grouping struct {
+	// Without is true when the grouping contains all labels except Labels.
+	Without bool
+	Labels  []string
+}
+
+// String returns a key which identifies the grouping.
+func (g Grouping) String() string {
+	var b strings.Builder
+	if g.Without {
+		b.WriteByte('-')
+	} else {
+		b.WriteByte('+')
+	}
+	for _, l := range g.Labels {
+		b.WriteString(l)
+		b.WriteByte(0xff)
+	}
+	return b.String()
+}
+
+// Hash returns the hash of the labels of metric which belong to the grouping.
+// Groupings with Without set never include the metric name or DropNameLabel in the hash.
+func (g Grouping) Hash(metric labels.Labels, buf []byte) uint64 {
+	buf = buf[:0]
+	if g.Without {
+		names := g.Labels
+		if metric.Has(DropNameLabel) {
+			names = append(names[:len(names):len(names)], DropNameLabel)
+		}
+		key, _ := metric.HashWithoutLabels(buf, names...)
+		return key
+	}
+	if len(g.Labels) == 0 {
+		return 0
+	}
+	key, _ := metric.HashForLabels(buf, g.Labels...)
+	return key
+}
+
+// HasMetricName returns true if the metric name belongs to the grouping.
+func (g Grouping) HasMetricName() bool {
+	if g.Without {
+		return false
+	}
+	for _, l := range g.Labels {
+		if l == labels.MetricName {
+			return true
+		}
+	}
+	return false
+}
+
+// Equal returns true if a and b have the same labels in the grouping.
+func (g Grouping) Equal(a, b labels.Labels) bool {
+	if !g.Without {
+		for _, name := range g.Labels {
+			if a.Get(name) != b.Get(name) {
+				return false
+			}
+		}
+		return true
+	}
+
+	excluded := func(name string) bool {
+		if name == labels.MetricName || name == DropNameLabel {
+			return true
+		}
+		for _, l := range g.Labels {
+			if l == name {
+				return true
+			}
+		}
+		return false
+	}
+	var (
+		equal = true
+		n     int
+	)
+	a.Range(func(l labels.Label) {
+		if !equal || excluded(l.Name) {
+			return
+		}
+		n++
+		equal = b.Get(l.Name) == l.Value
+	})
+	b.Range(func(l labels.Label) {
+		if !excluded(l.Name) {
+			n--
+		}
+	})
+	return equal && n == 0
+}
+
+// Groups assigns series to the groups of a grouping. Series are looked up by the hash
+// of their grouping labels, and their labels are compared with the first series of the
+// group, so that series whose hashes collide are not merged into the same group.
+type Groups struct {
+	grouping Grouping
+	byHash   map[uint64]int
+	// collisions holds the groups whose hash collides with the group in byHash.
+	collisions map[uint64][]int
+	metrics    []labels.Labels
+}
+
+// NewGroups creates an empty set of groups for the grouping.
+func NewGroups(grouping Grouping) *Groups {
+	return &Groups{
+		grouping: grouping,
+		byHash:   make(map[uint64]int),
+	}
+}
+
+// Get returns the ID of the group of metric, whose grouping hash is hash. IDs are assigned
+// sequentially from zero. The second return value is false if the group was created by the call.
+func (g *Groups) Get(hash uint64, metric labels.Labels) (int, bool) {
+	id, ok := g.byHash[hash]
+	if !ok {
+		id = g.add(metric)
+		g.byHash[hash] = id
+		return id, false
+	}
+	if g.grouping.Equal(g.metrics[id], metric) {
+		return id, true
+	}
+	for _, id := range g.collisions[hash] {
+		if g.grouping.Equal(g.metrics[id], metric) {
+			return id, true
+		}
+	}
+	if g.collisions == nil {
+		g.collisions = make(map[uint64][]int)
+	}
+	id = g.add(metric)
+	g.collisions[hash] = append(g.collisions[hash], id)
+	return id, false
+}
+
+func (g *Groups) add(metric labels.Labels) int {
+	g.metrics = append(g.metrics, metric)
+	return len(g.metrics) - 1
+}
+
+// HashedOperator is implemented by operators which keep the hashes of their
+// series, so that joins and aggregations do not need to hash label sets of
+// operators shared between them.
+type HashedOperator interface {
+	// SeriesHashes returns the hash of each series returned by Series for the given grouping.
+	SeriesHashes(ctx context.Context, grouping Grouping) ([]uint64, error)
+}
+
+// SeriesHashes returns the hash of each series of the operator for the given grouping.
+// Hashes are indexed by series ID and are computed once, before any steps are processed.
+func SeriesHashes(ctx context.Context, op VectorOperator, grouping Grouping) ([]uint64, error) {
+	if h, ok := op.(HashedOperator); ok {
+		return h.SeriesHashes(ctx, grouping)
+	}
+	series, err := op.Series(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return hashSeries(series, grouping), nil
+}
+
+// HashCache stores the hashes of the series of an operator for each grouping
+// requested by upstream operators.
+type HashCache struct {
+	mu     sync.Mutex
+	hashes map[string][]uint64
+}
+
+// Get returns the hashes of series for the given grouping, computing them on the first call.
+func (c *HashCache) Get(series []labels.Labels, grouping Grouping) []uint64 {
+	return c.GetFunc(grouping, func() []uint64 { return hashSeries(series, grouping) })
+}
+
+// GetFunc returns the hashes cached for the given grouping, calling compute on the first call.
+func (c *HashCache) GetFunc(grouping Grouping, compute func() []uint64) []uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := grouping.String()
+	if hashes, ok := c.hashes[key]; ok {
+		return hashes
+	}
+	if c.hashes == nil {
+		c.hashes = make(map[string][]uint64)
+	}
+	hashes := compute()
+	c.hashes[key] = hashes
+	return hashes
+}
+
+func hashSeries(series []labels.Labels, grouping Grouping) []uint64 {
+	buf := make([]byte, 0, 1024)
+	hashes := make([]uint64, len(series))
+	for i, s := range series {
+		hashes[i] = grouping.Hash(s, buf)
+	}
+	return hashes
+}
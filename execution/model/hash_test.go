@@ -0,0 +1,53 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package model_test
+
+import (
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+)
+
+func TestGroupingEqual(t *testing.T) {
+	a := labels.FromStrings("__name__", "foo", "pod", "p1", "zone", "a")
+	b := labels.FromStrings("__name__", "bar", "pod", "p2", "zone", "a")
+
+	testutil.Assert(t, model.Grouping{Labels: []string{"zone"}}.Equal(a, b))
+	testutil.Assert(t, !model.Grouping{Labels: []string{"pod", "zone"}}.Equal(a, b))
+	testutil.Assert(t, model.Grouping{Without: true, Labels: []string{"pod"}}.Equal(a, b))
+	testutil.Assert(t, !model.Grouping{Without: true}.Equal(a, b))
+	// Labels missing from one of the series do not match empty grouping labels.
+	testutil.Assert(t, !model.Grouping{Without: true, Labels: []string{"pod"}}.Equal(a, labels.FromStrings("zone", "a", "region", "eu")))
+	testutil.Assert(t, model.Grouping{Without: true, Labels: []string{"pod"}}.Equal(a, model.MarkDropName(b)))
+}
+
+func TestGroupingHasMetricName(t *testing.T) {
+	testutil.Assert(t, model.Grouping{Labels: []string{"__name__", "zone"}}.HasMetricName())
+	testutil.Assert(t, !model.Grouping{Labels: []string{"zone"}}.HasMetricName())
+	testutil.Assert(t, !model.Grouping{Without: true, Labels: []string{"__name__"}}.HasMetricName())
+}
+
+func TestGroupsHashCollision(t *testing.T) {
+	groups := model.NewGroups(model.Grouping{Labels: []string{"zone"}})
+	series := []labels.Labels{
+		labels.FromStrings("pod", "p1", "zone", "a"),
+		labels.FromStrings("pod", "p2", "zone", "b"),
+		labels.FromStrings("pod", "p3", "zone", "a"),
+		labels.FromStrings("pod", "p4", "zone", "b"),
+		labels.FromStrings("pod", "p5", "zone", "c"),
+	}
+	// All series have the same hash, as if the hashes of their zones collided.
+	var ids []int
+	var existing []bool
+	for _, s := range series {
+		id, ok := groups.Get(0, s)
+		ids = append(ids, id)
+		existing = append(existing, ok)
+	}
+	testutil.Equals(t, []int{0, 1, 0, 1, 2}, ids)
+	testutil.Equals(t, []bool{false, false, true, true, false}, existing)
+}
@@ -0,0 +1,41 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package model
+
+import "github.com/prometheus/prometheus/model/labels"
+
+// DropNameLabel marks series whose metric name is removed once the query is evaluated.
+// When metric names are removed lazily, functions which drop the metric name add this
+// label instead, so that the name can still be matched and grouped on by later operators.
+// The label is ignored by groupings and removed together with the metric name.
+const DropNameLabel = "__drop_name__"
+
+// MarkDropName returns a copy of l which is marked for metric name removal.
+// Series without a metric name are returned as they are.
+func MarkDropName(l labels.Labels) labels.Labels {
+	if !l.Has(labels.MetricName) {
+		return l
+	}
+	return labels.NewBuilder(l).Set(DropNameLabel, "true").Labels()
+}
+
+// RemoveMarkedNames removes the metric name from series marked with DropNameLabel.
+// Marked series are replaced in a copy of series, which is returned.
+func RemoveMarkedNames(series []labels.Labels) []labels.Labels {
+	var result []labels.Labels
+	for i, s := range series {
+		if !s.Has(DropNameLabel) {
+			continue
+		}
+		if result == nil {
+			result = make([]labels.Labels, len(series))
+			copy(result, series)
+		}
+		result[i] = labels.NewBuilder(s).Del(labels.MetricName, DropNameLabel).Labels()
+	}
+	if result == nil {
+		return series
+	}
+	return result
+}
@@ -20,3 +20,14 @@ func UnsupportedOperationErr(op parser.ItemType) error {
 }
 
 var ErrNotImplemented = errors.New("expression not implemented")
+
+const (
+	HistogramSampleType = "histogram"
+	FloatSampleType     = "float"
+)
+
+// IncompatibleTypesErr returns the annotation for samples which are dropped because
+// the operator is not defined between their types.
+func IncompatibleTypesErr(op parser.ItemType, lhsType, rhsType string) error {
+	return errors.Newf("PromQL info: incompatible sample types encountered for binary operator %q: %s %s %s", parser.ItemTypeStr[op], lhsType, parser.ItemTypeStr[op], rhsType)
+}
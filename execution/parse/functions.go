@@ -13,9 +13,55 @@ var Functions = map[string]*parser.Function{
 		ArgTypes:   []parser.ValueType{parser.ValueTypeMatrix},
 		ReturnType: parser.ValueTypeVector,
 	},
+	"xsmoothincrease": {
+		Name:       "xsmoothincrease",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeMatrix},
+		ReturnType: parser.ValueTypeVector,
+	},
 	"xrate": {
 		Name:       "xrate",
 		ArgTypes:   []parser.ValueType{parser.ValueTypeMatrix},
 		ReturnType: parser.ValueTypeVector,
 	},
 }
+
+// ExperimentalFunctions are functions which are only available when experimental functions are enabled.
+var ExperimentalFunctions = map[string]*parser.Function{
+	"mad_over_time": {
+		Name:       "mad_over_time",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeMatrix},
+		ReturnType: parser.ValueTypeVector,
+	},
+	"first_over_time": {
+		Name:       "first_over_time",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeMatrix},
+		ReturnType: parser.ValueTypeVector,
+	},
+	"ts_of_max_over_time": {
+		Name:       "ts_of_max_over_time",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeMatrix},
+		ReturnType: parser.ValueTypeVector,
+	},
+	"ts_of_min_over_time": {
+		Name:       "ts_of_min_over_time",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeMatrix},
+		ReturnType: parser.ValueTypeVector,
+	},
+	"ts_of_last_over_time": {
+		Name:       "ts_of_last_over_time",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeMatrix},
+		ReturnType: parser.ValueTypeVector,
+	},
+	"sort_by_label": {
+		Name:       "sort_by_label",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeVector, parser.ValueTypeString},
+		Variadic:   -1,
+		ReturnType: parser.ValueTypeVector,
+	},
+	"sort_by_label_desc": {
+		Name:       "sort_by_label_desc",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeVector, parser.ValueTypeString},
+		Variadic:   -1,
+		ReturnType: parser.ValueTypeVector,
+	},
+}
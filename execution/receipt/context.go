@@ -0,0 +1,106 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package receipt
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+type receiptKey string
+
+const key receiptKey = "promql-receipt"
+
+// Receipt summarizes what a query touched while it was executed.
+type Receipt struct {
+	// Selectors is the number of vector and matrix selectors evaluated against storage.
+	Selectors int64
+	// Shards is the number of shards in which the selectors were evaluated.
+	Shards int64
+	// Series is the number of series loaded by the selectors.
+	Series int64
+	// Samples is the number of samples read by the selectors.
+	Samples int64
+	// RemoteQueries is the number of queries executed against remote engines.
+	RemoteQueries int64
+}
+
+func (r Receipt) String() string {
+	return fmt.Sprintf(
+		"query touched %d selectors in %d shards, %d series, %d samples and %d remote engine queries",
+		r.Selectors, r.Shards, r.Series, r.Samples, r.RemoteQueries,
+	)
+}
+
+type receipt struct {
+	selectors     atomic.Int64
+	shards        atomic.Int64
+	series        atomic.Int64
+	samples       atomic.Int64
+	remoteQueries atomic.Int64
+}
+
+// NewContext returns a context which records what operators
+// touch while a query is executed.
+func NewContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, key, &receipt{})
+}
+
+// Detach returns a context in which nothing is recorded. It is used by operators
+// whose work is already accounted for elsewhere, such as selectors over remote results.
+func Detach(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(key).(*receipt); !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, key, nil)
+}
+
+// AddShard records a selector shard which loaded the given number of series.
+// The first shard of a selector also records the selector itself.
+func AddShard(shard, series int, ctx context.Context) {
+	r, ok := ctx.Value(key).(*receipt)
+	if !ok {
+		return
+	}
+	if shard == 0 {
+		r.selectors.Add(1)
+	}
+	r.shards.Add(1)
+	r.series.Add(int64(series))
+}
+
+// AddSamples records n samples read by a selector.
+func AddSamples(n int, ctx context.Context) {
+	r, ok := ctx.Value(key).(*receipt)
+	if !ok {
+		return
+	}
+	r.samples.Add(int64(n))
+}
+
+// AddRemoteQuery records a query executed against a remote engine.
+func AddRemoteQuery(ctx context.Context) {
+	r, ok := ctx.Value(key).(*receipt)
+	if !ok {
+		return
+	}
+	r.remoteQueries.Add(1)
+}
+
+// FromContext returns the receipt recorded in the context.
+// The second return value is false when receipts are not enabled.
+func FromContext(ctx context.Context) (Receipt, bool) {
+	r, ok := ctx.Value(key).(*receipt)
+	if !ok {
+		return Receipt{}, false
+	}
+	return Receipt{
+		Selectors:     r.selectors.Load(),
+		Shards:        r.shards.Load(),
+		Series:        r.series.Load(),
+		Samples:       r.samples.Load(),
+		RemoteQueries: r.remoteQueries.Load(),
+	}, true
+}
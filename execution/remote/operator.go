@@ -7,39 +7,55 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
+	"github.com/efficientgo/core/errors"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql"
 
+	"github.com/thanos-community/promql-engine/api"
 	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/execution/receipt"
 	"github.com/thanos-community/promql-engine/execution/scan"
 	engstore "github.com/thanos-community/promql-engine/execution/storage"
+	"github.com/thanos-community/promql-engine/execution/warnings"
 	"github.com/thanos-community/promql-engine/query"
 )
 
+// QueryFunc creates a remote query. It is called for every retried or hedged attempt of the query.
+type QueryFunc func() (promql.Query, error)
+
+// ReplanFunc is called after a remote query has been executed. It returns a function creating
+// a replacement query if the executed query was planned with stale information about the remote
+// engine, or nil if the results of the executed query can be used.
+type ReplanFunc func(executed promql.Query) (QueryFunc, error)
+
 type Execution struct {
+	once           sync.Once
 	storage        *storageAdapter
 	query          promql.Query
 	opts           *query.Options
 	vectorSelector model.VectorOperator
 }
 
-func NewExecution(query promql.Query, pool *model.VectorPool, opts *query.Options) *Execution {
-	storage := newStorageFromQuery(query, opts)
+// NewExecution creates an operator which returns the result of the remote query. Attempts
+// of the query after the first one are created with newQuery.
+func NewExecution(query promql.Query, newQuery QueryFunc, pool *model.VectorPool, opts *query.Options, replan ReplanFunc) *Execution {
+	storage := newStorageFromQuery(query, newQuery, opts, replan)
 	return &Execution{
 		storage:        storage,
 		query:          query,
 		opts:           opts,
-		vectorSelector: scan.NewVectorSelector(pool, storage, opts, 0, 0, 1),
+		vectorSelector: scan.NewVectorSelector(pool, storage, opts, 0, false, nil, 0, 1),
 	}
 }
 
 func (e *Execution) Series(ctx context.Context) ([]labels.Labels, error) {
-	return e.vectorSelector.Series(ctx)
+	return e.vectorSelector.Series(e.selectorContext(ctx))
 }
 
 func (e *Execution) Next(ctx context.Context) ([]model.StepVector, error) {
-	next, err := e.vectorSelector.Next(ctx)
+	next, err := e.vectorSelector.Next(e.selectorContext(ctx))
 	if next == nil {
 		// Closing the storage prematurely can lead to results from the query
 		// engine to be recycled. Because of this, we close the storage only
@@ -49,6 +65,13 @@ func (e *Execution) Next(ctx context.Context) ([]model.StepVector, error) {
 	return next, err
 }
 
+// selectorContext records the remote query in the receipt of the context, and returns a context
+// in which the selector over the remote results does not count as a selector of the query.
+func (e *Execution) selectorContext(ctx context.Context) context.Context {
+	e.once.Do(func() { receipt.AddRemoteQuery(ctx) })
+	return receipt.Detach(ctx)
+}
+
 func (e *Execution) GetPool() *model.VectorPool {
 	return e.vectorSelector.GetPool()
 }
@@ -58,23 +81,34 @@ func (e *Execution) Explain() (me string, next []model.VectorOperator) {
 }
 
 type storageAdapter struct {
-	query promql.Query
-	opts  *query.Options
+	query    promql.Query
+	newQuery QueryFunc
+	opts     *query.Options
+	replan   ReplanFunc
+	// token is the idempotency token of the query, which is kept when the query is retried.
+	token string
 
 	once   sync.Once
 	err    error
 	series []engstore.SignedSeries
 }
 
-func newStorageFromQuery(query promql.Query, opts *query.Options) *storageAdapter {
+func newStorageFromQuery(query promql.Query, newQuery QueryFunc, opts *query.Options, replan ReplanFunc) *storageAdapter {
 	return &storageAdapter{
-		query: query,
-		opts:  opts,
+		query:    query,
+		newQuery: newQuery,
+		opts:     opts,
+		replan:   replan,
+		token:    api.NewIdempotencyToken(),
 	}
 }
 
 func (s *storageAdapter) Matchers() []*labels.Matcher { return nil }
 
+func (s *storageAdapter) EstimateSeries(_ context.Context) (engstore.SeriesEstimate, bool, error) {
+	return engstore.SeriesEstimate{}, false, nil
+}
+
 func (s *storageAdapter) GetSeries(ctx context.Context, _, _ int) ([]engstore.SignedSeries, error) {
 	s.once.Do(func() { s.executeQuery(ctx) })
 	if s.err != nil {
@@ -85,7 +119,47 @@ func (s *storageAdapter) GetSeries(ctx context.Context, _, _ int) ([]engstore.Si
 }
 
 func (s *storageAdapter) executeQuery(ctx context.Context) {
-	result := s.query.Exec(ctx)
+	if s.opts.RemoteTimeout > 0 {
+		queryCtx, cancel := context.WithTimeout(ctx, s.opts.RemoteTimeout)
+		defer cancel()
+
+		s.executeQueryWithContext(queryCtx)
+		if s.err != nil && queryCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+			// The query proceeds without the results of the engine.
+			warnings.AddToContext(errors.Newf("remote query %q was abandoned after a timeout of %s", s.query, s.opts.RemoteTimeout), ctx)
+			s.err = nil
+			s.series = nil
+		}
+		return
+	}
+	s.executeQueryWithContext(ctx)
+}
+
+func (s *storageAdapter) executeQueryWithContext(ctx context.Context) {
+	result := s.execWithRetries(ctx)
+	if result.Err == nil && s.replan != nil {
+		replacement, err := s.replan(s.query)
+		if err != nil {
+			s.err = err
+			return
+		}
+		if replacement != nil {
+			query, err := replacement()
+			if err != nil {
+				s.err = err
+				return
+			}
+			s.query.Close()
+			s.query = query
+			s.newQuery = replacement
+			// The replacement covers a different time range, so it is a new request.
+			s.token = api.NewIdempotencyToken()
+			result = s.execWithRetries(ctx)
+		}
+	}
+	for _, w := range result.Warnings {
+		warnings.AddToContext(w, ctx)
+	}
 	if result.Err != nil {
 		s.err = result.Err
 		return
@@ -114,6 +188,88 @@ func (s *storageAdapter) executeQuery(ctx context.Context) {
 	}
 }
 
+// execWithRetries executes the query and retries it with backoff while it fails with a transient error,
+// as determined by api.IsTransient and the retry policy of the query. Retries are executed with the same
+// idempotency token. The query is replaced with the attempt whose result is returned, and the other
+// attempts are closed.
+func (s *storageAdapter) execWithRetries(ctx context.Context) *promql.Result {
+	policy := s.opts.RetryPolicy
+	for retry := 1; ; retry++ {
+		result := s.execHedged(ctx)
+		if result.Err == nil || !api.IsTransient(result.Err) || retry >= policy.MaxAttempts || ctx.Err() != nil {
+			return result
+		}
+
+		timer := time.NewTimer(policy.Backoff(retry))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return result
+		case <-timer.C:
+		}
+
+		query, err := s.newQuery()
+		if err != nil {
+			return &promql.Result{Err: err}
+		}
+		s.query.Close()
+		s.query = query
+	}
+}
+
+type attempt struct {
+	query  promql.Query
+	result *promql.Result
+}
+
+// execHedged executes the query and, if it has not completed within the hedge delay of the
+// retry policy, a second attempt of the query. The result of the first successful attempt is
+// returned, and the other attempt is canceled. Both attempts are executed at the same time,
+// so the hedged attempt is a separate request with an idempotency token of its own.
+func (s *storageAdapter) execHedged(ctx context.Context) *promql.Result {
+	delay := s.opts.RetryPolicy.HedgeDelay
+	if delay <= 0 || s.newQuery == nil {
+		return s.query.Exec(api.WithIdempotencyToken(ctx, s.token))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	attempts := make(chan attempt, 2)
+	exec := func(query promql.Query, token string) {
+		attempts <- attempt{query: query, result: query.Exec(api.WithIdempotencyToken(ctx, token))}
+	}
+	go exec(s.query, s.token)
+	pending := 1
+
+	timer := time.NewTimer(delay)
+	select {
+	case a := <-attempts:
+		timer.Stop()
+		return a.result
+	case <-timer.C:
+		// The first attempt keeps running on its own if the hedged query cannot be created.
+		if hedged, err := s.newQuery(); err == nil {
+			go exec(hedged, api.NewIdempotencyToken())
+			pending++
+		}
+	}
+
+	a := <-attempts
+	pending--
+	if a.result.Err != nil && pending > 0 {
+		a.query.Close()
+		a = <-attempts
+		pending--
+	}
+	if pending > 0 {
+		// Queries can only be closed once they are executed.
+		go func() { (<-attempts).query.Close() }()
+	}
+	s.query = a.query
+	return a.result
+}
+
 func (s *storageAdapter) Close() {
 	s.query.Close()
 }
@@ -0,0 +1,295 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package remote
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/thanos-community/promql-engine/api"
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/execution/receipt"
+	"github.com/thanos-community/promql-engine/execution/warnings"
+	"github.com/thanos-community/promql-engine/query"
+)
+
+// StreamingExecution is an operator which returns the result of a remote query that is streamed
+// in batches of steps. Only the steps of the current batch are held in memory, instead of the full
+// result of the query.
+//
+// Retries apply until the stream is opened. The remote timeout applies to the whole stream: if it
+// expires before the stream is opened, the query proceeds without the results of the engine, and
+// if it expires while the result is streamed, the query fails. Errors while the result is streamed
+// fail the query, since the steps which were already returned cannot be retried.
+// Streamed queries are not hedged.
+type StreamingExecution struct {
+	query    api.StreamingQuery
+	newQuery QueryFunc
+	replan   ReplanFunc
+	pool     *model.VectorPool
+	opts     *query.Options
+	// token is the idempotency token of the query, which is kept when the query is retried.
+	token string
+
+	once   sync.Once
+	err    error
+	stream api.ResultStream
+	series []labels.Labels
+	// deadline is the time at which the remote timeout expires, if the query has one.
+	deadline time.Time
+	// cancel cancels the context of the stream once it is closed.
+	cancel context.CancelFunc
+
+	steps       query.Steps
+	numSteps    int
+	maxt        int64
+	currentStep int64
+	// pending are the streamed steps which were not returned yet.
+	pending   []api.StepSamples
+	exhausted bool
+}
+
+// NewStreamingExecution creates an operator which returns the streamed result of the remote query.
+// Attempts of the query after the first one are created with newQuery.
+func NewStreamingExecution(query api.StreamingQuery, newQuery QueryFunc, pool *model.VectorPool, opts *query.Options, replan ReplanFunc) *StreamingExecution {
+	return &StreamingExecution{
+		query:    query,
+		newQuery: newQuery,
+		replan:   replan,
+		pool:     pool,
+		opts:     opts,
+		token:    api.NewIdempotencyToken(),
+
+		steps:       opts.Steps(),
+		numSteps:    opts.NumSteps(),
+		maxt:        opts.End.UnixMilli(),
+		currentStep: opts.Start.UnixMilli(),
+	}
+}
+
+func (e *StreamingExecution) Series(ctx context.Context) ([]labels.Labels, error) {
+	if err := e.open(ctx); err != nil {
+		return nil, err
+	}
+	return e.series, nil
+}
+
+func (e *StreamingExecution) Next(ctx context.Context) ([]model.StepVector, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	if e.currentStep > e.maxt {
+		return nil, nil
+	}
+	if err := e.open(ctx); err != nil {
+		return nil, err
+	}
+
+	vectors := e.pool.GetVectorBatch()
+	for i := 0; i < e.numSteps && e.currentStep <= e.maxt; i++ {
+		vector := e.pool.GetStepVector(e.currentStep)
+		step, ok, err := e.nextStep(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			for j, id := range step.SampleIDs {
+				vector.AppendSample(e.pool, id, step.Samples[j])
+			}
+			for j, id := range step.HistogramIDs {
+				vector.AppendHistogram(e.pool, id, step.Histograms[j])
+			}
+		}
+		vectors = append(vectors, vector)
+		e.currentStep = e.steps.Next(e.currentStep)
+	}
+	if e.currentStep > e.maxt {
+		e.close(ctx)
+	}
+	return vectors, nil
+}
+
+// nextStep returns the streamed samples at the current step, if there are any.
+// Batches are read from the stream until it reaches the current step.
+func (e *StreamingExecution) nextStep(ctx context.Context) (api.StepSamples, bool, error) {
+	for {
+		for len(e.pending) > 0 && e.pending[0].T < e.currentStep {
+			e.pending = e.pending[1:]
+		}
+		if len(e.pending) > 0 {
+			if e.pending[0].T > e.currentStep {
+				return api.StepSamples{}, false, nil
+			}
+			step := e.pending[0]
+			e.pending = e.pending[1:]
+			return step, true, nil
+		}
+		if e.stream == nil || e.exhausted {
+			return api.StepSamples{}, false, nil
+		}
+
+		batch, err := e.nextBatch(ctx)
+		if err != nil {
+			return api.StepSamples{}, false, err
+		}
+		if batch == nil {
+			e.exhausted = true
+		}
+		e.pending = batch
+	}
+}
+
+// nextBatch reads the next batch from the stream before the remote timeout expires.
+func (e *StreamingExecution) nextBatch(ctx context.Context) ([]api.StepSamples, error) {
+	if e.deadline.IsZero() {
+		return e.stream.Next(ctx)
+	}
+
+	readCtx, cancel := context.WithDeadline(ctx, e.deadline)
+	defer cancel()
+
+	batch, err := e.stream.Next(readCtx)
+	// The stream can also fail on its own context, which expires at the same deadline.
+	if err != nil && !time.Now().Before(e.deadline) && ctx.Err() == nil {
+		return nil, errors.Wrapf(err, "remote query %q exceeded the timeout of %s while its result was streamed", e.query, e.opts.RemoteTimeout)
+	}
+	return batch, err
+}
+
+// open opens the stream of the query once, and records the remote query in the receipt of the context.
+func (e *StreamingExecution) open(ctx context.Context) error {
+	e.once.Do(func() {
+		receipt.AddRemoteQuery(ctx)
+		e.err = e.openWithTimeout(ctx)
+	})
+	return e.err
+}
+
+func (e *StreamingExecution) openWithTimeout(ctx context.Context) error {
+	if e.opts.RemoteTimeout <= 0 {
+		return e.openStream(ctx)
+	}
+
+	// Streams can read their result with the context they were opened with,
+	// so it is only canceled once the stream is closed.
+	e.deadline = time.Now().Add(e.opts.RemoteTimeout)
+	streamCtx, cancel := context.WithDeadline(ctx, e.deadline)
+
+	err := e.openStream(streamCtx)
+	if err == nil {
+		e.cancel = cancel
+		return nil
+	}
+	cancel()
+	if streamCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		// The query proceeds without the results of the engine.
+		warnings.AddToContext(errors.Newf("remote query %q was abandoned after a timeout of %s", e.query, e.opts.RemoteTimeout), ctx)
+		return nil
+	}
+	return err
+}
+
+func (e *StreamingExecution) openStream(ctx context.Context) error {
+	if err := e.streamWithRetries(ctx); err != nil {
+		return err
+	}
+	if e.replan != nil {
+		replacement, err := e.replan(e.query)
+		if err != nil {
+			return err
+		}
+		if replacement != nil {
+			e.stream.Close()
+			e.stream = nil
+			if err := e.replaceQuery(replacement); err != nil {
+				return err
+			}
+			e.newQuery = replacement
+			// The replacement covers a different time range, so it is a new request.
+			e.token = api.NewIdempotencyToken()
+			if err := e.streamWithRetries(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	e.series = e.stream.Series()
+	return nil
+}
+
+// streamWithRetries opens the stream of the query and retries it with backoff while it fails with a transient
+// error, as determined by api.IsTransient and the retry policy of the query. Retries are executed with the same
+// idempotency token.
+func (e *StreamingExecution) streamWithRetries(ctx context.Context) error {
+	policy := e.opts.RetryPolicy
+	for retry := 1; ; retry++ {
+		stream, err := e.query.Stream(api.WithIdempotencyToken(ctx, e.token))
+		if err == nil {
+			e.stream = stream
+			return nil
+		}
+		if !api.IsTransient(err) || retry >= policy.MaxAttempts || ctx.Err() != nil || e.newQuery == nil {
+			return err
+		}
+
+		timer := time.NewTimer(policy.Backoff(retry))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		if err := e.replaceQuery(e.newQuery); err != nil {
+			return err
+		}
+	}
+}
+
+// replaceQuery closes the query and replaces it with a query created by newQuery.
+func (e *StreamingExecution) replaceQuery(newQuery QueryFunc) error {
+	qry, err := newQuery()
+	if err != nil {
+		return err
+	}
+	streaming, ok := qry.(api.StreamingQuery)
+	if !ok {
+		qry.Close()
+		return errors.Newf("remote query %q does not support streaming", qry)
+	}
+	e.query.Close()
+	e.query = streaming
+	return nil
+}
+
+// close adds the warnings of the exhausted stream to the context, closes the stream and the query,
+// and cancels the context of the stream.
+func (e *StreamingExecution) close(ctx context.Context) {
+	if e.stream != nil {
+		for _, w := range e.stream.Warnings() {
+			warnings.AddToContext(w, ctx)
+		}
+		e.stream.Close()
+		e.stream = nil
+	}
+	if e.cancel != nil {
+		e.cancel()
+		e.cancel = nil
+	}
+	e.pending = nil
+	e.query.Close()
+}
+
+func (e *StreamingExecution) GetPool() *model.VectorPool {
+	return e.pool
+}
+
+func (e *StreamingExecution) Explain() (me string, next []model.VectorOperator) {
+	return fmt.Sprintf("[*streamingRemoteExec] %s (%d, %d)", e.query, e.opts.Start.Unix(), e.opts.End.Unix()), nil
+}
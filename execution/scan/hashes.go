@@ -0,0 +1,53 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package scan
+
+import (
+	"context"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+	engstore "github.com/thanos-community/promql-engine/execution/storage"
+)
+
+// seriesHashes computes the grouping hashes of the series of a selector.
+// When the query has a series reference cache and all selected series have
+// stable references, hashes are reused across queries.
+type seriesHashes struct {
+	cache    model.HashCache
+	refCache *engstore.ScopedSeriesRefCache
+	refs     []storage.SeriesRef
+	// droppedName is true when the metric name was removed from the series,
+	// in which case hashes of groupings by the metric name differ from the cached ones.
+	droppedName bool
+}
+
+func (h *seriesHashes) init(ctx context.Context, droppedName bool) {
+	h.refCache = engstore.SeriesRefCacheFromContext(ctx)
+	h.droppedName = droppedName
+}
+
+// add records the references of the next series of the selector.
+func (h *seriesHashes) add(series []engstore.SignedSeries) {
+	if h.refCache == nil {
+		return
+	}
+	refs, ok := engstore.SeriesRefs(series)
+	if !ok {
+		h.refCache, h.refs = nil, nil
+		return
+	}
+	h.refs = append(h.refs, refs...)
+}
+
+func (h *seriesHashes) get(series []labels.Labels, grouping model.Grouping) []uint64 {
+	if h.refCache == nil || (h.droppedName && grouping.HasMetricName()) {
+		return h.cache.Get(series, grouping)
+	}
+	return h.cache.GetFunc(grouping, func() []uint64 {
+		return h.refCache.Hashes(h.refs, series, grouping)
+	})
+}
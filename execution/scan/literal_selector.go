@@ -21,7 +21,7 @@ type numberLiteralSelector struct {
 	numSteps    int
 	mint        int64
 	maxt        int64
-	step        int64
+	steps       query.Steps
 	currentStep int64
 	series      []labels.Labels
 	once        sync.Once
@@ -35,7 +35,7 @@ func NewNumberLiteralSelector(pool *model.VectorPool, opts *query.Options, val f
 		numSteps:    opts.NumSteps(),
 		mint:        opts.Start.UnixMilli(),
 		maxt:        opts.End.UnixMilli(),
-		step:        opts.Step.Milliseconds(),
+		steps:       opts.Steps(),
 		currentStep: opts.Start.UnixMilli(),
 		val:         val,
 	}
@@ -75,15 +75,9 @@ func (o *numberLiteralSelector) Next(ctx context.Context) ([]model.StepVector, e
 		}
 		vectors[currStep].AppendSample(o.vectorPool, 0, o.val)
 
-		ts += o.step
+		ts = o.steps.Next(ts)
 	}
-
-	// For instant queries, set the step to a positive value
-	// so that the operator can terminate.
-	if o.step == 0 {
-		o.step = 1
-	}
-	o.currentStep += o.step * int64(o.numSteps)
+	o.currentStep = o.steps.Advance(o.currentStep, o.numSteps)
 
 	return vectors, nil
 }
@@ -6,21 +6,26 @@ package scan
 import (
 	"context"
 	"fmt"
+	"math"
 	"sort"
 	"sync"
 	"time"
 
+	"github.com/efficientgo/core/errors"
+	prommodel "github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/model/value"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
 
-	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
-
+	"github.com/thanos-community/promql-engine/execution/audit"
 	"github.com/thanos-community/promql-engine/execution/function"
 	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/execution/receipt"
 	engstore "github.com/thanos-community/promql-engine/execution/storage"
+	"github.com/thanos-community/promql-engine/execution/warnings"
+	"github.com/thanos-community/promql-engine/logicalplan"
 	"github.com/thanos-community/promql-engine/query"
 )
 
@@ -29,31 +34,70 @@ type matrixScanner struct {
 	signature       uint64
 	previousSamples []promql.Sample
 	samples         *storage.BufferedSeriesIterator
+	// series is only set in streaming mode, where the iterator of the series is opened
+	// when it is first scanned, and released once the series has no samples left.
+	series storage.Series
 }
 
 type matrixSelector struct {
-	funcExpr *parser.Call
+	funcExpr *logicalplan.FunctionCall
 	storage  engstore.SeriesSelector
 	call     function.FunctionCall
-	scanners []matrixScanner
-	series   []labels.Labels
-	once     sync.Once
+	// scalarArgs are operators for the scalar arguments of the function, in the order of the function arguments.
+	scalarArgs []model.VectorOperator
+	// scalarPoints holds the values of the scalar arguments for each step in the current batch.
+	scalarPoints [][]float64
+	scanners     []matrixScanner
+	hashes       seriesHashes
+	series       []labels.Labels
+	once         sync.Once
 
 	vectorPool *model.VectorPool
 
-	numSteps    int
-	mint        int64
-	maxt        int64
-	step        int64
-	selectRange int64
-	offset      int64
-	currentStep int64
+	numSteps int
+	mint     int64
+	maxt     int64
+	steps    query.Steps
+	// stepInterval is the largest interval between two consecutive steps.
+	stepInterval int64
+	selectRange  int64
+	offset       int64
+	currentStep  int64
 
 	shard     int
 	numShards int
 
 	// Lookback delta for extended range functions.
 	extLookbackDelta int64
+	// maxPoints is the number of most recent points in a range which the function
+	// needs for its result, or which are kept when ranges are truncated.
+	// Zero means that all points are needed.
+	maxPoints int
+	// anyPoint is true when the function only needs to know whether there
+	// is any point in a range, in which case only the last point is selected.
+	anyPoint bool
+	// maxWindowPoints is the largest number of points a range can contain for a single series.
+	// Zero disables the limit.
+	maxWindowPoints int
+	// truncateWindows keeps only the most recent points of ranges which exceed
+	// maxWindowPoints instead of failing the query.
+	truncateWindows bool
+	// truncating is true when maxPoints was lowered to maxWindowPoints, so that
+	// points which are dropped while selecting a range truncate the range.
+	truncating bool
+
+	streaming bool
+	// exhausted replaces the iterators of series which have no samples left in streaming mode.
+	exhausted *storage.BufferedSeriesIterator
+
+	// delayNameRemoval marks series for removing the metric name once the query is evaluated.
+	delayNameRemoval bool
+
+	enableInfoAnnotations bool
+	// Number of evaluated windows with at least one sample, and with exactly
+	// one sample, used to detect ranges which are too short for the scrape interval.
+	sampledWindows      int
+	singleSampleWindows int
 }
 
 // NewMatrixSelector creates operator which selects vector of series over time.
@@ -61,22 +105,31 @@ func NewMatrixSelector(
 	pool *model.VectorPool,
 	selector engstore.SeriesSelector,
 	call function.FunctionCall,
-	funcExpr *parser.Call,
+	funcExpr *logicalplan.FunctionCall,
+	scalarArgs []model.VectorOperator,
 	opts *query.Options,
 	selectRange, offset time.Duration,
 	shard, numShard int,
 ) model.VectorOperator {
+	maxPoints := lastPointsFunctions[funcExpr.Func.Name]
+	truncating := opts.TruncateWindows && opts.MaxPointsPerWindow > 0 && (maxPoints == 0 || opts.MaxPointsPerWindow < maxPoints)
+	if truncating {
+		maxPoints = opts.MaxPointsPerWindow
+	}
+
 	// TODO(fpetkovski): Add offset parameter.
 	return &matrixSelector{
 		storage:    selector,
 		call:       call,
 		funcExpr:   funcExpr,
+		scalarArgs: scalarArgs,
 		vectorPool: pool,
 
-		numSteps: opts.NumSteps(),
-		mint:     opts.Start.UnixMilli(),
-		maxt:     opts.End.UnixMilli(),
-		step:     opts.Step.Milliseconds(),
+		numSteps:     opts.NumSteps(),
+		mint:         opts.Start.UnixMilli(),
+		maxt:         opts.End.UnixMilli(),
+		steps:        opts.Steps(),
+		stepInterval: opts.Steps().MaxInterval(),
 
 		selectRange: selectRange.Milliseconds(),
 		offset:      offset.Milliseconds(),
@@ -86,13 +139,24 @@ func NewMatrixSelector(
 		numShards: numShard,
 
 		extLookbackDelta: opts.ExtLookbackDelta.Milliseconds(),
+		maxPoints:        maxPoints,
+		anyPoint:         anyPointFunctions[funcExpr.Func.Name],
+		maxWindowPoints:  opts.MaxPointsPerWindow,
+		truncateWindows:  opts.TruncateWindows,
+		truncating:       truncating,
+
+		streaming: opts.EnableStreamingSeries,
+
+		delayNameRemoval: opts.EnableDelayedNameRemoval,
+
+		enableInfoAnnotations: opts.EnableInfoAnnotations,
 	}
 }
 
 func (o *matrixSelector) Explain() (me string, next []model.VectorOperator) {
 	r := time.Duration(o.selectRange) * time.Millisecond
 	if o.call != nil {
-		return fmt.Sprintf("[*matrixSelector] %v({%v}[%s] %v mod %v)", o.funcExpr.Func.Name, o.storage.Matchers(), r, o.shard, o.numShards), nil
+		return fmt.Sprintf("[*matrixSelector] %v({%v}[%s] %v mod %v)", o.funcExpr.Func.Name, o.storage.Matchers(), r, o.shard, o.numShards), o.scalarArgs
 	}
 	return fmt.Sprintf("[*matrixSelector] {%v}[%s] %v mod %v", o.storage.Matchers(), r, o.shard, o.numShards), nil
 }
@@ -104,6 +168,13 @@ func (o *matrixSelector) Series(ctx context.Context) ([]labels.Labels, error) {
 	return o.series, nil
 }
 
+func (o *matrixSelector) SeriesHashes(ctx context.Context, grouping model.Grouping) ([]uint64, error) {
+	if err := o.loadSeries(ctx); err != nil {
+		return nil, err
+	}
+	return o.hashes.get(o.series, grouping), nil
+}
+
 func (o *matrixSelector) GetPool() *model.VectorPool {
 	return o.vectorPool
 }
@@ -116,6 +187,7 @@ func (o *matrixSelector) Next(ctx context.Context) ([]model.StepVector, error) {
 	}
 
 	if o.currentStep > o.maxt {
+		o.reportSmallRange(ctx)
 		return nil, nil
 	}
 
@@ -123,13 +195,21 @@ func (o *matrixSelector) Next(ctx context.Context) ([]model.StepVector, error) {
 		return nil, err
 	}
 
+	if err := o.loadScalarPoints(ctx); err != nil {
+		return nil, err
+	}
+
+	var numSamples int
 	vectors := o.vectorPool.GetVectorBatch()
 	ts := o.currentStep
 	for i := 0; i < len(o.scanners); i++ {
 		var (
-			series   = o.scanners[i]
+			series   = &o.scanners[i]
 			seriesTs = ts
 		)
+		if o.streaming && series.samples == nil {
+			series.samples = storage.NewBufferIterator(series.series.Iterator(nil), o.bufferRange())
+		}
 
 		for currStep := 0; currStep < o.numSteps && seriesTs <= o.maxt; currStep++ {
 			if len(vectors) <= currStep {
@@ -138,29 +218,60 @@ func (o *matrixSelector) Next(ctx context.Context) ([]model.StepVector, error) {
 			maxt := seriesTs - o.offset
 			mint := maxt - o.selectRange
 
-			var rangeSamples []promql.Sample
-			var err error
+			var (
+				rangeSamples []promql.Sample
+				dropped      bool
+				err          error
+			)
+			// Ranges which exceed the window limit stop being selected at the first point over the limit,
+			// unless they are truncated, in which case only the most recent points are kept while selecting.
+			limit := 0
+			if !o.truncateWindows {
+				limit = o.maxWindowPoints
+			}
 
-			if function.IsExtFunction(o.funcExpr.Func.Name) {
-				rangeSamples, err = selectExtPoints(series.samples, mint, maxt, o.scanners[i].previousSamples, o.funcExpr.Func.Name, o.extLookbackDelta)
+			if o.anyPoint {
+				rangeSamples, err = selectLastPoint(series.samples, mint, maxt, o.scanners[i].previousSamples)
+			} else if function.IsExtFunction(o.funcExpr.Func.Name) {
+				rangeSamples, dropped, err = selectExtPoints(series.samples, mint, maxt, o.scanners[i].previousSamples, o.funcExpr.Func.Name, o.extLookbackDelta, o.maxPoints, limit)
 			} else {
-				rangeSamples, err = selectPoints(series.samples, mint, maxt, o.scanners[i].previousSamples)
+				rangeSamples, dropped, err = selectPoints(series.samples, mint, maxt, o.scanners[i].previousSamples, o.maxPoints, limit)
 			}
 
 			if err != nil {
 				return nil, err
 			}
+			if limit > 0 && len(rangeSamples) > limit {
+				return nil, errors.Newf(
+					"range of %s for series %s contains more than %d points, which exceeds the limit of points per window",
+					o.funcExpr.Func.Name, series.labels, o.maxWindowPoints,
+				)
+			}
+			if o.truncating && dropped {
+				warnings.AddToContext(errors.Newf(
+					"PromQL warning: ranges of %s contain more than %d points for some series, only the most recent points were used",
+					o.funcExpr.Func.Name, o.maxWindowPoints,
+				), ctx)
+			}
+			numSamples += len(rangeSamples)
+			if len(rangeSamples) > 0 {
+				o.sampledWindows++
+				if len(rangeSamples) == 1 {
+					o.singleSampleWindows++
+				}
+			}
 
 			// TODO(saswatamcode): Handle multi-arg functions for matrixSelectors.
 			// Also, allow operator to exist independently without being nested
 			// under parser.Call by implementing new data model.
 			// https://github.com/thanos-community/promql-engine/issues/39
 			result := o.call(function.FunctionArgs{
-				Labels:      series.labels,
-				Samples:     rangeSamples,
-				StepTime:    seriesTs,
-				SelectRange: o.selectRange,
-				Offset:      o.offset,
+				Labels:       series.labels,
+				Samples:      rangeSamples,
+				StepTime:     seriesTs,
+				SelectRange:  o.selectRange,
+				ScalarPoints: o.scalarPoints[currStep],
+				Offset:       o.offset,
 			})
 
 			if result.T != function.InvalidSample.T {
@@ -176,64 +287,193 @@ func (o *matrixSelector) Next(ctx context.Context) ([]model.StepVector, error) {
 
 			// Only buffer stepRange milliseconds from the second step on.
 			stepRange := o.selectRange
-			if stepRange > o.step {
-				stepRange = o.step
+			if stepRange > o.stepInterval {
+				stepRange = o.stepInterval
 			}
 			series.samples.ReduceDelta(stepRange)
 
-			seriesTs += o.step
+			seriesTs = o.steps.Next(seriesTs)
+		}
+		if o.streaming {
+			if err := o.releaseExhausted(series, seriesTs); err != nil {
+				return nil, err
+			}
 		}
 	}
-	// For instant queries, set the step to a positive value
-	// so that the operator can terminate.
-	if o.step == 0 {
-		o.step = 1
-	}
-	o.currentStep += o.step * int64(o.numSteps)
+	receipt.AddSamples(numSamples, ctx)
+	o.currentStep = o.steps.Advance(o.currentStep, o.numSteps)
 
 	return vectors, nil
 }
 
+// loadScalarPoints reads the values of the scalar arguments for the next batch of steps.
+// Steps for which an argument has no value get a NaN value for it.
+func (o *matrixSelector) loadScalarPoints(ctx context.Context) error {
+	if o.scalarPoints == nil {
+		o.scalarPoints = make([][]float64, o.numSteps)
+		for i := range o.scalarPoints {
+			o.scalarPoints[i] = make([]float64, len(o.scalarArgs))
+		}
+	}
+	for i, arg := range o.scalarArgs {
+		args, err := arg.Next(ctx)
+		if err != nil {
+			return err
+		}
+		for step := range o.scalarPoints {
+			o.scalarPoints[step][i] = math.NaN()
+			if step < len(args) && len(args[step].Samples) > 0 {
+				o.scalarPoints[step][i] = args[step].Samples[0]
+			}
+		}
+		for _, vector := range args {
+			arg.GetPool().PutStepVector(vector)
+		}
+		arg.GetPool().PutVectors(args)
+	}
+	if len(o.scanners) == 0 {
+		return nil
+	}
+	for _, points := range o.scalarPoints {
+		if err := function.ValidateScalarArgs(o.funcExpr.Func.Name, points); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reportSmallRange adds an informational annotation when most evaluated windows of rate
+// or increase contained a single sample, in which case no value could be calculated for them.
+func (o *matrixSelector) reportSmallRange(ctx context.Context) {
+	if !o.enableInfoAnnotations {
+		return
+	}
+	if o.funcExpr.Func.Name != "rate" && o.funcExpr.Func.Name != "increase" {
+		return
+	}
+	if o.singleSampleWindows*2 <= o.sampledWindows {
+		return
+	}
+	r := time.Duration(o.selectRange) * time.Millisecond
+	warnings.AddToContext(errors.Newf(
+		"PromQL info: range [%s] of %s contains fewer than two samples for most series, consider using a larger range",
+		prommodel.Duration(r), o.funcExpr.Func.Name,
+	), ctx)
+	o.sampledWindows, o.singleSampleWindows = 0, 0
+}
+
 func (o *matrixSelector) loadSeries(ctx context.Context) error {
 	var err error
 	o.once.Do(func() {
-		series, loadErr := o.storage.GetSeries(ctx, o.shard, o.numShards)
-		if loadErr != nil {
-			err = loadErr
+		dropName := !function.KeepsMetricName(o.funcExpr.Func.Name) && !o.delayNameRemoval
+		o.hashes.init(ctx, dropName)
+		if o.streaming {
+			o.exhausted = storage.NewBufferIterator(chunkenc.NewNopIterator(), 0)
+			err = engstore.GetSeriesBatches(ctx, o.storage, o.shard, o.numShards, seriesBatchSize, func(series []engstore.SignedSeries) error {
+				o.addSeries(ctx, series)
+				return nil
+			})
+		} else {
+			var series []engstore.SignedSeries
+			if series, err = o.storage.GetSeries(ctx, o.shard, o.numShards); err == nil {
+				o.scanners = make([]matrixScanner, 0, len(series))
+				o.series = make([]labels.Labels, 0, len(series))
+				o.addSeries(ctx, series)
+			}
+		}
+		if err != nil {
 			return
 		}
+		receipt.AddShard(o.shard, len(o.series), ctx)
+		o.vectorPool.SetStepSize(len(o.series))
+	})
+	return err
+}
 
-		o.scanners = make([]matrixScanner, len(series))
-		o.series = make([]labels.Labels, len(series))
-		for i, s := range series {
-			lbls := s.Labels()
-			if o.funcExpr.Func.Name != "last_over_time" {
-				// This modifies the array in place. Because labels.Labels
-				// can be re-used between different Select() calls, it means that
-				// we have to copy it here.
-				// TODO(GiedriusS): could we identify somehow whether labels.Labels
-				// is reused between Select() calls?
-				lbls, _ = function.DropMetricName(lbls.Copy())
-			}
+func (o *matrixSelector) addSeries(ctx context.Context, series []engstore.SignedSeries) {
+	dropName := !function.KeepsMetricName(o.funcExpr.Func.Name) && !o.delayNameRemoval
+	markName := !function.KeepsMetricName(o.funcExpr.Func.Name) && o.delayNameRemoval
+
+	offset := len(o.hashes.refs)
+	o.hashes.add(series)
+	var numCopies, numSorts int
+	for i, s := range series {
+		lbls := s.Labels()
+		switch {
+		case dropName && o.hashes.refCache != nil:
+			// Labels without the metric name are reused from previous queries.
+			lbls = o.hashes.refCache.DropMetricName(o.hashes.refs[offset+i], lbls)
+		case dropName:
+			// This modifies the array in place. Because labels.Labels
+			// can be re-used between different Select() calls, it means that
+			// we have to copy it here.
+			// TODO(GiedriusS): could we identify somehow whether labels.Labels
+			// is reused between Select() calls?
+			lbls, _ = function.DropMetricName(lbls.Copy())
+			numCopies++
+			sort.Sort(lbls)
+			numSorts++
+		case markName:
+			// Marking the metric name copies the labels.
+			lbls = model.MarkDropName(lbls)
+			numCopies++
+		default:
+			sort.Sort(lbls)
+			numSorts++
+		}
 
-			// If we are dealing with an extended range function we need to search further in the past for valid series.
-			var selectRange = o.selectRange
-			if function.IsExtFunction(o.funcExpr.Func.Name) {
-				selectRange += o.extLookbackDelta
-			}
+		scanner := matrixScanner{
+			labels:    lbls,
+			signature: s.Signature,
+		}
+		if o.streaming {
+			scanner.series = s.Series
+		} else {
+			scanner.samples = storage.NewBufferIterator(s.Iterator(nil), o.bufferRange())
+		}
+		o.scanners = append(o.scanners, scanner)
+		o.series = append(o.series, lbls)
+	}
+	audit.AddLabelCopies(numCopies, ctx)
+	audit.AddLabelSorts(numSorts, ctx)
+}
 
-			sort.Sort(lbls)
+// bufferRange returns the range of samples buffered for each series.
+// Extended range functions need to search further in the past for valid samples.
+func (o *matrixSelector) bufferRange() int64 {
+	if function.IsExtFunction(o.funcExpr.Func.Name) {
+		return o.selectRange + o.extLookbackDelta
+	}
+	return o.selectRange
+}
 
-			o.scanners[i] = matrixScanner{
-				labels:    lbls,
-				signature: s.Signature,
-				samples:   storage.NewBufferIterator(s.Iterator(nil), selectRange),
+// releaseExhausted releases the iterator of a series in streaming mode when the
+// ranges of the steps from ts on contain no sample of the series.
+func (o *matrixSelector) releaseExhausted(s *matrixScanner, ts int64) error {
+	if s.series == nil {
+		return nil
+	}
+	if ts <= o.maxt {
+		maxt := ts - o.offset
+		mint := maxt - o.bufferRange()
+		if s.samples.Seek(maxt) != chunkenc.ValNone {
+			return nil
+		}
+		if err := s.samples.Err(); err != nil {
+			return err
+		}
+		if n := len(s.previousSamples); n > 0 && s.previousSamples[n-1].T >= mint {
+			return nil
+		}
+		buf := s.samples.Buffer()
+		for buf.Next() != chunkenc.ValNone {
+			if buf.AtT() >= mint {
+				return nil
 			}
-			o.series[i] = lbls
 		}
-		o.vectorPool.SetStepSize(len(series))
-	})
-	return err
+	}
+	s.series, s.samples, s.previousSamples = nil, o.exhausted, nil
+	return nil
 }
 
 // matrixIterSlice populates a matrix vector covering the requested range for a
@@ -244,8 +484,11 @@ func (o *matrixSelector) loadSeries(ctx context.Context) error {
 // values). Any such points falling before mint are discarded; points that fall
 // into the [mint, maxt] range are retained; only points with later timestamps
 // are populated from the iterator.
+// If maxPoints is positive, only the last maxPoints points of the range are kept in out,
+// and the returned bool reports whether older points were dropped. If limit is positive,
+// selection stops as soon as out holds more than limit points.
 // TODO(fpetkovski): Add max samples limit.
-func selectPoints(it *storage.BufferedSeriesIterator, mint, maxt int64, out []promql.Sample) ([]promql.Sample, error) {
+func selectPoints(it *storage.BufferedSeriesIterator, mint, maxt int64, out []promql.Sample, maxPoints, limit int) ([]promql.Sample, bool, error) {
 	if len(out) > 0 && out[len(out)-1].T >= mint {
 		// There is an overlap between previous and current ranges, retain common
 		// points. In most such cases:
@@ -266,10 +509,18 @@ func selectPoints(it *storage.BufferedSeriesIterator, mint, maxt int64, out []pr
 	soughtValueType := it.Seek(maxt)
 	if soughtValueType == chunkenc.ValNone {
 		if it.Err() != nil {
-			return nil, it.Err()
+			return nil, false, it.Err()
 		}
 	}
 
+	var dropped bool
+	add := func(s promql.Sample) bool {
+		var d bool
+		out, d = appendPoint(out, s, maxPoints)
+		dropped = dropped || d
+		return limit > 0 && len(out) > limit
+	}
+
 	buf := it.Buffer()
 loop:
 	for {
@@ -282,7 +533,9 @@ loop:
 				continue loop
 			}
 			if t >= mint {
-				out = append(out, promql.Sample{T: t, H: h.ToFloat()})
+				if add(promql.Sample{T: t, H: h.ToFloat()}) {
+					return out, dropped, nil
+				}
 			}
 		case chunkenc.ValFloatHistogram:
 			t, fh := buf.AtFloatHistogram()
@@ -290,7 +543,9 @@ loop:
 				continue loop
 			}
 			if t >= mint {
-				out = append(out, promql.Sample{T: t, H: fh})
+				if add(promql.Sample{T: t, H: fh}) {
+					return out, dropped, nil
+				}
 			}
 		case chunkenc.ValFloat:
 			t, v := buf.At()
@@ -299,7 +554,9 @@ loop:
 			}
 			// Values in the buffer are guaranteed to be smaller than maxt.
 			if t >= mint {
-				out = append(out, promql.Sample{T: t, F: v})
+				if add(promql.Sample{T: t, F: v}) {
+					return out, dropped, nil
+				}
 			}
 		}
 	}
@@ -309,22 +566,102 @@ loop:
 	case chunkenc.ValHistogram:
 		t, h := it.AtHistogram()
 		if t == maxt && !value.IsStaleNaN(h.Sum) {
-			out = append(out, promql.Sample{T: t, H: h.ToFloat()})
+			add(promql.Sample{T: t, H: h.ToFloat()})
 		}
 
 	case chunkenc.ValFloatHistogram:
 		t, fh := it.AtFloatHistogram()
 		if t == maxt && !value.IsStaleNaN(fh.Sum) {
-			out = append(out, promql.Sample{T: t, H: fh})
+			add(promql.Sample{T: t, H: fh})
 		}
 	case chunkenc.ValFloat:
 		t, v := it.At()
 		if t == maxt && !value.IsStaleNaN(v) {
-			out = append(out, promql.Sample{T: t, F: v})
+			add(promql.Sample{T: t, F: v})
 		}
 	}
 
-	return out, nil
+	return out, dropped, nil
+}
+
+// selectLastPoint returns the most recent point in the [mint, maxt] range of a single
+// time series, for functions which only need to know whether there is any point in a range.
+// Buffered points are searched backwards from maxt, so that selection stops at the first
+// point found. The point selected for an earlier step is retained in out, and is kept if
+// no newer point is found.
+func selectLastPoint(it *storage.BufferedSeriesIterator, mint, maxt int64, out []promql.Sample) ([]promql.Sample, error) {
+	soughtValueType := it.Seek(maxt)
+	switch soughtValueType {
+	case chunkenc.ValNone:
+		if it.Err() != nil {
+			return nil, it.Err()
+		}
+	case chunkenc.ValHistogram:
+		t, h := it.AtHistogram()
+		if t == maxt && !value.IsStaleNaN(h.Sum) {
+			return append(out[:0], promql.Sample{T: t, H: h.ToFloat()}), nil
+		}
+	case chunkenc.ValFloatHistogram:
+		t, fh := it.AtFloatHistogram()
+		if t == maxt && !value.IsStaleNaN(fh.Sum) {
+			return append(out[:0], promql.Sample{T: t, H: fh}), nil
+		}
+	case chunkenc.ValFloat:
+		t, v := it.At()
+		if t == maxt && !value.IsStaleNaN(v) {
+			return append(out[:0], promql.Sample{T: t, F: v}), nil
+		}
+	}
+
+	for n := 1; ; n++ {
+		s, ok := it.PeekBack(n)
+		if !ok || s.T() < mint {
+			break
+		}
+		switch s.Type() {
+		case chunkenc.ValHistogram:
+			if !value.IsStaleNaN(s.H().Sum) {
+				return append(out[:0], promql.Sample{T: s.T(), H: s.H().ToFloat()}), nil
+			}
+		case chunkenc.ValFloatHistogram:
+			if !value.IsStaleNaN(s.FH().Sum) {
+				return append(out[:0], promql.Sample{T: s.T(), H: s.FH()}), nil
+			}
+		case chunkenc.ValFloat:
+			if !value.IsStaleNaN(s.F()) {
+				return append(out[:0], promql.Sample{T: s.T(), F: s.F()}), nil
+			}
+		}
+	}
+
+	if len(out) > 0 && out[len(out)-1].T >= mint {
+		return out[len(out)-1:], nil
+	}
+	return out[:0], nil
+}
+
+// lastPointsFunctions are range functions which only use the most recent points
+// of a range, mapped to the number of points they need.
+var lastPointsFunctions = map[string]int{
+	"irate":  2,
+	"idelta": 2,
+}
+
+// anyPointFunctions are range functions which only need to know
+// whether there is any point in a range.
+var anyPointFunctions = map[string]bool{
+	"present_over_time": true,
+}
+
+// appendPoint appends a point to out. If out already holds maxPoints points,
+// the oldest point is dropped so that at most maxPoints points are buffered.
+// The returned bool reports whether a point was dropped.
+func appendPoint(out []promql.Sample, s promql.Sample, maxPoints int) ([]promql.Sample, bool) {
+	if maxPoints > 0 && len(out) >= maxPoints {
+		copy(out, out[len(out)-maxPoints+1:])
+		return append(out[:maxPoints-1], s), true
+	}
+	return append(out, s), false
 }
 
 // matrixIterSlice populates a matrix vector covering the requested range for a
@@ -335,8 +672,9 @@ loop:
 // values). Any such points falling before mint are discarded; points that fall
 // into the [mint, maxt] range are retained; only points with later timestamps
 // are populated from the iterator.
+// maxPoints and limit bound the points of the range as in selectPoints.
 // TODO(fpetkovski): Add max samples limit.
-func selectExtPoints(it *storage.BufferedSeriesIterator, mint, maxt int64, out []promql.Sample, functionName string, extLookbackDelta int64) ([]promql.Sample, error) {
+func selectExtPoints(it *storage.BufferedSeriesIterator, mint, maxt int64, out []promql.Sample, functionName string, extLookbackDelta int64, maxPoints, limit int) ([]promql.Sample, bool, error) {
 	extMint := mint - extLookbackDelta
 
 	if len(out) > 0 && out[len(out)-1].T >= mint {
@@ -369,10 +707,18 @@ func selectExtPoints(it *storage.BufferedSeriesIterator, mint, maxt int64, out [
 	soughtValueType := it.Seek(maxt)
 	if soughtValueType == chunkenc.ValNone {
 		if it.Err() != nil {
-			return nil, it.Err()
+			return nil, false, it.Err()
 		}
 	}
 
+	var dropped bool
+	add := func(s promql.Sample) bool {
+		var d bool
+		out, d = appendPoint(out, s, maxPoints)
+		dropped = dropped || d
+		return limit > 0 && len(out) > limit
+	}
+
 	appendedPointBeforeMint := len(out) > 0
 	buf := it.Buffer()
 loop:
@@ -382,16 +728,19 @@ loop:
 			break loop
 		case chunkenc.ValHistogram:
 			t, h := buf.AtHistogram()
-			if t >= mint {
-				out = append(out, promql.Sample{T: t, H: h.ToFloat()})
+			if value.IsStaleNaN(h.Sum) {
+				continue loop
+			}
+			if t >= mint && add(promql.Sample{T: t, H: h.ToFloat()}) {
+				return out, dropped, nil
 			}
 		case chunkenc.ValFloatHistogram:
 			t, fh := buf.AtFloatHistogram()
 			if value.IsStaleNaN(fh.Sum) {
 				continue loop
 			}
-			if t >= mint {
-				out = append(out, promql.Sample{T: t, H: fh})
+			if t >= mint && add(promql.Sample{T: t, H: fh}) {
+				return out, dropped, nil
 			}
 		case chunkenc.ValFloat:
 			t, v := buf.At()
@@ -403,8 +752,10 @@ loop:
 			// exists at or before range start, add it and then keep replacing
 			// it with later points while not yet (strictly) inside the range.
 			if t > mint || !appendedPointBeforeMint {
-				out = append(out, promql.Sample{T: t, F: v})
 				appendedPointBeforeMint = true
+				if add(promql.Sample{T: t, F: v}) {
+					return out, dropped, nil
+				}
 			} else {
 				out[len(out)-1] = promql.Sample{T: t, F: v}
 			}
@@ -416,20 +767,20 @@ loop:
 	switch soughtValueType {
 	case chunkenc.ValHistogram:
 		t, h := it.AtHistogram()
-		if t == maxt {
-			out = append(out, promql.Sample{T: t, H: h.ToFloat()})
+		if t == maxt && !value.IsStaleNaN(h.Sum) {
+			add(promql.Sample{T: t, H: h.ToFloat()})
 		}
 	case chunkenc.ValFloatHistogram:
 		t, fh := it.AtFloatHistogram()
 		if t == maxt && !value.IsStaleNaN(fh.Sum) {
-			out = append(out, promql.Sample{T: t, H: fh})
+			add(promql.Sample{T: t, H: fh})
 		}
 	case chunkenc.ValFloat:
 		t, v := it.At()
 		if t == maxt && !value.IsStaleNaN(v) {
-			out = append(out, promql.Sample{T: t, F: v})
+			add(promql.Sample{T: t, F: v})
 		}
 	}
 
-	return out, nil
+	return out, dropped, nil
 }
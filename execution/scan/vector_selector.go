@@ -13,7 +13,12 @@ import (
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
 
 	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/execution/parse"
+	"github.com/thanos-community/promql-engine/execution/receipt"
 	engstore "github.com/thanos-community/promql-engine/execution/storage"
+	"github.com/thanos-community/promql-engine/execution/warnings"
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+	"github.com/thanos-community/promql-engine/logicalplan"
 	"github.com/thanos-community/promql-engine/query"
 
 	"github.com/prometheus/prometheus/model/histogram"
@@ -23,16 +28,23 @@ import (
 	"github.com/prometheus/prometheus/storage"
 )
 
+// seriesBatchSize is the number of series which are read from storage at a time in streaming mode.
+const seriesBatchSize = 1024
+
 type vectorScanner struct {
 	labels    labels.Labels
 	signature uint64
 	samples   *storage.MemoizedSeriesIterator
+	// series is only set in streaming mode, where the iterator of the series is opened
+	// when it is first scanned, and released once the series has no samples left.
+	series storage.Series
 }
 
 type vectorSelector struct {
 	storage  engstore.SeriesSelector
 	scanners []vectorScanner
 	series   []labels.Labels
+	hashes   seriesHashes
 
 	once       sync.Once
 	vectorPool *model.VectorPool
@@ -41,20 +53,35 @@ type vectorSelector struct {
 	mint          int64
 	maxt          int64
 	lookbackDelta int64
-	step          int64
+	steps         query.Steps
 	currentStep   int64
 	offset        int64
 
 	shard     int
 	numShards int
+
+	// selectTimestamp makes the selector emit the timestamps of selected
+	// samples instead of their values, as required by timestamp().
+	selectTimestamp bool
+	// valueFilters drop float samples which do not pass the comparisons,
+	// and histogram samples, before they are added to step vectors.
+	valueFilters []logicalplan.ValueFilter
+
+	streaming bool
+	// exhausted replaces the iterators of series which have no samples left in streaming mode.
+	exhausted *storage.MemoizedSeriesIterator
 }
 
 // NewVectorSelector creates operator which selects vector of series.
+// When selectTimestamp is set, the operator returns the timestamp of each selected
+// sample in seconds instead of its value.
 func NewVectorSelector(
 	pool *model.VectorPool,
 	selector engstore.SeriesSelector,
 	queryOpts *query.Options,
 	offset time.Duration,
+	selectTimestamp bool,
+	valueFilters []logicalplan.ValueFilter,
 	shard, numShards int,
 ) model.VectorOperator {
 	return &vectorSelector{
@@ -63,7 +90,7 @@ func NewVectorSelector(
 
 		mint:          queryOpts.Start.UnixMilli(),
 		maxt:          queryOpts.End.UnixMilli(),
-		step:          queryOpts.Step.Milliseconds(),
+		steps:         queryOpts.Steps(),
 		currentStep:   queryOpts.Start.UnixMilli(),
 		lookbackDelta: queryOpts.LookbackDelta.Milliseconds(),
 		offset:        offset.Milliseconds(),
@@ -71,10 +98,21 @@ func NewVectorSelector(
 
 		shard:     shard,
 		numShards: numShards,
+
+		selectTimestamp: selectTimestamp,
+		valueFilters:    valueFilters,
+
+		streaming: queryOpts.EnableStreamingSeries,
 	}
 }
 
 func (o *vectorSelector) Explain() (me string, next []model.VectorOperator) {
+	if o.selectTimestamp {
+		return fmt.Sprintf("[*vectorSelector] timestamp({%v}) %v mod %v", o.storage.Matchers(), o.shard, o.numShards), nil
+	}
+	if len(o.valueFilters) > 0 {
+		return fmt.Sprintf("[*vectorSelector] filter_values(%v, {%v}) %v mod %v", o.valueFilters, o.storage.Matchers(), o.shard, o.numShards), nil
+	}
 	return fmt.Sprintf("[*vectorSelector] {%v} %v mod %v", o.storage.Matchers(), o.shard, o.numShards), nil
 }
 
@@ -85,6 +123,13 @@ func (o *vectorSelector) Series(ctx context.Context) ([]labels.Labels, error) {
 	return o.series, nil
 }
 
+func (o *vectorSelector) SeriesHashes(ctx context.Context, grouping model.Grouping) ([]uint64, error) {
+	if err := o.loadSeries(ctx); err != nil {
+		return nil, err
+	}
+	return o.hashes.get(o.series, grouping), nil
+}
+
 func (o *vectorSelector) GetPool() *model.VectorPool {
 	return o.vectorPool
 }
@@ -104,66 +149,158 @@ func (o *vectorSelector) Next(ctx context.Context) ([]model.StepVector, error) {
 		return nil, err
 	}
 
+	var numSamples int
 	vectors := o.vectorPool.GetVectorBatch()
 	ts := o.currentStep
 	for i := 0; i < len(o.scanners); i++ {
 		var (
-			series   = o.scanners[i]
+			series   = &o.scanners[i]
 			seriesTs = ts
 		)
+		if o.streaming && series.samples == nil {
+			series.samples = storage.NewMemoizedIterator(series.series.Iterator(nil), o.lookbackDelta)
+		}
 
 		for currStep := 0; currStep < o.numSteps && seriesTs <= o.maxt; currStep++ {
 			if len(vectors) <= currStep {
 				vectors = append(vectors, o.vectorPool.GetStepVector(seriesTs))
 			}
-			_, v, h, ok, err := selectPoint(series.samples, seriesTs, o.lookbackDelta, o.offset)
+			t, v, h, ok, err := selectPoint(series.samples, seriesTs, o.lookbackDelta, o.offset)
 			if err != nil {
 				return nil, err
 			}
 			if ok {
-				if h != nil {
+				numSamples++
+				ok = o.filterValue(ctx, v, h)
+			}
+			if ok {
+				if o.selectTimestamp {
+					vectors[currStep].AppendSample(o.vectorPool, series.signature, float64(t)/1000)
+				} else if h != nil {
 					vectors[currStep].AppendHistogram(o.vectorPool, series.signature, h)
 				} else {
 					vectors[currStep].AppendSample(o.vectorPool, series.signature, v)
 				}
 			}
-			seriesTs += o.step
+			seriesTs = o.steps.Next(seriesTs)
+		}
+		if o.streaming {
+			if err := o.releaseExhausted(series, seriesTs); err != nil {
+				return nil, err
+			}
 		}
 	}
-	// For instant queries, set the step to a positive value
-	// so that the operator can terminate.
-	if o.step == 0 {
-		o.step = 1
-	}
-	o.currentStep += o.step * int64(o.numSteps)
+	receipt.AddSamples(numSamples, ctx)
+	o.currentStep = o.steps.Advance(o.currentStep, o.numSteps)
 
 	return vectors, nil
 }
 
+// filterValue returns false if the sample does not pass the value filters of the selector.
+func (o *vectorSelector) filterValue(ctx context.Context, v float64, h *histogram.FloatHistogram) bool {
+	for _, f := range o.valueFilters {
+		if h != nil {
+			if f.ScalarLeft {
+				warnings.AddToContext(parse.IncompatibleTypesErr(f.Op, parse.FloatSampleType, parse.HistogramSampleType), ctx)
+			} else {
+				warnings.AddToContext(parse.IncompatibleTypesErr(f.Op, parse.HistogramSampleType, parse.FloatSampleType), ctx)
+			}
+			return false
+		}
+		lhs, rhs := v, f.Value
+		if f.ScalarLeft {
+			lhs, rhs = rhs, lhs
+		}
+		if !compare(f.Op, lhs, rhs) {
+			return false
+		}
+	}
+	return true
+}
+
+func compare(op parser.ItemType, lhs, rhs float64) bool {
+	switch op {
+	case parser.EQLC:
+		return lhs == rhs
+	case parser.NEQ:
+		return lhs != rhs
+	case parser.GTR:
+		return lhs > rhs
+	case parser.LSS:
+		return lhs < rhs
+	case parser.GTE:
+		return lhs >= rhs
+	case parser.LTE:
+		return lhs <= rhs
+	default:
+		panic(errors.Newf("operator %q is not a comparison", parser.ItemTypeStr[op]))
+	}
+}
+
 func (o *vectorSelector) loadSeries(ctx context.Context) error {
 	var err error
 	o.once.Do(func() {
-		series, loadErr := o.storage.GetSeries(ctx, o.shard, o.numShards)
-		if loadErr != nil {
-			err = loadErr
-			return
-		}
-
-		o.scanners = make([]vectorScanner, len(series))
-		o.series = make([]labels.Labels, len(series))
-		for i, s := range series {
-			o.scanners[i] = vectorScanner{
-				labels:    s.Labels(),
-				signature: s.Signature,
-				samples:   storage.NewMemoizedIterator(s.Iterator(nil), o.lookbackDelta),
+		o.hashes.init(ctx, false)
+		if o.streaming {
+			o.exhausted = storage.NewMemoizedIterator(chunkenc.NewNopIterator(), o.lookbackDelta)
+			err = engstore.GetSeriesBatches(ctx, o.storage, o.shard, o.numShards, seriesBatchSize, o.addSeries)
+		} else {
+			var series []engstore.SignedSeries
+			if series, err = o.storage.GetSeries(ctx, o.shard, o.numShards); err == nil {
+				o.scanners = make([]vectorScanner, 0, len(series))
+				o.series = make([]labels.Labels, 0, len(series))
+				err = o.addSeries(series)
 			}
-			o.series[i] = s.Labels()
 		}
-		o.vectorPool.SetStepSize(len(series))
+		if err != nil {
+			return
+		}
+		receipt.AddShard(o.shard, len(o.series), ctx)
+		o.vectorPool.SetStepSize(len(o.series))
 	})
 	return err
 }
 
+func (o *vectorSelector) addSeries(series []engstore.SignedSeries) error {
+	o.hashes.add(series)
+	for _, s := range series {
+		scanner := vectorScanner{
+			labels:    s.Labels(),
+			signature: s.Signature,
+		}
+		if o.streaming {
+			scanner.series = s.Series
+		} else {
+			scanner.samples = storage.NewMemoizedIterator(s.Iterator(nil), o.lookbackDelta)
+		}
+		o.scanners = append(o.scanners, scanner)
+		o.series = append(o.series, scanner.labels)
+	}
+	return nil
+}
+
+// releaseExhausted releases the iterator of a series in streaming mode when no sample
+// of the series can be selected at the steps from ts on.
+func (o *vectorSelector) releaseExhausted(s *vectorScanner, ts int64) error {
+	if s.series == nil {
+		return nil
+	}
+	if ts <= o.maxt {
+		refTime := ts - o.offset
+		if s.samples.Seek(refTime) != chunkenc.ValNone {
+			return nil
+		}
+		if err := s.samples.Err(); err != nil {
+			return err
+		}
+		if t, _, _, _, ok := s.samples.PeekPrev(); ok && t >= refTime-o.lookbackDelta {
+			return nil
+		}
+	}
+	s.series, s.samples = nil, o.exhausted
+	return nil
+}
+
 // TODO(fpetkovski): Add max samples limit.
 func selectPoint(it *storage.MemoizedSeriesIterator, ts, lookbackDelta, offset int64) (int64, float64, *histogram.FloatHistogram, bool, error) {
 	refTime := ts - offset
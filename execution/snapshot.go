@@ -0,0 +1,56 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package execution
+
+import (
+	"github.com/thanos-community/promql-engine/execution/model"
+)
+
+// OperatorState is a snapshot of an operator in the tree of a query which is being executed.
+type OperatorState struct {
+	// Operator describes the operator, as returned by its Explain method.
+	Operator string
+	// Tracked is true when the operator tracks its progress. Only operators created
+	// for expressions track their progress, and not helper operators such as exchanges.
+	Tracked bool
+	// Batches is the number of batches of steps produced by the operator.
+	Batches int64
+	// CurrentStep is the timestamp of the last step produced by the operator, in milliseconds.
+	// It is only set once the operator produced a batch.
+	CurrentStep int64
+	// InSeries is true when the operator is loading its series.
+	InSeries bool
+	// InNext is true when the operator is producing a batch.
+	InNext   bool
+	Children []OperatorState
+}
+
+// Snapshot returns the state of the operator tree rooted at the given operator.
+// Operators only track their state when the query is created with TrackOperatorState.
+func Snapshot(operator model.VectorOperator) OperatorState {
+	me, next := operator.Explain()
+	var state OperatorState
+	if o, ok := operator.(*stateOperator); ok {
+		state = o.state()
+		state.Tracked = true
+	}
+	state.Operator = me
+	for _, child := range next {
+		state.Children = append(state.Children, Snapshot(child))
+	}
+	return state
+}
+
+// WaitingOn returns the operators which the query is waiting on. These are operators
+// which are loading series or producing a batch without waiting on a child operator.
+func (s OperatorState) WaitingOn() []string {
+	var waiting []string
+	for _, child := range s.Children {
+		waiting = append(waiting, child.WaitingOn()...)
+	}
+	if len(waiting) == 0 && (s.InSeries || s.InNext) {
+		waiting = append(waiting, s.Operator)
+	}
+	return waiting
+}
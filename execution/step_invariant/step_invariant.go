@@ -10,9 +10,8 @@ import (
 	"github.com/efficientgo/core/errors"
 	"github.com/prometheus/prometheus/model/labels"
 
-	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
-
 	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/logicalplan"
 	"github.com/thanos-community/promql-engine/query"
 )
 
@@ -28,7 +27,7 @@ type stepInvariantOperator struct {
 
 	mint        int64
 	maxt        int64
-	step        int64
+	steps       query.Steps
 	currentStep int64
 	stepsBatch  int
 }
@@ -40,29 +39,24 @@ func (u *stepInvariantOperator) Explain() (me string, next []model.VectorOperato
 func NewStepInvariantOperator(
 	pool *model.VectorPool,
 	next model.VectorOperator,
-	expr parser.Expr,
+	expr logicalplan.Node,
 	opts *query.Options,
 	stepsBatch int,
 ) (model.VectorOperator, error) {
-	interval := opts.Step.Milliseconds()
-	// We set interval to be at least 1.
-	if interval == 0 {
-		interval = 1
-	}
 	u := &stepInvariantOperator{
 		vectorPool:  pool,
 		next:        next,
 		currentStep: opts.Start.UnixMilli(),
 		mint:        opts.Start.UnixMilli(),
 		maxt:        opts.End.UnixMilli(),
-		step:        interval,
+		steps:       opts.Steps(),
 		stepsBatch:  stepsBatch,
 		cacheResult: true,
 	}
 	// We do not duplicate results for range selectors since result is a matrix
 	// with their unique timestamps which does not depend on the step.
 	switch expr.(type) {
-	case *parser.MatrixSelector, *parser.SubqueryExpr:
+	case *logicalplan.MatrixSelector, *logicalplan.Subquery:
 		u.cacheResult = false
 	}
 
@@ -103,7 +97,7 @@ func (u *stepInvariantOperator) Next(ctx context.Context) ([]model.StepVector, e
 		return nil, err
 	}
 
-	if len(u.cachedVector.Samples) == 0 {
+	if len(u.cachedVector.Samples) == 0 && len(u.cachedVector.Histograms) == 0 {
 		return nil, nil
 	}
 
@@ -113,7 +107,7 @@ func (u *stepInvariantOperator) Next(ctx context.Context) ([]model.StepVector, e
 		outVector.AppendSamples(u.vectorPool, u.cachedVector.SampleIDs, u.cachedVector.Samples)
 		outVector.AppendHistograms(u.vectorPool, u.cachedVector.HistogramIDs, u.cachedVector.Histograms)
 		result = append(result, outVector)
-		u.currentStep += u.step
+		u.currentStep = u.steps.Next(u.currentStep)
 	}
 
 	return result, nil
@@ -129,7 +123,7 @@ func (u *stepInvariantOperator) cacheInputVector(ctx context.Context) error {
 		}
 		defer u.next.GetPool().PutVectors(in)
 
-		if len(in) == 0 || len(in[0].Samples) == 0 {
+		if len(in) == 0 || (len(in[0].Samples) == 0 && len(in[0].Histograms) == 0) {
 			return
 		}
 
@@ -0,0 +1,209 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package storage
+
+import (
+	"context"
+	"sort"
+
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+)
+
+type chunkQueryable struct {
+	queryable storage.ChunkQueryable
+}
+
+// NewChunkQueryable returns a storage.Queryable which selects series from a storage.ChunkQueryable.
+// Samples are decoded lazily from the selected chunks, which means that chunks which
+// fall outside of the time ranges accessed by scanners are never decoded.
+func NewChunkQueryable(queryable storage.ChunkQueryable) storage.Queryable {
+	return &chunkQueryable{queryable: queryable}
+}
+
+func (c *chunkQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	querier, err := c.queryable.ChunkQuerier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkQuerier{LabelQuerier: querier, querier: querier}, nil
+}
+
+type chunkQuerier struct {
+	storage.LabelQuerier
+	querier storage.ChunkQuerier
+}
+
+func (c *chunkQuerier) Select(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	return &chunkSeriesSet{ChunkSeriesSet: c.querier.Select(sortSeries, hints, matchers...)}
+}
+
+type chunkSeriesSet struct {
+	storage.ChunkSeriesSet
+
+	current storage.Series
+	err     error
+}
+
+func (c *chunkSeriesSet) Next() bool {
+	if c.err != nil || !c.ChunkSeriesSet.Next() {
+		return false
+	}
+
+	series := c.ChunkSeriesSet.At()
+	iter := series.Iterator(nil)
+	var metas []chunks.Meta
+	for iter.Next() {
+		metas = append(metas, iter.At())
+	}
+	if err := iter.Err(); err != nil {
+		c.err = err
+		return false
+	}
+
+	c.current = newChunkSeries(series.Labels(), metas)
+	return true
+}
+
+func (c *chunkSeriesSet) At() storage.Series {
+	return c.current
+}
+
+func (c *chunkSeriesSet) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.ChunkSeriesSet.Err()
+}
+
+func newChunkSeries(lbls labels.Labels, metas []chunks.Meta) storage.Series {
+	for i := 1; i < len(metas); i++ {
+		if metas[i].MinTime <= metas[i-1].MaxTime {
+			// Overlapping chunks need to be merged sample by sample.
+			series := make([]storage.Series, 0, len(metas))
+			for _, meta := range metas {
+				meta := meta
+				series = append(series, &storage.SeriesEntry{
+					Lset: lbls,
+					SampleIteratorFn: func(it chunkenc.Iterator) chunkenc.Iterator {
+						return meta.Chunk.Iterator(it)
+					},
+				})
+			}
+			return storage.ChainedSeriesMerge(series...)
+		}
+	}
+
+	return &chunkSeries{labels: lbls, metas: metas}
+}
+
+type chunkSeries struct {
+	labels labels.Labels
+	metas  []chunks.Meta
+}
+
+func (c *chunkSeries) Labels() labels.Labels {
+	return c.labels
+}
+
+func (c *chunkSeries) Iterator(it chunkenc.Iterator) chunkenc.Iterator {
+	if ci, ok := it.(*chunkSeriesIterator); ok {
+		ci.reset(c.metas)
+		return ci
+	}
+	ci := &chunkSeriesIterator{}
+	ci.reset(c.metas)
+	return ci
+}
+
+// chunkSeriesIterator iterates over samples from a set of sorted and non-overlapping chunks.
+// A chunk is only decoded once the iterator advances into its time range.
+type chunkSeriesIterator struct {
+	metas []chunks.Meta
+	// idx is the index of the chunk which is currently being decoded.
+	idx     int
+	curr    chunkenc.Iterator
+	valType chunkenc.ValueType
+}
+
+func (c *chunkSeriesIterator) reset(metas []chunks.Meta) {
+	c.metas = metas
+	c.idx = -1
+	c.valType = chunkenc.ValNone
+}
+
+func (c *chunkSeriesIterator) Next() chunkenc.ValueType {
+	if c.idx >= 0 && c.idx < len(c.metas) {
+		if c.valType = c.curr.Next(); c.valType != chunkenc.ValNone || c.curr.Err() != nil {
+			return c.valType
+		}
+	}
+	for c.idx+1 < len(c.metas) {
+		c.openChunk(c.idx + 1)
+		if c.valType = c.curr.Next(); c.valType != chunkenc.ValNone || c.curr.Err() != nil {
+			return c.valType
+		}
+	}
+	c.idx = len(c.metas)
+	c.valType = chunkenc.ValNone
+	return c.valType
+}
+
+func (c *chunkSeriesIterator) Seek(t int64) chunkenc.ValueType {
+	if c.valType != chunkenc.ValNone && c.curr.AtT() >= t {
+		return c.valType
+	}
+	if c.idx >= len(c.metas) {
+		return chunkenc.ValNone
+	}
+
+	if c.idx < 0 || c.metas[c.idx].MaxTime < t {
+		// Skip all chunks which end before t without decoding them.
+		next := c.idx + 1 + sort.Search(len(c.metas)-c.idx-1, func(i int) bool {
+			return c.metas[c.idx+1+i].MaxTime >= t
+		})
+		if next >= len(c.metas) {
+			c.idx = len(c.metas)
+			c.valType = chunkenc.ValNone
+			return c.valType
+		}
+		c.openChunk(next)
+	}
+
+	if c.valType = c.curr.Seek(t); c.valType != chunkenc.ValNone || c.curr.Err() != nil {
+		return c.valType
+	}
+	return c.Next()
+}
+
+func (c *chunkSeriesIterator) openChunk(idx int) {
+	c.idx = idx
+	c.curr = c.metas[idx].Chunk.Iterator(c.curr)
+}
+
+func (c *chunkSeriesIterator) At() (int64, float64) {
+	return c.curr.At()
+}
+
+func (c *chunkSeriesIterator) AtHistogram() (int64, *histogram.Histogram) {
+	return c.curr.AtHistogram()
+}
+
+func (c *chunkSeriesIterator) AtFloatHistogram() (int64, *histogram.FloatHistogram) {
+	return c.curr.AtFloatHistogram()
+}
+
+func (c *chunkSeriesIterator) AtT() int64 {
+	return c.curr.AtT()
+}
+
+func (c *chunkSeriesIterator) Err() error {
+	if c.curr == nil {
+		return nil
+	}
+	return c.curr.Err()
+}
@@ -0,0 +1,32 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package storage
+
+import (
+	"context"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// emptySelector is a selector whose matchers cannot match any series.
+// It never queries storage.
+type emptySelector struct {
+	matchers []*labels.Matcher
+}
+
+func NewEmptySelector(matchers []*labels.Matcher) SeriesSelector {
+	return &emptySelector{matchers: matchers}
+}
+
+func (e *emptySelector) GetSeries(_ context.Context, _, _ int) ([]SignedSeries, error) {
+	return nil, nil
+}
+
+func (e *emptySelector) EstimateSeries(_ context.Context) (SeriesEstimate, bool, error) {
+	return SeriesEstimate{}, true, nil
+}
+
+func (e *emptySelector) Matchers() []*labels.Matcher {
+	return e.matchers
+}
@@ -0,0 +1,83 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package storage
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// SeriesEstimate is an estimate of the number of series and samples returned by a selector.
+type SeriesEstimate struct {
+	Series  int64
+	Samples int64
+}
+
+// CardinalityEstimator is implemented by queriers which can estimate the number of series and
+// samples matching a set of matchers from index statistics, without selecting the series.
+// Estimates are taken while queries are planned, so they need to be cheap to compute.
+type CardinalityEstimator interface {
+	EstimateSeries(hints *storage.SelectHints, matchers ...*labels.Matcher) (SeriesEstimate, error)
+}
+
+// Estimator estimates the series of selections for a single query. Estimates are taken with the
+// context of the query, and selections are passed through the select hook of the context first.
+// Queryables whose queriers cannot estimate series are remembered, so that queriers are only
+// opened once for them instead of once for every selection.
+type Estimator struct {
+	mu          sync.Mutex
+	unsupported map[storage.Queryable]struct{}
+}
+
+// NewEstimator creates an Estimator for a single query.
+func NewEstimator() *Estimator {
+	return &Estimator{unsupported: make(map[storage.Queryable]struct{})}
+}
+
+// EstimateSeries returns the estimate of the series and samples matching the matchers in [hints.Start, hints.End].
+// The returned bool is false if the querier of the queryable does not implement CardinalityEstimator.
+func (e *Estimator) EstimateSeries(ctx context.Context, queryable storage.Queryable, hints *storage.SelectHints, matchers ...*labels.Matcher) (SeriesEstimate, bool, error) {
+	queryable, matchers, err := applySelectHook(ctx, queryable, matchers, *hints)
+	if err != nil {
+		return SeriesEstimate{}, false, err
+	}
+	// Queryables which cannot be used as map keys are checked for every selection.
+	cacheable := queryable != nil && reflect.TypeOf(queryable).Comparable()
+	if cacheable && e.isUnsupported(queryable) {
+		return SeriesEstimate{}, false, nil
+	}
+
+	querier, err := queryable.Querier(ctx, hints.Start, hints.End)
+	if err != nil {
+		return SeriesEstimate{}, false, err
+	}
+	defer querier.Close()
+
+	estimator, ok := querier.(CardinalityEstimator)
+	if !ok {
+		if cacheable {
+			e.mu.Lock()
+			e.unsupported[queryable] = struct{}{}
+			e.mu.Unlock()
+		}
+		return SeriesEstimate{}, false, nil
+	}
+	estimate, err := estimator.EstimateSeries(hints, matchers...)
+	if err != nil {
+		return SeriesEstimate{}, false, err
+	}
+	return estimate, true, nil
+}
+
+func (e *Estimator) isUnsupported(queryable storage.Queryable) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	_, ok := e.unsupported[queryable]
+	return ok
+}
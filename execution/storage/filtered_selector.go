@@ -8,20 +8,28 @@ import (
 	"sync"
 
 	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+
+	"github.com/thanos-community/promql-engine/logicalplan"
 )
 
 type filteredSelector struct {
-	selector *seriesSelector
-	filter   Filter
+	selector   *seriesSelector
+	filter     Filter
+	projection *logicalplan.Projection
+	// histogramStats removes the buckets of native histograms.
+	histogramStats bool
 
 	once   sync.Once
 	series []SignedSeries
 }
 
-func NewFilteredSelector(selector *seriesSelector, filter Filter) SeriesSelector {
+func NewFilteredSelector(selector *seriesSelector, filter Filter, projection *logicalplan.Projection, histogramStats bool) SeriesSelector {
 	return &filteredSelector{
-		selector: selector,
-		filter:   filter,
+		selector:       selector,
+		filter:         filter,
+		projection:     projection,
+		histogramStats: histogramStats,
 	}
 }
 
@@ -29,8 +37,20 @@ func (f *filteredSelector) Matchers() []*labels.Matcher {
 	return append(f.selector.matchers, f.filter.Matchers()...)
 }
 
+// EstimateSeries returns the estimate of the unfiltered selector, since filters can only remove series.
+func (f *filteredSelector) EstimateSeries(ctx context.Context) (SeriesEstimate, bool, error) {
+	return f.selector.EstimateSeries(ctx)
+}
+
 func (f *filteredSelector) GetSeries(ctx context.Context, shard, numShards int) ([]SignedSeries, error) {
-	var err error
+	series, ok, err := f.selector.getShardedSeries(ctx, shard, numShards)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return f.filterSeries(series), nil
+	}
+
 	f.once.Do(func() { err = f.loadSeries(ctx) })
 	if err != nil {
 		return nil, err
@@ -39,23 +59,77 @@ func (f *filteredSelector) GetSeries(ctx context.Context, shard, numShards int)
 	return seriesShard(f.series, shard, numShards), nil
 }
 
+// GetSeriesBatches filters the batches of series as they are read from storage. Shards of
+// multiple shards are computed from the full filtered series set, like with GetSeries.
+func (f *filteredSelector) GetSeriesBatches(ctx context.Context, shard, numShards, batchSize int, fn func([]SignedSeries) error) error {
+	if numShards > 1 {
+		series, err := f.GetSeries(ctx, shard, numShards)
+		if err != nil {
+			return err
+		}
+		return batchSeries(series, batchSize, fn)
+	}
+
+	var numFiltered uint64
+	return f.selector.GetSeriesBatches(ctx, 0, 1, batchSize, func(series []SignedSeries) error {
+		filtered := f.filterSeries(series)
+		if len(filtered) == 0 {
+			return nil
+		}
+		for i := range filtered {
+			filtered[i].Signature += numFiltered
+		}
+		numFiltered += uint64(len(filtered))
+		return fn(filtered)
+	})
+}
+
 func (f *filteredSelector) loadSeries(ctx context.Context) error {
 	series, err := f.selector.GetSeries(ctx, 0, 1)
 	if err != nil {
 		return err
 	}
+	f.series = f.filterSeries(series)
+
+	return nil
+}
 
+func (f *filteredSelector) filterSeries(series []SignedSeries) []SignedSeries {
 	var i uint64
-	f.series = make([]SignedSeries, 0, len(series))
+	filtered := make([]SignedSeries, 0, len(series))
 	for _, s := range series {
 		if f.filter.Matches(s) {
-			f.series = append(f.series, SignedSeries{
-				Series:    s.Series,
+			filtered = append(filtered, SignedSeries{
+				Series:    f.removeBuckets(f.project(s.Series)),
 				Signature: i,
 			})
 			i++
 		}
 	}
+	return filtered
+}
 
-	return nil
+func (f *filteredSelector) project(series storage.Series) storage.Series {
+	if f.projection == nil {
+		return series
+	}
+	return &projectedSeries{
+		Series: series,
+		labels: series.Labels().MatchLabels(f.projection.Include, f.projection.Labels...),
+	}
+}
+
+func (f *filteredSelector) removeBuckets(series storage.Series) storage.Series {
+	if !f.histogramStats {
+		return series
+	}
+	return &histogramStatsSeries{Series: series}
 }
+
+// projectedSeries is a series which only retains the labels from a projection.
+type projectedSeries struct {
+	storage.Series
+	labels labels.Labels
+}
+
+func (p *projectedSeries) Labels() labels.Labels { return p.labels }
@@ -0,0 +1,107 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package storage
+
+import (
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+// histogramStatsSeries is a series whose native histograms only retain their count and sum.
+type histogramStatsSeries struct {
+	storage.Series
+}
+
+func (s *histogramStatsSeries) Iterator(it chunkenc.Iterator) chunkenc.Iterator {
+	if statsIterator, ok := it.(*histogramStatsIterator); ok {
+		statsIterator.reset(s.Series.Iterator(statsIterator.Iterator))
+		return statsIterator
+	}
+	return &histogramStatsIterator{Iterator: s.Series.Iterator(it)}
+}
+
+// histogramStatsIterator returns native histograms without buckets, so that operators
+// which only need the count and sum of histograms do not have to process their buckets.
+// Since counter resets cannot be detected from the count and sum alone, they are detected
+// from the full histograms and passed on as counter reset hints, like Prometheus does.
+type histogramStatsIterator struct {
+	chunkenc.Iterator
+
+	valueType chunkenc.ValueType
+	t         int64
+	current   histogram.FloatHistogram
+	// last is the previous histogram returned by the iterator, or nil if it is not known.
+	last *histogram.FloatHistogram
+}
+
+func (it *histogramStatsIterator) reset(next chunkenc.Iterator) {
+	it.Iterator = next
+	it.valueType = chunkenc.ValNone
+	it.last = nil
+}
+
+func (it *histogramStatsIterator) Next() chunkenc.ValueType {
+	return it.load(it.Iterator.Next())
+}
+
+func (it *histogramStatsIterator) Seek(t int64) chunkenc.ValueType {
+	if it.valueType != chunkenc.ValNone && it.t >= t {
+		return it.valueType
+	}
+	// Samples which are skipped by the seek are not compared with the next histogram.
+	it.last = nil
+	return it.load(it.Iterator.Seek(t))
+}
+
+func (it *histogramStatsIterator) load(valueType chunkenc.ValueType) chunkenc.ValueType {
+	it.valueType = valueType
+	switch valueType {
+	case chunkenc.ValHistogram, chunkenc.ValFloatHistogram:
+		var h *histogram.FloatHistogram
+		it.t, h = it.Iterator.AtFloatHistogram()
+		it.current = histogram.FloatHistogram{
+			CounterResetHint: counterResetHint(h, it.last),
+			Count:            h.Count,
+			Sum:              h.Sum,
+		}
+		it.last = h
+	case chunkenc.ValFloat:
+		it.t, _ = it.Iterator.At()
+		it.last = nil
+	default:
+		it.last = nil
+	}
+	return valueType
+}
+
+func (it *histogramStatsIterator) AtHistogram() (int64, *histogram.Histogram) {
+	return it.t, &histogram.Histogram{
+		CounterResetHint: it.current.CounterResetHint,
+		Count:            uint64(it.current.Count),
+		Sum:              it.current.Sum,
+	}
+}
+
+func (it *histogramStatsIterator) AtFloatHistogram() (int64, *histogram.FloatHistogram) {
+	h := it.current
+	return it.t, &h
+}
+
+func (it *histogramStatsIterator) AtT() int64 {
+	if it.valueType == chunkenc.ValNone {
+		return it.Iterator.AtT()
+	}
+	return it.t
+}
+
+func counterResetHint(h, last *histogram.FloatHistogram) histogram.CounterResetHint {
+	if h.CounterResetHint != histogram.UnknownCounterReset || last == nil {
+		return h.CounterResetHint
+	}
+	if h.DetectReset(last) {
+		return histogram.CounterReset
+	}
+	return histogram.NotCounterReset
+}
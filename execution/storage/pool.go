@@ -4,57 +4,165 @@
 package storage
 
 import (
+	"context"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cespare/xxhash/v2"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/storage"
+
+	"github.com/thanos-community/promql-engine/logicalplan"
+	"github.com/thanos-community/promql-engine/query"
 )
 
 var sep = []byte{'\xff'}
 
+// maxMergeGap is the largest gap in milliseconds between the time ranges of selectors which are merged.
+// Merged selectors also select the samples in the gap, so selectors which are further apart, such as
+// the ones of comparisons with the previous day, are selected separately.
+const maxMergeGap = int64(time.Hour / time.Millisecond)
+
+// SelectorPool shares series selectors between the operators of a query.
+// Selectors with identical matchers and hints whose time ranges overlap or are at most
+// maxMergeGap apart, such as the ones of `rate(m[5m]) / rate(m[5m] offset 1h)`, are merged
+// into a single selector which covers both time ranges and the gap between them,
+// so that each distinct selection is only made once against storage.
 type SelectorPool struct {
-	selectors map[uint64]*seriesSelector
+	selectors map[uint64][]*seriesSelector
+
+	queryable            storage.Queryable
+	regexResolutionLimit int
+	estimator            *Estimator
+
+	// shard and numShards restrict the series returned by selectors to a single shard.
+	shard     int
+	numShards int
+}
 
-	queryable storage.Queryable
+func NewSelectorPool(queryable storage.Queryable, opts *query.Options) *SelectorPool {
+	return &SelectorPool{
+		selectors:            make(map[uint64][]*seriesSelector),
+		queryable:            queryable,
+		regexResolutionLimit: opts.RegexResolutionLimit,
+		estimator:            NewEstimator(),
+	}
 }
 
-func NewSelectorPool(queryable storage.Queryable) *SelectorPool {
+// Isolated returns an empty SelectorPool for the same queryable. Its selectors are not merged
+// with the selectors of this pool, so that parts of a query which are evaluated for disjoint
+// time ranges, such as the slices of a split query, select series for their own range only.
+func (p *SelectorPool) Isolated() *SelectorPool {
 	return &SelectorPool{
-		selectors: make(map[uint64]*seriesSelector),
-		queryable: queryable,
+		selectors:            make(map[uint64][]*seriesSelector),
+		queryable:            p.queryable,
+		regexResolutionLimit: p.regexResolutionLimit,
+		estimator:            p.estimator,
+		shard:                p.shard,
+		numShards:            p.numShards,
 	}
 }
 
-func (p *SelectorPool) GetSelector(mint, maxt, step int64, matchers []*labels.Matcher, hints storage.SelectHints) SeriesSelector {
-	key := hashMatchers(matchers, mint, maxt, hints)
-	if _, ok := p.selectors[key]; !ok {
-		p.selectors[key] = newSeriesSelector(p.queryable, mint, maxt, step, matchers, hints)
+// Sharded returns a SelectorPool whose selectors only return the shard-th of numShards
+// disjoint shards of the selected series. Selections are shared with this pool, so
+// that the series are only selected once for all shards.
+func (p *SelectorPool) Sharded(shard, numShards int) *SelectorPool {
+	return &SelectorPool{
+		selectors:            p.selectors,
+		queryable:            p.queryable,
+		regexResolutionLimit: p.regexResolutionLimit,
+		estimator:            p.estimator,
+		shard:                shard,
+		numShards:            numShards,
+	}
+}
+
+// SelectorOption configures the selectors returned by a SelectorPool.
+type SelectorOption func(*selectorOptions)
+
+type selectorOptions struct {
+	existenceOnly  bool
+	histogramStats bool
+}
+
+func newSelectorOptions(opts []SelectorOption) selectorOptions {
+	var options selectorOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// WithExistenceOnly returns a selector for which only the presence of samples is needed,
+// and not their values. It is passed as a hint to queriers which implement ShardedQuerier.
+// Other queriers are not hinted, since storage.SelectHints cannot express it, and return samples as usual.
+func WithExistenceOnly() SelectorOption {
+	return func(o *selectorOptions) {
+		o.existenceOnly = true
+	}
+}
+
+// WithHistogramStats returns a filtered selector whose native histograms only retain
+// their count and sum. The series are still shared with selectors which need buckets.
+func WithHistogramStats() SelectorOption {
+	return func(o *selectorOptions) {
+		o.histogramStats = true
+	}
+}
+
+func (p *SelectorPool) GetSelector(mint, maxt, step int64, matchers []*labels.Matcher, hints storage.SelectHints, opts ...SelectorOption) SeriesSelector {
+	return p.shardSelector(p.getSelector(mint, maxt, step, matchers, hints, newSelectorOptions(opts)))
+}
+
+// GetFilteredSelector returns a selector which applies the filters to series selected with the
+// given matchers. A non-nil projection limits the labels of the returned series.
+func (p *SelectorPool) GetFilteredSelector(mint, maxt, step int64, matchers, filters []*labels.Matcher, projection *logicalplan.Projection, hints storage.SelectHints, opts ...SelectorOption) SeriesSelector {
+	options := newSelectorOptions(opts)
+	return p.shardSelector(NewFilteredSelector(p.getSelector(mint, maxt, step, matchers, hints, options), NewFilter(filters), projection, options.histogramStats))
+}
+
+// EstimateSeries estimates the series matching the matchers in [hints.Start, hints.End] without
+// creating a selector. The returned bool is false if storage cannot estimate them.
+func (p *SelectorPool) EstimateSeries(ctx context.Context, hints storage.SelectHints, matchers []*labels.Matcher) (SeriesEstimate, bool, error) {
+	return p.estimator.EstimateSeries(ctx, p.queryable, &hints, matchers...)
+}
+
+func (p *SelectorPool) shardSelector(selector SeriesSelector) SeriesSelector {
+	if p.numShards <= 1 {
+		return selector
 	}
-	return p.selectors[key]
+	return &shardedSelector{SeriesSelector: selector, shard: p.shard, numShards: p.numShards}
 }
 
-func (p *SelectorPool) GetFilteredSelector(mint, maxt, step int64, matchers, filters []*labels.Matcher, hints storage.SelectHints) SeriesSelector {
-	key := hashMatchers(matchers, mint, maxt, hints)
-	if _, ok := p.selectors[key]; !ok {
-		p.selectors[key] = newSeriesSelector(p.queryable, mint, maxt, step, matchers, hints)
+func (p *SelectorPool) getSelector(mint, maxt, step int64, matchers []*labels.Matcher, hints storage.SelectHints, options selectorOptions) *seriesSelector {
+	key := hashMatchers(matchers, hints, options)
+	for _, selector := range p.selectors[key] {
+		if selector.mint-maxMergeGap <= maxt && mint <= selector.maxt+maxMergeGap {
+			selector.extendTimeRange(mint, maxt)
+			return selector
+		}
 	}
 
-	return NewFilteredSelector(p.selectors[key], NewFilter(filters))
+	selector := newSeriesSelector(p.queryable, mint, maxt, step, matchers, hints)
+	selector.regexResolutionLimit = p.regexResolutionLimit
+	selector.estimator = p.estimator
+	selector.existenceOnly = options.existenceOnly
+	p.selectors[key] = append(p.selectors[key], selector)
+	return selector
 }
 
-func hashMatchers(matchers []*labels.Matcher, mint, maxt int64, hints storage.SelectHints) uint64 {
+func hashMatchers(matchers []*labels.Matcher, hints storage.SelectHints, options selectorOptions) uint64 {
 	sb := xxhash.New()
 	for _, m := range matchers {
 		writeMatcher(sb, m)
 	}
-	writeInt64(sb, mint)
-	writeInt64(sb, maxt)
 	writeInt64(sb, hints.Step)
+	writeInt64(sb, hints.Range)
 	writeString(sb, hints.Func)
 	writeString(sb, strings.Join(hints.Grouping, ";"))
 	writeBool(sb, hints.By)
+	writeBool(sb, options.existenceOnly)
 
 	key := sb.Sum64()
 	return key
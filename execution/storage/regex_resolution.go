@@ -0,0 +1,73 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package storage
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// resolveRegexMatchers replaces regex matchers with matchers for an explicit list of the
+// label values they match, as long as a matcher does not match more than limit values.
+// Stores which only index equality matchers can select series for such value lists
+// more efficiently than for arbitrary regular expressions. Resolution is best effort and
+// matchers are left untouched when label values cannot be retrieved.
+// The returned bool is false when one of the matchers does not match any series.
+func resolveRegexMatchers(querier storage.LabelQuerier, matchers []*labels.Matcher, limit int) ([]*labels.Matcher, bool) {
+	if limit <= 0 {
+		return matchers, true
+	}
+
+	var equalityMatchers []*labels.Matcher
+	for _, m := range matchers {
+		if m.Type == labels.MatchEqual {
+			equalityMatchers = append(equalityMatchers, m)
+		}
+	}
+
+	var resolved []*labels.Matcher
+	for i, m := range matchers {
+		if m.Type != labels.MatchRegexp || isLiteralAlternation(m.Value) {
+			continue
+		}
+		values, warns, err := querier.LabelValues(m.Name, equalityMatchers...)
+		// Warnings can indicate that values are missing, in which case
+		// resolving the matcher could drop series from the result.
+		if err != nil || len(warns) > 0 || len(values) > limit {
+			continue
+		}
+
+		matching := make([]string, 0, len(values))
+		for _, v := range values {
+			if m.Matches(v) {
+				matching = append(matching, regexp.QuoteMeta(v))
+			}
+		}
+		if m.Matches("") {
+			// Series without the label also match.
+			matching = append(matching, "")
+		}
+		if len(matching) == 0 {
+			return nil, false
+		}
+
+		if resolved == nil {
+			resolved = make([]*labels.Matcher, len(matchers))
+			copy(resolved, matchers)
+		}
+		resolved[i] = labels.MustNewMatcher(labels.MatchRegexp, m.Name, strings.Join(matching, "|"))
+	}
+	if resolved == nil {
+		return matchers, true
+	}
+	return resolved, true
+}
+
+// isLiteralAlternation returns true if the regex is an alternation of literal values.
+func isLiteralAlternation(re string) bool {
+	return !strings.ContainsAny(re, `\.+*?()[]{}^$`)
+}
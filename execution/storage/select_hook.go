@@ -0,0 +1,55 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package storage
+
+import (
+	"context"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// SelectRequest describes a select which is about to be made by a selector.
+type SelectRequest struct {
+	// Matchers are the label matchers of the selector.
+	Matchers []*labels.Matcher
+	// Hints are the select hints of the selector.
+	Hints storage.SelectHints
+	// Queryable is the storage which series are selected from.
+	Queryable storage.Queryable
+}
+
+// SelectHook is called with each select before it is made. It can veto the select by returning
+// an error, which fails the query, or change the request by rewriting its matchers or substituting
+// a different Queryable, for example for enforcing access control or routing selects of some
+// metrics to a dedicated store. Hooks may be called concurrently, and more than once for
+// the same selector when its shards are selected separately.
+type SelectHook func(ctx context.Context, req *SelectRequest) error
+
+type selectHookKey struct{}
+
+// WithSelectHook returns a context which makes queries executed with it
+// call the hook before each select.
+func WithSelectHook(ctx context.Context, hook SelectHook) context.Context {
+	return context.WithValue(ctx, selectHookKey{}, hook)
+}
+
+// applySelectHook returns the queryable and matchers which the selector should use,
+// after applying the select hook from the context, if there is one.
+func applySelectHook(ctx context.Context, queryable storage.Queryable, matchers []*labels.Matcher, hints storage.SelectHints) (storage.Queryable, []*labels.Matcher, error) {
+	hook, _ := ctx.Value(selectHookKey{}).(SelectHook)
+	if hook == nil {
+		return queryable, matchers, nil
+	}
+
+	req := &SelectRequest{
+		Matchers:  append([]*labels.Matcher(nil), matchers...),
+		Hints:     hints,
+		Queryable: queryable,
+	}
+	if err := hook(ctx, req); err != nil {
+		return nil, nil, err
+	}
+	return req.Queryable, req.Matchers, nil
+}
@@ -0,0 +1,328 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package storage
+
+import (
+	"container/list"
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+// SeriesCache caches series sets resolved by Select calls across queries.
+// Selected series are copied into immutable in-memory series, so that cached entries
+// do not depend on the querier which selected them. Entries are keyed by the queryable,
+// matchers, time range and select hints. They expire after the configured TTL, so that
+// samples which were appended to the storage become visible again, and are evicted in
+// least-recently-used order once the total number of cached samples exceeds the configured size.
+type SeriesCache struct {
+	maxSamples int
+	ttl        time.Duration
+	now        func() time.Time
+
+	mu      sync.Mutex
+	size    int
+	entries map[seriesCacheKey]*list.Element
+	lru     *list.List
+}
+
+type seriesCacheKey struct {
+	// scope is the storage which the series were selected from.
+	scope interface{}
+	hash  uint64
+}
+
+type seriesCacheEntry struct {
+	key     seriesCacheKey
+	series  []storage.Series
+	samples int
+	expires time.Time
+}
+
+// NewSeriesCache creates a SeriesCache which holds at most maxSamples samples,
+// and whose entries expire after ttl.
+func NewSeriesCache(maxSamples int, ttl time.Duration) *SeriesCache {
+	return &SeriesCache{
+		maxSamples: maxSamples,
+		ttl:        ttl,
+		now:        time.Now,
+		entries:    make(map[seriesCacheKey]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+func (c *SeriesCache) get(key seriesCacheKey) ([]storage.Series, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*seriesCacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.series, true
+}
+
+func (c *SeriesCache) set(key seriesCacheKey, series []storage.Series, samples int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(&seriesCacheEntry{
+		key:     key,
+		series:  series,
+		samples: samples,
+		expires: c.now().Add(c.ttl),
+	})
+	c.size += samples
+	for c.size > c.maxSamples {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *SeriesCache) remove(elem *list.Element) {
+	entry := elem.Value.(*seriesCacheEntry)
+	c.lru.Remove(elem)
+	delete(c.entries, entry.key)
+	c.size -= entry.samples
+}
+
+// Len returns the number of samples held by the cache.
+func (c *SeriesCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.size
+}
+
+type cachedQueryable struct {
+	queryable storage.Queryable
+	scope     interface{}
+	cache     *SeriesCache
+}
+
+// NewCachedQueryable returns a storage.Queryable which resolves Select calls from the
+// cache when an identical selection has already been made by a previous query.
+// Queryables which cannot be used as cache keys are returned unchanged.
+func NewCachedQueryable(queryable storage.Queryable, cache *SeriesCache) storage.Queryable {
+	if queryable == nil || !reflect.TypeOf(queryable).Comparable() {
+		return queryable
+	}
+	return &cachedQueryable{queryable: queryable, scope: queryable, cache: cache}
+}
+
+// NewCachedChunkQueryable returns a storage.Queryable which selects series as chunks, like the queryable
+// returned by NewChunkQueryable, and which resolves Select calls from the cache when an identical selection
+// has already been made by a previous query. Selections which are served from the cache are not read as chunks.
+// Queryables which cannot be used as cache keys are not cached.
+func NewCachedChunkQueryable(queryable storage.ChunkQueryable, cache *SeriesCache) storage.Queryable {
+	if queryable == nil || !reflect.TypeOf(queryable).Comparable() {
+		return NewChunkQueryable(queryable)
+	}
+	return &cachedQueryable{queryable: NewChunkQueryable(queryable), scope: queryable, cache: cache}
+}
+
+func (c *cachedQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	querier, err := c.queryable.Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedQuerier{Querier: querier, scope: c.scope, cache: c.cache, mint: mint, maxt: maxt}, nil
+}
+
+type cachedQuerier struct {
+	storage.Querier
+	scope interface{}
+	cache *SeriesCache
+
+	mint int64
+	maxt int64
+}
+
+func (c *cachedQuerier) Select(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	key := c.cacheKey(sortSeries, hints, matchers)
+	if series, ok := c.cache.get(key); ok {
+		return &cachedSeriesSet{series: series}
+	}
+
+	seriesSet := c.Querier.Select(sortSeries, hints, matchers...)
+	var (
+		series  []storage.Series
+		samples int
+	)
+	for seriesSet.Next() {
+		s, err := newCachedSeries(seriesSet.At())
+		if err != nil {
+			return storage.ErrSeriesSet(err)
+		}
+		samples += len(s.samples)
+		series = append(series, s)
+		if samples > c.cache.maxSamples {
+			// The selection does not fit into the cache, the remaining series are returned as they are.
+			return &cachedSeriesSet{series: series, next: seriesSet}
+		}
+	}
+	if seriesSet.Err() != nil || len(seriesSet.Warnings()) > 0 {
+		return &cachedSeriesSet{series: series, err: seriesSet.Err(), warnings: seriesSet.Warnings()}
+	}
+
+	c.cache.set(key, series, samples)
+	return &cachedSeriesSet{series: series}
+}
+
+func (c *cachedQuerier) cacheKey(sortSeries bool, hints *storage.SelectHints, matchers []*labels.Matcher) seriesCacheKey {
+	var selectHints storage.SelectHints
+	if hints != nil {
+		selectHints = *hints
+	}
+
+	sb := xxhash.New()
+	writeInt64(sb, int64(hashMatchers(matchers, selectHints, selectorOptions{})))
+	writeInt64(sb, c.mint)
+	writeInt64(sb, c.maxt)
+	writeInt64(sb, selectHints.Start)
+	writeInt64(sb, selectHints.End)
+	writeBool(sb, selectHints.DisableTrimming)
+	writeBool(sb, sortSeries)
+	return seriesCacheKey{scope: c.scope, hash: sb.Sum64()}
+}
+
+// cachedSeriesSet returns the cached series, followed by the series of next if it is set.
+type cachedSeriesSet struct {
+	series   []storage.Series
+	next     storage.SeriesSet
+	err      error
+	warnings storage.Warnings
+
+	i   int
+	cur storage.Series
+}
+
+func (s *cachedSeriesSet) Next() bool {
+	if s.i < len(s.series) {
+		s.cur = s.series[s.i]
+		s.i++
+		return true
+	}
+	if s.next == nil || !s.next.Next() {
+		return false
+	}
+	s.cur = s.next.At()
+	return true
+}
+
+func (s *cachedSeriesSet) At() storage.Series { return s.cur }
+
+func (s *cachedSeriesSet) Err() error {
+	if s.next != nil {
+		return s.next.Err()
+	}
+	return s.err
+}
+
+func (s *cachedSeriesSet) Warnings() storage.Warnings {
+	if s.next != nil {
+		return s.next.Warnings()
+	}
+	return s.warnings
+}
+
+type cachedSample struct {
+	t  int64
+	f  float64
+	fh *histogram.FloatHistogram
+}
+
+// cachedSeries is an immutable copy of the labels and samples of a selected series.
+type cachedSeries struct {
+	labels  labels.Labels
+	samples []cachedSample
+}
+
+func newCachedSeries(s storage.Series) (*cachedSeries, error) {
+	series := &cachedSeries{labels: s.Labels().Copy()}
+	it := s.Iterator(nil)
+	for {
+		switch it.Next() {
+		case chunkenc.ValNone:
+			return series, it.Err()
+		case chunkenc.ValFloat:
+			t, f := it.At()
+			series.samples = append(series.samples, cachedSample{t: t, f: f})
+		case chunkenc.ValHistogram, chunkenc.ValFloatHistogram:
+			t, fh := it.AtFloatHistogram()
+			series.samples = append(series.samples, cachedSample{t: t, fh: fh.Copy()})
+		}
+	}
+}
+
+func (s *cachedSeries) Labels() labels.Labels { return s.labels }
+
+func (s *cachedSeries) Iterator(chunkenc.Iterator) chunkenc.Iterator {
+	return &cachedSeriesIterator{samples: s.samples, i: -1}
+}
+
+type cachedSeriesIterator struct {
+	samples []cachedSample
+	i       int
+}
+
+func (it *cachedSeriesIterator) Next() chunkenc.ValueType {
+	if it.i < len(it.samples) {
+		it.i++
+	}
+	return it.valueType()
+}
+
+func (it *cachedSeriesIterator) Seek(t int64) chunkenc.ValueType {
+	if it.i < 0 {
+		it.i = 0
+	}
+	if it.i < len(it.samples) && it.samples[it.i].t < t {
+		it.i += sort.Search(len(it.samples)-it.i, func(j int) bool { return it.samples[it.i+j].t >= t })
+	}
+	return it.valueType()
+}
+
+func (it *cachedSeriesIterator) valueType() chunkenc.ValueType {
+	if it.i >= len(it.samples) {
+		return chunkenc.ValNone
+	}
+	if it.samples[it.i].fh != nil {
+		return chunkenc.ValFloatHistogram
+	}
+	return chunkenc.ValFloat
+}
+
+func (it *cachedSeriesIterator) At() (int64, float64) {
+	return it.samples[it.i].t, it.samples[it.i].f
+}
+
+func (it *cachedSeriesIterator) AtHistogram() (int64, *histogram.Histogram) {
+	panic("cached series only contain float histograms")
+}
+
+// AtFloatHistogram returns a copy of the cached histogram, since histograms can be modified by operators.
+func (it *cachedSeriesIterator) AtFloatHistogram() (int64, *histogram.FloatHistogram) {
+	return it.samples[it.i].t, it.samples[it.i].fh.Copy()
+}
+
+func (it *cachedSeriesIterator) AtT() int64 { return it.samples[it.i].t }
+
+func (it *cachedSeriesIterator) Err() error { return nil }
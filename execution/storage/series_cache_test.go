@@ -0,0 +1,109 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package storage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	promstg "github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+
+	"github.com/thanos-community/promql-engine/execution/storage"
+)
+
+type cachedSample struct {
+	T int64
+	V float64
+}
+
+func TestCachedQueryable(t *testing.T) {
+	newQuerier := func() *listQuerier {
+		return &listQuerier{series: []promstg.Series{
+			promql.NewStorageSeries(promql.Series{
+				Metric: labels.FromStrings("__name__", "foo", "pod", "p1"),
+				Floats: []promql.FPoint{{T: 10, F: 1}, {T: 20, F: 2}},
+			}),
+			promql.NewStorageSeries(promql.Series{
+				Metric: labels.FromStrings("__name__", "foo", "pod", "p2"),
+				Floats: []promql.FPoint{{T: 10, F: 3}, {T: 20, F: 4}},
+			}),
+		}}
+	}
+	expected := map[string][]cachedSample{
+		`{__name__="foo", pod="p1"}`: {{T: 10, V: 1}, {T: 20, V: 2}},
+		`{__name__="foo", pod="p2"}`: {{T: 10, V: 3}, {T: 20, V: 4}},
+	}
+
+	selectSeries := func(queryable promstg.Queryable, mint, maxt int64, matchers ...*labels.Matcher) map[string][]cachedSample {
+		q, err := queryable.Querier(context.Background(), mint, maxt)
+		testutil.Ok(t, err)
+
+		result := make(map[string][]cachedSample)
+		seriesSet := q.Select(false, &promstg.SelectHints{Start: mint, End: maxt}, matchers...)
+		for seriesSet.Next() {
+			series := seriesSet.At()
+			var samples []cachedSample
+			it := series.Iterator(nil)
+			for it.Next() == chunkenc.ValFloat {
+				ts, v := it.At()
+				samples = append(samples, cachedSample{T: ts, V: v})
+			}
+			testutil.Ok(t, it.Err())
+			result[series.Labels().String()] = samples
+		}
+		testutil.Ok(t, seriesSet.Err())
+		// Cached series remain readable after the querier which selected them was closed.
+		testutil.Ok(t, q.Close())
+		return result
+	}
+
+	foo := labels.MustNewMatcher(labels.MatchEqual, "__name__", "foo")
+	bar := labels.MustNewMatcher(labels.MatchEqual, "__name__", "bar")
+
+	t.Run("eviction", func(t *testing.T) {
+		querier := newQuerier()
+		cache := storage.NewSeriesCache(6, time.Hour)
+		queryable := storage.NewCachedQueryable(&promstg.MockQueryable{MockQuerier: querier}, cache)
+
+		testutil.Equals(t, expected, selectSeries(queryable, 0, 100, foo))
+		testutil.Equals(t, expected, selectSeries(queryable, 0, 100, foo))
+		testutil.Equals(t, 1, querier.calls)
+		testutil.Equals(t, 4, cache.Len())
+
+		// A different time range is not served from the cache, and evicts the first entry.
+		testutil.Equals(t, expected, selectSeries(queryable, 0, 200, foo))
+		testutil.Equals(t, 2, querier.calls)
+		testutil.Equals(t, 4, cache.Len())
+		testutil.Equals(t, expected, selectSeries(queryable, 0, 100, foo))
+		testutil.Equals(t, 3, querier.calls)
+
+		// Different queryables do not share entries.
+		other := newQuerier()
+		otherQueryable := storage.NewCachedQueryable(&promstg.MockQueryable{MockQuerier: other}, cache)
+		testutil.Equals(t, expected, selectSeries(otherQueryable, 0, 100, foo))
+		testutil.Equals(t, 1, other.calls)
+
+		// Selections which exceed the size of the cache are returned in full, but are not cached.
+		small := storage.NewSeriesCache(3, time.Hour)
+		smallQueryable := storage.NewCachedQueryable(&promstg.MockQueryable{MockQuerier: querier}, small)
+		testutil.Equals(t, expected, selectSeries(smallQueryable, 0, 100, bar))
+		testutil.Equals(t, 0, small.Len())
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		querier := newQuerier()
+		cache := storage.NewSeriesCache(100, 0)
+		queryable := storage.NewCachedQueryable(&promstg.MockQueryable{MockQuerier: querier}, cache)
+
+		// Entries expire immediately, so every selection reaches the storage.
+		testutil.Equals(t, expected, selectSeries(queryable, 0, 100, foo))
+		testutil.Equals(t, expected, selectSeries(queryable, 0, 100, foo))
+		testutil.Equals(t, 2, querier.calls)
+	})
+}
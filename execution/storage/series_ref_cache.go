@@ -0,0 +1,185 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package storage
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+)
+
+// SeriesReferencer is implemented by series which have a reference that
+// is stable across queries, such as series from the head block of a TSDB.
+type SeriesReferencer interface {
+	SeriesRef() storage.SeriesRef
+}
+
+// SeriesRefCache caches computations on the labels of series across queries,
+// keyed by the queryable which returned the series and their references. Since
+// references can be reassigned to different series, the cache has to be reset
+// whenever that happens, for example after the head block of a TSDB has been truncated.
+// The cache holds at most the configured number of entries, and is reset once it is full.
+type SeriesRefCache struct {
+	maxEntries int
+
+	mu          sync.RWMutex
+	size        int
+	droppedName map[seriesRefKey]labels.Labels
+	hashes      map[string]map[seriesRefKey]uint64
+}
+
+// seriesRefKey identifies a series by its reference, which is only unique
+// within the queryable which returned it.
+type seriesRefKey struct {
+	queryable storage.Queryable
+	ref       storage.SeriesRef
+}
+
+// NewSeriesRefCache creates an empty SeriesRefCache which holds at most maxEntries entries.
+func NewSeriesRefCache(maxEntries int) *SeriesRefCache {
+	return &SeriesRefCache{
+		maxEntries:  maxEntries,
+		droppedName: make(map[seriesRefKey]labels.Labels),
+		hashes:      make(map[string]map[seriesRefKey]uint64),
+	}
+}
+
+// Reset removes all entries from the cache.
+func (c *SeriesRefCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.reset()
+}
+
+func (c *SeriesRefCache) reset() {
+	c.size = 0
+	c.droppedName = make(map[seriesRefKey]labels.Labels)
+	c.hashes = make(map[string]map[seriesRefKey]uint64)
+}
+
+// reserve makes room for n new entries, resetting the cache if it is full. It reports
+// whether the entries can be added, which they can not if they exceed the size of the cache.
+func (c *SeriesRefCache) reserve(n int) bool {
+	if n > c.maxEntries {
+		return false
+	}
+	if c.size+n > c.maxEntries {
+		c.reset()
+	}
+	c.size += n
+	return true
+}
+
+// Len returns the number of entries held by the cache.
+func (c *SeriesRefCache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.size
+}
+
+// ScopedSeriesRefCache is a view of a SeriesRefCache for the series of a single queryable.
+type ScopedSeriesRefCache struct {
+	cache     *SeriesRefCache
+	queryable storage.Queryable
+}
+
+// DropMetricName returns the labels of the series with the metric name removed.
+// The returned labels are shared between queries and must not be modified.
+func (s *ScopedSeriesRefCache) DropMetricName(ref storage.SeriesRef, lbls labels.Labels) labels.Labels {
+	c, key := s.cache, seriesRefKey{queryable: s.queryable, ref: ref}
+	c.mu.RLock()
+	dropped, ok := c.droppedName[key]
+	c.mu.RUnlock()
+	if ok {
+		return dropped
+	}
+
+	dropped = labels.NewBuilder(lbls).Del(labels.MetricName).Labels()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.droppedName[key]; !ok && c.reserve(1) {
+		c.droppedName[key] = dropped
+	}
+	return dropped
+}
+
+// Hashes returns the hash of each series for the given grouping.
+func (s *ScopedSeriesRefCache) Hashes(refs []storage.SeriesRef, series []labels.Labels, grouping model.Grouping) []uint64 {
+	c, group := s.cache, grouping.String()
+	result := make([]uint64, len(series))
+
+	var missing []int
+	c.mu.RLock()
+	cached := c.hashes[group]
+	for i, ref := range refs {
+		h, ok := cached[seriesRefKey{queryable: s.queryable, ref: ref}]
+		if !ok {
+			missing = append(missing, i)
+			continue
+		}
+		result[i] = h
+	}
+	c.mu.RUnlock()
+	if len(missing) == 0 {
+		return result
+	}
+
+	buf := make([]byte, 0, 1024)
+	for _, i := range missing {
+		result[i] = grouping.Hash(series[i], buf)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.reserve(len(missing)) {
+		return result
+	}
+	if c.hashes[group] == nil {
+		c.hashes[group] = make(map[seriesRefKey]uint64)
+	}
+	for _, i := range missing {
+		c.hashes[group][seriesRefKey{queryable: s.queryable, ref: refs[i]}] = result[i]
+	}
+	return result
+}
+
+type seriesRefCacheKey struct{}
+
+// WithSeriesRefCache returns a context which makes selectors reuse computations on series with
+// stable references from the cache. Entries are scoped to the queryable which the query selects
+// from, since references are only unique within a queryable. Queryables which can not be used as
+// cache keys do not use the cache.
+func WithSeriesRefCache(ctx context.Context, cache *SeriesRefCache, queryable storage.Queryable) context.Context {
+	if queryable == nil || !reflect.TypeOf(queryable).Comparable() {
+		return ctx
+	}
+	return context.WithValue(ctx, seriesRefCacheKey{}, &ScopedSeriesRefCache{cache: cache, queryable: queryable})
+}
+
+// SeriesRefCacheFromContext returns the cache attached to the context, or nil if there is none.
+func SeriesRefCacheFromContext(ctx context.Context) *ScopedSeriesRefCache {
+	cache, _ := ctx.Value(seriesRefCacheKey{}).(*ScopedSeriesRefCache)
+	return cache
+}
+
+// SeriesRefs returns the references of the series, or false
+// if any of the series does not have a stable reference.
+func SeriesRefs(series []SignedSeries) ([]storage.SeriesRef, bool) {
+	refs := make([]storage.SeriesRef, len(series))
+	for i, s := range series {
+		r, ok := s.Series.(SeriesReferencer)
+		if !ok {
+			return nil, false
+		}
+		refs[i] = r.SeriesRef()
+	}
+	return refs, true
+}
@@ -0,0 +1,54 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package storage_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	promstg "github.com/prometheus/prometheus/storage"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/execution/storage"
+)
+
+func TestSeriesRefCache(t *testing.T) {
+	cache := storage.NewSeriesRefCache(5)
+	queryable := &promstg.MockQueryable{}
+	scoped := storage.SeriesRefCacheFromContext(storage.WithSeriesRefCache(context.Background(), cache, queryable))
+	series := []labels.Labels{
+		labels.FromStrings("__name__", "foo", "pod", "p1", "zone", "a"),
+		labels.FromStrings("__name__", "foo", "pod", "p2", "zone", "a"),
+	}
+	refs := []promstg.SeriesRef{1, 2}
+
+	dropped := scoped.DropMetricName(refs[0], series[0])
+	testutil.Equals(t, labels.FromStrings("pod", "p1", "zone", "a"), dropped)
+	// Cached labels are returned for the reference, regardless of the labels passed in.
+	testutil.Equals(t, dropped, scoped.DropMetricName(refs[0], series[1]))
+
+	// References of other queryables do not share entries.
+	other := storage.SeriesRefCacheFromContext(storage.WithSeriesRefCache(context.Background(), cache, &promstg.MockQueryable{}))
+	testutil.Equals(t, labels.FromStrings("pod", "p2", "zone", "a"), other.DropMetricName(refs[0], series[1]))
+	testutil.Equals(t, 2, cache.Len())
+
+	byZone := model.Grouping{Labels: []string{"zone"}}
+	hashes := scoped.Hashes(refs, series, byZone)
+	testutil.Equals(t, hashes[0], hashes[1])
+	testutil.Equals(t, hashes, scoped.Hashes(refs, series, byZone))
+	testutil.Equals(t, 4, cache.Len())
+
+	// The cache is reset once it is full.
+	withoutZone := model.Grouping{Without: true, Labels: []string{"zone"}}
+	hashes = scoped.Hashes(refs, series, withoutZone)
+	testutil.Assert(t, hashes[0] != hashes[1])
+	testutil.Equals(t, 2, cache.Len())
+	testutil.Equals(t, labels.FromStrings("pod", "p2", "zone", "a"), scoped.DropMetricName(refs[0], series[1]))
+
+	cache.Reset()
+	testutil.Equals(t, 0, cache.Len())
+	testutil.Equals(t, labels.FromStrings("pod", "p1", "zone", "a"), scoped.DropMetricName(refs[0], series[0]))
+}
@@ -6,14 +6,57 @@ package storage
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/storage"
+
+	"github.com/thanos-community/promql-engine/execution/warnings"
 )
 
 type SeriesSelector interface {
 	GetSeries(ctx context.Context, shard, numShards int) ([]SignedSeries, error)
 	Matchers() []*labels.Matcher
+	// EstimateSeries returns an estimate of the series and samples returned by the selector
+	// without selecting them. The returned bool is false if storage cannot estimate them.
+	EstimateSeries(ctx context.Context) (SeriesEstimate, bool, error)
+}
+
+// SeriesBatchSelector is implemented by selectors which can return the series
+// of a shard in batches, as they are read from storage.
+type SeriesBatchSelector interface {
+	SeriesSelector
+	// GetSeriesBatches calls f with consecutive batches of at most batchSize series of the shard.
+	// The signatures of the series are numbered across batches, as with GetSeries.
+	GetSeriesBatches(ctx context.Context, shard, numShards, batchSize int, f func([]SignedSeries) error) error
+}
+
+// GetSeriesBatches calls f with consecutive batches of at most batchSize series of the shard.
+// The series of selectors which do not implement SeriesBatchSelector are loaded before
+// they are split into batches.
+func GetSeriesBatches(ctx context.Context, selector SeriesSelector, shard, numShards, batchSize int, f func([]SignedSeries) error) error {
+	if s, ok := selector.(SeriesBatchSelector); ok {
+		return s.GetSeriesBatches(ctx, shard, numShards, batchSize, f)
+	}
+	series, err := selector.GetSeries(ctx, shard, numShards)
+	if err != nil {
+		return err
+	}
+	return batchSeries(series, batchSize, f)
+}
+
+func batchSeries(series []SignedSeries, batchSize int, f func([]SignedSeries) error) error {
+	for len(series) > 0 {
+		n := batchSize
+		if n > len(series) {
+			n = len(series)
+		}
+		if err := f(series[:n]); err != nil {
+			return err
+		}
+		series = series[n:]
+	}
+	return nil
 }
 
 type SignedSeries struct {
@@ -21,6 +64,32 @@ type SignedSeries struct {
 	Signature uint64
 }
 
+// ShardedSelectHints extends storage.SelectHints with the shard
+// which should be returned by a sharded select.
+type ShardedSelectHints struct {
+	storage.SelectHints
+
+	// ShardIndex is the index of the shard to select, in the range [0, ShardCount).
+	ShardIndex uint64
+	// ShardCount is the total number of shards the series are split into.
+	ShardCount uint64
+	// ExistenceOnly is set when only the presence of samples is needed and not their values,
+	// for example for count() and group(). Queriers can then avoid decoding native histograms
+	// and return float samples with any value instead, but they must keep stale markers.
+	// storage.SelectHints has no equivalent, so the hint only reaches queriers which implement
+	// ShardedQuerier, which are then called with a single shard when series are not sharded.
+	ExistenceOnly bool
+}
+
+// ShardedQuerier is implemented by queriers which are able to return
+// only the series belonging to a single shard. When the querier returned
+// by the underlying Queryable implements this interface, each shard of a
+// selector fetches only its own series instead of sharding the full series
+// set after it has been loaded from storage.
+type ShardedQuerier interface {
+	SelectShard(sortSeries bool, hints *ShardedSelectHints, matchers ...*labels.Matcher) storage.SeriesSet
+}
+
 type seriesSelector struct {
 	storage  storage.Queryable
 	mint     int64
@@ -29,8 +98,34 @@ type seriesSelector struct {
 	matchers []*labels.Matcher
 	hints    storage.SelectHints
 
+	regexResolutionLimit int
+	existenceOnly        bool
+	estimator            *Estimator
+
 	once   sync.Once
 	series []SignedSeries
+
+	estimateOnce sync.Once
+	estimate     SeriesEstimate
+	estimated    bool
+	estimateErr  error
+
+	shardingUnsupported atomic.Bool
+	shardsMu            sync.Mutex
+	shards              map[shardKey]*selectedShard
+}
+
+type shardKey struct {
+	shard     int
+	numShards int
+}
+
+type selectedShard struct {
+	once   sync.Once
+	series []SignedSeries
+	// sharded is false when the querier does not implement ShardedQuerier.
+	sharded bool
+	err     error
 }
 
 func newSeriesSelector(storage storage.Queryable, mint, maxt, step int64, matchers []*labels.Matcher, hints storage.SelectHints) *seriesSelector {
@@ -41,6 +136,20 @@ func newSeriesSelector(storage storage.Queryable, mint, maxt, step int64, matche
 		step:     step,
 		matchers: matchers,
 		hints:    hints,
+		shards:   make(map[shardKey]*selectedShard),
+	}
+}
+
+// extendTimeRange widens the time range of the selector so that it also
+// covers [mint, maxt]. It must be called before any series are loaded.
+func (o *seriesSelector) extendTimeRange(mint, maxt int64) {
+	if mint < o.mint {
+		o.mint = mint
+		o.hints.Start = mint
+	}
+	if maxt > o.maxt {
+		o.maxt = maxt
+		o.hints.End = maxt
 	}
 }
 
@@ -48,8 +157,24 @@ func (o *seriesSelector) Matchers() []*labels.Matcher {
 	return o.matchers
 }
 
+func (o *seriesSelector) EstimateSeries(ctx context.Context) (SeriesEstimate, bool, error) {
+	o.estimateOnce.Do(func() {
+		hints := o.hints
+		hints.Start, hints.End = o.mint, o.maxt
+		o.estimate, o.estimated, o.estimateErr = o.estimator.EstimateSeries(ctx, o.storage, &hints, o.matchers...)
+	})
+	return o.estimate, o.estimated, o.estimateErr
+}
+
 func (o *seriesSelector) GetSeries(ctx context.Context, shard int, numShards int) ([]SignedSeries, error) {
-	var err error
+	series, ok, err := o.getShardedSeries(ctx, shard, numShards)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return series, nil
+	}
+
 	o.once.Do(func() { err = o.loadSeries(ctx) })
 	if err != nil {
 		return nil, err
@@ -59,13 +184,27 @@ func (o *seriesSelector) GetSeries(ctx context.Context, shard int, numShards int
 }
 
 func (o *seriesSelector) loadSeries(ctx context.Context) error {
-	querier, err := o.storage.Querier(ctx, o.mint, o.maxt)
+	queryable, matchers, err := applySelectHook(ctx, o.storage, o.matchers, o.hints)
+	if err != nil {
+		return err
+	}
+	querier, err := queryable.Querier(ctx, o.mint, o.maxt)
 	if err != nil {
 		return err
 	}
 	defer querier.Close()
 
-	seriesSet := querier.Select(false, &o.hints, o.matchers...)
+	matchers, ok := resolveRegexMatchers(querier, matchers, o.regexResolutionLimit)
+	if !ok {
+		return nil
+	}
+	var seriesSet storage.SeriesSet
+	if sharded, ok := querier.(ShardedQuerier); ok && o.existenceOnly {
+		// The existence hint can only be passed with sharded selects.
+		seriesSet = sharded.SelectShard(false, &ShardedSelectHints{SelectHints: o.hints, ShardCount: 1, ExistenceOnly: true}, matchers...)
+	} else {
+		seriesSet = querier.Select(false, &o.hints, matchers...)
+	}
 	i := 0
 	for seriesSet.Next() {
 		s := seriesSet.At()
@@ -75,6 +214,157 @@ func (o *seriesSelector) loadSeries(ctx context.Context) error {
 		})
 		i++
 	}
+	for _, w := range seriesSet.Warnings() {
+		warnings.AddToContext(w, ctx)
+	}
+
+	return seriesSet.Err()
+}
+
+// GetSeriesBatches passes the series of the shard to f in batches as they are read from storage.
+// Unlike GetSeries, the series are selected on each call and are not retained by the selector,
+// unless the querier does not support sharded selects and the shard has to be computed from
+// the full series set.
+func (o *seriesSelector) GetSeriesBatches(ctx context.Context, shard, numShards, batchSize int, f func([]SignedSeries) error) error {
+	if numShards > 1 && o.shardingUnsupported.Load() {
+		return o.getSeriesBatches(ctx, shard, numShards, batchSize, f)
+	}
+
+	queryable, matchers, err := applySelectHook(ctx, o.storage, o.matchers, o.hints)
+	if err != nil {
+		return err
+	}
+	querier, err := queryable.Querier(ctx, o.mint, o.maxt)
+	if err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	sharded, ok := querier.(ShardedQuerier)
+	if !ok && numShards > 1 {
+		o.shardingUnsupported.Store(true)
+		return o.getSeriesBatches(ctx, shard, numShards, batchSize, f)
+	}
+	matchers, ok = resolveRegexMatchers(querier, matchers, o.regexResolutionLimit)
+	if !ok {
+		return nil
+	}
+	var seriesSet storage.SeriesSet
+	switch {
+	case sharded != nil && (numShards > 1 || o.existenceOnly):
+		hints := &ShardedSelectHints{SelectHints: o.hints, ShardIndex: uint64(shard), ShardCount: 1, ExistenceOnly: o.existenceOnly}
+		if numShards > 1 {
+			hints.ShardCount = uint64(numShards)
+		}
+		seriesSet = sharded.SelectShard(false, hints, matchers...)
+	default:
+		seriesSet = querier.Select(false, &o.hints, matchers...)
+	}
+
+	batch := make([]SignedSeries, 0, batchSize)
+	i := 0
+	for seriesSet.Next() {
+		batch = append(batch, SignedSeries{
+			Series:    seriesSet.At(),
+			Signature: uint64(i),
+		})
+		i++
+		if len(batch) == batchSize {
+			if err := f(batch); err != nil {
+				return err
+			}
+			batch = make([]SignedSeries, 0, batchSize)
+		}
+	}
+	if len(batch) > 0 {
+		if err := f(batch); err != nil {
+			return err
+		}
+	}
+	for _, w := range seriesSet.Warnings() {
+		warnings.AddToContext(w, ctx)
+	}
+
+	return seriesSet.Err()
+}
+
+func (o *seriesSelector) getSeriesBatches(ctx context.Context, shard, numShards, batchSize int, f func([]SignedSeries) error) error {
+	series, err := o.GetSeries(ctx, shard, numShards)
+	if err != nil {
+		return err
+	}
+	return batchSeries(series, batchSize, f)
+}
+
+// getShardedSeries returns the series of a single shard when the underlying
+// querier supports sharded selects. The returned bool is false when the
+// shard needs to be computed from the full series set instead.
+func (o *seriesSelector) getShardedSeries(ctx context.Context, shard int, numShards int) ([]SignedSeries, bool, error) {
+	if numShards <= 1 || o.shardingUnsupported.Load() {
+		return nil, false, nil
+	}
+
+	s := o.getShard(shard, numShards)
+	s.once.Do(func() { s.err = o.loadShard(ctx, s, shard, numShards) })
+	if s.err != nil {
+		return nil, false, s.err
+	}
+	return s.series, s.sharded, nil
+}
+
+func (o *seriesSelector) getShard(shard, numShards int) *selectedShard {
+	o.shardsMu.Lock()
+	defer o.shardsMu.Unlock()
+
+	key := shardKey{shard: shard, numShards: numShards}
+	s, ok := o.shards[key]
+	if !ok {
+		s = &selectedShard{}
+		o.shards[key] = s
+	}
+	return s
+}
+
+func (o *seriesSelector) loadShard(ctx context.Context, s *selectedShard, shard, numShards int) error {
+	queryable, matchers, err := applySelectHook(ctx, o.storage, o.matchers, o.hints)
+	if err != nil {
+		return err
+	}
+	querier, err := queryable.Querier(ctx, o.mint, o.maxt)
+	if err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	sharded, ok := querier.(ShardedQuerier)
+	if !ok {
+		o.shardingUnsupported.Store(true)
+		return nil
+	}
+	s.sharded = true
+
+	matchers, ok = resolveRegexMatchers(querier, matchers, o.regexResolutionLimit)
+	if !ok {
+		return nil
+	}
+	hints := &ShardedSelectHints{
+		SelectHints:   o.hints,
+		ShardIndex:    uint64(shard),
+		ShardCount:    uint64(numShards),
+		ExistenceOnly: o.existenceOnly,
+	}
+	seriesSet := sharded.SelectShard(false, hints, matchers...)
+	i := 0
+	for seriesSet.Next() {
+		s.series = append(s.series, SignedSeries{
+			Series:    seriesSet.At(),
+			Signature: uint64(i),
+		})
+		i++
+	}
+	for _, w := range seriesSet.Warnings() {
+		warnings.AddToContext(w, ctx)
+	}
 
 	return seriesSet.Err()
 }
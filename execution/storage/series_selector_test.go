@@ -0,0 +1,534 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package storage_test
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	promstg "github.com/prometheus/prometheus/storage"
+
+	"github.com/thanos-community/promql-engine/execution/storage"
+	"github.com/thanos-community/promql-engine/query"
+)
+
+func TestSeriesSelector_GetSeries(t *testing.T) {
+	const numShards = 3
+	series := []promstg.Series{
+		&mockLabelSeries{labels: labels.FromStrings("__name__", "foo", "pod", "p1")},
+		&mockLabelSeries{labels: labels.FromStrings("__name__", "foo", "pod", "p2")},
+		&mockLabelSeries{labels: labels.FromStrings("__name__", "foo", "pod", "p3")},
+		&mockLabelSeries{labels: labels.FromStrings("__name__", "foo", "pod", "p4")},
+		&mockLabelSeries{labels: labels.FromStrings("__name__", "foo", "pod", "p5")},
+	}
+	matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "foo")}
+	filters := []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "pod", "p[1-3]")}
+
+	cases := []struct {
+		name          string
+		sharded       bool
+		filtered      bool
+		expected      []string
+		expectedCalls int
+	}{
+		{
+			name:          "querier without sharding support",
+			expected:      []string{"p1", "p2", "p3", "p4", "p5"},
+			expectedCalls: 1,
+		},
+		{
+			name:          "querier with sharding support",
+			sharded:       true,
+			expected:      []string{"p1", "p2", "p3", "p4", "p5"},
+			expectedCalls: numShards,
+		},
+		{
+			name:          "filtered querier without sharding support",
+			filtered:      true,
+			expected:      []string{"p1", "p2", "p3"},
+			expectedCalls: 1,
+		},
+		{
+			name:          "filtered querier with sharding support",
+			sharded:       true,
+			filtered:      true,
+			expected:      []string{"p1", "p2", "p3"},
+			expectedCalls: numShards,
+		},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			querier := &listQuerier{series: series}
+			var queryable promstg.Queryable = &promstg.MockQueryable{MockQuerier: querier}
+			if tcase.sharded {
+				queryable = &promstg.MockQueryable{MockQuerier: &shardedQuerier{listQuerier: querier}}
+			}
+			pool := storage.NewSelectorPool(queryable, &query.Options{})
+
+			var selector storage.SeriesSelector
+			if tcase.filtered {
+				selector = pool.GetFilteredSelector(0, 100, 10, matchers, filters, nil, promstg.SelectHints{})
+			} else {
+				selector = pool.GetSelector(0, 100, 10, matchers, promstg.SelectHints{})
+			}
+
+			var pods []string
+			for i := 0; i < numShards; i++ {
+				shard, err := selector.GetSeries(context.Background(), i, numShards)
+				testutil.Ok(t, err)
+				for j, s := range shard {
+					testutil.Equals(t, uint64(j), s.Signature)
+					pods = append(pods, s.Labels().Get("pod"))
+				}
+			}
+			sort.Strings(pods)
+			testutil.Equals(t, tcase.expected, pods)
+
+			querier.mu.Lock()
+			defer querier.mu.Unlock()
+			testutil.Equals(t, tcase.expectedCalls, querier.calls)
+			if tcase.sharded {
+				sort.Slice(querier.shards, func(i, j int) bool { return querier.shards[i] < querier.shards[j] })
+				testutil.Equals(t, []uint64{0, 1, 2}, querier.shards)
+			}
+		})
+	}
+}
+
+func TestSeriesSelector_GetSeriesBatches(t *testing.T) {
+	series := []promstg.Series{
+		&mockLabelSeries{labels: labels.FromStrings("__name__", "foo", "pod", "p1")},
+		&mockLabelSeries{labels: labels.FromStrings("__name__", "foo", "pod", "p2")},
+		&mockLabelSeries{labels: labels.FromStrings("__name__", "foo", "pod", "p3")},
+		&mockLabelSeries{labels: labels.FromStrings("__name__", "foo", "pod", "p4")},
+		&mockLabelSeries{labels: labels.FromStrings("__name__", "foo", "pod", "p5")},
+	}
+	matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "foo")}
+	filters := []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "pod", "p[1-3]|p5")}
+
+	cases := []struct {
+		name     string
+		filtered bool
+		expected [][]string
+	}{
+		{
+			name:     "selector",
+			expected: [][]string{{"p1", "p2"}, {"p3", "p4"}, {"p5"}},
+		},
+		{
+			name:     "filtered selector",
+			filtered: true,
+			expected: [][]string{{"p1", "p2"}, {"p3"}, {"p5"}},
+		},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			pool := storage.NewSelectorPool(&promstg.MockQueryable{MockQuerier: &listQuerier{series: series}}, &query.Options{})
+
+			var selector storage.SeriesSelector
+			if tcase.filtered {
+				selector = pool.GetFilteredSelector(0, 100, 10, matchers, filters, nil, promstg.SelectHints{})
+			} else {
+				selector = pool.GetSelector(0, 100, 10, matchers, promstg.SelectHints{})
+			}
+
+			var (
+				batches   [][]string
+				signature uint64
+			)
+			err := storage.GetSeriesBatches(context.Background(), selector, 0, 1, 2, func(series []storage.SignedSeries) error {
+				var pods []string
+				for _, s := range series {
+					testutil.Equals(t, signature, s.Signature)
+					signature++
+					pods = append(pods, s.Labels().Get("pod"))
+				}
+				batches = append(batches, pods)
+				return nil
+			})
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expected, batches)
+		})
+	}
+}
+
+func TestSelectorPool_MergesOverlappingSelectors(t *testing.T) {
+	querier := &listQuerier{series: []promstg.Series{
+		&mockLabelSeries{labels: labels.FromStrings("__name__", "foo", "pod", "p1")},
+	}}
+	pool := storage.NewSelectorPool(&promstg.MockQueryable{MockQuerier: querier}, &query.Options{})
+	matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "foo")}
+	hints := func(start, end int64) promstg.SelectHints {
+		return promstg.SelectHints{Start: start, End: end, Func: "rate", Range: 300}
+	}
+
+	selectors := []storage.SeriesSelector{
+		pool.GetSelector(1000, 2000, 10, matchers, hints(1000, 2000)),
+		// Same selection with an offset.
+		pool.GetSelector(500, 1500, 10, matchers, hints(500, 1500)),
+		pool.GetFilteredSelector(1800, 2500, 10, matchers, nil, nil, hints(1800, 2500)),
+		// More than an hour apart from the others.
+		pool.GetSelector(3_700_000, 3_800_000, 10, matchers, hints(3_700_000, 3_800_000)),
+	}
+	for _, selector := range selectors {
+		series, err := selector.GetSeries(context.Background(), 0, 1)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(series))
+	}
+
+	testutil.Equals(t, 2, querier.calls)
+	testutil.Equals(t, []promstg.SelectHints{hints(500, 2500), hints(3_700_000, 3_800_000)}, querier.hints)
+}
+
+func TestSelectorPool_MergesSelectorsWithOffsets(t *testing.T) {
+	matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "m")}
+	const (
+		fiveMinutes = 300_000
+		hour        = 3_600_000
+	)
+	hints := func(start, end int64) promstg.SelectHints {
+		return promstg.SelectHints{Start: start, End: end, Func: "rate", Range: fiveMinutes}
+	}
+
+	// The selectors of `rate(m[5m]) / rate(m[5m] offset 1h)` for an instant query and for range queries
+	// shorter than the offset do not overlap, and are merged into a single selection.
+	cases := []struct {
+		name       string
+		start, end int64
+	}{
+		{name: "instant query", start: 2 * hour, end: 2 * hour},
+		{name: "range query", start: 2 * hour, end: 2*hour + 6*fiveMinutes},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			querier := &listQuerier{series: []promstg.Series{
+				&mockLabelSeries{labels: labels.FromStrings("__name__", "m", "pod", "p1")},
+			}}
+			pool := storage.NewSelectorPool(&promstg.MockQueryable{MockQuerier: querier}, &query.Options{})
+
+			mint, maxt := tcase.start-fiveMinutes, tcase.end
+			selectors := []storage.SeriesSelector{
+				pool.GetSelector(mint, maxt, 10, matchers, hints(mint, maxt)),
+				pool.GetSelector(mint-hour, maxt-hour, 10, matchers, hints(mint-hour, maxt-hour)),
+			}
+			for _, selector := range selectors {
+				series, err := selector.GetSeries(context.Background(), 0, 1)
+				testutil.Ok(t, err)
+				testutil.Equals(t, 1, len(series))
+			}
+
+			testutil.Equals(t, 1, querier.calls)
+			testutil.Equals(t, []promstg.SelectHints{hints(mint-hour, maxt)}, querier.hints)
+		})
+	}
+}
+
+func TestSelectorPool_ExistenceOnly(t *testing.T) {
+	querier := &shardedQuerier{listQuerier: &listQuerier{series: []promstg.Series{
+		&mockLabelSeries{labels: labels.FromStrings("__name__", "foo", "pod", "p1")},
+	}}}
+	pool := storage.NewSelectorPool(&promstg.MockQueryable{MockQuerier: querier}, &query.Options{})
+	matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "foo")}
+
+	// Selections which need sample values are not shared with selections which do not.
+	selectors := []storage.SeriesSelector{
+		pool.GetSelector(0, 100, 10, matchers, promstg.SelectHints{}),
+		pool.GetSelector(0, 100, 10, matchers, promstg.SelectHints{}, storage.WithExistenceOnly()),
+		pool.GetFilteredSelector(0, 100, 10, matchers, nil, nil, promstg.SelectHints{}, storage.WithExistenceOnly()),
+	}
+	for _, selector := range selectors {
+		series, err := selector.GetSeries(context.Background(), 0, 2)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(series))
+	}
+
+	testutil.Equals(t, 2, querier.calls)
+	testutil.Equals(t, []bool{false, true}, querier.existenceOnly)
+
+	// The hint is also passed when the series are not split into shards.
+	selector := pool.GetSelector(0, 200, 10, matchers, promstg.SelectHints{}, storage.WithExistenceOnly())
+	series, err := selector.GetSeries(context.Background(), 0, 1)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(series))
+	testutil.Equals(t, []bool{false, true, true}, querier.existenceOnly)
+}
+
+func TestSeriesSelector_EstimateSeries(t *testing.T) {
+	matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "foo")}
+	filters := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "pod", "p1")}
+
+	t.Run("querier without estimates", func(t *testing.T) {
+		queryable := &countingQueryable{Queryable: &promstg.MockQueryable{MockQuerier: &listQuerier{}}}
+		pool := storage.NewSelectorPool(queryable, &query.Options{})
+		for _, selector := range []storage.SeriesSelector{
+			pool.GetSelector(0, 100, 10, matchers, promstg.SelectHints{}),
+			pool.GetSelector(0, 100, 10, filters, promstg.SelectHints{}),
+		} {
+			_, ok, err := selector.EstimateSeries(context.Background())
+			testutil.Ok(t, err)
+			testutil.Assert(t, !ok, "expected no estimate")
+		}
+
+		// Queryables without estimates are only checked once for all selectors of a query.
+		testutil.Equals(t, 1, queryable.queriers)
+	})
+	t.Run("select hook", func(t *testing.T) {
+		querier := &estimatingQuerier{listQuerier: &listQuerier{}, estimate: storage.SeriesEstimate{Series: 10, Samples: 100}}
+		pool := storage.NewSelectorPool(&promstg.MockQueryable{MockQuerier: &listQuerier{}}, &query.Options{})
+		ctx := storage.WithSelectHook(context.Background(), func(_ context.Context, req *storage.SelectRequest) error {
+			req.Queryable = &promstg.MockQueryable{MockQuerier: querier}
+			req.Matchers = append(req.Matchers, filters...)
+			return nil
+		})
+		estimate, ok, err := pool.GetSelector(0, 100, 10, matchers, promstg.SelectHints{}).EstimateSeries(ctx)
+		testutil.Ok(t, err)
+		testutil.Assert(t, ok, "expected an estimate")
+		testutil.Equals(t, querier.estimate, estimate)
+		testutil.Equals(t, append(matchers, filters...), querier.matchers[0])
+
+		ctx = storage.WithSelectHook(context.Background(), func(context.Context, *storage.SelectRequest) error {
+			return errors.New("denied")
+		})
+		_, _, err = pool.GetSelector(0, 100, 10, filters, promstg.SelectHints{}).EstimateSeries(ctx)
+		testutil.NotOk(t, err)
+	})
+	t.Run("querier with estimates", func(t *testing.T) {
+		querier := &estimatingQuerier{listQuerier: &listQuerier{}, estimate: storage.SeriesEstimate{Series: 10, Samples: 100}}
+		pool := storage.NewSelectorPool(&promstg.MockQueryable{MockQuerier: querier}, &query.Options{})
+		selectors := []storage.SeriesSelector{
+			pool.GetSelector(0, 100, 10, matchers, promstg.SelectHints{}),
+			pool.GetFilteredSelector(0, 100, 10, matchers, filters, nil, promstg.SelectHints{}),
+		}
+		for _, selector := range selectors {
+			estimate, ok, err := selector.EstimateSeries(context.Background())
+			testutil.Ok(t, err)
+			testutil.Assert(t, ok, "expected an estimate")
+			testutil.Equals(t, querier.estimate, estimate)
+		}
+
+		// Estimates are taken once for selectors which are shared, and without selecting series.
+		testutil.Equals(t, 1, querier.estimates)
+		testutil.Equals(t, matchers, querier.matchers[0])
+		testutil.Equals(t, 0, querier.calls)
+	})
+	t.Run("empty selector", func(t *testing.T) {
+		estimate, ok, err := storage.NewEmptySelector(matchers).EstimateSeries(context.Background())
+		testutil.Ok(t, err)
+		testutil.Assert(t, ok, "expected an estimate")
+		testutil.Equals(t, storage.SeriesEstimate{}, estimate)
+	})
+}
+
+type estimatingQuerier struct {
+	*listQuerier
+	estimate  storage.SeriesEstimate
+	estimates int
+}
+
+func (q *estimatingQuerier) EstimateSeries(_ *promstg.SelectHints, matchers ...*labels.Matcher) (storage.SeriesEstimate, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.estimates++
+	q.matchers = append(q.matchers, matchers)
+	return q.estimate, nil
+}
+
+// countingQueryable counts the queriers which are opened.
+type countingQueryable struct {
+	promstg.Queryable
+	queriers int
+}
+
+func (q *countingQueryable) Querier(ctx context.Context, mint, maxt int64) (promstg.Querier, error) {
+	q.queriers++
+	return q.Queryable.Querier(ctx, mint, maxt)
+}
+
+func TestSeriesSelector_ResolvesRegexMatchers(t *testing.T) {
+	name := labels.MustNewMatcher(labels.MatchEqual, "__name__", "foo")
+	cases := []struct {
+		name        string
+		matchers    []*labels.Matcher
+		labelValues []string
+		limit       int
+		expected    []*labels.Matcher
+	}{
+		{
+			name:        "resolution disabled",
+			matchers:    []*labels.Matcher{name, labels.MustNewMatcher(labels.MatchRegexp, "pod", "p.+")},
+			labelValues: []string{"p1", "p2", "q1"},
+			expected:    []*labels.Matcher{name, labels.MustNewMatcher(labels.MatchRegexp, "pod", "p.+")},
+		},
+		{
+			name:        "regex is resolved",
+			matchers:    []*labels.Matcher{name, labels.MustNewMatcher(labels.MatchRegexp, "pod", "p.+")},
+			labelValues: []string{"p1", "p.2", "q1"},
+			limit:       3,
+			expected:    []*labels.Matcher{name, labels.MustNewMatcher(labels.MatchRegexp, "pod", `p1|p\.2`)},
+		},
+		{
+			name:        "regex matching empty values is resolved",
+			matchers:    []*labels.Matcher{name, labels.MustNewMatcher(labels.MatchRegexp, "pod", "p.*|")},
+			labelValues: []string{"p1", "q1"},
+			limit:       3,
+			expected:    []*labels.Matcher{name, labels.MustNewMatcher(labels.MatchRegexp, "pod", `p1|`)},
+		},
+		{
+			name:        "too many values",
+			matchers:    []*labels.Matcher{name, labels.MustNewMatcher(labels.MatchRegexp, "pod", "p.+")},
+			labelValues: []string{"p1", "p2", "p3", "p4"},
+			limit:       3,
+			expected:    []*labels.Matcher{name, labels.MustNewMatcher(labels.MatchRegexp, "pod", "p.+")},
+		},
+		{
+			name:        "literal alternation is not resolved",
+			matchers:    []*labels.Matcher{name, labels.MustNewMatcher(labels.MatchRegexp, "pod", "p1|p2")},
+			labelValues: []string{"p1"},
+			limit:       3,
+			expected:    []*labels.Matcher{name, labels.MustNewMatcher(labels.MatchRegexp, "pod", "p1|p2")},
+		},
+		{
+			name:        "no values match",
+			matchers:    []*labels.Matcher{name, labels.MustNewMatcher(labels.MatchRegexp, "pod", "p.+")},
+			labelValues: []string{"q1"},
+			limit:       3,
+		},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			querier := &listQuerier{labelValues: tcase.labelValues}
+			pool := storage.NewSelectorPool(&promstg.MockQueryable{MockQuerier: querier}, &query.Options{RegexResolutionLimit: tcase.limit})
+			_, err := pool.GetSelector(0, 100, 10, tcase.matchers, promstg.SelectHints{}).GetSeries(context.Background(), 0, 1)
+			testutil.Ok(t, err)
+
+			if tcase.expected == nil {
+				testutil.Equals(t, 0, querier.calls)
+				return
+			}
+			testutil.Equals(t, 1, querier.calls)
+			testutil.Equals(t, len(tcase.expected), len(querier.matchers[0]))
+			for i, m := range tcase.expected {
+				testutil.Equals(t, m.String(), querier.matchers[0][i].String())
+			}
+		})
+	}
+}
+
+type listQuerier struct {
+	promstg.MockQuerier
+	series []promstg.Series
+
+	labelValues []string
+
+	mu            sync.Mutex
+	calls         int
+	shards        []uint64
+	existenceOnly []bool
+	hints         []promstg.SelectHints
+	matchers      [][]*labels.Matcher
+}
+
+func (q *listQuerier) LabelValues(string, ...*labels.Matcher) ([]string, promstg.Warnings, error) {
+	return q.labelValues, nil, nil
+}
+
+func (q *listQuerier) Select(_ bool, hints *promstg.SelectHints, matchers ...*labels.Matcher) promstg.SeriesSet {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.calls++
+	q.hints = append(q.hints, *hints)
+	q.matchers = append(q.matchers, matchers)
+	return &seriesSet{series: q.series}
+}
+
+type shardedQuerier struct {
+	*listQuerier
+}
+
+func (q *shardedQuerier) Select(_ bool, _ *promstg.SelectHints, _ ...*labels.Matcher) promstg.SeriesSet {
+	panic("unexpected non-sharded select")
+}
+
+func (q *shardedQuerier) SelectShard(_ bool, hints *storage.ShardedSelectHints, _ ...*labels.Matcher) promstg.SeriesSet {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.calls++
+	q.shards = append(q.shards, hints.ShardIndex)
+	q.existenceOnly = append(q.existenceOnly, hints.ExistenceOnly)
+	var series []promstg.Series
+	for i, s := range q.series {
+		if uint64(i)%hints.ShardCount == hints.ShardIndex {
+			series = append(series, s)
+		}
+	}
+	return &seriesSet{series: series}
+}
+
+type seriesSet struct {
+	series []promstg.Series
+	i      int
+}
+
+func (s *seriesSet) Next() bool {
+	s.i++
+	return s.i <= len(s.series)
+}
+
+func (s *seriesSet) At() promstg.Series         { return s.series[s.i-1] }
+func (s *seriesSet) Err() error                 { return nil }
+func (s *seriesSet) Warnings() promstg.Warnings { return nil }
+
+func TestSeriesSelector_SelectHook(t *testing.T) {
+	matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "foo")}
+	tenant := labels.MustNewMatcher(labels.MatchEqual, "tenant", "a")
+
+	t.Run("veto", func(t *testing.T) {
+		querier := &listQuerier{}
+		pool := storage.NewSelectorPool(&promstg.MockQueryable{MockQuerier: querier}, &query.Options{})
+		ctx := storage.WithSelectHook(context.Background(), func(_ context.Context, req *storage.SelectRequest) error {
+			return errors.New("access denied")
+		})
+		_, err := pool.GetSelector(0, 100, 10, matchers, promstg.SelectHints{}).GetSeries(ctx, 0, 1)
+		testutil.NotOk(t, err)
+		testutil.Equals(t, 0, querier.calls)
+	})
+
+	t.Run("rewrite matchers", func(t *testing.T) {
+		querier := &listQuerier{}
+		pool := storage.NewSelectorPool(&promstg.MockQueryable{MockQuerier: querier}, &query.Options{})
+		ctx := storage.WithSelectHook(context.Background(), func(_ context.Context, req *storage.SelectRequest) error {
+			req.Matchers = append(req.Matchers, tenant)
+			return nil
+		})
+		_, err := pool.GetSelector(0, 100, 10, matchers, promstg.SelectHints{}).GetSeries(ctx, 0, 1)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, querier.calls)
+		testutil.Equals(t, []*labels.Matcher{matchers[0], tenant}, querier.matchers[0])
+	})
+
+	t.Run("substitute queryable", func(t *testing.T) {
+		querier := &listQuerier{}
+		dedicated := &listQuerier{series: []promstg.Series{
+			&mockLabelSeries{labels: labels.FromStrings("__name__", "foo", "pod", "p1")},
+		}}
+		pool := storage.NewSelectorPool(&promstg.MockQueryable{MockQuerier: querier}, &query.Options{})
+		ctx := storage.WithSelectHook(context.Background(), func(_ context.Context, req *storage.SelectRequest) error {
+			req.Queryable = &promstg.MockQueryable{MockQuerier: dedicated}
+			return nil
+		})
+		series, err := pool.GetSelector(0, 100, 10, matchers, promstg.SelectHints{}).GetSeries(ctx, 0, 1)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(series))
+		testutil.Equals(t, 0, querier.calls)
+		testutil.Equals(t, 1, dedicated.calls)
+	})
+}
@@ -0,0 +1,68 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package storage
+
+import (
+	"context"
+	"sync"
+)
+
+// shardedSelector is a selector which only returns one shard of the series of its selector.
+// Shards of the returned series are sub-shards of that shard.
+type shardedSelector struct {
+	SeriesSelector
+
+	shard     int
+	numShards int
+}
+
+func (s *shardedSelector) GetSeries(ctx context.Context, shard, numShards int) ([]SignedSeries, error) {
+	series, err := s.SeriesSelector.GetSeries(ctx, s.shard, s.numShards)
+	if err != nil {
+		return nil, err
+	}
+	if numShards <= 1 {
+		return series, nil
+	}
+	return seriesShard(series, shard, numShards), nil
+}
+
+func (s *shardedSelector) EstimateSeries(ctx context.Context) (SeriesEstimate, bool, error) {
+	estimate, ok, err := s.SeriesSelector.EstimateSeries(ctx)
+	if err != nil || !ok {
+		return estimate, ok, err
+	}
+	n := int64(s.numShards)
+	return SeriesEstimate{
+		Series:  (estimate.Series + n - 1) / n,
+		Samples: (estimate.Samples + n - 1) / n,
+	}, true, nil
+}
+
+// loadedSelector is a selector which selects all series of its selector once, and splits
+// the selected series into shards instead of selecting each shard from storage.
+type loadedSelector struct {
+	SeriesSelector
+
+	once   sync.Once
+	series []SignedSeries
+	err    error
+}
+
+// NewLoadedSelector returns a selector which selects all series of the selector once, so that
+// the series can be counted before they are split into any number of shards.
+func NewLoadedSelector(selector SeriesSelector) SeriesSelector {
+	return &loadedSelector{SeriesSelector: selector}
+}
+
+func (s *loadedSelector) GetSeries(ctx context.Context, shard, numShards int) ([]SignedSeries, error) {
+	s.once.Do(func() { s.series, s.err = s.SeriesSelector.GetSeries(ctx, 0, 1) })
+	if s.err != nil {
+		return nil, s.err
+	}
+	if numShards <= 1 {
+		return s.series, nil
+	}
+	return seriesShard(s.series, shard, numShards), nil
+}
@@ -51,7 +51,11 @@ func (u *unaryNegation) loadSeries(ctx context.Context) error {
 		}
 		u.series = make([]labels.Labels, len(series))
 		for i := range series {
-			lbls := labels.NewBuilder(series[i]).Del(labels.MetricName).Labels()
+			// Series of scalar operands have no labels and are kept as they are.
+			if series[i] == nil {
+				continue
+			}
+			lbls := labels.NewBuilder(series[i]).Del(labels.MetricName, model.DropNameLabel).Labels()
 			u.series[i] = lbls
 		}
 	})
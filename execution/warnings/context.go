@@ -0,0 +1,64 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package warnings
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/prometheus/storage"
+)
+
+type warningKey string
+
+const key warningKey = "promql-warnings"
+
+type warnings struct {
+	mu    sync.Mutex
+	seen  map[string]struct{}
+	warns storage.Warnings
+}
+
+func (w *warnings) add(warn error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Operators running in parallel can report the same warning more than once.
+	if _, ok := w.seen[warn.Error()]; ok {
+		return
+	}
+	w.seen[warn.Error()] = struct{}{}
+	w.warns = append(w.warns, warn)
+}
+
+func (w *warnings) get() storage.Warnings {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.warns
+}
+
+// NewContext returns a context which collects warnings and annotations
+// reported by operators while a query is executed.
+func NewContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, key, &warnings{seen: make(map[string]struct{})})
+}
+
+// AddToContext adds a warning to the collector in the context, if one is present.
+func AddToContext(warn error, ctx context.Context) {
+	w, ok := ctx.Value(key).(*warnings)
+	if !ok {
+		return
+	}
+	w.add(warn)
+}
+
+// FromContext returns the warnings collected in the context.
+func FromContext(ctx context.Context) storage.Warnings {
+	w, ok := ctx.Value(key).(*warnings)
+	if !ok {
+		return nil
+	}
+	return w.get()
+}
@@ -121,8 +121,13 @@ func (node *Call) String() string {
 }
 
 func (node *MatrixSelector) String() string {
+	vs, ok := node.VectorSelector.(*VectorSelector)
+	if !ok {
+		// Selectors rewritten by the logical plan print their own modifiers.
+		return fmt.Sprintf("%s[%s]", node.VectorSelector.String(), model.Duration(node.Range))
+	}
 	// Copy the Vector selector before changing the offset
-	vecSelector := *node.VectorSelector.(*VectorSelector)
+	vecSelector := *vs
 	offset := ""
 	if vecSelector.OriginalOffset > time.Duration(0) {
 		offset = fmt.Sprintf(" offset %s", model.Duration(vecSelector.OriginalOffset))
@@ -0,0 +1,611 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/thanos-community/promql-engine/execution/parse"
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+// Marshal encodes the logical plan rooted at node as JSON, so that plans can be cached,
+// sent to remote engines or inspected by external tools. Remote engines cannot be encoded,
+// so the RemoteExecution nodes of a decoded plan do not have an engine.
+func Marshal(node Node) ([]byte, error) {
+	encoded, err := encodeNode(node, make(map[*SharedExpr]struct{}))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(encoded)
+}
+
+// Unmarshal decodes a logical plan which was encoded by Marshal.
+func Unmarshal(data []byte) (Node, error) {
+	var encoded jsonNode
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return nil, err
+	}
+	return decodeNode(&encoded, make(map[int]*SharedExpr))
+}
+
+// jsonNode is the encoding of a node. Children are encoded in the order of childSlots,
+// with null for children which are not set.
+type jsonNode struct {
+	Type     string          `json:"type"`
+	Data     json.RawMessage `json:"data,omitempty"`
+	Children []*jsonNode     `json:"children,omitempty"`
+}
+
+type jsonMatcher struct {
+	Type  string `json:"type"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type jsonSelector struct {
+	Name           string        `json:"name"`
+	Matchers       []jsonMatcher `json:"matchers"`
+	Offset         time.Duration `json:"offset,omitempty"`
+	OriginalOffset time.Duration `json:"originalOffset,omitempty"`
+	Timestamp      *int64        `json:"timestamp,omitempty"`
+	StartOrEnd     string        `json:"startOrEnd,omitempty"`
+
+	// The fields below are only set for filtered selectors.
+	Filters              []jsonMatcher     `json:"filters,omitempty"`
+	ValueFilters         []jsonValueFilter `json:"valueFilters,omitempty"`
+	Projection           *jsonProjection   `json:"projection,omitempty"`
+	Empty                bool              `json:"empty,omitempty"`
+	SkipHistogramBuckets bool              `json:"skipHistogramBuckets,omitempty"`
+}
+
+type jsonValueFilter struct {
+	Op         string `json:"op"`
+	Value      string `json:"value"`
+	ScalarLeft bool   `json:"scalarLeft,omitempty"`
+}
+
+type jsonProjection struct {
+	Labels  []string `json:"labels"`
+	Include bool     `json:"include"`
+}
+
+type jsonMatrixSelector struct {
+	Range time.Duration `json:"range"`
+}
+
+type jsonAggregation struct {
+	Op       string   `json:"op"`
+	Grouping []string `json:"grouping,omitempty"`
+	Without  bool     `json:"without,omitempty"`
+}
+
+type jsonBinary struct {
+	Op             string              `json:"op"`
+	VectorMatching *jsonVectorMatching `json:"vectorMatching,omitempty"`
+	ReturnBool     bool                `json:"returnBool,omitempty"`
+}
+
+type jsonVectorMatching struct {
+	Card           string   `json:"card"`
+	MatchingLabels []string `json:"matchingLabels,omitempty"`
+	On             bool     `json:"on,omitempty"`
+	Include        []string `json:"include,omitempty"`
+}
+
+type jsonFunctionCall struct {
+	Func string `json:"func"`
+}
+
+type jsonLiteral struct {
+	Val string `json:"val"`
+}
+
+type jsonSubquery struct {
+	Range          time.Duration `json:"range"`
+	Offset         time.Duration `json:"offset,omitempty"`
+	OriginalOffset time.Duration `json:"originalOffset,omitempty"`
+	Timestamp      *int64        `json:"timestamp,omitempty"`
+	StartOrEnd     string        `json:"startOrEnd,omitempty"`
+	Step           time.Duration `json:"step,omitempty"`
+}
+
+type jsonUnary struct {
+	Op string `json:"op"`
+}
+
+type jsonRemoteExecution struct {
+	Query           string    `json:"query"`
+	QueryRangeStart time.Time `json:"queryRangeStart"`
+}
+
+type jsonDeduplicate struct {
+	Expressions []jsonRemoteExecution `json:"expressions"`
+}
+
+type jsonSharedExpr struct {
+	ID int `json:"id"`
+}
+
+type jsonTimeSplit struct {
+	Slices []jsonTimeRange `json:"slices"`
+}
+
+type jsonShard struct {
+	Index int `json:"index"`
+	Total int `json:"total"`
+}
+
+type jsonTimeRange struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+func encodeNode(node Node, encoded map[*SharedExpr]struct{}) (*jsonNode, error) {
+	if node == nil {
+		return nil, nil
+	}
+	var (
+		typ  string
+		data interface{}
+	)
+	switch n := node.(type) {
+	case *VectorSelector:
+		typ, data = "vectorSelector", encodeSelector(n)
+	case *FilteredSelector:
+		selector := encodeSelector(n.VectorSelector)
+		selector.Filters = encodeMatchers(n.Filters)
+		for _, f := range n.ValueFilters {
+			selector.ValueFilters = append(selector.ValueFilters, jsonValueFilter{
+				Op:         encodeItemType(f.Op),
+				Value:      encodeFloat(f.Value),
+				ScalarLeft: f.ScalarLeft,
+			})
+		}
+		if n.Projection != nil {
+			selector.Projection = &jsonProjection{Labels: n.Projection.Labels, Include: n.Projection.Include}
+		}
+		selector.Empty = n.Empty
+		selector.SkipHistogramBuckets = n.SkipHistogramBuckets
+		typ, data = "filteredSelector", selector
+	case *MatrixSelector:
+		typ, data = "matrixSelector", jsonMatrixSelector{Range: n.Range}
+	case *Aggregation:
+		typ, data = "aggregation", jsonAggregation{Op: encodeItemType(n.Op), Grouping: n.Grouping, Without: n.Without}
+	case *Binary:
+		binary := jsonBinary{Op: encodeItemType(n.Op), ReturnBool: n.ReturnBool}
+		if vm := n.VectorMatching; vm != nil {
+			binary.VectorMatching = &jsonVectorMatching{
+				Card:           vm.Card.String(),
+				MatchingLabels: vm.MatchingLabels,
+				On:             vm.On,
+				Include:        vm.Include,
+			}
+		}
+		typ, data = "binary", binary
+	case *FunctionCall:
+		typ, data = "functionCall", jsonFunctionCall{Func: n.Func.Name}
+	case *NumberLiteral:
+		typ, data = "numberLiteral", jsonLiteral{Val: encodeFloat(n.Val)}
+	case *StringLiteral:
+		typ, data = "stringLiteral", jsonLiteral{Val: n.Val}
+	case *Subquery:
+		typ, data = "subquery", jsonSubquery{
+			Range:          n.Range,
+			Offset:         n.Offset,
+			OriginalOffset: n.OriginalOffset,
+			Timestamp:      n.Timestamp,
+			StartOrEnd:     encodeItemType(n.StartOrEnd),
+			Step:           n.Step,
+		}
+	case *StepInvariantExpr:
+		typ = "stepInvariant"
+	case *Parens:
+		typ = "parens"
+	case *Unary:
+		typ, data = "unary", jsonUnary{Op: encodeItemType(n.Op)}
+	case RemoteExecution:
+		typ, data = "remoteExecution", encodeRemoteExecution(n)
+	case Deduplicate:
+		dedup := jsonDeduplicate{Expressions: make([]jsonRemoteExecution, 0, len(n.Expressions))}
+		for _, e := range n.Expressions {
+			dedup.Expressions = append(dedup.Expressions, encodeRemoteExecution(e))
+		}
+		typ, data = "deduplicate", dedup
+	case Noop:
+		typ = "noop"
+	case *PartialAggregation:
+		typ, data = "partialAggregation", jsonAggregation{Op: encodeItemType(n.Op), Grouping: n.Grouping, Without: n.Without}
+	case *TimeSplit:
+		split := jsonTimeSplit{Slices: make([]jsonTimeRange, 0, len(n.Slices))}
+		for _, r := range n.Slices {
+			split.Slices = append(split.Slices, jsonTimeRange{Start: r.Start, End: r.End})
+		}
+		typ, data = "timeSplit", split
+	case *Shard:
+		typ, data = "shard", jsonShard{Index: n.Index, Total: n.Total}
+	case *Coalesce:
+		typ = "coalesce"
+	case *SharedExpr:
+		typ, data = "shared", jsonSharedExpr{ID: n.ID}
+		// The expression is only encoded for the first occurrence.
+		if _, ok := encoded[n]; ok {
+			return &jsonNode{Type: typ, Data: mustMarshal(data)}, nil
+		}
+		encoded[n] = struct{}{}
+	default:
+		return nil, errors.Newf("cannot encode node of type %T", node)
+	}
+
+	result := &jsonNode{Type: typ}
+	if data != nil {
+		result.Data = mustMarshal(data)
+	}
+	for _, child := range childSlots(node) {
+		encodedChild, err := encodeNode(*child, encoded)
+		if err != nil {
+			return nil, err
+		}
+		result.Children = append(result.Children, encodedChild)
+	}
+	return result, nil
+}
+
+func decodeNode(encoded *jsonNode, shared map[int]*SharedExpr) (Node, error) {
+	if encoded == nil {
+		return nil, nil
+	}
+	var node Node
+	switch encoded.Type {
+	case "vectorSelector":
+		var data jsonSelector
+		if err := json.Unmarshal(encoded.Data, &data); err != nil {
+			return nil, err
+		}
+		selector, err := decodeSelector(data)
+		if err != nil {
+			return nil, err
+		}
+		node = selector
+	case "filteredSelector":
+		var data jsonSelector
+		if err := json.Unmarshal(encoded.Data, &data); err != nil {
+			return nil, err
+		}
+		selector, err := decodeSelector(data)
+		if err != nil {
+			return nil, err
+		}
+		filtered := &FilteredSelector{VectorSelector: selector, Empty: data.Empty, SkipHistogramBuckets: data.SkipHistogramBuckets}
+		if filtered.Filters, err = decodeMatchers(data.Filters); err != nil {
+			return nil, err
+		}
+		for _, f := range data.ValueFilters {
+			op, err := decodeItemType(f.Op)
+			if err != nil {
+				return nil, err
+			}
+			value, err := strconv.ParseFloat(f.Value, 64)
+			if err != nil {
+				return nil, err
+			}
+			filtered.ValueFilters = append(filtered.ValueFilters, ValueFilter{Op: op, Value: value, ScalarLeft: f.ScalarLeft})
+		}
+		if data.Projection != nil {
+			filtered.Projection = &Projection{Labels: data.Projection.Labels, Include: data.Projection.Include}
+		}
+		node = filtered
+	case "matrixSelector":
+		var data jsonMatrixSelector
+		if err := json.Unmarshal(encoded.Data, &data); err != nil {
+			return nil, err
+		}
+		node = &MatrixSelector{Range: data.Range}
+	case "aggregation":
+		var data jsonAggregation
+		if err := json.Unmarshal(encoded.Data, &data); err != nil {
+			return nil, err
+		}
+		op, err := decodeItemType(data.Op)
+		if err != nil {
+			return nil, err
+		}
+		node = &Aggregation{Op: op, Grouping: data.Grouping, Without: data.Without}
+	case "binary":
+		var data jsonBinary
+		if err := json.Unmarshal(encoded.Data, &data); err != nil {
+			return nil, err
+		}
+		op, err := decodeItemType(data.Op)
+		if err != nil {
+			return nil, err
+		}
+		binary := &Binary{Op: op, ReturnBool: data.ReturnBool}
+		if vm := data.VectorMatching; vm != nil {
+			card, err := decodeCardinality(vm.Card)
+			if err != nil {
+				return nil, err
+			}
+			binary.VectorMatching = &parser.VectorMatching{
+				Card:           card,
+				MatchingLabels: vm.MatchingLabels,
+				On:             vm.On,
+				Include:        vm.Include,
+			}
+		}
+		node = binary
+	case "functionCall":
+		var data jsonFunctionCall
+		if err := json.Unmarshal(encoded.Data, &data); err != nil {
+			return nil, err
+		}
+		f, err := decodeFunction(data.Func)
+		if err != nil {
+			return nil, err
+		}
+		node = &FunctionCall{Func: f, Args: make([]Node, len(encoded.Children))}
+	case "numberLiteral":
+		var data jsonLiteral
+		if err := json.Unmarshal(encoded.Data, &data); err != nil {
+			return nil, err
+		}
+		val, err := strconv.ParseFloat(data.Val, 64)
+		if err != nil {
+			return nil, err
+		}
+		node = &NumberLiteral{Val: val}
+	case "stringLiteral":
+		var data jsonLiteral
+		if err := json.Unmarshal(encoded.Data, &data); err != nil {
+			return nil, err
+		}
+		node = &StringLiteral{Val: data.Val}
+	case "subquery":
+		var data jsonSubquery
+		if err := json.Unmarshal(encoded.Data, &data); err != nil {
+			return nil, err
+		}
+		startOrEnd, err := decodeItemType(data.StartOrEnd)
+		if err != nil {
+			return nil, err
+		}
+		node = &Subquery{
+			Range:          data.Range,
+			Offset:         data.Offset,
+			OriginalOffset: data.OriginalOffset,
+			Timestamp:      data.Timestamp,
+			StartOrEnd:     startOrEnd,
+			Step:           data.Step,
+		}
+	case "stepInvariant":
+		node = &StepInvariantExpr{}
+	case "parens":
+		node = &Parens{}
+	case "unary":
+		var data jsonUnary
+		if err := json.Unmarshal(encoded.Data, &data); err != nil {
+			return nil, err
+		}
+		op, err := decodeItemType(data.Op)
+		if err != nil {
+			return nil, err
+		}
+		node = &Unary{Op: op}
+	case "remoteExecution":
+		var data jsonRemoteExecution
+		if err := json.Unmarshal(encoded.Data, &data); err != nil {
+			return nil, err
+		}
+		node = RemoteExecution{Query: data.Query, QueryRangeStart: data.QueryRangeStart}
+	case "deduplicate":
+		var data jsonDeduplicate
+		if err := json.Unmarshal(encoded.Data, &data); err != nil {
+			return nil, err
+		}
+		dedup := Deduplicate{Expressions: make(RemoteExecutions, 0, len(data.Expressions))}
+		for _, e := range data.Expressions {
+			dedup.Expressions = append(dedup.Expressions, RemoteExecution{Query: e.Query, QueryRangeStart: e.QueryRangeStart})
+		}
+		node = dedup
+	case "noop":
+		node = Noop{}
+	case "partialAggregation":
+		var data jsonAggregation
+		if err := json.Unmarshal(encoded.Data, &data); err != nil {
+			return nil, err
+		}
+		op, err := decodeItemType(data.Op)
+		if err != nil {
+			return nil, err
+		}
+		node = &PartialAggregation{Op: op, Grouping: data.Grouping, Without: data.Without}
+	case "timeSplit":
+		var data jsonTimeSplit
+		if err := json.Unmarshal(encoded.Data, &data); err != nil {
+			return nil, err
+		}
+		split := &TimeSplit{Slices: make([]TimeRange, 0, len(data.Slices))}
+		for _, r := range data.Slices {
+			split.Slices = append(split.Slices, TimeRange{Start: r.Start, End: r.End})
+		}
+		node = split
+	case "shard":
+		var data jsonShard
+		if err := json.Unmarshal(encoded.Data, &data); err != nil {
+			return nil, err
+		}
+		node = &Shard{Index: data.Index, Total: data.Total}
+	case "coalesce":
+		node = &Coalesce{Exprs: make([]Node, len(encoded.Children))}
+	case "shared":
+		var data jsonSharedExpr
+		if err := json.Unmarshal(encoded.Data, &data); err != nil {
+			return nil, err
+		}
+		if s, ok := shared[data.ID]; ok {
+			return s, nil
+		}
+		s := &SharedExpr{ID: data.ID}
+		shared[data.ID] = s
+		node = s
+	default:
+		return nil, errors.Newf("cannot decode node of type %q", encoded.Type)
+	}
+
+	slots := childSlots(node)
+	if len(encoded.Children) != len(slots) {
+		return nil, errors.Newf("%s node has %d children, expected %d", encoded.Type, len(encoded.Children), len(slots))
+	}
+	for i, child := range encoded.Children {
+		decoded, err := decodeNode(child, shared)
+		if err != nil {
+			return nil, err
+		}
+		*slots[i] = decoded
+	}
+	return node, nil
+}
+
+// childSlots returns pointers to all children of a node, including optional children which are not set.
+func childSlots(node Node) []*Node {
+	switch n := node.(type) {
+	case *Aggregation:
+		return []*Node{&n.Expr, &n.Param}
+	case *PartialAggregation:
+		return []*Node{&n.Count, &n.Sum, &n.Mean, &n.Variance}
+	default:
+		return node.Children()
+	}
+}
+
+func encodeSelector(v *VectorSelector) jsonSelector {
+	return jsonSelector{
+		Name:           v.Name,
+		Matchers:       encodeMatchers(v.LabelMatchers),
+		Offset:         v.Offset,
+		OriginalOffset: v.OriginalOffset,
+		Timestamp:      v.Timestamp,
+		StartOrEnd:     encodeItemType(v.StartOrEnd),
+	}
+}
+
+func decodeSelector(data jsonSelector) (*VectorSelector, error) {
+	matchers, err := decodeMatchers(data.Matchers)
+	if err != nil {
+		return nil, err
+	}
+	startOrEnd, err := decodeItemType(data.StartOrEnd)
+	if err != nil {
+		return nil, err
+	}
+	return &VectorSelector{
+		Name:           data.Name,
+		LabelMatchers:  matchers,
+		Offset:         data.Offset,
+		OriginalOffset: data.OriginalOffset,
+		Timestamp:      data.Timestamp,
+		StartOrEnd:     startOrEnd,
+	}, nil
+}
+
+func encodeMatchers(matchers []*labels.Matcher) []jsonMatcher {
+	if matchers == nil {
+		return nil
+	}
+	result := make([]jsonMatcher, 0, len(matchers))
+	for _, m := range matchers {
+		result = append(result, jsonMatcher{Type: m.Type.String(), Name: m.Name, Value: m.Value})
+	}
+	return result
+}
+
+func decodeMatchers(matchers []jsonMatcher) ([]*labels.Matcher, error) {
+	if matchers == nil {
+		return nil, nil
+	}
+	result := make([]*labels.Matcher, 0, len(matchers))
+	for _, m := range matchers {
+		matchType, err := decodeMatchType(m.Type)
+		if err != nil {
+			return nil, err
+		}
+		matcher, err := labels.NewMatcher(matchType, m.Name, m.Value)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, matcher)
+	}
+	return result, nil
+}
+
+func decodeMatchType(s string) (labels.MatchType, error) {
+	for _, t := range []labels.MatchType{labels.MatchEqual, labels.MatchNotEqual, labels.MatchRegexp, labels.MatchNotRegexp} {
+		if t.String() == s {
+			return t, nil
+		}
+	}
+	return 0, errors.Newf("unknown matcher type %q", s)
+}
+
+func encodeRemoteExecution(r RemoteExecution) jsonRemoteExecution {
+	return jsonRemoteExecution{Query: r.Query, QueryRangeStart: r.QueryRangeStart}
+}
+
+// encodeItemType returns the PromQL representation of an operator or preprocessor,
+// or an empty string if it is not set.
+func encodeItemType(t parser.ItemType) string {
+	if t == 0 {
+		return ""
+	}
+	return t.String()
+}
+
+func decodeItemType(s string) (parser.ItemType, error) {
+	if s == "" {
+		return 0, nil
+	}
+	for t, str := range parser.ItemTypeStr {
+		if str == s {
+			return t, nil
+		}
+	}
+	return 0, errors.Newf("unknown operator %q", s)
+}
+
+func decodeCardinality(s string) (parser.VectorMatchCardinality, error) {
+	for _, c := range []parser.VectorMatchCardinality{parser.CardOneToOne, parser.CardManyToOne, parser.CardOneToMany, parser.CardManyToMany} {
+		if c.String() == s {
+			return c, nil
+		}
+	}
+	return 0, errors.Newf("unknown vector matching cardinality %q", s)
+}
+
+func decodeFunction(name string) (*parser.Function, error) {
+	for _, functions := range []map[string]*parser.Function{parser.Functions, parse.Functions, parse.ExperimentalFunctions} {
+		if f, ok := functions[name]; ok {
+			return f, nil
+		}
+	}
+	return nil, errors.Newf("unknown function %q", name)
+}
+
+// encodeFloat encodes floats as strings since JSON numbers cannot represent NaN and infinities.
+func encodeFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func mustMarshal(data interface{}) json.RawMessage {
+	// The encoded types only contain strings, numbers and booleans, so encoding does not fail.
+	b, err := json.Marshal(data)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,92 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/thanos-community/promql-engine/api"
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	engines := []api.RemoteEngine{
+		newEngineMock(1, []labels.Labels{labels.FromStrings("region", "east")}),
+		newEngineMock(2, []labels.Labels{labels.FromStrings("region", "west")}),
+	}
+	for _, e := range engines {
+		e.(*engineMock).capabilities.PlanProtocolVersion = api.PlanProtocolPartialAggregates
+	}
+	distributed := []Optimizer{DistributedExecutionOptimizer{Endpoints: api.NewStaticEndpoints(engines)}}
+
+	cases := []struct {
+		expr       string
+		optimizers []Optimizer
+	}{
+		{expr: `metric{a="b", c=~"d|e"} @ 100 offset 5m`, optimizers: AllOptimizers},
+		{expr: `sum by (a) (rate(metric{c="d"}[5m])) / on (a) group_left (b) count by (a) (metric > 1)`, optimizers: AllOptimizers},
+		{expr: `sum(rate(metric[5m])) / count(rate(metric[5m]))`, optimizers: AllOptimizers},
+		{expr: `histogram_count(rate(metric[5m])) + -Inf`, optimizers: AllOptimizers},
+		{expr: `max_over_time(rate(metric[1m])[10m:1m] @ end())`, optimizers: AllOptimizers},
+		{expr: `topk(3, label_replace(metric, "dst", "$1", "src", "(.*)"))`, optimizers: AllOptimizers},
+		{expr: `sum by (pod) (rate(http_requests_total[5m]))`, optimizers: distributed},
+		{expr: `stddev by (pod) (http_requests_total)`, optimizers: distributed},
+		{expr: `absent(http_requests_total)`, optimizers: distributed},
+		{expr: `sum by (pod) (rate(http_requests_total[5m]))`, optimizers: append(distributed, TimeSplitOptimizer{SliceRange: 20 * time.Minute})},
+		{expr: `sum by (pod) (rate(http_requests_total[5m])) / count(http_requests_total)`, optimizers: append(AllOptimizers, VerticalShardingOptimizer{Shards: 3})},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.expr, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			opts := &Opts{Start: time.Unix(0, 0), End: time.Unix(3600, 0), Step: time.Minute}
+			plan := New(expr, opts).Optimize(tcase.optimizers)
+
+			data, err := Marshal(plan.Root())
+			testutil.Ok(t, err)
+			decoded, err := Unmarshal(data)
+			testutil.Ok(t, err)
+			testutil.Equals(t, plan.Root().String(), decoded.String())
+
+			reencoded, err := Marshal(decoded)
+			testutil.Ok(t, err)
+			testutil.Equals(t, string(data), string(reencoded))
+		})
+	}
+}
+
+func TestUnmarshalSharedExpressions(t *testing.T) {
+	expr, err := parser.ParseExpr(`sum(rate(metric[5m])) / count(rate(metric[5m]))`)
+	testutil.Ok(t, err)
+	plan := New(expr, &Opts{}).Optimize([]Optimizer{CommonSubexpressionOptimizer{}})
+
+	data, err := Marshal(plan.Root())
+	testutil.Ok(t, err)
+	decoded, err := Unmarshal(data)
+	testutil.Ok(t, err)
+
+	binary := decoded.(*Binary)
+	lhs := binary.LHS.(*Aggregation).Expr
+	rhs := binary.RHS.(*Aggregation).Expr
+	testutil.Assert(t, lhs.(*SharedExpr) == rhs.(*SharedExpr), "occurrences of a shared expression should be decoded into the same node")
+}
+
+func TestUnmarshalRegexMatchers(t *testing.T) {
+	expr, err := parser.ParseExpr(`metric{a=~"b.*"}`)
+	testutil.Ok(t, err)
+
+	data, err := Marshal(New(expr, &Opts{}).Root())
+	testutil.Ok(t, err)
+	decoded, err := Unmarshal(data)
+	testutil.Ok(t, err)
+
+	matcher := decoded.(*VectorSelector).LabelMatchers[0]
+	testutil.Assert(t, matcher.Matches("bc"))
+	testutil.Assert(t, !matcher.Matches("cb"))
+}
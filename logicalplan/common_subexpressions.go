@@ -0,0 +1,126 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"fmt"
+
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+// SharedExpr is an expression which occurs more than once in a query. All occurrences
+// refer to the same SharedExpr, which is evaluated once for all of them.
+type SharedExpr struct {
+	// ID distinguishes shared expressions of a query in the plan.
+	ID   int
+	Expr Node
+}
+
+func (s *SharedExpr) String() string {
+	return fmt.Sprintf("shared(%d, %s)", s.ID, s.Expr.String())
+}
+
+func (s *SharedExpr) ReturnType() parser.ValueType { return s.Expr.ReturnType() }
+
+func (s *SharedExpr) Children() []*Node { return []*Node{&s.Expr} }
+
+// CommonSubexpressionOptimizer replaces subexpressions which occur more than once in a query
+// with a SharedExpr, so that they are only evaluated once. For example, the expression:
+//
+//	sum(rate(metric[5m])) / count(rate(metric[5m])) becomes:
+//	sum(shared(0, rate(metric[5m]))) / count(shared(0, rate(metric[5m]))).
+//
+// Only aggregations, function calls and binary expressions are shared, since selectors
+// already share their series through the selector pool. Subqueries and step invariant
+// expressions are evaluated at different steps than the rest of the query, so
+// subexpressions are not shared across them.
+type CommonSubexpressionOptimizer struct{}
+
+func (c CommonSubexpressionOptimizer) Optimize(expr Node, _ *Opts) Node {
+	total := make(map[string]int)
+	countSubexpressions(expr, func(key string) bool {
+		total[key]++
+		return true
+	})
+
+	// Subexpressions of repeated expressions are only evaluated for their first occurrence,
+	// so they are counted again without descending into the other occurrences.
+	occurrences := make(map[string]int)
+	countSubexpressions(expr, func(key string) bool {
+		occurrences[key]++
+		return total[key] < 2 || occurrences[key] == 1
+	})
+
+	shared := make(map[string]*SharedExpr)
+	replaceSubexpressions(&expr, occurrences, shared)
+	return expr
+}
+
+// countSubexpressions calls visit with the key of each subexpression which can be shared,
+// and descends into its arguments only when visit returns true.
+func countSubexpressions(expr Node, visit func(key string) bool) {
+	if isShareable(expr) && !visit(expr.String()) {
+		return
+	}
+	for _, child := range subexpressions(expr) {
+		countSubexpressions(*child, visit)
+	}
+}
+
+func replaceSubexpressions(expr *Node, occurrences map[string]int, shared map[string]*SharedExpr) {
+	if isShareable(*expr) {
+		key := (*expr).String()
+		if occurrences[key] > 1 {
+			if s, ok := shared[key]; ok {
+				*expr = s
+				return
+			}
+			s := &SharedExpr{ID: len(shared), Expr: *expr}
+			shared[key] = s
+			*expr = s
+			expr = &s.Expr
+		}
+	}
+	for _, child := range subexpressions(*expr) {
+		replaceSubexpressions(child, occurrences, shared)
+	}
+}
+
+func isShareable(expr Node) bool {
+	switch e := expr.(type) {
+	case *Aggregation:
+		return true
+	case *FunctionCall:
+		return len(e.Args) > 0
+	case *Binary:
+		return e.ReturnType() == parser.ValueTypeVector
+	default:
+		return false
+	}
+}
+
+// subexpressions returns the arguments of an expression which are evaluated at the same steps.
+func subexpressions(expr Node) []*Node {
+	switch e := expr.(type) {
+	case *Aggregation:
+		if e.Param == nil {
+			return []*Node{&e.Expr}
+		}
+		return []*Node{&e.Expr, &e.Param}
+	case *FunctionCall:
+		args := make([]*Node, len(e.Args))
+		for i := range e.Args {
+			args[i] = &e.Args[i]
+		}
+		return args
+	case *Binary:
+		return []*Node{&e.LHS, &e.RHS}
+	case *Parens:
+		return []*Node{&e.Expr}
+	case *Unary:
+		return []*Node{&e.Expr}
+	default:
+		return nil
+	}
+}
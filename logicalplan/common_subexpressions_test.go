@@ -0,0 +1,64 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+func TestCommonSubexpressionOptimizer(t *testing.T) {
+	cases := []struct {
+		name     string
+		expr     string
+		expected string
+	}{
+		{
+			name:     "repeated aggregation",
+			expr:     `sum(rate(metric[5m])) / sum(rate(metric[5m]))`,
+			expected: `shared(0, sum(rate(metric[5m]))) / shared(0, sum(rate(metric[5m])))`,
+		},
+		{
+			name:     "repeated function call in different aggregations",
+			expr:     `sum(rate(metric[5m])) / count(rate(metric[5m]))`,
+			expected: `sum(shared(0, rate(metric[5m]))) / count(shared(0, rate(metric[5m])))`,
+		},
+		{
+			name:     "nested repeated expressions",
+			expr:     `sum(rate(metric[5m])) / sum(rate(metric[5m])) + rate(metric[5m])`,
+			expected: `shared(0, sum(shared(1, rate(metric[5m])))) / shared(0, sum(shared(1, rate(metric[5m])))) + shared(1, rate(metric[5m]))`,
+		},
+		{
+			name:     "different offsets",
+			expr:     `sum(rate(metric[5m])) / sum(rate(metric[5m] offset 1h))`,
+			expected: `sum(rate(metric[5m])) / sum(rate(metric[5m] offset 1h))`,
+		},
+		{
+			name:     "repeated selectors",
+			expr:     `metric / metric`,
+			expected: `metric / metric`,
+		},
+		{
+			name:     "repeated expression in a subquery",
+			expr:     `max_over_time(rate(metric[5m])[1h:1m]) / rate(metric[5m])`,
+			expected: `max_over_time(rate(metric[5m])[1h:1m]) / rate(metric[5m])`,
+		},
+	}
+
+	optimizers := []Optimizer{CommonSubexpressionOptimizer{}}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			plan := New(expr, &Opts{Start: time.Unix(0, 0), End: time.Unix(0, 0)})
+			optimizedPlan := plan.Optimize(optimizers)
+			testutil.Equals(t, tcase.expected, optimizedPlan.Root().String())
+		})
+	}
+}
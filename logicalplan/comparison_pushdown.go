@@ -0,0 +1,79 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+// ComparisonPushdownOptimizer pushes comparisons between vector selectors and constants
+// in the arguments of aggregations down to the selectors, which then drop samples that do
+// not pass the comparison while series are scanned. For example, the expression:
+//
+//	sum(metric > 100) becomes:
+//	sum(filter_values([value > 100], metric)).
+//
+// Comparisons without the bool modifier return the selected samples unchanged,
+// so the filtered selector replaces the comparison.
+type ComparisonPushdownOptimizer struct{}
+
+func (c ComparisonPushdownOptimizer) Optimize(expr Node, _ *Opts) Node {
+	traverse(&expr, func(node *Node) {
+		aggr, ok := (*node).(*Aggregation)
+		if !ok {
+			return
+		}
+		pushdownComparisons(&aggr.Expr)
+	})
+	return expr
+}
+
+func pushdownComparisons(expr *Node) {
+	switch e := (*expr).(type) {
+	case *Parens:
+		pushdownComparisons(&e.Expr)
+	case *Binary:
+		if !e.Op.IsComparisonOperator() || e.ReturnBool {
+			return
+		}
+		pushdownComparisons(&e.LHS)
+		pushdownComparisons(&e.RHS)
+
+		if value, ok := numberLiteral(e.RHS); ok {
+			if selector, ok := filteredSelector(e.LHS); ok {
+				selector.ValueFilters = append(selector.ValueFilters, ValueFilter{Op: e.Op, Value: value})
+				*expr = selector
+			}
+			return
+		}
+		if value, ok := numberLiteral(e.LHS); ok {
+			if selector, ok := filteredSelector(e.RHS); ok {
+				selector.ValueFilters = append(selector.ValueFilters, ValueFilter{Op: e.Op, Value: value, ScalarLeft: true})
+				*expr = selector
+			}
+		}
+	}
+}
+
+func numberLiteral(expr Node) (float64, bool) {
+	switch e := expr.(type) {
+	case *NumberLiteral:
+		return e.Val, true
+	case *Parens:
+		return numberLiteral(e.Expr)
+	case *StepInvariantExpr:
+		return numberLiteral(e.Expr)
+	default:
+		return 0, false
+	}
+}
+
+func filteredSelector(expr Node) (*FilteredSelector, bool) {
+	switch e := expr.(type) {
+	case *VectorSelector:
+		return &FilteredSelector{VectorSelector: e}, true
+	case *FilteredSelector:
+		return e, true
+	case *Parens:
+		return filteredSelector(e.Expr)
+	default:
+		return nil, false
+	}
+}
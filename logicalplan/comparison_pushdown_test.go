@@ -0,0 +1,74 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+func TestComparisonPushdownOptimizer(t *testing.T) {
+	cases := []struct {
+		name     string
+		expr     string
+		expected string
+	}{
+		{
+			name:     "comparison with constant on the right",
+			expr:     `sum(metric > 100)`,
+			expected: `sum(filter_values([value > 100], metric))`,
+		},
+		{
+			name:     "comparison with constant on the left",
+			expr:     `count by (job) (100 <= metric)`,
+			expected: `count by (job) (filter_values([100 <= value], metric))`,
+		},
+		{
+			name:     "chained comparisons",
+			expr:     `max((metric > 10) < 100)`,
+			expected: `max(filter_values([value > 10 value < 100], metric))`,
+		},
+		{
+			name:     "comparison of a filtered selector",
+			expr:     `sum(metric{a="b", c="d"} > 1) / sum(metric{a="b"})`,
+			expected: `sum(filter_values([value > 1], filter([c="d"], metric{a="b"}))) / sum(metric{a="b"})`,
+		},
+		{
+			name:     "bool modifier",
+			expr:     `sum(metric > bool 100)`,
+			expected: `sum(metric > bool 100)`,
+		},
+		{
+			name:     "comparison outside of aggregation",
+			expr:     `metric > 100`,
+			expected: `metric > 100`,
+		},
+		{
+			name:     "comparison between vectors",
+			expr:     `sum(metric > other_metric)`,
+			expected: `sum(metric > other_metric)`,
+		},
+		{
+			name:     "arithmetic operator",
+			expr:     `sum(metric * 100)`,
+			expected: `sum(metric * 100)`,
+		},
+	}
+
+	optimizers := []Optimizer{MergeSelectsOptimizer{}, ComparisonPushdownOptimizer{}}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			plan := New(expr, &Opts{Start: time.Unix(0, 0), End: time.Unix(0, 0)})
+			optimizedPlan := plan.Optimize(optimizers)
+			testutil.Equals(t, tcase.expected, optimizedPlan.Root().String())
+		})
+	}
+}
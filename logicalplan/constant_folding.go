@@ -0,0 +1,120 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"math"
+
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+// ConstantFoldingOptimizer evaluates constant scalar subexpressions at planning time
+// and replaces them with number literals. For example, the expression:
+//
+//	rate(metric[5m]) * (60 * 60) becomes:
+//	rate(metric[5m]) * 3600.
+type ConstantFoldingOptimizer struct{}
+
+func (c ConstantFoldingOptimizer) Optimize(expr Node, _ *Opts) Node {
+	foldConstants(&expr)
+	return expr
+}
+
+// foldConstants replaces the constant subexpressions of the expression with their value.
+func foldConstants(expr *Node) {
+	switch e := (*expr).(type) {
+	case *StepInvariantExpr:
+		foldConstants(&e.Expr)
+		// Literals are constant at every step, so they do not need to be wrapped.
+		if literal, ok := e.Expr.(*NumberLiteral); ok {
+			*expr = literal
+		}
+	case *Parens:
+		foldConstants(&e.Expr)
+		if literal, ok := e.Expr.(*NumberLiteral); ok {
+			*expr = literal
+		}
+	case *Unary:
+		foldConstants(&e.Expr)
+		if literal, ok := e.Expr.(*NumberLiteral); ok {
+			val := literal.Val
+			if e.Op == parser.SUB {
+				val = -val
+			}
+			*expr = &NumberLiteral{Val: val}
+		}
+	case *Binary:
+		foldConstants(&e.LHS)
+		foldConstants(&e.RHS)
+		lhs, ok := e.LHS.(*NumberLiteral)
+		if !ok {
+			return
+		}
+		rhs, ok := e.RHS.(*NumberLiteral)
+		if !ok {
+			return
+		}
+		if val, ok := scalarBinop(e.Op, e.ReturnBool, lhs.Val, rhs.Val); ok {
+			*expr = &NumberLiteral{Val: val}
+		}
+	case *Aggregation:
+		foldConstants(&e.Expr)
+		if e.Param != nil {
+			foldConstants(&e.Param)
+		}
+	case *FunctionCall:
+		for i := range e.Args {
+			foldConstants(&e.Args[i])
+		}
+	case *Subquery:
+		foldConstants(&e.Expr)
+	}
+}
+
+// scalarBinop evaluates a binary operation between two scalars the same way as Prometheus.
+// Comparisons between scalars are only valid with the bool modifier.
+func scalarBinop(op parser.ItemType, returnBool bool, lhs, rhs float64) (float64, bool) {
+	switch op {
+	case parser.ADD:
+		return lhs + rhs, true
+	case parser.SUB:
+		return lhs - rhs, true
+	case parser.MUL:
+		return lhs * rhs, true
+	case parser.DIV:
+		return lhs / rhs, true
+	case parser.POW:
+		return math.Pow(lhs, rhs), true
+	case parser.MOD:
+		return math.Mod(lhs, rhs), true
+	case parser.ATAN2:
+		return math.Atan2(lhs, rhs), true
+	}
+	if !returnBool {
+		return 0, false
+	}
+	switch op {
+	case parser.EQLC:
+		return btof(lhs == rhs), true
+	case parser.NEQ:
+		return btof(lhs != rhs), true
+	case parser.GTR:
+		return btof(lhs > rhs), true
+	case parser.LSS:
+		return btof(lhs < rhs), true
+	case parser.GTE:
+		return btof(lhs >= rhs), true
+	case parser.LTE:
+		return btof(lhs <= rhs), true
+	default:
+		return 0, false
+	}
+}
+
+func btof(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
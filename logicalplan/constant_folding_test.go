@@ -0,0 +1,74 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+func TestConstantFoldingOptimizer(t *testing.T) {
+	cases := []struct {
+		name     string
+		expr     string
+		expected string
+	}{
+		{
+			name:     "constant expression",
+			expr:     `4 + 0.5`,
+			expected: `4.5`,
+		},
+		{
+			name:     "constant operand",
+			expr:     `rate(metric[5m]) * (60 * 60)`,
+			expected: `rate(metric[5m]) * 3600`,
+		},
+		{
+			name:     "function arguments",
+			expr:     `histogram_quantile(0.5 + 0.4, rate(metric[5m]))`,
+			expected: `histogram_quantile(0.9, rate(metric[5m]))`,
+		},
+		{
+			name:     "aggregation parameter",
+			expr:     `topk(2 * 5, metric)`,
+			expected: `topk(10, metric)`,
+		},
+		{
+			name:     "unary expression",
+			expr:     `metric - -(2 ^ 3)`,
+			expected: `metric - -8`,
+		},
+		{
+			name:     "comparison",
+			expr:     `metric > bool (1 < bool 2)`,
+			expected: `metric > bool 1`,
+		},
+		{
+			name:     "constant in subquery",
+			expr:     `max_over_time((metric * (1 + 1))[5m:1m])`,
+			expected: `max_over_time((metric * 2)[5m:1m])`,
+		},
+		{
+			name:     "non-constant scalar",
+			expr:     `metric * (time() + 1)`,
+			expected: `metric * (time() + 1)`,
+		},
+	}
+
+	optimizers := []Optimizer{ConstantFoldingOptimizer{}}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			plan := New(expr, &Opts{Start: time.Unix(0, 0), End: time.Unix(0, 0)})
+			optimizedPlan := plan.Optimize(optimizers)
+			testutil.Equals(t, tcase.expected, optimizedPlan.Root().String())
+		})
+	}
+}
@@ -0,0 +1,24 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+// EstimateCost returns a relative estimate of the cost of evaluating the expression, which is
+// computed before any data is selected. For each selector, the cost is the number of seconds
+// of samples it selects, plus the number of seconds of samples in the range it evaluates at each step.
+// Since the number of selected series is not known in advance, estimates are only meaningful
+// when compared to each other.
+func EstimateCost(expr Node, opts *Opts) float64 {
+	steps := int64(1)
+	// Instant queries are planned with a step shorter than a millisecond.
+	if opts.Step.Milliseconds() > 0 {
+		steps = opts.End.Sub(opts.Start).Milliseconds()/opts.Step.Milliseconds() + 1
+	}
+
+	var cost float64
+	for _, r := range SelectorRanges(expr, opts) {
+		cost += float64(r.MaxT-r.MinT) / 1000
+		cost += float64(steps) * r.Range.Seconds()
+	}
+	return cost
+}
@@ -5,6 +5,7 @@ package logicalplan
 
 import (
 	"fmt"
+	"math"
 	"sort"
 	"strings"
 	"time"
@@ -14,6 +15,7 @@ import (
 	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
 
 	"github.com/thanos-community/promql-engine/api"
+	"github.com/thanos-community/promql-engine/execution/parse"
 )
 
 type RemoteExecutions []RemoteExecution
@@ -41,13 +43,9 @@ func (r RemoteExecution) String() string {
 	return fmt.Sprintf("remote(%s) [%s]", r.Query, r.QueryRangeStart.String())
 }
 
-func (r RemoteExecution) Pretty(level int) string { return r.String() }
+func (r RemoteExecution) ReturnType() parser.ValueType { return parser.ValueTypeMatrix }
 
-func (r RemoteExecution) PositionRange() parser.PositionRange { return parser.PositionRange{} }
-
-func (r RemoteExecution) Type() parser.ValueType { return parser.ValueTypeMatrix }
-
-func (r RemoteExecution) PromQLExpr() {}
+func (r RemoteExecution) Children() []*Node { return nil }
 
 // Deduplicate is a logical plan which deduplicates samples from multiple RemoteExecutions.
 type Deduplicate struct {
@@ -58,25 +56,65 @@ func (r Deduplicate) String() string {
 	return fmt.Sprintf("dedup(%s)", r.Expressions.String())
 }
 
-func (r Deduplicate) Pretty(level int) string { return r.String() }
+func (r Deduplicate) ReturnType() parser.ValueType { return parser.ValueTypeMatrix }
 
-func (r Deduplicate) PositionRange() parser.PositionRange { return parser.PositionRange{} }
+func (r Deduplicate) Children() []*Node { return nil }
 
-func (r Deduplicate) Type() parser.ValueType { return parser.ValueTypeMatrix }
+// PartialAggregation is a logical plan which combines partial aggregates returned by remote
+// engines into an exact avg, stddev or stdvar aggregation. Each engine returns the number of
+// aggregated samples together with their sum for avg, or with their mean and variance for
+// stddev and stdvar.
+type PartialAggregation struct {
+	Op       parser.ItemType
+	Grouping []string
+	Without  bool
 
-func (r Deduplicate) PromQLExpr() {}
+	Count    Node
+	Sum      Node
+	Mean     Node
+	Variance Node
+}
 
-type Noop struct{}
+func (r *PartialAggregation) String() string {
+	components := []string{fmt.Sprintf("count: %s", r.Count)}
+	if r.Sum != nil {
+		components = append(components, fmt.Sprintf("sum: %s", r.Sum))
+	}
+	if r.Mean != nil {
+		components = append(components, fmt.Sprintf("mean: %s", r.Mean))
+	}
+	if r.Variance != nil {
+		components = append(components, fmt.Sprintf("variance: %s", r.Variance))
+	}
 
-func (r Noop) String() string { return "noop" }
+	grouping := ""
+	if r.Without {
+		grouping = fmt.Sprintf(" without (%s)", strings.Join(r.Grouping, ", "))
+	} else if len(r.Grouping) > 0 {
+		grouping = fmt.Sprintf(" by (%s)", strings.Join(r.Grouping, ", "))
+	}
+	return fmt.Sprintf("partial %s%s (%s)", r.Op, grouping, strings.Join(components, ", "))
+}
 
-func (r Noop) Pretty(level int) string { return r.String() }
+func (r *PartialAggregation) ReturnType() parser.ValueType { return parser.ValueTypeVector }
 
-func (r Noop) PositionRange() parser.PositionRange { return parser.PositionRange{} }
+func (r *PartialAggregation) Children() []*Node {
+	children := []*Node{&r.Count}
+	for _, component := range []*Node{&r.Sum, &r.Mean, &r.Variance} {
+		if *component != nil {
+			children = append(children, component)
+		}
+	}
+	return children
+}
+
+type Noop struct{}
 
-func (r Noop) Type() parser.ValueType { return parser.ValueTypeMatrix }
+func (r Noop) String() string { return "noop" }
+
+func (r Noop) ReturnType() parser.ValueType { return parser.ValueTypeMatrix }
 
-func (r Noop) PromQLExpr() {}
+func (r Noop) Children() []*Node { return nil }
 
 // distributiveAggregations are all PromQL aggregations which support
 // distributed execution.
@@ -94,19 +132,35 @@ var distributiveAggregations = map[parser.ItemType]struct{}{
 // distributed Query execution.
 type DistributedExecutionOptimizer struct {
 	Endpoints api.RemoteEndpoints
+	// ReplicaLabels are the labels by which results of remote engines are deduplicated.
+	// Results with replicas always have to be deduplicated, even within a single engine.
+	ReplicaLabels []string
 }
 
-func (m DistributedExecutionOptimizer) Optimize(plan parser.Expr, opts *Opts) parser.Expr {
+func (m DistributedExecutionOptimizer) Optimize(plan Node, opts *Opts) Node {
 	engines := m.Endpoints.Engines()
-	traverseBottomUp(nil, &plan, func(parent, current *parser.Expr) (stop bool) {
+	inSubquery := make(map[*Node]struct{})
+	markSubqueryExprs(&plan, false, inSubquery)
+	traverseBottomUp(nil, &plan, func(parent, current *Node) (stop bool) {
+		// Expressions in subqueries are evaluated for the steps of the subquery,
+		// so they can only be distributed together with the subquery.
+		if _, ok := inSubquery[current]; ok {
+			return false
+		}
+		// Subqueries are only distributed together with the function consuming them, since
+		// remote engines only return instant vectors.
+		if subquery, ok := (*current).(*Subquery); ok && (!isFunctionArg(parent) || !isEngineLocal(subquery, engines)) {
+			return true
+		}
+
 		// If the current operation is not distributive, stop the traversal.
-		if !isDistributive(current) {
+		if !isDistributive(current) || !isSupportedByEngines(current, engines) {
 			return true
 		}
 
 		// If the current node is an aggregation, distribute the operation and
 		// stop the traversal.
-		if aggr, ok := (*current).(*parser.AggregateExpr); ok {
+		if aggr, ok := (*current).(*Aggregation); ok {
 			localAggregation := aggr.Op
 			if aggr.Op == parser.COUNT {
 				localAggregation = parser.SUM
@@ -114,22 +168,34 @@ func (m DistributedExecutionOptimizer) Optimize(plan parser.Expr, opts *Opts) pa
 
 			remoteAggregation := newRemoteAggregation(aggr, engines)
 			subQueries := m.distributeQuery(&remoteAggregation, engines, opts)
-			*current = &parser.AggregateExpr{
+			*current = &Aggregation{
 				Op:       localAggregation,
 				Expr:     subQueries,
 				Param:    aggr.Param,
 				Grouping: aggr.Grouping,
 				Without:  aggr.Without,
-				PosRange: aggr.PosRange,
 			}
 			return true
 		}
 
+		// Averages and standard deviations can be computed exactly from partial aggregates
+		// when all engines support the partial aggregation protocol.
+		if aggr, ok := partialAggregation(parent, engines); ok {
+			*parent = m.distributePartialAggregation(aggr, engines, opts)
+			return true
+		}
+
 		// If the parent operation is distributive, continue the traversal.
-		if isDistributive(parent) {
+		if isDistributive(parent) && isSupportedByEngines(parent, engines) {
 			return false
 		}
 
+		// Range selectors can only be executed remotely together with the function
+		// consuming them, so the expression is evaluated centrally instead.
+		if isRangeSelectorArg(parent, current) {
+			return true
+		}
+
 		*current = m.distributeQuery(current, engines, opts)
 		return true
 	})
@@ -137,7 +203,7 @@ func (m DistributedExecutionOptimizer) Optimize(plan parser.Expr, opts *Opts) pa
 	return plan
 }
 
-func newRemoteAggregation(rootAggregation *parser.AggregateExpr, engines []api.RemoteEngine) parser.Expr {
+func newRemoteAggregation(rootAggregation *Aggregation, engines []api.RemoteEngine) Node {
 	groupingSet := make(map[string]struct{})
 	for _, lbl := range rootAggregation.Grouping {
 		groupingSet[lbl] = struct{}{}
@@ -166,22 +232,83 @@ func newRemoteAggregation(rootAggregation *parser.AggregateExpr, engines []api.R
 	return &remoteAggregation
 }
 
-// distributeQuery takes a PromQL expression in the form of *parser.Expr and a set of remote engines.
+// partialAggregations are aggregations which can be computed from partial aggregates.
+var partialAggregations = map[parser.ItemType]struct{}{
+	parser.AVG:    {},
+	parser.STDDEV: {},
+	parser.STDVAR: {},
+}
+
+// partialAggregation returns the parent aggregation if it can be
+// computed from partial aggregates returned by all engines.
+func partialAggregation(parent *Node, engines []api.RemoteEngine) (*Aggregation, bool) {
+	if parent == nil || len(engines) == 0 {
+		return nil, false
+	}
+	aggr, ok := (*parent).(*Aggregation)
+	if !ok {
+		return nil, false
+	}
+	if _, ok := partialAggregations[aggr.Op]; !ok {
+		return nil, false
+	}
+	for _, e := range engines {
+		if e.Capabilities().PlanProtocolVersion < api.PlanProtocolPartialAggregates {
+			return nil, false
+		}
+	}
+	return aggr, true
+}
+
+// distributePartialAggregation distributes the aggregations needed for computing the given
+// aggregation from partial aggregates. Remote aggregations are grouped by external labels
+// in addition to the original grouping labels so that results from overlapping engines
+// can be deduplicated before they are combined.
+func (m DistributedExecutionOptimizer) distributePartialAggregation(aggr *Aggregation, engines []api.RemoteEngine, opts *Opts) Node {
+	component := func(op parser.ItemType) Node {
+		remoteAggregation := newRemoteAggregation(aggr, engines).(*Aggregation)
+		remoteAggregation.Op = op
+		var expr Node = remoteAggregation
+		return m.distributeQuery(&expr, engines, opts)
+	}
+
+	partial := &PartialAggregation{
+		Op:       aggr.Op,
+		Grouping: aggr.Grouping,
+		Without:  aggr.Without,
+		Count:    component(parser.COUNT),
+	}
+	if aggr.Op == parser.AVG {
+		partial.Sum = component(parser.SUM)
+	} else {
+		partial.Mean = component(parser.AVG)
+		partial.Variance = component(parser.STDVAR)
+	}
+	return partial
+}
+
+// distributeQuery takes a PromQL expression in the form of *Node and a set of remote engines.
 // For each engine which matches the time range of the query, it creates a RemoteExecution scoped to the range of the engine.
-// All remote executions are wrapped in a Deduplicate logical node to make sure that results from overlapping engines are deduplicated.
-// TODO(fpetkovski): Prune remote engines based on external labels.
-func (m DistributedExecutionOptimizer) distributeQuery(expr *parser.Expr, engines []api.RemoteEngine, opts *Opts) parser.Expr {
+// Engines whose external labels contradict the matchers of a selector in the expression are pruned.
+// Remote executions are wrapped in a Deduplicate logical node to make sure that results from overlapping engines are deduplicated.
+// If the engines attach disjoint external label sets to their series, and the expression keeps them, no two engines can return
+// the same series. The remote executions are then concatenated with a Coalesce node instead, regardless of their time ranges.
+func (m DistributedExecutionOptimizer) distributeQuery(expr *Node, engines []api.RemoteEngine, opts *Opts) Node {
 	if isAbsent(*expr) {
 		return m.distributeAbsent(*expr, engines, opts)
 	}
 
+	// Subqueries select samples before the first step of the query,
+	// so engines are pruned by the range of their subqueries as well.
+	subqueryRange := maxSubqueryRange(*expr)
+
 	remoteQueries := make(RemoteExecutions, 0, len(engines))
 	for _, e := range engines {
 		if !matchesExternalLabelSet(*expr, e.LabelSets()) {
 			continue
 		}
 
-		if e.MaxT() < opts.Start.UnixMilli()-opts.LookbackDelta.Milliseconds() {
+		if e.MaxT() < opts.Start.UnixMilli()-opts.LookbackDelta.Milliseconds()-subqueryRange.Milliseconds() {
 			continue
 		}
 		if e.MinT() > opts.End.UnixMilli() {
@@ -190,7 +317,10 @@ func (m DistributedExecutionOptimizer) distributeQuery(expr *parser.Expr, engine
 
 		start := opts.Start
 		if e.MinT() > start.UnixMilli() {
-			start = calculateStepAlignedStart(e, opts)
+			start = StepAlignedStart(subqueryStart(e, engines, subqueryRange), opts)
+		}
+		if start.After(opts.End) {
+			continue
 		}
 
 		remoteQueries = append(remoteQueries, RemoteExecution{
@@ -204,12 +334,77 @@ func (m DistributedExecutionOptimizer) distributeQuery(expr *parser.Expr, engine
 		return Noop{}
 	}
 
+	if len(m.ReplicaLabels) == 0 && hasDisjointLabelSets(remoteQueries) && keepsEngineLabels(*expr, engines) {
+		exprs := make([]Node, len(remoteQueries))
+		for i, q := range remoteQueries {
+			exprs[i] = q
+		}
+		return &Coalesce{Exprs: exprs}
+	}
 	return Deduplicate{
 		Expressions: remoteQueries,
 	}
 }
 
-func (m DistributedExecutionOptimizer) distributeAbsent(expr parser.Expr, engines []api.RemoteEngine, opts *Opts) parser.Expr {
+// labelChangingFunctions are functions which return series without the labels of their arguments.
+var labelChangingFunctions = map[string]struct{}{
+	"absent":           {},
+	"absent_over_time": {},
+	"label_join":       {},
+	"label_replace":    {},
+	"scalar":           {},
+	"vector":           {},
+}
+
+// keepsEngineLabels returns true if the series returned for the expression keep the
+// external labels of the series selected from each engine.
+func keepsEngineLabels(expr Node, engines []api.RemoteEngine) bool {
+	keeps := true
+	inspect(expr, nil, func(node Node, _ []Node) {
+		switch n := node.(type) {
+		case *Aggregation:
+			keeps = keeps && keepsExternalLabels(n, engines)
+		case *Binary:
+			keeps = keeps && (isNumberLiteral(n.LHS) || isNumberLiteral(n.RHS))
+		case *FunctionCall:
+			_, ok := labelChangingFunctions[n.Func.Name]
+			keeps = keeps && !ok
+		}
+	})
+	return keeps
+}
+
+// hasDisjointLabelSets returns true if all engines attach their external labels to their series, and
+// the label sets of each engine differ from the label sets of all other engines in the value of a label.
+func hasDisjointLabelSets(queries RemoteExecutions) bool {
+	for i, q := range queries {
+		if !q.Engine.Capabilities().ExternalLabels || len(q.Engine.LabelSets()) == 0 {
+			return false
+		}
+		for _, other := range queries[i+1:] {
+			for _, lbls := range q.Engine.LabelSets() {
+				for _, otherLbls := range other.Engine.LabelSets() {
+					if !conflictingLabelSets(lbls, otherLbls) {
+						return false
+					}
+				}
+			}
+		}
+	}
+	return true
+}
+
+// conflictingLabelSets returns true if a label is set to different values in the label sets.
+func conflictingLabelSets(a, b labels.Labels) bool {
+	for _, l := range a {
+		if v := b.Get(l.Name); v != "" && v != l.Value {
+			return true
+		}
+	}
+	return false
+}
+
+func (m DistributedExecutionOptimizer) distributeAbsent(expr Node, engines []api.RemoteEngine, opts *Opts) Node {
 	queries := make(RemoteExecutions, 0, len(engines))
 	for i := range engines {
 		queries = append(queries, RemoteExecution{
@@ -219,9 +414,9 @@ func (m DistributedExecutionOptimizer) distributeAbsent(expr parser.Expr, engine
 		})
 	}
 
-	var rootExpr parser.Expr = queries[0]
+	var rootExpr Node = queries[0]
 	for i := 1; i < len(queries); i++ {
-		rootExpr = &parser.BinaryExpr{
+		rootExpr = &Binary{
 			Op:             parser.MUL,
 			LHS:            rootExpr,
 			RHS:            queries[i],
@@ -232,21 +427,21 @@ func (m DistributedExecutionOptimizer) distributeAbsent(expr parser.Expr, engine
 	return rootExpr
 }
 
-func isAbsent(expr parser.Expr) bool {
-	call, ok := expr.(*parser.Call)
+func isAbsent(expr Node) bool {
+	call, ok := expr.(*FunctionCall)
 	if !ok {
 		return false
 	}
 	return call.Func.Name == "absent" || call.Func.Name == "absent_over_time"
 }
 
-// calculateStepAlignedStart returns a start time for the query based on the
-// engine min time and the query step size.
+// StepAlignedStart returns a start time for a remote query against an engine
+// with the given min time, based on the query step size.
 // The purpose of this alignment is to make sure that the steps for the remote query
 // have the same timestamps as the ones for the central query.
-func calculateStepAlignedStart(engine api.RemoteEngine, opts *Opts) time.Time {
+func StepAlignedStart(mint int64, opts *Opts) time.Time {
 	originalSteps := numSteps(opts.Start, opts.End, opts.Step)
-	remoteQuerySteps := numSteps(time.UnixMilli(engine.MinT()), opts.End, opts.Step)
+	remoteQuerySteps := numSteps(time.UnixMilli(mint), opts.End, opts.Step)
 
 	stepsToSkip := originalSteps - remoteQuerySteps
 	stepAlignedStartTime := opts.Start.UnixMilli() + stepsToSkip*opts.Step.Milliseconds()
@@ -258,12 +453,12 @@ func numSteps(start, end time.Time, step time.Duration) int64 {
 	return (end.UnixMilli()-start.UnixMilli())/step.Milliseconds() + 1
 }
 
-func isDistributive(expr *parser.Expr) bool {
+func isDistributive(expr *Node) bool {
 	if expr == nil {
 		return false
 	}
 	switch aggr := (*expr).(type) {
-	case *parser.BinaryExpr:
+	case *Binary:
 		// Binary expressions are joins and need to be done across the entire
 		// data set. This is why we cannot push down aggregations where
 		// the operand is a binary expression.
@@ -271,25 +466,230 @@ func isDistributive(expr *parser.Expr) bool {
 		lhsConstant := isNumberLiteral(aggr.LHS)
 		rhsConstant := isNumberLiteral(aggr.RHS)
 		return lhsConstant || rhsConstant
-	case *parser.AggregateExpr:
+	case *Aggregation:
 		// Certain aggregations are currently not supported.
 		if _, ok := distributiveAggregations[aggr.Op]; !ok {
 			return false
 		}
-	case *parser.Call:
+	case *FunctionCall:
 		return len(aggr.Args) > 0
 	}
 
 	return true
 }
 
-// matchesExternalLabels returns false if given matchers are not matching external labels.
-func matchesExternalLabelSet(expr parser.Expr, externalLabelSet []labels.Labels) bool {
+// xFunctions are functions which remote engines only support when they
+// have the XFunctions capability.
+var xFunctions = map[string]struct{}{
+	"xdelta":          {},
+	"xincrease":       {},
+	"xrate":           {},
+	"xsmoothincrease": {},
+}
+
+// nativeHistogramFunctions are functions which remote engines only support
+// when they have the NativeHistograms capability.
+var nativeHistogramFunctions = map[string]struct{}{
+	"histogram_count":    {},
+	"histogram_sum":      {},
+	"histogram_fraction": {},
+	"histogram_stddev":   {},
+	"histogram_stdvar":   {},
+}
+
+// isSupportedByEngines returns false if any of the engines lacks
+// the capabilities needed for evaluating the given expression.
+func isSupportedByEngines(expr *Node, engines []api.RemoteEngine) bool {
+	if expr == nil {
+		return true
+	}
+	call, ok := (*expr).(*FunctionCall)
+	if !ok {
+		return true
+	}
+
+	name := call.Func.Name
+	for _, e := range engines {
+		capabilities := e.Capabilities()
+		if !capabilities.SupportsFunction(name) {
+			return false
+		}
+		if _, ok := xFunctions[name]; ok && !capabilities.XFunctions {
+			return false
+		}
+		if _, ok := parse.ExperimentalFunctions[name]; ok && !capabilities.ExperimentalFunctions {
+			return false
+		}
+		if _, ok := nativeHistogramFunctions[name]; ok && !capabilities.NativeHistograms {
+			return false
+		}
+	}
+	return true
+}
+
+// isRangeSelectorArg returns true if the current node is the selector of a range selector,
+// or a subquery, which is passed as an argument to the parent function call.
+func isRangeSelectorArg(parent, current *Node) bool {
+	if parent == nil {
+		return false
+	}
+	call, ok := (*parent).(*FunctionCall)
+	if !ok {
+		return false
+	}
+	for i, arg := range call.Args {
+		switch a := arg.(type) {
+		case *MatrixSelector:
+			if &a.VectorSelector == current {
+				return true
+			}
+		case *Subquery:
+			if &call.Args[i] == current {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isFunctionArg(parent *Node) bool {
+	if parent == nil {
+		return false
+	}
+	_, ok := (*parent).(*FunctionCall)
+	return ok
+}
+
+// markSubqueryExprs adds the expressions nested in subqueries to the set.
+func markSubqueryExprs(expr *Node, inSubquery bool, set map[*Node]struct{}) {
+	if inSubquery {
+		set[expr] = struct{}{}
+	}
+	_, isSubquery := (*expr).(*Subquery)
+	for _, child := range (*expr).Children() {
+		markSubqueryExprs(child, inSubquery || isSubquery, set)
+	}
+}
+
+// isEngineLocal returns true if the subquery can be evaluated by each engine independently,
+// so that the results of engines only need to be deduplicated. This is the case when its
+// expression does not join series and its aggregations keep the series of different engines
+// apart by external labels. Subqueries with @ modifiers are evaluated centrally.
+func isEngineLocal(subquery *Subquery, engines []api.RemoteEngine) bool {
+	local := true
+	inspect(subquery, nil, func(node Node, _ []Node) {
+		switch n := node.(type) {
+		case *Subquery:
+			local = local && n.Timestamp == nil
+		case *VectorSelector:
+			local = local && n.Timestamp == nil
+		case *FilteredSelector:
+			local = local && n.Timestamp == nil
+		case *Aggregation:
+			local = local && keepsExternalLabels(n, engines)
+		case *Binary:
+			local = local && (isNumberLiteral(n.LHS) || isNumberLiteral(n.RHS))
+		case *FunctionCall:
+			local = local && !isAbsent(n) && isSupportedByEngines(&node, engines)
+		}
+	})
+	return local
+}
+
+// keepsExternalLabels returns true if the aggregation groups series by all external labels
+// of engines, so that series from different engines are never aggregated together.
+func keepsExternalLabels(aggr *Aggregation, engines []api.RemoteEngine) bool {
+	grouping := make(map[string]struct{}, len(aggr.Grouping))
+	for _, lbl := range aggr.Grouping {
+		grouping[lbl] = struct{}{}
+	}
+	for _, e := range engines {
+		// Engines without external labels can hold series of the same group.
+		if len(e.LabelSets()) == 0 {
+			return false
+		}
+		for _, lbls := range e.LabelSets() {
+			if len(lbls) == 0 {
+				return false
+			}
+			for _, lbl := range lbls {
+				if _, ok := grouping[lbl.Name]; ok == aggr.Without {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// maxSubqueryRange returns the longest range before each step from which subqueries in the
+// expression select samples, including the ranges selected by the expressions of subqueries.
+func maxSubqueryRange(expr Node) time.Duration {
+	if subquery, ok := expr.(*Subquery); ok {
+		return subquery.Range + subquery.Offset + maxSelectRange(subquery.Expr)
+	}
+	var maxRange time.Duration
+	for _, child := range expr.Children() {
+		if r := maxSubqueryRange(*child); r > maxRange {
+			maxRange = r
+		}
+	}
+	return maxRange
+}
+
+// maxSelectRange returns the longest range before each step from which the expression selects samples.
+func maxSelectRange(expr Node) time.Duration {
+	switch e := expr.(type) {
+	case *VectorSelector:
+		return e.Offset
+	case *FilteredSelector:
+		return e.Offset
+	case *MatrixSelector:
+		return e.Range + maxSelectRange(e.VectorSelector)
+	case *Subquery:
+		return e.Range + e.Offset + maxSelectRange(e.Expr)
+	}
+	var maxRange time.Duration
+	for _, child := range expr.Children() {
+		if r := maxSelectRange(*child); r > maxRange {
+			maxRange = r
+		}
+	}
+	return maxRange
+}
+
+// subqueryStart returns the time from which the engine evaluates a query whose subqueries
+// select samples from subqueryRange before each step. Until the range is covered by the
+// engine, steps are left to older engines which overlap with it, since the engine would
+// only evaluate the subqueries over part of their range.
+func subqueryStart(engine api.RemoteEngine, engines []api.RemoteEngine, subqueryRange time.Duration) int64 {
+	if subqueryRange <= 0 {
+		return engine.MinT()
+	}
+	var coveredUntil int64 = math.MinInt64
+	for _, e := range engines {
+		if e.MinT() < engine.MinT() && e.MaxT() >= engine.MinT() && e.MaxT() > coveredUntil {
+			coveredUntil = e.MaxT()
+		}
+	}
+	if coveredUntil == math.MinInt64 {
+		return engine.MinT()
+	}
+	// Older engines evaluate steps up to their max time.
+	start := engine.MinT() + subqueryRange.Milliseconds()
+	if coveredUntil+1 < start {
+		return coveredUntil + 1
+	}
+	return start
+}
+
+// matchesExternalLabelSet returns false if the matchers of any selector in the expression
+// contradict each of the external label sets of an engine.
+func matchesExternalLabelSet(expr Node, externalLabelSet []labels.Labels) bool {
 	if len(externalLabelSet) == 0 {
 		return true
 	}
-	selectorSet := parser.ExtractSelectors(expr)
-	for _, selectors := range selectorSet {
+	for _, selectors := range selectorMatchers(expr) {
 		hasMatch := false
 		for _, externalLabels := range externalLabelSet {
 			hasMatch = hasMatch || matchesExternalLabels(selectors, externalLabels)
@@ -302,6 +702,20 @@ func matchesExternalLabelSet(expr parser.Expr, externalLabelSet []labels.Labels)
 	return true
 }
 
+// selectorMatchers returns the matchers of each selector in the expression.
+func selectorMatchers(expr Node) [][]*labels.Matcher {
+	var selectors [][]*labels.Matcher
+	inspect(expr, nil, func(node Node, _ []Node) {
+		switch n := node.(type) {
+		case *VectorSelector:
+			selectors = append(selectors, n.LabelMatchers)
+		case *FilteredSelector:
+			selectors = append(selectors, n.LabelMatchers)
+		}
+	})
+	return selectors
+}
+
 // matchesExternalLabels returns false if given matchers are not matching external labels.
 func matchesExternalLabels(ms []*labels.Matcher, externalLabels labels.Labels) bool {
 	if len(externalLabels) == 0 {
@@ -317,12 +731,12 @@ func matchesExternalLabels(ms []*labels.Matcher, externalLabels labels.Labels) b
 	return true
 }
 
-func isNumberLiteral(expr parser.Expr) bool {
-	if _, ok := expr.(*parser.NumberLiteral); ok {
+func isNumberLiteral(expr Node) bool {
+	if _, ok := expr.(*NumberLiteral); ok {
 		return true
 	}
 
-	stepInvariant, ok := expr.(*parser.StepInvariantExpr)
+	stepInvariant, ok := expr.(*StepInvariantExpr)
 	if !ok {
 		return false
 	}
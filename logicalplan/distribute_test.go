@@ -138,6 +138,33 @@ histogram_quantile(0.5, sum by (le) (dedup(
   remote(sum by (le, region) (rate(coredns_dns_request_duration_seconds_bucket[5m]))), 
   remote(sum by (le, region) (rate(coredns_dns_request_duration_seconds_bucket[5m])))
 )))`,
+		},
+		{
+			name: `histogram quantile with additional grouping labels`,
+			expr: `histogram_quantile(0.9, sum by (pod, le) (rate(coredns_dns_request_duration_seconds_bucket[5m])))`,
+			expected: `
+histogram_quantile(0.9, sum by (pod, le) (dedup(
+  remote(sum by (le, pod, region) (rate(coredns_dns_request_duration_seconds_bucket[5m]))),
+  remote(sum by (le, pod, region) (rate(coredns_dns_request_duration_seconds_bucket[5m])))
+)))`,
+		},
+		{
+			name: `histogram quantile with aggregation without labels`,
+			expr: `histogram_quantile(0.9, sum without (pod) (rate(coredns_dns_request_duration_seconds_bucket[5m])))`,
+			expected: `
+histogram_quantile(0.9, sum without (pod) (dedup(
+  remote(sum without (pod) (rate(coredns_dns_request_duration_seconds_bucket[5m]))),
+  remote(sum without (pod) (rate(coredns_dns_request_duration_seconds_bucket[5m])))
+)))`,
+		},
+		{
+			name: `histogram quantile in binary expression`,
+			expr: `histogram_quantile(0.9, sum by (le) (rate(coredns_dns_request_duration_seconds_bucket[5m]))) > 0.5`,
+			expected: `
+histogram_quantile(0.9, sum by (le) (dedup(
+  remote(sum by (le, region) (rate(coredns_dns_request_duration_seconds_bucket[5m]))),
+  remote(sum by (le, region) (rate(coredns_dns_request_duration_seconds_bucket[5m])))
+))) > 0.5`,
 		},
 		{
 			name:     "binary expression with time",
@@ -185,6 +212,54 @@ remote(sum by (pod, region) (rate(http_requests_total[2m]) * 60))))`,
 			expr:     `sum by (pod) (rate(http_requests_total{region="south"}[2m]))`,
 			expected: `sum by (pod) (dedup(remote(sum by (pod, region) (rate(http_requests_total{region="south"}[2m])))))`,
 		},
+		{
+			name:     "label based pruning with negative matcher matching one label set of an engine",
+			expr:     `http_requests_total{region!="east"}`,
+			expected: `dedup(remote(http_requests_total{region!="east"}), remote(http_requests_total{region!="east"}))`,
+		},
+		{
+			name:     "label based pruning with regex matcher",
+			expr:     `http_requests_total{region!~"east|south"}`,
+			expected: `dedup(remote(http_requests_total{region!~"east|south"}))`,
+		},
+		{
+			name:     "subquery",
+			expr:     `max_over_time(rate(http_requests_total[5m])[1h:1m])`,
+			expected: `dedup(remote(max_over_time(rate(http_requests_total[5m])[1h:1m])), remote(max_over_time(rate(http_requests_total[5m])[1h:1m])))`,
+		},
+		{
+			name: "aggregation of subquery with aggregation by external labels",
+			expr: `max by (pod) (max_over_time(sum by (pod, region) (rate(http_requests_total[5m]))[1h:1m]))`,
+			expected: `
+max by (pod) (dedup(
+  remote(max by (pod, region) (max_over_time(sum by (pod, region) (rate(http_requests_total[5m]))[1h:1m]))),
+  remote(max by (pod, region) (max_over_time(sum by (pod, region) (rate(http_requests_total[5m]))[1h:1m])))))`,
+		},
+		{
+			name:     "subquery with aggregation across engines",
+			expr:     `max_over_time(sum by (pod) (rate(http_requests_total[5m]))[1h:1m])`,
+			expected: `max_over_time(sum by (pod) (rate(http_requests_total[5m]))[1h:1m])`,
+		},
+		{
+			name:     "subquery with join",
+			expr:     `max_over_time((metric_a / metric_b)[1h:1m])`,
+			expected: `max_over_time((metric_a / metric_b)[1h:1m])`,
+		},
+		{
+			name:     "subquery without function",
+			expr:     `metric_a[1h:1m]`,
+			expected: `metric_a[1h:1m]`,
+		},
+		{
+			name:     "subquery with @ modifier",
+			expr:     `max_over_time(metric_a[1h:1m] @ 0)`,
+			expected: `max_over_time(metric_a[1h:1m] @ 0.000)`,
+		},
+		{
+			name:     "label based pruning with matcher on label which is not external",
+			expr:     `http_requests_total{pod="nginx-1"}`,
+			expected: `dedup(remote(http_requests_total{pod="nginx-1"}), remote(http_requests_total{pod="nginx-1"}))`,
+		},
 	}
 
 	engines := []api.RemoteEngine{
@@ -206,16 +281,297 @@ remote(sum by (pod, region) (rate(http_requests_total[2m]) * 60))))`,
 			plan := New(expr, &Opts{Start: time.Unix(0, 0), End: time.Unix(0, 0)})
 			optimizedPlan := plan.Optimize(optimizers)
 			expectedPlan := cleanUp(replacements, tcase.expected)
-			testutil.Equals(t, expectedPlan, optimizedPlan.Expr().String())
+			testutil.Equals(t, expectedPlan, optimizedPlan.Root().String())
+		})
+	}
+}
+
+func TestDistributedConcatenation(t *testing.T) {
+	newEngine := func(maxT int64, labelSets ...labels.Labels) *engineMock {
+		return &engineMock{maxT: maxT, labelSets: labelSets, capabilities: api.Capabilities{ExternalLabels: true}}
+	}
+	east := newEngine(1, labels.FromStrings("region", "east"))
+	west := newEngine(2, labels.FromStrings("region", "west"), labels.FromStrings("region", "south"))
+	eastReplica := newEngine(3, labels.FromStrings("region", "east", "replica", "b"))
+	unlabeled := newEngine(4)
+	withoutExternalLabels := newEngineMock(5, []labels.Labels{labels.FromStrings("region", "north")})
+
+	cases := []struct {
+		name          string
+		expr          string
+		engines       []api.RemoteEngine
+		replicaLabels []string
+		expected      string
+	}{
+		{
+			name:     "disjoint label sets",
+			expr:     `http_requests_total`,
+			engines:  []api.RemoteEngine{east, west},
+			expected: `coalesce(remote(http_requests_total), remote(http_requests_total))`,
+		},
+		{
+			name:     "aggregation",
+			expr:     `sum by (pod) (rate(http_requests_total[5m]))`,
+			engines:  []api.RemoteEngine{east, west},
+			expected: `sum by (pod) (coalesce(remote(sum by (pod, region) (rate(http_requests_total[5m]))), remote(sum by (pod, region) (rate(http_requests_total[5m])))))`,
+		},
+		{
+			name:     "operands of binary expression",
+			expr:     `http_requests_total / on (pod) http_errors_total`,
+			engines:  []api.RemoteEngine{east, west},
+			expected: `coalesce(remote(http_requests_total), remote(http_requests_total)) / on (pod) coalesce(remote(http_errors_total), remote(http_errors_total))`,
+		},
+		{
+			name:     "overlapping label sets",
+			expr:     `http_requests_total`,
+			engines:  []api.RemoteEngine{east, west, eastReplica},
+			expected: `dedup(remote(http_requests_total), remote(http_requests_total), remote(http_requests_total))`,
+		},
+		{
+			name:     "engine without label sets",
+			expr:     `http_requests_total`,
+			engines:  []api.RemoteEngine{east, unlabeled},
+			expected: `dedup(remote(http_requests_total), remote(http_requests_total))`,
+		},
+		{
+			name:     "engine which does not attach external labels",
+			expr:     `http_requests_total`,
+			engines:  []api.RemoteEngine{east, withoutExternalLabels},
+			expected: `dedup(remote(http_requests_total), remote(http_requests_total))`,
+		},
+		{
+			name:          "replica labels",
+			expr:          `http_requests_total`,
+			engines:       []api.RemoteEngine{east, west},
+			replicaLabels: []string{"replica"},
+			expected:      `dedup(remote(http_requests_total), remote(http_requests_total))`,
+		},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			optimizers := []Optimizer{DistributedExecutionOptimizer{Endpoints: api.NewStaticEndpoints(tcase.engines), ReplicaLabels: tcase.replicaLabels}}
+			plan := New(expr, &Opts{Start: time.Unix(0, 0), End: time.Unix(0, 0)})
+			testutil.Equals(t, tcase.expected, plan.Optimize(optimizers).Root().String())
+		})
+	}
+}
+
+func TestDistributedSubqueryStart(t *testing.T) {
+	older := newEngineMock(time.Unix(3*3600, 0).UnixMilli(), []labels.Labels{labels.FromStrings("region", "east")})
+	newer := newEngineMock(time.Unix(5*3600, 0).UnixMilli(), []labels.Labels{labels.FromStrings("region", "east")})
+	newer.minT = time.Unix(2*3600, 0).UnixMilli()
+	engines := []api.RemoteEngine{older, newer}
+
+	cases := []struct {
+		name     string
+		expr     string
+		start    time.Time
+		expected string
+	}{
+		{
+			name:     "selector starts at the min time of the newer engine",
+			expr:     `http_requests_total`,
+			start:    time.Unix(0, 0),
+			expected: `dedup(remote(http_requests_total), remote(http_requests_total) [1970-01-01 02:00:00 +0000 UTC])`,
+		},
+		{
+			name:     "subquery starts once its range is covered by the newer engine",
+			expr:     `max_over_time(http_requests_total[30m:1m])`,
+			start:    time.Unix(0, 0),
+			expected: `dedup(remote(max_over_time(http_requests_total[30m:1m])), remote(max_over_time(http_requests_total[30m:1m])) [1970-01-01 02:30:00 +0000 UTC])`,
+		},
+		{
+			name:     "subquery start includes the range of selectors in the subquery",
+			expr:     `max_over_time(rate(http_requests_total[5m] offset 1m)[30m:1m])`,
+			start:    time.Unix(0, 0),
+			expected: `dedup(remote(max_over_time(rate(http_requests_total[5m] offset 1m)[30m:1m])), remote(max_over_time(rate(http_requests_total[5m] offset 1m)[30m:1m])) [1970-01-01 02:36:00 +0000 UTC])`,
+		},
+		{
+			name:     "subquery starts after the max time of the older engine",
+			expr:     `max_over_time(http_requests_total[2h:1m])`,
+			start:    time.Unix(0, 0),
+			expected: `dedup(remote(max_over_time(http_requests_total[2h:1m])), remote(max_over_time(http_requests_total[2h:1m])) [1970-01-01 03:01:00 +0000 UTC])`,
+		},
+		{
+			name:     "selector does not need older engine",
+			expr:     `http_requests_total`,
+			start:    time.Unix(3*3600+30*60, 0),
+			expected: `dedup(remote(http_requests_total) [1970-01-01 03:30:00 +0000 UTC])`,
+		},
+		{
+			name:     "subquery selects samples from older engine",
+			expr:     `max_over_time(http_requests_total[1h:1m])`,
+			start:    time.Unix(3*3600+30*60, 0),
+			expected: `dedup(remote(max_over_time(http_requests_total[1h:1m])) [1970-01-01 03:30:00 +0000 UTC], remote(max_over_time(http_requests_total[1h:1m])) [1970-01-01 03:30:00 +0000 UTC])`,
+		},
+	}
+
+	optimizers := []Optimizer{DistributedExecutionOptimizer{Endpoints: api.NewStaticEndpoints(engines)}}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			opts := &Opts{Start: tcase.start, End: time.Unix(5*3600, 0), Step: time.Minute, LookbackDelta: 5 * time.Minute}
+			plan := New(expr, opts).Optimize(optimizers)
+			testutil.Equals(t, tcase.expected, plan.Root().String())
+		})
+	}
+}
+
+func TestDistributedExecutionWithCapabilities(t *testing.T) {
+	cases := []struct {
+		name     string
+		expr     string
+		expected string
+	}{
+		{
+			name:     "supported function",
+			expr:     `abs(http_requests_total)`,
+			expected: `dedup(remote(abs(http_requests_total)), remote(abs(http_requests_total)))`,
+		},
+		{
+			name:     "unsupported function over instant vector",
+			expr:     `sort(http_requests_total)`,
+			expected: `sort(dedup(remote(http_requests_total), remote(http_requests_total)))`,
+		},
+		{
+			name:     "unsupported function inside aggregation",
+			expr:     `sum by (pod) (sort(http_requests_total))`,
+			expected: `sum by (pod) (sort(dedup(remote(http_requests_total), remote(http_requests_total))))`,
+		},
+		{
+			name:     "unsupported function over range vector",
+			expr:     `sum by (pod) (deriv(http_requests_total[2m]))`,
+			expected: `sum by (pod) (deriv(http_requests_total[2m]))`,
+		},
+		{
+			name:     "native histogram function",
+			expr:     `histogram_count(http_requests_total)`,
+			expected: `histogram_count(dedup(remote(http_requests_total), remote(http_requests_total)))`,
+		},
+	}
+
+	capabilities := api.Capabilities{
+		Functions: map[string]struct{}{"abs": {}, "histogram_count": {}},
+	}
+	engines := []api.RemoteEngine{
+		&engineMock{maxT: 1, labelSets: []labels.Labels{labels.FromStrings("region", "east")}, capabilities: capabilities},
+		&engineMock{maxT: 2, labelSets: []labels.Labels{labels.FromStrings("region", "west")}, capabilities: capabilities},
+	}
+	optimizers := []Optimizer{DistributedExecutionOptimizer{Endpoints: api.NewStaticEndpoints(engines)}}
+	replacements := map[string]*regexp.Regexp{
+		" ": spaces,
+		"(": openParenthesis,
+		")": closedParenthesis,
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			plan := New(expr, &Opts{Start: time.Unix(0, 0), End: time.Unix(0, 0)})
+			optimizedPlan := plan.Optimize(optimizers)
+			expectedPlan := cleanUp(replacements, tcase.expected)
+			testutil.Equals(t, expectedPlan, optimizedPlan.Root().String())
+		})
+	}
+}
+
+func TestDistributedExecutionWithPartialAggregates(t *testing.T) {
+	cases := []struct {
+		name     string
+		expr     string
+		expected string
+	}{
+		{
+			name: "avg",
+			expr: `avg by (pod) (http_requests_total)`,
+			expected: `
+partial avg by (pod) (
+  count: dedup(
+    remote(count by (pod, region) (http_requests_total)),
+    remote(count by (pod, region) (http_requests_total))
+  ),
+  sum: dedup(
+    remote(sum by (pod, region) (http_requests_total)),
+    remote(sum by (pod, region) (http_requests_total))
+  )
+)`,
+		},
+		{
+			name: "stddev over function",
+			expr: `stddev without (pod) (rate(http_requests_total[2m]))`,
+			expected: `
+partial stddev without (pod) (
+  count: dedup(
+    remote(count without (pod) (rate(http_requests_total[2m]))),
+    remote(count without (pod) (rate(http_requests_total[2m])))
+  ),
+  mean: dedup(
+    remote(avg without (pod) (rate(http_requests_total[2m]))),
+    remote(avg without (pod) (rate(http_requests_total[2m])))
+  ),
+  variance: dedup(
+    remote(stdvar without (pod) (rate(http_requests_total[2m]))),
+    remote(stdvar without (pod) (rate(http_requests_total[2m])))
+  )
+)`,
+		},
+		{
+			name: "stdvar over binary expression with constant",
+			expr: `stdvar(http_requests_total * 2)`,
+			expected: `
+partial stdvar (
+  count: dedup(
+    remote(count by (region) (http_requests_total * 2)),
+    remote(count by (region) (http_requests_total * 2))
+  ),
+  mean: dedup(
+    remote(avg by (region) (http_requests_total * 2)),
+    remote(avg by (region) (http_requests_total * 2))
+  ),
+  variance: dedup(
+    remote(stdvar by (region) (http_requests_total * 2)),
+    remote(stdvar by (region) (http_requests_total * 2))
+  )
+)`,
+		},
+	}
+
+	capabilities := api.Capabilities{PlanProtocolVersion: api.PlanProtocolPartialAggregates}
+	engines := []api.RemoteEngine{
+		&engineMock{maxT: 1, labelSets: []labels.Labels{labels.FromStrings("region", "east")}, capabilities: capabilities},
+		&engineMock{maxT: 2, labelSets: []labels.Labels{labels.FromStrings("region", "west")}, capabilities: capabilities},
+	}
+	optimizers := []Optimizer{DistributedExecutionOptimizer{Endpoints: api.NewStaticEndpoints(engines)}}
+	replacements := map[string]*regexp.Regexp{
+		" ": spaces,
+		"(": openParenthesis,
+		")": closedParenthesis,
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			plan := New(expr, &Opts{Start: time.Unix(0, 0), End: time.Unix(0, 0)})
+			optimizedPlan := plan.Optimize(optimizers)
+			expectedPlan := cleanUp(replacements, tcase.expected)
+			testutil.Equals(t, expectedPlan, optimizedPlan.Root().String())
 		})
 	}
 }
 
 type engineMock struct {
 	api.RemoteEngine
-	minT      int64
-	maxT      int64
-	labelSets []labels.Labels
+	minT         int64
+	maxT         int64
+	labelSets    []labels.Labels
+	capabilities api.Capabilities
 }
 
 func (e engineMock) MaxT() int64 {
@@ -230,6 +586,10 @@ func (e engineMock) LabelSets() []labels.Labels {
 	return e.labelSets
 }
 
+func (e engineMock) Capabilities() api.Capabilities {
+	return e.capabilities
+}
+
 func newEngineMock(maxT int64, labelSets []labels.Labels) *engineMock {
 	return &engineMock{maxT: maxT, labelSets: labelSets}
 }
@@ -0,0 +1,40 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"github.com/thanos-community/promql-engine/execution/parse"
+)
+
+// extendedRangeFunctions maps functions to their counterparts with extended range semantics.
+var extendedRangeFunctions = map[string]string{
+	"delta":    "xdelta",
+	"increase": "xincrease",
+	"rate":     "xrate",
+}
+
+// ExtendedRangeFunctions replaces delta, increase and rate over range selectors with xdelta,
+// xincrease and xrate. These also use the last sample before each range, so that results do
+// not depend on extrapolation, which eases migrating from engines with the same semantics.
+type ExtendedRangeFunctions struct{}
+
+func (ExtendedRangeFunctions) Optimize(expr Node, _ *Opts) Node {
+	traverseBottomUp(nil, &expr, func(parent, current *Node) bool {
+		if parent == nil {
+			return false
+		}
+		call, ok := (*parent).(*FunctionCall)
+		if !ok || len(call.Args) != 1 {
+			return false
+		}
+		if _, ok := call.Args[0].(*MatrixSelector); !ok {
+			return false
+		}
+		if name, ok := extendedRangeFunctions[call.Func.Name]; ok {
+			call.Func = parse.Functions[name]
+		}
+		return false
+	})
+	return expr
+}
@@ -0,0 +1,52 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+func TestExtendedRangeFunctions(t *testing.T) {
+	cases := []struct {
+		name     string
+		expr     string
+		expected string
+	}{
+		{
+			name:     "rate",
+			expr:     "rate(X[5m])",
+			expected: "xrate(X[5m])",
+		},
+		{
+			name:     "nested",
+			expr:     `sum by (pod) (increase(X[5m])) / sum(delta(Y[1m] offset 5m))`,
+			expected: `sum by (pod) (xincrease(X[5m])) / sum(xdelta(Y[1m] offset 5m))`,
+		},
+		{
+			name:     "other functions",
+			expr:     "irate(X[5m]) + avg_over_time(Y[5m])",
+			expected: "irate(X[5m]) + avg_over_time(Y[5m])",
+		},
+		{
+			name:     "subquery",
+			expr:     "rate(X[5m:1m])",
+			expected: "rate(X[5m:1m])",
+		},
+	}
+	optimizers := []Optimizer{ExtendedRangeFunctions{}}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			plan := New(expr, &Opts{})
+			optimizedPlan := plan.Optimize(optimizers)
+			testutil.Equals(t, tcase.expected, optimizedPlan.Root().String())
+		})
+	}
+}
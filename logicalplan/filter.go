@@ -12,18 +12,56 @@ import (
 )
 
 type FilteredSelector struct {
-	*parser.VectorSelector
+	*VectorSelector
 	Filters []*labels.Matcher
+	// ValueFilters are comparisons with constants which float samples have to pass
+	// in order to be selected. Histogram samples are never selected when they are set.
+	ValueFilters []ValueFilter
+	// Projection is the set of labels retained by the selector.
+	// A nil projection retains all labels.
+	Projection *Projection
+	// Empty is set when the matchers and filters of the selector contradict each other,
+	// so that it cannot select any series.
+	Empty bool
+	// SkipHistogramBuckets is set when only the count and sum of native histograms are needed.
+	SkipHistogramBuckets bool
 }
 
 func (f FilteredSelector) String() string {
-	return fmt.Sprintf("filter(%s, %s)", f.Filters, f.VectorSelector.String())
+	s := f.VectorSelector.String()
+	if len(f.Filters) > 0 || (f.Projection == nil && len(f.ValueFilters) == 0 && !f.Empty && !f.SkipHistogramBuckets) {
+		s = fmt.Sprintf("filter(%s, %s)", f.Filters, s)
+	}
+	if len(f.ValueFilters) > 0 {
+		s = fmt.Sprintf("filter_values(%s, %s)", f.ValueFilters, s)
+	}
+	if f.Projection != nil {
+		s = fmt.Sprintf("project(%s, %s)", f.Projection, s)
+	}
+	if f.SkipHistogramBuckets {
+		s = fmt.Sprintf("histogram_stats(%s)", s)
+	}
+	if f.Empty {
+		s = fmt.Sprintf("empty(%s)", s)
+	}
+	return s
 }
 
-func (f FilteredSelector) Pretty(level int) string { return f.String() }
+func (f FilteredSelector) ReturnType() parser.ValueType { return parser.ValueTypeVector }
 
-func (f FilteredSelector) PositionRange() parser.PositionRange { return parser.PositionRange{} }
+func (f FilteredSelector) Children() []*Node { return nil }
 
-func (f FilteredSelector) Type() parser.ValueType { return parser.ValueTypeVector }
+// ValueFilter is a comparison between the values of samples and a constant.
+type ValueFilter struct {
+	Op    parser.ItemType
+	Value float64
+	// ScalarLeft is true when the constant is on the left side of the comparison.
+	ScalarLeft bool
+}
 
-func (f FilteredSelector) PromQLExpr() {}
+func (f ValueFilter) String() string {
+	if f.ScalarLeft {
+		return fmt.Sprintf("%v %s value", f.Value, parser.ItemTypeStr[f.Op])
+	}
+	return fmt.Sprintf("value %s %v", parser.ItemTypeStr[f.Op], f.Value)
+}
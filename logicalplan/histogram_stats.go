@@ -0,0 +1,65 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+// HistogramStatsOptimizer marks the selectors in the arguments of histogram_count and
+// histogram_sum, so that they only return the count and sum of native histograms.
+// For example, the expression:
+//
+//	histogram_count(rate(metric[5m])) becomes:
+//	histogram_count(rate(histogram_stats(metric)[5m])).
+//
+// Operators between the function and the selector then do not have to process buckets.
+// As in Prometheus, the outermost histogram function decides whether buckets are needed.
+type HistogramStatsOptimizer struct{}
+
+func (h HistogramStatsOptimizer) Optimize(expr Node, _ *Opts) Node {
+	markHistogramStats(&expr, false, false)
+	return expr
+}
+
+// markHistogramStats marks the selectors of the expression if stats is true. Once decided is
+// true, nested histogram functions no longer change whether buckets are needed.
+func markHistogramStats(expr *Node, stats, decided bool) {
+	switch e := (*expr).(type) {
+	case *VectorSelector:
+		if stats {
+			*expr = &FilteredSelector{VectorSelector: e, SkipHistogramBuckets: true}
+		}
+	case *FilteredSelector:
+		if stats {
+			e.SkipHistogramBuckets = true
+		}
+	case *MatrixSelector:
+		markHistogramStats(&e.VectorSelector, stats, decided)
+	case *FunctionCall:
+		if !decided {
+			switch e.Func.Name {
+			case "histogram_count", "histogram_sum":
+				stats, decided = true, true
+			case "histogram_quantile", "histogram_fraction":
+				decided = true
+			}
+		}
+		for i := range e.Args {
+			markHistogramStats(&e.Args[i], stats, decided)
+		}
+	case *Aggregation:
+		markHistogramStats(&e.Expr, stats, decided)
+		if e.Param != nil {
+			markHistogramStats(&e.Param, stats, decided)
+		}
+	case *Binary:
+		markHistogramStats(&e.LHS, stats, decided)
+		markHistogramStats(&e.RHS, stats, decided)
+	case *Parens:
+		markHistogramStats(&e.Expr, stats, decided)
+	case *Unary:
+		markHistogramStats(&e.Expr, stats, decided)
+	case *StepInvariantExpr:
+		markHistogramStats(&e.Expr, stats, decided)
+	case *Subquery:
+		markHistogramStats(&e.Expr, stats, decided)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+func TestHistogramStatsOptimizer(t *testing.T) {
+	cases := []struct {
+		name     string
+		expr     string
+		expected string
+	}{
+		{
+			name:     "histogram_count of selector",
+			expr:     `histogram_count(metric)`,
+			expected: `histogram_count(histogram_stats(metric))`,
+		},
+		{
+			name:     "histogram_sum of rate",
+			expr:     `histogram_sum(sum by (pod) (rate(metric[5m])))`,
+			expected: `histogram_sum(sum by (pod) (rate(histogram_stats(metric)[5m])))`,
+		},
+		{
+			name:     "histogram_quantile",
+			expr:     `histogram_quantile(0.9, rate(metric[5m]))`,
+			expected: `histogram_quantile(0.9, rate(metric[5m]))`,
+		},
+		{
+			name:     "same selector with and without buckets",
+			expr:     `histogram_count(metric) / histogram_fraction(0, 1, metric)`,
+			expected: `histogram_count(histogram_stats(metric)) / histogram_fraction(0, 1, metric)`,
+		},
+		{
+			name:     "filtered selector",
+			expr:     `histogram_count(metric{a="b", c="d"}) / histogram_count(metric{a="b"})`,
+			expected: `histogram_count(histogram_stats(filter([c="d"], metric{a="b"}))) / histogram_count(histogram_stats(metric{a="b"}))`,
+		},
+	}
+
+	optimizers := []Optimizer{MergeSelectsOptimizer{}, HistogramStatsOptimizer{}}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			plan := New(expr, &Opts{Start: time.Unix(0, 0), End: time.Unix(0, 0)})
+			optimizedPlan := plan.Optimize(optimizers)
+			testutil.Equals(t, tcase.expected, optimizedPlan.Root().String())
+		})
+	}
+}
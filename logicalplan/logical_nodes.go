@@ -0,0 +1,354 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+// Node is a node of the logical plan. Plans are lowered from the syntax tree of a query,
+// rewritten by optimizers and finally turned into operators by the physical planner.
+type Node interface {
+	// String returns the node as a PromQL expression. Nodes which are
+	// added by optimizers are printed as a description of the node.
+	String() string
+	// ReturnType returns the type of the values which the node evaluates to.
+	ReturnType() parser.ValueType
+	// Children returns pointers to the children of the node, so that they can be replaced.
+	Children() []*Node
+}
+
+// VectorSelector selects the latest sample of each series matching its matchers.
+type VectorSelector struct {
+	Name          string
+	LabelMatchers []*labels.Matcher
+
+	// Offset is the offset used during evaluation, which includes the difference
+	// between the start of the query and the timestamp of the @ modifier.
+	Offset         time.Duration
+	OriginalOffset time.Duration
+	// Timestamp is the timestamp of the @ modifier in milliseconds, if it is set.
+	Timestamp  *int64
+	StartOrEnd parser.ItemType
+}
+
+func (v *VectorSelector) String() string {
+	return v.selectorString("")
+}
+
+// selectorString returns the selector with the range of a matrix selector, which is
+// printed between the matchers and the modifiers of the selector.
+func (v *VectorSelector) selectorString(rangeStr string) string {
+	var labelStrings []string
+	if len(v.LabelMatchers) > 1 {
+		labelStrings = make([]string, 0, len(v.LabelMatchers)-1)
+	}
+	for _, matcher := range v.LabelMatchers {
+		if matcher.Name == labels.MetricName && matcher.Type == labels.MatchEqual && matcher.Value == v.Name {
+			continue
+		}
+		labelStrings = append(labelStrings, matcher.String())
+	}
+	modifiers := rangeStr + atString(v.Timestamp, v.StartOrEnd) + offsetString(v.OriginalOffset)
+
+	if len(labelStrings) == 0 {
+		return v.Name + modifiers
+	}
+	sort.Strings(labelStrings)
+	return fmt.Sprintf("%s{%s}%s", v.Name, strings.Join(labelStrings, ","), modifiers)
+}
+
+func (v *VectorSelector) ReturnType() parser.ValueType { return parser.ValueTypeVector }
+
+func (v *VectorSelector) Children() []*Node { return nil }
+
+// MatrixSelector selects the samples in a range of each series matching its selector,
+// which is either a VectorSelector or a FilteredSelector.
+type MatrixSelector struct {
+	VectorSelector Node
+	Range          time.Duration
+}
+
+func (m *MatrixSelector) String() string {
+	rangeStr := fmt.Sprintf("[%s]", model.Duration(m.Range))
+	if vs, ok := m.VectorSelector.(*VectorSelector); ok {
+		return vs.selectorString(rangeStr)
+	}
+	return m.VectorSelector.String() + rangeStr
+}
+
+func (m *MatrixSelector) ReturnType() parser.ValueType { return parser.ValueTypeMatrix }
+
+func (m *MatrixSelector) Children() []*Node { return []*Node{&m.VectorSelector} }
+
+// Aggregation aggregates the series of its expression.
+type Aggregation struct {
+	Op       parser.ItemType
+	Expr     Node
+	Param    Node
+	Grouping []string
+	Without  bool
+}
+
+func (a *Aggregation) String() string {
+	s := a.Op.String()
+	switch {
+	case a.Without:
+		s += fmt.Sprintf(" without (%s) ", strings.Join(a.Grouping, ", "))
+	case len(a.Grouping) > 0:
+		s += fmt.Sprintf(" by (%s) ", strings.Join(a.Grouping, ", "))
+	}
+	if a.Op.IsAggregatorWithParam() {
+		return fmt.Sprintf("%s(%s, %s)", s, a.Param, a.Expr)
+	}
+	return fmt.Sprintf("%s(%s)", s, a.Expr)
+}
+
+func (a *Aggregation) ReturnType() parser.ValueType { return parser.ValueTypeVector }
+
+func (a *Aggregation) Children() []*Node {
+	if a.Param == nil {
+		return []*Node{&a.Expr}
+	}
+	return []*Node{&a.Expr, &a.Param}
+}
+
+// Binary is a binary operation between two scalars or vectors.
+type Binary struct {
+	Op  parser.ItemType
+	LHS Node
+	RHS Node
+	// VectorMatching is nil for operations with a scalar operand.
+	VectorMatching *parser.VectorMatching
+	ReturnBool     bool
+}
+
+func (b *Binary) String() string {
+	returnBool := ""
+	if b.ReturnBool {
+		returnBool = " bool"
+	}
+	return fmt.Sprintf("%s %s%s%s %s", b.LHS, b.Op, returnBool, matchingString(b.VectorMatching), b.RHS)
+}
+
+func matchingString(vm *parser.VectorMatching) string {
+	if vm == nil || (len(vm.MatchingLabels) == 0 && !vm.On) {
+		return ""
+	}
+	tag := "ignoring"
+	if vm.On {
+		tag = "on"
+	}
+	matching := fmt.Sprintf(" %s (%s)", tag, strings.Join(vm.MatchingLabels, ", "))
+	if vm.Card == parser.CardManyToOne || vm.Card == parser.CardOneToMany {
+		side := "right"
+		if vm.Card == parser.CardManyToOne {
+			side = "left"
+		}
+		matching += fmt.Sprintf(" group_%s (%s)", side, strings.Join(vm.Include, ", "))
+	}
+	return matching
+}
+
+func (b *Binary) ReturnType() parser.ValueType {
+	if b.LHS.ReturnType() == parser.ValueTypeScalar && b.RHS.ReturnType() == parser.ValueTypeScalar {
+		return parser.ValueTypeScalar
+	}
+	return parser.ValueTypeVector
+}
+
+func (b *Binary) Children() []*Node { return []*Node{&b.LHS, &b.RHS} }
+
+// FunctionCall is a call of a PromQL function.
+type FunctionCall struct {
+	Func *parser.Function
+	Args []Node
+}
+
+func (f *FunctionCall) String() string {
+	args := make([]string, len(f.Args))
+	for i, arg := range f.Args {
+		args[i] = arg.String()
+	}
+	return fmt.Sprintf("%s(%s)", f.Func.Name, strings.Join(args, ", "))
+}
+
+func (f *FunctionCall) ReturnType() parser.ValueType { return f.Func.ReturnType }
+
+func (f *FunctionCall) Children() []*Node {
+	children := make([]*Node, len(f.Args))
+	for i := range f.Args {
+		children[i] = &f.Args[i]
+	}
+	return children
+}
+
+// NumberLiteral is a constant scalar.
+type NumberLiteral struct {
+	Val float64
+}
+
+func (n *NumberLiteral) String() string { return fmt.Sprint(n.Val) }
+
+func (n *NumberLiteral) ReturnType() parser.ValueType { return parser.ValueTypeScalar }
+
+func (n *NumberLiteral) Children() []*Node { return nil }
+
+// StringLiteral is a constant string.
+type StringLiteral struct {
+	Val string
+}
+
+func (s *StringLiteral) String() string { return fmt.Sprintf("%q", s.Val) }
+
+func (s *StringLiteral) ReturnType() parser.ValueType { return parser.ValueTypeString }
+
+func (s *StringLiteral) Children() []*Node { return nil }
+
+// Subquery evaluates its expression at each step of a range.
+type Subquery struct {
+	Expr  Node
+	Range time.Duration
+	// Offset is the offset used during evaluation, which includes the difference
+	// between the start of the query and the timestamp of the @ modifier.
+	Offset         time.Duration
+	OriginalOffset time.Duration
+	// Timestamp is the timestamp of the @ modifier in milliseconds, if it is set.
+	Timestamp  *int64
+	StartOrEnd parser.ItemType
+	Step       time.Duration
+}
+
+func (s *Subquery) String() string {
+	step := ""
+	if s.Step != 0 {
+		step = model.Duration(s.Step).String()
+	}
+	return fmt.Sprintf("%s[%s:%s]%s%s", s.Expr, model.Duration(s.Range), step, atString(s.Timestamp, s.StartOrEnd), offsetString(s.OriginalOffset))
+}
+
+func (s *Subquery) ReturnType() parser.ValueType { return parser.ValueTypeMatrix }
+
+func (s *Subquery) Children() []*Node { return []*Node{&s.Expr} }
+
+// StepInvariantExpr is an expression whose value is the same at every step,
+// so that it only needs to be evaluated once.
+type StepInvariantExpr struct {
+	Expr Node
+}
+
+func (s *StepInvariantExpr) String() string { return s.Expr.String() }
+
+func (s *StepInvariantExpr) ReturnType() parser.ValueType { return s.Expr.ReturnType() }
+
+func (s *StepInvariantExpr) Children() []*Node { return []*Node{&s.Expr} }
+
+// Parens is an expression in parentheses.
+type Parens struct {
+	Expr Node
+}
+
+func (p *Parens) String() string { return fmt.Sprintf("(%s)", p.Expr) }
+
+func (p *Parens) ReturnType() parser.ValueType { return p.Expr.ReturnType() }
+
+func (p *Parens) Children() []*Node { return []*Node{&p.Expr} }
+
+// Unary is a unary operation on a scalar or vector.
+type Unary struct {
+	Op   parser.ItemType
+	Expr Node
+}
+
+func (u *Unary) String() string { return fmt.Sprintf("%s%s", u.Op, u.Expr) }
+
+func (u *Unary) ReturnType() parser.ValueType { return u.Expr.ReturnType() }
+
+func (u *Unary) Children() []*Node { return []*Node{&u.Expr} }
+
+func atString(ts *int64, startOrEnd parser.ItemType) string {
+	switch {
+	case ts != nil:
+		return fmt.Sprintf(" @ %.3f", float64(*ts)/1000.0)
+	case startOrEnd == parser.START:
+		return " @ start()"
+	case startOrEnd == parser.END:
+		return " @ end()"
+	default:
+		return ""
+	}
+}
+
+func offsetString(offset time.Duration) string {
+	switch {
+	case offset > 0:
+		return fmt.Sprintf(" offset %s", model.Duration(offset))
+	case offset < 0:
+		return fmt.Sprintf(" offset -%s", model.Duration(-offset))
+	default:
+		return ""
+	}
+}
+
+// lower converts the syntax tree of a query into a logical plan.
+func lower(expr parser.Expr) Node {
+	switch e := expr.(type) {
+	case *parser.VectorSelector:
+		// Optimizers modify the matchers of selectors, so they are copied from the syntax tree.
+		return &VectorSelector{
+			Name:           e.Name,
+			LabelMatchers:  append([]*labels.Matcher(nil), e.LabelMatchers...),
+			Offset:         e.Offset,
+			OriginalOffset: e.OriginalOffset,
+			Timestamp:      e.Timestamp,
+			StartOrEnd:     e.StartOrEnd,
+		}
+	case *parser.MatrixSelector:
+		return &MatrixSelector{VectorSelector: lower(e.VectorSelector), Range: e.Range}
+	case *parser.AggregateExpr:
+		aggr := &Aggregation{Op: e.Op, Expr: lower(e.Expr), Grouping: e.Grouping, Without: e.Without}
+		if e.Param != nil {
+			aggr.Param = lower(e.Param)
+		}
+		return aggr
+	case *parser.BinaryExpr:
+		return &Binary{Op: e.Op, LHS: lower(e.LHS), RHS: lower(e.RHS), VectorMatching: e.VectorMatching, ReturnBool: e.ReturnBool}
+	case *parser.Call:
+		args := make([]Node, len(e.Args))
+		for i := range e.Args {
+			args[i] = lower(e.Args[i])
+		}
+		return &FunctionCall{Func: e.Func, Args: args}
+	case *parser.NumberLiteral:
+		return &NumberLiteral{Val: e.Val}
+	case *parser.StringLiteral:
+		return &StringLiteral{Val: e.Val}
+	case *parser.SubqueryExpr:
+		return &Subquery{
+			Expr:           lower(e.Expr),
+			Range:          e.Range,
+			Offset:         e.Offset,
+			OriginalOffset: e.OriginalOffset,
+			Timestamp:      e.Timestamp,
+			StartOrEnd:     e.StartOrEnd,
+			Step:           e.Step,
+		}
+	case *parser.StepInvariantExpr:
+		return &StepInvariantExpr{Expr: lower(e.Expr)}
+	case *parser.ParenExpr:
+		return &Parens{Expr: lower(e.Expr)}
+	case *parser.UnaryExpr:
+		return &Unary{Op: e.Op, Expr: lower(e.Expr)}
+	}
+
+	panic(fmt.Sprintf("found unexpected node %#v", expr))
+}
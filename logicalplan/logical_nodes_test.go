@@ -0,0 +1,48 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+func TestLowering(t *testing.T) {
+	cases := []string{
+		`metric{a="b", c=~"d.*"}`,
+		`rate(metric[5m] offset 1h)`,
+		`sum by (a) (metric @ 100.000)`,
+		`topk(3, -metric)`,
+		`count_values("value", metric)`,
+		`a / on (b) group_left (c) b`,
+		`1 + 2 * (3 > bool 2)`,
+		`max_over_time(rate(metric[1m])[10m:1m] offset -5m)`,
+		`label_replace(metric, "dst", "$1", "src", "(.*)")`,
+	}
+	for _, query := range cases {
+		t.Run(query, func(t *testing.T) {
+			expr, err := parser.ParseExpr(query)
+			testutil.Ok(t, err)
+
+			testutil.Equals(t, expr.String(), lower(expr).String())
+			testutil.Equals(t, expr.Type(), lower(expr).ReturnType())
+		})
+	}
+}
+
+func TestPlanDoesNotModifySyntaxTree(t *testing.T) {
+	expr, err := parser.ParseExpr(`metric{c="d", a="b"} @ start() / metric{a="b"}`)
+	testutil.Ok(t, err)
+	original := parser.Tree(expr)
+
+	start := time.Unix(1000, 0)
+	plan := New(expr, &Opts{Start: start, End: start}).Optimize(AllOptimizers)
+
+	testutil.Equals(t, original, parser.Tree(expr))
+	testutil.Equals(t, `filter([c="d"], metric{a="b"} @ 1000.000) / metric{a="b"}`, plan.Root().String())
+}
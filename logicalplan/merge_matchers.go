@@ -0,0 +1,101 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// MergeMatchersOptimizer merges the matchers of a selector which apply to the same label.
+// Matchers which are implied by an equality matcher on the same label are dropped,
+// so that the expression:
+//
+//	metric{a="b", a=~"b|c"} becomes:
+//	metric{a="b"}.
+//
+// Selectors whose matchers contradict each other, like metric{a="b", a="c"},
+// cannot select any series and are marked as empty, so that they do not query storage.
+type MergeMatchersOptimizer struct{}
+
+func (m MergeMatchersOptimizer) Optimize(expr Node, _ *Opts) Node {
+	traverse(&expr, func(node *Node) {
+		switch e := (*node).(type) {
+		case *VectorSelector:
+			matchers, ok := mergeMatchers(e.LabelMatchers)
+			if !ok {
+				*node = &FilteredSelector{VectorSelector: e, Empty: true}
+				return
+			}
+			e.LabelMatchers = matchers
+		case *FilteredSelector:
+			mergeFilteredSelector(e)
+		}
+	})
+	return expr
+}
+
+// mergeFilteredSelector merges the matchers and filters of a filtered selector. Since the selector
+// can be shared with other filtered selectors, filters are never merged into its matchers.
+func mergeFilteredSelector(e *FilteredSelector) {
+	matchers, ok := mergeMatchers(e.LabelMatchers)
+	if !ok {
+		e.Empty = true
+		return
+	}
+	e.LabelMatchers = matchers
+
+	merged, ok := mergeMatchers(append(append([]*labels.Matcher{}, matchers...), e.Filters...))
+	if !ok {
+		e.Empty = true
+		return
+	}
+	selected := make(map[*labels.Matcher]struct{}, len(matchers))
+	for _, m := range matchers {
+		selected[m] = struct{}{}
+	}
+	var filters []*labels.Matcher
+	for _, m := range merged {
+		if _, ok := selected[m]; !ok {
+			filters = append(filters, m)
+		}
+	}
+	e.Filters = filters
+}
+
+// mergeMatchers drops the matchers which are implied by an equality matcher on the same label.
+// The returned bool is false if the matchers contradict each other and cannot match any series.
+func mergeMatchers(matchers []*labels.Matcher) ([]*labels.Matcher, bool) {
+	equal := make(map[string]*labels.Matcher)
+	for _, m := range matchers {
+		if m.Type != labels.MatchEqual {
+			continue
+		}
+		if eq, ok := equal[m.Name]; ok {
+			if eq.Value != m.Value {
+				return nil, false
+			}
+			continue
+		}
+		equal[m.Name] = m
+	}
+	if len(equal) == 0 {
+		return matchers, true
+	}
+
+	merged := make([]*labels.Matcher, 0, len(matchers))
+	for _, m := range matchers {
+		eq, ok := equal[m.Name]
+		if !ok {
+			merged = append(merged, m)
+			continue
+		}
+		if !m.Matches(eq.Value) {
+			return nil, false
+		}
+		if m == eq {
+			merged = append(merged, m)
+		}
+	}
+	return merged, true
+}
@@ -0,0 +1,100 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+func TestMergeMatchersOptimizer(t *testing.T) {
+	cases := []struct {
+		name     string
+		expr     string
+		expected string
+	}{
+		{
+			name:     "implied regex matcher",
+			expr:     `metric{a="b", a=~"b|c"}`,
+			expected: `metric{a="b"}`,
+		},
+		{
+			name:     "duplicate equality matchers",
+			expr:     `sum(metric{a="b", c="d", a="b"})`,
+			expected: `sum(metric{a="b",c="d"})`,
+		},
+		{
+			name:     "regex matchers without equality",
+			expr:     `metric{a=~"b|c", a!="c"}`,
+			expected: `metric{a!="c",a=~"b|c"}`,
+		},
+		{
+			name:     "contradicting equality matchers",
+			expr:     `metric{a="b", a="c"}`,
+			expected: `empty(metric{a="b",a="c"})`,
+		},
+		{
+			name:     "contradicting regex matcher",
+			expr:     `rate(metric{a="b", a!~"b|c"}[5m])`,
+			expected: `rate(empty(metric{a!~"b|c",a="b"})[5m])`,
+		},
+		{
+			name:     "contradiction in function argument",
+			expr:     `absent(metric{a="", a!=""})`,
+			expected: `absent(empty(metric{a!="",a=""}))`,
+		},
+		{
+			name:     "contradicting metric names",
+			expr:     `{__name__="foo", __name__="bar"}`,
+			expected: `empty({__name__="bar",__name__="foo"})`,
+		},
+	}
+
+	optimizers := []Optimizer{SortMatchers{}, MergeMatchersOptimizer{}}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			plan := New(expr, &Opts{Start: time.Unix(0, 0), End: time.Unix(0, 0)})
+			optimizedPlan := plan.Optimize(optimizers)
+			testutil.Equals(t, tcase.expected, optimizedPlan.Root().String())
+		})
+	}
+}
+
+func TestMergeMatchersOfFilteredSelectors(t *testing.T) {
+	cases := []struct {
+		name     string
+		expr     string
+		expected string
+	}{
+		{
+			name:     "filter implied by selector",
+			expr:     `metric{a="b", c="d", c=~"d|e"} / scalar(metric{a="b"})`,
+			expected: `filter([c="d"], metric{a="b"}) / scalar(metric{a="b"})`,
+		},
+		{
+			name:     "filter contradicting another filter",
+			expr:     `metric{a="b", c="d", c="e"} / scalar(metric{a="b"})`,
+			expected: `empty(filter([c="d" c="e"], metric{a="b"})) / scalar(metric{a="b"})`,
+		},
+	}
+
+	optimizers := []Optimizer{SortMatchers{}, MergeSelectsOptimizer{}, MergeMatchersOptimizer{}}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			plan := New(expr, &Opts{Start: time.Unix(0, 0), End: time.Unix(0, 0)})
+			optimizedPlan := plan.Optimize(optimizers)
+			testutil.Equals(t, tcase.expected, optimizedPlan.Root().String())
+		})
+	}
+}
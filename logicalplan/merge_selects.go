@@ -5,8 +5,6 @@ package logicalplan
 
 import (
 	"github.com/prometheus/prometheus/model/labels"
-
-	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
 )
 
 // MergeSelectsOptimizer optimizes a binary expression where
@@ -20,7 +18,7 @@ import (
 // and apply an additional filter for {c="d"}.
 type MergeSelectsOptimizer struct{}
 
-func (m MergeSelectsOptimizer) Optimize(expr parser.Expr, _ *Opts) parser.Expr {
+func (m MergeSelectsOptimizer) Optimize(expr Node, _ *Opts) Node {
 	heap := make(matcherHeap)
 	extractSelectors(heap, expr)
 	replaceMatchers(heap, &expr)
@@ -28,24 +26,23 @@ func (m MergeSelectsOptimizer) Optimize(expr parser.Expr, _ *Opts) parser.Expr {
 	return expr
 }
 
-func extractSelectors(selectors matcherHeap, expr parser.Expr) {
-	parser.Inspect(expr, func(node parser.Node, nodes []parser.Node) error {
-		e, ok := node.(*parser.VectorSelector)
+func extractSelectors(selectors matcherHeap, expr Node) {
+	inspect(expr, nil, func(node Node, _ []Node) {
+		e, ok := node.(*VectorSelector)
 		if !ok {
-			return nil
+			return
 		}
 		for _, l := range e.LabelMatchers {
 			if l.Name == labels.MetricName {
 				selectors.add(l.Value, e.LabelMatchers)
 			}
 		}
-		return nil
 	})
 }
 
-func replaceMatchers(selectors matcherHeap, expr *parser.Expr) {
-	traverse(expr, func(node *parser.Expr) {
-		e, ok := (*node).(*parser.VectorSelector)
+func replaceMatchers(selectors matcherHeap, expr *Node) {
+	traverse(expr, func(node *Node) {
+		e, ok := (*node).(*VectorSelector)
 		if !ok {
 			return
 		}
@@ -15,7 +15,7 @@ import (
 
 var (
 	NoOptimizers  = []Optimizer{}
-	AllOptimizers = append(DefaultOptimizers, PropagateMatchersOptimizer{})
+	AllOptimizers = append(DefaultOptimizers, SimplifyRegexOptimizer{}, ConstantFoldingOptimizer{}, PropagateMatchersOptimizer{}, MergeMatchersOptimizer{}, ComparisonPushdownOptimizer{}, ProjectionOptimizer{}, HistogramStatsOptimizer{}, CommonSubexpressionOptimizer{})
 )
 
 var DefaultOptimizers = []Optimizer{
@@ -28,24 +28,30 @@ type Opts struct {
 	End           time.Time
 	Step          time.Duration
 	LookbackDelta time.Duration
+	// ExtLookbackDelta is the additional range selected by the arguments of x-functions.
+	ExtLookbackDelta time.Duration
 }
 
 type Plan interface {
 	Optimize([]Optimizer) Plan
-	Expr() parser.Expr
+	// Root returns the root node of the logical plan.
+	Root() Node
+	// SelectorRanges returns the effective time range of each selector in the plan.
+	SelectorRanges() []SelectorRange
 }
 
 type Optimizer interface {
-	Optimize(expr parser.Expr, opts *Opts) parser.Expr
+	Optimize(plan Node, opts *Opts) Node
 }
 
 type plan struct {
-	expr parser.Expr
+	expr Node
 	opts *Opts
 }
 
-func New(expr parser.Expr, opts *Opts) Plan {
-	expr = preprocessExpr(expr, opts.Start, opts.End)
+// New lowers the syntax tree of a query into a logical plan. The syntax tree is not modified.
+func New(ast parser.Expr, opts *Opts) Plan {
+	expr := preprocessExpr(lower(ast), opts.Start, opts.End)
 	setOffsetForAtModifier(opts.Start.UnixMilli(), expr)
 
 	return &plan{
@@ -62,73 +68,96 @@ func (p *plan) Optimize(optimizers []Optimizer) Plan {
 	return &plan{expr: p.expr, opts: p.opts}
 }
 
-func (p *plan) Expr() parser.Expr {
+func (p *plan) Root() Node {
 	return p.expr
 }
 
-func traverse(expr *parser.Expr, transform func(*parser.Expr)) {
+func (p *plan) SelectorRanges() []SelectorRange {
+	return SelectorRanges(p.expr, p.opts)
+}
+
+// inspect calls f for each node of the plan in depth-first order, together with the path of its ancestors.
+func inspect(node Node, path []Node, f func(Node, []Node)) {
+	f(node, path)
+	path = append(path, node)
+	for _, child := range node.Children() {
+		inspect(*child, path, f)
+	}
+}
+
+func traverse(expr *Node, transform func(*Node)) {
 	switch node := (*expr).(type) {
-	case *parser.StepInvariantExpr:
+	case *StepInvariantExpr:
 		transform(&node.Expr)
-	case *parser.VectorSelector:
+	case *VectorSelector, *FilteredSelector:
 		transform(expr)
-	case *parser.MatrixSelector:
+	case *MatrixSelector:
 		transform(&node.VectorSelector)
-	case *parser.AggregateExpr:
+	case *Aggregation:
 		transform(expr)
 		traverse(&node.Expr, transform)
-	case *parser.Call:
-		for _, n := range node.Args {
-			traverse(&n, transform)
+	case *FunctionCall:
+		for i := range node.Args {
+			traverse(&node.Args[i], transform)
 		}
-	case *parser.BinaryExpr:
+	case *Binary:
 		transform(expr)
 		traverse(&node.LHS, transform)
 		traverse(&node.RHS, transform)
-	case *parser.UnaryExpr:
+	case *Unary:
+		traverse(&node.Expr, transform)
+	case *Parens:
 		traverse(&node.Expr, transform)
-	case *parser.ParenExpr:
+	case *Subquery:
 		traverse(&node.Expr, transform)
-	case *parser.SubqueryExpr:
+	case *SharedExpr:
 		traverse(&node.Expr, transform)
 	}
 }
 
-func traverseBottomUp(parent *parser.Expr, current *parser.Expr, transform func(parent *parser.Expr, node *parser.Expr) bool) bool {
+func traverseBottomUp(parent *Node, current *Node, transform func(parent *Node, node *Node) bool) bool {
 	switch node := (*current).(type) {
-	case *parser.NumberLiteral:
+	case *NumberLiteral:
 		return false
-	case *parser.StepInvariantExpr:
+	case *StepInvariantExpr:
 		return traverseBottomUp(current, &node.Expr, transform)
-	case *parser.VectorSelector:
+	case *VectorSelector:
 		return transform(parent, current)
-	case *parser.MatrixSelector:
+	case *MatrixSelector:
 		return transform(parent, &node.VectorSelector)
-	case *parser.AggregateExpr:
+	case *Aggregation:
 		if stop := traverseBottomUp(current, &node.Expr, transform); stop {
 			return stop
 		}
 		return transform(parent, current)
-	case *parser.Call:
+	case *FunctionCall:
 		for i := range node.Args {
 			if stop := traverseBottomUp(current, &node.Args[i], transform); stop {
 				return stop
 			}
 		}
 		return transform(parent, current)
-	case *parser.BinaryExpr:
+	case *Binary:
 		lstop := traverseBottomUp(current, &node.LHS, transform)
 		rstop := traverseBottomUp(current, &node.RHS, transform)
 		if lstop || rstop {
 			return true
 		}
 		return transform(parent, current)
-	case *parser.UnaryExpr:
+	case *Unary:
 		return traverseBottomUp(current, &node.Expr, transform)
-	case *parser.ParenExpr:
-		return traverseBottomUp(current, &node.Expr, transform)
-	case *parser.SubqueryExpr:
+	case *Parens:
 		return traverseBottomUp(current, &node.Expr, transform)
+	case *Subquery:
+		if stop := traverseBottomUp(current, &node.Expr, transform); stop {
+			return stop
+		}
+		return transform(parent, current)
+	case *SharedExpr:
+		// A shared expression is reached once for each of its occurrences. Its children are
+		// transformed in place, but the traversal stops since the occurrences cannot be moved apart.
+		traverseBottomUp(current, &node.Expr, transform)
+		return true
 	}
 
 	return true
@@ -136,9 +165,9 @@ func traverseBottomUp(parent *parser.Expr, current *parser.Expr, transform func(
 
 // preprocessExpr wraps all possible step invariant parts of the given expression with
 // StepInvariantExpr. It also resolves the preprocessors.
-// Copied from Prometheus and adjusted to work with the vendored parser:
+// Copied from Prometheus and adjusted to work with logical plan nodes:
 // https://github.com/prometheus/prometheus/blob/3ac49d4ae210869043e6c33e3a82f13f2f849361/promql/engine.go#L2676-L2684
-func preprocessExpr(expr parser.Expr, start, end time.Time) parser.Expr {
+func preprocessExpr(expr Node, start, end time.Time) Node {
 	isStepInvariant := preprocessExprHelper(expr, start, end)
 	if isStepInvariant {
 		return newStepInvariantExpr(expr)
@@ -150,9 +179,9 @@ func preprocessExpr(expr parser.Expr, start, end time.Time) parser.Expr {
 // with a StepInvariantExpr wherever it's step invariant. The returned boolean is true if the
 // passed expression qualifies to be wrapped by StepInvariantExpr.
 // It also resolves the preprocessors.
-func preprocessExprHelper(expr parser.Expr, start, end time.Time) bool {
+func preprocessExprHelper(expr Node, start, end time.Time) bool {
 	switch n := expr.(type) {
-	case *parser.VectorSelector:
+	case *VectorSelector:
 		if n.StartOrEnd == parser.START {
 			n.Timestamp = makeInt64Pointer(timestamp.FromTime(start))
 		} else if n.StartOrEnd == parser.END {
@@ -160,10 +189,10 @@ func preprocessExprHelper(expr parser.Expr, start, end time.Time) bool {
 		}
 		return n.Timestamp != nil
 
-	case *parser.AggregateExpr:
+	case *Aggregation:
 		return preprocessExprHelper(n.Expr, start, end)
 
-	case *parser.BinaryExpr:
+	case *Binary:
 		isInvariant1, isInvariant2 := preprocessExprHelper(n.LHS, start, end), preprocessExprHelper(n.RHS, start, end)
 		if isInvariant1 && isInvariant2 {
 			return true
@@ -178,7 +207,7 @@ func preprocessExprHelper(expr parser.Expr, start, end time.Time) bool {
 
 		return false
 
-	case *parser.Call:
+	case *FunctionCall:
 		_, ok := promql.AtModifierUnsafeFunctions[n.Func.Name]
 		isStepInvariant := !ok
 		isStepInvariantSlice := make([]bool, len(n.Args))
@@ -199,10 +228,10 @@ func preprocessExprHelper(expr parser.Expr, start, end time.Time) bool {
 		}
 		return false
 
-	case *parser.MatrixSelector:
+	case *MatrixSelector:
 		return preprocessExprHelper(n.VectorSelector, start, end)
 
-	case *parser.SubqueryExpr:
+	case *Subquery:
 		// Since we adjust offset for the @ modifier evaluation,
 		// it gets tricky to adjust it for every subquery step.
 		// Hence we wrap the inside of subquery irrespective of
@@ -219,15 +248,15 @@ func preprocessExprHelper(expr parser.Expr, start, end time.Time) bool {
 		}
 		return n.Timestamp != nil
 
-	case *parser.ParenExpr:
+	case *Parens:
 		return preprocessExprHelper(n.Expr, start, end)
 
-	case *parser.UnaryExpr:
+	case *Unary:
 		return preprocessExprHelper(n.Expr, start, end)
 
-	case *parser.NumberLiteral:
+	case *NumberLiteral:
 		return true
-	case *parser.StringLiteral:
+	case *StringLiteral:
 		// strings should be used as fixed strings; no need
 		// to wrap under stepInvariantExpr
 		return false
@@ -242,13 +271,13 @@ func makeInt64Pointer(val int64) *int64 {
 	return valp
 }
 
-func newStepInvariantExpr(expr parser.Expr) parser.Expr {
-	return &parser.StepInvariantExpr{Expr: expr}
+func newStepInvariantExpr(expr Node) Node {
+	return &StepInvariantExpr{Expr: expr}
 }
 
 // Copy from https://github.com/prometheus/prometheus/blob/v2.39.1/promql/engine.go#L2658.
-func setOffsetForAtModifier(evalTime int64, expr parser.Expr) {
-	getOffset := func(ts *int64, originalOffset time.Duration, path []parser.Node) time.Duration {
+func setOffsetForAtModifier(evalTime int64, expr Node) {
+	getOffset := func(ts *int64, originalOffset time.Duration, path []Node) time.Duration {
 		if ts == nil {
 			return originalOffset
 		}
@@ -259,18 +288,13 @@ func setOffsetForAtModifier(evalTime int64, expr parser.Expr) {
 		return originalOffset + offsetDiff
 	}
 
-	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+	inspect(expr, nil, func(node Node, path []Node) {
 		switch n := node.(type) {
-		case *parser.VectorSelector:
+		case *VectorSelector:
 			n.Offset = getOffset(n.Timestamp, n.OriginalOffset, path)
 
-		case *parser.MatrixSelector:
-			vs := n.VectorSelector.(*parser.VectorSelector)
-			vs.Offset = getOffset(vs.Timestamp, vs.OriginalOffset, path)
-
-		case *parser.SubqueryExpr:
+		case *Subquery:
 			n.Offset = getOffset(n.Timestamp, n.OriginalOffset, path)
 		}
-		return nil
 	})
 }
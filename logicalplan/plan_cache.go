@@ -0,0 +1,119 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+// PlanCacheKey identifies the plans which can be shared between queries.
+type PlanCacheKey struct {
+	// Query is the query string which the plan was parsed from.
+	Query string
+	// Range is true for plans of range queries and false for plans of instant queries.
+	Range         bool
+	LookbackDelta time.Duration
+}
+
+// CachedPlan is an optimized plan together with the syntax tree it was lowered from.
+type CachedPlan struct {
+	Expr parser.Expr
+	root Node
+}
+
+// Plan returns the cached plan for a query with the given options. Plans are shared
+// between queries, so the returned plan must not be optimized again by optimizers
+// which modify its nodes.
+func (c *CachedPlan) Plan(opts *Opts) Plan {
+	return &plan{expr: c.root, opts: opts}
+}
+
+// PlanCache caches optimized plans across queries, so that queries which are repeated
+// with different time ranges, such as the ones of dashboards, are only parsed and optimized once.
+// Plans are evicted in least-recently-used order once the cache holds more than its size.
+// Only plans which do not depend on the time range of queries are cached, which excludes
+// queries with @ modifiers. Optimizers of plans which are cached must not depend on it either.
+type PlanCache struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[PlanCacheKey]*list.Element
+	lru     *list.List
+}
+
+type planCacheEntry struct {
+	key  PlanCacheKey
+	plan *CachedPlan
+}
+
+// NewPlanCache creates a PlanCache which holds at most size plans.
+func NewPlanCache(size int) *PlanCache {
+	return &PlanCache{
+		size:    size,
+		entries: make(map[PlanCacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Get returns the cached plan for the key, if there is one.
+func (c *PlanCache) Get(key PlanCacheKey) (*CachedPlan, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*planCacheEntry).plan, true
+}
+
+// Add caches the optimized plan p which was lowered from expr. Plans which depend on the
+// time range of the query are not cached.
+func (c *PlanCache) Add(key PlanCacheKey, expr parser.Expr, p Plan) {
+	if c.size <= 0 || dependsOnTimeRange(expr) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&planCacheEntry{key: key, plan: &CachedPlan{Expr: expr, root: p.Root()}})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*planCacheEntry).key)
+	}
+}
+
+// Len returns the number of plans held by the cache.
+func (c *PlanCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+// dependsOnTimeRange returns true if the expression has @ modifiers, which are
+// resolved against the start and end of the query when it is planned.
+func dependsOnTimeRange(expr parser.Expr) bool {
+	var found bool
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			found = found || n.Timestamp != nil || n.StartOrEnd != 0
+		case *parser.SubqueryExpr:
+			found = found || n.Timestamp != nil || n.StartOrEnd != 0
+		}
+		return nil
+	})
+	return found
+}
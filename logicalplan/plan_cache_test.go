@@ -0,0 +1,56 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+func TestPlanCache(t *testing.T) {
+	cache := NewPlanCache(2)
+	add := func(query string) PlanCacheKey {
+		expr, err := parser.ParseExpr(query)
+		testutil.Ok(t, err)
+
+		key := PlanCacheKey{Query: query, Range: true, LookbackDelta: 5 * time.Minute}
+		cache.Add(key, expr, New(expr, &Opts{Start: time.Unix(0, 0), End: time.Unix(600, 0)}).Optimize(DefaultOptimizers))
+		return key
+	}
+
+	first := add(`sum(metric_a)`)
+	second := add(`sum(metric_b)`)
+	testutil.Equals(t, 2, cache.Len())
+
+	// Queries with @ modifiers are not cached since their plans depend on the time range.
+	atModifier := add(`metric_a @ start()`)
+	_, ok := cache.Get(atModifier)
+	testutil.Assert(t, !ok, "plans with @ modifiers should not be cached")
+	testutil.Equals(t, 2, cache.Len())
+
+	// The first plan becomes the most recently used one, so the second one is evicted.
+	_, ok = cache.Get(first)
+	testutil.Assert(t, ok)
+	third := add(`sum(metric_c)`)
+	testutil.Equals(t, 2, cache.Len())
+	_, ok = cache.Get(second)
+	testutil.Assert(t, !ok, "least recently used plan should be evicted")
+
+	cached, ok := cache.Get(third)
+	testutil.Assert(t, ok)
+	testutil.Equals(t, `sum(metric_c)`, cached.Expr.String())
+
+	opts := &Opts{Start: time.Unix(1200, 0), End: time.Unix(1800, 0), LookbackDelta: 5 * time.Minute}
+	plan := cached.Plan(opts)
+	testutil.Equals(t, `sum(metric_c)`, plan.Root().String())
+	testutil.Equals(t, int64(900_000), plan.SelectorRanges()[0].MinT)
+
+	// Instant queries do not share plans with range queries.
+	_, ok = cache.Get(PlanCacheKey{Query: third.Query, LookbackDelta: third.LookbackDelta})
+	testutil.Assert(t, !ok)
+}
@@ -89,7 +89,7 @@ func TestDefaultOptimizers(t *testing.T) {
 			plan := New(expr, &Opts{Start: time.Unix(0, 0), End: time.Unix(0, 0)})
 			optimizedPlan := plan.Optimize(DefaultOptimizers)
 			expectedPlan := strings.Trim(spaces.ReplaceAllString(tcase.expected, " "), " ")
-			testutil.Equals(t, expectedPlan, optimizedPlan.Expr().String())
+			testutil.Equals(t, expectedPlan, optimizedPlan.Root().String())
 		})
 	}
 }
@@ -120,6 +120,31 @@ func TestMatcherPropagation(t *testing.T) {
 			expr:     `node_filesystem_files{host="$host", mountpoint="/"} - node_filesystem_files_free`,
 			expected: `node_filesystem_files{host="$host",mountpoint="/"} - node_filesystem_files_free{host="$host",mountpoint="/"}`,
 		},
+		{
+			name:     "common matchers keep metric names",
+			expr:     `foo{a="b"} - bar`,
+			expected: `foo{a="b"} - bar{a="b"}`,
+		},
+		{
+			name:     "matchers on labels in on",
+			expr:     `foo{job="x", env="prod"} / on (job) bar{instance="y"}`,
+			expected: `foo{env="prod",job="x"} / on (job) bar{instance="y",job="x"}`,
+		},
+		{
+			name:     "matchers on labels not in ignoring",
+			expr:     `foo{job="x", env="prod"} / ignoring (env) group_left bar{instance="y"}`,
+			expected: `foo{env="prod",instance="y",job="x"} / ignoring (env) group_left () bar{instance="y",job="x"}`,
+		},
+		{
+			name:     "matchers on the same label",
+			expr:     `foo{job=~"x|y"} + on (job) bar{job="y"}`,
+			expected: `foo{job="y",job=~"x|y"} + on (job) bar{job="y",job=~"x|y"}`,
+		},
+		{
+			name:     "set operation",
+			expr:     `foo{job="x"} or on (job) bar`,
+			expected: `foo{job="x"} or on (job) bar`,
+		},
 	}
 
 	optimizers := []Optimizer{PropagateMatchersOptimizer{}}
@@ -131,7 +156,7 @@ func TestMatcherPropagation(t *testing.T) {
 			plan := New(expr, &Opts{Start: time.Unix(0, 0), End: time.Unix(0, 0)})
 			optimizedPlan := plan.Optimize(optimizers)
 			expectedPlan := strings.Trim(spaces.ReplaceAllString(tcase.expected, " "), " ")
-			testutil.Equals(t, expectedPlan, optimizedPlan.Expr().String())
+			testutil.Equals(t, expectedPlan, optimizedPlan.Root().String())
 		})
 	}
 }
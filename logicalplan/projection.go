@@ -0,0 +1,81 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+// Projection is a set of labels which a selector needs to retain for
+// the rest of the query to produce a correct result.
+type Projection struct {
+	// Labels are the labels which are included or excluded by the projection.
+	Labels []string
+	// Include is true when only Labels are retained, and false when
+	// all labels except Labels and the metric name are retained.
+	Include bool
+}
+
+func (p Projection) String() string {
+	if p.Include {
+		return fmt.Sprintf("by (%s)", strings.Join(p.Labels, ", "))
+	}
+	return fmt.Sprintf("without (%s)", strings.Join(p.Labels, ", "))
+}
+
+// ProjectionOptimizer pushes the grouping labels of aggregations down to selectors
+// so that series only carry labels which are needed for computing the aggregation.
+// For example, the expression:
+//
+//	sum by (job) (rate(metric[5m])) becomes:
+//	sum by (job) (rate(project(by (job), metric)[5m])).
+//
+// Projections are only pushed through functions which do not depend on label values.
+type ProjectionOptimizer struct{}
+
+func (p ProjectionOptimizer) Optimize(expr Node, _ *Opts) Node {
+	traverse(&expr, func(node *Node) {
+		aggr, ok := (*node).(*Aggregation)
+		if !ok {
+			return
+		}
+		switch aggr.Op {
+		case parser.TOPK, parser.BOTTOMK, parser.COUNT_VALUES:
+			// These aggregations either return the original series or add new labels.
+			return
+		}
+
+		projection := &Projection{Labels: aggr.Grouping, Include: !aggr.Without}
+		projectSelectors(&aggr.Expr, projection)
+	})
+	return expr
+}
+
+func projectSelectors(expr *Node, projection *Projection) {
+	switch e := (*expr).(type) {
+	case *VectorSelector:
+		*expr = &FilteredSelector{VectorSelector: e, Projection: projection}
+	case *FilteredSelector:
+		e.Projection = projection
+	case *MatrixSelector:
+		projectSelectors(&e.VectorSelector, projection)
+	case *Parens:
+		projectSelectors(&e.Expr, projection)
+	case *Unary:
+		projectSelectors(&e.Expr, projection)
+	case *StepInvariantExpr:
+		projectSelectors(&e.Expr, projection)
+	case *FunctionCall:
+		switch e.Func.Name {
+		case "label_replace", "label_join", "histogram_quantile", "absent", "absent_over_time":
+			return
+		}
+		for i := range e.Args {
+			projectSelectors(&e.Args[i], projection)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+func TestProjectionOptimizer(t *testing.T) {
+	cases := []struct {
+		name     string
+		expr     string
+		expected string
+	}{
+		{
+			name:     "aggregation by",
+			expr:     `sum by (job) (metric)`,
+			expected: `sum by (job) (project(by (job), metric))`,
+		},
+		{
+			name:     "aggregation without",
+			expr:     `max without (pod, instance) (metric)`,
+			expected: `max without (pod, instance) (project(without (pod, instance), metric))`,
+		},
+		{
+			name:     "aggregation without grouping",
+			expr:     `count(metric)`,
+			expected: `count(project(by (), metric))`,
+		},
+		{
+			name:     "range function",
+			expr:     `sum by (job) (rate(metric[5m]))`,
+			expected: `sum by (job) (rate(project(by (job), metric)[5m]))`,
+		},
+		{
+			name:     "nested functions",
+			expr:     `sum by (job) (-abs(rate(metric[5m])))`,
+			expected: `sum by (job) (-abs(rate(project(by (job), metric)[5m])))`,
+		},
+		{
+			name:     "nested aggregations",
+			expr:     `sum by (job) (max by (job, pod) (metric))`,
+			expected: `sum by (job) (max by (job, pod) (project(by (job, pod), metric)))`,
+		},
+		{
+			name:     "label dependent functions",
+			expr:     `sum by (job) (label_replace(metric, "job", "$1", "pod", "(.*)"))`,
+			expected: `sum by (job) (label_replace(metric, "job", "$1", "pod", "(.*)"))`,
+		},
+		{
+			name:     "binary expressions",
+			expr:     `sum by (job) (metric_1 / metric_2)`,
+			expected: `sum by (job) (metric_1 / metric_2)`,
+		},
+		{
+			name:     "topk",
+			expr:     `topk by (job) (1, metric)`,
+			expected: `topk by (job) (1, metric)`,
+		},
+	}
+
+	optimizers := []Optimizer{ProjectionOptimizer{}}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			plan := New(expr, &Opts{Start: time.Unix(0, 0), End: time.Unix(0, 0)})
+			optimizedPlan := plan.Optimize(optimizers)
+			testutil.Equals(t, tcase.expected, optimizedPlan.Root().String())
+		})
+	}
+}
@@ -13,11 +13,17 @@ import (
 
 // PropagateMatchersOptimizer implements matcher propagation between
 // two vector selectors in a binary expression.
+// Series from both sides of a binary expression are only joined when the values of
+// their matching labels are equal, so matchers on labels which are used for matching
+// have to hold for both sides. For example, the expression:
+//
+//	a{job="x", env="prod"} / on (job) b becomes:
+//	a{job="x", env="prod"} / on (job) b{job="x"}.
 type PropagateMatchersOptimizer struct{}
 
-func (m PropagateMatchersOptimizer) Optimize(expr parser.Expr, _ *Opts) parser.Expr {
-	traverse(&expr, func(expr *parser.Expr) {
-		binOp, ok := (*expr).(*parser.BinaryExpr)
+func (m PropagateMatchersOptimizer) Optimize(expr Node, _ *Opts) Node {
+	traverse(&expr, func(expr *Node) {
+		binOp, ok := (*expr).(*Binary)
 		if !ok {
 			return
 		}
@@ -27,13 +33,8 @@ func (m PropagateMatchersOptimizer) Optimize(expr parser.Expr, _ *Opts) parser.E
 			return
 		}
 
-		// TODO(fpetkovski): Investigate support for vector matching on a subset of labels.
-		if binOp.VectorMatching != nil && len(binOp.VectorMatching.MatchingLabels) > 0 {
-			return
-		}
-
-		// TODO(fpetkovski): Investigate support for one-to-many and many-to-one.
-		if binOp.VectorMatching != nil && binOp.VectorMatching.Card != parser.CardOneToOne {
+		// Set operations do not require series from both sides to match.
+		if binOp.VectorMatching != nil && binOp.VectorMatching.Card == parser.CardManyToMany {
 			return
 		}
 
@@ -43,12 +44,12 @@ func (m PropagateMatchersOptimizer) Optimize(expr parser.Expr, _ *Opts) parser.E
 	return expr
 }
 
-func propagateMatchers(binOp *parser.BinaryExpr) {
-	lhSelector, ok := binOp.LHS.(*parser.VectorSelector)
+func propagateMatchers(binOp *Binary) {
+	lhSelector, ok := binOp.LHS.(*VectorSelector)
 	if !ok {
 		return
 	}
-	rhSelector, ok := binOp.RHS.(*parser.VectorSelector)
+	rhSelector, ok := binOp.RHS.(*VectorSelector)
 	if !ok {
 		return
 	}
@@ -57,65 +58,50 @@ func propagateMatchers(binOp *parser.BinaryExpr) {
 		return
 	}
 
-	lhMatchers := toMatcherMap(lhSelector)
-	rhMatchers := toMatcherMap(rhSelector)
-	union, hasDuplicates := makeUnion(lhMatchers, rhMatchers)
-	if hasDuplicates {
-		return
-	}
-
-	finalMatchers := toSlice(union)
-	lhSelector.LabelMatchers = finalMatchers
-	rhSelector.LabelMatchers = finalMatchers
+	lhMatchers := lhSelector.LabelMatchers
+	rhMatchers := rhSelector.LabelMatchers
+	lhSelector.LabelMatchers = addMatchers(lhMatchers, rhMatchers, binOp.VectorMatching)
+	rhSelector.LabelMatchers = addMatchers(rhMatchers, lhMatchers, binOp.VectorMatching)
 }
 
-func toSlice(union map[string]*labels.Matcher) []*labels.Matcher {
-	finalMatchers := make([]*labels.Matcher, 0, len(union))
-	for _, m := range union {
-		finalMatchers = append(finalMatchers, m)
+// addMatchers returns the matchers with the other matchers on labels used for vector matching
+// which they do not already contain. Added matchers are sorted into the result by label name.
+func addMatchers(matchers, other []*labels.Matcher, matching *parser.VectorMatching) []*labels.Matcher {
+	existing := make(map[string]struct{}, len(matchers))
+	for _, m := range matchers {
+		existing[m.String()] = struct{}{}
 	}
 
-	sort.Slice(finalMatchers, func(i, j int) bool { return finalMatchers[i].Name < finalMatchers[j].Name })
-	return finalMatchers
-}
-
-func makeUnion(lhMatchers map[string]*labels.Matcher, rhMatchers map[string]*labels.Matcher) (map[string]*labels.Matcher, bool) {
-	union := make(map[string]*labels.Matcher)
-	for _, m := range lhMatchers {
-		if m.Name == labels.MetricName {
+	result := matchers
+	for _, m := range other {
+		if !isMatchingLabel(m.Name, matching) {
 			continue
 		}
-		if duplicateExists(rhMatchers, m) {
-			return nil, true
-		}
-		union[m.Name] = m
-	}
-
-	for _, m := range rhMatchers {
-		if m.Name == labels.MetricName {
+		if _, ok := existing[m.String()]; ok {
 			continue
 		}
-		if duplicateExists(lhMatchers, m) {
-			return nil, true
+		if len(result) == len(matchers) {
+			// Copy the matchers since they can be shared with other selectors.
+			result = append(make([]*labels.Matcher, 0, len(matchers)+len(other)), matchers...)
 		}
-		union[m.Name] = m
+		result = append(result, m)
 	}
-	return union, false
-}
-
-func toMatcherMap(lhSelector *parser.VectorSelector) map[string]*labels.Matcher {
-	lhMatchers := make(map[string]*labels.Matcher)
-	for _, m := range lhSelector.LabelMatchers {
-		lhMatchers[m.Name] = m
+	if len(result) > len(matchers) {
+		sort.SliceStable(result, func(i, j int) bool { return result[i].Name < result[j].Name })
 	}
-	return lhMatchers
+	return result
 }
 
-func duplicateExists(matchers map[string]*labels.Matcher, matcher *labels.Matcher) bool {
-	existing, ok := matchers[matcher.Name]
-	if !ok {
-		return false
+// isMatchingLabel returns true if the label has to be equal in series from both sides
+// of a binary expression with the given vector matching in order to join them.
+func isMatchingLabel(name string, matching *parser.VectorMatching) bool {
+	if matching == nil {
+		return name != labels.MetricName
 	}
-
-	return existing.String() == matcher.String()
+	for _, l := range matching.MatchingLabels {
+		if l == name {
+			return matching.On
+		}
+	}
+	return !matching.On && name != labels.MetricName
 }
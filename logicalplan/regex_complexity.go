@@ -0,0 +1,60 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"regexp/syntax"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+// ErrRegexTooComplex is returned when a regex matcher exceeds the configured complexity limit.
+var ErrRegexTooComplex = errors.New("regex matcher is too complex")
+
+// CheckRegexComplexity returns an error for the first regex matcher in the expression
+// whose complexity exceeds the given limit. The complexity of a regex is the number of
+// instructions in its compiled program. Large alternations and nested or counted
+// quantifiers expand into many instructions, which makes matching them against
+// label values expensive.
+func CheckRegexComplexity(expr parser.Expr, limit int) error {
+	var err error
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		vs, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+		for _, m := range vs.LabelMatchers {
+			if m.Type != labels.MatchRegexp && m.Type != labels.MatchNotRegexp {
+				continue
+			}
+			complexity, cerr := regexComplexity(m.Value)
+			if cerr != nil {
+				err = cerr
+				return err
+			}
+			if complexity > limit {
+				err = errors.Wrapf(ErrRegexTooComplex, "matcher %s has complexity %d, limit is %d", m.String(), complexity, limit)
+				return err
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+func regexComplexity(pattern string) (int, error) {
+	// Prometheus anchors regex matchers on both sides.
+	re, err := syntax.Parse("^(?:"+pattern+")$", syntax.Perl)
+	if err != nil {
+		return 0, err
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return 0, err
+	}
+	return len(prog.Inst), nil
+}
@@ -0,0 +1,69 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+func TestCheckRegexComplexity(t *testing.T) {
+	cases := []struct {
+		name     string
+		expr     string
+		tooLarge bool
+	}{
+		{
+			name: "equality matchers",
+			expr: `sum(metric{a="b", c!="d"})`,
+		},
+		{
+			name: "simple regex",
+			expr: `sum(rate(metric{a=~"b|c", c!~"d.+"}[5m]))`,
+		},
+		{
+			name:     "large alternation",
+			expr:     `metric{a=~"` + alternation(200) + `"}`,
+			tooLarge: true,
+		},
+		{
+			name:     "nested counted quantifiers",
+			expr:     `metric{a=~"(a{1,30}){1,30}"}`,
+			tooLarge: true,
+		},
+		{
+			name:     "complex regex in binary expression",
+			expr:     `metric_1 / on() metric_2{a!~"(foo|bar){150}"}`,
+			tooLarge: true,
+		},
+	}
+
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			err = CheckRegexComplexity(expr, 1000)
+			if tcase.tooLarge {
+				testutil.Assert(t, errors.Is(err, ErrRegexTooComplex), "expected regex complexity error, got %v", err)
+			} else {
+				testutil.Ok(t, err)
+			}
+		})
+	}
+}
+
+func alternation(n int) string {
+	values := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		values = append(values, fmt.Sprintf("%08x", uint32(i)*2654435761))
+	}
+	return strings.Join(values, "|")
+}
@@ -0,0 +1,129 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"math"
+	"time"
+
+	"github.com/prometheus/prometheus/model/timestamp"
+)
+
+// SelectorRange is the time range of samples which a selector reads from storage.
+type SelectorRange struct {
+	Selector *VectorSelector
+	// Range is the range of the matrix selector, or zero for instant vector selectors.
+	Range time.Duration
+	// MinT and MaxT are the bounds of the selected samples in milliseconds, inclusive.
+	MinT int64
+	MaxT int64
+}
+
+// SelectorRanges returns the effective time range of each selector in the expression,
+// taking into account the lookback delta, offsets, @ modifiers, subqueries and the
+// extended lookback of x-functions. Selectors which are executed by remote engines
+// are not included.
+func SelectorRanges(expr Node, opts *Opts) []SelectorRange {
+	var ranges []SelectorRange
+	inspectSelectors(expr, nil, func(vs *VectorSelector, path []Node) {
+		var evalRange time.Duration
+		if len(path) > 0 {
+			if ms, ok := path[len(path)-1].(*MatrixSelector); ok {
+				evalRange = ms.Range
+			}
+		}
+		mint, maxt := selectorRange(vs, path, opts, evalRange)
+		ranges = append(ranges, SelectorRange{
+			Selector: vs,
+			Range:    evalRange,
+			MinT:     mint,
+			MaxT:     maxt,
+		})
+	})
+	return ranges
+}
+
+// inspectSelectors calls f for each vector selector in the expression with the path of its ancestors.
+// Selectors of remote executions are not part of the plan, and empty selectors do not select any samples.
+func inspectSelectors(node Node, path []Node, f func(*VectorSelector, []Node)) {
+	inspect(node, path, func(node Node, path []Node) {
+		switch n := node.(type) {
+		case *VectorSelector:
+			f(n, path)
+		case *FilteredSelector:
+			if !n.Empty {
+				f(n.VectorSelector, path)
+			}
+		}
+	})
+}
+
+func selectorRange(vs *VectorSelector, path []Node, opts *Opts, evalRange time.Duration) (int64, int64) {
+	start, end := timestamp.FromTime(opts.Start), timestamp.FromTime(opts.End)
+	subqOffset, subqRange, subqTs := subqueryTimes(path)
+	if subqTs != nil {
+		// The @ modifier of a subquery overrides the time range of the query.
+		start, end = *subqTs, *subqTs
+	}
+
+	if vs.Timestamp != nil {
+		// The @ modifier of the selector overrides everything else.
+		start, end = *vs.Timestamp, *vs.Timestamp
+	} else {
+		start -= subqOffset.Milliseconds() + subqRange.Milliseconds()
+		end -= subqOffset.Milliseconds()
+	}
+
+	if evalRange == 0 {
+		start -= opts.LookbackDelta.Milliseconds()
+	} else {
+		start -= evalRange.Milliseconds()
+		if isXFunctionArg(path) {
+			start -= opts.ExtLookbackDelta.Milliseconds()
+		}
+	}
+
+	offset := vs.OriginalOffset.Milliseconds()
+	return start - offset, end - offset
+}
+
+// subqueryTimes returns the sum of offsets and ranges of the subqueries in the path,
+// and the timestamp of the innermost subquery with an @ modifier.
+func subqueryTimes(path []Node) (time.Duration, time.Duration, *int64) {
+	var (
+		subqOffset, subqRange time.Duration
+		ts                    int64 = math.MaxInt64
+	)
+	for _, node := range path {
+		if n, ok := node.(*Subquery); ok {
+			subqOffset += n.OriginalOffset
+			subqRange += n.Range
+			if n.Timestamp != nil {
+				// The @ modifier resets the offsets and ranges of outer subqueries.
+				subqOffset = n.OriginalOffset
+				subqRange = n.Range
+				ts = *n.Timestamp
+			}
+		}
+	}
+	if ts == math.MaxInt64 {
+		return subqOffset, subqRange, nil
+	}
+	return subqOffset, subqRange, &ts
+}
+
+// isXFunctionArg returns true if the matrix selector at the end of the path is an argument of an x-function.
+func isXFunctionArg(path []Node) bool {
+	for i := len(path) - 2; i >= 0; i-- {
+		switch n := path[i].(type) {
+		case *StepInvariantExpr, *Parens:
+			continue
+		case *FunctionCall:
+			_, ok := xFunctions[n.Func.Name]
+			return ok
+		}
+		return false
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+
+	"github.com/thanos-community/promql-engine/execution/parse"
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+func TestSelectorRanges(t *testing.T) {
+	parser.Functions["xincrease"] = parse.Functions["xincrease"]
+
+	type selectorRange struct {
+		selector   string
+		mint, maxt int64
+	}
+	cases := []struct {
+		name     string
+		expr     string
+		expected []selectorRange
+	}{
+		{
+			name:     "vector selector",
+			expr:     `http_requests_total`,
+			expected: []selectorRange{{`http_requests_total`, 600_000, 1_000_000}},
+		},
+		{
+			name:     "matrix selector",
+			expr:     `rate(http_requests_total[1m])`,
+			expected: []selectorRange{{`http_requests_total`, 840_000, 1_000_000}},
+		},
+		{
+			name:     "offset",
+			expr:     `rate(http_requests_total[1m] offset 10m)`,
+			expected: []selectorRange{{`http_requests_total offset 10m`, 240_000, 400_000}},
+		},
+		{
+			name:     "negative offset",
+			expr:     `http_requests_total offset -1m`,
+			expected: []selectorRange{{`http_requests_total offset -1m`, 660_000, 1_060_000}},
+		},
+		{
+			name:     "@ modifier",
+			expr:     `rate(http_requests_total[1m] @ 300)`,
+			expected: []selectorRange{{`http_requests_total @ 300.000`, 240_000, 300_000}},
+		},
+		{
+			name:     "@ end()",
+			expr:     `http_requests_total @ end() offset 1m`,
+			expected: []selectorRange{{`http_requests_total @ 1000.000 offset 1m`, 640_000, 940_000}},
+		},
+		{
+			name:     "x-function",
+			expr:     `xincrease(http_requests_total[1m])`,
+			expected: []selectorRange{{`http_requests_total`, 780_000, 1_000_000}},
+		},
+		{
+			name:     "subquery",
+			expr:     `max_over_time(rate(http_requests_total[1m])[5m:1m] offset 1m)`,
+			expected: []selectorRange{{`http_requests_total`, 480_000, 940_000}},
+		},
+		{
+			name:     "subquery with @ modifier",
+			expr:     `max_over_time(http_requests_total[5m:1m] @ 500)`,
+			expected: []selectorRange{{`http_requests_total`, -100_000, 500_000}},
+		},
+		{
+			name: "binary expression",
+			expr: `http_requests_total / rate(errors_total[1m])`,
+			expected: []selectorRange{
+				{`http_requests_total`, 600_000, 1_000_000},
+				{`errors_total`, 840_000, 1_000_000},
+			},
+		},
+	}
+
+	opts := &Opts{
+		Start:            time.Unix(900, 0),
+		End:              time.Unix(1000, 0),
+		Step:             30 * time.Second,
+		LookbackDelta:    5 * time.Minute,
+		ExtLookbackDelta: time.Minute,
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			plan := New(expr, opts)
+			ranges := plan.SelectorRanges()
+			testutil.Equals(t, len(tcase.expected), len(ranges))
+			for i, r := range ranges {
+				testutil.Equals(t, tcase.expected[i], selectorRange{r.Selector.String(), r.MinT, r.MaxT})
+			}
+		})
+	}
+}
+
+func TestEstimateCost(t *testing.T) {
+	opts := &Opts{
+		Start:         time.Unix(0, 0),
+		End:           time.Unix(3600, 0),
+		Step:          time.Minute,
+		LookbackDelta: 5 * time.Minute,
+	}
+	cases := []struct {
+		expr     string
+		expected float64
+	}{
+		{expr: `http_requests_total`, expected: 3900},
+		{expr: `rate(http_requests_total[5m])`, expected: 3900 + 61*300},
+		{expr: `http_requests_total @ 100`, expected: 300},
+		{expr: `http_requests_total / http_responses_total`, expected: 2 * 3900},
+		{expr: `vector(1)`, expected: 0},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.expr, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expected, EstimateCost(New(expr, opts).Root(), opts))
+		})
+	}
+}
+
+func TestSelectorRangesOfOptimizedPlan(t *testing.T) {
+	opts := &Opts{
+		Start:         time.Unix(900, 0),
+		End:           time.Unix(1000, 0),
+		Step:          30 * time.Second,
+		LookbackDelta: 5 * time.Minute,
+	}
+	expr, err := parser.ParseExpr(`sum(rate(metric{a="b", c="d"}[1m])) / sum(rate(metric{a="b"}[1m]))`)
+	testutil.Ok(t, err)
+
+	ranges := New(expr, opts).Optimize(DefaultOptimizers).SelectorRanges()
+	testutil.Equals(t, 2, len(ranges))
+	for _, r := range ranges {
+		testutil.Equals(t, `metric{a="b"}`, r.Selector.String())
+		testutil.Equals(t, int64(840_000), r.MinT)
+		testutil.Equals(t, int64(1_000_000), r.MaxT)
+	}
+}
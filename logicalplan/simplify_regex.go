@@ -0,0 +1,216 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// maxRegexValues is the maximum number of values a regex matcher can be expanded to.
+const maxRegexValues = 64
+
+// SimplifyRegexOptimizer rewrites regex matchers into forms which storage can evaluate
+// with index lookups instead of matching every label value against the regex:
+//   - regex matchers for a single value become equality matchers, for example
+//     metric{a=~"foo"} becomes metric{a="foo"};
+//   - regex matchers for a small set of values become an alternation of the values,
+//     for example metric{a=~"(foo|bar)(1|2)"} becomes metric{a=~"bar1|bar2|foo1|foo2"};
+//   - capture groups and anchors, which are redundant since matchers are always anchored,
+//     are removed, so that literal prefixes are at the start of the regex,
+//     for example metric{a=~"^(foo.*)$"} becomes metric{a=~"(?-s:foo.*)"}.
+type SimplifyRegexOptimizer struct{}
+
+func (s SimplifyRegexOptimizer) Optimize(expr Node, _ *Opts) Node {
+	traverse(&expr, func(node *Node) {
+		switch e := (*node).(type) {
+		case *VectorSelector:
+			e.LabelMatchers = simplifyRegexMatchers(e.LabelMatchers)
+		case *FilteredSelector:
+			e.LabelMatchers = simplifyRegexMatchers(e.LabelMatchers)
+			e.Filters = simplifyRegexMatchers(e.Filters)
+		}
+	})
+	return expr
+}
+
+// simplifyRegexMatchers returns the matchers with simplified regex matchers.
+// The matchers are copied when one of them is simplified, since they can be shared between selectors.
+func simplifyRegexMatchers(matchers []*labels.Matcher) []*labels.Matcher {
+	var simplified []*labels.Matcher
+	for i, m := range matchers {
+		s, ok := simplifyRegexMatcher(m)
+		if !ok {
+			continue
+		}
+		if simplified == nil {
+			simplified = make([]*labels.Matcher, len(matchers))
+			copy(simplified, matchers)
+		}
+		simplified[i] = s
+	}
+	if simplified == nil {
+		return matchers
+	}
+	return simplified
+}
+
+// simplifyRegexMatcher returns a simpler matcher which matches the same values as m.
+// The returned bool is false if the matcher cannot be simplified.
+func simplifyRegexMatcher(m *labels.Matcher) (*labels.Matcher, bool) {
+	if m.Type != labels.MatchRegexp && m.Type != labels.MatchNotRegexp {
+		return nil, false
+	}
+	re, err := syntax.Parse(m.Value, syntax.Perl)
+	if err != nil {
+		return nil, false
+	}
+	re, changed := removeCaptures(re)
+	re, anchorsRemoved := removeAnchors(re)
+	changed = changed || anchorsRemoved
+
+	if values, ok := regexValues(re, maxRegexValues); ok {
+		sort.Strings(values)
+		values = dedupValues(values)
+		if len(values) == 1 {
+			matchType := labels.MatchEqual
+			if m.Type == labels.MatchNotRegexp {
+				matchType = labels.MatchNotEqual
+			}
+			return labels.MustNewMatcher(matchType, m.Name, values[0]), true
+		}
+		for i := range values {
+			values[i] = regexp.QuoteMeta(values[i])
+		}
+		if value := strings.Join(values, "|"); value != m.Value {
+			return labels.MustNewMatcher(m.Type, m.Name, value), true
+		}
+		return nil, false
+	}
+	if !changed {
+		return nil, false
+	}
+	return labels.MustNewMatcher(m.Type, m.Name, re.String()), true
+}
+
+// removeCaptures replaces capture groups with their contents, since matchers do not use captures.
+func removeCaptures(re *syntax.Regexp) (*syntax.Regexp, bool) {
+	changed := false
+	for re.Op == syntax.OpCapture {
+		re, changed = re.Sub[0], true
+	}
+	for i, sub := range re.Sub {
+		var subChanged bool
+		re.Sub[i], subChanged = removeCaptures(sub)
+		changed = changed || subChanged
+	}
+	return re, changed
+}
+
+// removeAnchors removes the anchors at the start and end of the regex and of each of its alternatives.
+func removeAnchors(re *syntax.Regexp) (*syntax.Regexp, bool) {
+	if re.Op == syntax.OpAlternate {
+		changed := false
+		for i, sub := range re.Sub {
+			var subChanged bool
+			re.Sub[i], subChanged = removeAnchors(sub)
+			changed = changed || subChanged
+		}
+		return re, changed
+	}
+	if re.Op != syntax.OpConcat {
+		return re, false
+	}
+	sub := re.Sub
+	if len(sub) > 0 && sub[0].Op == syntax.OpBeginText {
+		sub = sub[1:]
+	}
+	if len(sub) > 0 && sub[len(sub)-1].Op == syntax.OpEndText {
+		sub = sub[:len(sub)-1]
+	}
+	switch {
+	case len(sub) == len(re.Sub):
+		return re, false
+	case len(sub) == 0:
+		return &syntax.Regexp{Op: syntax.OpEmptyMatch}, true
+	case len(sub) == 1:
+		return sub[0], true
+	default:
+		return &syntax.Regexp{Op: syntax.OpConcat, Flags: re.Flags, Sub: sub}, true
+	}
+}
+
+// regexValues returns all values matched by the regex if there are at most limit values.
+func regexValues(re *syntax.Regexp, limit int) ([]string, bool) {
+	switch re.Op {
+	case syntax.OpEmptyMatch:
+		return []string{""}, true
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return nil, false
+		}
+		return []string{string(re.Rune)}, true
+	case syntax.OpCharClass:
+		var values []string
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			for r := re.Rune[i]; r <= re.Rune[i+1]; r++ {
+				if len(values) == limit {
+					return nil, false
+				}
+				values = append(values, string(r))
+			}
+		}
+		return values, true
+	case syntax.OpQuest:
+		values, ok := regexValues(re.Sub[0], limit-1)
+		if !ok {
+			return nil, false
+		}
+		return append(values, ""), true
+	case syntax.OpAlternate:
+		var values []string
+		for _, sub := range re.Sub {
+			subValues, ok := regexValues(sub, limit-len(values))
+			if !ok {
+				return nil, false
+			}
+			values = append(values, subValues...)
+		}
+		return values, true
+	case syntax.OpConcat:
+		values := []string{""}
+		for _, sub := range re.Sub {
+			subValues, ok := regexValues(sub, limit)
+			if !ok || len(values)*len(subValues) > limit {
+				return nil, false
+			}
+			concatenated := make([]string, 0, len(values)*len(subValues))
+			for _, prefix := range values {
+				for _, suffix := range subValues {
+					concatenated = append(concatenated, prefix+suffix)
+				}
+			}
+			values = concatenated
+		}
+		return values, true
+	default:
+		return nil, false
+	}
+}
+
+func dedupValues(values []string) []string {
+	i := 0
+	for _, v := range values {
+		if i > 0 && values[i-1] == v {
+			continue
+		}
+		values[i] = v
+		i++
+	}
+	return values[:i]
+}
@@ -0,0 +1,104 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+func TestSimplifyRegexOptimizer(t *testing.T) {
+	cases := []struct {
+		name     string
+		expr     string
+		expected string
+	}{
+		{
+			name:     "literal regex",
+			expr:     `metric{a=~"foo"}`,
+			expected: `metric{a="foo"}`,
+		},
+		{
+			name:     "negated literal regex",
+			expr:     `metric{a!~"foo"}`,
+			expected: `metric{a!="foo"}`,
+		},
+		{
+			name:     "anchored empty regex",
+			expr:     `metric{a=~"^$"}`,
+			expected: `metric{a=""}`,
+		},
+		{
+			name:     "escaped literal regex",
+			expr:     `metric{a=~"foo\\.bar"}`,
+			expected: `metric{a="foo.bar"}`,
+		},
+		{
+			name:     "alternation",
+			expr:     `metric{a=~"(foo|bar)"}`,
+			expected: `metric{a=~"bar|foo"}`,
+		},
+		{
+			name:     "alternation with duplicates",
+			expr:     `metric{a=~"foo|bar|foo"}`,
+			expected: `metric{a=~"bar|foo"}`,
+		},
+		{
+			name:     "factored alternation",
+			expr:     `metric{a=~"foo-(1|2)"}`,
+			expected: `metric{a=~"foo-1|foo-2"}`,
+		},
+		{
+			name:     "optional characters and character classes",
+			expr:     `metric{a!~"colou?r-[ab]"}`,
+			expected: `metric{a!~"color-a|color-b|colour-a|colour-b"}`,
+		},
+		{
+			name:     "anchored alternatives",
+			expr:     `metric{a=~"^foo$|^bar$"}`,
+			expected: `metric{a=~"bar|foo"}`,
+		},
+		{
+			name:     "anchored prefix",
+			expr:     `metric{a=~"^(foo.*)$"}`,
+			expected: `metric{a=~"(?-s:foo.*)"}`,
+		},
+		{
+			name:     "case insensitive regex",
+			expr:     `metric{a=~"(?i)foo"}`,
+			expected: `metric{a=~"(?i)foo"}`,
+		},
+		{
+			name:     "too many values",
+			expr:     `metric{a=~"[0-9][0-9]"}`,
+			expected: `metric{a=~"[0-9][0-9]"}`,
+		},
+		{
+			name:     "regex without literal values",
+			expr:     `metric{a=~"foo.+"}`,
+			expected: `metric{a=~"foo.+"}`,
+		},
+		{
+			name:     "regex in function argument",
+			expr:     `sum(rate(metric{a=~"foo|bar", b=~"baz"}[5m]))`,
+			expected: `sum(rate(metric{a=~"bar|foo",b="baz"}[5m]))`,
+		},
+	}
+
+	optimizers := []Optimizer{SimplifyRegexOptimizer{}}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			plan := New(expr, &Opts{Start: time.Unix(0, 0), End: time.Unix(0, 0)})
+			optimizedPlan := plan.Optimize(optimizers)
+			testutil.Equals(t, tcase.expected, optimizedPlan.Root().String())
+		})
+	}
+}
@@ -5,8 +5,6 @@ package logicalplan
 
 import (
 	"sort"
-
-	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
 )
 
 // SortMatchers sorts all matchers in a selector so that
@@ -14,9 +12,9 @@ import (
 // can rely on this property.
 type SortMatchers struct{}
 
-func (m SortMatchers) Optimize(expr parser.Expr, _ *Opts) parser.Expr {
-	traverse(&expr, func(node *parser.Expr) {
-		e, ok := (*node).(*parser.VectorSelector)
+func (m SortMatchers) Optimize(expr Node, _ *Opts) Node {
+	traverse(&expr, func(node *Node) {
+		e, ok := (*node).(*VectorSelector)
 		if !ok {
 			return
 		}
@@ -0,0 +1,89 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+// TimeRange is an inclusive range of evaluation timestamps.
+type TimeRange struct {
+	Start time.Time
+	End   time.Time
+}
+
+func (r TimeRange) String() string {
+	return fmt.Sprintf("[%d, %d]", r.Start.UnixMilli(), r.End.UnixMilli())
+}
+
+// TimeSplit evaluates its expression independently for each of its time ranges,
+// which are consecutive slices of the range of the query. The results of the
+// slices are concatenated.
+type TimeSplit struct {
+	Expr   Node
+	Slices []TimeRange
+}
+
+func (t *TimeSplit) String() string {
+	slices := make([]string, len(t.Slices))
+	for i, s := range t.Slices {
+		slices[i] = s.String()
+	}
+	return fmt.Sprintf("split([%s], %s)", strings.Join(slices, ", "), t.Expr)
+}
+
+func (t *TimeSplit) ReturnType() parser.ValueType { return t.Expr.ReturnType() }
+
+func (t *TimeSplit) Children() []*Node { return []*Node{&t.Expr} }
+
+// TimeSplitOptimizer splits range queries which are longer than SliceRange into consecutive
+// step-aligned slices of at most SliceRange. Slices are evaluated concurrently as independent
+// plans, so that the memory used by operators is bounded by the range of a slice.
+// Other optimizers do not optimize expressions inside of slices, so it has to run last.
+// Queries with @ modifiers are not split since their offsets are relative to the start of the query.
+type TimeSplitOptimizer struct {
+	SliceRange time.Duration
+}
+
+func (m TimeSplitOptimizer) Optimize(plan Node, opts *Opts) Node {
+	if m.SliceRange <= 0 || opts.Step.Milliseconds() <= 0 || opts.End.Sub(opts.Start) <= m.SliceRange {
+		return plan
+	}
+	if hasAtModifier(plan) {
+		return plan
+	}
+
+	stepsPerSlice := int64(m.SliceRange/opts.Step) + 1
+	sliceStep := time.Duration(stepsPerSlice) * opts.Step
+
+	var slices []TimeRange
+	for start := opts.Start; !start.After(opts.End); start = start.Add(sliceStep) {
+		end := start.Add(sliceStep - opts.Step)
+		if end.After(opts.End) {
+			end = opts.End
+		}
+		slices = append(slices, TimeRange{Start: start, End: end})
+	}
+	return &TimeSplit{Expr: plan, Slices: slices}
+}
+
+// hasAtModifier returns true if a selector or subquery in the plan has an @ modifier.
+func hasAtModifier(plan Node) bool {
+	var found bool
+	inspect(plan, nil, func(node Node, _ []Node) {
+		switch n := node.(type) {
+		case *VectorSelector:
+			found = found || n.Timestamp != nil
+		case *FilteredSelector:
+			found = found || n.Timestamp != nil
+		case *Subquery:
+			found = found || n.Timestamp != nil
+		}
+	})
+	return found
+}
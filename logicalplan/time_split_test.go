@@ -0,0 +1,63 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+func TestTimeSplitOptimizer(t *testing.T) {
+	cases := []struct {
+		name     string
+		expr     string
+		opts     *Opts
+		expected string
+	}{
+		{
+			name:     "range is split into step-aligned slices",
+			expr:     `sum(rate(http_requests_total[5m]))`,
+			opts:     &Opts{Start: time.Unix(0, 0), End: time.Unix(600, 0), Step: time.Minute},
+			expected: `split([[0, 240000], [300000, 540000], [600000, 600000]], sum(rate(http_requests_total[5m])))`,
+		},
+		{
+			name:     "slices are aligned to the start of the query",
+			expr:     `http_requests_total`,
+			opts:     &Opts{Start: time.Unix(30, 0), End: time.Unix(570, 0), Step: 2 * time.Minute},
+			expected: `split([[30000, 270000], [390000, 570000]], http_requests_total)`,
+		},
+		{
+			name:     "range shorter than a slice is not split",
+			expr:     `http_requests_total`,
+			opts:     &Opts{Start: time.Unix(0, 0), End: time.Unix(240, 0), Step: time.Minute},
+			expected: `http_requests_total`,
+		},
+		{
+			name:     "instant query is not split",
+			expr:     `http_requests_total`,
+			opts:     &Opts{Start: time.Unix(600, 0), End: time.Unix(600, 0), Step: 1},
+			expected: `http_requests_total`,
+		},
+		{
+			name:     "query with @ modifier is not split",
+			expr:     `http_requests_total - http_requests_total @ start()`,
+			opts:     &Opts{Start: time.Unix(0, 0), End: time.Unix(600, 0), Step: time.Minute},
+			expected: `http_requests_total - http_requests_total @ 0.000`,
+		},
+	}
+	optimizers := []Optimizer{TimeSplitOptimizer{SliceRange: 4 * time.Minute}}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			plan := New(expr, tcase.opts).Optimize(optimizers)
+			testutil.Equals(t, tcase.expected, plan.Root().String())
+		})
+	}
+}
@@ -3,30 +3,37 @@
 
 package logicalplan
 
-import (
-	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
-)
-
 // TrimSortFunctions trims sort functions. It can do that because for nested sort functions
 // we can safely say f(sort(X)) == f(X). Top-level sort functions are handled by the engine
 // when presenting the query results. The engine depends on this optimizer to be able to ignore
-// the 'sort' and 'sort_desc' functions when building its Operator tree.
+// the 'sort', 'sort_desc', 'sort_by_label' and 'sort_by_label_desc' functions when building its Operator tree.
+// All nodes are walked through their children, so that sort functions are also trimmed in shared
+// expressions and above nodes which other optimizers introduce.
 type TrimSortFunctions struct {
 }
 
-func (TrimSortFunctions) Optimize(expr parser.Expr, _ *Opts) parser.Expr {
-	traverseBottomUp(nil, &expr, func(parent, current *parser.Expr) bool {
-		if current == nil || parent == nil {
-			return true
-		}
-		switch e := (*parent).(type) {
-		case *parser.Call:
-			switch e.Func.Name {
-			case "sort", "sort_desc":
-				*parent = *current
-			}
-		}
-		return false
-	})
+func (TrimSortFunctions) Optimize(expr Node, _ *Opts) Node {
+	trimSortFunctions(&expr)
 	return expr
 }
+
+func trimSortFunctions(expr *Node) {
+	for isSortFunction(*expr) {
+		*expr = (*expr).(*FunctionCall).Args[0]
+	}
+	for _, child := range (*expr).Children() {
+		trimSortFunctions(child)
+	}
+}
+
+func isSortFunction(expr Node) bool {
+	call, ok := expr.(*FunctionCall)
+	if !ok {
+		return false
+	}
+	switch call.Func.Name {
+	case "sort", "sort_desc", "sort_by_label", "sort_by_label_desc":
+		return true
+	}
+	return false
+}
@@ -53,7 +53,15 @@ func TestTrimSorts(t *testing.T) {
 
 			plan := New(expr, &Opts{})
 			optimizedPlan := plan.Optimize(optimizers)
-			testutil.Equals(t, tcase.expected, optimizedPlan.Expr().String())
+			testutil.Equals(t, tcase.expected, optimizedPlan.Root().String())
 		})
 	}
 }
+
+func TestTrimSortsInSharedExpressions(t *testing.T) {
+	expr, err := parser.ParseExpr(`sort(sum by (a) (foo)) + sum by (a) (foo)`)
+	testutil.Ok(t, err)
+
+	plan := New(expr, &Opts{}).Optimize([]Optimizer{CommonSubexpressionOptimizer{}, TrimSortFunctions{}})
+	testutil.Equals(t, "shared(0, sum by (a) (foo)) + shared(0, sum by (a) (foo))", plan.Root().String())
+}
@@ -0,0 +1,118 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"regexp/syntax"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+// ErrUnboundedSelector is returned when a selector can select every series in storage.
+var ErrUnboundedSelector = errors.New("selector is unbounded")
+
+// CheckUnboundedSelectors returns an error for the first selector in the expression which
+// has no selective matcher, such as {__name__=~".+"}. A matcher is selective if it is an
+// equality matcher on the metric name, a positive matcher on another label which does not
+// match the empty string and, for regexes, does not match any non-empty value such as {job=~".+"},
+// or if it is equal to one of the allowed matchers.
+func CheckUnboundedSelectors(expr parser.Expr, allowed []*labels.Matcher) error {
+	var err error
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		vs, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+		for _, m := range vs.LabelMatchers {
+			if isSelective(m, allowed) {
+				return nil
+			}
+		}
+		err = errors.Wrapf(ErrUnboundedSelector, "%s has to contain an equality matcher on the metric name or a matcher on another label which matches neither the empty string nor any value", vs.String())
+		return err
+	})
+	return err
+}
+
+func isSelective(m *labels.Matcher, allowed []*labels.Matcher) bool {
+	for _, a := range allowed {
+		if a.Type == m.Type && a.Name == m.Name && a.Value == m.Value {
+			return true
+		}
+	}
+	if m.Name == labels.MetricName {
+		return m.Type == labels.MatchEqual && m.Value != ""
+	}
+	switch m.Type {
+	case labels.MatchEqual:
+		return !m.Matches("")
+	case labels.MatchRegexp:
+		return !m.Matches("") && !matchesAnyNonEmpty(m.Value)
+	default:
+		return false
+	}
+}
+
+// matchesAnyNonEmpty returns true if the regex matches any non-empty value, which
+// is the case for regexes such as ".+" and "(.+)" or alternatives such as "foo|.+".
+// Regexes which cannot be parsed are treated as if they match any value.
+func matchesAnyNonEmpty(value string) bool {
+	re, err := syntax.Parse(value, syntax.Perl|syntax.DotNL)
+	if err != nil {
+		return true
+	}
+	return isUnboundedRegex(re.Simplify())
+}
+
+func isUnboundedRegex(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpCapture:
+		return isUnboundedRegex(re.Sub[0])
+	case syntax.OpAlternate:
+		for _, sub := range re.Sub {
+			if isUnboundedRegex(sub) {
+				return true
+			}
+		}
+		return false
+	case syntax.OpConcat:
+		// A sequence of wildcards matches any value if one of them is repeated without bound.
+		var repeated bool
+		for _, sub := range re.Sub {
+			if !isWildcard(sub) {
+				return false
+			}
+			repeated = repeated || isUnboundedRegex(sub)
+		}
+		return repeated
+	case syntax.OpStar, syntax.OpPlus:
+		return isWildcard(re.Sub[0])
+	case syntax.OpRepeat:
+		return re.Max == -1 && isWildcard(re.Sub[0])
+	default:
+		return false
+	}
+}
+
+// isWildcard returns true if the regex only consists of any characters.
+func isWildcard(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return true
+	case syntax.OpCapture, syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		return isWildcard(re.Sub[0])
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			if !isWildcard(sub) {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"testing"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+func TestCheckUnboundedSelectors(t *testing.T) {
+	allowed := []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, "job:.+")}
+	cases := []struct {
+		name      string
+		expr      string
+		unbounded bool
+	}{
+		{
+			name: "metric name",
+			expr: `sum(rate(metric[5m]))`,
+		},
+		{
+			name: "regex on metric name with label matcher",
+			expr: `{__name__=~".+", job="api"}`,
+		},
+		{
+			name: "regex on label",
+			expr: `{job=~"api|web"}`,
+		},
+		{
+			name:      "regex on metric name",
+			expr:      `{__name__=~".+"}`,
+			unbounded: true,
+		},
+		{
+			name:      "negative matcher",
+			expr:      `{__name__=~"foo.+", job!=""}`,
+			unbounded: true,
+		},
+		{
+			name:      "matchers on labels which match the empty string",
+			expr:      `{__name__=~"foo.*", job=~".*", pod!="nginx"}`,
+			unbounded: true,
+		},
+		{
+			name:      "regex on label which matches any non-empty value",
+			expr:      `{job=~".+"}`,
+			unbounded: true,
+		},
+		{
+			name:      "regexes on labels which match any non-empty value",
+			expr:      `{__name__=~"foo.+", job=~"(.+)", pod=~"..*", zone=~"a|.{1,}"}`,
+			unbounded: true,
+		},
+		{
+			name: "regex on label with prefix",
+			expr: `{job=~"api.+"}`,
+		},
+		{
+			name:      "unbounded selector in binary expression",
+			expr:      `metric / on() count({__name__=~"up|down"})`,
+			unbounded: true,
+		},
+		{
+			name: "allowed matcher",
+			expr: `sum(rate({__name__=~"job:.+"}[5m]))`,
+		},
+	}
+
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			err = CheckUnboundedSelectors(expr, allowed)
+			if tcase.unbounded {
+				testutil.Assert(t, errors.Is(err, ErrUnboundedSelector), "expected unbounded selector error, got %v", err)
+			} else {
+				testutil.Ok(t, err)
+			}
+		})
+	}
+}
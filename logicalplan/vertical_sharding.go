@@ -0,0 +1,168 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+// Shard evaluates its expression only for the Index-th of Total disjoint shards
+// of the series selected by the expression.
+type Shard struct {
+	Expr  Node
+	Index int
+	Total int
+}
+
+func (s *Shard) String() string {
+	return fmt.Sprintf("shard(%d of %d, %s)", s.Index, s.Total, s.Expr)
+}
+
+func (s *Shard) ReturnType() parser.ValueType { return s.Expr.ReturnType() }
+
+func (s *Shard) Children() []*Node { return []*Node{&s.Expr} }
+
+// Coalesce returns the series of all of its expressions, which have to be disjoint.
+type Coalesce struct {
+	Exprs []Node
+}
+
+func (c *Coalesce) String() string {
+	exprs := make([]string, len(c.Exprs))
+	for i, e := range c.Exprs {
+		exprs[i] = e.String()
+	}
+	return fmt.Sprintf("coalesce(%s)", strings.Join(exprs, ", "))
+}
+
+func (c *Coalesce) ReturnType() parser.ValueType { return parser.ValueTypeVector }
+
+func (c *Coalesce) Children() []*Node {
+	children := make([]*Node, len(c.Exprs))
+	for i := range c.Exprs {
+		children[i] = &c.Exprs[i]
+	}
+	return children
+}
+
+// shardMergeAggregations maps aggregations which can be computed per shard
+// to the aggregations which merge the results of the shards.
+var shardMergeAggregations = map[parser.ItemType]parser.ItemType{
+	parser.SUM:   parser.SUM,
+	parser.MIN:   parser.MIN,
+	parser.MAX:   parser.MAX,
+	parser.COUNT: parser.SUM,
+	parser.GROUP: parser.GROUP,
+}
+
+// unshardableFunctions are functions whose result for a series depends on other series,
+// or which change the labels of series so that series from different shards could collide.
+var unshardableFunctions = map[string]struct{}{
+	"absent":             {},
+	"absent_over_time":   {},
+	"histogram_quantile": {},
+	"label_join":         {},
+	"label_replace":      {},
+	"scalar":             {},
+	"sort":               {},
+	"sort_desc":          {},
+	"sort_by_label":      {},
+	"sort_by_label_desc": {},
+	"vector":             {},
+}
+
+// VerticalShardingOptimizer splits aggregations over a single selector, such as
+// sum by (l) (rate(m[5m])), into Shards partial aggregations which are each evaluated for
+// one shard of the selected series. The partial aggregations are coalesced and combined by
+// a merge aggregation, so that a single query uses all cores with independent operators and
+// memory pools per shard. The expressions of shards are shared, so other optimizers
+// have to run before it.
+type VerticalShardingOptimizer struct {
+	Shards int
+}
+
+func (m VerticalShardingOptimizer) Optimize(plan Node, _ *Opts) Node {
+	if m.Shards <= 1 {
+		return plan
+	}
+	m.shard(&plan)
+	return plan
+}
+
+func (m VerticalShardingOptimizer) shard(expr *Node) {
+	switch e := (*expr).(type) {
+	case *Aggregation:
+		if mergeOp, ok := shardMergeAggregations[e.Op]; ok && e.Param == nil && countShardableSelectors(e.Expr) == 1 {
+			*expr = m.shardAggregation(e, mergeOp)
+			return
+		}
+	case *Subquery, *SharedExpr:
+		// Subqueries and shared expressions are evaluated with their own operators.
+		return
+	}
+	for _, child := range (*expr).Children() {
+		m.shard(child)
+	}
+}
+
+func (m VerticalShardingOptimizer) shardAggregation(aggr *Aggregation, mergeOp parser.ItemType) Node {
+	shards := make([]Node, m.Shards)
+	for i := range shards {
+		partial := *aggr
+		shards[i] = &Shard{Expr: &partial, Index: i, Total: m.Shards}
+	}
+	return &Aggregation{
+		Op:       mergeOp,
+		Expr:     &Coalesce{Exprs: shards},
+		Grouping: aggr.Grouping,
+		Without:  aggr.Without,
+	}
+}
+
+// countShardableSelectors returns the number of selectors in the expression if the expression
+// can be evaluated independently for each shard of their series, or -1 otherwise.
+// Expressions with more than one selector are joins, which cannot be sharded.
+func countShardableSelectors(expr Node) int {
+	switch e := expr.(type) {
+	case *VectorSelector, *FilteredSelector:
+		return 1
+	case *NumberLiteral, *StringLiteral:
+		return 0
+	case *MatrixSelector:
+		return countShardableSelectors(e.VectorSelector)
+	case *StepInvariantExpr:
+		return countShardableSelectors(e.Expr)
+	case *Parens:
+		return countShardableSelectors(e.Expr)
+	case *Unary:
+		return countShardableSelectors(e.Expr)
+	case *Binary:
+		lhs, rhs := countShardableSelectors(e.LHS), countShardableSelectors(e.RHS)
+		if lhs < 0 || rhs < 0 || lhs+rhs > 1 {
+			return -1
+		}
+		return lhs + rhs
+	case *FunctionCall:
+		if _, ok := unshardableFunctions[e.Func.Name]; ok {
+			return -1
+		}
+		var count int
+		for _, arg := range e.Args {
+			c := countShardableSelectors(arg)
+			if c < 0 {
+				return -1
+			}
+			count += c
+		}
+		if count > 1 {
+			return -1
+		}
+		return count
+	default:
+		return -1
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+
+	"github.com/thanos-community/promql-engine/internal/prometheus/parser"
+)
+
+func TestVerticalShardingOptimizer(t *testing.T) {
+	cases := []struct {
+		name     string
+		expr     string
+		expected string
+	}{
+		{
+			name:     "aggregation of range function",
+			expr:     `sum by (pod) (rate(http_requests_total[5m]))`,
+			expected: `sum by (pod) (coalesce(shard(0 of 2, sum by (pod) (rate(http_requests_total[5m]))), shard(1 of 2, sum by (pod) (rate(http_requests_total[5m])))))`,
+		},
+		{
+			name:     "count is merged by sum",
+			expr:     `count without (pod) (http_requests_total * 2)`,
+			expected: `sum without (pod) (coalesce(shard(0 of 2, count without (pod) (http_requests_total * 2)), shard(1 of 2, count without (pod) (http_requests_total * 2))))`,
+		},
+		{
+			name:     "operands of binary expressions are sharded separately",
+			expr:     `max(a) - min(b)`,
+			expected: `max(coalesce(shard(0 of 2, max(a)), shard(1 of 2, max(a)))) - min(coalesce(shard(0 of 2, min(b)), shard(1 of 2, min(b))))`,
+		},
+		{
+			name:     "join is not sharded",
+			expr:     `sum(a / b)`,
+			expected: `sum(a / b)`,
+		},
+		{
+			name:     "aggregation which cannot be merged is not sharded",
+			expr:     `avg(a)`,
+			expected: `avg(a)`,
+		},
+		{
+			name:     "aggregation with parameter is not sharded",
+			expr:     `topk(1, a)`,
+			expected: `topk(1, a)`,
+		},
+		{
+			name:     "function depending on other series is not sharded",
+			expr:     `sum(label_replace(a, "dst", "$1", "src", "(.*)"))`,
+			expected: `sum(label_replace(a, "dst", "$1", "src", "(.*)"))`,
+		},
+		{
+			name:     "inner aggregation is sharded",
+			expr:     `sum(max by (pod) (a))`,
+			expected: `sum(max by (pod) (coalesce(shard(0 of 2, max by (pod) (a)), shard(1 of 2, max by (pod) (a)))))`,
+		},
+	}
+	optimizers := []Optimizer{VerticalShardingOptimizer{Shards: 2}}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			plan := New(expr, &Opts{Start: time.Unix(0, 0), End: time.Unix(0, 0)}).Optimize(optimizers)
+			testutil.Equals(t, tcase.expected, plan.Root().String())
+		})
+	}
+}
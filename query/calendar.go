@@ -0,0 +1,126 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+)
+
+// CalendarUnit is the unit of a calendar-aware step.
+type CalendarUnit int
+
+const (
+	// CalendarDay steps are aligned to midnight.
+	CalendarDay CalendarUnit = iota
+	// CalendarWeek steps are aligned to midnight on Mondays.
+	CalendarWeek
+	// CalendarMonth steps are aligned to midnight on the first day of the month.
+	CalendarMonth
+)
+
+// CalendarStep is an interval between evaluation timestamps which follows the calendar
+// of a time zone, so that days affected by daylight saving time changes and months with
+// different numbers of days are stepped over correctly.
+type CalendarStep struct {
+	Count int
+	Unit  CalendarUnit
+}
+
+// ParseCalendarStep parses a calendar step such as "1d", "2w" or "3M".
+func ParseCalendarStep(s string) (CalendarStep, error) {
+	if len(s) < 2 {
+		return CalendarStep{}, errors.Newf("invalid calendar step %q", s)
+	}
+
+	var step CalendarStep
+	switch s[len(s)-1] {
+	case 'd':
+		step.Unit = CalendarDay
+	case 'w':
+		step.Unit = CalendarWeek
+	case 'M':
+		step.Unit = CalendarMonth
+	default:
+		return CalendarStep{}, errors.Newf("invalid calendar step %q: unit must be one of d, w or M", s)
+	}
+
+	count, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil || count <= 0 {
+		return CalendarStep{}, errors.Newf("invalid calendar step %q: count must be a positive integer", s)
+	}
+	step.Count = count
+	return step, nil
+}
+
+func (s CalendarStep) String() string {
+	switch s.Unit {
+	case CalendarWeek:
+		return fmt.Sprintf("%dw", s.Count)
+	case CalendarMonth:
+		return fmt.Sprintf("%dM", s.Count)
+	default:
+		return fmt.Sprintf("%dd", s.Count)
+	}
+}
+
+// align returns the first calendar boundary of the step's unit at or after t.
+func (s CalendarStep) align(t time.Time) time.Time {
+	var aligned time.Time
+	switch s.Unit {
+	case CalendarWeek:
+		// Weekdays start at Sunday, while weeks are aligned to Mondays.
+		offset := (int(t.Weekday()) + 6) % 7
+		aligned = time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, t.Location())
+	case CalendarMonth:
+		aligned = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	default:
+		aligned = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	}
+	if !aligned.Before(t) {
+		return aligned
+	}
+	unit := CalendarStep{Count: 1, Unit: s.Unit}
+	return unit.advance(aligned, 1)
+}
+
+// advance returns the timestamp n steps after t.
+func (s CalendarStep) advance(t time.Time, n int) time.Time {
+	switch s.Unit {
+	case CalendarWeek:
+		return t.AddDate(0, 0, 7*n*s.Count)
+	case CalendarMonth:
+		return t.AddDate(0, n*s.Count, 0)
+	default:
+		return t.AddDate(0, 0, n*s.Count)
+	}
+}
+
+// CalendarTimestamps returns the evaluation timestamps between start and end, inclusive,
+// which are spaced by the given calendar step in the given location. The first timestamp is
+// the first boundary of the step's unit at or after start.
+func CalendarTimestamps(start, end time.Time, step CalendarStep, loc *time.Location) ([]time.Time, error) {
+	if step.Count <= 0 {
+		return nil, errors.Newf("invalid calendar step %s: count must be positive", step)
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	first := step.align(start.In(loc))
+	var timestamps []time.Time
+	// Each timestamp is computed from the first one so that wall clock times
+	// normalized around daylight saving time changes do not drift.
+	for i := 0; ; i++ {
+		ts := step.advance(first, i)
+		if ts.After(end) {
+			break
+		}
+		timestamps = append(timestamps, ts)
+	}
+	return timestamps, nil
+}
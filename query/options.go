@@ -4,9 +4,59 @@
 package query
 
 import (
+	"sort"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DedupPolicy determines which value is kept when engines with overlapping time ranges
+// return different values for the same series and step.
+type DedupPolicy int
+
+const (
+	// DedupPreferNewest keeps the value from the engine with the highest MaxT.
+	DedupPreferNewest DedupPolicy = iota
+	// DedupPreferLargest keeps the largest of the returned values.
+	DedupPreferLargest
+	// DedupAverage keeps the average of the returned values.
+	DedupAverage
+	// DedupPenalty keeps the values of one replica of a series for as long as it has samples, and only
+	// switches to another replica when the selected one has a gap. A replica which had a gap is penalized
+	// and not selected again for twice the length of the gap, unless no other replica has a sample.
+	DedupPenalty
 )
 
+// RetryPolicy determines how the queries of remote executions are retried and hedged.
+type RetryPolicy struct {
+	// MaxAttempts is the largest number of times a failed remote query is executed.
+	// Only queries which fail with transient errors, as reported by api.IsTransient, are retried.
+	// Values below 2 disable retries.
+	MaxAttempts int
+	// MinBackoff is the delay before the first retry. The delay doubles with each retry.
+	MinBackoff time.Duration
+	// MaxBackoff is the longest delay between retries. Zero leaves the delay unbounded.
+	MaxBackoff time.Duration
+	// HedgeDelay is the time after which a remote query which has not completed is sent again,
+	// and the result of whichever attempt completes first is used. Zero disables hedging.
+	HedgeDelay time.Duration
+}
+
+// Backoff returns the delay before the given retry, starting with 1 for the first retry.
+func (p RetryPolicy) Backoff(retry int) time.Duration {
+	backoff := p.MinBackoff
+	for i := 1; i < retry; i++ {
+		if p.MaxBackoff > 0 && backoff >= p.MaxBackoff {
+			break
+		}
+		backoff *= 2
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	return backoff
+}
+
 type Options struct {
 	Start            time.Time
 	End              time.Time
@@ -15,23 +65,172 @@ type Options struct {
 	ExtLookbackDelta time.Duration
 
 	StepsBatch int64
+
+	// Timestamps are explicit evaluation timestamps in milliseconds, sorted in ascending order.
+	// When set, the query is evaluated at these timestamps instead of at every Step between
+	// Start and End, which have to be equal to the first and the last timestamp.
+	Timestamps []int64
+
+	// RegexResolutionLimit is the maximum number of label values a regex matcher
+	// can be resolved into before selecting series. Zero disables resolution.
+	RegexResolutionLimit int
+
+	// EnableInfoAnnotations enables informational annotations about the query.
+	EnableInfoAnnotations bool
+
+	// EnableStreamingSeries makes selectors read series from storage in batches, open the iterator
+	// of each series when it is first scanned, and release it once the series has no samples left.
+	EnableStreamingSeries bool
+
+	// DedupPolicy resolves conflicting values when deduplicating samples from remote engines.
+	DedupPolicy DedupPolicy
+
+	// DedupConflictTolerance is the largest absolute difference between values from remote
+	// engines which is not annotated as a conflict. Zero disables conflict annotations.
+	DedupConflictTolerance float64
+
+	// DedupReplicaLabels are labels which identify replicas of a series. Series which only differ in
+	// these labels are deduplicated, and the labels are removed from the deduplicated series.
+	DedupReplicaLabels []string
+
+	// RetryPolicy determines how the queries of remote executions are retried and hedged.
+	RetryPolicy RetryPolicy
+
+	// RemoteTimeout is the time after which a remote execution is abandoned, and the query proceeds
+	// without its results. It includes all attempts of the remote query. Zero disables the timeout.
+	RemoteTimeout time.Duration
+
+	// MaxPointsPerWindow is the largest number of points a range selector
+	// can select for a single series at a single step. Zero disables the limit.
+	MaxPointsPerWindow int
+
+	// TruncateWindows keeps only the most recent points of ranges exceeding
+	// MaxPointsPerWindow, instead of failing the query.
+	TruncateWindows bool
+
+	// JoinMemoryLimit is the number of bytes the index of a binary operation between
+	// two vectors can use before it is spilled to SpillDirectory. Zero disables spilling.
+	JoinMemoryLimit int64
+
+	// SpillDirectory is the directory for temporary files of spilled operators.
+	// The default directory for temporary files is used when it is empty.
+	SpillDirectory string
+
+	// TrackOperatorState makes operators track their progress
+	// so that snapshots can be taken while the query is executed.
+	TrackOperatorState bool
+
+	// AuditLabels makes operators count the label copies and sorts they perform,
+	// so that they are included in the analysis of the query.
+	AuditLabels bool
+
+	// EnableStreamingAggregation aggregates the shards of vector selectors as their
+	// batches arrive, and only combines the partial aggregates of the shards.
+	EnableStreamingAggregation bool
+
+	// EnableParallelAggregation aggregates the shards of vector selectors and of functions
+	// over matrix selectors concurrently, and only combines the partial aggregates of the shards.
+	EnableParallelAggregation bool
+
+	// EnableDelayedNameRemoval makes functions mark series for removing the metric name
+	// once the query is evaluated, instead of removing it from their output.
+	EnableDelayedNameRemoval bool
+
+	// TraceOperators makes operators record a span for loading their
+	// series and for each batch of steps they produce.
+	TraceOperators bool
+
+	// BatchDurations records the wall time spent by operators on producing
+	// each batch of steps, partitioned by the operator type.
+	BatchDurations *prometheus.HistogramVec
 }
 
 func (o *Options) NumSteps() int {
+	totalSteps := o.TotalSteps()
+	if o.StepsBatch < totalSteps {
+		return int(o.StepsBatch)
+	}
+	return int(totalSteps)
+}
+
+// TotalSteps returns the number of steps at which the query is evaluated.
+func (o *Options) TotalSteps() int64 {
+	if len(o.Timestamps) > 0 {
+		return int64(len(o.Timestamps))
+	}
 	// Instant evaluation is executed as a range evaluation with one step.
 	if o.Step.Milliseconds() == 0 {
 		return 1
 	}
+	return (o.End.UnixMilli()-o.Start.UnixMilli())/o.Step.Milliseconds() + 1
+}
 
-	totalSteps := (o.End.UnixMilli()-o.Start.UnixMilli())/o.Step.Milliseconds() + 1
-	if o.StepsBatch < totalSteps {
-		return int(o.StepsBatch)
-	}
-	return int(totalSteps)
+// Steps returns the evaluation timestamps of the query.
+func (o *Options) Steps() Steps {
+	return Steps{step: o.Step.Milliseconds(), timestamps: o.Timestamps}
 }
 
 func (o *Options) WithEndTime(end time.Time) *Options {
 	result := *o
 	result.End = end
+	if len(o.Timestamps) > 0 {
+		n := sort.Search(len(o.Timestamps), func(i int) bool { return o.Timestamps[i] > end.UnixMilli() })
+		result.Timestamps = o.Timestamps[:n]
+	}
+	return &result
+}
+
+// WithTimeRange returns the options for evaluating the query at the steps between start and end.
+// Explicit evaluation timestamps are not supported.
+func (o *Options) WithTimeRange(start, end time.Time) *Options {
+	result := *o
+	result.Start = start
+	result.End = end
 	return &result
 }
+
+// Steps iterates over the evaluation timestamps of a query, which are
+// either spaced by a fixed step or given as an explicit list.
+type Steps struct {
+	step       int64
+	timestamps []int64
+}
+
+// Next returns the timestamp of the step following the step at t.
+// If t is the last step, the returned timestamp is after the end of the query.
+func (s Steps) Next(t int64) int64 {
+	return s.Advance(t, 1)
+}
+
+// MaxInterval returns the largest interval between two consecutive steps.
+func (s Steps) MaxInterval() int64 {
+	if len(s.timestamps) == 0 {
+		return s.step
+	}
+	var interval int64
+	for i := 1; i < len(s.timestamps); i++ {
+		if d := s.timestamps[i] - s.timestamps[i-1]; d > interval {
+			interval = d
+		}
+	}
+	return interval
+}
+
+// Advance returns the timestamp of the n-th step following the step at t.
+// If there are fewer than n steps left, the returned timestamp is after the end of the query.
+func (s Steps) Advance(t int64, n int) int64 {
+	if len(s.timestamps) == 0 {
+		// Instant queries have a zero step, so they advance by one
+		// millisecond in order for operators to terminate.
+		if s.step == 0 {
+			return t + 1
+		}
+		return t + s.step*int64(n)
+	}
+
+	i := sort.Search(len(s.timestamps), func(i int) bool { return s.timestamps[i] >= t }) + n
+	if i >= len(s.timestamps) {
+		return s.timestamps[len(s.timestamps)-1] + 1
+	}
+	return s.timestamps[i]
+}